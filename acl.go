@@ -0,0 +1,173 @@
+// This file implements the access control lists deciding, per client identity, which
+// topics a client may publish to and which it may subscribe to.
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+)
+
+// Identity matched by the rules for clients that are not authenticated
+const anonymousIdentity = "anonymous"
+
+// ACLRule allows the identities matching Identity to publish and subscribe to the
+// topics matching the Publish and Subscribe patterns. Patterns are globs where *
+// matches any sequence of characters and ? matches a single character.
+type ACLRule struct {
+	Identity  string   `json:"identity"`
+	Publish   []string `json:"publish"`
+	Subscribe []string `json:"subscribe"`
+}
+
+type ACL struct {
+	Rules []ACLRule `json:"rules"`
+}
+
+// Function to load an ACL from a JSON file, e.g.
+// {"rules": [{"identity": "*", "subscribe": ["public.*"]}, {"identity": "backend", "publish": ["*"]}]}
+// Parameters:
+// path: string - The path of the JSON file.
+// Returns:
+// *ACL - The ACL.
+// error - An error if the file could not be read or parsed.
+func LoadACL(path string) (*ACL, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	a := &ACL{}
+	if err := json.Unmarshal(data, a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Function to decide whether a client may perform an action on a topic. Everything
+// not allowed by a rule is denied.
+// Parameters:
+// client: *Client - The client.
+// action: string - PUBLISH or SUBSCRIBE.
+// topic: string - The topic.
+// Returns:
+// bool - True if a rule matching the client's identity allows the action on the topic.
+func (a *ACL) Allowed(client *Client, action string, topic string) bool {
+	identity := client.identity()
+	for _, rule := range a.Rules {
+		if !globMatch(rule.Identity, identity) {
+			continue
+		}
+		patterns := rule.Subscribe
+		if action == PUBLISH {
+			patterns = rule.Publish
+		}
+		for _, pattern := range patterns {
+			if globMatch(pattern, topic) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Function to get the identity ACL rules match a client against.
+// Returns:
+// string - The principal of the client, or anonymous.
+func (client *Client) identity() string {
+	if principal := client.Principal(); principal != "" {
+		return principal
+	}
+	return anonymousIdentity
+}
+
+// Function to check whether the ACL, if any, allows a client to perform an action on a topic.
+// Parameters:
+// client: *Client - The client.
+// action: string - PUBLISH or SUBSCRIBE.
+// topic: string - The topic.
+// Returns:
+// bool - True if no ACL is configured or the ACL allows the action.
+func (ps *PubSub) aclAllows(client *Client, action string, topic string) bool {
+	current := ps.currentACL()
+	return current == nil || current.Allowed(client, action, topic)
+}
+
+// Function to get the ACL of the server.
+// Returns:
+// *ACL - The ACL, or nil if every topic is allowed.
+func (ps *PubSub) currentACL() *ACL {
+	options := ps.options()
+	options.aclMu.RLock()
+	defer options.aclMu.RUnlock()
+	return options.acl
+}
+
+// Function to replace the ACL and re-authorize the subscribers of the topics whose
+// policy asks to be re-authorized on changes.
+// Parameters:
+// a: *ACL - The new ACL, or nil to allow everything.
+func (ps *PubSub) SetACL(a *ACL) {
+	options := ps.options()
+	options.aclMu.Lock()
+	options.acl = a
+	options.aclMu.Unlock()
+	ps.reauthorizeChanged()
+}
+
+// Function to register the admin API reading and replacing the ACL.
+// Parameters:
+// mux: *http.ServeMux - The mux to register the routes on.
+// pubsub: *PubSub - The PubSub the routes serve.
+func setupACLRoutes(mux *http.ServeMux, pubsub *PubSub) {
+	mux.HandleFunc("GET /admin/acl", pubsub.requireAPIKey(PermissionAdmin, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, pubsub.currentACL())
+	}))
+
+	mux.HandleFunc("PUT /admin/acl", pubsub.requireAPIKey(PermissionAdmin, func(w http.ResponseWriter, r *http.Request) {
+		a := &ACL{}
+		if err := json.NewDecoder(r.Body).Decode(a); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pubsub.SetACL(a)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	mux.HandleFunc("DELETE /admin/acl", pubsub.requireAPIKey(PermissionAdmin, func(w http.ResponseWriter, r *http.Request) {
+		pubsub.SetACL(nil)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
+
+// Function to match a string against a glob pattern where * matches any sequence of
+// characters, including none, and ? matches exactly one character.
+// Parameters:
+// pattern: string - The pattern.
+// s: string - The string.
+// Returns:
+// bool - True if the string matches the pattern.
+func globMatch(pattern string, s string) bool {
+	p, str := []rune(pattern), []rune(s)
+	// Position of the last * and of the string when it was reached, to backtrack to
+	star, match := -1, 0
+	i, j := 0, 0
+	for j < len(str) {
+		switch {
+		case i < len(p) && (p[i] == '?' || p[i] == str[j]):
+			i++
+			j++
+		case i < len(p) && p[i] == '*':
+			star, match = i, j
+			i++
+		case star >= 0:
+			match++
+			i, j = star+1, match
+		default:
+			return false
+		}
+	}
+	for i < len(p) && p[i] == '*' {
+		i++
+	}
+	return i == len(p)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGlobMatch(t *testing.T) {
+	assert.True(t, globMatch("*", ""))
+	assert.True(t, globMatch("*", "anything/at/all"))
+	assert.True(t, globMatch("chat.*", "chat.room1"))
+	assert.True(t, globMatch("chat.*.messages", "chat.room1.messages"))
+	assert.True(t, globMatch("sensor-??", "sensor-42"))
+	assert.True(t, globMatch("a*b*c", "axxbyyc"))
+	assert.False(t, globMatch("chat.*", "news.today"))
+	assert.False(t, globMatch("sensor-??", "sensor-421"))
+	assert.False(t, globMatch("a*b*c", "axxbyy"))
+	assert.False(t, globMatch("", "x"))
+}
+
+func TestACLAllowed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acl.json")
+	os.WriteFile(path, []byte(`{"rules":[
+		{"identity":"*","subscribe":["public.*"]},
+		{"identity":"backend","publish":["*"]},
+		{"identity":"user-*","subscribe":["users.*"],"publish":["chat.*"]}
+	]}`), 0o644)
+	a, err := LoadACL(path)
+	assert.NoError(t, err)
+
+	anonymous := &Client{}
+	backend := &Client{Claims: jwt.MapClaims{"sub": "backend"}}
+	user := &Client{Claims: jwt.MapClaims{"sub": "user-7"}}
+
+	assert.True(t, a.Allowed(anonymous, SUBSCRIBE, "public.news"))
+	assert.False(t, a.Allowed(anonymous, PUBLISH, "public.news"))
+	assert.True(t, a.Allowed(backend, PUBLISH, "users.7"))
+	assert.False(t, a.Allowed(backend, SUBSCRIBE, "users.7"))
+	assert.True(t, a.Allowed(user, SUBSCRIBE, "users.7"))
+	assert.True(t, a.Allowed(user, PUBLISH, "chat.lobby"))
+	assert.False(t, a.Allowed(user, PUBLISH, "public.news"))
+}
+
+func TestHandleRecvdMessageConsultsACL(t *testing.T) {
+	ps := &PubSub{}
+	ps.options().acl = &ACL{Rules: []ACLRule{{Identity: "*", Subscribe: []string{"public.*"}}}}
+	client, peer := newTestClient(t)
+
+	ps.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"public.news"}`))
+	ps.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"private.news"}`))
+	assert.Len(t, ps.Subscriptions(), 1)
+
+	var reply map[string]string
+	assert.NoError(t, peer.ReadJSON(&reply))
+	assert.Equal(t, "forbidden", reply["code"])
+	assert.Equal(t, "subscribe", reply["request"])
+	assert.Equal(t, "private.news", reply["topic"])
+
+	ps.HandleRecvdMessage(client, 1, []byte(`{"action":"publish","topic":"public.news","message":{}}`))
+	assert.NoError(t, peer.ReadJSON(&reply))
+	assert.Equal(t, "forbidden", reply["code"])
+	assert.Equal(t, "publish", reply["request"])
+}
@@ -0,0 +1,328 @@
+// This file lets operators inspect what is connected without attaching a debugger: the
+// admin API lists the clients, the topics and the subscribers of a topic, built from a
+// snapshot of the PubSub state. It also lets them kick clients and remove subscriptions.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Frame telling a client an administrator removed one of its subscriptions
+const UNSUBSCRIBED = "unsubscribed"
+
+var errUnknownClient = errors.New("unknown client")
+var errUnknownSubscription = errors.New("unknown subscription")
+
+// ClientInfo describes a connected client.
+type ClientInfo struct {
+	Id            string   `json:"id"`
+	Principal     string   `json:"principal,omitempty"`
+	Tenant        string   `json:"tenant,omitempty"`
+	Transport     string   `json:"transport"`
+	Subscriptions []string `json:"subscriptions"`
+	// Display name and attributes the client gave
+	Name       string            `json:"name,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	// Messages waiting in the outbound queue and dropped from it
+	Queued  int    `json:"queued"`
+	Dropped uint64 `json:"dropped"`
+	// Address of the client and when its connection was opened and last active
+	RemoteAddr  string     `json:"remoteAddr,omitempty"`
+	ConnectedAt *time.Time `json:"connectedAt,omitempty"`
+	LastActive  *time.Time `json:"lastActive,omitempty"`
+}
+
+// TopicInfo describes a topic and its subscribers.
+type TopicInfo struct {
+	Name        string      `json:"name"`
+	Owner       string      `json:"owner,omitempty"`
+	CreatedAt   *time.Time  `json:"createdAt,omitempty"`
+	Policy      TopicPolicy `json:"policy"`
+	Grants      []string    `json:"grants"`
+	Subscribers int         `json:"subscribers"`
+	Waiting     int         `json:"waiting"`
+	// When the topic was last published to, subscribed to or left
+	LastActivity *time.Time `json:"lastActivity,omitempty"`
+	// Messages and bytes published to the topic, and when it was last published to
+	Messages      uint64     `json:"messages"`
+	Bytes         uint64     `json:"bytes"`
+	LastPublishAt *time.Time `json:"lastPublishAt,omitempty"`
+}
+
+// SubscriberInfo describes a subscription to a topic.
+type SubscriberInfo struct {
+	ClientId  string `json:"clientId"`
+	Principal string `json:"principal,omitempty"`
+	Envelope  bool   `json:"envelope"`
+	Stats     bool   `json:"stats"`
+	// When the subscription expires unless refreshed
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// Display name and attributes the client gave
+	Name       string            `json:"name,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// Function to name the transport a client is connected over.
+// Returns:
+// string - websocket, mqtt, webhook, or internal for the server's own clients such as the prober.
+func (client *Client) transportName() string {
+	switch client.Transport.(type) {
+	case nil:
+		return "websocket"
+	case *mqttSession:
+		return "mqtt"
+	case *webhookTransport:
+		return "webhook"
+	default:
+		return "internal"
+	}
+}
+
+// Function to list the clients, including the clients of other transports that are
+// only known by their subscriptions.
+// Returns:
+// []ClientInfo - The clients, sorted by ID.
+func (ps *PubSub) ClientInfos() []ClientInfo {
+	infos := map[string]*ClientInfo{}
+	add := func(client *Client) *ClientInfo {
+		info, ok := infos[client.Id]
+		if !ok {
+			info = &ClientInfo{
+				Id:            client.Id,
+				Principal:     client.Principal(),
+				Tenant:        client.Tenant(),
+				Transport:     client.transportName(),
+				Subscriptions: []string{},
+				Name:          client.Metadata.Name(),
+				Attributes:    client.Metadata.Attributes(),
+			}
+			if client.Outbox != nil {
+				info.Dropped = client.Outbox.Dropped()
+			}
+			if session := client.Session; session != nil {
+				connectedAt, lastActive := session.ConnectedAt, session.LastActive()
+				info.RemoteAddr = session.RemoteAddr
+				info.ConnectedAt = &connectedAt
+				info.LastActive = &lastActive
+			}
+			infos[client.Id] = info
+		}
+		return info
+	}
+	outboxes := map[string]*Outbox{}
+	clients := ps.Clients()
+	for i := range clients {
+		add(&clients[i])
+		outboxes[clients[i].Id] = clients[i].Outbox
+	}
+	for _, sub := range ps.Subscriptions() {
+		info := add(sub.Client)
+		info.Subscriptions = append(info.Subscriptions, sub.Topic)
+	}
+
+	list := make([]ClientInfo, 0, len(infos))
+	for id, info := range infos {
+		if outbox := outboxes[id]; outbox != nil {
+			info.Queued = outbox.Len()
+		}
+		sort.Strings(info.Subscriptions)
+		list = append(list, *info)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+	return list
+}
+
+// Function to list the topics, including topics that only have subscribers of other
+// transports.
+// Returns:
+// []TopicInfo - The topics, sorted by name.
+func (ps *PubSub) TopicInfos() []TopicInfo {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	infos := map[string]*TopicInfo{}
+	for name, topic := range ps.Topics {
+		createdAt := topic.CreatedAt
+		info := &TopicInfo{
+			Name:      name,
+			Owner:     topic.Owner,
+			CreatedAt: &createdAt,
+			Policy:    topic.Policy,
+			Grants:    []string{},
+			Waiting:   len(topic.waitlist),
+		}
+		for principal := range topic.Grants {
+			info.Grants = append(info.Grants, principal)
+		}
+		sort.Strings(info.Grants)
+		infos[name] = info
+	}
+	for _, sub := range ps.Subscriptions() {
+		info, ok := infos[sub.Topic]
+		if !ok {
+			info = &TopicInfo{Name: sub.Topic, Grants: []string{}}
+			infos[sub.Topic] = info
+		}
+		info.Subscribers++
+	}
+
+	list := make([]TopicInfo, 0, len(infos))
+	for name, info := range infos {
+		if last, ok := ps.lastActivity(name); ok {
+			info.LastActivity = &last
+		}
+		if counters, ok := ps.topicCountersOf(name); ok {
+			info.Messages, info.Bytes, info.LastPublishAt = counters.messages, counters.bytes, &counters.lastPublishAt
+		}
+		list = append(list, *info)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Function to list the subscribers of a topic.
+// Parameters:
+// topic: string - The topic.
+// Returns:
+// []SubscriberInfo - The subscribers, in subscription order.
+// error - errUnknownTopic if the topic neither exists nor has subscribers.
+func (ps *PubSub) SubscriberInfos(topic string) ([]SubscriberInfo, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	subscribers := []SubscriberInfo{}
+	for _, sub := range ps.GetSubscriptions(topic, nil) {
+		info := SubscriberInfo{
+			ClientId:   sub.Client.Id,
+			Principal:  sub.Client.Principal(),
+			Envelope:   sub.Envelope,
+			Stats:      sub.Stats != nil,
+			Name:       sub.Client.Metadata.Name(),
+			Attributes: sub.Client.Metadata.Attributes(),
+		}
+		if expiresAt := sub.ExpiresAt; !expiresAt.IsZero() {
+			info.ExpiresAt = &expiresAt
+		}
+		subscribers = append(subscribers, info)
+	}
+	if _, ok := ps.Topics[topic]; !ok && len(subscribers) == 0 {
+		return nil, errUnknownTopic
+	}
+	return subscribers, nil
+}
+
+// Function to disconnect a WebSocket client with a close frame.
+// Parameters:
+// id: string - The ID of the client.
+// reason: DisconnectReason - Why the client is disconnected.
+// Returns:
+// error - errUnknownClient if no WebSocket client has the ID.
+func (ps *PubSub) Kick(id string, reason DisconnectReason) error {
+	var client *Client
+	for _, connected := range ps.clientsWithID(id) {
+		if connected.Closable() {
+			client = &connected
+			break
+		}
+	}
+	if client == nil {
+		return errUnknownClient
+	}
+
+	client.logger().Info("Kicking client", "reason", reason)
+	disconnectClient(context.Background(), *client, reason, false)
+	return nil
+}
+
+// Function to remove a client from a topic on behalf of an administrator. The client
+// is told with an unsubscribed frame when it is connected over a WebSocket.
+// Parameters:
+// id: string - The ID of the client.
+// topic: string - The topic.
+// Returns:
+// error - errUnknownSubscription if the client is not subscribed to the topic.
+func (ps *PubSub) ForceUnsubscribe(id string, topic string) error {
+	subscriber := ps.unsubscribe(&Client{Id: id}, topic)
+	if subscriber == nil {
+		return errUnknownSubscription
+	}
+	subscriber.logger().Info("Unsubscribed client", logKeyTopic, topic)
+	// Clients of other transports have no frame to receive it in
+	if subscriber.Transport == nil {
+		subscriber.Send(unsubscribedMessage(topic, "admin"))
+	}
+	return nil
+}
+
+// Function to build the frame telling a client the server removed its subscription.
+// Parameters:
+// topic: string - The topic.
+// reason: string - Why, e.g. admin when an administrator removed it.
+// Returns:
+// []byte - The JSON encoded frame.
+func unsubscribedMessage(topic string, reason string) []byte {
+	message, _ := json.Marshal(map[string]string{
+		"action": UNSUBSCRIBED,
+		"topic":  topic,
+		"reason": reason,
+	})
+	return message
+}
+
+// Function to register the admin API to inspect the clients, topics and subscriptions,
+// kick clients and remove subscriptions.
+// Parameters:
+// mux: *http.ServeMux - The mux to register the routes on.
+// pubsub: *PubSub - The PubSub the routes serve.
+func setupAdminRoutes(mux *http.ServeMux, pubsub *PubSub) {
+	mux.HandleFunc("GET /admin/clients", pubsub.requireAPIKey(PermissionAdmin, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, pubsub.ClientInfos())
+	}))
+
+	mux.HandleFunc("GET /admin/topics", pubsub.requireAPIKey(PermissionAdmin, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, pubsub.TopicInfos())
+	}))
+
+	mux.HandleFunc("GET /admin/topics/{topic}/subscribers", pubsub.requireAPIKey(PermissionAdmin, func(w http.ResponseWriter, r *http.Request) {
+		subscribers, err := pubsub.SubscriberInfos(r.PathValue("topic"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, http.StatusOK, subscribers)
+	}))
+
+	mux.HandleFunc("DELETE /admin/clients/{id}", pubsub.requireAPIKey(PermissionAdmin, func(w http.ResponseWriter, r *http.Request) {
+		reason := DisconnectReason(r.URL.Query().Get("reason"))
+		if reason == "" {
+			reason = ReasonKicked
+		}
+		if _, ok := closeCodes[reason]; !ok {
+			http.Error(w, "unknown disconnect reason", http.StatusBadRequest)
+			return
+		}
+		if err := pubsub.Kick(r.PathValue("id"), reason); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	mux.HandleFunc("DELETE /admin/subscriptions", pubsub.requireAPIKey(PermissionAdmin, func(w http.ResponseWriter, r *http.Request) {
+		id, topic := r.URL.Query().Get("client"), r.URL.Query().Get("topic")
+		if id == "" || topic == "" {
+			http.Error(w, "client and topic are required", http.StatusBadRequest)
+			return
+		}
+		if err := pubsub.ForceUnsubscribe(id, topic); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
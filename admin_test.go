@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminInspectRoutes(t *testing.T) {
+	keys := NewAPIKeyStore()
+	isolatePubSub(t).apiKeys = keys
+	keys.Add("admin-secret", "ops", []string{PermissionAdmin})
+	keys.Add("reader", "dashboard", []string{PermissionSubscribe})
+	mux := http.NewServeMux()
+	setupAdminRoutes(mux, ps)
+
+	alice := Client{Id: "c1", Claims: jwt.MapClaims{"sub": "alice", tenantClaim: "acme"}}
+	ps.AddClient(alice)
+	ps.HandleRecvdMessage(alice, 1, []byte(`{"action":"subscribe","topic":"news","envelope":true}`))
+	device := &Client{Id: "mqtt-sensor", Transport: &mqttSession{}}
+	ps.Subscribe(device, "sensors")
+
+	get := func(path string, key string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, path, nil)
+		request.Header.Set(apiKeyHeader, key)
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, request)
+		return recorder
+	}
+	assert.Equal(t, http.StatusForbidden, get("/admin/clients", "reader").Code)
+
+	response := get("/admin/clients", "admin-secret")
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.JSONEq(t, `[
+		{"id": "c1", "principal": "alice", "tenant": "acme", "transport": "websocket", "subscriptions": ["news"], "queued": 0, "dropped": 0},
+		{"id": "mqtt-sensor", "transport": "mqtt", "subscriptions": ["sensors"], "queued": 0, "dropped": 0}
+	]`, response.Body.String())
+
+	topics := ps.TopicInfos()
+	assert.Len(t, topics, 2)
+	assert.Equal(t, "news", topics[0].Name)
+	assert.Equal(t, "alice", topics[0].Owner)
+	assert.Equal(t, 1, topics[0].Subscribers)
+	assert.Equal(t, "sensors", topics[1].Name, "Topics with only MQTT subscribers should be listed")
+	assert.Equal(t, http.StatusOK, get("/admin/topics", "admin-secret").Code)
+
+	response = get("/admin/topics/news/subscribers", "admin-secret")
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.JSONEq(t, `[{"clientId": "c1", "principal": "alice", "envelope": true, "stats": false}]`, response.Body.String())
+	assert.Equal(t, http.StatusNotFound, get("/admin/topics/nothing/subscribers", "admin-secret").Code)
+}
+
+func TestAdminKickAndForceUnsubscribe(t *testing.T) {
+	keys := NewAPIKeyStore()
+	isolatePubSub(t).apiKeys = keys
+	keys.Add("admin-secret", "ops", []string{PermissionAdmin})
+	mux := http.NewServeMux()
+	setupAdminRoutes(mux, ps)
+	remove := func(path string) int {
+		request := httptest.NewRequest(http.MethodDelete, path, nil)
+		request.Header.Set(apiKeyHeader, "admin-secret")
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	client, peer := newTestClient(t)
+	ps.AddClient(client)
+	ps.Subscribe(&client, "news")
+	ps.Subscribe(&client, "sports")
+
+	assert.Equal(t, http.StatusBadRequest, remove("/admin/subscriptions?client="+client.Id))
+	assert.Equal(t, http.StatusNotFound, remove("/admin/subscriptions?client="+client.Id+"&topic=weather"))
+	assert.Equal(t, http.StatusNoContent, remove("/admin/subscriptions?client="+client.Id+"&topic=news"))
+	_, message, err := peer.ReadMessage()
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"action":"unsubscribed","topic":"news","reason":"admin"}`, string(message))
+	assert.Empty(t, ps.GetSubscriptions("news", nil))
+	assert.Len(t, ps.GetSubscriptions("sports", nil), 1, "Other subscriptions should be kept")
+
+	assert.Equal(t, http.StatusBadRequest, remove("/admin/clients/"+client.Id+"?reason=because"))
+	assert.Equal(t, http.StatusNotFound, remove("/admin/clients/nobody"))
+	assert.Equal(t, http.StatusNoContent, remove("/admin/clients/"+client.Id+"?reason=policy_violation"))
+	_, _, err = peer.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation))
+}
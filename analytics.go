@@ -0,0 +1,397 @@
+// This file samples the messages of selected topics into an analytics sink feeding
+// product usage dashboards, without mirroring the traffic. A policy file picks the
+// topics, the fraction of their messages sampled and whether the payload is stripped
+// or hashed; every sampled message becomes an event with its topic, size, publishing
+// tenant and the latency from its publish until it was delivered to local subscribers.
+// Events are sent in batches by a background worker and dropped when the sink falls
+// behind, so analytics never slows publishing down.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// AnalyticsPayload decides what an analytics event keeps of the payload of its message.
+type AnalyticsPayload string
+
+const (
+	// Only the size of the payload is kept
+	AnalyticsStrip AnalyticsPayload = "strip"
+	// The SHA-256 hash of the payload is kept, to count distinct messages
+	AnalyticsHash AnalyticsPayload = "hash"
+)
+
+// Defaults of the analytics pipeline
+const (
+	defaultAnalyticsBatchSize     = 500
+	defaultAnalyticsFlushInterval = 5 * time.Second
+	// Events waiting to be sent before new events are dropped
+	analyticsQueueSize = 10000
+	// How long sending a batch may take
+	analyticsSendTimeout = 10 * time.Second
+)
+
+var analyticsEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "gowebsockets_analytics_events_total",
+	Help: "Number of sampled analytics events, by result (sent, dropped or failed).",
+}, []string{"result"})
+
+// AnalyticsRule samples Rate of the messages of the topics matching Topic, a glob
+// where * matches any sequence of characters and ? matches a single character.
+type AnalyticsRule struct {
+	Topic   string           `json:"topic"`
+	Rate    float64          `json:"rate"`
+	Payload AnalyticsPayload `json:"payload"`
+}
+
+// AnalyticsPolicy samples the messages of a topic as the first rule matching it says;
+// the messages of topics no rule matches are not sampled.
+type AnalyticsPolicy struct {
+	Rules []AnalyticsRule `json:"rules"`
+}
+
+// AnalyticsEvent describes a sampled message.
+type AnalyticsEvent struct {
+	Timestamp time.Time `json:"timestamp"`
+	Id        string    `json:"id"`
+	Topic     string    `json:"topic"`
+	Tenant    string    `json:"tenant"`
+	Size      int       `json:"size"`
+	// Milliseconds from the publish until the message was delivered to local subscribers
+	LatencyMs float64 `json:"latencyMs"`
+	// Hex encoded SHA-256 hash of the payload, if the policy of the topic keeps it
+	PayloadHash string `json:"payloadHash,omitempty"`
+}
+
+// AnalyticsSink stores batches of analytics events.
+type AnalyticsSink interface {
+	Send(ctx context.Context, events []AnalyticsEvent) error
+}
+
+// HTTPAnalyticsSink posts every batch as a JSON array of events to a collector.
+type HTTPAnalyticsSink struct {
+	URL    string
+	Client *http.Client
+}
+
+func (s HTTPAnalyticsSink) Send(ctx context.Context, events []AnalyticsEvent) error {
+	body, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+	return postAnalytics(ctx, s.Client, s.URL, "application/json", body)
+}
+
+// ClickHouseSink inserts every batch into a ClickHouse table over its HTTP interface,
+// one JSONEachRow row per event. The table has the columns of AnalyticsEvent, e.g.
+// timestamp DateTime64(3), id String, topic String, tenant String, size UInt32,
+// latencyMs Float64, payloadHash String.
+type ClickHouseSink struct {
+	// URL of the HTTP interface, e.g. http://clickhouse:8123/
+	URL    string
+	Table  string
+	Client *http.Client
+}
+
+func (s ClickHouseSink) Send(ctx context.Context, events []AnalyticsEvent) error {
+	endpoint, err := url.Parse(s.URL)
+	if err != nil {
+		return err
+	}
+	query := endpoint.Query()
+	query.Set("query", fmt.Sprintf("INSERT INTO %s FORMAT JSONEachRow", s.Table))
+	// Timestamps are RFC 3339
+	query.Set("date_time_input_format", "best_effort")
+	endpoint.RawQuery = query.Encode()
+
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, event := range events {
+		if err := encoder.Encode(event); err != nil {
+			return err
+		}
+	}
+	return postAnalytics(ctx, s.Client, endpoint.String(), "application/x-ndjson", body.Bytes())
+}
+
+// Function to post a batch of events.
+// Parameters:
+// ctx: context.Context - Bounds how long the request may take.
+// client: *http.Client - The client making the request, nil for the default client.
+// url: string - Where the batch is posted.
+// contentType: string - The content type of the body.
+// body: []byte - The encoded batch.
+// Returns:
+// error - An error if the request failed or was not answered with a 2xx status.
+func postAnalytics(ctx context.Context, client *http.Client, url string, contentType string, body []byte) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", contentType)
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("analytics sink answered %s", response.Status)
+	}
+	return nil
+}
+
+// Function to load an analytics policy from a JSON file, e.g.
+// {"rules": [{"topic": "chat.*", "rate": 0.05, "payload": "hash"}, {"topic": "orders.*", "rate": 1}]}
+// Parameters:
+// path: string - The path of the JSON file.
+// Returns:
+// *AnalyticsPolicy - The policy.
+// error - An error if the file could not be read or a rule is invalid.
+func LoadAnalyticsPolicy(path string) (*AnalyticsPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	policy := &AnalyticsPolicy{}
+	if err := json.Unmarshal(data, policy); err != nil {
+		return nil, err
+	}
+	if err := policy.validate(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// Function to check the rules of the policy.
+// Returns:
+// error - An error describing the first invalid rule.
+func (p *AnalyticsPolicy) validate() error {
+	for _, rule := range p.Rules {
+		if rule.Topic == "" {
+			return fmt.Errorf("analytics rule without a topic")
+		}
+		if rule.Rate <= 0 || rule.Rate > 1 {
+			return fmt.Errorf("analytics rate %v of %q is not within (0, 1]", rule.Rate, rule.Topic)
+		}
+		switch rule.Payload {
+		case "", AnalyticsStrip, AnalyticsHash:
+		default:
+			return fmt.Errorf("unknown analytics payload policy %q", rule.Payload)
+		}
+	}
+	return nil
+}
+
+// Function to get the rule sampling a topic.
+// Parameters:
+// topic: string - The topic.
+// Returns:
+// AnalyticsRule - The first rule matching the topic.
+// bool - False if no rule matches the topic.
+func (p *AnalyticsPolicy) Rule(topic string) (AnalyticsRule, bool) {
+	for _, rule := range p.Rules {
+		if globMatch(rule.Topic, topic) {
+			return rule, true
+		}
+	}
+	return AnalyticsRule{}, false
+}
+
+// Key of the tenant of a publisher in the context of its publish
+type tenantKey struct{}
+
+// Function to attach the tenant of the publisher of a message to the context of its publish.
+// Parameters:
+// ctx: context.Context - The context of the publish.
+// tenant: string - The tenant, or "" if the publisher has none.
+// Returns:
+// context.Context - The context carrying the tenant.
+func withTenant(ctx context.Context, tenant string) context.Context {
+	if tenant == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// Key of the analytics sample of a message in the context of its publish
+type analyticsSampleKey struct{}
+
+// analyticsSample is a message chosen to become an analytics event once delivered.
+type analyticsSample struct {
+	Rule        AnalyticsRule
+	Tenant      string
+	PublishedAt time.Time
+}
+
+// Function to get the analytics sample of the message published in a context.
+// Parameters:
+// ctx: context.Context - The context of the publish.
+// Returns:
+// *analyticsSample - The sample, or nil if the message was not sampled.
+func analyticsSampleFrom(ctx context.Context) *analyticsSample {
+	sample, _ := ctx.Value(analyticsSampleKey{}).(*analyticsSample)
+	return sample
+}
+
+// Function to carry the analytics sample of a context over to another context.
+// Parameters:
+// ctx: context.Context - The context receiving the sample.
+// sample: *analyticsSample - The sample, or nil.
+// Returns:
+// context.Context - The context carrying the sample.
+func withAnalyticsSample(ctx context.Context, sample *analyticsSample) context.Context {
+	if sample == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, analyticsSampleKey{}, sample)
+}
+
+// Analytics samples published messages and sends them as events to a sink.
+type Analytics struct {
+	Policy *AnalyticsPolicy
+	Sink   AnalyticsSink
+	// Most events sent in one batch
+	BatchSize int
+	// Longest time an event waits before its batch is sent
+	FlushInterval time.Duration
+	events        chan AnalyticsEvent
+	done          chan struct{}
+	stopped       chan struct{}
+}
+
+// Function to create the analytics pipeline.
+// Parameters:
+// policy: *AnalyticsPolicy - Which messages are sampled and what is kept of them.
+// sink: AnalyticsSink - Where the events are sent.
+// Returns:
+// *Analytics - The pipeline; call Start to begin sending events.
+func NewAnalytics(policy *AnalyticsPolicy, sink AnalyticsSink) *Analytics {
+	return &Analytics{
+		Policy:        policy,
+		Sink:          sink,
+		BatchSize:     defaultAnalyticsBatchSize,
+		FlushInterval: defaultAnalyticsFlushInterval,
+		events:        make(chan AnalyticsEvent, analyticsQueueSize),
+		done:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+	}
+}
+
+// Function to decide whether a message being published is sampled.
+// Parameters:
+// ctx: context.Context - The context of the publish.
+// topic: string - The topic.
+// Returns:
+// context.Context - The context, carrying the sample if the message was sampled.
+func (a *Analytics) Sample(ctx context.Context, topic string) context.Context {
+	rule, ok := a.Policy.Rule(topic)
+	if !ok || rand.Float64() >= rule.Rate {
+		return ctx
+	}
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return withAnalyticsSample(ctx, &analyticsSample{Rule: rule, Tenant: tenant, PublishedAt: time.Now()})
+}
+
+// Function to record a sampled message once it was delivered, dropping its event if
+// the queue is full.
+// Parameters:
+// sample: *analyticsSample - The sample of the message.
+// id: string - The ID of the message.
+// topic: string - The topic.
+// message: []byte - The message.
+func (a *Analytics) Record(sample *analyticsSample, id string, topic string, message []byte) {
+	now := time.Now()
+	event := AnalyticsEvent{
+		Timestamp: sample.PublishedAt.UTC(),
+		Id:        id,
+		Topic:     topic,
+		Tenant:    sample.Tenant,
+		Size:      len(message),
+		LatencyMs: float64(now.Sub(sample.PublishedAt).Microseconds()) / 1000,
+	}
+	if sample.Rule.Payload == AnalyticsHash {
+		sum := sha256.Sum256(message)
+		event.PayloadHash = hex.EncodeToString(sum[:])
+	}
+	select {
+	case a.events <- event:
+	default:
+		analyticsEvents.WithLabelValues("dropped").Inc()
+	}
+}
+
+// Function to send the events in batches until stopped.
+func (a *Analytics) Start() {
+	go func() {
+		defer close(a.stopped)
+		ticker := time.NewTicker(a.FlushInterval)
+		defer ticker.Stop()
+		var batch []AnalyticsEvent
+		for {
+			select {
+			case event := <-a.events:
+				if batch = append(batch, event); len(batch) >= a.BatchSize {
+					batch = a.flush(batch)
+				}
+			case <-ticker.C:
+				batch = a.flush(batch)
+			case <-a.done:
+				// The events still queued are sent before stopping
+				for {
+					select {
+					case event := <-a.events:
+						if batch = append(batch, event); len(batch) >= a.BatchSize {
+							batch = a.flush(batch)
+						}
+					default:
+						a.flush(batch)
+						return
+					}
+				}
+			}
+		}
+	}()
+}
+
+// Function to send a batch of events.
+// Parameters:
+// batch: []AnalyticsEvent - The events.
+// Returns:
+// []AnalyticsEvent - nil, to collect the next events in; the sink may keep the batch sent.
+func (a *Analytics) flush(batch []AnalyticsEvent) []AnalyticsEvent {
+	if len(batch) == 0 {
+		return batch
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), analyticsSendTimeout)
+	defer cancel()
+	if err := a.Sink.Send(ctx, batch); err != nil {
+		slog.Error("Error sending analytics events", "count", len(batch), "error", err)
+		analyticsEvents.WithLabelValues("failed").Add(float64(len(batch)))
+	} else {
+		analyticsEvents.WithLabelValues("sent").Add(float64(len(batch)))
+	}
+	return nil
+}
+
+// Function to stop sampling, once the events queued were sent.
+func (a *Analytics) Stop() {
+	close(a.done)
+	<-a.stopped
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingSink keeps the analytics events sent to it.
+type recordingSink struct {
+	mu     sync.Mutex
+	events []AnalyticsEvent
+}
+
+func (s *recordingSink) Send(ctx context.Context, events []AnalyticsEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, events...)
+	return nil
+}
+
+func TestLoadAnalyticsPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "analytics.json")
+	os.WriteFile(path, []byte(`{"rules": [{"topic": "chat.*", "rate": 0.05, "payload": "hash"}, {"topic": "*", "rate": 1}]}`), 0o600)
+	policy, err := LoadAnalyticsPolicy(path)
+	if assert.NoError(t, err) {
+		rule, ok := policy.Rule("chat.lobby")
+		assert.True(t, ok)
+		assert.Equal(t, AnalyticsHash, rule.Payload)
+		rule, _ = policy.Rule("orders")
+		assert.Equal(t, 1.0, rule.Rate, "The first matching rule applies")
+	}
+
+	for _, invalid := range []string{
+		`{"rules": [{"topic": "chat.*", "rate": 0}]}`,
+		`{"rules": [{"topic": "chat.*", "rate": 1.5}]}`,
+		`{"rules": [{"topic": "chat.*", "rate": 1, "payload": "full"}]}`,
+		`{"rules": [{"rate": 1}]}`,
+	} {
+		os.WriteFile(path, []byte(invalid), 0o600)
+		_, err := LoadAnalyticsPolicy(path)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestAnalyticsSamplesSelectedTopics(t *testing.T) {
+	sink := &recordingSink{}
+	pubsub := &PubSub{}
+	pubsub.Analytics = NewAnalytics(&AnalyticsPolicy{Rules: []AnalyticsRule{
+		{Topic: "chat.*", Rate: 1, Payload: AnalyticsHash},
+		{Topic: "orders", Rate: 1},
+	}}, sink)
+	pubsub.Analytics.Start()
+
+	client, _ := newTestClient(t)
+	client.Claims = jwt.MapClaims{"sub": "alice", tenantClaim: "acme"}
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"publish","topic":"chat.lobby","message":"hello"}`))
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"publish","topic":"orders","message":{"id":1}}`))
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"publish","topic":"prices","message":1}`))
+	pubsub.Publish("orders", []byte(`{"id":2}`), nil)
+	pubsub.Analytics.Stop()
+
+	if !assert.Len(t, sink.events, 3, "Topics no rule matches are not sampled") {
+		return
+	}
+	chat := sink.events[0]
+	assert.Equal(t, "chat.lobby", chat.Topic)
+	assert.Equal(t, "acme", chat.Tenant)
+	assert.Equal(t, len(`"hello"`), chat.Size)
+	sum := sha256.Sum256([]byte(`"hello"`))
+	assert.Equal(t, hex.EncodeToString(sum[:]), chat.PayloadHash)
+	assert.GreaterOrEqual(t, chat.LatencyMs, 0.0)
+	assert.NotEmpty(t, chat.Id)
+
+	assert.Empty(t, sink.events[1].PayloadHash, "Payloads are stripped unless the rule hashes them")
+	assert.Equal(t, "acme", sink.events[1].Tenant)
+	assert.Empty(t, sink.events[2].Tenant, "Messages of the server have no tenant")
+}
+
+func TestClickHouseSinkInsertsRows(t *testing.T) {
+	var query string
+	var rows []AnalyticsEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query().Get("query")
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			var row AnalyticsEvent
+			json.Unmarshal(scanner.Bytes(), &row)
+			rows = append(rows, row)
+		}
+	}))
+	defer server.Close()
+
+	sink := ClickHouseSink{URL: server.URL, Table: "analytics.messages"}
+	err := sink.Send(context.Background(), []AnalyticsEvent{{Id: "m1", Topic: "chat", Size: 5}, {Id: "m2", Topic: "chat", Size: 7}})
+	assert.NoError(t, err)
+	assert.Equal(t, "INSERT INTO analytics.messages FORMAT JSONEachRow", query)
+	if assert.Len(t, rows, 2) {
+		assert.Equal(t, "m2", rows[1].Id)
+		assert.Equal(t, 7, rows[1].Size)
+	}
+
+	missing := httptest.NewServer(http.NotFoundHandler())
+	defer missing.Close()
+	failing := HTTPAnalyticsSink{URL: missing.URL}
+	assert.Error(t, failing.Send(context.Background(), []AnalyticsEvent{{Id: "m3"}}), "Batches the sink did not accept fail")
+}
@@ -0,0 +1,314 @@
+// This file implements API key authentication and the admin API used to create and
+// revoke keys at runtime. Each key maps to a client identity and a permission set.
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Permissions a key can grant
+const (
+	PermissionPublish   = "publish"
+	PermissionSubscribe = "subscribe"
+	PermissionAdmin     = "admin"
+)
+
+const (
+	// Header and query parameter carrying an API key
+	apiKeyHeader     = "X-API-Key"
+	apiKeyQueryParam = "api_key"
+
+	// Claims describing the client a key belongs to
+	permissionsClaim = "permissions"
+	apiKeyIdClaim    = "api_key_id"
+)
+
+var errInvalidAPIKey = errors.New("invalid API key")
+
+// APIKey is a key as listed by the admin API; the secret is only shown when created.
+type APIKey struct {
+	Id          string    `json:"id"`
+	Secret      string    `json:"key,omitempty"`
+	Identity    string    `json:"identity"`
+	Permissions []string  `json:"permissions"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+type APIKeyStore struct {
+	// Keys by the SHA-256 hash of their secret, so secrets are never kept in memory
+	keys map[string]APIKey
+	mu   sync.RWMutex
+}
+
+// Function to create an empty key store.
+// Returns:
+// *APIKeyStore - The key store.
+func NewAPIKeyStore() *APIKeyStore {
+	return &APIKeyStore{keys: map[string]APIKey{}}
+}
+
+// Function to load keys from a JSON file holding a list of keys, e.g.
+// [{"key": "...", "identity": "backend", "permissions": ["publish"]}].
+// Parameters:
+// path: string - The path of the JSON file.
+// Returns:
+// error - An error if the file could not be read or parsed.
+func (s *APIKeyStore) LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var keys []APIKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if key.Secret == "" {
+			return errors.New("API key for " + key.Identity + " has no key")
+		}
+		s.Add(key.Secret, key.Identity, key.Permissions)
+	}
+	return nil
+}
+
+// Function to add a key with a known secret.
+// Parameters:
+// secret: string - The key presented by clients.
+// identity: string - The identity of the clients using the key.
+// permissions: []string - The permissions granted by the key.
+// Returns:
+// APIKey - The added key, without its secret.
+func (s *APIKeyStore) Add(secret string, identity string, permissions []string) APIKey {
+	key := APIKey{
+		Id:          autoId(),
+		Identity:    identity,
+		Permissions: permissions,
+		CreatedAt:   time.Now().UTC(),
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[hashAPIKey(secret)] = key
+	return key
+}
+
+// Function to create a key with a random secret.
+// Parameters:
+// identity: string - The identity of the clients using the key.
+// permissions: []string - The permissions granted by the key.
+// Returns:
+// APIKey - The created key, including its secret.
+// error - An error if no random secret could be generated.
+func (s *APIKeyStore) Create(identity string, permissions []string) (APIKey, error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return APIKey{}, err
+	}
+	secret := hex.EncodeToString(random)
+	key := s.Add(secret, identity, permissions)
+	key.Secret = secret
+	return key, nil
+}
+
+// Function to revoke a key.
+// Parameters:
+// id: string - The ID of the key.
+// Returns:
+// bool - False if there is no key with that ID.
+func (s *APIKeyStore) Revoke(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for hash, key := range s.keys {
+		if key.Id == id {
+			delete(s.keys, hash)
+			return true
+		}
+	}
+	return false
+}
+
+// Function to list the keys, without their secrets.
+// Returns:
+// []APIKey - The keys, oldest first.
+func (s *APIKeyStore) List() []APIKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := make([]APIKey, 0, len(s.keys))
+	for _, key := range s.keys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys
+}
+
+// Function to look up the key presented by a request.
+// Parameters:
+// r: *http.Request - The request carrying the key in the X-API-Key header or api_key query parameter.
+// Returns:
+// APIKey - The key.
+// error - An error if the request has no key or the key is unknown.
+func (s *APIKeyStore) Authenticate(r *http.Request) (APIKey, error) {
+	secret := apiKeyFromRequest(r)
+	if secret == "" {
+		return APIKey{}, errMissingToken
+	}
+	hash := hashAPIKey(secret)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for known, key := range s.keys {
+		if subtle.ConstantTimeCompare([]byte(known), []byte(hash)) == 1 {
+			return key, nil
+		}
+	}
+	return APIKey{}, errInvalidAPIKey
+}
+
+// Function to describe the client a key belongs to as claims, so clients
+// authenticated by key or by token are handled alike.
+// Returns:
+// jwt.MapClaims - The subject, permissions and key ID of the key.
+func (key APIKey) Claims() jwt.MapClaims {
+	permissions := make([]interface{}, len(key.Permissions))
+	for i, permission := range key.Permissions {
+		permissions[i] = permission
+	}
+	return jwt.MapClaims{
+		"sub":            key.Identity,
+		permissionsClaim: permissions,
+		apiKeyIdClaim:    key.Id,
+	}
+}
+
+// Function to check whether a key grants a permission.
+// Parameters:
+// permission: string - The permission.
+// Returns:
+// bool - True if the key grants it.
+func (key APIKey) HasPermission(permission string) bool {
+	for _, p := range key.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// Function to wrap a handler so it only serves requests presenting a key with a permission.
+// Parameters:
+// permission: string - The permission required.
+// next: http.HandlerFunc - The handler to protect.
+// Returns:
+// http.HandlerFunc - The protected handler.
+func (ps *PubSub) requireAPIKey(permission string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, err := ps.options().apiKeys.Authenticate(r)
+		if err != nil {
+			writeUnauthorized(w, err)
+			return
+		}
+		if !key.HasPermission(permission) {
+			http.Error(w, "forbidden: key lacks the "+permission+" permission", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Function to register the admin API managing keys.
+// Parameters:
+// mux: *http.ServeMux - The mux to register the routes on.
+// pubsub: *PubSub - The PubSub the routes serve.
+func setupAPIKeyRoutes(mux *http.ServeMux, pubsub *PubSub) {
+	mux.HandleFunc("GET /admin/keys", pubsub.requireAPIKey(PermissionAdmin, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, pubsub.options().apiKeys.List())
+	}))
+
+	mux.HandleFunc("POST /admin/keys", pubsub.requireAPIKey(PermissionAdmin, func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Identity    string   `json:"identity"`
+			Permissions []string `json:"permissions"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Identity == "" {
+			http.Error(w, "expected {\"identity\": ..., \"permissions\": [...]}", http.StatusBadRequest)
+			return
+		}
+		key, err := pubsub.options().apiKeys.Create(request.Identity, request.Permissions)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusCreated, key)
+	}))
+
+	mux.HandleFunc("DELETE /admin/keys/{id}", pubsub.requireAPIKey(PermissionAdmin, func(w http.ResponseWriter, r *http.Request) {
+		if !pubsub.options().apiKeys.Revoke(r.PathValue("id")) {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
+
+// Function to get the API key of a request from the header or the query string.
+// Parameters:
+// r: *http.Request - The request.
+// Returns:
+// string - The key, or an empty string if there is none.
+func apiKeyFromRequest(r *http.Request) string {
+	if key := r.Header.Get(apiKeyHeader); key != "" {
+		return key
+	}
+	return r.URL.Query().Get(apiKeyQueryParam)
+}
+
+// Function to hash a key secret for storage.
+// Parameters:
+// secret: string - The key secret.
+// Returns:
+// string - The hex encoded SHA-256 hash.
+func hashAPIKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Function to write a JSON response.
+// Parameters:
+// w: http.ResponseWriter - The response writer.
+// status: int - The HTTP status code.
+// value: interface{} - The value to encode.
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+// Code of the error frames telling a client it lacks the permission for an action
+const codeForbidden = "forbidden"
+
+// Function to build the frame telling a client it lacks the permission for an action.
+// Parameters:
+// action: string - The action that was refused.
+// topic: string - The topic of the action.
+// Returns:
+// []byte - The JSON encoded frame.
+func forbiddenMessage(action string, topic string) []byte {
+	message, _ := json.Marshal(map[string]string{
+		"action":  "error",
+		"code":    codeForbidden,
+		"request": action,
+		"topic":   topic,
+	})
+	return message
+}
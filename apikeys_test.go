@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIKeyStoreLifecycle(t *testing.T) {
+	store := NewAPIKeyStore()
+	key, err := store.Create("backend", []string{PermissionPublish})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, key.Secret)
+
+	request := httptest.NewRequest("GET", "/ws", nil)
+	request.Header.Set(apiKeyHeader, key.Secret)
+	found, err := store.Authenticate(request)
+	assert.NoError(t, err)
+	assert.Equal(t, "backend", found.Identity)
+	assert.Empty(t, found.Secret, "Stored keys should not keep their secret")
+	assert.True(t, found.HasPermission(PermissionPublish))
+	assert.False(t, found.HasPermission(PermissionAdmin))
+
+	assert.True(t, store.Revoke(key.Id))
+	assert.False(t, store.Revoke(key.Id))
+	_, err = store.Authenticate(request)
+	assert.ErrorIs(t, err, errInvalidAPIKey)
+}
+
+func TestAPIKeyStoreLoadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	os.WriteFile(path, []byte(`[{"key":"k1","identity":"sensor","permissions":["publish"]}]`), 0o600)
+
+	store := NewAPIKeyStore()
+	assert.NoError(t, store.LoadFile(path))
+	found, err := store.Authenticate(httptest.NewRequest("GET", "/ws?api_key=k1", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, "sensor", found.Identity)
+
+	os.WriteFile(path, []byte(`[{"identity":"sensor"}]`), 0o600)
+	assert.Error(t, NewAPIKeyStore().LoadFile(path), "Keys without a secret should be rejected")
+}
+
+func TestAPIKeyAdminRoutes(t *testing.T) {
+	keys := NewAPIKeyStore()
+	isolatePubSub(t).apiKeys = keys
+	keys.Add("root", "admin", []string{PermissionAdmin})
+	keys.Add("pub", "backend", []string{PermissionPublish})
+
+	mux := http.NewServeMux()
+	setupAPIKeyRoutes(mux, ps)
+	serve := func(method, target, key, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, target, strings.NewReader(body))
+		request.Header.Set(apiKeyHeader, key)
+		response := httptest.NewRecorder()
+		mux.ServeHTTP(response, request)
+		return response
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, serve("GET", "/admin/keys", "", "").Code)
+	assert.Equal(t, http.StatusForbidden, serve("GET", "/admin/keys", "pub", "").Code)
+
+	response := serve("POST", "/admin/keys", "root", `{"identity":"dashboard","permissions":["subscribe"]}`)
+	assert.Equal(t, http.StatusCreated, response.Code)
+	var created APIKey
+	json.Unmarshal(response.Body.Bytes(), &created)
+	assert.NotEmpty(t, created.Secret)
+
+	response = serve("GET", "/admin/keys", "root", "")
+	var listed []APIKey
+	json.Unmarshal(response.Body.Bytes(), &listed)
+	assert.Len(t, listed, 3)
+	for _, key := range listed {
+		assert.Empty(t, key.Secret, "Listed keys should not expose secrets")
+	}
+
+	assert.Equal(t, http.StatusNoContent, serve("DELETE", "/admin/keys/"+created.Id, "root", "").Code)
+	assert.Equal(t, http.StatusNotFound, serve("DELETE", "/admin/keys/"+created.Id, "root", "").Code)
+}
+
+func TestWebSocketHandlerEnforcesAPIKeyPermissions(t *testing.T) {
+	keys := NewAPIKeyStore()
+	isolatePubSub(t).apiKeys = keys
+	keys.Add("reader", "dashboard", []string{PermissionSubscribe})
+
+	server := httptest.NewServer(http.HandlerFunc(ps.webSocketHandler))
+	defer server.Close()
+	wsURL := "ws" + server.URL[4:]
+
+	_, response, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusUnauthorized, response.StatusCode, "A key is required once keys are configured")
+
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{apiKeyHeader: {"reader"}})
+	assert.NoError(t, err)
+	defer ws.Close()
+
+	var welcome welcomeFrame
+	assert.NoError(t, ws.ReadJSON(&welcome))
+
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"action":"publish","topic":"news","message":{}}`))
+	_, ack, _ := ws.ReadMessage()
+	assert.Equal(t, "Server received the message!", string(ack))
+
+	var reply map[string]string
+	assert.NoError(t, ws.ReadJSON(&reply))
+	assert.Equal(t, "forbidden", reply["code"])
+	assert.Equal(t, "publish", reply["request"])
+}
@@ -0,0 +1,372 @@
+// This file archives the history of selected topics to object storage, so history
+// requests can reach further back than the history kept in memory. Every interval the
+// entries appended since the last flush are written as a segment of gzip compressed
+// NDJSON, one entry per line as encoded by the json history codec, and listed in the
+// manifest of their topic. History requests asking for messages the history in memory
+// no longer holds are served from the segments, newest first, transparently.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Default interval at which history is archived
+const defaultArchiveInterval = time.Minute
+
+// Most archived entries a history request reads, so one request cannot read a whole archive
+const maxArchiveReplay = 10_000
+
+var archiveSegments = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "gowebsockets_archive_segments_total",
+	Help: "Number of history segments written to the archive, by whether they were stored.",
+}, []string{"result"})
+
+// The manifest of the archive of a topic, stored as manifest.json next to its segments
+type archiveManifest struct {
+	Topic string `json:"topic"`
+	// The segments, oldest first
+	Segments []archiveSegment `json:"segments"`
+}
+
+// A segment of archived entries
+type archiveSegment struct {
+	Key     string    `json:"key"`
+	Count   int       `json:"count"`
+	FirstId string    `json:"firstId"`
+	LastId  string    `json:"lastId"`
+	From    time.Time `json:"from"`
+	To      time.Time `json:"to"`
+}
+
+// HistoryArchiver flushes the history of the topics matching Topics to Store every
+// Interval and reads it back for history requests.
+type HistoryArchiver struct {
+	Store ObjectStore
+	// Topic patterns whose history is archived
+	Topics []string
+	// Prepended to the keys of the objects, e.g. "history/"
+	Prefix   string
+	Interval time.Duration
+	ps       *PubSub
+	// Sequence of the last entry archived, by topic
+	archived map[string]uint64
+	// Manifests read or written, by topic
+	manifests map[string]*archiveManifest
+	// Serializes flushes
+	flushing sync.Mutex
+	mu       sync.Mutex
+	done     chan struct{}
+	stopped  chan struct{}
+}
+
+// Function to create a history archiver.
+// Parameters:
+// store: ObjectStore - The store the history is archived to.
+// topics: []string - The topic patterns whose history is archived.
+// ps: *PubSub - The PubSub instance whose history is archived.
+// Returns:
+// *HistoryArchiver - The archiver; call Start to begin archiving.
+func NewHistoryArchiver(store ObjectStore, topics []string, ps *PubSub) *HistoryArchiver {
+	return &HistoryArchiver{
+		Store:     store,
+		Topics:    topics,
+		Interval:  defaultArchiveInterval,
+		ps:        ps,
+		archived:  map[string]uint64{},
+		manifests: map[string]*archiveManifest{},
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+}
+
+// Function to tell whether the history of a topic is archived.
+// Parameters:
+// topic: string - The topic.
+// Returns:
+// bool - True if the topic matches one of the patterns.
+func (a *HistoryArchiver) Archives(topic string) bool {
+	for _, pattern := range a.Topics {
+		if globMatch(pattern, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// Function to flush the history every interval.
+func (a *HistoryArchiver) Start() {
+	go func() {
+		defer close(a.stopped)
+		ticker := time.NewTicker(a.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-a.done:
+				return
+			case <-ticker.C:
+				ctx, cancel := context.WithTimeout(context.Background(), archiveTimeout)
+				a.Flush(ctx)
+				cancel()
+			}
+		}
+	}()
+}
+
+// Function to stop flushing the history every interval, after a last flush.
+func (a *HistoryArchiver) Stop() {
+	close(a.done)
+	<-a.stopped
+	ctx, cancel := context.WithTimeout(context.Background(), archiveTimeout)
+	defer cancel()
+	a.Flush(ctx)
+}
+
+// Function to archive the entries appended to the history of the archived topics since
+// the last flush.
+// Parameters:
+// ctx: context.Context - Cancels the requests to the store.
+// Returns:
+// error - The errors of the topics that could not be archived; they are retried on the next flush.
+func (a *HistoryArchiver) Flush(ctx context.Context) error {
+	a.flushing.Lock()
+	defer a.flushing.Unlock()
+
+	var errs []error
+	for _, topic := range a.ps.History.Topics() {
+		if !a.Archives(topic) {
+			continue
+		}
+		if err := a.flushTopic(ctx, topic); err != nil {
+			archiveSegments.WithLabelValues("failed").Inc()
+			slog.Error("Error archiving history", logKeyTopic, topic, "error", err)
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Function to archive the entries appended to the history of a topic since the last
+// flush as a new segment.
+// Parameters:
+// ctx: context.Context - Cancels the requests to the store.
+// topic: string - The topic.
+// Returns:
+// error - An error if the history could not be read or the store failed.
+func (a *HistoryArchiver) flushTopic(ctx context.Context, topic string) error {
+	entries, err := a.ps.History.Entries(topic)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	archived := a.archived[topic]
+	a.mu.Unlock()
+	for len(entries) > 0 && entries[0].Sequence <= archived {
+		entries = entries[1:]
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	var lines bytes.Buffer
+	for _, entry := range entries {
+		data, err := JSONEntryCodec{}.Encode(entry)
+		if err != nil {
+			return err
+		}
+		lines.Write(data)
+		lines.WriteByte('\n')
+	}
+	data, err := GzipCompressor{}.Compress(lines.Bytes())
+	if err != nil {
+		return err
+	}
+	first, last := entries[0], entries[len(entries)-1]
+	segment := archiveSegment{
+		Key:     a.topicKey(topic) + first.Timestamp.Format("20060102T150405.000000000Z") + "-" + first.Id + ".ndjson.gz",
+		Count:   len(entries),
+		FirstId: first.Id,
+		LastId:  last.Id,
+		From:    first.Timestamp,
+		To:      last.Timestamp,
+	}
+	if err := a.Store.Put(ctx, segment.Key, data, "application/gzip"); err != nil {
+		return err
+	}
+
+	manifest, err := a.manifest(ctx, topic)
+	if err != nil {
+		return err
+	}
+	updated := &archiveManifest{Topic: topic, Segments: append(slices.Clip(manifest.Segments), segment)}
+	data, err = json.Marshal(updated)
+	if err != nil {
+		return err
+	}
+	if err := a.Store.Put(ctx, a.topicKey(topic)+"manifest.json", data, "application/json"); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	a.manifests[topic] = updated
+	a.archived[topic] = last.Sequence
+	a.mu.Unlock()
+	archiveSegments.WithLabelValues("stored").Inc()
+	slog.Debug("Archived history", logKeyTopic, topic, "key", segment.Key, "entries", segment.Count)
+	return nil
+}
+
+// Function to get the manifest of the archive of a topic, reading it from the store
+// the first time.
+// Parameters:
+// ctx: context.Context - Cancels the request to the store.
+// topic: string - The topic.
+// Returns:
+// *archiveManifest - The manifest, not to be modified; empty if nothing was archived.
+// error - An error if the manifest could not be read.
+func (a *HistoryArchiver) manifest(ctx context.Context, topic string) (*archiveManifest, error) {
+	a.mu.Lock()
+	manifest, ok := a.manifests[topic]
+	a.mu.Unlock()
+	if ok {
+		return manifest, nil
+	}
+
+	manifest = &archiveManifest{Topic: topic}
+	data, err := a.Store.Get(ctx, a.topicKey(topic)+"manifest.json")
+	if err != nil && !errors.Is(err, errObjectNotFound) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, manifest); err != nil {
+			return nil, err
+		}
+	}
+	a.mu.Lock()
+	if cached, ok := a.manifests[topic]; ok {
+		manifest = cached
+	} else {
+		a.manifests[topic] = manifest
+	}
+	a.mu.Unlock()
+	return manifest, nil
+}
+
+// Function to read the entries of a segment.
+// Parameters:
+// ctx: context.Context - Cancels the request to the store.
+// segment: archiveSegment - The segment.
+// Returns:
+// []HistoryEntry - The entries, oldest first.
+// error - An error if the segment could not be read or is corrupt.
+func (a *HistoryArchiver) readSegment(ctx context.Context, segment archiveSegment) ([]HistoryEntry, error) {
+	data, err := a.Store.Get(ctx, segment.Key)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = (GzipCompressor{}).Decompress(data); err != nil {
+		return nil, err
+	}
+	entries := make([]HistoryEntry, 0, segment.Count)
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		entry, err := JSONEntryCodec{}.Decode(line)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Function to prepend archived entries to the history of a topic in memory, when a
+// history request reaches further back: its Since message is not in memory, or it asks
+// for more entries than memory holds. Segments are read newest first until the Since
+// message or enough entries are found, at most maxArchiveReplay entries.
+// Parameters:
+// ctx: context.Context - Cancels the requests to the store.
+// key: historyRange - The requested range.
+// recent: []HistoryEntry - The history of the topic in memory, oldest first.
+// Returns:
+// []HistoryEntry - The archived entries after the Since message, or the last archived entries, followed by recent.
+// error - An error if the archive could not be read.
+func (a *HistoryArchiver) Extend(ctx context.Context, key historyRange, recent []HistoryEntry) ([]HistoryEntry, error) {
+	if !a.Archives(key.Topic) {
+		return recent, nil
+	}
+	seen := make(map[string]bool, len(recent))
+	for _, entry := range recent {
+		seen[entry.Id] = true
+	}
+	if key.Since != "" && seen[key.Since] || key.Since == "" && (key.Limit <= 0 || key.Limit <= len(recent)) {
+		return recent, nil
+	}
+
+	manifest, err := a.manifest(ctx, key.Topic)
+	if err != nil {
+		return nil, err
+	}
+	var older []HistoryEntry
+	found := false
+	for i := len(manifest.Segments) - 1; i >= 0 && !found; i-- {
+		entries, err := a.readSegment(ctx, manifest.Segments[i])
+		if err != nil {
+			return nil, err
+		}
+		// Entries still in memory were archived too
+		entries = slices.DeleteFunc(entries, func(entry HistoryEntry) bool { return seen[entry.Id] })
+		if key.Since != "" {
+			if at := slices.IndexFunc(entries, func(entry HistoryEntry) bool { return entry.Id == key.Since }); at >= 0 {
+				entries, found = entries[at+1:], true
+			}
+		}
+		older = append(entries, older...)
+		if key.Limit > 0 && len(older)+len(recent) >= key.Limit || len(older) >= maxArchiveReplay {
+			break
+		}
+	}
+	if key.Since != "" && !found && (key.Limit <= 0 || len(older)+len(recent) < key.Limit) {
+		// The Since message is unknown, so the whole history in memory is the answer as before
+		return recent, nil
+	}
+	if len(older) > maxArchiveReplay {
+		older = older[len(older)-maxArchiveReplay:]
+	}
+	return append(older, recent...), nil
+}
+
+// Function to get the prefix of the keys of the objects archiving a topic.
+// Parameters:
+// topic: string - The topic.
+// Returns:
+// string - The prefix, ending with a slash.
+func (a *HistoryArchiver) topicKey(topic string) string {
+	return a.Prefix + url.PathEscape(topic) + "/"
+}
+
+// Function to list the topics with a history.
+// Returns:
+// []string - The topics, in no particular order.
+func (h *MemoryHistory) Topics() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	topics := make([]string, 0, len(h.topics))
+	for topic, entries := range h.topics {
+		if len(entries) > 0 {
+			topics = append(topics, topic)
+		}
+	}
+	return topics
+}
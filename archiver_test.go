@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Function to get the IDs of the messages of a history frame.
+func historyIds(t *testing.T, frame []byte) []string {
+	var reply struct {
+		Messages []struct {
+			Id string `json:"id"`
+		} `json:"messages"`
+	}
+	assert.NoError(t, json.Unmarshal(frame, &reply))
+	ids := []string{}
+	for _, message := range reply.Messages {
+		ids = append(ids, message.Id)
+	}
+	return ids
+}
+
+func TestHistoryArchiver(t *testing.T) {
+	fake, store := newFakeS3(t)
+	ctx := context.Background()
+	pubsub := &PubSub{History: NewMemoryHistory(JSONEntryCodec{}, 3)}
+	pubsub.Archiver = NewHistoryArchiver(store, []string{"feed/*"}, pubsub)
+	pubsub.Archiver.Prefix = "history/"
+
+	publish := func(topic string, from, to int) {
+		for i := from; i <= to; i++ {
+			pubsub.History.Append(fmt.Sprintf("m%d", i), topic, []byte(fmt.Sprintf(`{"n":%d}`, i)))
+		}
+	}
+	publish("feed/a", 1, 3)
+	publish("other", 1, 1)
+	assert.NoError(t, pubsub.Archiver.Flush(ctx))
+	publish("feed/a", 4, 5)
+	assert.NoError(t, pubsub.Archiver.Flush(ctx))
+	assert.NoError(t, pubsub.Archiver.Flush(ctx), "flushing without new entries writes nothing")
+	publish("feed/a", 6, 6)
+
+	// Two segments and the manifest, nothing of the topic that is not archived
+	assert.Len(t, fake.keys(), 3)
+	manifest, err := store.Get(ctx, "history/feed%2Fa/manifest.json")
+	assert.NoError(t, err)
+	var stored archiveManifest
+	assert.NoError(t, json.Unmarshal(manifest, &stored))
+	if assert.Len(t, stored.Segments, 2) {
+		assert.Equal(t, archiveSegment{Key: stored.Segments[0].Key, Count: 3, FirstId: "m1", LastId: "m3", From: stored.Segments[0].From, To: stored.Segments[0].To}, stored.Segments[0])
+		assert.Equal(t, 2, stored.Segments[1].Count)
+		assert.Equal(t, "m4", stored.Segments[1].FirstId)
+	}
+
+	// Memory holds m4 to m6; older messages are read from the archive
+	read := func(key historyRange) []string {
+		frame, err := pubsub.readHistory(key)
+		assert.NoError(t, err)
+		return historyIds(t, frame)
+	}
+	assert.Equal(t, []string{"m4", "m5", "m6"}, read(historyRange{Topic: "feed/a"}))
+	assert.Equal(t, []string{"m5", "m6"}, read(historyRange{Topic: "feed/a", Since: "m4"}))
+	assert.Equal(t, []string{"m2", "m3", "m4", "m5", "m6"}, read(historyRange{Topic: "feed/a", Since: "m1"}))
+	assert.Equal(t, []string{"m3", "m4", "m5", "m6"}, read(historyRange{Topic: "feed/a", Limit: 4}))
+	assert.Equal(t, []string{"m1", "m2", "m3", "m4", "m5", "m6"}, read(historyRange{Topic: "feed/a", Limit: 10}))
+	assert.Equal(t, []string{"m4", "m5", "m6"}, read(historyRange{Topic: "feed/a", Since: "unknown"}))
+
+	// A new archiver, e.g. after a restart, reads the manifest from the store
+	restarted := NewHistoryArchiver(store, []string{"feed/*"}, &PubSub{History: NewMemoryHistory(JSONEntryCodec{}, 3)})
+	restarted.Prefix = "history/"
+	entries, err := restarted.Extend(ctx, historyRange{Topic: "feed/a", Since: "m3"}, nil)
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, "m4", entries[0].Id)
+		assert.JSONEq(t, `{"n":5}`, string(entries[1].Payload))
+	}
+}
+
+func TestHistoryArchiverKeepsFailedEntries(t *testing.T) {
+	_, store := newFakeS3(t)
+	ctx := context.Background()
+	pubsub := &PubSub{History: NewMemoryHistory(JSONEntryCodec{}, 10)}
+	pubsub.Archiver = NewHistoryArchiver(store, []string{"*"}, pubsub)
+	pubsub.History.Append("m1", "feed", []byte(`1`))
+
+	accessKey := store.AccessKey
+	store.AccessKey = "refused"
+	assert.Error(t, pubsub.Archiver.Flush(ctx))
+	store.AccessKey = accessKey
+	assert.NoError(t, pubsub.Archiver.Flush(ctx))
+
+	manifest, err := pubsub.Archiver.manifest(ctx, "feed")
+	assert.NoError(t, err)
+	if assert.Len(t, manifest.Segments, 1) {
+		assert.Equal(t, "m1", manifest.Segments[0].FirstId)
+	}
+}
@@ -0,0 +1,203 @@
+// This file authenticates WebSocket upgrade requests with JSON Web Tokens or API keys.
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Prefix of the topics of the server, such as $topics, $deadletter and inboxes
+const reservedPrefix = "$"
+
+// Query parameter carrying the token for browsers, which cannot set headers on WebSocket requests
+const tokenQueryParam = "token"
+
+var errMissingToken = errors.New("missing authentication token")
+
+type JWTAuthenticator struct {
+	Key      interface{}
+	Methods  []string
+	Issuer   string
+	Audience string
+	// How long minted tokens are valid by default, and at most; 5 minutes and an hour when 0
+	TokenTTL    time.Duration
+	TokenMaxTTL time.Duration
+}
+
+// Function to create an authenticator for tokens signed with a shared secret (HS256/384/512).
+// Parameters:
+// secret: []byte - The shared secret.
+// Returns:
+// *JWTAuthenticator - The authenticator.
+func NewHMACAuthenticator(secret []byte) *JWTAuthenticator {
+	return &JWTAuthenticator{
+		Key:     secret,
+		Methods: []string{"HS256", "HS384", "HS512"},
+	}
+}
+
+// Function to create an authenticator for tokens signed with a private key, verified
+// with its PEM encoded RSA or ECDSA public key.
+// Parameters:
+// pemData: []byte - The PEM encoded public key.
+// Returns:
+// *JWTAuthenticator - The authenticator.
+// error - An error if the key could not be parsed.
+func NewPublicKeyAuthenticator(pemData []byte) (*JWTAuthenticator, error) {
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil, errors.New("no PEM data found in public key")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return &JWTAuthenticator{
+		Key:     key,
+		Methods: []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"},
+	}, nil
+}
+
+// Function to verify the token of a request.
+// Parameters:
+// r: *http.Request - The upgrade request carrying the token in the Authorization header
+// or the token query parameter.
+// Returns:
+// jwt.MapClaims - The verified claims of the token.
+// error - An error if the token is missing or invalid.
+func (a *JWTAuthenticator) Authenticate(r *http.Request) (jwt.MapClaims, error) {
+	tokenString := tokenFromRequest(r)
+	if tokenString == "" {
+		return nil, errMissingToken
+	}
+
+	options := []jwt.ParserOption{jwt.WithValidMethods(a.Methods), jwt.WithExpirationRequired()}
+	if a.Issuer != "" {
+		options = append(options, jwt.WithIssuer(a.Issuer))
+	}
+	if a.Audience != "" {
+		options = append(options, jwt.WithAudience(a.Audience))
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		return a.Key, nil
+	}, options...)
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// Function to authenticate a WebSocket upgrade request with its API key, or else its
+// token. Requests are anonymous only when no authentication method is configured.
+// Parameters:
+// r: *http.Request - The upgrade request.
+// Returns:
+// jwt.MapClaims - The claims of the client, or nil for anonymous clients.
+// error - An error if the request failed authentication.
+func (options *serverOptions) authenticate(r *http.Request) (jwt.MapClaims, error) {
+	if options.apiKeys != nil && (apiKeyFromRequest(r) != "" || options.jwtAuthenticator == nil) {
+		key, err := options.apiKeys.Authenticate(r)
+		if err != nil {
+			return nil, err
+		}
+		return key.Claims(), nil
+	}
+	if options.jwtAuthenticator != nil {
+		return options.jwtAuthenticator.Authenticate(r)
+	}
+	return nil, nil
+}
+
+// Function to check whether a client may perform an action. Clients whose claims do
+// not list permissions, such as anonymous clients, may perform every action.
+// Parameters:
+// permission: string - The permission, e.g. publish or subscribe.
+// Returns:
+// bool - True if the client has the permission.
+func (client *Client) HasPermission(permission string) bool {
+	permissions, ok := client.Claims[permissionsClaim].([]interface{})
+	if !ok {
+		return true
+	}
+	for _, p := range permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// Function to check whether a client was explicitly granted a permission. Unlike
+// HasPermission, clients whose claims do not list permissions, such as anonymous
+// clients, have none, so it guards what only admins may see.
+// Parameters:
+// permission: string - The permission, e.g. admin.
+// Returns:
+// bool - True if the claims of the client list the permission.
+func (client *Client) hasExplicitPermission(permission string) bool {
+	permissions, _ := client.Claims[permissionsClaim].([]interface{})
+	for _, p := range permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// Function to check whether a topic belongs to the server, as every topic starting with $ does.
+// Parameters:
+// topic: string - The topic.
+// Returns:
+// bool - True if only the server publishes to the topic.
+func reservedTopic(topic string) bool {
+	return strings.HasPrefix(topic, reservedPrefix)
+}
+
+// Function to check whether a client may subscribe to a topic of the server. They carry
+// what other clients sent or were sent, so only clients whose token lists the admin
+// permission may, but for inboxes, which only their client may subscribe to.
+// Parameters:
+// client: *Client - The client.
+// topic: string - The topic.
+// Returns:
+// bool - True if the topic is not reserved, is the client's inbox or the client is an admin.
+func mayReadReserved(client *Client, topic string) bool {
+	if !reservedTopic(topic) {
+		return true
+	}
+	if isInbox(topic) {
+		return topic == inboxOf(client)
+	}
+	return client.hasExplicitPermission(PermissionAdmin)
+}
+
+// Function to get the token of a request from the Authorization header or the query string.
+// Parameters:
+// r: *http.Request - The request.
+// Returns:
+// string - The token, or an empty string if there is none.
+func tokenFromRequest(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); header != "" {
+		if scheme, token, ok := strings.Cut(header, " "); ok && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+	}
+	return r.URL.Query().Get(tokenQueryParam)
+}
+
+// Function to reject a request that failed authentication.
+// Parameters:
+// w: http.ResponseWriter - The response writer.
+// err: error - Why authentication failed.
+func writeUnauthorized(w http.ResponseWriter, err error) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="gowebsockets"`)
+	http.Error(w, "unauthorized: "+err.Error(), http.StatusUnauthorized)
+}
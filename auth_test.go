@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func signTestToken(t *testing.T, method jwt.SigningMethod, key interface{}, claims jwt.MapClaims) string {
+	token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestHMACAuthenticator(t *testing.T) {
+	auth := NewHMACAuthenticator([]byte("s3cret"))
+	valid := signTestToken(t, jwt.SigningMethodHS256, []byte("s3cret"), jwt.MapClaims{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()})
+
+	request := httptest.NewRequest("GET", "/ws", nil)
+	request.Header.Set("Authorization", "Bearer "+valid)
+	claims, err := auth.Authenticate(request)
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", claims["sub"])
+
+	request = httptest.NewRequest("GET", "/ws?token="+valid, nil)
+	_, err = auth.Authenticate(request)
+	assert.NoError(t, err, "Token should be accepted from the query string")
+
+	_, err = auth.Authenticate(httptest.NewRequest("GET", "/ws", nil))
+	assert.ErrorIs(t, err, errMissingToken)
+
+	expired := signTestToken(t, jwt.SigningMethodHS256, []byte("s3cret"), jwt.MapClaims{"sub": "alice", "exp": time.Now().Add(-time.Hour).Unix()})
+	_, err = auth.Authenticate(httptest.NewRequest("GET", "/ws?token="+expired, nil))
+	assert.Error(t, err, "Expired tokens should be rejected")
+
+	forged := signTestToken(t, jwt.SigningMethodHS256, []byte("guess"), jwt.MapClaims{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()})
+	_, err = auth.Authenticate(httptest.NewRequest("GET", "/ws?token="+forged, nil))
+	assert.Error(t, err, "Tokens signed with another key should be rejected")
+}
+
+func TestPublicKeyAuthenticatorRequiresIssuer(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	auth, err := NewPublicKeyAuthenticator(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	assert.NoError(t, err)
+	auth.Issuer = "https://auth.example.com"
+
+	token := signTestToken(t, jwt.SigningMethodES256, key, jwt.MapClaims{"sub": "bob", "iss": "https://auth.example.com", "exp": time.Now().Add(time.Hour).Unix()})
+	claims, err := auth.Authenticate(httptest.NewRequest("GET", "/ws?token="+token, nil))
+	assert.NoError(t, err)
+	assert.Equal(t, "bob", claims["sub"])
+
+	other := signTestToken(t, jwt.SigningMethodES256, key, jwt.MapClaims{"sub": "bob", "iss": "https://evil.example.com", "exp": time.Now().Add(time.Hour).Unix()})
+	_, err = auth.Authenticate(httptest.NewRequest("GET", "/ws?token="+other, nil))
+	assert.Error(t, err)
+}
+
+func TestWebSocketHandlerRequiresToken(t *testing.T) {
+	options := isolatePubSub(t)
+	options.jwtAuthenticator = NewHMACAuthenticator([]byte("s3cret"))
+
+	server := httptest.NewServer(http.HandlerFunc(ps.webSocketHandler))
+	defer server.Close()
+	wsURL := "ws" + server.URL[4:]
+
+	_, response, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+
+	token := signTestToken(t, jwt.SigningMethodHS256, []byte("s3cret"), jwt.MapClaims{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()})
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL+"?token="+token, nil)
+	assert.NoError(t, err)
+	defer ws.Close()
+}
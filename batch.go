@@ -0,0 +1,128 @@
+// This file lets a client subscribe to or unsubscribe from many topics with one frame,
+// e.g. {"action":"subscribe","topics":["a","b","c"]}, so restoring its subscriptions
+// after a reconnect takes one round trip. Every topic is handled like a frame naming it
+// alone, with the options of the batch, and the batch is answered with one frame giving
+// the result of each topic:
+// {"action":"subscribed","results":[{"topic":"a","status":"subscribed"},{"topic":"b","status":"error","code":"forbidden"}]}.
+// Topics refused under the drop or honeypot unauthorized policies are left out of the
+// results, as a frame naming them alone would not be answered either.
+package main
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// Most topics a batch may name
+const maxBatchTopics = 1000
+
+// Statuses of the topics of a batch
+const (
+	TopicSubscribed   = "subscribed"
+	TopicUnsubscribed = "unsubscribed"
+	TopicWaitlisted   = "waitlisted"
+	// The topic is a lobby the client now waits in for a match
+	TopicLobby = "lobby"
+	// The topic was refused, Code telling why
+	TopicError = "error"
+)
+
+// TopicResult is the result of subscribing to or unsubscribing from a topic.
+type TopicResult struct {
+	Topic  string `json:"topic"`
+	Status string `json:"status"`
+	// Code of the error refusing the topic
+	Code string `json:"code,omitempty"`
+	// Place of the client on the waitlist of the topic
+	Position int `json:"position,omitempty"`
+	// Lifetime of the subscription, if the frame named one
+	Lifetime SubscriptionLifetime `json:"lifetime,omitempty"`
+}
+
+// Function to build the frame answering a batch.
+// Parameters:
+// action: string - SUBSCRIBED or UNSUBSCRIBED.
+// results: []TopicResult - The result of each topic.
+// Returns:
+// []byte - The JSON encoded frame.
+func batchResultsMessage(action string, results []TopicResult) []byte {
+	message, _ := json.Marshal(struct {
+		Action  string        `json:"action"`
+		Results []TopicResult `json:"results"`
+	}{action, results})
+	return message
+}
+
+// Function to list the topics of a batch once each.
+// Parameters:
+// client: *Client - The client that sent the batch.
+// m: Message - The batch.
+// Returns:
+// []string - The topics, in the order the batch names them.
+// bool - False if the batch names too many topics, the client having been told.
+func batchTopics(client *Client, m Message) ([]string, bool) {
+	if len(m.Topics) > maxBatchTopics {
+		client.Send(errorDetailMessage("batch_too_large", "", "a batch names at most 1000 topics"))
+		return nil, false
+	}
+	seen := map[string]bool{}
+	var topics []string
+	for _, topic := range m.Topics {
+		if !seen[topic] {
+			seen[topic] = true
+			topics = append(topics, topic)
+		}
+	}
+	return topics, true
+}
+
+// Function to subscribe a client to every topic of a batch.
+// Parameters:
+// ctx: context.Context - The context carrying the trace of the frame.
+// client: *Client - The client.
+// m: Message - The subscribe frame naming the topics.
+func (ps *PubSub) subscribeBatch(ctx context.Context, client *Client, m Message) {
+	topics, ok := batchTopics(client, m)
+	if !ok {
+		return
+	}
+	results := []TopicResult{}
+	for _, topic := range topics {
+		single := m
+		single.Topic, single.Topics = topic, nil
+		// Explicit topics must be created before they are used
+		if !ps.topicDeclared(topic) {
+			results = append(results, TopicResult{Topic: topic, Status: TopicError, Code: "unknown_topic"})
+			continue
+		}
+		result := ps.subscribeTopic(ctx, client, single)
+		if result.Code == codeForbidden && !ps.recordRefusal(client, single) {
+			continue
+		}
+		results = append(results, result)
+	}
+	client.logger().Info("Batch subscribe", "topics", len(topics))
+	client.Send(batchResultsMessage(SUBSCRIBED, results))
+}
+
+// Function to unsubscribe a client from every topic of a batch.
+// Parameters:
+// client: *Client - The client.
+// m: Message - The unsubscribe frame naming the topics.
+func (ps *PubSub) unsubscribeBatch(client *Client, m Message) {
+	topics, ok := batchTopics(client, m)
+	if !ok {
+		return
+	}
+	results := []TopicResult{}
+	for _, topic := range topics {
+		if ps.isLobby(topic) {
+			ps.Matchmaking.Leave(topic, client.Id)
+		} else {
+			ps.Unsubscribe(client, topic)
+		}
+		results = append(results, TopicResult{Topic: topic, Status: TopicUnsubscribed})
+	}
+	client.logger().Info("Batch unsubscribe", "topics", len(topics))
+	client.Send(batchResultsMessage(UNSUBSCRIBED, results))
+}
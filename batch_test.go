@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatchSubscribe(t *testing.T) {
+	pubsub := &PubSub{}
+	pubsub.options().acl = &ACL{Rules: []ACLRule{{Identity: "*", Subscribe: []string{"public.*"}}}}
+	client, peer := newTestClient(t)
+
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topics":["public.a","secret","public.b","public.a"],"qos":1}`))
+	var answer struct {
+		Action  string        `json:"action"`
+		Results []TopicResult `json:"results"`
+	}
+	assert.NoError(t, json.Unmarshal(mustRead(t, peer), &answer))
+	assert.Equal(t, SUBSCRIBED, answer.Action)
+	assert.Equal(t, []TopicResult{
+		{Topic: "public.a", Status: TopicSubscribed},
+		{Topic: "secret", Status: TopicError, Code: codeForbidden},
+		{Topic: "public.b", Status: TopicSubscribed},
+	}, answer.Results, "Each topic gets one result, in the order of the batch")
+	assert.Equal(t, 1, subscriptionCount(pubsub, &client, "public.a"))
+	assert.Equal(t, 0, subscriptionCount(pubsub, &client, "secret"))
+	assert.Equal(t, 1, pubsub.GetSubscriptions("public.b", &client)[0].QoS, "Topics get the options of the batch")
+
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"unsubscribe","topics":["public.a","public.b"]}`))
+	assert.NoError(t, json.Unmarshal(mustRead(t, peer), &answer))
+	assert.Equal(t, UNSUBSCRIBED, answer.Action)
+	assert.Len(t, answer.Results, 2)
+	assert.Equal(t, 0, subscriptionCount(pubsub, &client, "public.a"))
+	assert.Equal(t, 0, subscriptionCount(pubsub, &client, "public.b"))
+}
+
+func TestBatchSubscribeChecksEachTopic(t *testing.T) {
+	pubsub := &PubSub{ExplicitTopics: true}
+	pubsub.CreateTopic("orders", "", TopicPolicy{})
+	client, peer := newTestClient(t)
+
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topics":["orders","missing"]}`))
+	assert.Contains(t, string(mustRead(t, peer)), `{"topic":"missing","status":"error","code":"unknown_topic"}`)
+
+	topics, _ := json.Marshal(strings.Split(strings.Repeat("t,", maxBatchTopics+1), ","))
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topics":`+string(topics)+`}`))
+	assert.Equal(t, "batch_too_large", readFrame(t, peer)["code"])
+}
@@ -0,0 +1,86 @@
+// This file streams binary data, such as audio or sensor readings, through topics.
+// As in the history, a message that is not a JSON value is binary data: it is
+// delivered in binary frames, base64 encoded in the data field of envelopes, and can
+// be published base64 encoded in the data field of a publish frame. A client that
+// binds a topic also publishes every binary frame it sends to it as is, without
+// wrapping it in a publish frame.
+package main
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// Binds the binary frames of a connection to a topic, or unbinds them without a topic
+const BIND = "bind"
+
+// Frame confirming the topic binary frames are published to
+const BOUND = "bound"
+
+// Function to bind the binary frames of a client to a topic, which it must be allowed
+// to publish to, or unbind them if no topic is given.
+// Parameters:
+// client: *Client - The client.
+// m: Message - The bind frame.
+func (ps *PubSub) handleBind(client *Client, m Message) {
+	if m.Topic != "" && !ps.mayPublish(client, m.Topic) {
+		ps.refuse(client, m)
+		return
+	}
+	client.Session.Bind(m.Topic)
+	client.logger().Info("Bound binary frames", logKeyTopic, m.Topic)
+	client.Send(boundMessage(m.Topic))
+}
+
+// Function to publish a binary frame to the topic its client bound.
+// Parameters:
+// ctx: context.Context - The context the frame was received in.
+// client: *Client - The client.
+// topic: string - The bound topic.
+// data: []byte - The frame.
+func (ps *PubSub) publishBound(ctx context.Context, client *Client, topic string, data []byte) {
+	// The permissions of the client may have changed since it bound the topic
+	if !ps.mayPublish(client, topic) {
+		ps.refuse(client, Message{Action: PUBLISH, Topic: topic})
+		return
+	}
+	if !ps.conformsToSchema(client, topic, data) {
+		return
+	}
+	ctx = withTenant(withPublisher(ctx, client.Principal()), client.Tenant())
+	ctx = withEchoSource(ctx, &echoSource{ClientId: client.Id})
+	ps.clientPublished(ctx, client, topic, data)
+	ps.PublishContext(ctx, topic, data, nil)
+}
+
+// Function to set the topic the binary frames of a connection are published to.
+// Parameters:
+// topic: string - The topic, or "" to handle binary frames like text frames.
+func (s *Session) Bind(topic string) {
+	if s != nil {
+		s.bound.Store(&topic)
+	}
+}
+
+// Function to get the topic the binary frames of a connection are published to.
+// Returns:
+// string - The topic, or "" if none is bound.
+func (s *Session) BoundTopic() string {
+	if s == nil {
+		return ""
+	}
+	if topic := s.bound.Load(); topic != nil {
+		return *topic
+	}
+	return ""
+}
+
+// Function to build the frame confirming a binding.
+// Parameters:
+// topic: string - The bound topic, "" once unbound.
+// Returns:
+// []byte - The JSON encoded frame.
+func boundMessage(topic string) []byte {
+	message, _ := json.Marshal(map[string]string{"action": BOUND, "topic": topic})
+	return message
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBinaryFramesOnBoundTopic(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(ps.webSocketHandler))
+	defer server.Close()
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+server.URL[4:], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	// read returns the type and data of the next frame after the acknowledgement
+	read := func() (int, []byte) {
+		messageType, data, err := ws.ReadMessage()
+		assert.NoError(t, err)
+		return messageType, data
+	}
+	send := func(messageType int, frame string) (int, []byte) {
+		ws.WriteMessage(messageType, []byte(frame))
+		_, ack := read()
+		assert.Equal(t, "Server received the message!", string(ack))
+		return read()
+	}
+	read()
+
+	ws.WriteJSON(map[string]string{"action": "subscribe", "topic": "audio/1"})
+	read()
+	_, refused := send(websocket.TextMessage, `{"action":"bind","topic":"`+ps.options().adminEventsTopic+`"}`)
+	assert.Contains(t, string(refused), `"action":"error"`, "Binding needs access to publish to the topic")
+	_, bound := send(websocket.TextMessage, `{"action":"bind","topic":"audio/1"}`)
+	assert.JSONEq(t, `{"action":"bound","topic":"audio/1"}`, string(bound))
+
+	chunk := string([]byte{0x00, 0xff, 0x10, 0x80})
+	messageType, data := send(websocket.BinaryMessage, chunk)
+	assert.Equal(t, websocket.BinaryMessage, messageType, "Binary data should be delivered in binary frames")
+	assert.Equal(t, chunk, string(data))
+
+	// Binary data can also be published in a publish frame
+	messageType, data = send(websocket.TextMessage, `{"action":"publish","topic":"audio/1","data":"AP8QgA=="}`)
+	assert.Equal(t, websocket.BinaryMessage, messageType)
+	assert.Equal(t, chunk, string(data))
+	messageType, data = send(websocket.TextMessage, `{"action":"publish","topic":"audio/1","message":{"muted":true}}`)
+	assert.Equal(t, websocket.TextMessage, messageType, "JSON messages should stay in text frames")
+	assert.JSONEq(t, `{"muted":true}`, string(data))
+
+	// Once unbound, binary frames are handled like text frames again
+	_, bound = send(websocket.TextMessage, `{"action":"bind"}`)
+	assert.JSONEq(t, `{"action":"bound","topic":""}`, string(bound))
+	messageType, data = send(websocket.BinaryMessage, `{"action":"publish","topic":"audio/1","message":1}`)
+	assert.Equal(t, websocket.TextMessage, messageType)
+	assert.Equal(t, "1", string(data))
+}
+
+func TestBinaryPayloadInEnvelopeAndCodecs(t *testing.T) {
+	pubsub := &PubSub{}
+	envelopes := &eventRecorder{}
+	pubsub.SubscribeWith(&Client{Id: "enveloped", Transport: envelopes}, "sensors", SubscribeOptions{Envelope: true})
+
+	pubsub.fanOut(context.Background(), "m1", "sensors", []byte{0x01, 0x02})
+	if assert.Len(t, envelopes.frames, 1) {
+		assert.Equal(t, "AQI=", envelopes.frames[0]["data"], "Binary data should be base64 encoded in envelopes")
+	}
+
+	cbor, _ := GetEnvelopeCodec("cbor")
+	encoded, err := cbor.EncodeBinary([]byte{0x01, 0x02})
+	assert.NoError(t, err)
+	assert.Equal(t, "420102", hex.EncodeToString(encoded), "Binary data should be a CBOR byte string")
+
+	assert.True(t, NewMessagePayload([]byte{0xff}).Binary)
+	assert.False(t, NewMessagePayload([]byte(`{"t":1}`)).Binary)
+	var decoded Message
+	json.Unmarshal([]byte(`{"action":"publish","data":"AQI="}`), &decoded)
+	assert.Equal(t, []byte{0x01, 0x02}, decoded.Data)
+}
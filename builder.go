@@ -0,0 +1,242 @@
+// This file lets embedders assemble the server in code with functional options instead
+// of a configuration file:
+//
+//	server, err := New(
+//		WithConfig(config),
+//		WithAuth(Auth{Authenticator: NewHMACAuthenticator(secret), APIKeys: keys}),
+//		WithBackplane(Backplane{RedisURL: "redis://localhost:6379"}),
+//		WithStore(NewMemoryHistory(JSONEntryCodec{}, 100)),
+//		WithMetrics("/internal/metrics"),
+//		WithLimits(Limits{MaxSubscriptions: 50, MaxMessageSize: 64 << 10}),
+//		WithClientIDs(ClaimClientIDs{Claim: "sub", Fallback: UUIDClientIDs{}}),
+//	)
+//
+// Combinations that cannot work together are refused by New before anything starts.
+// Each server has a PubSub, authentication and limits of its own, which its handlers
+// close over, so a process may run several servers at once.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Option configures the server New assembles.
+type Option func(*builder)
+
+// The configuration and pieces a server is assembled from
+type builder struct {
+	config Config
+	parts  serverParts
+}
+
+// Auth is how clients and API callers are authenticated and what they may access.
+type Auth struct {
+	// Verifies the tokens of WebSocket clients, nil to accept anonymous clients
+	Authenticator *JWTAuthenticator
+	// Keys of the HTTP and admin APIs, nil to not serve them
+	APIKeys *APIKeyStore
+	// Topics each identity may publish and subscribe to, nil to allow every topic
+	ACL *ACL
+}
+
+// Backplane relays the messages of the server to the other instances: through NATS,
+// Redis, or a cluster of servers linked to each other.
+type Backplane struct {
+	NATSURL        string
+	RedisURL       string
+	ClusterAddress string
+	ClusterSecret  string
+	ClusterPeers   []string
+}
+
+// Server is a server assembled by New.
+type Server struct {
+	// The HTTP server, with its address and routes
+	HTTP *http.Server
+	// The PubSub, to publish and handle requests from the embedding program
+	PubSub *PubSub
+	close  func()
+}
+
+// Function to start from a configuration, e.g. DefaultConfig() or LoadConfig(...). It
+// replaces the whole configuration, so it comes before the other options.
+// Parameters:
+// config: Config - The configuration.
+// Returns:
+// Option - The option.
+func WithConfig(config Config) Option {
+	return func(b *builder) {
+		b.config = config
+	}
+}
+
+// Function to set how clients are authenticated and what they may access.
+// Parameters:
+// auth: Auth - The authenticator, API keys and ACL.
+// Returns:
+// Option - The option.
+func WithAuth(auth Auth) Option {
+	return func(b *builder) {
+		b.parts.authenticator = auth.Authenticator
+		b.parts.apiKeys = auth.APIKeys
+		b.parts.acl = auth.ACL
+	}
+}
+
+// Function to set the backplane relaying messages to the other instances.
+// Parameters:
+// backplane: Backplane - The backplane.
+// Returns:
+// Option - The option.
+func WithBackplane(backplane Backplane) Option {
+	return func(b *builder) {
+		b.config.NATSURL = backplane.NATSURL
+		b.config.RedisURL = backplane.RedisURL
+		b.config.ClusterAddress = backplane.ClusterAddress
+		b.config.ClusterSecret = backplane.ClusterSecret
+		b.config.ClusterPeers = backplane.ClusterPeers
+	}
+}
+
+// Function to set the history the messages of topics are kept in.
+// Parameters:
+// history: *MemoryHistory - The history, e.g. NewMemoryHistory(JSONEntryCodec{}, 100) with a retention policy.
+// Returns:
+// Option - The option.
+func WithStore(history *MemoryHistory) Option {
+	return func(b *builder) {
+		b.parts.history = history
+	}
+}
+
+// Function to set the path the Prometheus metrics are served on.
+// Parameters:
+// path: string - The path, or "" to not serve the metrics.
+// Returns:
+// Option - The option.
+func WithMetrics(path string) Option {
+	return func(b *builder) {
+		b.config.MetricsPath = path
+	}
+}
+
+// Function to set the default limits of clients, which their tokens may override.
+// Parameters:
+// limits: Limits - The limits.
+// Returns:
+// Option - The option.
+func WithLimits(limits Limits) Option {
+	return func(b *builder) {
+		b.parts.limits = &limits
+	}
+}
+
+// Function to set how the IDs of clients are decided.
+// Parameters:
+// provider: ClientIDProvider - The provider, e.g. ClaimClientIDs{Claim: "sub"} for IDs stable across reconnects.
+// Returns:
+// Option - The option.
+func WithClientIDs(provider ClientIDProvider) Option {
+	return func(b *builder) {
+		b.parts.clientIDs = provider
+	}
+}
+
+// Function to check that the options can work together.
+// Returns:
+// error - An error describing every incompatible combination.
+func (b *builder) validate() error {
+	var errs []error
+	config, parts := b.config, b.parts
+
+	var backplanes []string
+	for name, url := range map[string]string{"NATS": config.NATSURL, "Redis": config.RedisURL, "cluster": config.ClusterAddress} {
+		if url != "" {
+			backplanes = append(backplanes, name)
+		}
+	}
+	if len(backplanes) > 1 {
+		errs = append(errs, fmt.Errorf("only one backplane may relay messages, got %s", strings.Join(backplanes, " and ")))
+	}
+	if config.ClusterAddress == "" && (config.ClusterSecret != "" || len(config.ClusterPeers) > 0) {
+		errs = append(errs, errors.New("cluster peers and secret need a cluster address"))
+	}
+
+	if parts.authenticator != nil && (config.JWTSecret != "" || config.JWTPublicKeyFile != "") {
+		errs = append(errs, errors.New("an authenticator is given along with a JWT secret or public key in the configuration"))
+	}
+	if parts.apiKeys != nil && (config.APIKeysFile != "" || config.AdminAPIKey != "") {
+		errs = append(errs, errors.New("API keys are given along with an API keys file or admin key in the configuration"))
+	}
+	if parts.acl != nil && config.ACLFile != "" {
+		errs = append(errs, errors.New("an ACL is given along with an ACL file in the configuration"))
+	}
+
+	if parts.history != nil && (config.HistoryLimit > 0 || config.RetentionPolicyFile != "" || config.HistoryCompression != "") {
+		errs = append(errs, errors.New("a store is given along with a history limit, retention policy or compression in the configuration"))
+	}
+	if parts.history != nil && parts.history.Codec == nil {
+		errs = append(errs, errors.New("the store has no entry codec"))
+	}
+
+	if parts.clientIDs != nil && config.ClientIDProvider != "" && config.ClientIDProvider != "uuid" {
+		errs = append(errs, errors.New("a client ID provider is given along with client_id_provider in the configuration"))
+	}
+
+	if config.MetricsPath != "" && (!strings.HasPrefix(config.MetricsPath, "/") || config.MetricsPath == "/" || config.MetricsPath == "/ws") {
+		errs = append(errs, fmt.Errorf("invalid metrics path %q", config.MetricsPath))
+	}
+
+	if limits := parts.limits; limits != nil && (limits.MaxSubscriptions < 0 || limits.MaxMessageSize < 0 ||
+		limits.RateLimit < 0 || limits.RateBurst < 0 || limits.HeartbeatInterval < 0) {
+		errs = append(errs, errors.New("limits must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// Function to assemble a server from options, starting from the default configuration.
+// The server is validated and constructed, and its backplane and background tasks
+// started, but it only accepts connections once run.
+// Parameters:
+// options: ...Option - The options, applied in order.
+// Returns:
+// *Server - The server.
+// error - An error if options are incompatible or a piece could not be constructed.
+func New(options ...Option) (*Server, error) {
+	b := &builder{config: DefaultConfig()}
+	for _, option := range options {
+		option(b)
+	}
+	if err := b.validate(); err != nil {
+		return nil, err
+	}
+	server, pubsub, closeAll, err := newServer(b.config, b.parts)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{HTTP: server, PubSub: pubsub, close: closeAll}, nil
+}
+
+// Function to run the server until it fails or a termination signal arrives, shut it
+// down gracefully and close what it started.
+// Returns:
+// error - The error that stopped the server, or nil after a graceful shutdown.
+func (s *Server) Run() error {
+	defer s.Close()
+	if err := run(s.HTTP, s.PubSub); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Function to close the backplane and background tasks of a server that is not run,
+// or no longer.
+func (s *Server) Close() {
+	if s.close != nil {
+		s.close()
+		s.close = nil
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildServerWithOptions(t *testing.T) {
+	keys := NewAPIKeyStore()
+	keys.Add("admin-secret", "ops", []string{PermissionAdmin})
+	history := NewMemoryHistory(JSONEntryCodec{}, 7)
+
+	config := DefaultConfig()
+	config.ListenAddr = ":9998"
+	server, err := New(
+		WithConfig(config),
+		WithAuth(Auth{APIKeys: keys}),
+		WithStore(history),
+		WithMetrics("/internal/metrics"),
+		WithLimits(Limits{MaxSubscriptions: 4}),
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer server.Close()
+
+	assert.Equal(t, ":9998", server.HTTP.Addr)
+	assert.Same(t, history, server.PubSub.History, "The store given should be used")
+	assert.Equal(t, 4, server.PubSub.options().defaultLimits.MaxSubscriptions)
+
+	request := httptest.NewRequest(http.MethodGet, "/admin/reports", nil)
+	request.Header.Set(apiKeyHeader, "admin-secret")
+	recorder := httptest.NewRecorder()
+	server.HTTP.Handler.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code, "The admin routes should accept the keys given")
+
+	for path, served := range map[string]bool{"/internal/metrics": true, "/metrics": false} {
+		recorder := httptest.NewRecorder()
+		server.HTTP.Handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, served, strings.Contains(recorder.Body.String(), "gowebsockets_"), path)
+	}
+}
+
+func TestBuiltServersCoexist(t *testing.T) {
+	build := func(secret string, limits Limits) *Server {
+		keys := NewAPIKeyStore()
+		keys.Add(secret, "ops", []string{PermissionAdmin})
+		server, err := New(WithAuth(Auth{APIKeys: keys}), WithLimits(limits))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { server.Close() })
+		return server
+	}
+	first := build("first-secret", Limits{MaxSubscriptions: 4})
+	second := build("second-secret", Limits{MaxSubscriptions: 8})
+
+	assert.NotSame(t, first.PubSub, second.PubSub)
+	assert.Equal(t, 4, first.PubSub.options().defaultLimits.MaxSubscriptions, "Each server keeps its limits")
+	assert.Equal(t, 8, second.PubSub.options().defaultLimits.MaxSubscriptions)
+
+	for server, accepted := range map[*Server]string{first: "first-secret", second: "second-secret"} {
+		for _, key := range []string{"first-secret", "second-secret"} {
+			request := httptest.NewRequest(http.MethodGet, "/admin/reports", nil)
+			request.Header.Set(apiKeyHeader, key)
+			recorder := httptest.NewRecorder()
+			server.HTTP.Handler.ServeHTTP(recorder, request)
+			assert.Equal(t, key == accepted, recorder.Code == http.StatusOK, "Each server accepts its own keys only")
+		}
+	}
+
+	listener := httptest.NewServer(first.HTTP.Handler)
+	t.Cleanup(listener.Close)
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(listener.URL, "http")+"/ws", http.Header{apiKeyHeader: {"first-secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	assert.Eventually(t, func() bool { return len(first.PubSub.Clients()) == 1 }, time.Second, 10*time.Millisecond)
+	assert.Empty(t, second.PubSub.Clients(), "Clients join the server they connected to")
+}
+
+func TestBuildServerRejectsIncompatibleOptions(t *testing.T) {
+	withHistoryLimit := DefaultConfig()
+	withHistoryLimit.HistoryLimit = 10
+	withAdminKey := DefaultConfig()
+	withAdminKey.AdminAPIKey = "admin-secret"
+	withClaimIDs := DefaultConfig()
+	withClaimIDs.ClientIDProvider = "claim:sub"
+	withPublicHoneypot := DefaultConfig()
+	withPublicHoneypot.HoneypotTopic = "security"
+
+	for name, options := range map[string][]Option{
+		"two backplanes":     {WithBackplane(Backplane{NATSURL: "nats://localhost:4222", RedisURL: "redis://localhost:6379"})},
+		"peers without node": {WithBackplane(Backplane{ClusterPeers: []string{"10.0.0.2:7946"}})},
+		"cluster no secret":  {WithBackplane(Backplane{ClusterAddress: "127.0.0.1:7946"})},
+		"public honeypot":    {WithConfig(withPublicHoneypot)},
+		"store and limit":    {WithConfig(withHistoryLimit), WithStore(NewMemoryHistory(JSONEntryCodec{}, 5))},
+		"keys and admin key": {WithConfig(withAdminKey), WithAuth(Auth{APIKeys: NewAPIKeyStore()})},
+		"relative metrics":   {WithMetrics("metrics")},
+		"negative limits":    {WithLimits(Limits{MaxSubscriptions: -1})},
+		"two ID providers":   {WithConfig(withClaimIDs), WithClientIDs(&SequentialClientIDs{})},
+	} {
+		server, err := New(options...)
+		assert.Error(t, err, name)
+		assert.Nil(t, server, name)
+	}
+}
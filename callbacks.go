@@ -0,0 +1,163 @@
+// This file lets programs embedding the server react to the lifecycle of its clients:
+// OnConnect and OnDisconnect run when a client connects over any transport and when it
+// disconnects, OnSubscribe when a client is subscribed to a topic, and OnPublish when a
+// client publishes, after the publish was allowed and before it is delivered. They suit
+// auth bookkeeping, analytics or custom greetings, e.g.
+// ps.OnConnect(func(client *Client) { client.Send([]byte(`{"action":"greeting"}`)) }).
+// Callbacks run in the order they were registered and never while ps.mu is held, so they
+// may call back into the PubSub. They run in the goroutine of the client, but for the
+// subscribe callbacks of clients leaving a waitlist, which run in the goroutine that
+// freed their place: the one of the client that left, or of the admin request that
+// raised the capacity of the room.
+package main
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// lifecycleCallbacks are the callbacks registered on a PubSub.
+type lifecycleCallbacks struct {
+	connect    []func(client *Client)
+	disconnect []func(client *Client)
+	subscribe  []func(client *Client, topic string)
+	// Read without ps.mu, as they run on every publish
+	publish atomic.Pointer[[]func(ctx context.Context, client *Client, topic string, message []byte)]
+	// Subscriptions made since ps.mu was taken, waiting for the subscribe callbacks
+	subscribed []subscribedEvent
+}
+
+// subscribedEvent is a client subscribed to a topic.
+type subscribedEvent struct {
+	client *Client
+	topic  string
+}
+
+// Function to register a callback run when a client connects.
+// Parameters:
+// callback: func(client *Client) - The callback, given the client once it was added.
+func (ps *PubSub) OnConnect(callback func(client *Client)) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.callbacks.connect = append(ps.callbacks.connect[:len(ps.callbacks.connect):len(ps.callbacks.connect)], callback)
+}
+
+// Function to register a callback run when a client disconnects.
+// Parameters:
+// callback: func(client *Client) - The callback, given the client once its subscriptions were removed.
+func (ps *PubSub) OnDisconnect(callback func(client *Client)) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.callbacks.disconnect = append(ps.callbacks.disconnect[:len(ps.callbacks.disconnect):len(ps.callbacks.disconnect)], callback)
+}
+
+// Function to register a callback run when a client is subscribed to a topic. It runs
+// for new subscriptions only, including those of clients leaving a waitlist.
+// Parameters:
+// callback: func(client *Client, topic string) - The callback.
+func (ps *PubSub) OnSubscribe(callback func(client *Client, topic string)) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.callbacks.subscribe = append(ps.callbacks.subscribe[:len(ps.callbacks.subscribe):len(ps.callbacks.subscribe)], callback)
+}
+
+// Function to register a callback run when a client publishes a message.
+// Parameters:
+// callback: func(ctx context.Context, client *Client, topic string, message []byte) - The callback, given the context of the publish.
+func (ps *PubSub) OnPublish(callback func(ctx context.Context, client *Client, topic string, message []byte)) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	var callbacks []func(ctx context.Context, client *Client, topic string, message []byte)
+	if current := ps.callbacks.publish.Load(); current != nil {
+		callbacks = *current
+	}
+	callbacks = append(callbacks[:len(callbacks):len(callbacks)], callback)
+	ps.callbacks.publish.Store(&callbacks)
+}
+
+// Function to run the connect callbacks.
+// Parameters:
+// client: *Client - The client that connected.
+func (ps *PubSub) clientConnected(client *Client) {
+	ps.mu.Lock()
+	callbacks := ps.callbacks.connect
+	ps.mu.Unlock()
+	for _, callback := range callbacks {
+		callback(client)
+	}
+}
+
+// Function to run the disconnect callbacks.
+// Parameters:
+// client: *Client - The client that disconnected.
+func (ps *PubSub) clientDisconnected(client *Client) {
+	ps.mu.Lock()
+	callbacks := ps.callbacks.disconnect
+	ps.mu.Unlock()
+	for _, callback := range callbacks {
+		callback(client)
+	}
+}
+
+// Function to record a new subscription for the subscribe callbacks, taken by
+// takeSubscribedLocked before ps.mu is released. The caller must hold ps.mu.
+// Parameters:
+// client: *Client - The subscribed client.
+// topic: string - The topic.
+func (ps *PubSub) subscribedLocked(client *Client, topic string) {
+	if len(ps.callbacks.subscribe) > 0 {
+		ps.callbacks.subscribed = append(ps.callbacks.subscribed, subscribedEvent{client, topic})
+	}
+}
+
+// Function to take the subscriptions recorded since ps.mu was taken, so that their
+// callbacks run in the goroutine that made them rather than in the next one to take
+// ps.mu. The caller must hold ps.mu.
+// Returns:
+// []subscribedEvent - The subscriptions.
+func (ps *PubSub) takeSubscribedLocked() []subscribedEvent {
+	subscribed := ps.callbacks.subscribed
+	ps.callbacks.subscribed = nil
+	return subscribed
+}
+
+// Function to release ps.mu and run the subscribe callbacks of the subscriptions made
+// while it was held. The caller must hold ps.mu.
+func (ps *PubSub) unlockRunningSubscribeCallbacks() {
+	subscribed := ps.takeSubscribedLocked()
+	ps.mu.Unlock()
+	ps.runSubscribeCallbacks(subscribed)
+}
+
+// Function to run the subscribe callbacks of subscriptions. The caller must not hold ps.mu.
+// Parameters:
+// subscribed: []subscribedEvent - The subscriptions, taken by takeSubscribedLocked.
+func (ps *PubSub) runSubscribeCallbacks(subscribed []subscribedEvent) {
+	if len(subscribed) == 0 {
+		return
+	}
+	ps.mu.Lock()
+	callbacks := ps.callbacks.subscribe
+	ps.mu.Unlock()
+	for _, event := range subscribed {
+		for _, callback := range callbacks {
+			callback(event.client, event.topic)
+		}
+	}
+}
+
+// Function to run the publish callbacks.
+// Parameters:
+// ctx: context.Context - The context of the publish.
+// client: *Client - The publishing client.
+// topic: string - The topic.
+// message: []byte - The message.
+func (ps *PubSub) clientPublished(ctx context.Context, client *Client, topic string, message []byte) {
+	callbacks := ps.callbacks.publish.Load()
+	if callbacks == nil {
+		return
+	}
+	for _, callback := range *callbacks {
+		callback(ctx, client, topic, message)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLifecycleCallbacks(t *testing.T) {
+	pubsub := &PubSub{}
+	var events []string
+	pubsub.OnConnect(func(client *Client) {
+		events = append(events, "connect")
+		client.Send([]byte(`{"action":"greeting"}`))
+	})
+	pubsub.OnSubscribe(func(client *Client, topic string) {
+		events = append(events, "subscribe "+topic)
+		// Callbacks may call back into the PubSub
+		assert.Len(t, pubsub.GetSubscriptions(topic, client), 1)
+	})
+	pubsub.OnPublish(func(ctx context.Context, client *Client, topic string, message []byte) {
+		events = append(events, "publish "+topic+" "+string(message))
+	})
+	pubsub.OnDisconnect(func(client *Client) {
+		events = append(events, "disconnect")
+	})
+	client, peer := newTestClient(t)
+
+	pubsub.AddClient(client)
+	assert.JSONEq(t, `{"action":"greeting"}`, string(mustRead(t, peer)), "Connect callbacks can greet the client")
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"orders"}`))
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"orders"}`))
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"publish","topic":"orders","message":1}`))
+	mustRead(t, peer)
+	pubsub.RemoveClient(client)
+	assert.Equal(t, []string{"connect", "subscribe orders", "publish orders 1", "disconnect"}, events, "Subscribing again is not a new subscription")
+}
+
+func TestSubscribeCallbacksRunForPromotedClients(t *testing.T) {
+	pubsub := &PubSub{}
+	pubsub.CreateTopic("room", "", TopicPolicy{Capacity: 1, Waitlist: true})
+	var subscribed []string
+	pubsub.OnSubscribe(func(client *Client, topic string) {
+		subscribed = append(subscribed, client.Id)
+	})
+	first, _ := newTestClient(t)
+	second, _ := newTestClient(t)
+	pubsub.Join(&first, "room", SubscribeOptions{})
+	pubsub.Join(&second, "room", SubscribeOptions{})
+	assert.Equal(t, []string{first.Id}, subscribed)
+	pubsub.Unsubscribe(&first, "room")
+	assert.Equal(t, []string{first.Id, second.Id}, subscribed, "Clients leaving a waitlist are subscribed")
+}
+
+func TestSubscribeCallbacksRunBeforeTheSubscribeReturns(t *testing.T) {
+	pubsub := &PubSub{}
+	var mu sync.Mutex
+	called := map[string]bool{}
+	pubsub.OnSubscribe(func(client *Client, topic string) {
+		mu.Lock()
+		defer mu.Unlock()
+		called[client.Id] = true
+	})
+
+	// Each subscription's callbacks run in its own goroutine, not in whichever takes ps.mu next
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client := &Client{Id: fmt.Sprint("client-", i)}
+			pubsub.Subscribe(client, "orders")
+			mu.Lock()
+			defer mu.Unlock()
+			assert.True(t, called[client.Id])
+		}()
+	}
+	wg.Wait()
+}
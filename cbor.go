@@ -0,0 +1,404 @@
+// This file translates frames between JSON and CBOR (RFC 8949) for the CBOR envelope
+// codec. Only the JSON data model is needed: maps with string keys, arrays, strings,
+// numbers, booleans and null. Integers stay integers, byte strings become base64
+// strings, tags are dropped and integer map keys become decimal strings.
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+)
+
+// CBOR major types
+const (
+	cborUnsigned = 0
+	cborNegative = 1
+	cborBytes    = 2
+	cborText     = 3
+	cborArray    = 4
+	cborMap      = 5
+	cborTag      = 6
+	cborSimple   = 7
+)
+
+// Additional information of an item of indefinite length, and the break ending it
+const (
+	cborIndefinite = 31
+	cborBreak      = 0xff
+)
+
+// How deep CBOR items may nest, so a hostile frame cannot exhaust the stack
+const maxCBORDepth = 64
+
+var errCBORTruncated = errors.New("cbor: truncated item")
+
+// Function to translate a JSON document to CBOR.
+// Parameters:
+// data: []byte - The JSON document.
+// Returns:
+// []byte - The CBOR item.
+// error - An error if the document is not valid JSON.
+func jsonToCBOR(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	var buffer bytes.Buffer
+	writeCBOR(&buffer, value)
+	return buffer.Bytes(), nil
+}
+
+// Function to write a decoded JSON value as CBOR.
+// Parameters:
+// buffer: *bytes.Buffer - The buffer written to.
+// value: interface{} - The value, as decoded with json.Decoder.UseNumber.
+func writeCBOR(buffer *bytes.Buffer, value interface{}) {
+	switch value := value.(type) {
+	case nil:
+		buffer.WriteByte(cborSimple<<5 | 22)
+	case bool:
+		if value {
+			buffer.WriteByte(cborSimple<<5 | 21)
+		} else {
+			buffer.WriteByte(cborSimple<<5 | 20)
+		}
+	case json.Number:
+		if n, err := strconv.ParseInt(string(value), 10, 64); err == nil {
+			if n >= 0 {
+				writeCBORHead(buffer, cborUnsigned, uint64(n))
+			} else {
+				writeCBORHead(buffer, cborNegative, uint64(-1-n))
+			}
+			return
+		}
+		f, _ := value.Float64()
+		buffer.WriteByte(cborSimple<<5 | 27)
+		binary.Write(buffer, binary.BigEndian, math.Float64bits(f))
+	case string:
+		writeCBORHead(buffer, cborText, uint64(len(value)))
+		buffer.WriteString(value)
+	case []interface{}:
+		writeCBORHead(buffer, cborArray, uint64(len(value)))
+		for _, item := range value {
+			writeCBOR(buffer, item)
+		}
+	case map[string]interface{}:
+		// Keys are sorted so the same document always encodes the same
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		writeCBORHead(buffer, cborMap, uint64(len(value)))
+		for _, key := range keys {
+			writeCBOR(buffer, key)
+			writeCBOR(buffer, value[key])
+		}
+	}
+}
+
+// Function to write the head of a CBOR item in its shortest form.
+// Parameters:
+// buffer: *bytes.Buffer - The buffer written to.
+// major: byte - The major type.
+// n: uint64 - The argument: the value of an integer, or the length of a string, array or map.
+func writeCBORHead(buffer *bytes.Buffer, major byte, n uint64) {
+	switch {
+	case n < 24:
+		buffer.WriteByte(major<<5 | byte(n))
+	case n <= math.MaxUint8:
+		buffer.Write([]byte{major<<5 | 24, byte(n)})
+	case n <= math.MaxUint16:
+		buffer.WriteByte(major<<5 | 25)
+		binary.Write(buffer, binary.BigEndian, uint16(n))
+	case n <= math.MaxUint32:
+		buffer.WriteByte(major<<5 | 26)
+		binary.Write(buffer, binary.BigEndian, uint32(n))
+	default:
+		buffer.WriteByte(major<<5 | 27)
+		binary.Write(buffer, binary.BigEndian, n)
+	}
+}
+
+// Function to translate a CBOR item to JSON.
+// Parameters:
+// data: []byte - A single CBOR item.
+// Returns:
+// []byte - The JSON document.
+// error - An error if the data is not a single well-formed item or cannot be represented in JSON.
+func cborToJSON(data []byte) ([]byte, error) {
+	reader := &cborReader{data: data}
+	value, err := reader.item(0)
+	if err != nil {
+		return nil, err
+	}
+	if reader.offset != len(data) {
+		return nil, errors.New("cbor: data after the item")
+	}
+	return json.Marshal(value)
+}
+
+// Reader of the items of a CBOR document
+type cborReader struct {
+	data   []byte
+	offset int
+}
+
+// Function to read the head of an item.
+// Returns:
+// byte - The major type.
+// byte - The additional information.
+// uint64 - The argument, 0 for items of indefinite length.
+// error - errCBORTruncated if the data ends within the head.
+func (r *cborReader) head() (byte, byte, uint64, error) {
+	if r.offset >= len(r.data) {
+		return 0, 0, 0, errCBORTruncated
+	}
+	initial := r.data[r.offset]
+	r.offset++
+	major, info := initial>>5, initial&0x1f
+	var size int
+	switch {
+	case info < 24:
+		return major, info, uint64(info), nil
+	case info == cborIndefinite:
+		return major, info, 0, nil
+	case info > 27:
+		return 0, 0, 0, fmt.Errorf("cbor: invalid additional information %d", info)
+	default:
+		size = 1 << (info - 24)
+	}
+	if len(r.data)-r.offset < size {
+		return 0, 0, 0, errCBORTruncated
+	}
+	var n uint64
+	for _, b := range r.data[r.offset : r.offset+size] {
+		n = n<<8 | uint64(b)
+	}
+	r.offset += size
+	return major, info, n, nil
+}
+
+// Function to read n bytes.
+// Parameters:
+// n: uint64 - The number of bytes.
+// Returns:
+// []byte - The bytes.
+// error - errCBORTruncated if fewer bytes are left.
+func (r *cborReader) bytes(n uint64) ([]byte, error) {
+	if n > uint64(len(r.data)-r.offset) {
+		return nil, errCBORTruncated
+	}
+	b := r.data[r.offset : r.offset+int(n)]
+	r.offset += int(n)
+	return b, nil
+}
+
+// Function to tell whether the next byte is the break ending an item of indefinite
+// length, consuming it if so.
+// Returns:
+// bool - True at a break.
+// error - errCBORTruncated if the data ended.
+func (r *cborReader) atBreak() (bool, error) {
+	if r.offset >= len(r.data) {
+		return false, errCBORTruncated
+	}
+	if r.data[r.offset] == cborBreak {
+		r.offset++
+		return true, nil
+	}
+	return false, nil
+}
+
+// Function to read an item as a value json.Marshal encodes.
+// Parameters:
+// depth: int - How deep the item is nested.
+// Returns:
+// interface{} - The value.
+// error - An error if the item is malformed or nested too deep.
+func (r *cborReader) item(depth int) (interface{}, error) {
+	if depth > maxCBORDepth {
+		return nil, errors.New("cbor: items nested too deep")
+	}
+	major, info, n, err := r.head()
+	if err != nil {
+		return nil, err
+	}
+	if info == cborIndefinite && (major == cborUnsigned || major == cborNegative || major == cborTag) {
+		return nil, errors.New("cbor: integer or tag of indefinite length")
+	}
+	switch major {
+	case cborUnsigned:
+		return n, nil
+	case cborNegative:
+		if n > math.MaxInt64 {
+			return -1 - float64(n), nil
+		}
+		return -1 - int64(n), nil
+	case cborBytes, cborText:
+		var data []byte
+		if info == cborIndefinite {
+			// Chunks of the same type, each of definite length
+			for {
+				end, err := r.atBreak()
+				if err != nil {
+					return nil, err
+				}
+				if end {
+					break
+				}
+				chunkMajor, chunkInfo, size, err := r.head()
+				if err != nil {
+					return nil, err
+				}
+				if chunkMajor != major || chunkInfo == cborIndefinite {
+					return nil, errors.New("cbor: invalid chunk of a string of indefinite length")
+				}
+				chunk, err := r.bytes(size)
+				if err != nil {
+					return nil, err
+				}
+				data = append(data, chunk...)
+			}
+		} else if data, err = r.bytes(n); err != nil {
+			return nil, err
+		}
+		if major == cborBytes {
+			return append([]byte{}, data...), nil
+		}
+		if !utf8.Valid(data) {
+			return nil, errors.New("cbor: text string is not valid UTF-8")
+		}
+		return string(data), nil
+	case cborArray:
+		array := []interface{}{}
+		for i := uint64(0); info == cborIndefinite || i < n; i++ {
+			if info == cborIndefinite {
+				if end, err := r.atBreak(); err != nil {
+					return nil, err
+				} else if end {
+					break
+				}
+			} else if n-i > uint64(len(r.data)-r.offset) {
+				// Every item takes at least a byte
+				return nil, errCBORTruncated
+			}
+			value, err := r.item(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, value)
+		}
+		return array, nil
+	case cborMap:
+		object := map[string]interface{}{}
+		for i := uint64(0); info == cborIndefinite || i < n; i++ {
+			if info == cborIndefinite {
+				if end, err := r.atBreak(); err != nil {
+					return nil, err
+				} else if end {
+					break
+				}
+			} else if n-i > uint64(len(r.data)-r.offset) {
+				return nil, errCBORTruncated
+			}
+			key, err := r.item(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			value, err := r.item(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			switch key := key.(type) {
+			case string:
+				object[key] = value
+			case uint64, int64:
+				object[fmt.Sprint(key)] = value
+			default:
+				return nil, fmt.Errorf("cbor: map key of type %T", key)
+			}
+		}
+		return object, nil
+	case cborTag:
+		return r.item(depth + 1)
+	default:
+		return r.simple(info, n)
+	}
+}
+
+// Function to read a simple value or a float.
+// Parameters:
+// info: byte - The additional information of the item.
+// n: uint64 - Its argument.
+// Returns:
+// interface{} - A bool, nil or float64.
+// error - An error for other simple values and a stray break.
+func (r *cborReader) simple(info byte, n uint64) (interface{}, error) {
+	switch info {
+	case 20:
+		return false, nil
+	case 21:
+		return true, nil
+	case 22, 23:
+		return nil, nil
+	case 25:
+		return finite(float16(uint16(n)))
+	case 26:
+		return finite(float64(math.Float32frombits(uint32(n))))
+	case 27:
+		return finite(math.Float64frombits(n))
+	case cborIndefinite:
+		return nil, errors.New("cbor: unexpected break")
+	default:
+		return nil, fmt.Errorf("cbor: unsupported simple value %d", n)
+	}
+}
+
+// Function to refuse the floats JSON cannot represent.
+// Parameters:
+// f: float64 - The float.
+// Returns:
+// interface{} - The float.
+// error - An error for NaN and infinities.
+func finite(f float64) (interface{}, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, fmt.Errorf("cbor: %v cannot be represented in JSON", f)
+	}
+	return f, nil
+}
+
+// Function to decode an IEEE 754 half-precision float.
+// Parameters:
+// bits: uint16 - The encoded float.
+// Returns:
+// float64 - The float.
+func float16(bits uint16) float64 {
+	exponent := int(bits>>10) & 0x1f
+	mantissa := float64(bits & 0x3ff)
+	var f float64
+	switch exponent {
+	case 0:
+		f = math.Ldexp(mantissa, -24)
+	case 0x1f:
+		f = math.Inf(1)
+		if mantissa != 0 {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mantissa+1024, exponent-25)
+	}
+	if bits&0x8000 != 0 {
+		f = -f
+	}
+	return f
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCBORRoundTrip(t *testing.T) {
+	documents := []string{
+		`{"action":"publish","topic":"sensors/42","message":{"t":21.5,"ok":true,"ids":[1,-2,300,70000,5000000000],"note":null}}`,
+		`"Server received the message!"`,
+		`[]`,
+		`{}`,
+		`-9223372036854775808`,
+		`1e300`,
+	}
+	for _, document := range documents {
+		encoded, err := jsonToCBOR([]byte(document))
+		assert.NoError(t, err, document)
+		decoded, err := cborToJSON(encoded)
+		assert.NoError(t, err, document)
+		assert.JSONEq(t, document, string(decoded))
+	}
+}
+
+func TestCBORVectors(t *testing.T) {
+	// Examples of RFC 8949, appendix A
+	vectors := []struct {
+		cbor string
+		json string
+	}{
+		{"00", `0`},
+		{"17", `23`},
+		{"1818", `24`},
+		{"1903e8", `1000`},
+		{"1b000000e8d4a51000", `1000000000000`},
+		{"20", `-1`},
+		{"3903e7", `-1000`},
+		{"f93c00", `1`},
+		{"f9c400", `-4`},
+		{"fa47c35000", `100000`},
+		{"fb3ff199999999999a", `1.1`},
+		{"f4", `false`},
+		{"f6", `null`},
+		{"6449455446", `"IETF"`},
+		{"4401020304", `"AQIDBA=="`},
+		{"c074323031332d30332d32315432303a30343a30305a", `"2013-03-21T20:04:00Z"`},
+		{"83010203", `[1,2,3]`},
+		{"a201020304", `{"1":2,"3":4}`},
+		{"a26161016162820203", `{"a":1,"b":[2,3]}`},
+		{"7f657374726561646d696e67ff", `"streaming"`},
+		{"9f018202039f0405ffff", `[1,[2,3],[4,5]]`},
+		{"bf61610161629f0203ffff", `{"a":1,"b":[2,3]}`},
+	}
+	for _, vector := range vectors {
+		data, _ := hex.DecodeString(vector.cbor)
+		decoded, err := cborToJSON(data)
+		if assert.NoError(t, err, vector.cbor) {
+			assert.JSONEq(t, vector.json, string(decoded), vector.cbor)
+		}
+	}
+
+	encoded, _ := jsonToCBOR([]byte(`{"b":[2,3],"a":1}`))
+	assert.Equal(t, "a26161016162820203", hex.EncodeToString(encoded), "Maps should be encoded with sorted keys")
+}
+
+func TestMalformedCBOR(t *testing.T) {
+	deep := make([]byte, 100)
+	for i := range deep {
+		deep[i] = 0x81
+	}
+	for _, data := range [][]byte{
+		{},
+		{0x19, 0x03},             // truncated integer
+		{0x65, 'a', 'b'},         // truncated string
+		{0x62, 0xff, 0xfe},       // invalid UTF-8
+		{0xf9, 0x7c, 0x00},       // infinity
+		{0xa1, 0x80, 0x01},       // array key
+		{0x01, 0x02},             // data after the item
+		{0xff},                   // stray break
+		{0x1f},                   // integer of indefinite length
+		{0x7f, 0x41, 0x00, 0xff}, // byte chunk in a text string
+		{0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, // huge array
+		deep,
+	} {
+		_, err := cborToJSON(data)
+		assert.Error(t, err, "%x", data)
+	}
+}
@@ -0,0 +1,564 @@
+// This file is the Go client of the server. It speaks the JSON protocol over a
+// WebSocket, delivers the messages of each subscribed topic on a channel of its own,
+// and reconnects with exponential backoff when the connection drops, subscribing again
+// to every topic it was subscribed to. Requests wait for the reply matching their
+// correlation ID in the client's inbox.
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Default settings of a client
+const (
+	defaultMinBackoff = 100 * time.Millisecond
+	defaultMaxBackoff = 30 * time.Second
+	defaultBuffer     = 64
+	writeTimeout      = 10 * time.Second
+	// Prefix of the inbox topics the server delivers replies to
+	inboxPrefix = "$inbox."
+)
+
+var (
+	// ErrClosed is returned by the methods of a closed client.
+	ErrClosed = errors.New("client: closed")
+	// ErrNotConnected is returned when publishing while the client is reconnecting.
+	ErrNotConnected = errors.New("client: not connected")
+	// ErrAlreadySubscribed is returned when subscribing twice to a topic.
+	ErrAlreadySubscribed = errors.New("client: already subscribed")
+)
+
+// Message is a message delivered on a subscribed topic.
+type Message struct {
+	Id    string
+	Topic string
+	// The message as published: JSON as is, any other message decoded from base64
+	Payload []byte
+	// The principal that published the message, set by the server; "" if anonymous
+	Publisher string
+	// Where the replies to a request go and the ID matching them to it; "" for other messages
+	ReplyTo       string
+	CorrelationId string
+}
+
+// ServerError is an error frame the server answered a request with, e.g. a subscribe
+// the client is not allowed to make.
+type ServerError struct {
+	Code    string `json:"code"`
+	Request string `json:"request"`
+	Topic   string `json:"topic"`
+	Reason  string `json:"reason"`
+}
+
+// Function to describe the error.
+// Returns:
+// string - The code, request, topic and reason of the error.
+func (e *ServerError) Error() string {
+	text := "server: " + e.Code
+	if e.Request != "" {
+		text += " " + e.Request
+	}
+	if e.Topic != "" {
+		text += " " + e.Topic
+	}
+	if e.Reason != "" {
+		text += ": " + e.Reason
+	}
+	return text
+}
+
+// Options configures a client. The zero value is usable.
+type Options struct {
+	// Headers of the upgrade request, e.g. Authorization: Bearer <token>
+	Header http.Header
+	// Dialer opening the connection, websocket.DefaultDialer when nil
+	Dialer *websocket.Dialer
+	// Bounds of the exponentially growing delay between reconnection attempts
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Size of the channel of each subscription. Once it is full, reading waits for
+	// the subscriber, so a slow subscriber slows the whole connection down.
+	Buffer int
+	// Called with the error frames of the server and the errors dropping the connection
+	OnError func(err error)
+	// Called with the ID the server gave the client on every successful connection
+	OnConnect func(clientId string)
+}
+
+// A subscribed topic
+type subscription struct {
+	messages chan Message
+	// Closed on unsubscribing, so a delivery waiting for the subscriber gives up
+	done   chan struct{}
+	mu     sync.Mutex
+	closed bool
+}
+
+// Client is a connection to the server that survives reconnections.
+type Client struct {
+	url     string
+	options Options
+
+	// Guards the fields below and serializes writes to the connection
+	mu            sync.Mutex
+	conn          *websocket.Conn
+	clientId      string
+	subscriptions map[string]*subscription
+	closed        bool
+	// Requests waiting for their reply, by correlation ID
+	requests map[string]chan Message
+
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// A frame received from the server
+type frame struct {
+	Action    string          `json:"action"`
+	ClientId  string          `json:"clientId"`
+	Topic     string          `json:"topic"`
+	Id        string          `json:"id"`
+	Publisher string          `json:"publisher"`
+	Message   json.RawMessage `json:"message"`
+	Data      string          `json:"data"`
+	// Reply headers of a request, or of a reply for CorrelationId
+	ReplyTo       string `json:"replyTo"`
+	CorrelationId string `json:"correlationId"`
+	ServerError
+}
+
+// Function to connect to the server. The first connection must succeed; later drops
+// are recovered from in the background until the client is closed.
+// Parameters:
+// ctx: context.Context - Bounds the first connection.
+// url: string - The WebSocket URL of the server, e.g. ws://localhost:8080/ws.
+// options: Options - The settings of the client.
+// Returns:
+// *Client - The connected client.
+// error - An error if the server could not be reached or did not welcome the client.
+func Connect(ctx context.Context, url string, options Options) (*Client, error) {
+	if options.Dialer == nil {
+		options.Dialer = websocket.DefaultDialer
+	}
+	if options.MinBackoff <= 0 {
+		options.MinBackoff = defaultMinBackoff
+	}
+	if options.MaxBackoff < options.MinBackoff {
+		options.MaxBackoff = max(defaultMaxBackoff, options.MinBackoff)
+	}
+	if options.Buffer <= 0 {
+		options.Buffer = defaultBuffer
+	}
+
+	c := &Client{
+		url:           url,
+		options:       options,
+		subscriptions: map[string]*subscription{},
+		requests:      map[string]chan Message{},
+		done:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+	}
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	go c.run(conn)
+	return c, nil
+}
+
+// Function to open a connection and subscribe again to every topic.
+// Parameters:
+// ctx: context.Context - Bounds the connection.
+// Returns:
+// *websocket.Conn - The connection.
+// error - An error if the server could not be reached or did not welcome the client.
+func (c *Client) dial(ctx context.Context) (*websocket.Conn, error) {
+	conn, _, err := c.options.Dialer.DialContext(ctx, c.url, c.options.Header)
+	if err != nil {
+		return nil, err
+	}
+
+	// The server greets every connection with its client ID
+	deadline := time.Now().Add(writeTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn.SetReadDeadline(deadline)
+	var welcome frame
+	if err := conn.ReadJSON(&welcome); err != nil || welcome.Action != "welcome" {
+		conn.Close()
+		if err == nil {
+			err = fmt.Errorf("client: expected a welcome frame, got %q", welcome.Action)
+		}
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		conn.Close()
+		return nil, ErrClosed
+	}
+	c.conn = conn
+	c.clientId = welcome.ClientId
+	for topic := range c.subscriptions {
+		if err := c.writeLocked(map[string]interface{}{"action": "subscribe", "topic": topic, "envelope": true}); err != nil {
+			// The reader notices the broken connection and reconnects
+			break
+		}
+	}
+	c.mu.Unlock()
+
+	if c.options.OnConnect != nil {
+		c.options.OnConnect(welcome.ClientId)
+	}
+	return conn, nil
+}
+
+// Function to read the connection until the client is closed, reconnecting whenever
+// the connection drops.
+// Parameters:
+// conn: *websocket.Conn - The first connection.
+func (c *Client) run(conn *websocket.Conn) {
+	defer close(c.stopped)
+	for {
+		err := c.read(conn)
+
+		c.mu.Lock()
+		c.conn = nil
+		closed := c.closed
+		c.mu.Unlock()
+		conn.Close()
+		if closed {
+			return
+		}
+		c.reportError(err)
+
+		backoff := c.options.MinBackoff
+		for {
+			// Waiting between half and all of the backoff spreads out the clients
+			// of a restarted server
+			wait := backoff/2 + rand.N(backoff/2+1)
+			select {
+			case <-c.done:
+				return
+			case <-time.After(wait):
+			}
+			// Closing the client abandons the attempt
+			ctx, cancel := context.WithTimeout(context.Background(), c.options.MaxBackoff)
+			go func() {
+				select {
+				case <-c.done:
+					cancel()
+				case <-ctx.Done():
+				}
+			}()
+			conn, err = c.dial(ctx)
+			cancel()
+			if err == nil {
+				break
+			}
+			if errors.Is(err, ErrClosed) {
+				return
+			}
+			c.reportError(err)
+			backoff = min(backoff*2, c.options.MaxBackoff)
+		}
+	}
+}
+
+// Function to read frames from a connection until it fails.
+// Parameters:
+// conn: *websocket.Conn - The connection.
+// Returns:
+// error - The error that ended the connection.
+func (c *Client) read(conn *websocket.Conn) error {
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		var f frame
+		if json.Unmarshal(data, &f) != nil {
+			continue
+		}
+		switch f.Action {
+		case "message":
+			message := Message{Id: f.Id, Topic: f.Topic, Payload: f.Message, Publisher: f.Publisher,
+				ReplyTo: f.ReplyTo, CorrelationId: f.CorrelationId}
+			if f.Data != "" {
+				if message.Payload, err = base64.StdEncoding.DecodeString(f.Data); err != nil {
+					continue
+				}
+			}
+			c.deliver(message)
+		case "error":
+			// The topic of the frame shadows the topic of the embedded error
+			serverError := f.ServerError
+			serverError.Topic = f.Topic
+			c.reportError(&serverError)
+		}
+	}
+}
+
+// Function to hand a message to the request it replies to, or else to the subscription
+// of its topic, waiting for the subscriber if its channel is full.
+// Parameters:
+// message: Message - The message.
+func (c *Client) deliver(message Message) {
+	c.mu.Lock()
+	if reply, ok := c.requests[message.CorrelationId]; ok && strings.HasPrefix(message.Topic, inboxPrefix) {
+		delete(c.requests, message.CorrelationId)
+		c.mu.Unlock()
+		reply <- message
+		return
+	}
+	sub := c.subscriptions[message.Topic]
+	c.mu.Unlock()
+	if sub == nil {
+		return
+	}
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.closed {
+		return
+	}
+	select {
+	case sub.messages <- message:
+	case <-sub.done:
+	case <-c.done:
+	}
+}
+
+// Function to pass an error to the OnError callback, if any.
+// Parameters:
+// err: error - The error.
+func (c *Client) reportError(err error) {
+	if c.options.OnError != nil && err != nil {
+		c.options.OnError(err)
+	}
+}
+
+// Function to write a frame to the connection; c.mu must be held.
+// Parameters:
+// v: interface{} - The frame, encoded as JSON.
+// Returns:
+// error - ErrNotConnected while reconnecting, or the error writing the frame.
+func (c *Client) writeLocked(v interface{}) error {
+	if c.conn == nil {
+		return ErrNotConnected
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return c.conn.WriteJSON(v)
+}
+
+// Function to get the ID the server gave the current connection.
+// Returns:
+// string - The client ID, which changes when the client reconnects.
+func (c *Client) ID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.clientId
+}
+
+// Function to subscribe to a topic. The subscription is made again after every
+// reconnection until Unsubscribe or Close closes the channel. The server does not
+// acknowledge subscriptions; refusals are reported to OnError.
+// Parameters:
+// topic: string - The topic.
+// Returns:
+// <-chan Message - The messages published to the topic.
+// error - ErrAlreadySubscribed, ErrClosed, or an error writing the subscribe frame.
+func (c *Client) Subscribe(topic string) (<-chan Message, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, ErrClosed
+	}
+	if _, ok := c.subscriptions[topic]; ok {
+		return nil, ErrAlreadySubscribed
+	}
+	sub := &subscription{messages: make(chan Message, c.options.Buffer), done: make(chan struct{})}
+	c.subscriptions[topic] = sub
+	// While reconnecting, the subscription is made once connected
+	err := c.writeLocked(map[string]interface{}{"action": "subscribe", "topic": topic, "envelope": true})
+	if err != nil && !errors.Is(err, ErrNotConnected) {
+		delete(c.subscriptions, topic)
+		return nil, err
+	}
+	return sub.messages, nil
+}
+
+// Function to unsubscribe from a topic and close the channel of its messages.
+// Parameters:
+// topic: string - The topic.
+// Returns:
+// error - An error writing the unsubscribe frame; the channel is closed anyway.
+func (c *Client) Unsubscribe(topic string) error {
+	c.mu.Lock()
+	sub, ok := c.subscriptions[topic]
+	delete(c.subscriptions, topic)
+	var err error
+	if ok {
+		err = c.writeLocked(map[string]string{"action": "unsubscribe", "topic": topic})
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	sub.close()
+	if errors.Is(err, ErrNotConnected) {
+		// The reconnection does not subscribe again
+		return nil
+	}
+	return err
+}
+
+// Function to close the channel of a subscription once no delivery is waiting on it.
+func (s *subscription) close() {
+	close(s.done)
+	s.mu.Lock()
+	s.closed = true
+	close(s.messages)
+	s.mu.Unlock()
+}
+
+// Function to publish a message to a topic.
+// Parameters:
+// topic: string - The topic.
+// message: interface{} - The message, encoded as JSON; json.RawMessage is sent as is.
+// Returns:
+// error - ErrNotConnected while reconnecting, ErrClosed, or an error encoding or writing the message.
+func (c *Client) Publish(topic string, message interface{}) error {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	return c.writeLocked(map[string]interface{}{"action": "publish", "topic": topic, "message": json.RawMessage(payload)})
+}
+
+// Function to publish binary data to a topic, e.g. audio or sensor readings.
+// Subscribers receive it in binary frames, or base64 encoded in their envelopes.
+// Parameters:
+// topic: string - The topic.
+// data: []byte - The data.
+// Returns:
+// error - ErrNotConnected while reconnecting, ErrClosed, or an error writing the message.
+func (c *Client) PublishBinary(topic string, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	return c.writeLocked(map[string]interface{}{"action": "publish", "topic": topic, "data": data})
+}
+
+// Function to publish a request to a topic and wait for the first reply to it. The
+// server subscribes the client to its inbox and gives the request a correlation ID
+// that responders reply with. A reply sent while the client reconnects is lost, as
+// the inbox changes with the client ID.
+// Parameters:
+// ctx: context.Context - Bounds the wait for the reply.
+// topic: string - The topic.
+// message: interface{} - The request, encoded as JSON; json.RawMessage is sent as is.
+// Returns:
+// Message - The reply.
+// error - ErrNotConnected while reconnecting, ErrClosed, an error encoding or writing the request, or the error of ctx.
+func (c *Client) Request(ctx context.Context, topic string, message interface{}) (Message, error) {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return Message{}, err
+	}
+	correlationId := fmt.Sprintf("%016x", rand.Uint64())
+	reply := make(chan Message, 1)
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return Message{}, ErrClosed
+	}
+	c.requests[correlationId] = reply
+	err = c.writeLocked(map[string]interface{}{"action": "request", "topic": topic, "message": json.RawMessage(payload), "correlationId": correlationId})
+	c.mu.Unlock()
+	if err == nil {
+		select {
+		case message := <-reply:
+			return message, nil
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-c.done:
+			err = ErrClosed
+		}
+	}
+	c.mu.Lock()
+	delete(c.requests, correlationId)
+	c.mu.Unlock()
+	return Message{}, err
+}
+
+// Function to reply to a request received on a subscribed topic.
+// Parameters:
+// request: Message - The request, carrying where to reply and its correlation ID.
+// message: interface{} - The reply, encoded as JSON; json.RawMessage is sent as is.
+// Returns:
+// error - An error if the message is not a request, ErrNotConnected while reconnecting, ErrClosed, or an error encoding or writing the reply.
+func (c *Client) Reply(request Message, message interface{}) error {
+	if request.ReplyTo == "" {
+		return fmt.Errorf("client: message %s is not a request", request.Id)
+	}
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	return c.writeLocked(map[string]interface{}{"action": "publish", "topic": request.ReplyTo, "message": json.RawMessage(payload), "correlationId": request.CorrelationId})
+}
+
+// Function to close the connection, stop reconnecting and close the channels of every
+// subscription.
+// Returns:
+// error - ErrClosed if the client was already closed.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrClosed
+	}
+	c.closed = true
+	close(c.done)
+	if c.conn != nil {
+		c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+		c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+		c.conn.Close()
+	}
+	subscriptions := c.subscriptions
+	c.subscriptions = map[string]*subscription{}
+	c.mu.Unlock()
+
+	<-c.stopped
+	for _, sub := range subscriptions {
+		sub.close()
+	}
+	return nil
+}
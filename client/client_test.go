@@ -0,0 +1,227 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// A server speaking enough of the protocol for the client: it welcomes connections,
+// echoes publishes to the connection's own subscriptions in envelopes, answers
+// requests from the inbox and refuses topics starting with "secret"
+type fakeServer struct {
+	*httptest.Server
+	mu          sync.Mutex
+	connections int
+	subscribes  []string
+	conns       []*websocket.Conn
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	server := &fakeServer{}
+	upgrader := websocket.Upgrader{}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		server.mu.Lock()
+		server.connections++
+		server.conns = append(server.conns, ws)
+		ws.WriteJSON(map[string]string{"action": "welcome", "clientId": fmt.Sprint("c", server.connections)})
+		server.mu.Unlock()
+
+		subscribed := map[string]bool{}
+		for {
+			var m struct {
+				Action        string          `json:"action"`
+				Topic         string          `json:"topic"`
+				Message       json.RawMessage `json:"message"`
+				Data          []byte          `json:"data"`
+				Envelope      bool            `json:"envelope"`
+				CorrelationId string          `json:"correlationId"`
+			}
+			if err := ws.ReadJSON(&m); err != nil {
+				return
+			}
+			switch m.Action {
+			case "subscribe":
+				server.mu.Lock()
+				server.subscribes = append(server.subscribes, m.Topic)
+				server.mu.Unlock()
+				if len(m.Topic) >= 6 && m.Topic[:6] == "secret" {
+					ws.WriteJSON(map[string]string{"action": "error", "code": "forbidden", "request": "subscribe", "topic": m.Topic})
+					continue
+				}
+				subscribed[m.Topic] = m.Envelope
+			case "unsubscribe":
+				delete(subscribed, m.Topic)
+			case "request":
+				// A stray reply first, then the reply to the request
+				for _, correlationId := range []string{"other", m.CorrelationId} {
+					ws.WriteJSON(map[string]interface{}{"action": "message", "topic": "$inbox.c1", "id": "r1", "message": m.Message, "correlationId": correlationId})
+				}
+			case "publish":
+				if subscribed[m.Topic] && m.Data != nil {
+					ws.WriteJSON(map[string]interface{}{"action": "message", "topic": m.Topic, "id": "m1", "data": m.Data})
+				} else if subscribed[m.Topic] {
+					ws.WriteJSON(map[string]interface{}{"action": "message", "topic": m.Topic, "id": "m1", "publisher": "alice", "message": m.Message})
+				}
+				// Binary messages are base64 encoded in their envelope
+				if subscribed["binary"] {
+					ws.WriteJSON(map[string]string{"action": "message", "topic": "binary", "id": "m2", "data": "AAE="})
+				}
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// Function to drop every connection, as a restarting server would.
+func (s *fakeServer) dropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+func (s *fakeServer) url() string {
+	return "ws" + s.URL[4:]
+}
+
+func receive(t *testing.T, messages <-chan Message) Message {
+	t.Helper()
+	select {
+	case message := <-messages:
+		return message
+	case <-time.After(2 * time.Second):
+		t.Fatal("No message received")
+		return Message{}
+	}
+}
+
+func TestSubscribeAndPublish(t *testing.T) {
+	server := newFakeServer(t)
+	errs := make(chan error, 1)
+	client, err := Connect(context.Background(), server.url(), Options{OnError: func(err error) { errs <- err }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	assert.Equal(t, "c1", client.ID())
+
+	news, err := client.Subscribe("news")
+	assert.NoError(t, err)
+	_, err = client.Subscribe("news")
+	assert.ErrorIs(t, err, ErrAlreadySubscribed)
+	binary, err := client.Subscribe("binary")
+	assert.NoError(t, err)
+
+	assert.NoError(t, client.Publish("news", map[string]string{"headline": "hello"}))
+	message := receive(t, news)
+	assert.Equal(t, "news", message.Topic)
+	assert.Equal(t, "m1", message.Id)
+	assert.Equal(t, "alice", message.Publisher)
+	assert.JSONEq(t, `{"headline":"hello"}`, string(message.Payload))
+	assert.Equal(t, []byte{0, 1}, receive(t, binary).Payload)
+	assert.NoError(t, client.PublishBinary("news", []byte{0xff, 0x00}))
+	assert.Equal(t, []byte{0xff, 0x00}, receive(t, news).Payload)
+	receive(t, binary)
+
+	_, err = client.Subscribe("secret-plans")
+	assert.NoError(t, err)
+	select {
+	case err := <-errs:
+		assert.Equal(t, &ServerError{Code: "forbidden", Request: "subscribe", Topic: "secret-plans"}, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("The refusal should be reported")
+	}
+
+	assert.NoError(t, client.Unsubscribe("news"))
+	_, open := <-news
+	assert.False(t, open, "Unsubscribing should close the channel")
+}
+
+func TestReconnectSubscribesAgain(t *testing.T) {
+	server := newFakeServer(t)
+	connected := make(chan string, 4)
+	client, err := Connect(context.Background(), server.url(), Options{
+		MinBackoff: 10 * time.Millisecond,
+		MaxBackoff: 50 * time.Millisecond,
+		OnConnect:  func(clientId string) { connected <- clientId },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "c1", <-connected)
+	news, err := client.Subscribe("news")
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		return len(server.subscribes) == 1
+	}, time.Second, 5*time.Millisecond)
+
+	server.dropConnections()
+	select {
+	case clientId := <-connected:
+		assert.Equal(t, "c2", clientId)
+	case <-time.After(2 * time.Second):
+		t.Fatal("The client should reconnect")
+	}
+	assert.Equal(t, "c2", client.ID())
+
+	assert.Eventually(t, func() bool {
+		return client.Publish("news", "again") == nil
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, `"again"`, string(receive(t, news).Payload), "The subscription should survive the reconnection")
+	server.mu.Lock()
+	assert.Equal(t, []string{"news", "news"}, server.subscribes)
+	server.mu.Unlock()
+
+	assert.NoError(t, client.Close())
+	_, open := <-news
+	assert.False(t, open, "Closing should close every channel")
+	assert.ErrorIs(t, client.Close(), ErrClosed)
+	assert.ErrorIs(t, client.Publish("news", "late"), ErrClosed)
+	_, err = client.Subscribe("news")
+	assert.ErrorIs(t, err, ErrClosed)
+}
+
+func TestConnectFails(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	_, err := Connect(context.Background(), "ws"+server.URL[4:], Options{})
+	assert.Error(t, err)
+}
+
+func TestRequestAndReply(t *testing.T) {
+	server := newFakeServer(t)
+	client, err := Connect(context.Background(), server.url(), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	reply, err := client.Request(ctx, "quotes", map[string]string{"symbol": "ACME"})
+	assert.NoError(t, err)
+	assert.Equal(t, "$inbox.c1", reply.Topic)
+	assert.NotEqual(t, "other", reply.CorrelationId, "Only the reply with the request's correlation ID should answer it")
+	assert.JSONEq(t, `{"symbol":"ACME"}`, string(reply.Payload))
+
+	assert.Error(t, client.Reply(Message{Id: "m1"}, "not a request"))
+}
@@ -0,0 +1,230 @@
+// This file decides the IDs of the clients connecting over WebSocket, TCP and MQTT. A
+// ClientIDProvider derives the ID from the connection request and the verified claims
+// of the client: a random UUID by default, or a sequential counter, a request header or
+// a claim of the token, so IDs can stay the same across reconnects. An ID is held by one
+// connection at a time: a client connecting with the ID of a connected client replaces
+// it, the older connection being closed with the replaced reason and torn down before
+// the newer one is added, so its subscriptions and state are never mixed with those of
+// the newer connection.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ClientIDProvider decides the ID of a connecting client.
+type ClientIDProvider interface {
+	// ClientID returns the ID of the client of a connection request, whose claims are nil
+	// when it is anonymous. TCP and MQTT clients are given the request their connect
+	// frame or packet stands for, which only carries their credentials.
+	ClientID(r *http.Request, claims jwt.MapClaims) (string, error)
+}
+
+// Longest client ID, in bytes
+const maxClientIDLength = 128
+
+// How long a client waits for the connection holding its ID to be torn down, and how
+// often that connection is looked for while it is not yet added
+const (
+	replaceWait  = 5 * time.Second
+	replaceRetry = 50 * time.Millisecond
+)
+
+var (
+	errNoClientID    = errors.New("the request carries no client ID")
+	errClientIDInUse = errors.New("the client ID is held by a connection that did not close")
+)
+
+// UUIDClientIDs gives every client a random UUID.
+type UUIDClientIDs struct{}
+
+// Function to give a client a random UUID.
+// Parameters:
+// r: *http.Request - The connection request.
+// claims: jwt.MapClaims - The claims of the client, or nil.
+// Returns:
+// string - The ID.
+// error - Always nil.
+func (UUIDClientIDs) ClientID(r *http.Request, claims jwt.MapClaims) (string, error) {
+	return autoId(), nil
+}
+
+// SequentialClientIDs numbers the clients in the order they connect, from 1. The IDs are
+// unique within the process only, not across restarts nor instances.
+type SequentialClientIDs struct {
+	// Prefix of the IDs, e.g. "conn-"
+	Prefix string
+	next   atomic.Uint64
+}
+
+// Function to give a client the next number.
+// Parameters:
+// r: *http.Request - The connection request.
+// claims: jwt.MapClaims - The claims of the client, or nil.
+// Returns:
+// string - The ID.
+// error - Always nil.
+func (s *SequentialClientIDs) ClientID(r *http.Request, claims jwt.MapClaims) (string, error) {
+	return s.Prefix + strconv.FormatUint(s.next.Add(1), 10), nil
+}
+
+// HeaderClientIDs takes the ID of a client from a header of its request. Clients can set
+// any header, so the header must be set by a gateway in front of the server that
+// overwrites what clients send.
+type HeaderClientIDs struct {
+	// Header carrying the ID, e.g. "X-Client-Id"
+	Header string
+	// Provider of the IDs of requests without the header, nil to refuse them
+	Fallback ClientIDProvider
+}
+
+// Function to take the ID of a client from the header of its request.
+// Parameters:
+// r: *http.Request - The connection request.
+// claims: jwt.MapClaims - The claims of the client, or nil.
+// Returns:
+// string - The ID.
+// error - errNoClientID if the request has no header and there is no fallback.
+func (h HeaderClientIDs) ClientID(r *http.Request, claims jwt.MapClaims) (string, error) {
+	if id := strings.TrimSpace(r.Header.Get(h.Header)); id != "" {
+		return id, nil
+	}
+	return fallbackClientID(h.Fallback, r, claims)
+}
+
+// ClaimClientIDs takes the ID of a client from a claim of its token, e.g. "sub", so every
+// connection of a user, or of a device its token was minted for, has the same ID.
+type ClaimClientIDs struct {
+	// Claim carrying the ID, a string or a number
+	Claim string
+	// Provider of the IDs of clients without the claim, anonymous ones included, nil to refuse them
+	Fallback ClientIDProvider
+}
+
+// Function to take the ID of a client from the claim of its token.
+// Parameters:
+// r: *http.Request - The connection request.
+// claims: jwt.MapClaims - The claims of the client, or nil.
+// Returns:
+// string - The ID.
+// error - errNoClientID if the client has no claim and there is no fallback.
+func (c ClaimClientIDs) ClientID(r *http.Request, claims jwt.MapClaims) (string, error) {
+	switch value := claims[c.Claim].(type) {
+	case string:
+		if value != "" {
+			return value, nil
+		}
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), nil
+	}
+	return fallbackClientID(c.Fallback, r, claims)
+}
+
+// Function to ask the fallback of a provider for an ID.
+// Parameters:
+// fallback: ClientIDProvider - The fallback, or nil.
+// r: *http.Request - The connection request.
+// claims: jwt.MapClaims - The claims of the client, or nil.
+// Returns:
+// string - The ID.
+// error - errNoClientID if there is no fallback.
+func fallbackClientID(fallback ClientIDProvider, r *http.Request, claims jwt.MapClaims) (string, error) {
+	if fallback == nil {
+		return "", errNoClientID
+	}
+	return fallback.ClientID(r, claims)
+}
+
+// Function to parse the provider of client IDs.
+// Parameters:
+// value: string - uuid, sequential or sequential:<prefix>, header:<name> or claim:<name>.
+// Returns:
+// ClientIDProvider - The provider; header and claim providers fall back to UUIDs.
+// error - An error if the provider is unknown or lacks its name.
+func ParseClientIDProvider(value string) (ClientIDProvider, error) {
+	kind, argument, _ := strings.Cut(value, ":")
+	switch {
+	case value == "" || value == "uuid":
+		return UUIDClientIDs{}, nil
+	case kind == "sequential":
+		return &SequentialClientIDs{Prefix: argument}, nil
+	case kind == "header" && argument != "":
+		return HeaderClientIDs{Header: argument, Fallback: UUIDClientIDs{}}, nil
+	case kind == "claim" && argument != "":
+		return ClaimClientIDs{Claim: argument, Fallback: UUIDClientIDs{}}, nil
+	}
+	return nil, fmt.Errorf("unknown client ID provider %q", value)
+}
+
+// Function to get the ID of a connecting client from the provider and check it.
+// Parameters:
+// r: *http.Request - The connection request.
+// claims: jwt.MapClaims - The claims of the client, or nil.
+// Returns:
+// string - The ID.
+// error - An error if the provider failed or gave an ID that is empty, too long, or has spaces, control characters or slashes.
+func (options *serverOptions) newClientID(r *http.Request, claims jwt.MapClaims) (string, error) {
+	id, err := options.clientIDs.ClientID(r, claims)
+	if err != nil {
+		return "", err
+	}
+	if id == "" || len(id) > maxClientIDLength || strings.ContainsFunc(id, func(c rune) bool {
+		return c == '/' || unicode.IsSpace(c) || !unicode.IsPrint(c)
+	}) {
+		return "", fmt.Errorf("invalid client ID %q", id)
+	}
+	return id, nil
+}
+
+// Function to hold a client ID for a connection, replacing the connection holding it.
+// The older connection is closed and its teardown awaited, so it no longer shares the ID
+// once this returns.
+// Parameters:
+// id: string - The ID.
+// Returns:
+// func() - Releases the ID; deferred before removing the client, so it runs once the client was removed.
+// error - errClientIDInUse if the connection holding the ID was not torn down in time.
+func (ps *PubSub) claimClientID(id string) (func(), error) {
+	deadline := time.NewTimer(replaceWait)
+	defer deadline.Stop()
+	kicked := false
+	for {
+		ps.mu.Lock()
+		held, taken := ps.heldClientIDs[id]
+		if !taken {
+			if ps.heldClientIDs == nil {
+				ps.heldClientIDs = map[string]chan struct{}{}
+			}
+			released := make(chan struct{})
+			ps.heldClientIDs[id] = released
+			ps.mu.Unlock()
+			return func() {
+				ps.mu.Lock()
+				delete(ps.heldClientIDs, id)
+				ps.mu.Unlock()
+				close(released)
+			}, nil
+		}
+		ps.mu.Unlock()
+
+		// The connection holding the ID may not be added yet, so it is looked for again
+		if !kicked {
+			kicked = ps.Kick(id, ReasonReplaced) == nil
+		}
+		select {
+		case <-held:
+		case <-time.After(replaceRetry):
+		case <-deadline.C:
+			return nil, errClientIDInUse
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientIDProviders(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	id, err := UUIDClientIDs{}.ClientID(r, nil)
+	assert.NoError(t, err)
+	assert.Len(t, id, 36)
+
+	sequential := &SequentialClientIDs{Prefix: "conn-"}
+	first, _ := sequential.ClientID(r, nil)
+	second, _ := sequential.ClientID(r, nil)
+	assert.Equal(t, []string{"conn-1", "conn-2"}, []string{first, second})
+
+	header := HeaderClientIDs{Header: "X-Client-Id"}
+	_, err = header.ClientID(r, nil)
+	assert.ErrorIs(t, err, errNoClientID, "Requests without the header are refused without a fallback")
+	header.Fallback = sequential
+	id, _ = header.ClientID(r, nil)
+	assert.Equal(t, "conn-3", id)
+	r.Header.Set("X-Client-Id", "device-7")
+	id, _ = header.ClientID(r, nil)
+	assert.Equal(t, "device-7", id)
+
+	claim := ClaimClientIDs{Claim: "sub"}
+	id, _ = claim.ClientID(r, jwt.MapClaims{"sub": "alice"})
+	assert.Equal(t, "alice", id)
+	id, _ = claim.ClientID(r, jwt.MapClaims{"sub": float64(42)})
+	assert.Equal(t, "42", id)
+	_, err = claim.ClientID(r, nil)
+	assert.ErrorIs(t, err, errNoClientID, "Anonymous clients are refused without a fallback")
+}
+
+func TestParseClientIDProvider(t *testing.T) {
+	for value, want := range map[string]ClientIDProvider{
+		"":                 UUIDClientIDs{},
+		"uuid":             UUIDClientIDs{},
+		"sequential:conn-": &SequentialClientIDs{Prefix: "conn-"},
+		"header:X-Id":      HeaderClientIDs{Header: "X-Id", Fallback: UUIDClientIDs{}},
+		"claim:sub":        ClaimClientIDs{Claim: "sub", Fallback: UUIDClientIDs{}},
+	} {
+		provider, err := ParseClientIDProvider(value)
+		assert.NoError(t, err, value)
+		assert.Equal(t, want, provider, value)
+	}
+	for _, value := range []string{"random", "header", "claim:"} {
+		_, err := ParseClientIDProvider(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestNewClientIDRefusesInvalidIDs(t *testing.T) {
+	options := newServerOptions()
+	options.clientIDs = HeaderClientIDs{Header: "X-Client-Id"}
+	for _, id := range []string{"a/b", "a\tb", "a\x00b", strings.Repeat("x", maxClientIDLength+1)} {
+		r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+		r.Header.Set("X-Client-Id", id)
+		_, err := options.newClientID(r, nil)
+		assert.Error(t, err, "%q should be refused", id)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	r.Header.Set("X-Client-Id", "auth0|1234")
+	id, err := options.newClientID(r, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "auth0|1234", id)
+}
+
+func TestClientWithHeldIDReplacesConnection(t *testing.T) {
+	options := isolatePubSub(t)
+	options.clientIDs = HeaderClientIDs{Header: "X-Client-Id"}
+	server := httptest.NewServer(http.HandlerFunc(ps.webSocketHandler))
+	t.Cleanup(server.Close)
+	dial := func() *websocket.Conn {
+		ws, _, err := websocket.DefaultDialer.Dial("ws"+server.URL[4:], http.Header{"X-Client-Id": {"device-1"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ws.Close() })
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		assert.Equal(t, "device-1", readFrame(t, ws)["clientId"])
+		return ws
+	}
+	subscribed := func() bool {
+		subs := ps.topicSubscriptions("news")
+		return len(subs) == 1 && subs[0].Client.Id == "device-1"
+	}
+
+	older := dial()
+	assert.NoError(t, older.WriteMessage(websocket.TextMessage, []byte(`{"action":"subscribe","topic":"news"}`)))
+	assert.Eventually(t, subscribed, 2*time.Second, 5*time.Millisecond)
+
+	newer := dial()
+	for {
+		if _, _, err := older.ReadMessage(); err != nil {
+			assert.True(t, websocket.IsCloseError(err, CloseReplaced), "The older connection is closed as replaced, got %v", err)
+			break
+		}
+	}
+	assert.Empty(t, ps.topicSubscriptions("news"), "The older connection was torn down before the newer one was added")
+
+	assert.NoError(t, newer.WriteMessage(websocket.TextMessage, []byte(`{"action":"subscribe","topic":"news"}`)))
+	assert.Eventually(t, subscribed, 2*time.Second, 5*time.Millisecond)
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	assert.Len(t, ps.Clients(), 1)
+}
@@ -0,0 +1,108 @@
+// This file finds the address a client connects from. Behind a load balancer or reverse
+// proxy every request comes from the proxy, so when the peer of a request is one of the
+// trusted proxies (TRUSTED_PROXIES, a comma separated list of IPs and CIDR ranges) the
+// client is the last address of X-Forwarded-For that is not a trusted proxy itself, or
+// X-Real-IP when there is no X-Forwarded-For. Headers sent by any other peer are ignored,
+// as clients could forge them.
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Function to parse the trusted proxies.
+// Parameters:
+// entries: []string - IPs and CIDR ranges.
+// Returns:
+// []*net.IPNet - The ranges, single IPs being ranges of one address.
+// error - An error if an entry is neither an IP nor a CIDR range.
+func parseTrustedProxies(entries []string) ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("trusted proxy %q is neither an IP nor a CIDR range", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q: %w", entry, err)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+// Function to check whether an address is a trusted proxy.
+// Parameters:
+// ip: net.IP - The address.
+// Returns:
+// bool - True if a trusted range contains it.
+func (options *serverOptions) isTrustedProxy(ip net.IP) bool {
+	for _, network := range options.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Function to get the IP of a network address.
+// Parameters:
+// addr: string - The address, with or without a port.
+// Returns:
+// string - The IP, or the address as is if it is not host:port.
+func hostOf(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// Function to find the IP a request comes from, trusting the forwarding headers of trusted proxies only.
+// Parameters:
+// r: *http.Request - The request.
+// Returns:
+// string - The IP of the client.
+func (options *serverOptions) clientIP(r *http.Request) string {
+	peer := hostOf(r.RemoteAddr)
+	ip := net.ParseIP(peer)
+	if ip == nil || !options.isTrustedProxy(ip) {
+		return peer
+	}
+	header := r.Header.Values("X-Forwarded-For")
+	if len(header) == 0 {
+		if real := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); real != nil {
+			return real.String()
+		}
+		return peer
+	}
+	// Each proxy appends the address it received the request from
+	client := peer
+	forwarded := strings.Split(strings.Join(header, ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if hop == nil {
+			break
+		}
+		client = hop.String()
+		if !options.isTrustedProxy(hop) {
+			break
+		}
+	}
+	return client
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8", " 192.0.2.1 ", "", "2001:db8::1"})
+	assert.NoError(t, err)
+	if assert.Len(t, proxies, 3) {
+		assert.Equal(t, "10.0.0.0/8", proxies[0].String())
+		assert.Equal(t, "192.0.2.1/32", proxies[1].String())
+		assert.Equal(t, "2001:db8::1/128", proxies[2].String())
+	}
+
+	_, err = parseTrustedProxies([]string{"proxy.internal"})
+	assert.Error(t, err)
+	_, err = parseTrustedProxies([]string{"10.0.0.0/33"})
+	assert.Error(t, err)
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8"})
+	assert.NoError(t, err)
+	options := &serverOptions{trustedProxies: proxies}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		realIP     string
+		want       string
+	}{
+		{"direct", "192.0.2.7:5000", nil, "", "192.0.2.7"},
+		{"untrusted peer", "192.0.2.7:5000", []string{"198.51.100.1"}, "198.51.100.2", "192.0.2.7"},
+		{"forwarded", "10.0.0.1:5000", []string{"198.51.100.1"}, "", "198.51.100.1"},
+		{"forged hops", "10.0.0.1:5000", []string{"203.0.113.9, 198.51.100.1, 10.0.0.2"}, "", "198.51.100.1"},
+		{"headers joined", "10.0.0.1:5000", []string{"203.0.113.9", "198.51.100.1"}, "", "198.51.100.1"},
+		{"only proxies", "10.0.0.1:5000", []string{"10.0.0.3, 10.0.0.2"}, "", "10.0.0.3"},
+		{"invalid hop", "10.0.0.1:5000", []string{"198.51.100.1, unknown"}, "", "10.0.0.1"},
+		{"real ip", "10.0.0.1:5000", nil, "198.51.100.2", "198.51.100.2"},
+		{"invalid real ip", "10.0.0.1:5000", nil, "unknown", "10.0.0.1"},
+		{"ipv6", "[2001:db8::7]:5000", nil, "", "2001:db8::7"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/ws", nil)
+			r.RemoteAddr = test.remoteAddr
+			for _, value := range test.forwarded {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			if test.realIP != "" {
+				r.Header.Set("X-Real-IP", test.realIP)
+			}
+			assert.Equal(t, test.want, options.clientIP(r))
+		})
+	}
+}
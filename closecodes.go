@@ -0,0 +1,259 @@
+// This file maps the reasons the server disconnects a client to RFC6455 close codes
+// and builds the machine-readable, localized reason sent in the close frame.
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// DisconnectReason identifies why the server closed a client connection.
+type DisconnectReason string
+
+const (
+	ReasonNormal             DisconnectReason = "normal"
+	ReasonServerShutdown     DisconnectReason = "server_shutdown"
+	ReasonServerRestart      DisconnectReason = "server_restart"
+	ReasonProtocolError      DisconnectReason = "protocol_error"
+	ReasonUnsupportedData    DisconnectReason = "unsupported_data"
+	ReasonInvalidPayload     DisconnectReason = "invalid_payload"
+	ReasonPolicyViolation    DisconnectReason = "policy_violation"
+	ReasonMessageTooLarge    DisconnectReason = "message_too_large"
+	ReasonInternalError      DisconnectReason = "internal_error"
+	ReasonServerFull         DisconnectReason = "server_full"
+	ReasonTryAgainLater      DisconnectReason = "try_again_later"
+	ReasonUnauthorized       DisconnectReason = "unauthorized"
+	ReasonForbidden          DisconnectReason = "forbidden"
+	ReasonRateLimited        DisconnectReason = "rate_limited"
+	ReasonSlowConsumer       DisconnectReason = "slow_consumer"
+	ReasonIdleTimeout        DisconnectReason = "idle_timeout"
+	ReasonHeartbeatTimeout   DisconnectReason = "heartbeat_timeout"
+	ReasonKicked             DisconnectReason = "kicked"
+	ReasonUnsupportedVersion DisconnectReason = "unsupported_version"
+	ReasonReplaced           DisconnectReason = "replaced"
+)
+
+// Close codes in the 4000-4999 range are reserved by RFC6455 for private use
+// and carry the reasons the standard codes do not describe.
+const (
+	CloseUnauthorized       = 4001
+	CloseForbidden          = 4003
+	CloseKicked             = 4004
+	CloseIdleTimeout        = 4008
+	CloseReplaced           = 4009
+	CloseUnsupportedVersion = 4010
+	CloseSlowConsumer       = 4011
+	CloseRateLimited        = 4029
+)
+
+// Table mapping every disconnect reason to the close code sent to the client
+var closeCodes = map[DisconnectReason]int{
+	ReasonNormal:             websocket.CloseNormalClosure,
+	ReasonServerShutdown:     websocket.CloseGoingAway,
+	ReasonServerRestart:      websocket.CloseServiceRestart,
+	ReasonProtocolError:      websocket.CloseProtocolError,
+	ReasonUnsupportedData:    websocket.CloseUnsupportedData,
+	ReasonInvalidPayload:     websocket.CloseInvalidFramePayloadData,
+	ReasonPolicyViolation:    websocket.ClosePolicyViolation,
+	ReasonMessageTooLarge:    websocket.CloseMessageTooBig,
+	ReasonInternalError:      websocket.CloseInternalServerErr,
+	ReasonServerFull:         websocket.CloseTryAgainLater,
+	ReasonTryAgainLater:      websocket.CloseTryAgainLater,
+	ReasonUnauthorized:       CloseUnauthorized,
+	ReasonForbidden:          CloseForbidden,
+	ReasonRateLimited:        CloseRateLimited,
+	ReasonSlowConsumer:       CloseSlowConsumer,
+	ReasonIdleTimeout:        CloseIdleTimeout,
+	ReasonHeartbeatTimeout:   CloseIdleTimeout,
+	ReasonKicked:             CloseKicked,
+	ReasonUnsupportedVersion: CloseUnsupportedVersion,
+	ReasonReplaced:           CloseReplaced,
+}
+
+// The language used when a client did not ask for one the catalog knows
+const defaultLanguage = "en"
+
+// A close frame payload may hold at most 125 bytes, two of which are the close code
+const maxCloseReasonBytes = 123
+
+// How long to wait for a close frame to be written before giving up
+const closeWriteWait = time.Second
+
+// MessageCatalog holds the human readable text of every disconnect reason per language.
+type MessageCatalog struct {
+	Messages map[string]map[DisconnectReason]string
+	mu       sync.RWMutex
+}
+
+// Function to construct a catalog with the text of every disconnect reason in the
+// default language.
+// Returns:
+// *MessageCatalog - The catalog.
+func newMessageCatalog() *MessageCatalog {
+	return &MessageCatalog{
+		Messages: map[string]map[DisconnectReason]string{
+			defaultLanguage: {
+				ReasonNormal:             "Connection closed",
+				ReasonServerShutdown:     "Server is shutting down",
+				ReasonServerRestart:      "Server is restarting, please reconnect",
+				ReasonProtocolError:      "Protocol error",
+				ReasonUnsupportedData:    "Unsupported data",
+				ReasonInvalidPayload:     "Invalid message payload",
+				ReasonPolicyViolation:    "Policy violation",
+				ReasonMessageTooLarge:    "Message too large",
+				ReasonInternalError:      "Internal server error",
+				ReasonServerFull:         "Server is full, try again later",
+				ReasonTryAgainLater:      "Try again later",
+				ReasonUnauthorized:       "Authentication required",
+				ReasonForbidden:          "Access denied",
+				ReasonRateLimited:        "Too many messages",
+				ReasonSlowConsumer:       "Client is not reading messages fast enough",
+				ReasonIdleTimeout:        "Connection was idle for too long",
+				ReasonHeartbeatTimeout:   "Heartbeat timed out",
+				ReasonKicked:             "Disconnected by an administrator",
+				ReasonUnsupportedVersion: "Unsupported protocol version",
+				ReasonReplaced:           "Replaced by a newer connection with the same client ID",
+			},
+		},
+	}
+}
+
+// Function to load translations of the disconnect reasons into the catalog.
+// The file is a JSON object keyed by language, e.g. {"de": {"kicked": "..."}}.
+// Parameters:
+// path: string - The path of the JSON file.
+// Returns:
+// error - An error if the file could not be read or parsed.
+func (c *MessageCatalog) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var messages map[string]map[DisconnectReason]string
+	if err := json.Unmarshal(data, &messages); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for language, texts := range messages {
+		language = strings.ToLower(language)
+		if c.Messages[language] == nil {
+			c.Messages[language] = map[DisconnectReason]string{}
+		}
+		for reason, text := range texts {
+			c.Messages[language][reason] = text
+		}
+	}
+	return nil
+}
+
+// Function to get the text of a disconnect reason in a language, falling back to
+// the default language and finally to the reason itself.
+// Parameters:
+// language: string - The preferred language of the client.
+// reason: DisconnectReason - The disconnect reason.
+// Returns:
+// string - The localized text.
+func (c *MessageCatalog) Text(language string, reason DisconnectReason) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if text, ok := c.Messages[language][reason]; ok {
+		return text
+	}
+	if text, ok := c.Messages[defaultLanguage][reason]; ok {
+		return text
+	}
+	return string(reason)
+}
+
+// Function to pick the language of a client from an Accept-Language header value.
+// Parameters:
+// header: string - The value of the Accept-Language header.
+// Returns:
+// string - The first language of the header, or the default language.
+func parseLanguage(header string) string {
+	first := strings.TrimSpace(strings.Split(header, ",")[0])
+	first = strings.Split(first, ";")[0]
+	first = strings.Split(first, "-")[0]
+	if first == "" || first == "*" {
+		return defaultLanguage
+	}
+	return strings.ToLower(first)
+}
+
+// Function to get the close code of a disconnect reason.
+// Parameters:
+// reason: DisconnectReason - The disconnect reason.
+// Returns:
+// int - The RFC6455 close code.
+func closeCode(reason DisconnectReason) int {
+	if code, ok := closeCodes[reason]; ok {
+		return code
+	}
+	return websocket.CloseInternalServerErr
+}
+
+// Function to build the payload of a close frame. The reason is a JSON object with a
+// machine-readable reason and localized text, truncated to fit in a close frame.
+// Parameters:
+// reason: DisconnectReason - The disconnect reason.
+// language: string - The language of the text.
+// Returns:
+// []byte - The close frame payload including the close code.
+func (c *MessageCatalog) closeMessage(reason DisconnectReason, language string) []byte {
+	text := c.Text(language, reason)
+	for {
+		payload, _ := json.Marshal(struct {
+			Reason DisconnectReason `json:"reason"`
+			Text   string           `json:"text"`
+		}{reason, text})
+		if len(payload) <= maxCloseReasonBytes || text == "" {
+			return websocket.FormatCloseMessage(closeCode(reason), string(payload))
+		}
+		_, size := utf8.DecodeLastRuneInString(text)
+		text = text[:len(text)-size]
+	}
+}
+
+// Function to close a client connection with the close code and reason text
+// matching why it is being disconnected.
+// Parameters:
+// reason: DisconnectReason - Why the client is disconnected.
+// Returns:
+// error - An error if the close frame could not be written.
+func (client *Client) Close(reason DisconnectReason) error {
+	if transport, ok := client.Transport.(closableTransport); ok {
+		return transport.Close(reason)
+	}
+	message := client.options().catalog.closeMessage(reason, client.Language)
+	if client.Stream != nil {
+		err := client.Stream.WriteFrame(websocket.CloseMessage, message)
+		client.Stream.Close()
+		return err
+	}
+	err := client.Connection.WriteControl(websocket.CloseMessage, message, time.Now().Add(closeWriteWait))
+	client.Connection.Close()
+	return err
+}
+
+// closableTransport is a transport holding a connection of its own, as MQTT clients do.
+type closableTransport interface {
+	Transport
+	Close(reason DisconnectReason) error
+}
+
+// Function to check whether a client has a connection that can be closed, unlike the
+// clients of transports such as webhooks.
+// Returns:
+// bool - True if the client is connected over a WebSocket, the plain TCP listener or MQTT.
+func (client *Client) Closable() bool {
+	_, closable := client.Transport.(closableTransport)
+	return client.Connection != nil || client.Stream != nil || closable
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEveryReasonHasCloseCodeAndText(t *testing.T) {
+	for reason := range closeCodes {
+		assert.NotEqual(t, string(reason), defaultOptions.catalog.Text(defaultLanguage, reason), "Reason %s should have default text", reason)
+		payload := defaultOptions.catalog.closeMessage(reason, defaultLanguage)
+		assert.LessOrEqual(t, len(payload), 125, "Close payload for %s should fit in a control frame", reason)
+	}
+}
+
+func TestCatalogLoadAndFallback(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "catalog.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`{"DE":{"kicked":"Von einem Administrator getrennt"}}`), 0o644))
+
+	c := &MessageCatalog{Messages: map[string]map[DisconnectReason]string{
+		defaultLanguage: {ReasonKicked: "Kicked", ReasonIdleTimeout: "Idle"},
+	}}
+	assert.NoError(t, c.Load(path))
+
+	assert.Equal(t, "Von einem Administrator getrennt", c.Text("de", ReasonKicked))
+	assert.Equal(t, "Idle", c.Text("de", ReasonIdleTimeout), "Missing translations should fall back to the default language")
+	assert.Equal(t, "rate_limited", c.Text("de", ReasonRateLimited), "Unknown reasons should fall back to the reason itself")
+}
+
+func TestParseLanguage(t *testing.T) {
+	assert.Equal(t, "de", parseLanguage("de-CH,de;q=0.9,en;q=0.8"))
+	assert.Equal(t, "fr", parseLanguage("fr;q=0.7"))
+	assert.Equal(t, defaultLanguage, parseLanguage(""))
+	assert.Equal(t, defaultLanguage, parseLanguage("*"))
+}
+
+func TestClientCloseSendsCodeAndReason(t *testing.T) {
+	client, peer := newTestClient(t)
+	client.Language = defaultLanguage
+
+	assert.NoError(t, client.Close(ReasonRateLimited))
+
+	_, _, err := peer.ReadMessage()
+	closeErr, ok := err.(*websocket.CloseError)
+	assert.True(t, ok, "Peer should receive a close frame")
+	assert.Equal(t, CloseRateLimited, closeErr.Code)
+
+	var reason map[string]string
+	assert.NoError(t, json.Unmarshal([]byte(closeErr.Text), &reason))
+	assert.Equal(t, "rate_limited", reason["reason"])
+	assert.Equal(t, "Too many messages", reason["text"])
+}
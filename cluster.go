@@ -0,0 +1,470 @@
+// This file implements cluster mode: server nodes discover each other from a static
+// peer list and by gossiping their members, and relay published messages to one
+// another over internal WebSocket links.
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Types of the frames exchanged over cluster links
+const (
+	clusterHello   = "hello"
+	clusterMembers = "members"
+	clusterPublish = "publish"
+	// Heartbeat carrying the subscribers connected to the sending node
+	clusterPresence = "presence"
+	// Rolling restarts (see rollout.go): asks a node to drain and restart, hands the
+	// sessions of a draining node over, tells the coordinator a node drained, and tells
+	// the other nodes a session handed over was resumed
+	clusterRestart        = "restart"
+	clusterSessions       = "sessions"
+	clusterDrained        = "drained"
+	clusterSessionResumed = "resumed"
+	// Tells the nodes which node a rolling restart drains, so they accept its frames
+	clusterRollout = "rollout"
+)
+
+const (
+	// Header carrying the shared secret peers must present to open a link
+	clusterSecretHeader = "X-Cluster-Secret"
+
+	// How many message IDs are remembered to drop relays that loop back
+	clusterSeenMessages = 10000
+
+	// Delays between attempts to reconnect to a peer
+	clusterMinBackoff = 500 * time.Millisecond
+	clusterMaxBackoff = 30 * time.Second
+
+	// How often nodes share their presence; a node missing three heartbeats is forgotten
+	clusterPresenceInterval = 5 * time.Second
+	clusterPresenceMissed   = 3
+)
+
+// Member is a node of the cluster.
+type Member struct {
+	NodeId  string `json:"node"`
+	Address string `json:"addr"`
+}
+
+// A frame exchanged over a cluster link
+type clusterFrame struct {
+	Type      string   `json:"type"`
+	Node      string   `json:"node,omitempty"`
+	Address   string   `json:"addr,omitempty"`
+	Members   []Member `json:"members,omitempty"`
+	MessageId string   `json:"id,omitempty"`
+	Origin    string   `json:"origin,omitempty"`
+	Topic     string   `json:"topic,omitempty"`
+	Message   []byte   `json:"message,omitempty"`
+	relayHeaders
+
+	Presence map[string][]PresenceMember `json:"presence,omitempty"`
+
+	Rollout  string            `json:"rollout,omitempty"`
+	Target   string            `json:"target,omitempty"`
+	Rate     float64           `json:"rate,omitempty"`
+	Count    int               `json:"count,omitempty"`
+	Sessions []migratedSession `json:"sessions,omitempty"`
+	Token    string            `json:"token,omitempty"`
+}
+
+// An internal WebSocket connection to another node
+type clusterLink struct {
+	member Member
+	conn   *websocket.Conn
+	mu     sync.Mutex
+	// How long a write may take, 0 for no limit
+	writeTimeout time.Duration
+}
+
+type Cluster struct {
+	NodeId  string
+	Address string
+	Secret  string
+	// Called once a rolling restart drained this node, to restart the process
+	Restart func()
+	ps      *PubSub
+
+	links   map[*clusterLink]bool
+	members map[string]Member
+	dialing map[string]bool
+	seen    map[string]bool
+	seenIds []string
+	mu      sync.Mutex
+	done    chan struct{}
+
+	// The last rolling restart coordinated by this node
+	rollout *Rollout
+	// The rolling restart announced by its coordinator, whose frames this node accepts
+	active activeRollout
+	// Channels waiting for a node to drain, by node ID
+	drainWaiters map[string]chan clusterFrame
+	// Tokens of the sessions each node handed over to this one, by node ID
+	adopted map[string]map[string]bool
+	// Set once a rolling restart drained this node
+	restarting atomic.Bool
+}
+
+// Function to create a cluster node.
+// Parameters:
+// address: string - The host:port other nodes use to reach this node's /cluster endpoint.
+// secret: string - The shared secret required to open a link, or empty for none.
+// ps: *PubSub - The PubSub instance that receives messages relayed from other nodes.
+// Returns:
+// *Cluster - The cluster node; serve it on /cluster and call Join to connect to peers.
+func NewCluster(address string, secret string, ps *PubSub) *Cluster {
+	return &Cluster{
+		NodeId:  autoId(),
+		Address: address,
+		Secret:  secret,
+		ps:      ps,
+		links:   map[*clusterLink]bool{},
+		members: map[string]Member{},
+		dialing: map[string]bool{},
+		seen:    map[string]bool{},
+		done:    make(chan struct{}),
+
+		drainWaiters: map[string]chan clusterFrame{},
+		adopted:      map[string]map[string]bool{},
+	}
+}
+
+// Function to connect to peers. Each address is dialed in the background and
+// redialed with backoff whenever its link drops.
+// Parameters:
+// addresses: []string - The host:port of each peer's /cluster endpoint.
+func (c *Cluster) Join(addresses []string) {
+	for _, address := range addresses {
+		c.connect(address)
+	}
+}
+
+// Function to get the nodes currently linked to this node.
+// Returns:
+// []Member - The members, sorted by address.
+func (c *Cluster) Members() []Member {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	members := make([]Member, 0, len(c.members))
+	for _, member := range c.members {
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Address < members[j].Address })
+	return members
+}
+
+// Function to accept links from other nodes on the /cluster endpoint.
+// Parameters:
+// w: http.ResponseWriter - The response writer to write HTTP responses.
+// r: *http.Request - The incoming HTTP request.
+func (c *Cluster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Every node presents the secret, so a node without one accepts no link
+	if c.Secret == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get(clusterSecretHeader)), []byte(c.Secret)) != 1 {
+		http.Error(w, "invalid cluster secret", http.StatusUnauthorized)
+		return
+	}
+	conn, err := c.ps.options().upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		slog.Warn("Cluster peer upgrade failed", "remote_addr", r.RemoteAddr, "error", err)
+		return
+	}
+	c.runLink(&clusterLink{conn: conn, writeTimeout: c.ps.options().writeTimeout})
+}
+
+// Function to relay a locally published message to every linked node.
+// Parameters:
+// ctx: context.Context - The context of the publish.
+// id: string - The ID of the message, also used to drop relays that loop back.
+// topic: string - The topic the message was published to.
+// message: []byte - The published message.
+func (c *Cluster) Relay(ctx context.Context, id string, topic string, message []byte) error {
+	frame := clusterFrame{
+		Type:         clusterPublish,
+		MessageId:    id,
+		Origin:       c.NodeId,
+		Topic:        topic,
+		Message:      message,
+		relayHeaders: relayHeadersOf(ctx),
+	}
+	c.markSeen(frame.MessageId)
+	c.forward(frame, nil)
+	return nil
+}
+
+// Function to share the subscribers of this node with the cluster on every heartbeat
+// and merge those of the other nodes into the presence registry of the PubSub.
+// Parameters:
+// interval: time.Duration - The time between heartbeats.
+func (c *Cluster) SharePresence(interval time.Duration) {
+	c.ps.Presence = NewPresenceRegistry(c.NodeId, clusterPresenceMissed*interval)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.done:
+				return
+			case <-ticker.C:
+				c.forward(c.presenceFrame(), nil)
+			}
+		}
+	}()
+}
+
+// Function to build the heartbeat carrying the presence of this node.
+// Returns:
+// clusterFrame - The presence frame.
+func (c *Cluster) presenceFrame() clusterFrame {
+	return clusterFrame{Type: clusterPresence, Node: c.NodeId, Presence: c.ps.localPresence()}
+}
+
+// Function to close every link and stop reconnecting to peers.
+func (c *Cluster) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	close(c.done)
+	for link := range c.links {
+		link.conn.Close()
+	}
+}
+
+// Function to keep a link to a peer address open, redialing with exponential backoff.
+// Parameters:
+// address: string - The host:port of the peer.
+func (c *Cluster) connect(address string) {
+	c.mu.Lock()
+	if address == c.Address || c.dialing[address] {
+		c.mu.Unlock()
+		return
+	}
+	c.dialing[address] = true
+	c.mu.Unlock()
+
+	go func() {
+		header := http.Header{clusterSecretHeader: {c.Secret}}
+		backoff := clusterMinBackoff
+		for {
+			conn, _, err := websocket.DefaultDialer.Dial(c.scheme()+"://"+address+"/cluster", header)
+			if err == nil {
+				backoff = clusterMinBackoff
+				c.runLink(&clusterLink{conn: conn, writeTimeout: c.ps.options().writeTimeout})
+			} else {
+				slog.Warn("Error connecting to cluster peer", "peer", address, "error", err)
+			}
+
+			select {
+			case <-c.done:
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > clusterMaxBackoff {
+				backoff = clusterMaxBackoff
+			}
+		}
+	}()
+}
+
+// Function to run a link until it closes: introduce this node, then handle the
+// frames received from the peer.
+// Parameters:
+// link: *clusterLink - The link, dialed or accepted.
+func (c *Cluster) runLink(link *clusterLink) {
+	defer link.conn.Close()
+
+	c.mu.Lock()
+	select {
+	case <-c.done:
+		c.mu.Unlock()
+		return
+	default:
+	}
+	c.links[link] = true
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.links, link)
+		if link.member.NodeId != "" {
+			delete(c.members, link.member.NodeId)
+			// A coordinator that went away no longer drains anything
+			if c.active.coordinator == link.member.NodeId {
+				c.active = activeRollout{}
+			}
+		}
+		c.mu.Unlock()
+	}()
+
+	if err := link.send(clusterFrame{Type: clusterHello, Node: c.NodeId, Address: c.Address}); err != nil {
+		return
+	}
+
+	for {
+		var frame clusterFrame
+		if err := link.conn.ReadJSON(&frame); err != nil {
+			return
+		}
+		c.handleFrame(link, frame)
+	}
+}
+
+// Function to handle a frame received over a link.
+// Parameters:
+// link: *clusterLink - The link the frame was received on.
+// frame: clusterFrame - The frame.
+func (c *Cluster) handleFrame(link *clusterLink, frame clusterFrame) {
+	switch frame.Type {
+
+	case clusterHello:
+		if frame.Node == c.NodeId {
+			// A peer address that points back to this node
+			link.conn.Close()
+			return
+		}
+		c.mu.Lock()
+		link.member = Member{NodeId: frame.Node, Address: frame.Address}
+		c.members[frame.Node] = link.member
+		c.mu.Unlock()
+		c.gossip()
+		// Share presence at once so a new link does not wait for the next heartbeat
+		if c.ps.Presence != nil {
+			link.send(c.presenceFrame())
+		}
+
+	case clusterPresence:
+		if c.ps.Presence != nil && frame.Node != c.NodeId {
+			c.ps.Presence.Update(frame.Node, frame.Presence)
+		}
+
+	case clusterMembers:
+		// Connect to the members this node does not know about yet
+		for _, member := range frame.Members {
+			c.mu.Lock()
+			_, known := c.members[member.NodeId]
+			c.mu.Unlock()
+			if !known && member.NodeId != c.NodeId && member.Address != "" {
+				c.connect(member.Address)
+			}
+		}
+
+	case clusterPublish:
+		if !c.markSeen(frame.MessageId) {
+			return
+		}
+		c.ps.deliver(frame.context(), frame.MessageId, frame.Topic, frame.Message)
+		// Forward to the other links so nodes that are not linked directly still receive it
+		c.forward(frame, link)
+
+	case clusterRollout:
+		c.rolloutAnnounced(link, frame)
+
+	case clusterRestart:
+		if active, ok := c.activeRolloutOf(link, frame); ok && active.coordinator == frame.Node && active.draining == c.NodeId {
+			// Draining takes a while, and the link must keep reading meanwhile
+			go c.drainForRestart(frame)
+		}
+
+	case clusterSessions:
+		if active, ok := c.activeRolloutOf(link, frame); ok && active.draining == frame.Node {
+			c.adoptSessions(frame)
+		}
+
+	case clusterDrained:
+		if active, ok := c.activeRolloutOf(link, frame); ok && active.coordinator == c.NodeId && active.draining == frame.Node {
+			c.nodeDrained(frame)
+		}
+
+	case clusterSessionResumed:
+		if c.ps.Sessions != nil {
+			c.ps.Sessions.forget(frame.Token)
+		}
+	}
+}
+
+// Function to tell every linked node about the members of this node.
+func (c *Cluster) gossip() {
+	members := append(c.Members(), Member{NodeId: c.NodeId, Address: c.Address})
+	c.forward(clusterFrame{Type: clusterMembers, Members: members}, nil)
+}
+
+// Function to send a frame on every link except one.
+// Parameters:
+// frame: clusterFrame - The frame to send.
+// except: *clusterLink - The link to skip, or nil.
+func (c *Cluster) forward(frame clusterFrame, except *clusterLink) {
+	c.mu.Lock()
+	links := make([]*clusterLink, 0, len(c.links))
+	for link := range c.links {
+		if link != except {
+			links = append(links, link)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, link := range links {
+		if err := link.send(frame); err != nil {
+			slog.Error("Error sending to cluster peer", "frame", frame.Type, logKeyTopic, frame.Topic, "error", err)
+		}
+	}
+}
+
+// Function to record a message ID, forgetting the oldest IDs once the limit is reached.
+// Parameters:
+// id: string - The message ID.
+// Returns:
+// bool - False if the ID was seen before.
+func (c *Cluster) markSeen(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.seen[id] {
+		return false
+	}
+	c.seen[id] = true
+	c.seenIds = append(c.seenIds, id)
+	if len(c.seenIds) > clusterSeenMessages {
+		delete(c.seen, c.seenIds[0])
+		c.seenIds = c.seenIds[1:]
+	}
+	return true
+}
+
+// Function to get the scheme used to dial peers, which serve TLS when this node does.
+// Returns:
+// string - wss when TLS is configured, ws otherwise.
+func (c *Cluster) scheme() string {
+	if c.ps.options().tlsOptions.Enabled() {
+		return "wss"
+	}
+	return "ws"
+}
+
+// Function to write a frame to a link.
+// Parameters:
+// frame: clusterFrame - The frame to write.
+// Returns:
+// error - An error if the frame could not be written.
+func (l *clusterLink) send(frame clusterFrame) error {
+	data, err := json.Marshal(frame)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.conn.SetWriteDeadline(deadlineAfter(l.writeTimeout))
+	return l.conn.WriteMessage(websocket.TextMessage, data)
+}
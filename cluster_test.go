@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestCluster starts a cluster node serving its /cluster endpoint on a test server.
+func newTestCluster(t *testing.T, secret string) (*Cluster, *PubSub) {
+	ps := &PubSub{}
+	server := httptest.NewUnstartedServer(nil)
+	cluster := NewCluster(server.Listener.Addr().String(), secret, ps)
+	server.Config.Handler = cluster
+	server.Start()
+	ps.Bridges = []Bridge{cluster}
+	t.Cleanup(func() {
+		cluster.Close()
+		server.Close()
+	})
+	return cluster, ps
+}
+
+func TestClusterRelaysPublishesBetweenNodes(t *testing.T) {
+	nodeA, psA := newTestCluster(t, "s3cret")
+	nodeB, psB := newTestCluster(t, "s3cret")
+	nodeA.Join([]string{nodeB.Address})
+
+	assert.Eventually(t, func() bool { return len(nodeA.Members()) == 1 && len(nodeB.Members()) == 1 }, 2*time.Second, 10*time.Millisecond)
+
+	client, peer := newTestClient(t)
+	psB.Subscribe(&client, "news")
+	psA.Publish("news", []byte("hello from A"), nil)
+
+	_, message, err := peer.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello from A"), message)
+}
+
+func TestClusterGossipLinksAllMembers(t *testing.T) {
+	nodeA, _ := newTestCluster(t, "s3cret")
+	nodeB, _ := newTestCluster(t, "s3cret")
+	nodeC, _ := newTestCluster(t, "s3cret")
+
+	// A and C only know about B; gossip should link A and C as well
+	nodeA.Join([]string{nodeB.Address})
+	nodeC.Join([]string{nodeB.Address})
+
+	assert.Eventually(t, func() bool {
+		return len(nodeA.Members()) == 2 && len(nodeB.Members()) == 2 && len(nodeC.Members()) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestClusterDropsDuplicateMessages(t *testing.T) {
+	cluster, ps := newTestCluster(t, "s3cret")
+
+	client, peer := newTestClient(t)
+	ps.Subscribe(&client, "news")
+
+	frame := clusterFrame{Type: clusterPublish, MessageId: autoId(), Origin: autoId(), Topic: "news", Message: []byte("once")}
+	cluster.handleFrame(nil, frame)
+	cluster.handleFrame(nil, frame)
+
+	_, message, err := peer.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("once"), message)
+
+	peer.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, _, err = peer.ReadMessage()
+	assert.Error(t, err, "A relayed message should be delivered only once")
+}
+
+func TestClusterRejectsWrongSecret(t *testing.T) {
+	nodeA, _ := newTestCluster(t, "one")
+	nodeB, _ := newTestCluster(t, "two")
+	nodeA.Join([]string{nodeB.Address})
+
+	// Nodes without a secret accept no link at all
+	nodeC, _ := newTestCluster(t, "")
+	nodeD, _ := newTestCluster(t, "")
+	nodeC.Join([]string{nodeD.Address})
+
+	time.Sleep(200 * time.Millisecond)
+	assert.Empty(t, nodeA.Members())
+	assert.Empty(t, nodeB.Members())
+	assert.Empty(t, nodeC.Members())
+	assert.Empty(t, nodeD.Members())
+}
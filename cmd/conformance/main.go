@@ -0,0 +1,66 @@
+// This file is the command running the wire-protocol conformance suite against a
+// server, e.g. another implementation of it:
+//
+//	conformance -url ws://localhost:8080/ws [-dir path/to/scenarios]
+//
+// Without -dir it runs the scenarios shipped with the suite.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+
+	"mywebsocketserver/conformance"
+)
+
+func main() {
+	os.Exit(run(context.Background(), os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// Function to run the suite.
+// Parameters:
+// ctx: context.Context - Bounds the connections.
+// args: []string - The arguments, without the program name.
+// stdout: io.Writer - Where the result of each scenario is printed.
+// stderr: io.Writer - Where usage and errors are printed.
+// Returns:
+// int - The exit code: 0 if every scenario passed, 1 otherwise, 2 on invalid usage.
+func run(ctx context.Context, args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("conformance", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	url := flags.String("url", "ws://localhost:8080/ws", "WebSocket URL of the server under test")
+	dir := flags.String("dir", "", "directory of scenario files, the shipped scenarios when empty")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	var fsys fs.FS = conformance.Scenarios
+	path := "scenarios"
+	if *dir != "" {
+		fsys, path = os.DirFS(*dir), "."
+	}
+	scenarios, err := conformance.Load(fsys, path)
+	if err != nil {
+		fmt.Fprintln(stderr, "conformance:", err)
+		return 1
+	}
+
+	failed := 0
+	for _, scenario := range scenarios {
+		if err := scenario.Run(ctx, *url); err != nil {
+			failed++
+			fmt.Fprintf(stdout, "FAIL %s\n", err)
+			continue
+		}
+		fmt.Fprintf(stdout, "ok   %s\n", scenario.Name)
+	}
+	fmt.Fprintf(stdout, "%d of %d scenarios passed\n", len(scenarios)-failed, len(scenarios))
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "connect.json"), []byte(`{"name": "connect", "steps": [{"client": "a", "expectNothing": true}]}`), 0o644)
+
+	var stdout bytes.Buffer
+	assert.Equal(t, 1, run(context.Background(), []string{"-url", "ws://127.0.0.1:1/ws", "-dir", dir}, &stdout, &bytes.Buffer{}))
+	assert.Contains(t, stdout.String(), "FAIL connect: step 1 (a): connecting")
+	assert.Contains(t, stdout.String(), "0 of 1 scenarios passed")
+
+	assert.Equal(t, 2, run(context.Background(), []string{"-bogus"}, &stdout, &bytes.Buffer{}))
+}
@@ -0,0 +1,290 @@
+// This file is loadgen, the load-testing harness of a running server. It connects many
+// clients, subscribes them across topics, publishes at a target rate and reports how
+// long the messages took to reach their subscribers and how many never did:
+//
+//	loadgen -url ws://localhost:8080/ws -clients 500 -topics 20 -rate 2000 -duration 1m
+//
+// Client i subscribes to topic i mod -topics, and the clients take turns publishing to
+// the topics in order, so every topic receives the same share of the rate. Each message
+// carries the time it was sent, so latencies are measured on one clock. Messages not
+// delivered -drain after publishing stopped are counted as dropped.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"mywebsocketserver/client"
+)
+
+// How often the publisher catches up with the target rate
+const publishTick = 10 * time.Millisecond
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	os.Exit(run(ctx, os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// Settings of a load test
+type settings struct {
+	url      string
+	token    string
+	clients  int
+	topics   int
+	rate     float64
+	duration time.Duration
+	drain    time.Duration
+	size     int
+	prefix   string
+}
+
+// Results of a load test
+type report struct {
+	clients       int
+	topics        int
+	elapsed       time.Duration
+	published     int64
+	publishErrors int64
+	serverErrors  int64
+	expected      int64
+	delivered     int64
+	// Delivery latencies, sorted
+	latencies []time.Duration
+}
+
+// A message as published by loadgen
+type probe struct {
+	Sent    int64  `json:"sent"`
+	Padding string `json:"padding,omitempty"`
+}
+
+// Function to run a load test.
+// Parameters:
+// ctx: context.Context - Cancelled to stop publishing early, e.g. on Ctrl-C.
+// args: []string - The arguments, without the program name.
+// stdout: io.Writer - Where the report is printed.
+// stderr: io.Writer - Where usage and errors are printed.
+// Returns:
+// int - The exit code: 0 on success, 1 on failure, 2 on invalid usage.
+func run(ctx context.Context, args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("loadgen", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	var s settings
+	flags.StringVar(&s.url, "url", "ws://localhost:8080/ws", "WebSocket URL of the server")
+	flags.StringVar(&s.token, "token", os.Getenv("LOADGEN_TOKEN"), "JWT sent in the Authorization header of every client")
+	flags.IntVar(&s.clients, "clients", 100, "concurrent clients")
+	flags.IntVar(&s.topics, "topics", 10, "topics the clients are subscribed across")
+	flags.Float64Var(&s.rate, "rate", 100, "messages published per second, across all topics")
+	flags.DurationVar(&s.duration, "duration", 10*time.Second, "how long to publish")
+	flags.DurationVar(&s.drain, "drain", 2*time.Second, "how long to wait for deliveries once publishing stopped")
+	flags.IntVar(&s.size, "size", 64, "size of the published messages in bytes, at least that of the timestamp")
+	flags.StringVar(&s.prefix, "prefix", "loadgen.", "prefix of the topics")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if s.clients < 1 || s.topics < 1 || s.rate <= 0 || s.duration <= 0 {
+		fmt.Fprintln(stderr, "loadgen: -clients, -topics, -rate and -duration must be positive")
+		return 2
+	}
+
+	result, err := loadTest(ctx, s, stderr)
+	if err != nil {
+		fmt.Fprintln(stderr, "loadgen:", err)
+		return 1
+	}
+	result.print(stdout)
+	return 0
+}
+
+// Function to connect the clients, publish for the duration and collect the deliveries.
+// Parameters:
+// ctx: context.Context - Cancelled to stop publishing early.
+// s: settings - The settings of the test.
+// stderr: io.Writer - Where progress is printed.
+// Returns:
+// *report - The results.
+// error - An error if a client could not connect or subscribe.
+func loadTest(ctx context.Context, s settings, stderr io.Writer) (*report, error) {
+	result := &report{clients: s.clients, topics: s.topics}
+	var serverErrors atomic.Int64
+	options := client.Options{OnError: func(err error) { serverErrors.Add(1) }}
+	if s.token != "" {
+		options.Header = http.Header{"Authorization": {"Bearer " + s.token}}
+	}
+
+	// Latencies of the deliveries, appended to by the readers of the subscriptions
+	var mu sync.Mutex
+	var latencies []time.Duration
+	var delivered atomic.Int64
+	var readers sync.WaitGroup
+	clients := make([]*client.Client, 0, s.clients)
+	defer func() {
+		for _, c := range clients {
+			c.Close()
+		}
+		readers.Wait()
+	}()
+	subscribers := make([]int64, s.topics)
+	for i := 0; i < s.clients; i++ {
+		dialCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		c, err := client.Connect(dialCtx, s.url, options)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("client %d: %w", i, err)
+		}
+		clients = append(clients, c)
+		messages, err := c.Subscribe(topicName(s.prefix, i%s.topics))
+		if err != nil {
+			return nil, fmt.Errorf("client %d: %w", i, err)
+		}
+		subscribers[i%s.topics]++
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for message := range messages {
+				var p probe
+				if json.Unmarshal(message.Payload, &p) != nil || p.Sent == 0 {
+					continue
+				}
+				latency := time.Since(time.Unix(0, p.Sent))
+				mu.Lock()
+				latencies = append(latencies, latency)
+				mu.Unlock()
+				delivered.Add(1)
+			}
+		}()
+	}
+	fmt.Fprintf(stderr, "loadgen: %d clients subscribed across %d topics, publishing %g messages/s for %s\n", s.clients, s.topics, s.rate, s.duration)
+
+	// Subscriptions are not acknowledged, so give the server a moment to make them
+	select {
+	case <-time.After(100 * time.Millisecond):
+	case <-ctx.Done():
+	}
+
+	start := time.Now()
+	publishCtx, cancel := context.WithTimeout(ctx, s.duration)
+	defer cancel()
+	ticker := time.NewTicker(publishTick)
+	defer ticker.Stop()
+	var published int64
+	for publishing := true; publishing; {
+		select {
+		case <-publishCtx.Done():
+			publishing = false
+		case now := <-ticker.C:
+			// Catch up with the messages due by now, so the rate holds whatever the tick
+			due := int64(now.Sub(start).Seconds() * s.rate)
+			for ; published < due; published++ {
+				topic := int(published % int64(s.topics))
+				c := clients[published%int64(len(clients))]
+				if err := c.Publish(topicName(s.prefix, topic), newProbe(s.size)); err != nil {
+					result.publishErrors++
+					continue
+				}
+				result.published++
+				result.expected += subscribers[topic]
+			}
+		}
+	}
+	result.elapsed = time.Since(start)
+
+	// Wait for the messages still on their way
+	deadline := time.After(s.drain)
+	for waiting := true; waiting && delivered.Load() < result.expected; {
+		select {
+		case <-deadline:
+			waiting = false
+		case <-time.After(publishTick):
+		}
+	}
+	mu.Lock()
+	result.delivered = delivered.Load()
+	result.latencies = append([]time.Duration(nil), latencies...)
+	mu.Unlock()
+	result.serverErrors = serverErrors.Load()
+	sort.Slice(result.latencies, func(i, j int) bool { return result.latencies[i] < result.latencies[j] })
+	return result, nil
+}
+
+// Function to name a topic of the test.
+// Parameters:
+// prefix: string - The prefix of the topics.
+// index: int - The index of the topic.
+// Returns:
+// string - The topic.
+func topicName(prefix string, index int) string {
+	return fmt.Sprintf("%s%d", prefix, index)
+}
+
+// Function to build a message carrying the time it is sent.
+// Parameters:
+// size: int - The size of the encoded message in bytes, if larger than the timestamp alone.
+// Returns:
+// probe - The message.
+func newProbe(size int) probe {
+	p := probe{Sent: time.Now().UnixNano()}
+	encoded, _ := json.Marshal(p)
+	// The padding field adds 13 bytes of its own
+	if padding := size - len(encoded) - 13; padding > 0 {
+		p.Padding = strings.Repeat("x", padding)
+	}
+	return p
+}
+
+// Function to get a percentile of sorted latencies, by the nearest-rank method.
+// Parameters:
+// sorted: []time.Duration - The latencies, sorted.
+// percentile: float64 - The percentile, from 0 to 100.
+// Returns:
+// time.Duration - The latency, 0 if there is none.
+func percentileOf(sorted []time.Duration, percentile float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(percentile/100*float64(len(sorted))+0.5) - 1
+	rank = max(0, min(rank, len(sorted)-1))
+	return sorted[rank]
+}
+
+// Function to print the report.
+// Parameters:
+// w: io.Writer - Where the report is printed.
+func (r *report) print(w io.Writer) {
+	dropped := r.expected - r.delivered
+	if dropped < 0 {
+		// Messages delivered twice, e.g. redelivered after a reconnection
+		dropped = 0
+	}
+	droppedPercent := 0.0
+	if r.expected > 0 {
+		droppedPercent = float64(dropped) / float64(r.expected) * 100
+	}
+	fmt.Fprintf(w, "clients          %d\n", r.clients)
+	fmt.Fprintf(w, "topics           %d\n", r.topics)
+	fmt.Fprintf(w, "duration         %s\n", r.elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "published        %d (%.1f/s)\n", r.published, float64(r.published)/r.elapsed.Seconds())
+	fmt.Fprintf(w, "publish errors   %d\n", r.publishErrors)
+	fmt.Fprintf(w, "server errors    %d\n", r.serverErrors)
+	fmt.Fprintf(w, "expected         %d deliveries\n", r.expected)
+	fmt.Fprintf(w, "delivered        %d (%.1f/s)\n", r.delivered, float64(r.delivered)/r.elapsed.Seconds())
+	fmt.Fprintf(w, "dropped          %d (%.2f%%)\n", dropped, droppedPercent)
+	for _, percentile := range []float64{50, 90, 99, 99.9} {
+		fmt.Fprintf(w, "latency p%-6g  %s\n", percentile, percentileOf(r.latencies, percentile).Round(time.Microsecond))
+	}
+	if len(r.latencies) > 0 {
+		fmt.Fprintf(w, "latency max      %s\n", r.latencies[len(r.latencies)-1].Round(time.Microsecond))
+	}
+}
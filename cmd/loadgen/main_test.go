@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// A server relaying publishes to the subscribers of every connection
+func newRelayServer(t *testing.T) string {
+	var mu sync.Mutex
+	subscribers := map[string][]*websocket.Conn{}
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		mu.Lock()
+		ws.WriteJSON(map[string]string{"action": "welcome", "clientId": "c"})
+		mu.Unlock()
+		for {
+			var m struct {
+				Action  string          `json:"action"`
+				Topic   string          `json:"topic"`
+				Message json.RawMessage `json:"message"`
+			}
+			if err := ws.ReadJSON(&m); err != nil {
+				return
+			}
+			mu.Lock()
+			switch m.Action {
+			case "subscribe":
+				subscribers[m.Topic] = append(subscribers[m.Topic], ws)
+			case "publish":
+				for _, subscriber := range subscribers[m.Topic] {
+					subscriber.WriteJSON(map[string]interface{}{"action": "message", "topic": m.Topic, "id": "m1", "message": m.Message})
+				}
+			}
+			mu.Unlock()
+		}
+	}))
+	t.Cleanup(server.Close)
+	return "ws" + server.URL[4:]
+}
+
+func TestLoadTest(t *testing.T) {
+	url := newRelayServer(t)
+	var stdout, stderr bytes.Buffer
+	code := run(context.Background(), []string{"-url", url, "-clients", "6", "-topics", "3", "-rate", "300", "-duration", "300ms"}, &stdout, &stderr)
+	assert.Equal(t, 0, code, stderr.String())
+
+	report := stdout.String()
+	assert.Contains(t, report, "clients          6\n")
+	assert.Contains(t, report, "dropped          0 (0.00%)\n", "Every subscriber of a topic receives its messages")
+	assert.Contains(t, report, "latency p99")
+	assert.Contains(t, report, "publish errors   0\n")
+}
+
+func TestUsage(t *testing.T) {
+	var stderr bytes.Buffer
+	assert.Equal(t, 2, run(context.Background(), []string{"-clients", "0"}, &bytes.Buffer{}, &stderr))
+	assert.Equal(t, 1, run(context.Background(), []string{"-url", "ws://127.0.0.1:1/ws", "-clients", "1"}, &bytes.Buffer{}, &stderr))
+	assert.True(t, strings.HasPrefix(stderr.String(), "loadgen:"))
+}
+
+func TestPercentileOf(t *testing.T) {
+	var latencies []time.Duration
+	for i := 1; i <= 100; i++ {
+		latencies = append(latencies, time.Duration(i)*time.Millisecond)
+	}
+	assert.Equal(t, 50*time.Millisecond, percentileOf(latencies, 50))
+	assert.Equal(t, 99*time.Millisecond, percentileOf(latencies, 99))
+	assert.Equal(t, 100*time.Millisecond, percentileOf(latencies, 100))
+	assert.Equal(t, time.Millisecond, percentileOf(latencies, 0))
+	assert.Equal(t, time.Duration(0), percentileOf(nil, 50))
+}
+
+func TestProbeSize(t *testing.T) {
+	encoded, _ := json.Marshal(newProbe(200))
+	assert.Len(t, encoded, 200)
+	encoded, _ = json.Marshal(newProbe(1))
+	assert.NotContains(t, string(encoded), "padding", "Messages are never smaller than their timestamp")
+}
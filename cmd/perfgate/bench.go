@@ -0,0 +1,154 @@
+// This file reads the output of go test -bench and compares two runs of the same
+// benchmarks: the median of every metric of the runs of a benchmark is compared, and
+// a metric growing by more than the threshold is a regression.
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// Metrics compared, lower being better; throughput in MB/s only mirrors ns/op
+var gatedUnits = []string{"ns/op", "B/op", "allocs/op"}
+
+// The results of a set of benchmarks
+type benchSet struct {
+	// Names of the benchmarks, in the order they ran
+	names []string
+	// Values of every metric of a benchmark, one per run, by name and unit
+	runs map[string]map[string][]float64
+}
+
+// Function to read the results of go test -bench, ignoring any other line.
+// Parameters:
+// r: io.Reader - The output of go test.
+// Returns:
+// *benchSet - The results.
+// error - An error reading r.
+func parseBench(r io.Reader) (*benchSet, error) {
+	set := &benchSet{runs: map[string]map[string][]float64{}}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// BenchmarkName-8   1000   1234 ns/op   56 B/op   2 allocs/op
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || !strings.HasPrefix(fields[0], "Benchmark") {
+			continue
+		}
+		if _, err := strconv.Atoi(fields[1]); err != nil {
+			continue
+		}
+		name := trimProcs(fields[0])
+		if set.runs[name] == nil {
+			set.runs[name] = map[string][]float64{}
+			set.names = append(set.names, name)
+		}
+		for i := 2; i+1 < len(fields); i += 2 {
+			value, err := strconv.ParseFloat(fields[i], 64)
+			if err != nil {
+				continue
+			}
+			set.runs[name][fields[i+1]] = append(set.runs[name][fields[i+1]], value)
+		}
+	}
+	return set, scanner.Err()
+}
+
+// Function to remove the GOMAXPROCS suffix go test appends to benchmark names, so runs
+// on machines with another number of CPUs compare.
+// Parameters:
+// name: string - The name, e.g. BenchmarkFanOut/subscribers=100-8.
+// Returns:
+// string - The name without the suffix, e.g. BenchmarkFanOut/subscribers=100.
+func trimProcs(name string) string {
+	i := strings.LastIndexByte(name, '-')
+	if i < 0 {
+		return name
+	}
+	if _, err := strconv.Atoi(name[i+1:]); err != nil {
+		return name
+	}
+	return name[:i]
+}
+
+// Function to get the median of the runs of a benchmark for a metric.
+// Parameters:
+// name: string - The benchmark.
+// unit: string - The metric, e.g. ns/op.
+// Returns:
+// float64 - The median.
+// bool - False if the benchmark did not report the metric.
+func (s *benchSet) median(name string, unit string) (float64, bool) {
+	values := slices.Clone(s.runs[name][unit])
+	if len(values) == 0 {
+		return 0, false
+	}
+	slices.Sort(values)
+	middle := len(values) / 2
+	if len(values)%2 == 0 {
+		return (values[middle-1] + values[middle]) / 2, true
+	}
+	return values[middle], true
+}
+
+// Function to compare the benchmarks of a new run with an old one and print a table
+// of the changes. Benchmarks missing from either run are listed but not gated.
+// Parameters:
+// old: *benchSet - The baseline.
+// new: *benchSet - The run compared with it.
+// threshold: float64 - The growth in percent above which a metric regresses.
+// w: io.Writer - Where the table is printed.
+// Returns:
+// int - The number of regressed metrics.
+func compareBench(old *benchSet, new *benchSet, threshold float64, w io.Writer) int {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "benchmark\tmetric\told\tnew\tdelta\t")
+	regressions := 0
+	for _, name := range new.names {
+		if old.runs[name] == nil {
+			fmt.Fprintf(table, "%s\t\t\t\tnew\t\n", name)
+			continue
+		}
+		for _, unit := range gatedUnits {
+			before, ok := old.median(name, unit)
+			after, ok2 := new.median(name, unit)
+			if !ok || !ok2 {
+				continue
+			}
+			delta := 0.0
+			switch {
+			case before > 0:
+				delta = (after - before) / before * 100
+			case after > 0:
+				delta = math.Inf(1)
+			}
+			verdict := ""
+			if delta > threshold {
+				verdict = "REGRESSION"
+				regressions++
+			}
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%+.1f%%\t%s\n", name, unit, formatValue(before), formatValue(after), delta, verdict)
+		}
+	}
+	for _, name := range old.names {
+		if new.runs[name] == nil {
+			fmt.Fprintf(table, "%s\t\t\t\tremoved\t\n", name)
+		}
+	}
+	table.Flush()
+	return regressions
+}
+
+// Function to format a metric without an exponent.
+// Parameters:
+// value: float64 - The value, e.g. a median of 1012345.5 ns/op.
+// Returns:
+// string - The value with at most one decimal.
+func formatValue(value float64) string {
+	return strconv.FormatFloat(math.Round(value*10)/10, 'f', -1, 64)
+}
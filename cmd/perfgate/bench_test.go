@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const oldBench = `goos: linux
+BenchmarkHotPathFanOut/subscribers=100-8   	     200	   1000000 ns/op	 389.68 MB/s	   24000 B/op	     100 allocs/op
+BenchmarkHotPathFanOut/subscribers=100-8   	     200	   1200000 ns/op	 389.68 MB/s	   24000 B/op	     100 allocs/op
+BenchmarkHotPathFanOut/subscribers=100-8   	     200	   1100000 ns/op	 389.68 MB/s	   24000 B/op	     100 allocs/op
+BenchmarkHotPathEnvelope-8                 	   85502	      3080 ns/op	     432 B/op	       3 allocs/op
+BenchmarkHotPathGone-8                     	   85502	      3080 ns/op
+PASS
+`
+
+func TestParseBench(t *testing.T) {
+	set, err := parseBench(strings.NewReader(oldBench))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"BenchmarkHotPathFanOut/subscribers=100", "BenchmarkHotPathEnvelope", "BenchmarkHotPathGone"}, set.names)
+	median, ok := set.median("BenchmarkHotPathFanOut/subscribers=100", "ns/op")
+	assert.True(t, ok)
+	assert.Equal(t, 1100000.0, median, "The median of the runs should be compared")
+	_, ok = set.median("BenchmarkHotPathGone", "B/op")
+	assert.False(t, ok)
+
+	assert.Equal(t, "BenchmarkName/n=1", trimProcs("BenchmarkName/n=1-16"))
+	assert.Equal(t, "BenchmarkName/a-b", trimProcs("BenchmarkName/a-b"))
+}
+
+func TestCompareBench(t *testing.T) {
+	old, _ := parseBench(strings.NewReader(oldBench))
+	new, _ := parseBench(strings.NewReader(`
+BenchmarkHotPathFanOut/subscribers=100-4   	     200	   1150000 ns/op	   24000 B/op	     130 allocs/op
+BenchmarkHotPathEnvelope-4                 	   85502	      2000 ns/op	     432 B/op	       3 allocs/op
+BenchmarkHotPathNew-4                      	   85502	      3080 ns/op
+`))
+	var out bytes.Buffer
+	assert.Equal(t, 1, compareBench(old, new, 10, &out), "Only the allocations of the fan-out should regress")
+	table := out.String()
+	assert.Regexp(t, `BenchmarkHotPathFanOut/subscribers=100\s+allocs/op\s+100\s+130\s+\+30.0%\s+REGRESSION`, table)
+	assert.Regexp(t, `BenchmarkHotPathFanOut/subscribers=100\s+ns/op\s+1100000\s+1150000\s+\+4.5%\s+\n`, table)
+	assert.Regexp(t, `BenchmarkHotPathEnvelope\s+ns/op\s+3080\s+2000\s+-35.1%`, table)
+	assert.Regexp(t, `BenchmarkHotPathNew\s+new`, table)
+	assert.Regexp(t, `BenchmarkHotPathGone\s+removed`, table)
+
+	assert.Equal(t, 0, compareBench(old, new, 50, &bytes.Buffer{}))
+}
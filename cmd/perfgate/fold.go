@@ -0,0 +1,271 @@
+// This file turns a pprof profile, as written by go test -cpuprofile, into folded
+// stacks: one line per distinct call stack, its functions from the root down separated
+// by semicolons, followed by its value. flamegraph.pl, inferno and speedscope draw
+// flame graphs from them. The profile is decoded with protowire, following
+// github.com/google/pprof/proto/profile.proto, as the module does not depend on pprof.
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Field numbers of profile.proto
+const (
+	profileSampleType  = 1
+	profileSample      = 2
+	profileLocation    = 4
+	profileFunction    = 5
+	profileStringTable = 6
+
+	valueTypeType = 1
+
+	sampleLocationId = 1
+	sampleValue      = 2
+
+	locationId   = 1
+	locationLine = 4
+
+	lineFunctionId = 1
+
+	functionId   = 1
+	functionName = 2
+)
+
+// The parts of a pprof profile needed to fold its stacks
+type profile struct {
+	// Type of every value of the samples, e.g. samples and cpu
+	sampleTypes []int64
+	samples     []sample
+	// Functions of every location, innermost first, as inlined calls share a location
+	locations map[uint64][]uint64
+	// Name of every function, as an index in strings
+	functions map[uint64]int64
+	strings   []string
+}
+
+// A sample of a profile
+type sample struct {
+	// Locations of the stack, the leaf first
+	locations []uint64
+	values    []int64
+}
+
+// Function to decode a pprof profile, gzip compressed or not.
+// Parameters:
+// data: []byte - The profile.
+// Returns:
+// *profile - The profile.
+// error - An error if data is not a profile.
+func parseProfile(data []byte) (*profile, error) {
+	if bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if data, err = io.ReadAll(reader); err != nil {
+			return nil, err
+		}
+	}
+
+	p := &profile{locations: map[uint64][]uint64{}, functions: map[uint64]int64{}}
+	err := walkMessage(data, func(number protowire.Number, value uint64, raw []byte) error {
+		switch number {
+		case profileSampleType:
+			return walkMessage(raw, func(number protowire.Number, value uint64, _ []byte) error {
+				if number == valueTypeType {
+					p.sampleTypes = append(p.sampleTypes, int64(value))
+				}
+				return nil
+			})
+		case profileSample:
+			var s sample
+			err := walkMessage(raw, func(number protowire.Number, value uint64, packed []byte) error {
+				if number != sampleLocationId && number != sampleValue {
+					return nil
+				}
+				values, err := integers(value, packed)
+				for _, value := range values {
+					if number == sampleLocationId {
+						s.locations = append(s.locations, value)
+					} else {
+						s.values = append(s.values, int64(value))
+					}
+				}
+				return err
+			})
+			p.samples = append(p.samples, s)
+			return err
+		case profileLocation:
+			var id uint64
+			var functions []uint64
+			err := walkMessage(raw, func(number protowire.Number, value uint64, raw []byte) error {
+				switch number {
+				case locationId:
+					id = value
+				case locationLine:
+					return walkMessage(raw, func(number protowire.Number, value uint64, _ []byte) error {
+						if number == lineFunctionId {
+							functions = append(functions, value)
+						}
+						return nil
+					})
+				}
+				return nil
+			})
+			p.locations[id] = functions
+			return err
+		case profileFunction:
+			var id uint64
+			var name int64
+			err := walkMessage(raw, func(number protowire.Number, value uint64, _ []byte) error {
+				switch number {
+				case functionId:
+					id = value
+				case functionName:
+					name = int64(value)
+				}
+				return nil
+			})
+			p.functions[id] = name
+			return err
+		case profileStringTable:
+			p.strings = append(p.strings, string(raw))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("not a pprof profile: %w", err)
+	}
+	return p, nil
+}
+
+// Function to call a function with every integer and length-delimited field of a
+// protobuf message.
+// Parameters:
+// data: []byte - The message.
+// field: func(protowire.Number, uint64, []byte) error - Called with the number of each field and its integer value, or its bytes, nil for integers.
+// Returns:
+// error - An error if the message is malformed, or the first error of field.
+func walkMessage(data []byte, field func(protowire.Number, uint64, []byte) error) error {
+	for len(data) > 0 {
+		number, kind, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		var err error
+		switch kind {
+		case protowire.VarintType:
+			var value uint64
+			if value, n = protowire.ConsumeVarint(data); n >= 0 {
+				err = field(number, value, nil)
+			}
+		case protowire.BytesType:
+			var value []byte
+			if value, n = protowire.ConsumeBytes(data); n >= 0 {
+				err = field(number, 0, append([]byte{}, value...))
+			}
+		default:
+			n = protowire.ConsumeFieldValue(number, kind, data)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		if err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// Function to get the values of a repeated integer field, packed or not.
+// Parameters:
+// value: uint64 - The value of an unpacked field.
+// packed: []byte - The varints of a packed field, nil for an unpacked one.
+// Returns:
+// []uint64 - The values.
+// error - An error if packed is not a sequence of varints.
+func integers(value uint64, packed []byte) ([]uint64, error) {
+	if packed == nil {
+		return []uint64{value}, nil
+	}
+	var values []uint64
+	for len(packed) > 0 {
+		value, n := protowire.ConsumeVarint(packed)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		values = append(values, value)
+		packed = packed[n:]
+	}
+	return values, nil
+}
+
+// Function to write the folded stacks of a profile, sorted, with the values of one of
+// its sample types.
+// Parameters:
+// p: *profile - The profile.
+// valueType: string - The sample type, e.g. cpu or alloc_space; the last one when empty.
+// w: io.Writer - Where the stacks are written.
+// Returns:
+// error - An error if the profile has no such sample type.
+func (p *profile) fold(valueType string, w io.Writer) error {
+	index := len(p.sampleTypes) - 1
+	if valueType != "" {
+		index = slices.IndexFunc(p.sampleTypes, func(t int64) bool { return p.str(t) == valueType })
+	}
+	if index < 0 {
+		var types []string
+		for _, t := range p.sampleTypes {
+			types = append(types, p.str(t))
+		}
+		return fmt.Errorf("no sample type %q, the profile has %s", valueType, strings.Join(types, ", "))
+	}
+
+	stacks := map[string]int64{}
+	for _, s := range p.samples {
+		if index >= len(s.values) || s.values[index] == 0 {
+			continue
+		}
+		var frames []string
+		for _, location := range s.locations {
+			for _, function := range p.locations[location] {
+				frames = append(frames, p.str(p.functions[function]))
+			}
+		}
+		slices.Reverse(frames)
+		stacks[strings.Join(frames, ";")] += s.values[index]
+	}
+
+	keys := make([]string, 0, len(stacks))
+	for stack := range stacks {
+		keys = append(keys, stack)
+	}
+	slices.Sort(keys)
+	for _, stack := range keys {
+		if _, err := fmt.Fprintf(w, "%s %d\n", stack, stacks[stack]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Function to look up a string of the profile.
+// Parameters:
+// index: int64 - The index in the string table.
+// Returns:
+// string - The string, "?" if the index is out of range.
+func (p *profile) str(index int64) string {
+	if index < 0 || index >= int64(len(p.strings)) {
+		return "?"
+	}
+	return p.strings[index]
+}
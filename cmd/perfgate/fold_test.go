@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"runtime/pprof"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// message encodes the fields of a protobuf message: integers as varints, byte
+// slices and strings as length-delimited fields, []uint64 packed.
+func message(fields ...interface{}) []byte {
+	var data []byte
+	for i := 0; i < len(fields); i += 2 {
+		number := protowire.Number(fields[i].(int))
+		switch value := fields[i+1].(type) {
+		case int:
+			data = protowire.AppendTag(data, number, protowire.VarintType)
+			data = protowire.AppendVarint(data, uint64(value))
+		case []uint64:
+			var packed []byte
+			for _, v := range value {
+				packed = protowire.AppendVarint(packed, v)
+			}
+			data = protowire.AppendTag(data, number, protowire.BytesType)
+			data = protowire.AppendBytes(data, packed)
+		case string:
+			data = protowire.AppendTag(data, number, protowire.BytesType)
+			data = protowire.AppendString(data, value)
+		case []byte:
+			data = protowire.AppendTag(data, number, protowire.BytesType)
+			data = protowire.AppendBytes(data, value)
+		}
+	}
+	return data
+}
+
+func TestFold(t *testing.T) {
+	// main calls fanOut, which inlines envelope at location 2, and write
+	data := message(
+		profileSampleType, message(valueTypeType, 1),
+		profileSampleType, message(valueTypeType, 2),
+		profileSample, message(sampleLocationId, []uint64{2, 1}, sampleValue, []uint64{1, 10}),
+		profileSample, message(sampleLocationId, []uint64{2, 1}, sampleValue, []uint64{2, 20}),
+		// An unpacked sample
+		profileSample, message(sampleLocationId, 3, sampleLocationId, 1, sampleValue, 1, sampleValue, 5),
+		profileLocation, message(locationId, 1, locationLine, message(lineFunctionId, 1)),
+		profileLocation, message(locationId, 2, locationLine, message(lineFunctionId, 3), locationLine, message(lineFunctionId, 2)),
+		profileLocation, message(locationId, 3, locationLine, message(lineFunctionId, 4)),
+		profileFunction, message(functionId, 1, functionName, 3),
+		profileFunction, message(functionId, 2, functionName, 4),
+		profileFunction, message(functionId, 3, functionName, 5),
+		profileFunction, message(functionId, 4, functionName, 6),
+		profileStringTable, "",
+		profileStringTable, "samples",
+		profileStringTable, "cpu",
+		profileStringTable, "main",
+		profileStringTable, "fanOut",
+		profileStringTable, "envelope",
+		profileStringTable, "write",
+	)
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write(data)
+	writer.Close()
+
+	p, err := parseProfile(compressed.Bytes())
+	assert.NoError(t, err)
+	var out bytes.Buffer
+	assert.NoError(t, p.fold("", &out))
+	assert.Equal(t, "main;fanOut;envelope 30\nmain;write 5\n", out.String())
+
+	out.Reset()
+	assert.NoError(t, p.fold("samples", &out))
+	assert.Equal(t, "main;fanOut;envelope 3\nmain;write 1\n", out.String())
+	assert.ErrorContains(t, p.fold("alloc_space", &out), "the profile has samples, cpu")
+
+	_, err = parseProfile([]byte{0xff, 0xff})
+	assert.Error(t, err)
+}
+
+func TestFoldRuntimeProfile(t *testing.T) {
+	var heap bytes.Buffer
+	assert.NoError(t, pprof.Lookup("heap").WriteTo(&heap, 0))
+	p, err := parseProfile(heap.Bytes())
+	assert.NoError(t, err)
+	assert.NoError(t, p.fold("alloc_space", &bytes.Buffer{}))
+}
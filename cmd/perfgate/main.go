@@ -0,0 +1,271 @@
+// This file is perfgate, the profiling harness of the delivery hot path. It runs the
+// HotPath benchmarks of the server, a fixed workload of fan-out, decoding and envelope
+// encoding, and catches regressions between revisions:
+//
+//	perfgate profile [-out dir]             benchmark, capture CPU and memory profiles and fold them for flame graphs
+//	perfgate compare old.txt new.txt        compare two saved benchmark outputs
+//	perfgate gate [-base ref]               benchmark ref and the working tree and compare them
+//	perfgate fold [-value cpu] cpu.pprof    print the folded stacks of a profile
+//
+// compare and gate exit with 1 when a metric of a benchmark grows by more than
+// -threshold percent. Run it from the root of the module.
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+)
+
+const usage = `usage: perfgate <command> [flags]
+
+commands:
+  profile [-out dir]            benchmark, capture cpu.pprof and mem.pprof and fold them into cpu.folded
+  compare old.txt new.txt       compare two outputs of go test -bench
+  gate [-base ref]              benchmark ref and the working tree, then compare them
+  fold [-value type] profile    print the folded stacks of a pprof profile`
+
+// Settings of a benchmark run
+type benchFlags struct {
+	bench     string
+	benchtime string
+	count     int
+	pkg       string
+}
+
+// Function to register the flags of a benchmark run.
+// Parameters:
+// flags: *flag.FlagSet - The flags of the command.
+// Returns:
+// *benchFlags - The settings, set once the flags are parsed.
+func addBenchFlags(flags *flag.FlagSet) *benchFlags {
+	b := &benchFlags{}
+	flags.StringVar(&b.bench, "bench", "HotPath", "benchmarks to run, as for go test -bench")
+	flags.StringVar(&b.benchtime, "benchtime", "1s", "duration or iterations (e.g. 5000x) of each benchmark")
+	flags.IntVar(&b.count, "count", 6, "runs of each benchmark, whose median is compared")
+	flags.StringVar(&b.pkg, "pkg", ".", "package of the benchmarks")
+	return b
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	os.Exit(run(ctx, os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// Function to run a command.
+// Parameters:
+// ctx: context.Context - Cancels the benchmarks.
+// args: []string - The arguments, without the program name.
+// stdout: io.Writer - Where results are printed.
+// stderr: io.Writer - Where usage and errors are printed.
+// Returns:
+// int - The exit code: 0 on success, 1 on a regression or error, 2 on invalid usage.
+func run(ctx context.Context, args []string, stdout io.Writer, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprintln(stderr, usage)
+		return 2
+	}
+	flags := flag.NewFlagSet("perfgate "+args[0], flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	threshold := flags.Float64("threshold", 10, "growth in percent of a metric that fails compare and gate")
+
+	var err error
+	switch args[0] {
+	case "profile":
+		out := flags.String("out", "profile", "directory of the benchmark output and profiles")
+		b := addBenchFlags(flags)
+		if flags.Parse(args[1:]) != nil {
+			return 2
+		}
+		err = profileCommand(ctx, *b, *out, stdout)
+	case "compare":
+		if flags.Parse(args[1:]) != nil || flags.NArg() != 2 {
+			fmt.Fprintln(stderr, usage)
+			return 2
+		}
+		var old, new *benchSet
+		if old, err = readBench(flags.Arg(0)); err == nil {
+			new, err = readBench(flags.Arg(1))
+		}
+		if err == nil && compareBench(old, new, *threshold, stdout) > 0 {
+			return 1
+		}
+	case "gate":
+		base := flags.String("base", "HEAD", "git revision to compare the working tree with, e.g. origin/main in CI")
+		out := flags.String("out", "profile", "directory of the benchmark outputs")
+		b := addBenchFlags(flags)
+		if flags.Parse(args[1:]) != nil {
+			return 2
+		}
+		var regressions int
+		regressions, err = gateCommand(ctx, *b, *base, *out, *threshold, stdout)
+		if err == nil && regressions > 0 {
+			fmt.Fprintf(stdout, "%d regressions against %s\n", regressions, *base)
+			return 1
+		}
+	case "fold":
+		value := flags.String("value", "", "sample type to fold, e.g. cpu or alloc_space; the last one by default")
+		if flags.Parse(args[1:]) != nil || flags.NArg() != 1 {
+			fmt.Fprintln(stderr, usage)
+			return 2
+		}
+		err = foldFile(flags.Arg(0), *value, stdout)
+	default:
+		fmt.Fprintln(stderr, usage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, "perfgate:", err)
+		return 1
+	}
+	return 0
+}
+
+// Function to benchmark the working tree with CPU and memory profiling and fold the
+// CPU profile.
+// Parameters:
+// ctx: context.Context - Cancels the benchmarks.
+// b: benchFlags - The benchmarks to run.
+// out: string - The directory of bench.txt, cpu.pprof, mem.pprof and cpu.folded.
+// stdout: io.Writer - Where progress is printed.
+// Returns:
+// error - An error running the benchmarks or folding the profile.
+func profileCommand(ctx context.Context, b benchFlags, out string, stdout io.Writer) error {
+	if err := os.MkdirAll(out, 0o755); err != nil {
+		return err
+	}
+	out, err := filepath.Abs(out)
+	if err != nil {
+		return err
+	}
+	if err := runBench(ctx, b, ".", filepath.Join(out, "bench.txt"),
+		"-cpuprofile", filepath.Join(out, "cpu.pprof"), "-memprofile", filepath.Join(out, "mem.pprof"),
+		"-o", filepath.Join(out, "bench.test")); err != nil {
+		return err
+	}
+	folded, err := os.Create(filepath.Join(out, "cpu.folded"))
+	if err != nil {
+		return err
+	}
+	defer folded.Close()
+	if err := foldFile(filepath.Join(out, "cpu.pprof"), "", folded); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "results in %s/bench.txt\n", out)
+	fmt.Fprintf(stdout, "flame graph: go tool pprof -http=: %s/cpu.pprof, or flamegraph.pl %s/cpu.folded > cpu.svg\n", out, out)
+	return nil
+}
+
+// Function to benchmark a revision in a temporary worktree and the working tree, one
+// after the other on the same machine, and compare them.
+// Parameters:
+// ctx: context.Context - Cancels the benchmarks.
+// b: benchFlags - The benchmarks to run.
+// base: string - The git revision of the baseline.
+// out: string - The directory of base.txt and head.txt.
+// threshold: float64 - The growth in percent above which a metric regresses.
+// stdout: io.Writer - Where the comparison is printed.
+// Returns:
+// int - The number of regressed metrics.
+// error - An error creating the worktree or running the benchmarks.
+func gateCommand(ctx context.Context, b benchFlags, base string, out string, threshold float64, stdout io.Writer) (int, error) {
+	if err := os.MkdirAll(out, 0o755); err != nil {
+		return 0, err
+	}
+	worktree, err := os.MkdirTemp("", "perfgate-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(worktree)
+	if output, err := exec.CommandContext(ctx, "git", "worktree", "add", "--detach", worktree, base).CombinedOutput(); err != nil {
+		return 0, fmt.Errorf("git worktree add %s: %w: %s", base, err, bytes.TrimSpace(output))
+	}
+	defer exec.Command("git", "worktree", "remove", "--force", worktree).Run()
+
+	// The package is found at the same place in the worktree
+	root, err := exec.CommandContext(ctx, "git", "rev-parse", "--show-prefix").Output()
+	if err != nil {
+		return 0, err
+	}
+	baseFile, headFile := filepath.Join(out, "base.txt"), filepath.Join(out, "head.txt")
+	fmt.Fprintf(stdout, "benchmarking %s\n", base)
+	if err := runBench(ctx, b, filepath.Join(worktree, string(bytes.TrimSpace(root))), baseFile); err != nil {
+		return 0, err
+	}
+	fmt.Fprintln(stdout, "benchmarking the working tree")
+	if err := runBench(ctx, b, ".", headFile); err != nil {
+		return 0, err
+	}
+
+	old, err := readBench(baseFile)
+	if err != nil {
+		return 0, err
+	}
+	new, err := readBench(headFile)
+	if err != nil {
+		return 0, err
+	}
+	return compareBench(old, new, threshold, stdout), nil
+}
+
+// Function to run benchmarks and save their output.
+// Parameters:
+// ctx: context.Context - Cancels the benchmarks.
+// b: benchFlags - The benchmarks to run.
+// dir: string - The directory go test runs in.
+// file: string - Where the output is saved.
+// extra: ...string - More flags of go test, e.g. -cpuprofile.
+// Returns:
+// error - An error running the benchmarks, with their output.
+func runBench(ctx context.Context, b benchFlags, dir string, file string, extra ...string) error {
+	args := append([]string{"test", "-run", "^$", "-bench", b.bench, "-benchtime", b.benchtime,
+		"-count", fmt.Sprint(b.count), "-benchmem"}, extra...)
+	command := exec.CommandContext(ctx, "go", append(args, b.pkg)...)
+	command.Dir = dir
+	output, err := command.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("go test in %s: %w\n%s", dir, err, output)
+	}
+	return os.WriteFile(file, output, 0o644)
+}
+
+// Function to read a saved benchmark output.
+// Parameters:
+// file: string - The file.
+// Returns:
+// *benchSet - The results.
+// error - An error reading the file.
+func readBench(file string) (*benchSet, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseBench(f)
+}
+
+// Function to write the folded stacks of a profile file.
+// Parameters:
+// file: string - The pprof profile.
+// value: string - The sample type to fold, the last one when empty.
+// w: io.Writer - Where the stacks are written.
+// Returns:
+// error - An error reading or folding the profile.
+func foldFile(file string, value string, w io.Writer) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	p, err := parseProfile(data)
+	if err != nil {
+		return err
+	}
+	return p.fold(value, w)
+}
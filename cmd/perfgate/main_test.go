@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	old, new := filepath.Join(dir, "old.txt"), filepath.Join(dir, "new.txt")
+	os.WriteFile(old, []byte("BenchmarkHotPathEnvelope-8   100   3000 ns/op\n"), 0o644)
+	os.WriteFile(new, []byte("BenchmarkHotPathEnvelope-8   100   3600 ns/op\n"), 0o644)
+
+	var stdout bytes.Buffer
+	assert.Equal(t, 1, run(context.Background(), []string{"compare", old, new}, &stdout, &bytes.Buffer{}))
+	assert.Contains(t, stdout.String(), "REGRESSION")
+	assert.Equal(t, 0, run(context.Background(), []string{"compare", "-threshold", "25", old, new}, &bytes.Buffer{}, &bytes.Buffer{}))
+
+	var stderr bytes.Buffer
+	assert.Equal(t, 1, run(context.Background(), []string{"fold", old}, &bytes.Buffer{}, &stderr))
+	assert.Contains(t, stderr.String(), "not a pprof profile")
+
+	assert.Equal(t, 2, run(context.Background(), nil, &bytes.Buffer{}, &bytes.Buffer{}))
+	assert.Equal(t, 2, run(context.Background(), []string{"compare", old}, &bytes.Buffer{}, &bytes.Buffer{}))
+	assert.Equal(t, 2, run(context.Background(), []string{"bogus"}, &bytes.Buffer{}, &bytes.Buffer{}))
+}
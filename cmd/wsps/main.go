@@ -0,0 +1,210 @@
+// This file is wsps, a command-line client of the server for testing and scripting:
+//
+//	wsps sub -t news              print the messages of a topic, one per line
+//	wsps pub -t news -m '{"x":1}' publish a message, or each line of stdin without -m
+//
+// The server URL and token come from -url and -token, or WSPS_URL and WSPS_TOKEN.
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"mywebsocketserver/client"
+)
+
+const usage = `usage: wsps [-url ws://host:port/ws] [-token jwt] <command> [flags]
+
+commands:
+  sub -t topic [-t topic ...] [-n count] [-v]   print the messages of the topics
+  pub -t topic [-m message]                     publish a message, or each line of stdin
+`
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	os.Exit(run(ctx, os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// Topics given with repeated -t flags
+type topicList []string
+
+func (l *topicList) String() string { return strings.Join(*l, ",") }
+
+func (l *topicList) Set(topic string) error {
+	*l = append(*l, topic)
+	return nil
+}
+
+// Function to run a command.
+// Parameters:
+// ctx: context.Context - Cancelled to stop subscribing, e.g. on Ctrl-C.
+// args: []string - The arguments, without the program name.
+// stdin: io.Reader - The messages to publish when pub has no -m.
+// stdout: io.Writer - Where received messages are printed.
+// stderr: io.Writer - Where usage and errors are printed.
+// Returns:
+// int - The exit code: 0 on success, 1 on failure, 2 on invalid usage.
+func run(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	global := flag.NewFlagSet("wsps", flag.ContinueOnError)
+	global.SetOutput(stderr)
+	global.Usage = func() { fmt.Fprint(stderr, usage) }
+	url := global.String("url", envOr("WSPS_URL", "ws://localhost:8080/ws"), "WebSocket URL of the server")
+	token := global.String("token", os.Getenv("WSPS_TOKEN"), "JWT sent in the Authorization header")
+	if err := global.Parse(args); err != nil {
+		return 2
+	}
+	if global.NArg() == 0 {
+		global.Usage()
+		return 2
+	}
+
+	command := flag.NewFlagSet(global.Arg(0), flag.ContinueOnError)
+	command.SetOutput(stderr)
+	command.Usage = global.Usage
+	var topics topicList
+	command.Var(&topics, "t", "topic")
+	message := command.String("m", "", "message to publish, JSON or text")
+	count := command.Int("n", 0, "exit after this many messages, 0 for never")
+	verbose := command.Bool("v", false, "print the topic and ID of each message")
+	if err := command.Parse(global.Args()[1:]); err != nil {
+		return 2
+	}
+	if len(topics) == 0 || (global.Arg(0) == "pub" && len(topics) != 1) {
+		fmt.Fprintln(stderr, "wsps: give one topic with -t to pub, and at least one to sub")
+		return 2
+	}
+
+	options := client.Options{OnError: func(err error) { fmt.Fprintln(stderr, "wsps:", err) }}
+	if *token != "" {
+		options.Header = http.Header{"Authorization": {"Bearer " + *token}}
+	}
+	dialCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	c, err := client.Connect(dialCtx, *url, options)
+	cancel()
+	if err != nil {
+		fmt.Fprintln(stderr, "wsps:", err)
+		return 1
+	}
+	defer c.Close()
+
+	switch global.Arg(0) {
+	case "sub":
+		err = subscribe(ctx, c, topics, *count, *verbose, stdout)
+	case "pub":
+		err = publish(c, topics[0], *message, stdin)
+	default:
+		global.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, "wsps:", err)
+		return 1
+	}
+	return 0
+}
+
+// Function to print the messages of topics until the context is cancelled.
+// Parameters:
+// ctx: context.Context - Cancelled to stop.
+// c: *client.Client - The connected client.
+// topics: []string - The topics.
+// count: int - The number of messages to print before returning, 0 for no limit.
+// verbose: bool - Whether to print the topic and ID before each message.
+// stdout: io.Writer - Where messages are printed.
+// Returns:
+// error - An error if a subscription failed.
+func subscribe(ctx context.Context, c *client.Client, topics []string, count int, verbose bool, stdout io.Writer) error {
+	// Every topic feeds one channel so messages print in the order they arrive
+	merged := make(chan client.Message)
+	for _, topic := range topics {
+		messages, err := c.Subscribe(topic)
+		if err != nil {
+			return err
+		}
+		go func() {
+			for message := range messages {
+				select {
+				case merged <- message:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	for received := 0; count == 0 || received < count; received++ {
+		select {
+		case <-ctx.Done():
+			return nil
+		case message := <-merged:
+			if verbose {
+				fmt.Fprintf(stdout, "%s %s %s\n", message.Topic, message.Id, message.Payload)
+			} else {
+				fmt.Fprintf(stdout, "%s\n", message.Payload)
+			}
+		}
+	}
+	return nil
+}
+
+// Function to publish a message, or each line of stdin when no message is given.
+// Parameters:
+// c: *client.Client - The connected client.
+// topic: string - The topic.
+// message: string - The message, or an empty string to read stdin.
+// stdin: io.Reader - The messages to publish, one per line.
+// Returns:
+// error - An error if a message could not be published.
+func publish(c *client.Client, topic string, message string, stdin io.Reader) error {
+	if message != "" {
+		return c.Publish(topic, payload(message))
+	}
+	scanner := bufio.NewScanner(stdin)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			if err := c.Publish(topic, payload(line)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// Function to get the payload of a message given on the command line.
+// Parameters:
+// message: string - The message.
+// Returns:
+// interface{} - The message as is if it is JSON, or else as a JSON string.
+func payload(message string) interface{} {
+	if json.Valid([]byte(message)) {
+		return json.RawMessage(message)
+	}
+	return message
+}
+
+// Function to read an environment variable with a default.
+// Parameters:
+// name: string - The variable.
+// fallback: string - The value when the variable is unset.
+// Returns:
+// string - The value.
+func envOr(name string, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
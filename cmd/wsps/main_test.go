@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// A server relaying publishes to the subscribers of every connection
+func newRelayServer(t *testing.T) string {
+	var mu sync.Mutex
+	subscribers := map[string][]*websocket.Conn{}
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		mu.Lock()
+		ws.WriteJSON(map[string]string{"action": "welcome", "clientId": "c"})
+		mu.Unlock()
+		for {
+			var m struct {
+				Action  string          `json:"action"`
+				Topic   string          `json:"topic"`
+				Message json.RawMessage `json:"message"`
+			}
+			if err := ws.ReadJSON(&m); err != nil {
+				return
+			}
+			mu.Lock()
+			switch m.Action {
+			case "subscribe":
+				subscribers[m.Topic] = append(subscribers[m.Topic], ws)
+			case "publish":
+				for _, subscriber := range subscribers[m.Topic] {
+					subscriber.WriteJSON(map[string]interface{}{"action": "message", "topic": m.Topic, "id": "m1", "message": m.Message})
+				}
+			}
+			mu.Unlock()
+		}
+	}))
+	t.Cleanup(server.Close)
+	return "ws" + server.URL[4:]
+}
+
+// A buffer written by a command running in the background
+type syncBuffer struct {
+	mu     sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.String()
+}
+
+func TestPubSub(t *testing.T) {
+	url := newRelayServer(t)
+	var stdout, stderr syncBuffer
+	done := make(chan int)
+	go func() {
+		done <- run(context.Background(), []string{"-url", url, "sub", "-t", "news", "-n", "3", "-v"}, nil, &stdout, &stderr)
+	}()
+
+	// Publish until the subscriber is listening
+	assert.Eventually(t, func() bool {
+		var pubErr bytes.Buffer
+		code := run(context.Background(), []string{"-url", url, "pub", "-t", "news", "-m", `{"x":1}`}, nil, &bytes.Buffer{}, &pubErr)
+		assert.Equal(t, 0, code, pubErr.String())
+		return strings.Count(stdout.String(), "\n") > 0
+	}, 2*time.Second, 50*time.Millisecond)
+	assert.Equal(t, 0, run(context.Background(), []string{"-url", url, "pub", "-t", "news"}, strings.NewReader("plain text\n\n[1,2]\n"), &bytes.Buffer{}, &bytes.Buffer{}))
+
+	select {
+	case code := <-done:
+		assert.Equal(t, 0, code, stderr.String())
+	case <-time.After(2 * time.Second):
+		t.Fatal("sub should exit after -n messages")
+	}
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	assert.Equal(t, `news m1 {"x":1}`, lines[0])
+	assert.Contains(t, lines, `news m1 "plain text"`)
+}
+
+func TestUsage(t *testing.T) {
+	var stderr bytes.Buffer
+	assert.Equal(t, 2, run(context.Background(), nil, nil, &bytes.Buffer{}, &stderr))
+	assert.Contains(t, stderr.String(), "usage: wsps")
+	assert.Equal(t, 2, run(context.Background(), []string{"pub", "-m", "x"}, nil, &bytes.Buffer{}, &stderr))
+	assert.Equal(t, 1, run(context.Background(), []string{"-url", "ws://127.0.0.1:1/ws", "sub", "-t", "news"}, nil, &bytes.Buffer{}, &stderr))
+}
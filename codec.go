@@ -0,0 +1,160 @@
+// This file abstracts the encoding of the frames of a connection behind a registry of
+// envelope codecs selectable by name. The server builds every frame as JSON; a client
+// asking for another codec with the Sec-WebSocket-Protocol header, e.g. cbor, msgpack
+// or protobuf, gets its frames translated to that format and sends frames in it, so
+// constrained devices never have to produce or parse JSON and high-frequency feeds use
+// less bandwidth.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+// Response header naming the subprotocol, and so the codec, the server selected
+const subprotocolHeader = "Sec-WebSocket-Protocol"
+
+// EnvelopeCodec encodes the frames of a connection.
+type EnvelopeCodec interface {
+	// The subprotocol selecting the codec
+	Name() string
+	// The WebSocket message type of the encoded frames
+	MessageType() int
+	// Encode translates a frame built by the server, usually JSON, to the codec's format
+	Encode(frame []byte) ([]byte, error)
+	// Decode translates a frame of a client to JSON
+	Decode(data []byte) ([]byte, error)
+	// EncodeBinary translates a binary message, sent in a binary frame
+	EncodeBinary(data []byte) ([]byte, error)
+}
+
+// Registry of the envelope codecs that can be selected by name
+var envelopeCodecs = map[string]EnvelopeCodec{}
+
+// Function to make an envelope codec selectable by its name.
+// Parameters:
+// codec: EnvelopeCodec - The codec to register.
+func RegisterEnvelopeCodec(codec EnvelopeCodec) {
+	envelopeCodecs[codec.Name()] = codec
+}
+
+// Function to look up a registered envelope codec.
+// Parameters:
+// name: string - The name of the codec, e.g. "json" or "cbor".
+// Returns:
+// EnvelopeCodec - The codec.
+// error - An error if no codec with that name is registered.
+func GetEnvelopeCodec(name string) (EnvelopeCodec, error) {
+	codec, ok := envelopeCodecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown envelope codec %q", name)
+	}
+	return codec, nil
+}
+
+func init() {
+	RegisterEnvelopeCodec(JSONEnvelopeCodec{})
+	RegisterEnvelopeCodec(CBOREnvelopeCodec{})
+	RegisterEnvelopeCodec(MsgpackEnvelopeCodec{})
+	RegisterEnvelopeCodec(ProtobufEnvelopeCodec{})
+}
+
+// JSONEnvelopeCodec sends frames as built, in text frames. It is the codec of clients
+// asking for none.
+type JSONEnvelopeCodec struct{}
+
+func (JSONEnvelopeCodec) Name() string { return "json" }
+
+func (JSONEnvelopeCodec) MessageType() int { return websocket.TextMessage }
+
+func (JSONEnvelopeCodec) Encode(frame []byte) ([]byte, error) { return frame, nil }
+
+func (JSONEnvelopeCodec) Decode(data []byte) ([]byte, error) { return data, nil }
+
+func (JSONEnvelopeCodec) EncodeBinary(data []byte) ([]byte, error) { return data, nil }
+
+// CBOREnvelopeCodec sends frames as CBOR in binary frames. Frames that are not JSON,
+// such as the acknowledgement of every frame, are sent as CBOR text strings and binary
+// messages as CBOR byte strings.
+type CBOREnvelopeCodec struct{}
+
+func (CBOREnvelopeCodec) Name() string { return "cbor" }
+
+func (CBOREnvelopeCodec) MessageType() int { return websocket.BinaryMessage }
+
+func (CBOREnvelopeCodec) Encode(frame []byte) ([]byte, error) {
+	if !json.Valid(frame) {
+		frame, _ = json.Marshal(string(frame))
+	}
+	return jsonToCBOR(frame)
+}
+
+func (CBOREnvelopeCodec) Decode(data []byte) ([]byte, error) {
+	return cborToJSON(data)
+}
+
+func (CBOREnvelopeCodec) EncodeBinary(data []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	writeCBORHead(&buffer, cborBytes, uint64(len(data)))
+	buffer.Write(data)
+	return buffer.Bytes(), nil
+}
+
+// MsgpackEnvelopeCodec sends frames as MessagePack in binary frames. Like with CBOR,
+// frames that are not JSON are sent as strings and binary messages as bin values.
+type MsgpackEnvelopeCodec struct{}
+
+func (MsgpackEnvelopeCodec) Name() string { return "msgpack" }
+
+func (MsgpackEnvelopeCodec) MessageType() int { return websocket.BinaryMessage }
+
+func (MsgpackEnvelopeCodec) Encode(frame []byte) ([]byte, error) {
+	if !json.Valid(frame) {
+		frame, _ = json.Marshal(string(frame))
+	}
+	return jsonToMsgpack(frame)
+}
+
+func (MsgpackEnvelopeCodec) Decode(data []byte) ([]byte, error) {
+	return msgpackToJSON(data)
+}
+
+func (MsgpackEnvelopeCodec) EncodeBinary(data []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	writeMsgpackHead(&buffer, len(data), 0, 0, 0xc4, 0xc5, 0xc6)
+	buffer.Write(data)
+	return buffer.Bytes(), nil
+}
+
+// ProtobufEnvelopeCodec sends frames as the protobuf Frame messages of
+// envelopepb/envelope.proto in binary frames, and reads Request messages.
+type ProtobufEnvelopeCodec struct{}
+
+func (ProtobufEnvelopeCodec) Name() string { return "protobuf" }
+
+func (ProtobufEnvelopeCodec) MessageType() int { return websocket.BinaryMessage }
+
+func (ProtobufEnvelopeCodec) Encode(frame []byte) ([]byte, error) { return jsonToProtobuf(frame) }
+
+func (ProtobufEnvelopeCodec) Decode(data []byte) ([]byte, error) { return protobufToJSON(data) }
+
+func (ProtobufEnvelopeCodec) EncodeBinary(data []byte) ([]byte, error) { return binaryToProtobuf(data) }
+
+// Function to pick the envelope codec of a connection from the subprotocols the client
+// offered, in the client's order of preference.
+// Parameters:
+// r: *http.Request - The upgrade request.
+// Returns:
+// EnvelopeCodec - The first registered codec offered, or nil for JSON if the client offered none.
+func negotiateCodec(r *http.Request) EnvelopeCodec {
+	for _, name := range websocket.Subprotocols(r) {
+		if codec, err := GetEnvelopeCodec(name); err == nil {
+			return codec
+		}
+	}
+	return nil
+}
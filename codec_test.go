@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCBORCodecIsNegotiatedBySubprotocol(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(ps.webSocketHandler))
+	defer server.Close()
+	dialer := websocket.Dialer{Subprotocols: []string{"v2.example", "cbor", "json"}}
+	ws, _, err := dialer.Dial("ws"+server.URL[4:], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	assert.Equal(t, "cbor", ws.Subprotocol(), "The first codec the client offered should be selected")
+
+	// read decodes the next frame, which must be binary CBOR
+	read := func() string {
+		messageType, data, err := ws.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, websocket.BinaryMessage, messageType)
+		decoded, err := cborToJSON(data)
+		assert.NoError(t, err)
+		return string(decoded)
+	}
+	assert.Contains(t, read(), `"action":"welcome"`)
+
+	frame, _ := jsonToCBOR([]byte(`{"action":"subscribe","topic":"cbor-sensors"}`))
+	ws.WriteMessage(websocket.BinaryMessage, frame)
+	assert.Equal(t, `"Server received the message!"`, read())
+	frame, _ = jsonToCBOR([]byte(`{"action":"publish","topic":"cbor-sensors","message":{"t":21.5}}`))
+	ws.WriteMessage(websocket.BinaryMessage, frame)
+	assert.Equal(t, `"Server received the message!"`, read())
+	assert.JSONEq(t, `{"t":21.5}`, read())
+}
+
+func TestMsgpackCodecIsNegotiatedBySubprotocol(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(ps.webSocketHandler))
+	defer server.Close()
+	dialer := websocket.Dialer{Subprotocols: []string{"msgpack"}}
+	ws, _, err := dialer.Dial("ws"+server.URL[4:], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	assert.Equal(t, "msgpack", ws.Subprotocol())
+
+	read := func() []byte {
+		messageType, data, err := ws.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, websocket.BinaryMessage, messageType)
+		return data
+	}
+	decode := func(data []byte) string {
+		decoded, err := msgpackToJSON(data)
+		assert.NoError(t, err)
+		return string(decoded)
+	}
+	assert.Contains(t, decode(read()), `"action":"welcome"`)
+
+	frame, _ := jsonToMsgpack([]byte(`{"action":"subscribe","topic":"msgpack-feed"}`))
+	ws.WriteMessage(websocket.BinaryMessage, frame)
+	assert.Equal(t, `"Server received the message!"`, decode(read()))
+	frame, _ = jsonToMsgpack([]byte(`{"action":"publish","topic":"msgpack-feed","message":{"bid":101.25,"ask":101.5}}`))
+	ws.WriteMessage(websocket.BinaryMessage, frame)
+	read()
+	assert.JSONEq(t, `{"bid":101.25,"ask":101.5}`, decode(read()))
+
+	// Binary messages arrive as bin values
+	frame, _ = jsonToMsgpack([]byte(`{"action":"publish","topic":"msgpack-feed","data":"AQI="}`))
+	ws.WriteMessage(websocket.BinaryMessage, frame)
+	read()
+	assert.Equal(t, []byte{0xc4, 0x02, 0x01, 0x02}, read())
+}
+
+func TestPreparedForCombinesCodecs(t *testing.T) {
+	payload := NewPayload([]byte(`{"t":21.5}`))
+	plain, err := payload.PreparedFor(nil, nil)
+	assert.NoError(t, err)
+	prepared, _ := payload.Prepared()
+	assert.Same(t, prepared, plain)
+
+	cbor, _ := GetEnvelopeCodec("cbor")
+	gzip, _ := GetCompressor("gzip")
+	encoded, err := payload.PreparedFor(cbor, gzip)
+	assert.NoError(t, err)
+	again, _ := payload.PreparedFor(cbor, gzip)
+	assert.Same(t, encoded, again, "Frames should be built once per pair of codecs")
+	compressed, _ := payload.PreparedFor(nil, gzip)
+	assert.NotSame(t, encoded, compressed)
+
+	_, err = GetEnvelopeCodec("xml")
+	assert.Error(t, err)
+}
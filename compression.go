@@ -0,0 +1,207 @@
+// This file abstracts compression behind a registry of codecs selectable by name. A
+// client picks the codec of its connection during the handshake, and the history
+// picks the codec of each topic's stored entries, so new codecs can be adopted
+// without touching the delivery pipeline.
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Response header naming the codec the server compresses the connection with
+const compressionHeader = "X-Compression"
+
+// Compressor compresses payloads written to connections or stored in the history.
+type Compressor interface {
+	Name() string
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+// Registry of the compressors that can be selected by name
+var compressors = map[string]Compressor{}
+
+// Function to make a compressor selectable by its name.
+// Parameters:
+// compressor: Compressor - The compressor to register.
+func RegisterCompressor(compressor Compressor) {
+	compressors[compressor.Name()] = compressor
+}
+
+// Function to look up a registered compressor.
+// Parameters:
+// name: string - The name of the compressor, e.g. "deflate", "gzip", "zstd" or "snappy".
+// Returns:
+// Compressor - The compressor.
+// error - An error if no compressor with that name is registered.
+func GetCompressor(name string) (Compressor, error) {
+	compressor, ok := compressors[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown compression codec %q", name)
+	}
+	return compressor, nil
+}
+
+func init() {
+	RegisterCompressor(DeflateCompressor{})
+	RegisterCompressor(GzipCompressor{})
+	RegisterCompressor(newZstdCompressor())
+	RegisterCompressor(SnappyCompressor{})
+}
+
+// DeflateCompressor compresses with raw DEFLATE (RFC 1951).
+type DeflateCompressor struct{}
+
+func (DeflateCompressor) Name() string { return "deflate" }
+
+func (DeflateCompressor) Compress(data []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer, _ := flate.NewWriter(&buffer, flate.DefaultCompression)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (DeflateCompressor) Decompress(data []byte) ([]byte, error) {
+	return io.ReadAll(flate.NewReader(bytes.NewReader(data)))
+}
+
+// GzipCompressor compresses with gzip (RFC 1952).
+type GzipCompressor struct{}
+
+func (GzipCompressor) Name() string { return "gzip" }
+
+func (GzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (GzipCompressor) Decompress(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(reader)
+}
+
+// ZstdCompressor compresses with Zstandard (RFC 8878). Its encoder and decoder are
+// shared and safe for concurrent use.
+type ZstdCompressor struct {
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}
+
+// Function to create the Zstandard compressor.
+// Returns:
+// *ZstdCompressor - The compressor.
+func newZstdCompressor() *ZstdCompressor {
+	encoder, _ := zstd.NewWriter(nil)
+	decoder, _ := zstd.NewReader(nil)
+	return &ZstdCompressor{encoder: encoder, decoder: decoder}
+}
+
+func (z *ZstdCompressor) Name() string { return "zstd" }
+
+func (z *ZstdCompressor) Compress(data []byte) ([]byte, error) {
+	return z.encoder.EncodeAll(data, nil), nil
+}
+
+func (z *ZstdCompressor) Decompress(data []byte) ([]byte, error) {
+	return z.decoder.DecodeAll(data, nil)
+}
+
+// SnappyCompressor compresses with the Snappy block format.
+type SnappyCompressor struct{}
+
+func (SnappyCompressor) Name() string { return "snappy" }
+
+func (SnappyCompressor) Compress(data []byte) ([]byte, error) {
+	return snappy.Encode(nil, data), nil
+}
+
+func (SnappyCompressor) Decompress(data []byte) ([]byte, error) {
+	return snappy.Decode(nil, data)
+}
+
+// Function to pick the codec of a connection from the compression query parameter of
+// the upgrade request, a comma separated list of codecs in order of preference.
+// Parameters:
+// r: *http.Request - The upgrade request.
+// Returns:
+// Compressor - The first registered codec of the list, or nil when none was asked for.
+// error - An error if none of the codecs asked for is registered.
+func negotiateCompression(r *http.Request) (Compressor, error) {
+	value := r.URL.Query().Get("compression")
+	if value == "" {
+		return nil, nil
+	}
+	for _, name := range strings.Split(value, ",") {
+		if compressor, err := GetCompressor(strings.TrimSpace(name)); err == nil {
+			return compressor, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported compression %q", value)
+}
+
+// CompressionRule selects the codec of the stored entries of the topics matching a pattern.
+type CompressionRule struct {
+	Topic      string
+	Compressor Compressor
+}
+
+// Function to parse the history compression rules, e.g. "logs.*=zstd,chat.*=snappy".
+// Parameters:
+// value: string - Comma separated pattern=codec pairs.
+// Returns:
+// []CompressionRule - The rules, in order.
+// error - An error if a rule is malformed or names an unknown codec.
+func ParseCompressionRules(value string) ([]CompressionRule, error) {
+	var rules []CompressionRule
+	for _, rule := range strings.Split(value, ",") {
+		topic, name, ok := strings.Cut(strings.TrimSpace(rule), "=")
+		if !ok || topic == "" {
+			return nil, fmt.Errorf("invalid compression rule %q", rule)
+		}
+		compressor, err := GetCompressor(name)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, CompressionRule{Topic: topic, Compressor: compressor})
+	}
+	return rules, nil
+}
+
+// Function to get the codec of the stored entries of a topic.
+// Parameters:
+// rules: []CompressionRule - The rules.
+// topic: string - The topic.
+// Returns:
+// Compressor - The codec of the first matching rule, or nil to store entries uncompressed.
+func compressorFor(rules []CompressionRule, topic string) Compressor {
+	for _, rule := range rules {
+		if globMatch(rule.Topic, topic) {
+			return rule.Compressor
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressorsRoundTrip(t *testing.T) {
+	message := []byte(strings.Repeat(`{"price": 101.5, "symbol": "ACME"}`, 20))
+	for _, name := range []string{"deflate", "gzip", "zstd", "snappy"} {
+		compressor, err := GetCompressor(name)
+		if !assert.NoError(t, err, name) {
+			continue
+		}
+		compressed, err := compressor.Compress(message)
+		assert.NoError(t, err, name)
+		assert.Less(t, len(compressed), len(message), name)
+		decompressed, err := compressor.Decompress(compressed)
+		assert.NoError(t, err, name)
+		assert.Equal(t, message, decompressed, name)
+	}
+	_, err := GetCompressor("brotli")
+	assert.Error(t, err)
+}
+
+func TestConnectionCompressionIsNegotiated(t *testing.T) {
+	previous := ps
+	ps = &PubSub{}
+	t.Cleanup(func() { ps = previous })
+	server := httptest.NewServer(http.HandlerFunc(ps.webSocketHandler))
+	defer server.Close()
+	url := "ws" + server.URL[4:]
+
+	_, response, err := websocket.DefaultDialer.Dial(url+"?compression=brotli", nil)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+
+	ws, response, err := websocket.DefaultDialer.Dial(url+"?compression=brotli,zstd", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	assert.Equal(t, "zstd", response.Header.Get(compressionHeader), "The first known codec should be picked")
+	zstd, _ := GetCompressor("zstd")
+	read := func() string {
+		messageType, data, err := ws.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, websocket.BinaryMessage, messageType)
+		data, err = zstd.Decompress(data)
+		assert.NoError(t, err)
+		return string(data)
+	}
+	var welcome welcomeFrame
+	assert.NoError(t, json.Unmarshal([]byte(read()), &welcome))
+	assert.Equal(t, "welcome", welcome.Action)
+
+	subscribe, _ := zstd.Compress([]byte(`{"action":"subscribe","topic":"prices"}`))
+	ws.WriteMessage(websocket.BinaryMessage, subscribe)
+	assert.Equal(t, "Server received the message!", read())
+	assert.Eventually(t, func() bool {
+		ps.mu.Lock()
+		defer ps.mu.Unlock()
+		return len(ps.Subscriptions()) == 1
+	}, time.Second, 10*time.Millisecond)
+	ps.Publish("prices", []byte(`{"ACME": 101.5}`), nil)
+	assert.Equal(t, `{"ACME": 101.5}`, read())
+}
+
+func TestHistoryCompressionPerTopic(t *testing.T) {
+	rules, err := ParseCompressionRules("logs.*=zstd, chat.*=snappy")
+	assert.NoError(t, err)
+	history := NewMemoryHistory(JSONEntryCodec{}, 10)
+	history.Compression = rules
+
+	history.Append("m1", "logs.api", []byte(`"started"`))
+	history.Append("m2", "news", []byte(`"headline"`))
+	assert.Equal(t, "zstd", history.topics["logs.api"][0].Compression)
+	assert.Empty(t, history.topics["news"][0].Compression)
+
+	entries, err := history.Entries("logs.api")
+	assert.NoError(t, err)
+	assert.Equal(t, `"started"`, string(entries[0].Payload))
+	assert.True(t, history.Redact("logs.api", "m1"), "Compressed entries should be found by ID")
+
+	_, err = ParseCompressionRules("logs.*=brotli")
+	assert.Error(t, err)
+}
@@ -0,0 +1,469 @@
+// This file loads the configuration of the server from an optional YAML file,
+// environment variables and command-line flags, in increasing order of precedence.
+// Every setting has one name used by all three sources: max_subscriptions in YAML,
+// MAX_SUBSCRIPTIONS in the environment and -max-subscriptions on the command line.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the configuration the server and its PubSub are constructed from.
+type Config struct {
+	ListenAddr      string
+	StaticDir       string
+	MetricsPath     string
+	ReadBufferSize  int
+	WriteBufferSize int
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	ShutdownTimeout time.Duration
+	LogLevel        string
+	LogFormat       string
+
+	PermessageDeflate              bool
+	PermessageDeflateLevel         int
+	PermessageDeflateExcludeTopics []string
+
+	TraceEndpoint    string
+	TraceSampleRatio float64
+
+	TLSCertFile   string
+	TLSKeyFile    string
+	AutocertHosts []string
+	AutocertCache string
+	AutocertEmail string
+
+	AllowedOrigins     []string
+	CloseReasonCatalog string
+
+	JWTSecret        string
+	JWTPublicKeyFile string
+	JWTIssuer        string
+	JWTAudience      string
+	TokenTTL         time.Duration
+	TokenMaxTTL      time.Duration
+	APIKeysFile      string
+	AdminAPIKey      string
+	ACLFile          string
+	InviteSecret     string
+
+	UnauthorizedPolicy   string
+	HoneypotTopic        string
+	StrictJSONEndpoints  []string
+	TrustClientPublisher bool
+
+	AdminEventsTopic string
+	DebugLogDir      string
+
+	StatusGracePeriod time.Duration
+
+	MatchmakingFile string
+
+	WidgetTokenTTL         time.Duration
+	WidgetMaxSubscriptions int
+	WidgetMaxMessageSize   int64
+
+	MaxConnections     int
+	MaxConnsPerIP      int
+	TrustedProxies     []string
+	ClientIDProvider   string
+	MaxSubscriptions   int
+	MaxMessageSize     int64
+	RateLimit          float64
+	RateBurst          int
+	RateLimitStrikes   int
+	HeartbeatInterval  time.Duration
+	SendQueueSize      int
+	SlowConsumerPolicy string
+	SlowStartRate      float64
+	SlowStartDuration  time.Duration
+
+	HistoryLimit        int
+	HistoryCodec        string
+	HistoryCompression  string
+	RetentionPolicyFile string
+	ReadYourWrites      bool
+	ExplicitTopics      bool
+	TopicIdleTTL        time.Duration
+	IdleTimeout         time.Duration
+	TopicMetricsLimit   int
+	FanOutWorkers       int
+	RegistryShards      int
+	FanOutThreshold     int
+	AckTimeout          time.Duration
+	RedeliveryBackoff   time.Duration
+	RedeliveryMaxDelay  time.Duration
+	MaxDeliveries       int
+	SessionGrace        time.Duration
+	OfflineQueueSize    int
+	DurableSubsFile     string
+	ArchiveDir          string
+	ArchiveTopics       []string
+	ArchiveInterval     time.Duration
+	ArchiveS3Endpoint   string
+	ArchiveS3Region     string
+	ArchiveS3Bucket     string
+	ArchiveS3Prefix     string
+	ArchiveS3AccessKey  string
+	ArchiveS3SecretKey  string
+
+	ModerationTopics         []string
+	ModerationHookURL        string
+	ModerationTimeout        time.Duration
+	ModerationTimeoutVerdict string
+	ScanURL                  string
+	ScanTopics               string
+	ScanTimeout              time.Duration
+	SchemaTopics             []string
+	SchemaSampleRate         float64
+	SchemaLearningSamples    int
+	SchemaDriftThreshold     float64
+	AnalyticsPolicyFile      string
+	AnalyticsURL             string
+	AnalyticsClickHouseTable string
+
+	NATSURL        string
+	RedisURL       string
+	ClusterAddress string
+	ClusterSecret  string
+	ClusterPeers   []string
+	ProbeInterval  time.Duration
+	MQTTAddr       string
+	TCPAddr        string
+}
+
+// Function to get the configuration used when nothing is set.
+// Returns:
+// Config - The default configuration.
+func DefaultConfig() Config {
+	return Config{
+		ListenAddr:             ":8080",
+		StaticDir:              "static",
+		MetricsPath:            "/metrics",
+		ReadBufferSize:         1024,
+		WriteBufferSize:        1024,
+		WriteTimeout:           10 * time.Second,
+		ShutdownTimeout:        10 * time.Second,
+		LogLevel:               "info",
+		LogFormat:              "text",
+		PermessageDeflateLevel: defaultDeflateLevel,
+		SendQueueSize:          256,
+		SlowConsumerPolicy:     string(DisconnectSlowConsumer),
+		SlowStartDuration:      10 * time.Second,
+		RateLimitStrikes:       defaultRateLimitStrikes,
+		TokenTTL:               5 * time.Minute,
+		TokenMaxTTL:            time.Hour,
+		HistoryCodec:           "json",
+		ArchiveInterval:        defaultArchiveInterval,
+		ArchiveS3Region:        "us-east-1",
+		ModerationTimeout:      defaultModerationTimeout,
+		AckTimeout:             defaultAckTimeout,
+		RedeliveryBackoff:      defaultRedeliveryBackoff,
+		RedeliveryMaxDelay:     defaultRedeliveryMaxDelay,
+		MaxDeliveries:          defaultMaxDeliveries,
+		SessionGrace:           defaultSessionGrace,
+		OfflineQueueSize:       defaultOfflineQueueSize,
+		TopicMetricsLimit:      defaultTopicMetricsLimit,
+		FanOutThreshold:        defaultFanOutThreshold,
+		RegistryShards:         defaultRegistryShards,
+		ScanTimeout:            defaultScanTimeout,
+		SchemaSampleRate:       defaultSchemaSampleRate,
+		SchemaLearningSamples:  defaultSchemaLearningSamples,
+		SchemaDriftThreshold:   defaultSchemaDriftThreshold,
+		TraceSampleRatio:       1,
+		UnauthorizedPolicy:     string(RejectUnauthorized),
+		HoneypotTopic:          "$honeypot",
+		AdminEventsTopic:       "$admin.events",
+		StatusGracePeriod:      5 * time.Second,
+		WidgetTokenTTL:         2 * time.Minute,
+		WidgetMaxSubscriptions: 5,
+		WidgetMaxMessageSize:   4096,
+	}
+}
+
+// A setting of the configuration. Value points to the field of the Config it sets.
+type setting struct {
+	Name  string
+	Usage string
+	Value any
+}
+
+// Function to list the settings of a configuration.
+// Returns:
+// []setting - The settings, pointing into c.
+func (c *Config) settings() []setting {
+	return []setting{
+		{"listen_addr", "address to listen on", &c.ListenAddr},
+		{"static_dir", "directory of the static files", &c.StaticDir},
+		{"metrics_path", "path the Prometheus metrics are served on, empty to not serve them", &c.MetricsPath},
+		{"read_buffer_size", "WebSocket read buffer size in bytes", &c.ReadBufferSize},
+		{"write_buffer_size", "WebSocket write buffer size in bytes", &c.WriteBufferSize},
+		{"read_timeout", "how long to wait for the next frame of a client, at least the heartbeat deadline, 0 for no limit", &c.ReadTimeout},
+		{"write_timeout", "how long a write to a client or cluster peer may take before the connection is considered stuck, 0 for no limit", &c.WriteTimeout},
+		{"shutdown_timeout", "how long a graceful shutdown may take", &c.ShutdownTimeout},
+		{"log_level", "debug, info, warn or error", &c.LogLevel},
+		{"log_format", "text, or json for log aggregation", &c.LogFormat},
+
+		{"permessage_deflate", "compress WebSocket frames with permessage-deflate when clients support it", &c.PermessageDeflate},
+		{"permessage_deflate_level", "permessage-deflate compression level, from -2 (Huffman only) to 9", &c.PermessageDeflateLevel},
+		{"permessage_deflate_exclude_topics", "topic patterns whose messages are not compressed with permessage-deflate", &c.PermessageDeflateExcludeTopics},
+
+		{"trace_endpoint", "URL of the OTLP/HTTP collector traces are exported to", &c.TraceEndpoint},
+		{"trace_sample_ratio", "fraction of the traces started by the server that are sampled", &c.TraceSampleRatio},
+
+		{"tls_cert_file", "TLS certificate file", &c.TLSCertFile},
+		{"tls_key_file", "TLS key file", &c.TLSKeyFile},
+		{"autocert_hosts", "hostnames to provision Let's Encrypt certificates for", &c.AutocertHosts},
+		{"autocert_cache", "directory of the provisioned certificates", &c.AutocertCache},
+		{"autocert_email", "contact address registered with Let's Encrypt", &c.AutocertEmail},
+
+		{"allowed_origins", "origins browsers may connect from", &c.AllowedOrigins},
+		{"close_reason_catalog", "JSON file translating the close reasons", &c.CloseReasonCatalog},
+
+		{"jwt_secret", "HMAC secret of the connection tokens", &c.JWTSecret},
+		{"jwt_public_key_file", "PEM public key of the connection tokens", &c.JWTPublicKeyFile},
+		{"jwt_issuer", "required issuer of the connection tokens", &c.JWTIssuer},
+		{"jwt_audience", "required audience of the connection tokens", &c.JWTAudience},
+		{"token_ttl", "default lifetime of minted connection tokens", &c.TokenTTL},
+		{"token_max_ttl", "longest lifetime of minted connection tokens", &c.TokenMaxTTL},
+		{"api_keys_file", "JSON file of API keys", &c.APIKeysFile},
+		{"admin_api_key", "API key with the admin permission", &c.AdminAPIKey},
+		{"acl_file", "JSON file of access control rules", &c.ACLFile},
+		{"invite_secret", "secret signing topic invitations", &c.InviteSecret},
+
+		{"unauthorized_policy", "reject, drop or honeypot: how unauthorized actions are answered", &c.UnauthorizedPolicy},
+		{"honeypot_topic", "topic the honeypot policy records unauthorized actions on", &c.HoneypotTopic},
+		{"strict_json_endpoints", "paths of the WebSocket endpoints decoding frames strictly, e.g. /widget", &c.StrictJSONEndpoints},
+		{"trust_client_publisher", "deliver the publisher named by publish frames instead of the connection's principal, while migrating clients", &c.TrustClientPublisher},
+		{"admin_events_topic", "topic debug captures stream to, which only admins may subscribe to", &c.AdminEventsTopic},
+		{"debug_log_dir", "directory file debug captures are written in", &c.DebugLogDir},
+		{"status_grace_period", "how long a user stays online after their last connection closed", &c.StatusGracePeriod},
+		{"matchmaking_file", "JSON file of the matchmaking lobbies", &c.MatchmakingFile},
+
+		{"widget_token_ttl", "longest lifetime of widget tokens", &c.WidgetTokenTTL},
+		{"widget_max_subscriptions", "subscriptions allowed per widget client", &c.WidgetMaxSubscriptions},
+		{"widget_max_message_size", "largest message in bytes a widget client may send", &c.WidgetMaxMessageSize},
+
+		{"max_connections", "most clients connected at once over WebSocket, TCP and MQTT, 0 for no limit", &c.MaxConnections},
+		{"max_connections_per_ip", "most clients connected at once from one IP, 0 for no limit", &c.MaxConnsPerIP},
+		{"trusted_proxies", "IPs and CIDR ranges of the proxies whose X-Forwarded-For and X-Real-IP headers name the client", &c.TrustedProxies},
+		{"client_id_provider", "how the IDs of clients are decided: uuid, sequential[:prefix], header:<name> or claim:<name>", &c.ClientIDProvider},
+		{"max_subscriptions", "subscriptions allowed per client, 0 for no limit", &c.MaxSubscriptions},
+		{"max_message_size", "largest message in bytes a client may send, 0 for no limit", &c.MaxMessageSize},
+		{"rate_limit", "messages per second a client may send, 0 for no limit", &c.RateLimit},
+		{"rate_burst", "messages a client may send at once above its rate limit, 0 for one second of messages", &c.RateBurst},
+		{"rate_limit_strikes", "messages over the rate limit in a row after which a client is disconnected, 0 to never disconnect it", &c.RateLimitStrikes},
+		{"heartbeat_interval", "interval of the heartbeat pings, 0 to disable", &c.HeartbeatInterval},
+		{"send_queue_size", "messages queued per client", &c.SendQueueSize},
+		{"slow_consumer_policy", "drop_oldest, drop_newest or disconnect", &c.SlowConsumerPolicy},
+		{"slow_start_rate", "initial delivery rate of new clients in messages per second", &c.SlowStartRate},
+		{"slow_start_duration", "how long slow start lasts", &c.SlowStartDuration},
+
+		{"history_limit", "messages kept per topic, 0 to disable the history", &c.HistoryLimit},
+		{"history_codec", "codec of the history entries", &c.HistoryCodec},
+		{"history_compression", "topic patterns and the codec compressing their history", &c.HistoryCompression},
+		{"retention_policy_file", "JSON file assigning retention tiers to topics", &c.RetentionPolicyFile},
+		{"read_your_writes", "fan the messages of each topic out in the order of its history, so publishers see their own messages in sequence", &c.ReadYourWrites},
+		{"explicit_topics", "refuse to publish or subscribe to topics that were not created first with create_topic or the admin API", &c.ExplicitTopics},
+		{"topic_idle_ttl", "how long a topic without subscribers is kept after its last message or subscriber, its history included, 0 to keep topics forever", &c.TopicIdleTTL},
+		{"fanout_workers", "workers delivering the messages of topics with many subscribers in parallel, 0 to deliver them one subscriber after the other", &c.FanOutWorkers},
+		{"fanout_threshold", "subscribers a topic needs for its messages to be delivered in parallel", &c.FanOutThreshold},
+		{"registry_shards", "shards of the topics and of the clients, each with its own lock, so publishes to different topics do not wait for each other", &c.RegistryShards},
+		{"idle_timeout", "how long a WebSocket or TCP client may go without sending or receiving a message before it is disconnected, 0 to never disconnect idle clients", &c.IdleTimeout},
+		{"topic_metrics_limit", "topics exported on /metrics with a label of their own, busiest first, the others added up under topic=\"_other\"", &c.TopicMetricsLimit},
+		{"ack_timeout", "how long a message of a qos 1 subscription waits for an ack or nack before it is delivered again", &c.AckTimeout},
+		{"redelivery_backoff", "delay before a nacked message is delivered again, doubled on every attempt", &c.RedeliveryBackoff},
+		{"redelivery_max_delay", "longest delay before a nacked message is delivered again", &c.RedeliveryMaxDelay},
+		{"max_deliveries", "deliveries of a message of a qos 1 subscription before it is dead-lettered", &c.MaxDeliveries},
+		{"session_grace", "how long a disconnected client can resume its session with its session token", &c.SessionGrace},
+		{"offline_queue_size", "messages queued for each disconnected session to redeliver when it is resumed, 0 for none", &c.OfflineQueueSize},
+		{"durable_subscriptions_file", "JSON file durable subscriptions are saved to, so they survive restarts; durable subscriptions are refused without it", &c.DurableSubsFile},
+		{"archive_dir", "directory the history of expired topics is exported to", &c.ArchiveDir},
+		{"archive_topics", "topic patterns whose history is archived to object storage", &c.ArchiveTopics},
+		{"archive_interval", "interval at which history is archived", &c.ArchiveInterval},
+		{"archive_s3_endpoint", "URL of the S3-compatible store history is archived to", &c.ArchiveS3Endpoint},
+		{"archive_s3_region", "region of the archive store", &c.ArchiveS3Region},
+		{"archive_s3_bucket", "bucket history is archived to", &c.ArchiveS3Bucket},
+		{"archive_s3_prefix", "prefix of the keys of archived history", &c.ArchiveS3Prefix},
+		{"archive_s3_access_key", "access key ID of the archive store", &c.ArchiveS3AccessKey},
+		{"archive_s3_secret_key", "secret access key of the archive store", &c.ArchiveS3SecretKey},
+
+		{"moderation_topics", "topic patterns whose messages are moderated", &c.ModerationTopics},
+		{"moderation_hook_url", "URL reviewing moderated messages", &c.ModerationHookURL},
+		{"moderation_timeout", "how long a message may wait for review", &c.ModerationTimeout},
+		{"moderation_timeout_verdict", "verdict applied when the review times out", &c.ModerationTimeoutVerdict},
+		{"scan_url", "URL of the content classifier", &c.ScanURL},
+		{"scan_topics", "scanned topic patterns and their policies", &c.ScanTopics},
+		{"scan_timeout", "how long a scan may take", &c.ScanTimeout},
+		{"schema_topics", "topic patterns whose message schemas are monitored for drift", &c.SchemaTopics},
+		{"schema_sample_rate", "fraction of the messages of monitored topics sampled", &c.SchemaSampleRate},
+		{"schema_learning_samples", "samples learning the schema of a topic", &c.SchemaLearningSamples},
+		{"schema_drift_threshold", "fraction of differing fields at which a sample drifts", &c.SchemaDriftThreshold},
+		{"analytics_policy_file", "JSON file selecting the topics sampled into the analytics sink", &c.AnalyticsPolicyFile},
+		{"analytics_url", "URL analytics events are posted to", &c.AnalyticsURL},
+		{"analytics_clickhouse_table", "ClickHouse table analytics events are inserted into, analytics_url being its HTTP interface", &c.AnalyticsClickHouseTable},
+
+		{"nats_url", "NATS server relaying messages between instances", &c.NATSURL},
+		{"redis_url", "Redis server relaying messages between instances", &c.RedisURL},
+		{"cluster_address", "address other cluster nodes reach this node at", &c.ClusterAddress},
+		{"cluster_secret", "secret shared by the cluster nodes", &c.ClusterSecret},
+		{"cluster_peers", "addresses of cluster nodes to join", &c.ClusterPeers},
+		{"probe_interval", "interval of the synthetic monitoring canaries", &c.ProbeInterval},
+		{"mqtt_addr", "address to accept MQTT clients on", &c.MQTTAddr},
+		{"tcp_addr", "address to accept clients speaking the protocol over plain TCP on", &c.TCPAddr},
+	}
+}
+
+// Function to get the environment variable of a setting.
+// Returns:
+// string - The name in upper case, e.g. MAX_SUBSCRIPTIONS.
+func (s setting) env() string {
+	return strings.ToUpper(s.Name)
+}
+
+// Function to get the command-line flag of a setting.
+// Returns:
+// string - The name with dashes, e.g. max-subscriptions.
+func (s setting) flag() string {
+	return strings.ReplaceAll(s.Name, "_", "-")
+}
+
+// Function to set a setting from its text form. Lists are comma separated.
+// Parameters:
+// value: string - The value.
+// Returns:
+// error - An error if the value does not parse as the type of the setting.
+func (s setting) set(value string) error {
+	var err error
+	switch target := s.Value.(type) {
+	case *string:
+		*target = value
+	case *int:
+		*target, err = strconv.Atoi(value)
+	case *int64:
+		*target, err = strconv.ParseInt(value, 10, 64)
+	case *float64:
+		*target, err = strconv.ParseFloat(value, 64)
+	case *bool:
+		*target, err = strconv.ParseBool(value)
+	case *time.Duration:
+		*target, err = time.ParseDuration(value)
+	case *[]string:
+		*target = nil
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*target = append(*target, item)
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %w", s.Name, value, err)
+	}
+	return nil
+}
+
+// Function to load the configuration. The YAML file is named by the -config flag or
+// the CONFIG_FILE environment variable; environment variables override it and flags
+// override both.
+// Parameters:
+// args: []string - The command-line arguments, without the program name.
+// lookupEnv: func(string) (string, bool) - Looks up environment variables, e.g. os.LookupEnv.
+// Returns:
+// Config - The configuration.
+// error - An error if a source could not be read or a value is invalid; flag.ErrHelp if -help was given.
+func LoadConfig(args []string, lookupEnv func(string) (string, bool)) (Config, error) {
+	config := DefaultConfig()
+	settings := config.settings()
+
+	// Flags are parsed first to find the file, but applied last
+	type flagValue struct {
+		setting setting
+		value   string
+	}
+	var flags []flagValue
+	file, _ := lookupEnv("CONFIG_FILE")
+	fs := flag.NewFlagSet("gowebsockets", flag.ContinueOnError)
+	fs.StringVar(&file, "config", file, "YAML configuration file")
+	for _, s := range settings {
+		s := s
+		fs.Func(s.flag(), s.Usage+" ($"+s.env()+")", func(value string) error {
+			flags = append(flags, flagValue{s, value})
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	if file != "" {
+		if err := config.loadFile(file, settings); err != nil {
+			return Config{}, err
+		}
+	}
+	for _, s := range settings {
+		if value, ok := lookupEnv(s.env()); ok {
+			if err := s.set(value); err != nil {
+				return Config{}, err
+			}
+		}
+	}
+	for _, f := range flags {
+		if err := f.setting.set(f.value); err != nil {
+			return Config{}, err
+		}
+	}
+	return config, nil
+}
+
+// Function to apply a YAML configuration file, e.g.
+// listen_addr: ":9000"
+// max_subscriptions: 50
+// allowed_origins: [https://app.example.com]
+// Parameters:
+// path: string - The path of the file.
+// settings: []setting - The settings of the configuration.
+// Returns:
+// error - An error if the file could not be read or names an unknown setting.
+func (c *Config) loadFile(path string, settings []setting) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	values := map[string]any{}
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	byName := make(map[string]setting, len(settings))
+	for _, s := range settings {
+		byName[s.Name] = s
+	}
+	for name, value := range values {
+		s, ok := byName[name]
+		if !ok {
+			return fmt.Errorf("%s: unknown setting %q", path, name)
+		}
+		text := ""
+		if list, ok := value.([]any); ok {
+			items := make([]string, len(list))
+			for i, item := range list {
+				items[i] = fmt.Sprint(item)
+			}
+			text = strings.Join(items, ",")
+		} else if value != nil {
+			text = fmt.Sprint(value)
+		}
+		if err := s.set(text); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// envMap returns a lookup function reading from a map instead of the environment.
+func envMap(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	config, err := LoadConfig(nil, envMap(nil))
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultConfig(), config)
+	assert.Equal(t, ":8080", config.ListenAddr)
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(path, []byte(`
+listen_addr: ":9000"
+max_subscriptions: 10
+heartbeat_interval: 30s
+allowed_origins:
+  - https://app.example.com
+  - "*.example.org"
+slow_start_rate: 2.5
+trust_client_publisher: true
+`), 0o600)
+
+	config, err := LoadConfig(
+		[]string{"-config", path, "-max-subscriptions", "30"},
+		envMap(map[string]string{"MAX_SUBSCRIPTIONS": "20", "STATIC_DIR": "public"}),
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, ":9000", config.ListenAddr, "The file should override the defaults")
+	assert.Equal(t, "public", config.StaticDir, "The environment should override the defaults")
+	assert.Equal(t, 30, config.MaxSubscriptions, "Flags should override the environment and the file")
+	assert.Equal(t, 30*time.Second, config.HeartbeatInterval)
+	assert.Equal(t, []string{"https://app.example.com", "*.example.org"}, config.AllowedOrigins)
+	assert.Equal(t, 2.5, config.SlowStartRate)
+	assert.True(t, config.TrustClientPublisher)
+}
+
+func TestLoadConfigFileFromEnvironment(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(path, []byte("cluster_peers: a:8080,b:8080\n"), 0o600)
+
+	config, err := LoadConfig(nil, envMap(map[string]string{"CONFIG_FILE": path}))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a:8080", "b:8080"}, config.ClusterPeers)
+}
+
+func TestLoadConfigRejectsInvalidValues(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(path, []byte("max_subscribers: 10\n"), 0o600)
+	_, err := LoadConfig([]string{"-config", path}, envMap(nil))
+	assert.ErrorContains(t, err, "unknown setting", "Misspelled settings should not be ignored")
+
+	_, err = LoadConfig(nil, envMap(map[string]string{"HEARTBEAT_INTERVAL": "often"}))
+	assert.ErrorContains(t, err, "heartbeat_interval")
+
+	_, err = LoadConfig([]string{"-send-queue-size", "many"}, envMap(nil))
+	assert.Error(t, err)
+}
+
+func TestNewServerFromConfig(t *testing.T) {
+	config := DefaultConfig()
+	config.ListenAddr = ":9999"
+	config.MaxSubscriptions = 3
+	config.HistoryLimit = 5
+	config.AdminAPIKey = "admin-secret"
+	server, pubsub, closeAll, err := newServer(config, serverParts{})
+	assert.NoError(t, err)
+	defer closeAll()
+
+	assert.Equal(t, ":9999", server.Addr)
+	assert.Equal(t, 3, pubsub.options().defaultLimits.MaxSubscriptions)
+	assert.Equal(t, 5, pubsub.History.Limit, "The PubSub should be constructed from the configuration")
+
+	request := httptest.NewRequest(http.MethodGet, "/admin/reports", nil)
+	request.Header.Set(apiKeyHeader, "admin-secret")
+	recorder := httptest.NewRecorder()
+	server.Handler.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code, "The admin routes should be served when an admin key is configured")
+
+	config.SlowConsumerPolicy = "ignore"
+	_, _, err = NewServer(config)
+	assert.Error(t, err)
+}
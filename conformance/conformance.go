@@ -0,0 +1,300 @@
+// This file runs the wire-protocol conformance suite. A scenario is a JSON file of
+// steps, each sending a frame from a named client or expecting the next frame a client
+// receives, so other client and server implementations can check themselves against
+// the same fixtures as the server:
+//
+//	{"name": "...", "steps": [
+//	  {"client": "alice", "expect": {"action": "welcome", "clientId": "$alice"}},
+//	  {"client": "alice", "send": {"action": "subscribe", "topic": "news"}},
+//	  {"client": "alice", "expectNothing": true}
+//	]}
+//
+// A client connects on its first step, or with "connect": "?query" to give the upgrade
+// request a query string. Expected frames match frames holding at least their fields;
+// arrays must have the same length. Frames that are not JSON, such as the
+// acknowledgement the server sends for every frame, match a string. The string "$any"
+// matches any value, and any other string starting with "$" is a variable: the first
+// match captures the value, later matches must equal it, and sent frames have variables
+// replaced by their values.
+package conformance
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Scenarios are the scenario files of the suite.
+//
+//go:embed scenarios/*.json
+var Scenarios embed.FS
+
+// How long a step waits for a frame, and how long expectNothing listens for one
+const (
+	expectTimeout = 2 * time.Second
+	quietPeriod   = 200 * time.Millisecond
+)
+
+// Scenario is a sequence of steps played against a server.
+type Scenario struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Steps       []Step `json:"steps"`
+}
+
+// Step is one action of a client of a scenario.
+type Step struct {
+	Client string `json:"client"`
+	// Query string of the upgrade request, e.g. "?name=Alice", connecting the client
+	Connect *string `json:"connect,omitempty"`
+	// Frame to send
+	Send json.RawMessage `json:"send,omitempty"`
+	// Pattern the next received frame must match
+	Expect json.RawMessage `json:"expect,omitempty"`
+	// Whether the client must receive nothing for a while
+	ExpectNothing bool `json:"expectNothing,omitempty"`
+}
+
+// Function to load the scenarios of a directory.
+// Parameters:
+// fsys: fs.FS - The file system, e.g. Scenarios or os.DirFS("conformance").
+// dir: string - The directory of the scenario files, e.g. "scenarios".
+// Returns:
+// []Scenario - The scenarios, in the order of their file names.
+// error - An error if a file cannot be read or is not a valid scenario.
+func Load(fsys fs.FS, dir string) ([]Scenario, error) {
+	names, err := fs.Glob(fsys, path.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	scenarios := make([]Scenario, 0, len(names))
+	for _, name := range names {
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		var scenario Scenario
+		if err := json.Unmarshal(data, &scenario); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if scenario.Name == "" {
+			scenario.Name = strings.TrimSuffix(path.Base(name), ".json")
+		}
+		scenarios = append(scenarios, scenario)
+	}
+	return scenarios, nil
+}
+
+// A connected client of a scenario, whose frames are read in the background so
+// waiting for a frame can time out without breaking the connection
+type peer struct {
+	conn   *websocket.Conn
+	frames chan []byte
+	// The error that ended the reading, once frames is closed
+	err error
+}
+
+// Function to connect a client of a scenario.
+// Parameters:
+// ctx: context.Context - Bounds the connection.
+// url: string - The WebSocket URL, with the query string of the upgrade request.
+// Returns:
+// *peer - The connected client.
+// error - An error if the client could not connect.
+func connect(ctx context.Context, url string) (*peer, error) {
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	p := &peer{conn: conn, frames: make(chan []byte, 64)}
+	go func() {
+		defer close(p.frames)
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				p.err = err
+				return
+			}
+			p.frames <- data
+		}
+	}()
+	return p, nil
+}
+
+// Function to wait for the next frame of a client.
+// Parameters:
+// timeout: time.Duration - How long to wait.
+// Returns:
+// []byte - The frame, or nil if none came in time.
+// error - The error that closed the connection, if it was closed.
+func (p *peer) next(timeout time.Duration) ([]byte, error) {
+	select {
+	case data, ok := <-p.frames:
+		if !ok {
+			return nil, p.err
+		}
+		return bytes.TrimSpace(data), nil
+	case <-time.After(timeout):
+		return nil, nil
+	}
+}
+
+// Function to play a scenario against a server.
+// Parameters:
+// ctx: context.Context - Bounds the connections.
+// url: string - The WebSocket URL of the server, e.g. ws://localhost:8080/ws.
+// Returns:
+// error - An error naming the first step the server did not conform at.
+func (s Scenario) Run(ctx context.Context, url string) error {
+	peers := map[string]*peer{}
+	defer func() {
+		for _, p := range peers {
+			p.conn.Close()
+		}
+	}()
+	vars := map[string]interface{}{}
+
+	for i, step := range s.Steps {
+		fail := func(format string, args ...interface{}) error {
+			return fmt.Errorf("%s: step %d (%s): %s", s.Name, i+1, step.Client, fmt.Sprintf(format, args...))
+		}
+
+		p := peers[step.Client]
+		if p == nil || step.Connect != nil {
+			if p != nil {
+				p.conn.Close()
+			}
+			query := ""
+			if step.Connect != nil {
+				query = *step.Connect
+			}
+			var err error
+			if p, err = connect(ctx, url+query); err != nil {
+				return fail("connecting: %v", err)
+			}
+			peers[step.Client] = p
+		}
+
+		switch {
+		case step.Send != nil:
+			var frame interface{}
+			if err := json.Unmarshal(step.Send, &frame); err != nil {
+				return fail("invalid frame: %v", err)
+			}
+			if err := p.conn.WriteJSON(substitute(frame, vars)); err != nil {
+				return fail("sending: %v", err)
+			}
+		case step.Expect != nil:
+			var expected interface{}
+			if err := json.Unmarshal(step.Expect, &expected); err != nil {
+				return fail("invalid pattern: %v", err)
+			}
+			data, err := p.next(expectTimeout)
+			if data == nil {
+				return fail("expected %s, got nothing (%v)", step.Expect, err)
+			}
+			// Frames that are not JSON, such as the acknowledgement of every frame, match
+			// a string
+			var actual interface{}
+			if json.Unmarshal(data, &actual) != nil {
+				actual = string(data)
+			}
+			if !match(expected, actual, vars) {
+				return fail("expected %s, got %s", step.Expect, data)
+			}
+		case step.ExpectNothing:
+			if data, _ := p.next(quietPeriod); data != nil {
+				return fail("expected nothing, got %s", data)
+			}
+		}
+	}
+	return nil
+}
+
+// Function to check a received value against a pattern, capturing variables.
+// Parameters:
+// expected: interface{} - The pattern.
+// actual: interface{} - The received value.
+// vars: map[string]interface{} - The captured variables, updated on success.
+// Returns:
+// bool - True if the value matches.
+func match(expected interface{}, actual interface{}, vars map[string]interface{}) bool {
+	switch expected := expected.(type) {
+	case string:
+		if expected == "$any" {
+			return true
+		}
+		if strings.HasPrefix(expected, "$") {
+			if value, ok := vars[expected]; ok {
+				return equal(value, actual)
+			}
+			vars[expected] = actual
+			return true
+		}
+	case map[string]interface{}:
+		actual, ok := actual.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for key, value := range expected {
+			field, ok := actual[key]
+			if !ok || !match(value, field, vars) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		actual, ok := actual.([]interface{})
+		if !ok || len(actual) != len(expected) {
+			return false
+		}
+		for i := range expected {
+			if !match(expected[i], actual[i], vars) {
+				return false
+			}
+		}
+		return true
+	}
+	return equal(expected, actual)
+}
+
+// Function to compare two decoded JSON values.
+func equal(a interface{}, b interface{}) bool {
+	x, _ := json.Marshal(a)
+	y, _ := json.Marshal(b)
+	return string(x) == string(y)
+}
+
+// Function to replace the variables of a frame by their captured values.
+// Parameters:
+// frame: interface{} - The decoded frame.
+// vars: map[string]interface{} - The captured variables.
+// Returns:
+// interface{} - The frame with its variables replaced.
+func substitute(frame interface{}, vars map[string]interface{}) interface{} {
+	switch frame := frame.(type) {
+	case string:
+		if value, ok := vars[frame]; ok {
+			return value
+		}
+	case map[string]interface{}:
+		for key, value := range frame {
+			frame[key] = substitute(value, vars)
+		}
+	case []interface{}:
+		for i, value := range frame {
+			frame[i] = substitute(value, vars)
+		}
+	}
+	return frame
+}
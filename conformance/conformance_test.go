@@ -0,0 +1,84 @@
+package conformance
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func decode(t *testing.T, data string) interface{} {
+	var value interface{}
+	if err := json.Unmarshal([]byte(data), &value); err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestMatch(t *testing.T) {
+	vars := map[string]interface{}{}
+	assert.True(t, match(decode(t, `{"action": "welcome", "clientId": "$alice"}`), decode(t, `{"action": "welcome", "clientId": "c1", "limits": {}}`), vars))
+	assert.Equal(t, "c1", vars["$alice"])
+	assert.True(t, match(decode(t, `{"members": [{"clientId": "$alice"}]}`), decode(t, `{"members": [{"clientId": "c1"}]}`), vars))
+	assert.False(t, match(decode(t, `{"members": [{"clientId": "$alice"}]}`), decode(t, `{"members": [{"clientId": "c2"}]}`), vars), "A variable should keep its value")
+	assert.False(t, match(decode(t, `{"members": []}`), decode(t, `{"members": [{"clientId": "c1"}]}`), vars), "Arrays should have the same length")
+	assert.False(t, match(decode(t, `{"action": "welcome"}`), decode(t, `{"clientId": "c1"}`), vars))
+	assert.True(t, match(decode(t, `{"limits": "$any"}`), decode(t, `{"limits": {"maxSubscriptions": 5}}`), vars))
+	assert.True(t, match(decode(t, `{"x": 1}`), decode(t, `{"x": 1.0}`), vars))
+
+	assert.Equal(t, decode(t, `{"action": "kick", "clientId": "c1", "topic": "$unset"}`),
+		substitute(decode(t, `{"action": "kick", "clientId": "$alice", "topic": "$unset"}`), vars))
+}
+
+func TestLoad(t *testing.T) {
+	scenarios, err := Load(Scenarios, "scenarios")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, scenarios)
+	for _, scenario := range scenarios {
+		assert.NotEmpty(t, scenario.Steps, scenario.Name)
+	}
+
+	scenarios, err = Load(fstest.MapFS{"s/ping.json": {Data: []byte(`{"steps": []}`)}}, "s")
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", scenarios[0].Name, "A scenario should be named after its file by default")
+	_, err = Load(fstest.MapFS{"s/broken.json": {Data: []byte(`{`)}}, "s")
+	assert.Error(t, err)
+}
+
+func TestRunReportsTheFailingStep(t *testing.T) {
+	// A server greeting clients and answering every frame with the same frame
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		ws.WriteJSON(map[string]string{"action": "welcome", "clientId": r.URL.Query().Get("id")})
+		for {
+			messageType, data, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			ws.WriteMessage(messageType, data)
+		}
+	}))
+	defer server.Close()
+
+	var scenario Scenario
+	assert.NoError(t, json.Unmarshal([]byte(`{"name": "echo", "steps": [
+		{"client": "a", "connect": "?id=c1", "expect": {"action": "welcome", "clientId": "$a"}},
+		{"client": "a", "send": {"echo": "$a"}},
+		{"client": "a", "expect": {"echo": "c1"}},
+		{"client": "a", "expectNothing": true},
+		{"client": "a", "send": {"echo": 2}},
+		{"client": "a", "expect": {"echo": 3}}
+	]}`), &scenario))
+	err := scenario.Run(context.Background(), "ws"+server.URL[4:])
+	assert.EqualError(t, err, `echo: step 6 (a): expected {"echo": 3}, got {"echo":2}`)
+}
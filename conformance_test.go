@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"mywebsocketserver/conformance"
+)
+
+func TestConformance(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(ps.webSocketHandler))
+	defer server.Close()
+
+	scenarios, err := conformance.Load(conformance.Scenarios, "scenarios")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEmpty(t, scenarios)
+	for _, scenario := range scenarios {
+		t.Run(scenario.Name, func(t *testing.T) {
+			assert.NoError(t, scenario.Run(context.Background(), "ws"+server.URL[4:]))
+		})
+	}
+}
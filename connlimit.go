@@ -0,0 +1,115 @@
+// This file bounds how many clients may be connected at once over WebSocket, TCP and
+// MQTT, in total and from each IP, so neither a flood of connections nor a single
+// misbehaving client can exhaust the memory of the server. Once the total limit is
+// reached, WebSocket upgrades are refused with 503 Service Unavailable, TCP clients get
+// a close frame with the server_full reason and MQTT clients a CONNACK refusing them as
+// the server is unavailable. An IP over its own limit gets 429 Too Many Requests, or a
+// close frame with the try_again_later reason. A place is held from the moment a
+// connection is accepted until it ends. The IP of WebSocket clients behind trusted
+// proxies is the one they forwarded.
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	errServerFull    = errors.New("server full")
+	errTooManyFromIP = errors.New("too many connections from this address")
+)
+
+// connectionLimiter holds the places of the connections to a server.
+type connectionLimiter struct {
+	// Most clients connected at once, 0 for no limit
+	max atomic.Int64
+	// Most clients connected at once from one IP, 0 for no limit
+	maxPerIP atomic.Int64
+	// Connections holding a place
+	open atomic.Int64
+	// Connections holding a place, by IP
+	byIP map[string]int64
+	mu   sync.Mutex
+}
+
+// Connections holding a place on every server of the process
+var openConnections atomic.Int64
+
+var (
+	rejectedConnections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gowebsockets_rejected_connections_total",
+		Help: "Number of connections refused because the server or their IP was full, by transport and reason.",
+	}, []string{"transport", "reason"})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "gowebsockets_open_connections",
+		Help: "Number of connections of clients over WebSocket, TCP and MQTT.",
+	}, func() float64 { return float64(openConnections.Load()) })
+)
+
+// Function to hold a place for a new connection.
+// Parameters:
+// transport: string - The transport of the connection, for the metrics.
+// ip: string - The IP the connection comes from.
+// Returns:
+// error - errServerFull or errTooManyFromIP if the connection is refused; otherwise
+// release must be called once the connection ends.
+func (l *connectionLimiter) acquire(transport string, ip string) error {
+	if open, limit := l.open.Add(1), l.max.Load(); limit > 0 && open > limit {
+		l.open.Add(-1)
+		rejectedConnections.WithLabelValues(transport, "server_full").Inc()
+		return errServerFull
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if limit := l.maxPerIP.Load(); limit > 0 && l.byIP[ip] >= limit {
+		l.open.Add(-1)
+		rejectedConnections.WithLabelValues(transport, "ip_limit").Inc()
+		return errTooManyFromIP
+	}
+	l.byIP[ip]++
+	openConnections.Add(1)
+	return nil
+}
+
+// Function to free the place of a connection that ended.
+// Parameters:
+// ip: string - The IP the connection came from.
+func (l *connectionLimiter) release(ip string) {
+	l.open.Add(-1)
+	openConnections.Add(-1)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.byIP[ip]--; l.byIP[ip] <= 0 {
+		delete(l.byIP, ip)
+	}
+}
+
+// Function to refuse an upgrade request the server has no place for.
+// Parameters:
+// w: http.ResponseWriter - The response writer.
+// err: error - errServerFull or errTooManyFromIP.
+func rejectConnection(w http.ResponseWriter, err error) {
+	w.Header().Set("Retry-After", "5")
+	status := http.StatusServiceUnavailable
+	if errors.Is(err, errTooManyFromIP) {
+		status = http.StatusTooManyRequests
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// Function to get the reason a stream client the server has no place for is closed with.
+// Parameters:
+// err: error - errServerFull or errTooManyFromIP.
+// Returns:
+// DisconnectReason - ReasonServerFull or ReasonTryAgainLater.
+func connectionRefusal(err error) DisconnectReason {
+	if errors.Is(err, errTooManyFromIP) {
+		return ReasonTryAgainLater
+	}
+	return ReasonServerFull
+}
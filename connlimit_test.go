@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// fillServer makes the server of a PubSub full.
+func fillServer(pubsub *PubSub) {
+	connections := &pubsub.options().connections
+	connections.max.Store(1)
+	// A place held by the test keeps the server full whatever other connections end
+	connections.open.Add(1)
+}
+
+func TestConnectionLimitRefusesUpgrades(t *testing.T) {
+	isolatePubSub(t)
+	server := httptest.NewServer(http.HandlerFunc(ps.webSocketHandler))
+	t.Cleanup(server.Close)
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	fillServer(ps)
+
+	_, response, err := websocket.DefaultDialer.Dial(url, nil)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, response.StatusCode)
+	assert.Equal(t, "5", response.Header.Get("Retry-After"))
+
+	ps.options().connections.max.Store(0)
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	assert.NoError(t, err, "No limit admits every connection")
+	ws.Close()
+}
+
+func TestConnectionLimitRefusesTCPClients(t *testing.T) {
+	pubsub := &PubSub{}
+	fillServer(pubsub)
+	peer := dialTCP(t, pubsub)
+	peer.send(t, `{"action":"connect"}`)
+	messageType, data := peer.read(t)
+	assert.Equal(t, websocket.CloseMessage, messageType)
+	assert.Equal(t, uint16(websocket.CloseTryAgainLater), binary.BigEndian.Uint16(data))
+	assert.Contains(t, string(data), string(ReasonServerFull))
+}
+
+func TestConnectionLimitRefusesMQTTClients(t *testing.T) {
+	pubsub := &PubSub{}
+	fillServer(pubsub)
+	server, err := ListenMQTT("127.0.0.1:0", pubsub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	go server.Serve()
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	device := &mqttSession{conn: conn, reader: bufio.NewReader(conn)}
+	connect := appendMQTTString(nil, "MQTT")
+	connect = append(connect, mqttProtocolLevel311, 0x02, 0, 60)
+	connect = appendMQTTString(connect, "sensor-1")
+	assert.NoError(t, device.writePacket(mqttConnect<<4, connect))
+	connack, err := device.readPacket(tcpMaxFrameSize)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0, mqttConnRefusedUnavailable}, connack.Body)
+}
+
+func TestAcquireConnection(t *testing.T) {
+	connections := &(&PubSub{}).options().connections
+	assert.NoError(t, connections.acquire("websocket", "192.0.2.1"))
+	connections.release("192.0.2.1")
+	connections.max.Store(1)
+	connections.open.Add(1)
+	assert.ErrorIs(t, connections.acquire("websocket", "192.0.2.1"), errServerFull)
+	assert.Equal(t, int64(1), connections.open.Load(), "Refused connections hold no place")
+}
+
+func TestAcquireConnectionPerIP(t *testing.T) {
+	connections := &(&PubSub{}).options().connections
+	connections.maxPerIP.Store(2)
+	before := openConnections.Load()
+	assert.NoError(t, connections.acquire("tcp", "192.0.2.1"))
+	assert.NoError(t, connections.acquire("tcp", "192.0.2.1"))
+	assert.ErrorIs(t, connections.acquire("tcp", "192.0.2.1"), errTooManyFromIP)
+	assert.Equal(t, int64(2), connections.open.Load(), "Refused connections hold no place")
+	assert.GreaterOrEqual(t, openConnections.Load(), before+2, "The places are counted for the whole process")
+	assert.NoError(t, connections.acquire("tcp", "192.0.2.2"), "Other IPs have places of their own")
+
+	connections.release("192.0.2.1")
+	assert.NoError(t, connections.acquire("tcp", "192.0.2.1"), "An ended connection frees its place")
+	for _, ip := range []string{"192.0.2.1", "192.0.2.1", "192.0.2.2"} {
+		connections.release(ip)
+	}
+	assert.NotContains(t, connections.byIP, "192.0.2.1", "IPs without connections are forgotten")
+	assert.NotContains(t, connections.byIP, "192.0.2.2")
+}
+
+func TestConnectionLimitsAreKeptPerServer(t *testing.T) {
+	full, other := &PubSub{}, &PubSub{}
+	fillServer(full)
+	assert.ErrorIs(t, full.options().connections.acquire("tcp", "192.0.2.1"), errServerFull)
+	assert.NoError(t, other.options().connections.acquire("tcp", "192.0.2.1"), "A full server leaves the others their places")
+	other.options().connections.release("192.0.2.1")
+}
+
+func TestConnectionLimitPerIPRefusesUpgrades(t *testing.T) {
+	options := isolatePubSub(t)
+	server := httptest.NewServer(http.HandlerFunc(ps.webSocketHandler))
+	t.Cleanup(server.Close)
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	options.connections.maxPerIP.Store(1)
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, response, err := websocket.DefaultDialer.Dial(url, nil)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, response.StatusCode)
+	assert.Equal(t, "5", response.Header.Get("Retry-After"))
+	ws.Close()
+}
+
+func TestConnectionLimitPerIPRefusesTCPClients(t *testing.T) {
+	pubsub := &PubSub{}
+	connections := &pubsub.options().connections
+	connections.maxPerIP.Store(1)
+	// A place held by the test keeps 127.0.0.1 at its limit
+	connections.byIP["127.0.0.1"]++
+	peer := dialTCP(t, pubsub)
+	peer.send(t, `{"action":"connect"}`)
+	messageType, data := peer.read(t)
+	assert.Equal(t, websocket.CloseMessage, messageType)
+	assert.Contains(t, string(data), string(ReasonTryAgainLater))
+}
@@ -0,0 +1,56 @@
+// This file bounds how long a connection may block the server. Every write to a
+// WebSocket, TCP, MQTT or cluster peer must finish within the write timeout, so a peer
+// that stopped reading fails the write instead of wedging the goroutine writing to it
+// forever. The read timeout bounds how long the server waits for the next frame of a
+// WebSocket or TCP client, or of an MQTT client without a keep-alive; with heartbeats,
+// pongs count as frames and the wait is at least the heartbeat deadline.
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// Function to get the deadline a wait ends at.
+// Parameters:
+// wait: time.Duration - The wait, 0 or less for none.
+// Returns:
+// time.Time - The deadline, or the zero time for no deadline.
+func deadlineAfter(wait time.Duration) time.Time {
+	if wait <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(wait)
+}
+
+// Function to get how long to wait for the next frame of a WebSocket client.
+// Parameters:
+// timeout: time.Duration - The read timeout of the server, 0 for none.
+// heartbeat: time.Duration - The heartbeat interval of the client, 0 when disabled.
+// Returns:
+// time.Duration - The wait, 0 for no limit.
+func readWait(timeout time.Duration, heartbeat time.Duration) time.Duration {
+	return max(timeout, heartbeat*missedPongs)
+}
+
+// Function to bound the next write to the WebSocket connection of a client. Writes to
+// a connection are never concurrent, so the deadline applies to that write alone.
+func (client *Client) armWriteDeadline() {
+	if client.Connection != nil {
+		client.Connection.SetWriteDeadline(deadlineAfter(client.options().writeTimeout))
+	}
+}
+
+// Function to bound the next write to a raw connection, falling back to a wait of its
+// own when writes are not otherwise bounded.
+// Parameters:
+// conn: net.Conn - The connection.
+// timeout: time.Duration - The write timeout of the server, 0 for none.
+// fallback: time.Duration - The wait without a write timeout, 0 for no limit.
+func armConnWriteDeadline(conn net.Conn, timeout time.Duration, fallback time.Duration) {
+	wait := timeout
+	if wait <= 0 {
+		wait = fallback
+	}
+	conn.SetWriteDeadline(deadlineAfter(wait))
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadWait(t *testing.T) {
+	assert.Equal(t, time.Duration(0), readWait(0, 0), "No read timeout nor heartbeat waits forever")
+	assert.Equal(t, 2*missedPongs*time.Second, readWait(0, 2*time.Second))
+	assert.Equal(t, time.Minute, readWait(time.Minute, 0))
+	assert.Equal(t, time.Minute, readWait(time.Minute, time.Second), "The read timeout is kept when longer than the heartbeat deadline")
+	assert.Equal(t, 2*time.Minute, readWait(time.Minute, time.Minute), "Pongs may take until the heartbeat deadline")
+	assert.True(t, deadlineAfter(0).IsZero())
+}
+
+func TestReadTimeoutClosesSilentWebSocketClients(t *testing.T) {
+	options := isolatePubSub(t)
+	options.readTimeout = 100 * time.Millisecond
+	server := httptest.NewServer(http.HandlerFunc(ps.webSocketHandler))
+	t.Cleanup(server.Close)
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+server.URL[4:], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	readFrame(t, ws)
+
+	_, _, err = ws.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, CloseIdleTimeout), "Clients sending nothing for the read timeout are closed")
+}
+
+func TestReadTimeoutClosesSilentTCPClients(t *testing.T) {
+	pubsub := &PubSub{}
+	pubsub.options().readTimeout = 100 * time.Millisecond
+	peer := dialTCP(t, pubsub)
+	peer.send(t, `{"action":"connect"}`)
+	for {
+		messageType, data := peer.read(t)
+		if messageType == websocket.CloseMessage {
+			assert.Equal(t, uint16(CloseIdleTimeout), binary.BigEndian.Uint16(data))
+			return
+		}
+		if t.Failed() {
+			return
+		}
+	}
+}
+
+func TestWriteTimeoutUnblocksWritesToStuckPeers(t *testing.T) {
+	// The peer never reads, so the buffers of the connection fill up
+	client, _ := newTestClient(t)
+	client.server = newServerOptions()
+	client.server.writeTimeout = 50 * time.Millisecond
+	message := make([]byte, 1<<20)
+	started := time.Now()
+	var err error
+	for i := 0; i < 100 && err == nil; i++ {
+		err = client.Send(message)
+	}
+	var netErr net.Error
+	if assert.ErrorAs(t, err, &netErr) {
+		assert.True(t, netErr.Timeout())
+	}
+	assert.Less(t, time.Since(started), 5*time.Second)
+}
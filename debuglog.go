@@ -0,0 +1,292 @@
+// This file captures every frame one connection sends and receives, so operators can
+// debug a single user's issue without turning on debug logging for everyone. A capture
+// is started for a client ID through the admin API, expires on its own, and streams its
+// records to the admin events topic or to a file in the debug log directory.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Frame recording a frame of a captured connection
+const DEBUG = "debug"
+
+// Directions of a captured frame
+const (
+	debugInbound  = "in"
+	debugOutbound = "out"
+)
+
+// Where the records of a capture go
+const (
+	DebugSinkTopic = "topic"
+	DebugSinkFile  = "file"
+)
+
+// How long a capture lasts when no duration is given, and at most
+const (
+	defaultDebugTTL = 10 * time.Minute
+	maxDebugTTL     = time.Hour
+)
+
+var errDebugFileSink = errors.New("file captures need a debug log directory")
+
+// Characters kept from client IDs in the names of capture files
+var debugFileName = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// DebugCapture describes a running capture.
+type DebugCapture struct {
+	ClientId  string    `json:"clientId"`
+	Sink      string    `json:"sink"`
+	File      string    `json:"file,omitempty"`
+	StartedAt time.Time `json:"startedAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// A running capture
+type debugCapture struct {
+	DebugCapture
+	ps      *PubSub
+	session *Session
+	timer   *time.Timer
+	// Serializes the writes to the file, which is nil once the capture stopped
+	file *os.File
+	mu   sync.Mutex
+}
+
+// Function to start capturing the frames of a connected client, replacing any capture
+// of it. The capture stops when it expires or the client disconnects.
+// Parameters:
+// clientId: string - The ID of the client.
+// sink: string - topic to stream records to the admin events topic, or file.
+// ttl: time.Duration - How long to capture, 0 for the default; longer than an hour is capped.
+// Returns:
+// DebugCapture - The capture.
+// error - errUnknownClient if the client is not connected over a WebSocket, or an error if the sink is invalid.
+func (ps *PubSub) StartDebugCapture(clientId string, sink string, ttl time.Duration) (DebugCapture, error) {
+	if ttl <= 0 {
+		ttl = defaultDebugTTL
+	}
+	ttl = min(ttl, maxDebugTTL)
+
+	var session *Session
+	for _, client := range ps.clientsWithID(clientId) {
+		if client.Closable() && client.Transport == nil {
+			session = client.Session
+			break
+		}
+	}
+	if session == nil {
+		return DebugCapture{}, errUnknownClient
+	}
+
+	now := time.Now().UTC()
+	capture := &debugCapture{
+		DebugCapture: DebugCapture{ClientId: clientId, Sink: sink, StartedAt: now, ExpiresAt: now.Add(ttl)},
+		ps:           ps,
+		session:      session,
+	}
+	switch sink {
+	case DebugSinkTopic:
+	case DebugSinkFile:
+		dir := ps.options().debugLogDir
+		if dir == "" {
+			return DebugCapture{}, errDebugFileSink
+		}
+		capture.File = filepath.Join(dir, fmt.Sprintf("%s-%d.jsonl", debugFileName.ReplaceAllString(clientId, "_"), now.Unix()))
+		file, err := os.OpenFile(capture.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if err != nil {
+			return DebugCapture{}, err
+		}
+		capture.file = file
+	default:
+		return DebugCapture{}, fmt.Errorf("invalid sink %q, expected topic or file", sink)
+	}
+
+	ps.StopDebugCapture(clientId)
+	ps.mu.Lock()
+	if ps.debugCaptures == nil {
+		ps.debugCaptures = map[string]*debugCapture{}
+	}
+	ps.debugCaptures[clientId] = capture
+	capture.timer = time.AfterFunc(ttl, func() { ps.stopDebugCapture(capture) })
+	ps.mu.Unlock()
+	session.debug.Store(capture)
+
+	(&Client{Id: clientId}).logger().Info("Started debug capture", "sink", sink, "expires_at", capture.ExpiresAt)
+	return capture.DebugCapture, nil
+}
+
+// Function to stop capturing the frames of a client.
+// Parameters:
+// clientId: string - The ID of the client.
+// Returns:
+// bool - False if the client was not captured.
+func (ps *PubSub) StopDebugCapture(clientId string) bool {
+	ps.mu.Lock()
+	capture := ps.debugCaptures[clientId]
+	ps.mu.Unlock()
+	if capture == nil {
+		return false
+	}
+	ps.stopDebugCapture(capture)
+	return true
+}
+
+// Function to stop a capture, unless another capture of its client replaced it.
+// Parameters:
+// capture: *debugCapture - The capture.
+func (ps *PubSub) stopDebugCapture(capture *debugCapture) {
+	ps.mu.Lock()
+	if ps.debugCaptures[capture.ClientId] != capture {
+		ps.mu.Unlock()
+		return
+	}
+	delete(ps.debugCaptures, capture.ClientId)
+	capture.timer.Stop()
+	ps.mu.Unlock()
+
+	capture.session.debug.CompareAndSwap(capture, nil)
+	capture.mu.Lock()
+	if capture.file != nil {
+		capture.file.Close()
+		capture.file = nil
+	}
+	capture.mu.Unlock()
+	(&Client{Id: capture.ClientId}).logger().Info("Stopped debug capture")
+}
+
+// Function to list the running captures.
+// Returns:
+// []DebugCapture - The captures, sorted by client ID.
+func (ps *PubSub) DebugCaptures() []DebugCapture {
+	ps.mu.Lock()
+	captures := make([]DebugCapture, 0, len(ps.debugCaptures))
+	for _, capture := range ps.debugCaptures {
+		captures = append(captures, capture.DebugCapture)
+	}
+	ps.mu.Unlock()
+	sort.Slice(captures, func(i, j int) bool { return captures[i].ClientId < captures[j].ClientId })
+	return captures
+}
+
+// Function to record a frame of a connection if it is being captured.
+// Parameters:
+// direction: string - in for a frame the client sent, out for a frame it was sent.
+// frame: []byte - The frame, uncompressed.
+func (s *Session) capture(direction string, frame []byte) {
+	if s == nil {
+		return
+	}
+	if capture := s.debug.Load(); capture != nil {
+		capture.record(direction, frame, time.Now())
+	}
+}
+
+// Function to write the record of a captured frame to the sink of the capture.
+// Parameters:
+// direction: string - in or out.
+// frame: []byte - The frame.
+// at: time.Time - When it was sent or received.
+func (c *debugCapture) record(direction string, frame []byte, at time.Time) {
+	record := struct {
+		Action    string          `json:"action"`
+		ClientId  string          `json:"clientId"`
+		Direction string          `json:"direction"`
+		At        string          `json:"at"`
+		Frame     json.RawMessage `json:"frame,omitempty"`
+		Text      string          `json:"text,omitempty"`
+	}{Action: DEBUG, ClientId: c.ClientId, Direction: direction, At: at.UTC().Format(time.RFC3339Nano)}
+	if json.Valid(frame) {
+		record.Frame = frame
+	} else {
+		record.Text = string(frame)
+	}
+	data, _ := json.Marshal(record)
+
+	if c.Sink == DebugSinkFile {
+		c.mu.Lock()
+		if c.file != nil {
+			c.file.Write(append(data, '\n'))
+		}
+		c.mu.Unlock()
+		return
+	}
+	// Records are not captured again, so capturing a client watching the admin events
+	// topic does not loop
+	payload := NewPayload(data)
+	payload.uncaptured = true
+	c.ps.fanOutPayload(context.Background(), autoId(), c.ps.options().adminEventsTopic, payload)
+}
+
+// Function to parse the duration of a capture.
+// Parameters:
+// value: string - A Go duration such as 15m, or an empty string for the default.
+// Returns:
+// time.Duration - The duration.
+// error - An error if the value is not a positive duration.
+func parseDebugTTL(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("invalid ttl %q", value)
+	}
+	return ttl, nil
+}
+
+// Function to register the admin API starting, listing and stopping captures.
+// Parameters:
+// mux: *http.ServeMux - The mux to register the routes on.
+// pubsub: *PubSub - The PubSub the routes serve.
+func setupDebugRoutes(mux *http.ServeMux, pubsub *PubSub) {
+	mux.HandleFunc("GET /admin/debug", pubsub.requireAPIKey(PermissionAdmin, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, pubsub.DebugCaptures())
+	}))
+
+	mux.HandleFunc("POST /admin/clients/{id}/debug", pubsub.requireAPIKey(PermissionAdmin, func(w http.ResponseWriter, r *http.Request) {
+		request := struct {
+			Sink string `json:"sink"`
+			TTL  string `json:"ttl"`
+		}{Sink: DebugSinkTopic}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				http.Error(w, "invalid request", http.StatusBadRequest)
+				return
+			}
+		}
+		ttl, err := parseDebugTTL(request.TTL)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		capture, err := pubsub.StartDebugCapture(r.PathValue("id"), request.Sink, ttl)
+		switch {
+		case errors.Is(err, errUnknownClient):
+			http.NotFound(w, r)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			writeJSON(w, http.StatusOK, capture)
+		}
+	}))
+
+	mux.HandleFunc("DELETE /admin/clients/{id}/debug", pubsub.requireAPIKey(PermissionAdmin, func(w http.ResponseWriter, r *http.Request) {
+		if !pubsub.StopDebugCapture(r.PathValue("id")) {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// A connected client with a session and an outbound queue, as serveWebSocket makes them
+func newSessionClient(t *testing.T) (Client, *websocket.Conn) {
+	client, peer := newTestClient(t)
+	client.Session = NewSession("127.0.0.1:5000")
+	client.Outbox = NewOutbox(&client, 8, DisconnectSlowConsumer, SlowStart{})
+	t.Cleanup(client.Outbox.Close)
+	return client, peer
+}
+
+type debugRecord struct {
+	Action    string          `json:"action"`
+	ClientId  string          `json:"clientId"`
+	Direction string          `json:"direction"`
+	Frame     json.RawMessage `json:"frame"`
+	Text      string          `json:"text"`
+}
+
+func TestDebugCaptureStreamsToAdminEventsTopic(t *testing.T) {
+	pubsub := &PubSub{}
+	client, peer := newSessionClient(t)
+	pubsub.AddClient(client)
+	ops, opsPeer := newSessionClient(t)
+	pubsub.AddClient(ops)
+	pubsub.Subscribe(&ops, pubsub.options().adminEventsTopic)
+
+	client.Session.capture(debugInbound, []byte(`{"action":"who"}`))
+	capture, err := pubsub.StartDebugCapture(client.Id, DebugSinkTopic, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, defaultDebugTTL, capture.ExpiresAt.Sub(capture.StartedAt))
+	assert.Equal(t, []DebugCapture{capture}, pubsub.DebugCaptures())
+
+	client.Session.capture(debugInbound, []byte(`{"action":"subscribe","topic":"news"}`))
+	var record debugRecord
+	assert.NoError(t, opsPeer.ReadJSON(&record))
+	assert.Equal(t, DEBUG, record.Action)
+	assert.Equal(t, client.Id, record.ClientId)
+	assert.Equal(t, debugInbound, record.Direction)
+	assert.JSONEq(t, `{"action":"subscribe","topic":"news"}`, string(record.Frame))
+
+	client.Send([]byte("Server received the message!"))
+	peer.ReadMessage()
+	assert.NoError(t, opsPeer.ReadJSON(&record))
+	assert.Equal(t, debugOutbound, record.Direction)
+	assert.Equal(t, "Server received the message!", record.Text)
+
+	// Capturing the operator watching the captures does not capture the records
+	_, err = pubsub.StartDebugCapture(ops.Id, DebugSinkTopic, time.Minute)
+	assert.NoError(t, err)
+	client.Session.capture(debugInbound, []byte(`"ping"`))
+	assert.NoError(t, opsPeer.ReadJSON(&record))
+	assert.Equal(t, client.Id, record.ClientId)
+	opsPeer.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, data, err := opsPeer.ReadMessage()
+	assert.Error(t, err, "Records should not be captured again, got %s", data)
+
+	assert.True(t, pubsub.StopDebugCapture(client.Id))
+	assert.False(t, pubsub.StopDebugCapture(client.Id))
+	assert.Nil(t, client.Session.debug.Load())
+}
+
+func TestDebugCaptureToFileExpires(t *testing.T) {
+	pubsub := &PubSub{}
+	pubsub.options().debugLogDir = t.TempDir()
+	client, _ := newSessionClient(t)
+	pubsub.AddClient(client)
+
+	capture, err := pubsub.StartDebugCapture(client.Id, DebugSinkFile, 100*time.Millisecond)
+	assert.NoError(t, err)
+	client.Session.capture(debugInbound, []byte(`{"action":"hello"}`))
+	client.Session.capture(debugInbound, []byte(`{"action":"who"}`))
+	assert.Eventually(t, func() bool { return len(pubsub.DebugCaptures()) == 0 }, time.Second, 10*time.Millisecond)
+	client.Session.capture(debugInbound, []byte(`{"action":"after"}`))
+
+	file, err := os.Open(capture.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	assert.Len(t, lines, 2, "Frames after the capture expired should not be written")
+	assert.Contains(t, lines[0], `"frame":{"action":"hello"}`)
+
+	_, err = pubsub.StartDebugCapture("nobody", DebugSinkTopic, 0)
+	assert.ErrorIs(t, err, errUnknownClient)
+	_, err = pubsub.StartDebugCapture(client.Id, "syslog", 0)
+	assert.Error(t, err)
+	pubsub.options().debugLogDir = ""
+	_, err = pubsub.StartDebugCapture(client.Id, DebugSinkFile, 0)
+	assert.ErrorIs(t, err, errDebugFileSink)
+}
+
+func TestOnlyAdminsSubscribeToAdminEvents(t *testing.T) {
+	pubsub := &PubSub{}
+	client, peer := newTestClient(t)
+	client.Claims = jwt.MapClaims{permissionsClaim: []interface{}{PermissionSubscribe, PermissionPublish}}
+
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"$admin.events"}`))
+	_, data, err := peer.ReadMessage()
+	assert.NoError(t, err)
+	assert.JSONEq(t, string(forbiddenMessage(SUBSCRIBE, pubsub.options().adminEventsTopic)), string(data))
+
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"publish","topic":"$admin.events","message":"fake"}`))
+	_, data, err = peer.ReadMessage()
+	assert.NoError(t, err)
+	assert.JSONEq(t, string(forbiddenMessage(PUBLISH, pubsub.options().adminEventsTopic)), string(data))
+}
+
+func TestClientsWithoutPermissionsDoNotSubscribeToAdminEvents(t *testing.T) {
+	pubsub := &PubSub{}
+	for name, claims := range map[string]jwt.MapClaims{
+		"anonymous":                    nil,
+		"token without permissions":    {"sub": "alice"},
+		"token with other permissions": {"sub": "bob", permissionsClaim: []interface{}{PermissionSubscribe}},
+	} {
+		client, peer := newTestClient(t)
+		client.Claims = claims
+		pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"$admin.events"}`))
+		_, data, err := peer.ReadMessage()
+		assert.NoError(t, err)
+		assert.JSONEq(t, string(forbiddenMessage(SUBSCRIBE, pubsub.options().adminEventsTopic)), string(data), name)
+	}
+	assert.Empty(t, pubsub.GetSubscriptions(pubsub.options().adminEventsTopic, nil))
+
+	admin, _ := newTestClient(t)
+	admin.Claims = jwt.MapClaims{permissionsClaim: []interface{}{PermissionSubscribe, PermissionAdmin}}
+	pubsub.HandleRecvdMessage(admin, 1, []byte(`{"action":"subscribe","topic":"$admin.events"}`))
+	assert.Len(t, pubsub.GetSubscriptions(pubsub.options().adminEventsTopic, nil), 1)
+}
+
+func TestDebugRoutes(t *testing.T) {
+	keys := NewAPIKeyStore()
+	isolatePubSub(t).apiKeys = keys
+	keys.Add("admin-secret", "ops", []string{PermissionAdmin})
+	mux := http.NewServeMux()
+	setupDebugRoutes(mux, ps)
+	client, _ := newSessionClient(t)
+	ps.AddClient(client)
+	t.Cleanup(func() {
+		ps.StopDebugCapture(client.Id)
+		ps.RemoveClient(client)
+	})
+
+	call := func(method string, path string, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, path, strings.NewReader(body))
+		request.Header.Set(apiKeyHeader, "admin-secret")
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, request)
+		return recorder
+	}
+	assert.Equal(t, http.StatusNotFound, call("POST", "/admin/clients/nobody/debug", "").Code)
+	assert.Equal(t, http.StatusBadRequest, call("POST", "/admin/clients/"+client.Id+"/debug", `{"ttl": "forever"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, call("POST", "/admin/clients/"+client.Id+"/debug", `{"sink": "file"}`).Code)
+
+	response := call("POST", "/admin/clients/"+client.Id+"/debug", `{"ttl": "2h"}`)
+	assert.Equal(t, http.StatusOK, response.Code)
+	var capture DebugCapture
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &capture))
+	assert.Equal(t, DebugSinkTopic, capture.Sink)
+	assert.Equal(t, maxDebugTTL, capture.ExpiresAt.Sub(capture.StartedAt), "Captures should last an hour at most")
+	assert.Contains(t, call("GET", "/admin/debug", "").Body.String(), client.Id)
+
+	assert.Equal(t, http.StatusNoContent, call("DELETE", "/admin/clients/"+client.Id+"/debug", "").Code)
+	assert.Equal(t, http.StatusNotFound, call("DELETE", "/admin/clients/"+client.Id+"/debug", "").Code)
+}
@@ -0,0 +1,68 @@
+// This file compresses WebSocket frames with the permessage-deflate extension (RFC
+// 7692), which browsers negotiate on their own, so large JSON payloads fanned out to
+// many clients don't saturate bandwidth. A frame shared by many subscribers is
+// compressed once per level and reused for all of them. Topics whose messages do not
+// compress, such as already compressed media, can opt out so no CPU is spent on them.
+package main
+
+import (
+	"compress/flate"
+	"fmt"
+
+	"github.com/gorilla/websocket"
+)
+
+// Default level frames are compressed at, favoring speed as messages are small
+const defaultDeflateLevel = flate.BestSpeed
+
+// Function to check a permessage-deflate compression level.
+// Parameters:
+// level: int - The level.
+// Returns:
+// error - An error if the level is not between flate.HuffmanOnly and flate.BestCompression.
+func validDeflateLevel(level int) error {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return fmt.Errorf("permessage-deflate level %d is not between %d and %d", level, flate.HuffmanOnly, flate.BestCompression)
+	}
+	return nil
+}
+
+// Function to tell whether the messages of a topic opted out of permessage-deflate.
+// Parameters:
+// topic: string - The topic.
+// Returns:
+// bool - True if the topic matches an excluded pattern.
+func (ps *PubSub) deflateExcluded(topic string) bool {
+	for _, pattern := range ps.options().permessageDeflateExcluded {
+		if globMatch(pattern, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// Function to write the frame of a payload to the WebSocket connection of a client,
+// compressed with permessage-deflate if the client negotiated it, unless the payload
+// opted out or the connection is already compressed by its compression codec.
+// Parameters:
+// payload: *Payload - The payload.
+// Returns:
+// error - An error if the frame could not be built or written.
+func (client *Client) writePayload(payload *Payload) error {
+	if client.Stream != nil {
+		if payload.Binary {
+			return client.Stream.WriteFrame(websocket.BinaryMessage, payload.Data)
+		}
+		return client.Stream.WriteFrame(websocket.TextMessage, payload.Data)
+	}
+	prepared, err := payload.PreparedFor(client.Codec, client.Compression)
+	if err != nil {
+		return err
+	}
+	if payload.undeflated || client.Compression != nil {
+		client.Connection.EnableWriteCompression(false)
+		defer client.Connection.EnableWriteCompression(true)
+	}
+	client.armWriteDeadline()
+	return client.Connection.WritePreparedMessage(prepared)
+}
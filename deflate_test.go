@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// countingConn counts the bytes read from a connection.
+type countingConn struct {
+	net.Conn
+	read *atomic.Int64
+}
+
+func (c countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func TestPermessageDeflate(t *testing.T) {
+	options := isolatePubSub(t)
+	options.upgrader.EnableCompression = true
+	options.permessageDeflateExcluded = []string{"deflate-media/*"}
+	server := httptest.NewServer(http.HandlerFunc(ps.webSocketHandler))
+	defer server.Close()
+
+	var read atomic.Int64
+	dialer := websocket.Dialer{EnableCompression: true, NetDial: func(network, addr string) (net.Conn, error) {
+		conn, err := net.Dial(network, addr)
+		return countingConn{conn, &read}, err
+	}}
+	ws, response, err := dialer.Dial("ws"+server.URL[4:], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	assert.Contains(t, response.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate")
+
+	_, _, err = ws.ReadMessage()
+	assert.NoError(t, err)
+	for _, topic := range []string{"deflate-docs", "deflate-media/clip"} {
+		ws.WriteJSON(map[string]string{"action": "subscribe", "topic": topic})
+		_, ack, err := ws.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, "Server received the message!", string(ack))
+	}
+
+	// deliver publishes a large, repetitive message and tells how many bytes carried it
+	message := `"` + strings.Repeat("compressible ", 2000) + `"`
+	deliver := func(topic string) int64 {
+		before := read.Load()
+		ps.Publish(topic, []byte(message), nil)
+		_, data, err := ws.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, message, string(data), "Frames should be decompressed transparently")
+		return read.Load() - before
+	}
+	assert.Less(t, deliver("deflate-docs"), int64(len(message)/10), "The message should be compressed")
+	assert.Greater(t, deliver("deflate-media/clip"), int64(len(message)), "Excluded topics should not be compressed")
+	assert.Less(t, deliver("deflate-docs"), int64(len(message)/10), "Compression should resume after an excluded topic")
+}
+
+func TestValidDeflateLevel(t *testing.T) {
+	assert.NoError(t, validDeflateLevel(-2))
+	assert.NoError(t, validDeflateLevel(9))
+	assert.Error(t, validDeflateLevel(10))
+	assert.Error(t, validDeflateLevel(-3))
+}
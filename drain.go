@@ -0,0 +1,152 @@
+// This file lets operators disconnect every connection of a tenant or user with one
+// admin call, e.g. when offboarding a customer or stopping abuse. Disconnects are paced
+// so the clients do not all reconnect elsewhere at once.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Claim naming the tenant a client belongs to
+const tenantClaim = "tenant"
+
+const (
+	// Disconnects per second when a drain does not ask for a rate
+	defaultDrainRate = 50
+	// How long a graceful drain waits for the queue of each client to be written
+	drainFlushTimeout = 5 * time.Second
+)
+
+// DrainMode decides whether queued messages are written before disconnecting.
+type DrainMode string
+
+const (
+	// Write the messages queued for the client, then close the connection
+	DrainGraceful DrainMode = "drain"
+	// Close the connection right away, discarding queued messages
+	DrainHard DrainMode = "disconnect"
+)
+
+// DrainRequest selects the clients to disconnect, by tenant, by principal or both.
+type DrainRequest struct {
+	Tenant    string           `json:"tenant"`
+	Principal string           `json:"principal"`
+	Mode      DrainMode        `json:"mode"`
+	Reason    DisconnectReason `json:"reason"`
+	// Disconnects per second
+	Rate float64 `json:"rate"`
+}
+
+// Function to get the tenant a client belongs to.
+// Returns:
+// string - The tenant claim of the client's token, or an empty string.
+func (client *Client) Tenant() string {
+	tenant, _ := client.Claims[tenantClaim].(string)
+	return tenant
+}
+
+// Function to fill in the defaults of a drain request and check it.
+// Returns:
+// error - An error if the request selects no clients or names an unknown mode or reason.
+func (request *DrainRequest) validate() error {
+	if request.Tenant == "" && request.Principal == "" {
+		return fmt.Errorf("a tenant or principal is required")
+	}
+	if request.Mode == "" {
+		request.Mode = DrainGraceful
+	}
+	if request.Mode != DrainGraceful && request.Mode != DrainHard {
+		return fmt.Errorf("unknown drain mode %q", request.Mode)
+	}
+	if request.Reason == "" {
+		request.Reason = ReasonKicked
+	}
+	if _, ok := closeCodes[request.Reason]; !ok {
+		return fmt.Errorf("unknown disconnect reason %q", request.Reason)
+	}
+	if request.Rate <= 0 {
+		request.Rate = defaultDrainRate
+	}
+	return nil
+}
+
+// Function to start disconnecting the WebSocket clients selected by a drain request,
+// at the rate it asks for.
+// Parameters:
+// request: DrainRequest - The validated request.
+// Returns:
+// int - The number of clients that will be disconnected.
+// <-chan struct{} - Closed once every selected client was disconnected.
+func (ps *PubSub) Drain(request DrainRequest) (int, <-chan struct{}) {
+	var clients []Client
+	for _, client := range ps.Clients() {
+		if !client.Closable() {
+			continue
+		}
+		if (request.Tenant == "" || client.Tenant() == request.Tenant) &&
+			(request.Principal == "" || client.Principal() == request.Principal) {
+			clients = append(clients, client)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		interval := time.Duration(float64(time.Second) / request.Rate)
+		for i, client := range clients {
+			if i > 0 {
+				time.Sleep(interval)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), drainFlushTimeout)
+			disconnectClient(ctx, client, request.Reason, request.Mode == DrainGraceful)
+			cancel()
+		}
+		slog.Info("Drained clients", "clients", len(clients), "tenant", request.Tenant, "principal", request.Principal)
+	}()
+	return len(clients), done
+}
+
+// Function to disconnect a WebSocket client with a close frame.
+// Parameters:
+// ctx: context.Context - Bounds how long to wait for the queue of the client to be written.
+// client: Client - The client.
+// reason: DisconnectReason - Why the client is disconnected.
+// flush: bool - Whether to write the messages queued for the client first.
+// Returns:
+// error - The context's error if the queue was not written in time.
+func disconnectClient(ctx context.Context, client Client, reason DisconnectReason, flush bool) error {
+	var err error
+	if client.Outbox != nil {
+		if flush {
+			err = client.Outbox.Flush(ctx)
+		}
+		client.Outbox.Close()
+	}
+	client.Close(reason)
+	return err
+}
+
+// Function to register the admin API draining the connections of a tenant or user.
+// Parameters:
+// mux: *http.ServeMux - The mux to register the route on.
+// pubsub: *PubSub - The PubSub the route serves.
+func setupDrainRoutes(mux *http.ServeMux, pubsub *PubSub) {
+	mux.HandleFunc("POST /admin/drain", pubsub.requireAPIKey(PermissionAdmin, func(w http.ResponseWriter, r *http.Request) {
+		var request DrainRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := request.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		count, _ := pubsub.Drain(request)
+		writeJSON(w, http.StatusAccepted, map[string]int{"clients": count})
+	}))
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDrainDisconnectsTenantAtRate(t *testing.T) {
+	pubsub := &PubSub{}
+	var peers []*websocket.Conn
+	for _, tenant := range []string{"acme", "acme", "globex"} {
+		client, peer := newTestClient(t)
+		client.Claims = jwt.MapClaims{"sub": "user-" + tenant, tenantClaim: tenant}
+		pubsub.AddClient(client)
+		peers = append(peers, peer)
+	}
+
+	request := DrainRequest{Tenant: "acme", Rate: 10}
+	assert.NoError(t, request.validate())
+	started := time.Now()
+	count, done := pubsub.Drain(request)
+	assert.Equal(t, 2, count)
+	<-done
+	assert.GreaterOrEqual(t, time.Since(started), 100*time.Millisecond, "Disconnects should be paced by the rate")
+
+	for _, peer := range peers[:2] {
+		_, _, err := peer.ReadMessage()
+		assert.True(t, websocket.IsCloseError(err, CloseKicked), "Clients of the tenant should be kicked")
+	}
+	peers[2].SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, _, err := peers[2].ReadMessage()
+	assert.False(t, websocket.IsCloseError(err, CloseKicked), "Clients of other tenants should stay connected")
+}
+
+func TestDrainGracefullyFlushesQueue(t *testing.T) {
+	pubsub := &PubSub{}
+	client, peer := newTestClient(t)
+	client.Claims = jwt.MapClaims{"sub": "mallory"}
+	client.Outbox = NewOutbox(&client, 8, DisconnectSlowConsumer, SlowStart{})
+	pubsub.AddClient(client)
+	client.Outbox.Push(NewPayload([]byte("last words")))
+
+	request := DrainRequest{Principal: "mallory", Reason: ReasonPolicyViolation}
+	assert.NoError(t, request.validate())
+	_, done := pubsub.Drain(request)
+	<-done
+
+	_, message, err := peer.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, "last words", string(message))
+	_, _, err = peer.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation))
+}
+
+func TestDrainAdminRoute(t *testing.T) {
+	keys := NewAPIKeyStore()
+	isolatePubSub(t).apiKeys = keys
+	keys.Add("admin-secret", "ops", []string{PermissionAdmin})
+	mux := http.NewServeMux()
+	setupDrainRoutes(mux, ps)
+
+	drain := func(body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodPost, "/admin/drain", strings.NewReader(body))
+		request.Header.Set(apiKeyHeader, "admin-secret")
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, request)
+		return recorder
+	}
+	assert.Equal(t, http.StatusBadRequest, drain(`{"mode": "disconnect"}`).Code, "A drain must select clients")
+	assert.Equal(t, http.StatusBadRequest, drain(`{"tenant": "acme", "mode": "later"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, drain(`{"tenant": "acme", "reason": "because"}`).Code)
+
+	response := drain(`{"tenant": "nobody", "mode": "disconnect"}`)
+	assert.Equal(t, http.StatusAccepted, response.Code)
+	assert.JSONEq(t, `{"clients": 0}`, response.Body.String())
+}
@@ -0,0 +1,52 @@
+// This file keeps publishers from receiving their own messages when they ask for it:
+// a publish with "noEcho": true is not delivered back to its publisher, a subscription
+// made with "noEcho": true receives no message its client published, and Publish skips
+// the client it is given to exclude. The publishing client travels with the message, so
+// it is suppressed even when the message is delivered after scanning or moderation.
+package main
+
+import (
+	"context"
+)
+
+// Key of the client that published a message in the context of its publish
+type echoKey struct{}
+
+// echoSource is the client a message was published by.
+type echoSource struct {
+	ClientId string
+	// The message is not delivered back to the client, whatever its subscription asked
+	Exclude bool
+}
+
+// Function to attach the client publishing a message to the context of its publish.
+// Parameters:
+// ctx: context.Context - The context of the publish.
+// source: *echoSource - The client, or nil for messages of the server.
+// Returns:
+// context.Context - The context carrying the client.
+func withEchoSource(ctx context.Context, source *echoSource) context.Context {
+	if source == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, echoKey{}, source)
+}
+
+// Function to get the client that published the message published in a context.
+// Parameters:
+// ctx: context.Context - The context of the publish.
+// Returns:
+// *echoSource - The client, or nil for messages of the server.
+func echoSourceFrom(ctx context.Context) *echoSource {
+	source, _ := ctx.Value(echoKey{}).(*echoSource)
+	return source
+}
+
+// Function to check whether a message is kept from a subscription.
+// Parameters:
+// sub: Subscription - The subscription.
+// Returns:
+// bool - True if the subscriber published the message and it or its subscription asked not to receive it.
+func (source *echoSource) suppresses(sub Subscription) bool {
+	return source != nil && source.ClientId == sub.Client.Id && (source.Exclude || sub.NoEcho)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublishExcludesClient(t *testing.T) {
+	pubsub := &PubSub{}
+	publisher, publisherPeer := newTestClient(t)
+	other, otherPeer := newTestClient(t)
+	pubsub.Subscribe(&publisher, "chat")
+	pubsub.Subscribe(&other, "chat")
+
+	pubsub.Publish("chat", []byte(`"hello"`), &publisher)
+	assert.Equal(t, `"hello"`, string(mustRead(t, otherPeer)))
+	publisherPeer.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, _, err := publisherPeer.ReadMessage()
+	assert.Error(t, err, "The excluded client should not receive the message")
+}
+
+func TestPublishWithNoEcho(t *testing.T) {
+	pubsub := &PubSub{}
+	publisher, publisherPeer := newTestClient(t)
+	other, otherPeer := newTestClient(t)
+	pubsub.HandleRecvdMessage(publisher, 1, []byte(`{"action":"subscribe","topic":"chat"}`))
+	pubsub.HandleRecvdMessage(other, 1, []byte(`{"action":"subscribe","topic":"chat"}`))
+
+	pubsub.HandleRecvdMessage(publisher, 1, []byte(`{"action":"publish","topic":"chat","message":"quiet","noEcho":true}`))
+	pubsub.HandleRecvdMessage(publisher, 1, []byte(`{"action":"publish","topic":"chat","message":"loud"}`))
+	assert.Equal(t, `"quiet"`, string(mustRead(t, otherPeer)))
+	assert.Equal(t, `"loud"`, string(mustRead(t, publisherPeer)), "Only the publish asking for it is not echoed")
+}
+
+func TestSubscribeWithNoEcho(t *testing.T) {
+	pubsub := &PubSub{}
+	client, peer := newTestClient(t)
+	other, _ := newTestClient(t)
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"chat","noEcho":true}`))
+
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"publish","topic":"chat","message":"mine"}`))
+	pubsub.HandleRecvdMessage(other, 1, []byte(`{"action":"publish","topic":"chat","message":"theirs"}`))
+	pubsub.Publish("chat", []byte(`"server"`), nil)
+	assert.Equal(t, `"theirs"`, string(mustRead(t, peer)), "The client's own messages are not delivered back")
+	assert.Equal(t, `"server"`, string(mustRead(t, peer)))
+}
+
+func TestNoEchoSurvivesModeration(t *testing.T) {
+	pubsub := &PubSub{}
+	pubsub.Moderation = NewModeration([]string{"chat"}, nil, pubsub)
+	publisher, publisherPeer := newTestClient(t)
+	pubsub.HandleRecvdMessage(publisher, 1, []byte(`{"action":"subscribe","topic":"chat"}`))
+
+	pubsub.HandleRecvdMessage(publisher, 1, []byte(`{"action":"publish","topic":"chat","message":"held","noEcho":true}`))
+	pubsub.HandleRecvdMessage(publisher, 1, []byte(`{"action":"publish","topic":"chat","message":"echoed"}`))
+	for _, held := range pubsub.Moderation.Pending() {
+		assert.NoError(t, pubsub.Moderation.Decide(held.Id, VerdictApprove))
+	}
+	assert.Equal(t, `"echoed"`, string(mustRead(t, publisherPeer)), "Released messages keep the publish's noEcho")
+}
@@ -0,0 +1,601 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.6
+// 	protoc        (unknown)
+// source: envelope.proto
+
+package envelopepb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	structpb "google.golang.org/protobuf/types/known/structpb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// A frame sent by a client, e.g. a publish or subscribe.
+type Request struct {
+	state  protoimpl.MessageState `protogen:"open.v1"`
+	Action string                 `protobuf:"bytes,1,opt,name=action,proto3" json:"action,omitempty"`
+	Topic  string                 `protobuf:"bytes,2,opt,name=topic,proto3" json:"topic,omitempty"`
+	// The JSON message of a publish
+	Message *structpb.Value `protobuf:"bytes,3,opt,name=message,proto3" json:"message,omitempty"`
+	// The binary message of a publish, sent instead of message
+	Data          []byte            `protobuf:"bytes,4,opt,name=data,proto3" json:"data,omitempty"`
+	Principal     string            `protobuf:"bytes,5,opt,name=principal,proto3" json:"principal,omitempty"`
+	Publisher     string            `protobuf:"bytes,6,opt,name=publisher,proto3" json:"publisher,omitempty"`
+	Policy        *structpb.Value   `protobuf:"bytes,7,opt,name=policy,proto3" json:"policy,omitempty"`
+	Grant         string            `protobuf:"bytes,8,opt,name=grant,proto3" json:"grant,omitempty"`
+	Ttl           int64             `protobuf:"varint,9,opt,name=ttl,proto3" json:"ttl,omitempty"`
+	Id            string            `protobuf:"bytes,10,opt,name=id,proto3" json:"id,omitempty"`
+	Reason        string            `protobuf:"bytes,11,opt,name=reason,proto3" json:"reason,omitempty"`
+	Envelope      bool              `protobuf:"varint,12,opt,name=envelope,proto3" json:"envelope,omitempty"`
+	StatsInterval int64             `protobuf:"varint,13,opt,name=stats_interval,json=statsInterval,proto3" json:"stats_interval,omitempty"`
+	Trace         map[string]string `protobuf:"bytes,14,rep,name=trace,proto3" json:"trace,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	Since         string            `protobuf:"bytes,15,opt,name=since,proto3" json:"since,omitempty"`
+	Limit         int64             `protobuf:"varint,16,opt,name=limit,proto3" json:"limit,omitempty"`
+	Name          string            `protobuf:"bytes,17,opt,name=name,proto3" json:"name,omitempty"`
+	Attributes    map[string]string `protobuf:"bytes,18,rep,name=attributes,proto3" json:"attributes,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	Users         []string          `protobuf:"bytes,19,rep,name=users,proto3" json:"users,omitempty"`
+	Start         string            `protobuf:"bytes,20,opt,name=start,proto3" json:"start,omitempty"`
+	// Where the replies to a request go and the ID matching them to it
+	ReplyTo       string `protobuf:"bytes,21,opt,name=reply_to,json=replyTo,proto3" json:"reply_to,omitempty"`
+	CorrelationId string `protobuf:"bytes,22,opt,name=correlation_id,json=correlationId,proto3" json:"correlation_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Request) Reset() {
+	*x = Request{}
+	mi := &file_envelope_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Request) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Request) ProtoMessage() {}
+
+func (x *Request) ProtoReflect() protoreflect.Message {
+	mi := &file_envelope_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Request.ProtoReflect.Descriptor instead.
+func (*Request) Descriptor() ([]byte, []int) {
+	return file_envelope_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Request) GetAction() string {
+	if x != nil {
+		return x.Action
+	}
+	return ""
+}
+
+func (x *Request) GetTopic() string {
+	if x != nil {
+		return x.Topic
+	}
+	return ""
+}
+
+func (x *Request) GetMessage() *structpb.Value {
+	if x != nil {
+		return x.Message
+	}
+	return nil
+}
+
+func (x *Request) GetData() []byte {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+func (x *Request) GetPrincipal() string {
+	if x != nil {
+		return x.Principal
+	}
+	return ""
+}
+
+func (x *Request) GetPublisher() string {
+	if x != nil {
+		return x.Publisher
+	}
+	return ""
+}
+
+func (x *Request) GetPolicy() *structpb.Value {
+	if x != nil {
+		return x.Policy
+	}
+	return nil
+}
+
+func (x *Request) GetGrant() string {
+	if x != nil {
+		return x.Grant
+	}
+	return ""
+}
+
+func (x *Request) GetTtl() int64 {
+	if x != nil {
+		return x.Ttl
+	}
+	return 0
+}
+
+func (x *Request) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *Request) GetReason() string {
+	if x != nil {
+		return x.Reason
+	}
+	return ""
+}
+
+func (x *Request) GetEnvelope() bool {
+	if x != nil {
+		return x.Envelope
+	}
+	return false
+}
+
+func (x *Request) GetStatsInterval() int64 {
+	if x != nil {
+		return x.StatsInterval
+	}
+	return 0
+}
+
+func (x *Request) GetTrace() map[string]string {
+	if x != nil {
+		return x.Trace
+	}
+	return nil
+}
+
+func (x *Request) GetSince() string {
+	if x != nil {
+		return x.Since
+	}
+	return ""
+}
+
+func (x *Request) GetLimit() int64 {
+	if x != nil {
+		return x.Limit
+	}
+	return 0
+}
+
+func (x *Request) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *Request) GetAttributes() map[string]string {
+	if x != nil {
+		return x.Attributes
+	}
+	return nil
+}
+
+func (x *Request) GetUsers() []string {
+	if x != nil {
+		return x.Users
+	}
+	return nil
+}
+
+func (x *Request) GetStart() string {
+	if x != nil {
+		return x.Start
+	}
+	return ""
+}
+
+func (x *Request) GetReplyTo() string {
+	if x != nil {
+		return x.ReplyTo
+	}
+	return ""
+}
+
+func (x *Request) GetCorrelationId() string {
+	if x != nil {
+		return x.CorrelationId
+	}
+	return ""
+}
+
+// A frame sent by the server.
+type Frame struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Types that are valid to be assigned to Frame:
+	//
+	//	*Frame_Envelope
+	//	*Frame_Json
+	//	*Frame_Binary
+	Frame         isFrame_Frame `protobuf_oneof:"frame"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Frame) Reset() {
+	*x = Frame{}
+	mi := &file_envelope_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Frame) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Frame) ProtoMessage() {}
+
+func (x *Frame) ProtoReflect() protoreflect.Message {
+	mi := &file_envelope_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Frame.ProtoReflect.Descriptor instead.
+func (*Frame) Descriptor() ([]byte, []int) {
+	return file_envelope_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Frame) GetFrame() isFrame_Frame {
+	if x != nil {
+		return x.Frame
+	}
+	return nil
+}
+
+func (x *Frame) GetEnvelope() *Envelope {
+	if x != nil {
+		if x, ok := x.Frame.(*Frame_Envelope); ok {
+			return x.Envelope
+		}
+	}
+	return nil
+}
+
+func (x *Frame) GetJson() *structpb.Value {
+	if x != nil {
+		if x, ok := x.Frame.(*Frame_Json); ok {
+			return x.Json
+		}
+	}
+	return nil
+}
+
+func (x *Frame) GetBinary() []byte {
+	if x != nil {
+		if x, ok := x.Frame.(*Frame_Binary); ok {
+			return x.Binary
+		}
+	}
+	return nil
+}
+
+type isFrame_Frame interface {
+	isFrame_Frame()
+}
+
+type Frame_Envelope struct {
+	// A message delivered in its envelope
+	Envelope *Envelope `protobuf:"bytes,1,opt,name=envelope,proto3,oneof"`
+}
+
+type Frame_Json struct {
+	// Any other frame, e.g. a welcome, an error or a message delivered as is
+	Json *structpb.Value `protobuf:"bytes,2,opt,name=json,proto3,oneof"`
+}
+
+type Frame_Binary struct {
+	// A binary message delivered as is
+	Binary []byte `protobuf:"bytes,3,opt,name=binary,proto3,oneof"`
+}
+
+func (*Frame_Envelope) isFrame_Frame() {}
+
+func (*Frame_Json) isFrame_Frame() {}
+
+func (*Frame_Binary) isFrame_Frame() {}
+
+// A delivered message with its ID, publisher, trace and reply headers.
+type Envelope struct {
+	state     protoimpl.MessageState `protogen:"open.v1"`
+	Topic     string                 `protobuf:"bytes,1,opt,name=topic,proto3" json:"topic,omitempty"`
+	Id        string                 `protobuf:"bytes,2,opt,name=id,proto3" json:"id,omitempty"`
+	Publisher string                 `protobuf:"bytes,3,opt,name=publisher,proto3" json:"publisher,omitempty"`
+	// Types that are valid to be assigned to Payload:
+	//
+	//	*Envelope_Message
+	//	*Envelope_Data
+	Payload       isEnvelope_Payload `protobuf_oneof:"payload"`
+	Trace         map[string]string  `protobuf:"bytes,6,rep,name=trace,proto3" json:"trace,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	ReplyTo       string             `protobuf:"bytes,7,opt,name=reply_to,json=replyTo,proto3" json:"reply_to,omitempty"`
+	CorrelationId string             `protobuf:"bytes,8,opt,name=correlation_id,json=correlationId,proto3" json:"correlation_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Envelope) Reset() {
+	*x = Envelope{}
+	mi := &file_envelope_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Envelope) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Envelope) ProtoMessage() {}
+
+func (x *Envelope) ProtoReflect() protoreflect.Message {
+	mi := &file_envelope_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Envelope.ProtoReflect.Descriptor instead.
+func (*Envelope) Descriptor() ([]byte, []int) {
+	return file_envelope_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *Envelope) GetTopic() string {
+	if x != nil {
+		return x.Topic
+	}
+	return ""
+}
+
+func (x *Envelope) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *Envelope) GetPublisher() string {
+	if x != nil {
+		return x.Publisher
+	}
+	return ""
+}
+
+func (x *Envelope) GetPayload() isEnvelope_Payload {
+	if x != nil {
+		return x.Payload
+	}
+	return nil
+}
+
+func (x *Envelope) GetMessage() *structpb.Value {
+	if x != nil {
+		if x, ok := x.Payload.(*Envelope_Message); ok {
+			return x.Message
+		}
+	}
+	return nil
+}
+
+func (x *Envelope) GetData() []byte {
+	if x != nil {
+		if x, ok := x.Payload.(*Envelope_Data); ok {
+			return x.Data
+		}
+	}
+	return nil
+}
+
+func (x *Envelope) GetTrace() map[string]string {
+	if x != nil {
+		return x.Trace
+	}
+	return nil
+}
+
+func (x *Envelope) GetReplyTo() string {
+	if x != nil {
+		return x.ReplyTo
+	}
+	return ""
+}
+
+func (x *Envelope) GetCorrelationId() string {
+	if x != nil {
+		return x.CorrelationId
+	}
+	return ""
+}
+
+type isEnvelope_Payload interface {
+	isEnvelope_Payload()
+}
+
+type Envelope_Message struct {
+	Message *structpb.Value `protobuf:"bytes,4,opt,name=message,proto3,oneof"`
+}
+
+type Envelope_Data struct {
+	Data []byte `protobuf:"bytes,5,opt,name=data,proto3,oneof"`
+}
+
+func (*Envelope_Message) isEnvelope_Payload() {}
+
+func (*Envelope_Data) isEnvelope_Payload() {}
+
+var File_envelope_proto protoreflect.FileDescriptor
+
+const file_envelope_proto_rawDesc = "" +
+	"\n" +
+	"\x0eenvelope.proto\x12\x18gowebsockets.envelope.v1\x1a\x1cgoogle/protobuf/struct.proto\"\xba\x06\n" +
+	"\aRequest\x12\x16\n" +
+	"\x06action\x18\x01 \x01(\tR\x06action\x12\x14\n" +
+	"\x05topic\x18\x02 \x01(\tR\x05topic\x120\n" +
+	"\amessage\x18\x03 \x01(\v2\x16.google.protobuf.ValueR\amessage\x12\x12\n" +
+	"\x04data\x18\x04 \x01(\fR\x04data\x12\x1c\n" +
+	"\tprincipal\x18\x05 \x01(\tR\tprincipal\x12\x1c\n" +
+	"\tpublisher\x18\x06 \x01(\tR\tpublisher\x12.\n" +
+	"\x06policy\x18\a \x01(\v2\x16.google.protobuf.ValueR\x06policy\x12\x14\n" +
+	"\x05grant\x18\b \x01(\tR\x05grant\x12\x10\n" +
+	"\x03ttl\x18\t \x01(\x03R\x03ttl\x12\x0e\n" +
+	"\x02id\x18\n" +
+	" \x01(\tR\x02id\x12\x16\n" +
+	"\x06reason\x18\v \x01(\tR\x06reason\x12\x1a\n" +
+	"\benvelope\x18\f \x01(\bR\benvelope\x12%\n" +
+	"\x0estats_interval\x18\r \x01(\x03R\rstatsInterval\x12B\n" +
+	"\x05trace\x18\x0e \x03(\v2,.gowebsockets.envelope.v1.Request.TraceEntryR\x05trace\x12\x14\n" +
+	"\x05since\x18\x0f \x01(\tR\x05since\x12\x14\n" +
+	"\x05limit\x18\x10 \x01(\x03R\x05limit\x12\x12\n" +
+	"\x04name\x18\x11 \x01(\tR\x04name\x12Q\n" +
+	"\n" +
+	"attributes\x18\x12 \x03(\v21.gowebsockets.envelope.v1.Request.AttributesEntryR\n" +
+	"attributes\x12\x14\n" +
+	"\x05users\x18\x13 \x03(\tR\x05users\x12\x14\n" +
+	"\x05start\x18\x14 \x01(\tR\x05start\x12\x19\n" +
+	"\breply_to\x18\x15 \x01(\tR\areplyTo\x12%\n" +
+	"\x0ecorrelation_id\x18\x16 \x01(\tR\rcorrelationId\x1a8\n" +
+	"\n" +
+	"TraceEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\x1a=\n" +
+	"\x0fAttributesEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"\x9a\x01\n" +
+	"\x05Frame\x12@\n" +
+	"\benvelope\x18\x01 \x01(\v2\".gowebsockets.envelope.v1.EnvelopeH\x00R\benvelope\x12,\n" +
+	"\x04json\x18\x02 \x01(\v2\x16.google.protobuf.ValueH\x00R\x04json\x12\x18\n" +
+	"\x06binary\x18\x03 \x01(\fH\x00R\x06binaryB\a\n" +
+	"\x05frame\"\xe4\x02\n" +
+	"\bEnvelope\x12\x14\n" +
+	"\x05topic\x18\x01 \x01(\tR\x05topic\x12\x0e\n" +
+	"\x02id\x18\x02 \x01(\tR\x02id\x12\x1c\n" +
+	"\tpublisher\x18\x03 \x01(\tR\tpublisher\x122\n" +
+	"\amessage\x18\x04 \x01(\v2\x16.google.protobuf.ValueH\x00R\amessage\x12\x14\n" +
+	"\x04data\x18\x05 \x01(\fH\x00R\x04data\x12C\n" +
+	"\x05trace\x18\x06 \x03(\v2-.gowebsockets.envelope.v1.Envelope.TraceEntryR\x05trace\x12\x19\n" +
+	"\breply_to\x18\a \x01(\tR\areplyTo\x12%\n" +
+	"\x0ecorrelation_id\x18\b \x01(\tR\rcorrelationId\x1a8\n" +
+	"\n" +
+	"TraceEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01B\t\n" +
+	"\apayloadB\x1eZ\x1cmywebsocketserver/envelopepbb\x06proto3"
+
+var (
+	file_envelope_proto_rawDescOnce sync.Once
+	file_envelope_proto_rawDescData []byte
+)
+
+func file_envelope_proto_rawDescGZIP() []byte {
+	file_envelope_proto_rawDescOnce.Do(func() {
+		file_envelope_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_envelope_proto_rawDesc), len(file_envelope_proto_rawDesc)))
+	})
+	return file_envelope_proto_rawDescData
+}
+
+var file_envelope_proto_msgTypes = make([]protoimpl.MessageInfo, 6)
+var file_envelope_proto_goTypes = []any{
+	(*Request)(nil),        // 0: gowebsockets.envelope.v1.Request
+	(*Frame)(nil),          // 1: gowebsockets.envelope.v1.Frame
+	(*Envelope)(nil),       // 2: gowebsockets.envelope.v1.Envelope
+	nil,                    // 3: gowebsockets.envelope.v1.Request.TraceEntry
+	nil,                    // 4: gowebsockets.envelope.v1.Request.AttributesEntry
+	nil,                    // 5: gowebsockets.envelope.v1.Envelope.TraceEntry
+	(*structpb.Value)(nil), // 6: google.protobuf.Value
+}
+var file_envelope_proto_depIdxs = []int32{
+	6, // 0: gowebsockets.envelope.v1.Request.message:type_name -> google.protobuf.Value
+	6, // 1: gowebsockets.envelope.v1.Request.policy:type_name -> google.protobuf.Value
+	3, // 2: gowebsockets.envelope.v1.Request.trace:type_name -> gowebsockets.envelope.v1.Request.TraceEntry
+	4, // 3: gowebsockets.envelope.v1.Request.attributes:type_name -> gowebsockets.envelope.v1.Request.AttributesEntry
+	2, // 4: gowebsockets.envelope.v1.Frame.envelope:type_name -> gowebsockets.envelope.v1.Envelope
+	6, // 5: gowebsockets.envelope.v1.Frame.json:type_name -> google.protobuf.Value
+	6, // 6: gowebsockets.envelope.v1.Envelope.message:type_name -> google.protobuf.Value
+	5, // 7: gowebsockets.envelope.v1.Envelope.trace:type_name -> gowebsockets.envelope.v1.Envelope.TraceEntry
+	8, // [8:8] is the sub-list for method output_type
+	8, // [8:8] is the sub-list for method input_type
+	8, // [8:8] is the sub-list for extension type_name
+	8, // [8:8] is the sub-list for extension extendee
+	0, // [0:8] is the sub-list for field type_name
+}
+
+func init() { file_envelope_proto_init() }
+func file_envelope_proto_init() {
+	if File_envelope_proto != nil {
+		return
+	}
+	file_envelope_proto_msgTypes[1].OneofWrappers = []any{
+		(*Frame_Envelope)(nil),
+		(*Frame_Json)(nil),
+		(*Frame_Binary)(nil),
+	}
+	file_envelope_proto_msgTypes[2].OneofWrappers = []any{
+		(*Envelope_Message)(nil),
+		(*Envelope_Data)(nil),
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_envelope_proto_rawDesc), len(file_envelope_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   6,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_envelope_proto_goTypes,
+		DependencyIndexes: file_envelope_proto_depIdxs,
+		MessageInfos:      file_envelope_proto_msgTypes,
+	}.Build()
+	File_envelope_proto = out.File
+	file_envelope_proto_goTypes = nil
+	file_envelope_proto_depIdxs = nil
+}
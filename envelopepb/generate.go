@@ -0,0 +1,5 @@
+// Package envelopepb holds the Go types of the protobuf envelope exchanged by clients
+// using the protobuf subprotocol, generated from envelope.proto.
+package envelopepb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative envelope.proto
@@ -0,0 +1,54 @@
+// This file builds the typed error frames sent to clients for the input the server
+// rejects: a frame that is not valid JSON gets {"action":"error","code":"bad_payload",
+// "detail":"..."} and a frame with a missing or unknown action gets the unknown_action
+// code, so clients are never left guessing why nothing happened.
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Codes of the error frames for rejected input
+const (
+	// The frame could not be decoded
+	codeBadPayload = "bad_payload"
+	// The frame has no action, or one the server does not know
+	codeUnknownAction = "unknown_action"
+	// An interceptor added by the embedder rejected the frame
+	codeIntercepted = "intercepted"
+)
+
+var rejectedFrames = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "gowebsockets_rejected_frames_total",
+	Help: "Number of frames rejected before they were handled, by error code.",
+}, []string{"code"})
+
+// Function to build an error frame explaining why a frame was rejected.
+// Parameters:
+// code: string - The machine-readable error code.
+// topic: string - The topic of the rejected frame, or "" if it has none.
+// detail: string - What was wrong with the frame, for humans.
+// Returns:
+// []byte - The JSON encoded frame.
+func errorDetailMessage(code string, topic string, detail string) []byte {
+	frame := map[string]string{"action": "error", "code": code, "detail": detail}
+	if topic != "" {
+		frame["topic"] = topic
+	}
+	message, _ := json.Marshal(frame)
+	return message
+}
+
+// Function to tell a client one of its frames was rejected.
+// Parameters:
+// client: *Client - The client.
+// code: string - The machine-readable error code.
+// topic: string - The topic of the rejected frame, or "".
+// detail: string - What was wrong with the frame.
+func rejectFrame(client *Client, code string, topic string, detail string) {
+	rejectedFrames.WithLabelValues(code).Inc()
+	client.Send(errorDetailMessage(code, topic, detail))
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRejectedFramesGetTypedErrors(t *testing.T) {
+	pubsub := &PubSub{}
+	client, peer := newTestClient(t)
+
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"publish",`))
+	frame := readFrame(t, peer)
+	assert.Equal(t, codeBadPayload, frame["code"])
+	assert.Contains(t, frame["detail"], "unexpected end of JSON input")
+	assert.NotContains(t, frame, "topic", "Frames that cannot be decoded have no topic")
+
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"dance","topic":"chat"}`))
+	assert.JSONEq(t, `{"action":"error","code":"unknown_action","topic":"chat","detail":"unknown action \"dance\""}`, string(mustRead(t, peer)))
+
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"topic":"chat"}`))
+	assert.Equal(t, codeUnknownAction, readFrame(t, peer)["code"], "Frames without an action are rejected")
+}
+
+func TestStrictClientsKeepStrictErrors(t *testing.T) {
+	pubsub := &PubSub{}
+	client, peer := newTestClient(t)
+	client.StrictJSON = true
+
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"publish","topic":"chat","bogus":1}`))
+	frame := readFrame(t, peer)
+	assert.Equal(t, "error", frame["action"])
+	assert.NotEqual(t, codeBadPayload, frame["code"], "Strict endpoints name the rule the frame broke")
+	assert.NotEmpty(t, frame["reason"])
+}
@@ -0,0 +1,151 @@
+// This file expires topics at a time set in their policy, e.g. channels of a one-day
+// event. When a topic expires its subscribers are told, its history is exported to the
+// archive sink, if one is configured, and the topic is deleted.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Frame telling the subscribers of a topic it expired
+const TOPIC_EXPIRED = "topic_expired"
+
+// How long exporting the archive of an expired topic may take
+const archiveTimeout = 30 * time.Second
+
+// TopicArchive is what is kept of an expired topic.
+type TopicArchive struct {
+	Topic     Topic     `json:"topic"`
+	ExpiredAt time.Time `json:"expiredAt"`
+	// The history of the topic, oldest first, encoded as by the json history codec
+	Messages []json.RawMessage `json:"messages"`
+}
+
+// ArchiveSink stores the archives of expired topics.
+type ArchiveSink interface {
+	Archive(ctx context.Context, archive TopicArchive) error
+}
+
+// FileArchive writes every archive as a JSON file in a directory.
+type FileArchive struct {
+	Dir string
+}
+
+// Function to write the archive of a topic to <topic>-<expiry>.json in the directory.
+// Parameters:
+// ctx: context.Context - Unused, files are written at once.
+// archive: TopicArchive - The archive.
+// Returns:
+// error - An error if the file could not be written.
+func (f FileArchive) Archive(ctx context.Context, archive TopicArchive) error {
+	data, err := json.MarshalIndent(archive, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(f.Dir, 0o755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.json", archiveFileName(archive.Topic.Name), archive.ExpiredAt.Format("20060102T150405Z"))
+	return os.WriteFile(filepath.Join(f.Dir, name), data, 0o644)
+}
+
+// Function to make a topic name safe to use in a file name.
+// Parameters:
+// topic: string - The topic.
+// Returns:
+// string - The topic with path separators and other unusual characters replaced by _.
+func archiveFileName(topic string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == '.' || r == '_' || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') {
+			return r
+		}
+		return '_'
+	}, topic)
+}
+
+// Function to schedule the expiry of a topic at the time its policy sets, replacing
+// any earlier schedule. The caller must hold ps.mu.
+// Parameters:
+// topic: *Topic - The topic.
+func (ps *PubSub) scheduleExpiryLocked(topic *Topic) {
+	if topic.expiry != nil {
+		topic.expiry.Stop()
+		topic.expiry = nil
+	}
+	if topic.Policy.ExpiresAt == nil {
+		return
+	}
+	name := topic.Name
+	topic.expiry = time.AfterFunc(time.Until(*topic.Policy.ExpiresAt), func() {
+		if err := ps.ExpireTopic(name); err != nil && !errors.Is(err, errUnknownTopic) {
+			slog.Error("Error expiring topic", logKeyTopic, name, "error", err)
+		}
+	})
+}
+
+// Function to expire a topic: its history is archived, then its subscribers are told
+// with a topic_expired frame and the topic is deleted. The topic is deleted even if
+// archiving failed.
+// Parameters:
+// name: string - The name of the topic.
+// Returns:
+// error - errUnknownTopic if the topic does not exist, or the error archiving it.
+func (ps *PubSub) ExpireTopic(name string) error {
+	ps.mu.Lock()
+	topic, ok := ps.Topics[name]
+	var snapshot Topic
+	if ok {
+		snapshot = *topic
+		snapshot.Grants = map[string]bool{}
+		for principal := range topic.Grants {
+			snapshot.Grants[principal] = true
+		}
+	}
+	ps.mu.Unlock()
+	if !ok {
+		return errUnknownTopic
+	}
+
+	var err error
+	if ps.Archive != nil {
+		err = ps.archiveTopic(snapshot)
+	}
+	if deleteErr := ps.deleteTopic(name, TOPIC_EXPIRED); deleteErr != nil {
+		return deleteErr
+	}
+	slog.Info("Topic expired", logKeyTopic, name)
+	return err
+}
+
+// Function to export the history of a topic to the archive sink.
+// Parameters:
+// topic: Topic - The topic.
+// Returns:
+// error - An error if the history could not be read or the sink failed.
+func (ps *PubSub) archiveTopic(topic Topic) error {
+	archive := TopicArchive{Topic: topic, ExpiredAt: time.Now().UTC(), Messages: []json.RawMessage{}}
+	if ps.History != nil {
+		entries, err := ps.History.Entries(topic.Name)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			data, err := JSONEntryCodec{}.Encode(entry)
+			if err != nil {
+				return err
+			}
+			archive.Messages = append(archive.Messages, data)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), archiveTimeout)
+	defer cancel()
+	return ps.Archive.Archive(ctx, archive)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTopicExpiryArchivesAndDeletes(t *testing.T) {
+	dir := t.TempDir()
+	pubsub := &PubSub{History: NewMemoryHistory(JSONEntryCodec{}, 10), Archive: FileArchive{Dir: dir}}
+	owner, peer := newTestClient(t)
+	owner.Claims = jwt.MapClaims{"sub": "organizer"}
+	pubsub.HandleRecvdMessage(owner, 1, []byte(`{"action":"subscribe","topic":"event/day-1"}`))
+	pubsub.Publish("event/day-1", []byte(`"doors open"`), nil)
+	pubsub.Publish("event/day-1", []byte(`"keynote"`), nil)
+
+	expiresAt := time.Now().Add(50 * time.Millisecond)
+	assert.NoError(t, pubsub.SetTopicPolicy("event/day-1", TopicPolicy{ExpiresAt: &expiresAt}))
+	for _, expected := range []string{`"doors open"`, `"keynote"`, `{"action":"topic_expired","topic":"event/day-1"}`} {
+		_, message, err := peer.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(message))
+	}
+
+	pubsub.mu.Lock()
+	assert.Empty(t, pubsub.Topics, "The expired topic should be deleted")
+	assert.Empty(t, pubsub.Subscriptions())
+	pubsub.mu.Unlock()
+	entries, _ := pubsub.History.Entries("event/day-1")
+	assert.Empty(t, entries)
+
+	files, _ := filepath.Glob(filepath.Join(dir, "event_day-1-*.json"))
+	if assert.Len(t, files, 1) {
+		data, _ := os.ReadFile(files[0])
+		var archive struct {
+			Topic struct {
+				Owner string `json:"owner"`
+			} `json:"topic"`
+			Messages []struct {
+				Message json.RawMessage `json:"message"`
+			} `json:"messages"`
+		}
+		assert.NoError(t, json.Unmarshal(data, &archive))
+		assert.Equal(t, "organizer", archive.Topic.Owner)
+		if assert.Len(t, archive.Messages, 2) {
+			assert.Equal(t, `"keynote"`, string(archive.Messages[1].Message))
+		}
+	}
+}
+
+func TestTopicExpiryCanBeCancelled(t *testing.T) {
+	pubsub := &PubSub{}
+	pubsub.mu.Lock()
+	pubsub.touchTopic("webinar", nil)
+	pubsub.mu.Unlock()
+
+	expiresAt := time.Now().Add(30 * time.Millisecond)
+	assert.NoError(t, pubsub.SetTopicPolicy("webinar", TopicPolicy{ExpiresAt: &expiresAt}))
+	assert.NoError(t, pubsub.SetTopicPolicy("webinar", TopicPolicy{}))
+	time.Sleep(60 * time.Millisecond)
+
+	pubsub.mu.Lock()
+	defer pubsub.mu.Unlock()
+	assert.Contains(t, pubsub.Topics, "webinar", "Clearing the expiry should keep the topic")
+}
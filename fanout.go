@@ -0,0 +1,163 @@
+// This file delivers the messages of topics with many subscribers in parallel. Writing
+// to thousands of subscribers one after the other makes the last wait for all the
+// others, so once a topic has the threshold of subscribers its subscriptions are split
+// into shards delivered by a bounded pool of workers, the publisher delivering a shard
+// itself. The subscriptions of a client always fall in the same shard, and the fan-out
+// of a message ends when every shard was delivered, so each client still gets the
+// messages of a publisher in order. When every worker is busy, the publisher delivers
+// the shards itself, so the pool never grows nor blocks. Outbound interceptors then run
+// concurrently for different clients.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Subscribers of a topic from which its messages are delivered in parallel, by default
+const defaultFanOutThreshold = 1000
+
+// FanOutPool is a bounded pool of workers delivering the shards of large fan-outs.
+type FanOutPool struct {
+	// Subscribers from which the messages of a topic are delivered in parallel
+	Threshold int
+	workers   int
+	jobs      chan func()
+	done      chan struct{}
+	stop      sync.Once
+}
+
+// Function to start a pool of fan-out workers.
+// Parameters:
+// workers: int - The number of workers.
+// threshold: int - The subscribers from which messages are delivered in parallel, the default if 0 or less.
+// Returns:
+// *FanOutPool - The pool; call Stop to end its workers.
+func NewFanOutPool(workers int, threshold int) *FanOutPool {
+	if threshold <= 0 {
+		threshold = defaultFanOutThreshold
+	}
+	pool := &FanOutPool{Threshold: threshold, workers: workers, jobs: make(chan func()), done: make(chan struct{})}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				select {
+				case <-pool.done:
+					return
+				case job := <-pool.jobs:
+					job()
+				}
+			}
+		}()
+	}
+	return pool
+}
+
+// Function to end the workers of the pool. Fan-outs still running deliver their
+// remaining shards themselves.
+func (p *FanOutPool) Stop() {
+	p.stop.Do(func() { close(p.done) })
+}
+
+// Function to check whether the messages of a topic are delivered in parallel.
+// Parameters:
+// subscribers: int - The subscriptions of the topic.
+// Returns:
+// bool - True if the pool is configured and the topic reaches its threshold.
+func (p *FanOutPool) parallel(subscribers int) bool {
+	return p != nil && p.workers > 0 && subscribers >= p.Threshold
+}
+
+// Function to deliver subscriptions in shards, and wait until every shard was delivered.
+// Parameters:
+// subscriptions: []Subscription - The subscriptions.
+// deliver: func(Subscription) - Delivers to a subscription; called concurrently for different clients.
+func (p *FanOutPool) deliver(subscriptions []Subscription, deliver func(Subscription)) {
+	// One shard per threshold of subscribers, for the workers and the publisher
+	count := min(p.workers+1, (len(subscriptions)+p.Threshold-1)/p.Threshold)
+	shards := make([][]Subscription, max(count, 1))
+	for _, sub := range subscriptions {
+		shard := shardOf(sub.Client.Id, len(shards))
+		shards[shard] = append(shards[shard], sub)
+	}
+
+	var wg sync.WaitGroup
+	for _, shard := range shards[1:] {
+		job := func() {
+			defer wg.Done()
+			for _, sub := range shard {
+				deliver(sub)
+			}
+		}
+		wg.Add(1)
+		select {
+		case p.jobs <- job:
+		default:
+			job()
+		}
+	}
+	for _, sub := range shards[0] {
+		deliver(sub)
+	}
+	wg.Wait()
+}
+
+// Function to get the shard of a key, e.g. the ID of a client or a topic.
+// Parameters:
+// key: string - The key.
+// shards: int - The number of shards.
+// Returns:
+// int - The shard, always the same for a key.
+func shardOf(key string, shards int) int {
+	// FNV-1a, inlined so publishing does not allocate
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return int(hash % uint32(shards))
+}
+
+// A message being delivered to the subscriptions of its topic. The envelope and the
+// decoded document are built once, by the first delivery needing them, whichever
+// goroutine it runs on.
+type publication struct {
+	ctx     context.Context
+	span    trace.Span
+	id      string
+	topic   string
+	payload *Payload
+
+	envelopeOnce sync.Once
+	enveloped    *Payload
+	decodeOnce   sync.Once
+	document     interface{}
+	decodable    bool
+}
+
+// Function to get the payload wrapped in an envelope carrying its ID.
+// Returns:
+// *Payload - The enveloped payload, shared by every subscription asking for it.
+func (p *publication) envelope() *Payload {
+	p.envelopeOnce.Do(func() {
+		p.enveloped = NewPayload(envelopeMessage(p.id, p.topic, p.payload.Data, traceCarrier(p.ctx), publisherFrom(p.ctx), replyFrom(p.ctx)))
+		p.enveloped.uncaptured = p.payload.uncaptured
+		p.enveloped.undeflated = p.payload.undeflated
+	})
+	return p.enveloped
+}
+
+// Function to check whether the message passes the filter of a subscription.
+// Parameters:
+// filter: *Filter - The filter.
+// Returns:
+// bool - True if the message is a JSON document the filter matches.
+func (p *publication) matches(filter *Filter) bool {
+	p.decodeOnce.Do(func() {
+		p.decodable = !p.payload.Binary && json.Unmarshal(p.payload.Data, &p.document) == nil
+	})
+	return p.decodable && filter.matchesDocument(p.document)
+}
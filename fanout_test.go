@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFanOutPoolDeliversEverySubscriptionOnce(t *testing.T) {
+	pool := NewFanOutPool(4, 10)
+	t.Cleanup(pool.Stop)
+	var subscriptions []Subscription
+	for i := 0; i < 100; i++ {
+		client := &Client{Id: fmt.Sprint("client-", i)}
+		// Two subscriptions per client, e.g. to a topic and a matching wildcard
+		subscriptions = append(subscriptions, Subscription{Topic: "feed", Client: client}, Subscription{Topic: "feed.*", Client: client})
+	}
+
+	var mu sync.Mutex
+	delivered := map[string][]string{}
+	pool.deliver(subscriptions, func(sub Subscription) {
+		mu.Lock()
+		defer mu.Unlock()
+		delivered[sub.Client.Id] = append(delivered[sub.Client.Id], sub.Topic)
+	})
+	assert.Len(t, delivered, 100)
+	for id, topics := range delivered {
+		assert.Equal(t, []string{"feed", "feed.*"}, topics, "The subscriptions of %s are delivered in order, once", id)
+	}
+}
+
+func TestFanOutPoolKeepsOrderOfEachClient(t *testing.T) {
+	pubsub := &PubSub{FanOut: NewFanOutPool(4, 8)}
+	t.Cleanup(pubsub.FanOut.Stop)
+	recorders := make([]*orderRecorder, 64)
+	for i := range recorders {
+		recorders[i] = &orderRecorder{}
+		pubsub.Subscribe(&Client{Id: fmt.Sprint("client-", i), Transport: recorders[i]}, "feed")
+	}
+	assert.True(t, pubsub.FanOut.parallel(len(recorders)))
+
+	var want []string
+	for i := 0; i < 50; i++ {
+		message := fmt.Sprint(i)
+		pubsub.Publish("feed", []byte(message), nil)
+		want = append(want, message)
+	}
+	for i, recorder := range recorders {
+		assert.Equal(t, want, recorder.messages, "Client %d gets the messages in the order they were published", i)
+	}
+}
+
+func TestFanOutPoolThreshold(t *testing.T) {
+	var pool *FanOutPool
+	assert.False(t, pool.parallel(1_000_000), "Without a pool messages are delivered one subscriber after the other")
+	pool = NewFanOutPool(2, 0)
+	t.Cleanup(pool.Stop)
+	assert.Equal(t, defaultFanOutThreshold, pool.Threshold)
+	assert.False(t, pool.parallel(defaultFanOutThreshold-1))
+	assert.True(t, pool.parallel(defaultFanOutThreshold))
+}
+
+func TestStoppedFanOutPoolStillDelivers(t *testing.T) {
+	pool := NewFanOutPool(2, 1)
+	pool.Stop()
+	pool.Stop()
+	count := 0
+	pool.deliver([]Subscription{{Client: &Client{Id: "a"}}, {Client: &Client{Id: "b"}}, {Client: &Client{Id: "c"}}}, func(Subscription) { count++ })
+	assert.Equal(t, 3, count, "The publisher delivers the shards no worker takes")
+}
+
+func TestShardOf(t *testing.T) {
+	assert.Equal(t, shardOf("client-1", 8), shardOf("client-1", 8))
+	for i := 0; i < 100; i++ {
+		shard := shardOf(fmt.Sprint("client-", i), 3)
+		assert.True(t, shard >= 0 && shard < 3)
+	}
+}
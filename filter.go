@@ -0,0 +1,478 @@
+// This file implements the filters a subscription may carry so that it only receives
+// the messages it wants, e.g. {"action":"subscribe","topic":"orders","filter":"region == 'EU' AND total >= 100"}.
+// A filter is a simple SQL-like selector on the fields of JSON messages: comparisons of a
+// field with a string, number, true, false or null literal (==, =, !=, <>, <, <=, >, >=,
+// IN (...)), a field alone testing it is present and neither false nor null, combined
+// with AND, OR, NOT (or &&, ||, !) and parentheses. Fields are dotted paths into the
+// message, optionally starting with payload. or the JSONPath root $., and index arrays
+// with numbers, e.g. payload.items.0.sku. A comparison with a missing field is false, and
+// messages that are not JSON match no filter.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Longest filter a subscription may carry
+const maxFilterLength = 1024
+
+// Filter selects the messages delivered to a subscription.
+type Filter struct {
+	// The expression the filter was parsed from
+	Source string
+	root   filterNode
+}
+
+// filterNode is a node of the expression of a filter.
+type filterNode interface {
+	eval(document interface{}) bool
+}
+
+// Function to parse a filter expression.
+// Parameters:
+// source: string - The expression, or "" for none.
+// Returns:
+// *Filter - The filter, or nil if the expression is empty.
+// error - An error if the expression is invalid.
+func ParseFilter(source string) (*Filter, error) {
+	if strings.TrimSpace(source) == "" {
+		return nil, nil
+	}
+	if len(source) > maxFilterLength {
+		return nil, fmt.Errorf("filter is longer than %d bytes", maxFilterLength)
+	}
+	tokens, err := tokenizeFilter(source)
+	if err != nil {
+		return nil, err
+	}
+	parser := &filterParser{tokens: tokens}
+	root, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if !parser.done() {
+		return nil, fmt.Errorf("unexpected %q in filter", parser.peek().text)
+	}
+	return &Filter{Source: source, root: root}, nil
+}
+
+// Function to check whether a message passes the filter.
+// Parameters:
+// message: []byte - The JSON message.
+// Returns:
+// bool - True if the filter is nil or selects the message.
+func (f *Filter) Matches(message []byte) bool {
+	if f == nil {
+		return true
+	}
+	var document interface{}
+	if err := json.Unmarshal(message, &document); err != nil {
+		return false
+	}
+	return f.root.eval(document)
+}
+
+// Function to check whether a decoded message passes the filter.
+// Parameters:
+// document: interface{} - The decoded message.
+// Returns:
+// bool - True if the filter is nil or selects the message.
+func (f *Filter) matchesDocument(document interface{}) bool {
+	return f == nil || f.root.eval(document)
+}
+
+// Kinds of the tokens of a filter
+const (
+	filterIdent = iota
+	filterString
+	filterNumber
+	filterOperator
+)
+
+// filterToken is a token of a filter expression.
+type filterToken struct {
+	kind int
+	text string
+}
+
+// Function to split a filter expression into tokens.
+// Parameters:
+// source: string - The expression.
+// Returns:
+// []filterToken - The tokens.
+// error - An error if the expression holds an unterminated string or an unknown character.
+func tokenizeFilter(source string) ([]filterToken, error) {
+	var tokens []filterToken
+	runes := []rune(source)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '\'' || r == '"':
+			var text strings.Builder
+			j := i + 1
+			for ; j < len(runes) && runes[j] != r; j++ {
+				if runes[j] == '\\' && j+1 < len(runes) {
+					j++
+				}
+				text.WriteRune(runes[j])
+			}
+			if j == len(runes) {
+				return nil, fmt.Errorf("unterminated string in filter")
+			}
+			tokens = append(tokens, filterToken{filterString, text.String()})
+			i = j + 1
+		case unicode.IsDigit(r) || r == '-' && i+1 < len(runes) && unicode.IsDigit(runes[i+1]):
+			j := i + 1
+			for j < len(runes) && (unicode.IsDigit(runes[j]) || strings.ContainsRune(".eE+-", runes[j])) {
+				j++
+			}
+			tokens = append(tokens, filterToken{filterNumber, string(runes[i:j])})
+			i = j
+		case unicode.IsLetter(r) || r == '_' || r == '$':
+			j := i + 1
+			for j < len(runes) && (unicode.IsLetter(runes[j]) || unicode.IsDigit(runes[j]) || strings.ContainsRune("_.$", runes[j])) {
+				j++
+			}
+			tokens = append(tokens, filterToken{filterIdent, string(runes[i:j])})
+			i = j
+		default:
+			operator := ""
+			for _, candidate := range []string{"==", "!=", "<>", "<=", ">=", "&&", "||", "=", "<", ">", "!", "(", ")", ","} {
+				if strings.HasPrefix(string(runes[i:min(i+2, len(runes))]), candidate) {
+					operator = candidate
+					break
+				}
+			}
+			if operator == "" {
+				return nil, fmt.Errorf("unexpected %q in filter", r)
+			}
+			tokens = append(tokens, filterToken{filterOperator, operator})
+			i += len(operator)
+		}
+	}
+	return tokens, nil
+}
+
+// filterParser parses the tokens of a filter by recursive descent.
+type filterParser struct {
+	tokens []filterToken
+	next   int
+}
+
+// Function to check whether every token was parsed.
+func (p *filterParser) done() bool {
+	return p.next >= len(p.tokens)
+}
+
+// Function to look at the next token without consuming it.
+func (p *filterParser) peek() filterToken {
+	if p.done() {
+		return filterToken{}
+	}
+	return p.tokens[p.next]
+}
+
+// Function to consume the next token if it is an operator or keyword.
+// Parameters:
+// words: ...string - The operators or keywords, keywords matched in any case.
+// Returns:
+// bool - True if the next token was one of them and was consumed.
+func (p *filterParser) accept(words ...string) bool {
+	token := p.peek()
+	if token.kind != filterOperator && token.kind != filterIdent {
+		return false
+	}
+	for _, word := range words {
+		if token.text == word || token.kind == filterIdent && strings.EqualFold(token.text, word) {
+			p.next++
+			return true
+		}
+	}
+	return false
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	left, err := p.parseAnd()
+	for err == nil && p.accept("||", "OR") {
+		var right filterNode
+		if right, err = p.parseAnd(); err == nil {
+			left = filterOr{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	left, err := p.parseNot()
+	for err == nil && p.accept("&&", "AND") {
+		var right filterNode
+		if right, err = p.parseNot(); err == nil {
+			left = filterAnd{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *filterParser) parseNot() (filterNode, error) {
+	if p.accept("!", "NOT") {
+		operand, err := p.parseNot()
+		return filterNot{operand}, err
+	}
+	if p.accept("(") {
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, fmt.Errorf("missing ) in filter")
+		}
+		return node, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *filterParser) parseComparison() (filterNode, error) {
+	token := p.peek()
+	if token.kind != filterIdent || isFilterKeyword(token.text) {
+		return nil, fmt.Errorf("expected a field in filter, got %q", token.text)
+	}
+	p.next++
+	path := filterPath(token.text)
+	if p.accept("IN") {
+		if !p.accept("(") {
+			return nil, fmt.Errorf("expected ( after IN in filter")
+		}
+		var values []interface{}
+		for {
+			value, err := p.parseLiteral()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+			if p.accept(")") {
+				return filterIn{path, values}, nil
+			}
+			if !p.accept(",") {
+				return nil, fmt.Errorf("expected , or ) in IN list of filter")
+			}
+		}
+	}
+	for _, operator := range []string{"==", "=", "!=", "<>", "<=", ">=", "<", ">"} {
+		if p.accept(operator) {
+			value, err := p.parseLiteral()
+			if err != nil {
+				return nil, err
+			}
+			return filterComparison{path, operator, value}, nil
+		}
+	}
+	return filterPresent{path}, nil
+}
+
+func (p *filterParser) parseLiteral() (interface{}, error) {
+	token := p.peek()
+	p.next++
+	switch token.kind {
+	case filterString:
+		return token.text, nil
+	case filterNumber:
+		number, err := strconv.ParseFloat(token.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q in filter", token.text)
+		}
+		return number, nil
+	case filterIdent:
+		switch strings.ToLower(token.text) {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+	}
+	return nil, fmt.Errorf("expected a value in filter, got %q", token.text)
+}
+
+// Function to check whether an identifier is a keyword of filters rather than a field.
+func isFilterKeyword(word string) bool {
+	switch strings.ToUpper(word) {
+	case "AND", "OR", "NOT", "IN", "TRUE", "FALSE", "NULL":
+		return true
+	}
+	return false
+}
+
+// Function to split the path of a field into its segments.
+// Parameters:
+// path: string - The dotted path, optionally starting with payload. or $.
+// Returns:
+// []string - The segments.
+func filterPath(path string) []string {
+	for _, root := range []string{"$.", "payload."} {
+		path = strings.TrimPrefix(path, root)
+	}
+	if path == "$" || path == "payload" {
+		return nil
+	}
+	return strings.Split(path, ".")
+}
+
+// Function to look up a field of a decoded message.
+// Parameters:
+// document: interface{} - The decoded message.
+// path: []string - The segments of the path of the field.
+// Returns:
+// interface{} - The value of the field.
+// bool - False if the message has no such field.
+func lookupField(document interface{}, path []string) (interface{}, bool) {
+	value := document
+	for _, segment := range path {
+		switch container := value.(type) {
+		case map[string]interface{}:
+			item, ok := container[segment]
+			if !ok {
+				return nil, false
+			}
+			value = item
+		case []interface{}:
+			index, err := strconv.Atoi(segment)
+			if err != nil || index < 0 || index >= len(container) {
+				return nil, false
+			}
+			value = container[index]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+type filterOr struct{ left, right filterNode }
+
+func (n filterOr) eval(document interface{}) bool {
+	return n.left.eval(document) || n.right.eval(document)
+}
+
+type filterAnd struct{ left, right filterNode }
+
+func (n filterAnd) eval(document interface{}) bool {
+	return n.left.eval(document) && n.right.eval(document)
+}
+
+type filterNot struct{ operand filterNode }
+
+func (n filterNot) eval(document interface{}) bool {
+	return !n.operand.eval(document)
+}
+
+type filterPresent struct{ path []string }
+
+func (n filterPresent) eval(document interface{}) bool {
+	value, ok := lookupField(document, n.path)
+	return ok && value != nil && value != false
+}
+
+type filterIn struct {
+	path   []string
+	values []interface{}
+}
+
+func (n filterIn) eval(document interface{}) bool {
+	value, ok := lookupField(document, n.path)
+	if !ok {
+		return false
+	}
+	for _, candidate := range n.values {
+		if compareFilterValues(value, candidate) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+type filterComparison struct {
+	path     []string
+	operator string
+	value    interface{}
+}
+
+func (n filterComparison) eval(document interface{}) bool {
+	value, ok := lookupField(document, n.path)
+	if !ok {
+		return false
+	}
+	order := compareFilterValues(value, n.value)
+	switch n.operator {
+	case "==", "=":
+		return order == 0
+	case "!=", "<>":
+		return order != 0
+	}
+	// Only numbers and strings are ordered
+	if order == filterIncomparable || order == filterUnequal {
+		return false
+	}
+	switch n.operator {
+	case "<":
+		return order < 0
+	case "<=":
+		return order <= 0
+	case ">":
+		return order > 0
+	default:
+		return order >= 0
+	}
+}
+
+// Results of comparing values that are not ordered
+const (
+	// The values are of the same unordered type and differ
+	filterUnequal = 2
+	// The values are of different types
+	filterIncomparable = 3
+)
+
+// Function to compare a field of a message with a literal of a filter.
+// Parameters:
+// value: interface{} - The field.
+// literal: interface{} - The literal.
+// Returns:
+// int - -1, 0 or 1 for ordered values, filterUnequal or filterIncomparable otherwise.
+func compareFilterValues(value interface{}, literal interface{}) int {
+	switch literal := literal.(type) {
+	case float64:
+		if number, ok := value.(float64); ok {
+			switch {
+			case number < literal:
+				return -1
+			case number > literal:
+				return 1
+			}
+			return 0
+		}
+	case string:
+		if text, ok := value.(string); ok {
+			return strings.Compare(text, literal)
+		}
+	case bool:
+		if flag, ok := value.(bool); ok {
+			if flag == literal {
+				return 0
+			}
+			return filterUnequal
+		}
+	case nil:
+		if value == nil {
+			return 0
+		}
+		return filterUnequal
+	}
+	return filterIncomparable
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterMatches(t *testing.T) {
+	message := []byte(`{"region":"EU","total":120,"paid":true,"coupon":null,"items":[{"sku":"A1"}],"customer":{"tier":"gold"}}`)
+	for source, expected := range map[string]bool{
+		`region == "EU"`:                          true,
+		`payload.region = 'EU'`:                   true,
+		`$.region != "EU"`:                        false,
+		`region <> 'US'`:                          true,
+		`total >= 100 AND region == "EU"`:         true,
+		`total > 200 or customer.tier == 'gold'`:  true,
+		`total < 100 || !paid`:                    false,
+		`NOT (region = 'US' OR region = 'UK')`:    true,
+		`region IN ('US', 'EU')`:                  true,
+		`total in (1, 2)`:                         false,
+		`items.0.sku == "A1"`:                     true,
+		`paid`:                                    true,
+		`coupon`:                                  false,
+		`coupon == null`:                          true,
+		`missing != "EU"`:                         false,
+		`region > 10`:                             false,
+		`total == -5 || total == 1.2e2`:           true,
+		`customer.tier == "gold" && paid == true`: true,
+	} {
+		filter, err := ParseFilter(source)
+		assert.NoError(t, err, source)
+		assert.Equal(t, expected, filter.Matches(message), source)
+	}
+	filter, _ := ParseFilter(`region == "EU"`)
+	assert.False(t, filter.Matches([]byte("not json")), "Messages that are not JSON match no filter")
+	assert.True(t, (*Filter)(nil).Matches([]byte("anything")), "No filter selects every message")
+}
+
+func TestParseFilterRejectsInvalidExpressions(t *testing.T) {
+	filter, err := ParseFilter("  ")
+	assert.NoError(t, err)
+	assert.Nil(t, filter)
+	for _, source := range []string{`region ==`, `region == "EU`, `(paid`, `paid paid`, `== 1`, `region # 1`, `region IN 'EU'`, `AND`} {
+		_, err := ParseFilter(source)
+		assert.Error(t, err, source)
+	}
+}
+
+func TestSubscriptionFilterSelectsMessages(t *testing.T) {
+	pubsub := &PubSub{}
+	client, peer := newTestClient(t)
+
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"orders","filter":"payload.region == \"EU\""}`))
+	pubsub.Publish("orders", []byte(`{"region":"US","id":1}`), nil)
+	pubsub.Publish("orders", []byte(`{"region":"EU","id":2}`), nil)
+	assert.JSONEq(t, `{"region":"EU","id":2}`, string(mustRead(t, peer)), "Messages the filter excludes are not delivered")
+
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"subscriptions"}`))
+	assert.Contains(t, string(mustRead(t, peer)), `"filter":"payload.region == \"EU\""`)
+
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"orders","filter":"region =="}`))
+	assert.Equal(t, "invalid_filter", readFrame(t, peer)["code"])
+}
+
+func TestSubscriptionFilterOutlivesConnection(t *testing.T) {
+	sessions := NewSessionStore(time.Minute)
+	pubsub := &PubSub{Sessions: sessions}
+	sessions.suspend("token", &suspendedSession{clientId: "phone", subscriptions: []StoredSubscription{
+		{Topic: "orders", Lifetime: LifetimeSession, Filter: `region == "EU"`},
+	}})
+	pubsub.Publish("orders", []byte(`{"region":"US"}`), nil)
+	pubsub.Publish("orders", []byte(`{"region":"EU"}`), nil)
+
+	client, peer := newTestClient(t)
+	client.Session = NewSession("test")
+	resumed := pubsub.resumeSession(&client, "token")
+	assert.Len(t, resumed.queued, 1, "Messages the filter excludes are not queued")
+	pubsub.AddClient(client)
+	pubsub.restoreSession(&client, resumed)
+	assert.Equal(t, SUBSCRIBED, readFrame(t, peer)["action"])
+	assert.JSONEq(t, `{"region":"EU"}`, string(mustRead(t, peer)))
+
+	pubsub.Publish("orders", []byte(`{"region":"US"}`), nil)
+	pubsub.Publish("orders", []byte(`{"region":"EU","n":2}`), nil)
+	assert.JSONEq(t, `{"region":"EU","n":2}`, string(mustRead(t, peer)), "Restored subscriptions keep their filter")
+}
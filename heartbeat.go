@@ -0,0 +1,64 @@
+// This file implements server-side heartbeats: the server pings every client at its
+// heartbeat interval and drops the connection when pongs stop arriving, so half-open
+// connections are reaped instead of lingering with their subscriptions.
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// How many heartbeats may pass without a pong before the connection is considered dead
+const missedPongs = 2
+
+// Function to start pinging a client and arm the read deadline its pongs extend.
+// Parameters:
+// client: *Client - The client, connected over a WebSocket.
+// interval: time.Duration - The time between pings.
+// Returns:
+// func() - Stops the pings.
+func startHeartbeat(client *Client, interval time.Duration) func() {
+	conn := client.Connection
+	pongWait := readWait(client.options().readTimeout, interval)
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(interval)); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// Function to get the heartbeat interval of a client.
+// Returns:
+// time.Duration - The interval, or 0 when heartbeats are disabled.
+func (limits Limits) heartbeat() time.Duration {
+	return time.Duration(limits.HeartbeatInterval) * time.Millisecond
+}
+
+// Function to check whether a read failed because the heartbeat deadline passed.
+// Parameters:
+// err: error - The error returned by the read.
+// Returns:
+// bool - True if no pong or message arrived in time.
+func isHeartbeatTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
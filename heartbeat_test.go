@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// dialWithHeartbeat connects to a test server whose clients are pinged every 50ms.
+func dialWithHeartbeat(t *testing.T) (*websocket.Conn, string) {
+	options := isolatePubSub(t)
+	options.defaultLimits = Limits{HeartbeatInterval: 50}
+
+	server := httptest.NewServer(http.HandlerFunc(ps.webSocketHandler))
+	t.Cleanup(server.Close)
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+
+	var welcome welcomeFrame
+	_, data, err := ws.ReadMessage()
+	assert.NoError(t, err)
+	json.Unmarshal(data, &welcome)
+	return ws, welcome.ClientId
+}
+
+func isConnected(id string) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for _, client := range ps.Clients() {
+		if client.Id == id {
+			return true
+		}
+	}
+	return false
+}
+
+func TestHeartbeatReapsDeadConnections(t *testing.T) {
+	ws, id := dialWithHeartbeat(t)
+	assert.True(t, isConnected(id))
+
+	// Swallow pings as a half-open connection would
+	ws.SetPingHandler(func(string) error { return nil })
+	_, _, err := ws.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, CloseIdleTimeout), "The server should close with the heartbeat timeout code")
+	assert.Eventually(t, func() bool { return !isConnected(id) }, time.Second, 10*time.Millisecond,
+		"The dead client should be removed")
+}
+
+func TestHeartbeatKeepsAnsweringClients(t *testing.T) {
+	ws, id := dialWithHeartbeat(t)
+
+	// The default ping handler answers with pongs while the client reads
+	ws.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	_, _, err := ws.ReadMessage()
+	assert.True(t, isHeartbeatTimeout(err), "Nothing but pings should arrive")
+	assert.True(t, isConnected(id), "A client answering pings should stay connected")
+}
@@ -0,0 +1,441 @@
+// This file keeps the history of messages published to each topic, with the last
+// entry of a topic being its retained message. Entries are stored encoded by a
+// pluggable codec so stores stay readable by external tools and can evolve.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// HistoryEntry is a message published to a topic as kept in the history.
+type HistoryEntry struct {
+	Id          string
+	Topic       string
+	Sequence    uint64
+	Timestamp   time.Time
+	ContentType string
+	Payload     []byte
+}
+
+// EntryCodec encodes history entries for storage.
+type EntryCodec interface {
+	Name() string
+	Encode(entry HistoryEntry) ([]byte, error)
+	Decode(data []byte) (HistoryEntry, error)
+}
+
+const (
+	contentTypeJSON   = "application/json"
+	contentTypeBinary = "application/octet-stream"
+
+	// Version written by the JSON codec; decoders accept older versions and ignore unknown fields
+	jsonEntryVersion = 1
+)
+
+// Registry of the codecs that can be selected by name
+var entryCodecs = map[string]EntryCodec{}
+
+// Function to make a codec selectable by its name.
+// Parameters:
+// codec: EntryCodec - The codec to register.
+func RegisterEntryCodec(codec EntryCodec) {
+	entryCodecs[codec.Name()] = codec
+}
+
+// Function to look up a registered codec.
+// Parameters:
+// name: string - The name of the codec, e.g. "json", "protobuf" or "raw".
+// Returns:
+// EntryCodec - The codec.
+// error - An error if no codec with that name is registered.
+func GetEntryCodec(name string) (EntryCodec, error) {
+	codec, ok := entryCodecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown history codec %q", name)
+	}
+	return codec, nil
+}
+
+func init() {
+	RegisterEntryCodec(JSONEntryCodec{})
+	RegisterEntryCodec(ProtobufEntryCodec{})
+	RegisterEntryCodec(RawEntryCodec{})
+}
+
+// JSONEntryCodec stores entries as JSON documents. JSON payloads are embedded as is,
+// any other payload is base64 encoded.
+type JSONEntryCodec struct{}
+
+type jsonEntry struct {
+	Version     int             `json:"v"`
+	Id          string          `json:"id,omitempty"`
+	Topic       string          `json:"topic"`
+	Sequence    uint64          `json:"seq"`
+	Timestamp   time.Time       `json:"ts"`
+	ContentType string          `json:"contentType"`
+	Message     json.RawMessage `json:"message,omitempty"`
+	Data        []byte          `json:"data,omitempty"`
+}
+
+func (JSONEntryCodec) Name() string { return "json" }
+
+func (JSONEntryCodec) Encode(entry HistoryEntry) ([]byte, error) {
+	record := jsonEntry{
+		Version:     jsonEntryVersion,
+		Id:          entry.Id,
+		Topic:       entry.Topic,
+		Sequence:    entry.Sequence,
+		Timestamp:   entry.Timestamp,
+		ContentType: entry.ContentType,
+	}
+	if entry.ContentType == contentTypeJSON {
+		record.Message = entry.Payload
+	} else {
+		record.Data = entry.Payload
+	}
+	return json.Marshal(record)
+}
+
+func (JSONEntryCodec) Decode(data []byte) (HistoryEntry, error) {
+	var record jsonEntry
+	if err := json.Unmarshal(data, &record); err != nil {
+		return HistoryEntry{}, err
+	}
+	entry := HistoryEntry{
+		Id:          record.Id,
+		Topic:       record.Topic,
+		Sequence:    record.Sequence,
+		Timestamp:   record.Timestamp,
+		ContentType: record.ContentType,
+		Payload:     record.Data,
+	}
+	if record.Message != nil {
+		entry.Payload = record.Message
+	}
+	return entry, nil
+}
+
+// ProtobufEntryCodec stores entries in the protobuf wire format of this schema:
+//
+//	message HistoryEntry {
+//	  string topic = 1;
+//	  uint64 sequence = 2;
+//	  int64 timestamp_unix_nano = 3;
+//	  string content_type = 4;
+//	  bytes payload = 5;
+//	  string id = 6;
+//	}
+//
+// Unknown fields are skipped when decoding, so fields can be added without breaking
+// existing stores.
+type ProtobufEntryCodec struct{}
+
+func (ProtobufEntryCodec) Name() string { return "protobuf" }
+
+func (ProtobufEntryCodec) Encode(entry HistoryEntry) ([]byte, error) {
+	var data []byte
+	data = protowire.AppendTag(data, 1, protowire.BytesType)
+	data = protowire.AppendString(data, entry.Topic)
+	data = protowire.AppendTag(data, 2, protowire.VarintType)
+	data = protowire.AppendVarint(data, entry.Sequence)
+	data = protowire.AppendTag(data, 3, protowire.VarintType)
+	data = protowire.AppendVarint(data, uint64(entry.Timestamp.UnixNano()))
+	data = protowire.AppendTag(data, 4, protowire.BytesType)
+	data = protowire.AppendString(data, entry.ContentType)
+	data = protowire.AppendTag(data, 5, protowire.BytesType)
+	data = protowire.AppendBytes(data, entry.Payload)
+	if entry.Id != "" {
+		data = protowire.AppendTag(data, 6, protowire.BytesType)
+		data = protowire.AppendString(data, entry.Id)
+	}
+	return data, nil
+}
+
+func (ProtobufEntryCodec) Decode(data []byte) (HistoryEntry, error) {
+	var entry HistoryEntry
+	for len(data) > 0 {
+		number, wireType, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return HistoryEntry{}, protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		switch {
+		case number == 1 && wireType == protowire.BytesType:
+			var topic string
+			topic, n = protowire.ConsumeString(data)
+			entry.Topic = topic
+		case number == 2 && wireType == protowire.VarintType:
+			entry.Sequence, n = protowire.ConsumeVarint(data)
+		case number == 3 && wireType == protowire.VarintType:
+			var nanos uint64
+			nanos, n = protowire.ConsumeVarint(data)
+			entry.Timestamp = time.Unix(0, int64(nanos))
+		case number == 4 && wireType == protowire.BytesType:
+			var contentType string
+			contentType, n = protowire.ConsumeString(data)
+			entry.ContentType = contentType
+		case number == 5 && wireType == protowire.BytesType:
+			var payload []byte
+			payload, n = protowire.ConsumeBytes(data)
+			entry.Payload = append([]byte{}, payload...)
+		case number == 6 && wireType == protowire.BytesType:
+			var id string
+			id, n = protowire.ConsumeString(data)
+			entry.Id = id
+		default:
+			n = protowire.ConsumeFieldValue(number, wireType, data)
+		}
+		if n < 0 {
+			return HistoryEntry{}, protowire.ParseError(n)
+		}
+		data = data[n:]
+	}
+	return entry, nil
+}
+
+// RawEntryCodec stores the payload as raw bytes after a MIME style header block
+// carrying the content type and the entry metadata, e.g.
+//
+//	Content-Type: application/json
+//	Message-Id: 3f1c...
+//	Topic: news
+//	Sequence: 42
+//	Timestamp: 2024-01-02T15:04:05.999999999Z
+//
+//	{"headline":"..."}
+type RawEntryCodec struct{}
+
+func (RawEntryCodec) Name() string { return "raw" }
+
+func (RawEntryCodec) Encode(entry HistoryEntry) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Content-Type: %s\r\n", entry.ContentType)
+	if entry.Id != "" {
+		fmt.Fprintf(&buf, "Message-Id: %s\r\n", entry.Id)
+	}
+	fmt.Fprintf(&buf, "Topic: %s\r\n", strconv.Quote(entry.Topic))
+	fmt.Fprintf(&buf, "Sequence: %d\r\n", entry.Sequence)
+	fmt.Fprintf(&buf, "Timestamp: %s\r\n\r\n", entry.Timestamp.Format(time.RFC3339Nano))
+	buf.Write(entry.Payload)
+	return buf.Bytes(), nil
+}
+
+func (RawEntryCodec) Decode(data []byte) (HistoryEntry, error) {
+	reader := bufio.NewReader(bytes.NewReader(data))
+	header, err := textproto.NewReader(reader).ReadMIMEHeader()
+	if err != nil {
+		return HistoryEntry{}, err
+	}
+	payload, err := io.ReadAll(reader)
+	if err != nil {
+		return HistoryEntry{}, err
+	}
+
+	entry := HistoryEntry{Id: header.Get("Message-Id"), ContentType: header.Get("Content-Type"), Payload: payload}
+	if entry.Topic, err = strconv.Unquote(header.Get("Topic")); err != nil {
+		return HistoryEntry{}, errors.New("raw history entry has an invalid Topic header")
+	}
+	if entry.Sequence, err = strconv.ParseUint(header.Get("Sequence"), 10, 64); err != nil {
+		return HistoryEntry{}, err
+	}
+	if entry.Timestamp, err = time.Parse(time.RFC3339Nano, header.Get("Timestamp")); err != nil {
+		return HistoryEntry{}, err
+	}
+	return entry, nil
+}
+
+// An encoded entry remembers its codec and compression so entries written before
+// either was changed can still be read.
+type storedEntry struct {
+	Codec       string
+	Compression string
+	Data        []byte
+}
+
+// Function to decompress and decode a stored entry.
+// Returns:
+// HistoryEntry - The entry.
+// error - An error if its codec or compression is unknown or the data is corrupt.
+func (s storedEntry) decode() (HistoryEntry, error) {
+	codec, err := GetEntryCodec(s.Codec)
+	if err != nil {
+		return HistoryEntry{}, err
+	}
+	data := s.Data
+	if s.Compression != "" {
+		compressor, err := GetCompressor(s.Compression)
+		if err != nil {
+			return HistoryEntry{}, err
+		}
+		if data, err = compressor.Decompress(data); err != nil {
+			return HistoryEntry{}, err
+		}
+	}
+	return codec.Decode(data)
+}
+
+// MemoryHistory keeps the last Limit entries of every topic in memory, or as many as
+// the retention tier of the topic allows when a retention policy is set.
+type MemoryHistory struct {
+	Codec     EntryCodec
+	Limit     int
+	Retention *RetentionPolicy
+	// Codecs compressing the entries of matching topics
+	Compression []CompressionRule
+	// Tiers configured for single topics, overriding Retention
+	tiers    map[string]RetentionTier
+	topics   map[string][]storedEntry
+	sequence uint64
+	mu       sync.Mutex
+}
+
+// Function to create an in-memory history.
+// Parameters:
+// codec: EntryCodec - The codec used to encode new entries.
+// limit: int - The number of entries kept per topic.
+// Returns:
+// *MemoryHistory - The empty history.
+func NewMemoryHistory(codec EntryCodec, limit int) *MemoryHistory {
+	return &MemoryHistory{Codec: codec, Limit: limit, topics: map[string][]storedEntry{}}
+}
+
+// Function to append a published message to the history of its topic, unless the
+// topic's retention tier keeps nothing.
+// Parameters:
+// id: string - The ID of the message.
+// topic: string - The topic the message was published to.
+// message: []byte - The published message.
+// Returns:
+// HistoryEntry - The entry that was stored.
+// error - An error if the entry could not be encoded.
+func (h *MemoryHistory) Append(id string, topic string, message []byte) (HistoryEntry, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.sequence++
+	entry := HistoryEntry{
+		Id:          id,
+		Topic:       topic,
+		Sequence:    h.sequence,
+		Timestamp:   time.Now().UTC(),
+		ContentType: contentTypeOf(message),
+		Payload:     message,
+	}
+	limit := h.limitLocked(topic)
+	if limit == 0 {
+		return entry, nil
+	}
+	data, err := h.Codec.Encode(entry)
+	if err != nil {
+		return HistoryEntry{}, err
+	}
+
+	stored := storedEntry{Codec: h.Codec.Name(), Data: data}
+	if compressor := compressorFor(h.Compression, topic); compressor != nil {
+		if stored.Data, err = compressor.Compress(data); err != nil {
+			return HistoryEntry{}, err
+		}
+		stored.Compression = compressor.Name()
+	}
+
+	entries := append(h.topics[topic], stored)
+	if limit > 0 && len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+	h.topics[topic] = entries
+	return entry, nil
+}
+
+// Function to get the history of a topic, oldest entry first.
+// Parameters:
+// topic: string - The topic.
+// Returns:
+// []HistoryEntry - The decoded entries.
+// error - An error if an entry could not be decoded.
+func (h *MemoryHistory) Entries(topic string) ([]HistoryEntry, error) {
+	h.mu.Lock()
+	stored := append([]storedEntry{}, h.topics[topic]...)
+	h.mu.Unlock()
+
+	entries := make([]HistoryEntry, 0, len(stored))
+	for _, s := range stored {
+		entry, err := s.decode()
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Function to get the retained message of a topic, which is its latest entry.
+// Parameters:
+// topic: string - The topic.
+// Returns:
+// HistoryEntry - The retained entry.
+// bool - False if nothing was published to the topic.
+// error - An error if the entry could not be decoded.
+func (h *MemoryHistory) Retained(topic string) (HistoryEntry, bool, error) {
+	entries, err := h.Entries(topic)
+	if err != nil || len(entries) == 0 {
+		return HistoryEntry{}, false, err
+	}
+	return entries[len(entries)-1], true, nil
+}
+
+// Function to remove a single message from the history of a topic. If it was the
+// retained message, the previous entry becomes the retained message.
+// Parameters:
+// topic: string - The topic.
+// id: string - The ID of the message.
+// Returns:
+// bool - False if the message is not in the history.
+func (h *MemoryHistory) Redact(topic string, id string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	entries := h.topics[topic]
+	for i, s := range entries {
+		entry, err := s.decode()
+		if err != nil || entry.Id != id {
+			continue
+		}
+		h.topics[topic] = append(entries[:i:i], entries[i+1:]...)
+		return true
+	}
+	return false
+}
+
+// Function to drop the history of a topic.
+// Parameters:
+// topic: string - The topic.
+func (h *MemoryHistory) Delete(topic string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.topics, topic)
+	delete(h.tiers, topic)
+}
+
+// Function to guess the content type of a published message.
+// Parameters:
+// message: []byte - The published message.
+// Returns:
+// string - application/json for valid JSON, application/octet-stream otherwise.
+func contentTypeOf(message []byte) string {
+	if json.Valid(message) {
+		return contentTypeJSON
+	}
+	return contentTypeBinary
+}
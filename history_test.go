@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEntryCodecsRoundTrip(t *testing.T) {
+	entries := []HistoryEntry{
+		{Id: "m1", Topic: "news", Sequence: 42, Timestamp: time.Date(2024, 1, 2, 15, 4, 5, 999, time.UTC), ContentType: contentTypeJSON, Payload: []byte(`{"headline":"hi"}`)},
+		{Topic: "audio feed", Sequence: 7, Timestamp: time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC), ContentType: contentTypeBinary, Payload: []byte{0x00, 0xff, '\r', '\n'}},
+	}
+
+	for _, name := range []string{"json", "protobuf", "raw"} {
+		codec, err := GetEntryCodec(name)
+		assert.NoError(t, err)
+		for _, entry := range entries {
+			data, err := codec.Encode(entry)
+			assert.NoError(t, err)
+			decoded, err := codec.Decode(data)
+			assert.NoError(t, err, "%s codec should decode what it encoded", name)
+			assert.Equal(t, entry.Id, decoded.Id, name)
+			assert.Equal(t, entry.Topic, decoded.Topic, name)
+			assert.Equal(t, entry.Sequence, decoded.Sequence, name)
+			assert.True(t, entry.Timestamp.Equal(decoded.Timestamp), name)
+			assert.Equal(t, entry.ContentType, decoded.ContentType, name)
+			assert.Equal(t, entry.Payload, decoded.Payload, name)
+		}
+	}
+
+	_, err := GetEntryCodec("xml")
+	assert.Error(t, err)
+}
+
+func TestJSONEntryCodecIgnoresUnknownFields(t *testing.T) {
+	entry, err := JSONEntryCodec{}.Decode([]byte(`{"v":2,"topic":"news","seq":3,"ts":"2024-01-02T15:04:05Z","contentType":"application/json","message":{"a":1},"priority":"high"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "news", entry.Topic)
+	assert.Equal(t, []byte(`{"a":1}`), entry.Payload)
+}
+
+func TestMemoryHistoryKeepsLimitAndOldCodecs(t *testing.T) {
+	history := NewMemoryHistory(JSONEntryCodec{}, 2)
+	history.Append(autoId(), "news", []byte(`"one"`))
+	history.Codec = ProtobufEntryCodec{}
+	history.Append(autoId(), "news", []byte(`"two"`))
+	history.Append(autoId(), "news", []byte("three"))
+
+	entries, err := history.Entries("news")
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2, "History should keep only the last Limit entries")
+	assert.Equal(t, []byte(`"two"`), entries[0].Payload)
+	assert.Equal(t, contentTypeBinary, entries[1].ContentType)
+
+	retained, ok, err := history.Retained("news")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(3), retained.Sequence)
+
+	_, ok, _ = history.Retained("sports")
+	assert.False(t, ok)
+}
+
+func TestPublishAppendsToHistory(t *testing.T) {
+	ps := PubSub{History: NewMemoryHistory(RawEntryCodec{}, 10)}
+	ps.Publish("news", []byte(`{"x":1}`), nil)
+
+	entries, err := ps.History.Entries("news")
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, contentTypeJSON, entries[0].ContentType)
+}
+
+func TestMemoryHistoryRedact(t *testing.T) {
+	for _, name := range []string{"json", "protobuf", "raw"} {
+		codec, _ := GetEntryCodec(name)
+		history := NewMemoryHistory(codec, 10)
+		history.Append("m1", "chat", []byte(`"hello"`))
+		history.Append("m2", "chat", []byte(`"spam"`))
+
+		assert.True(t, history.Redact("chat", "m2"), name)
+		assert.False(t, history.Redact("chat", "m2"), name)
+
+		retained, ok, err := history.Retained("chat")
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, "m1", retained.Id, "%s: the previous entry should become the retained message", name)
+	}
+}
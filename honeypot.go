@@ -0,0 +1,106 @@
+// This file decides how the server answers actions a client is not authorized to
+// perform. Besides refusing them with an error, it can drop them silently or record
+// them on a honeypot topic the security team watches, so probing is visible without
+// telling the client it was noticed.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// UnauthorizedPolicy is how the server answers an unauthorized action.
+type UnauthorizedPolicy string
+
+const (
+	// Refuse the action with a forbidden error
+	RejectUnauthorized UnauthorizedPolicy = "reject"
+	// Ignore the action without answering
+	DropUnauthorized UnauthorizedPolicy = "drop"
+	// Ignore the action without answering and record it on the honeypot topic
+	HoneypotUnauthorized UnauthorizedPolicy = "honeypot"
+)
+
+// Frame recording an unauthorized action on the honeypot topic
+const UNAUTHORIZED = "unauthorized"
+
+var unauthorizedActions = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "gowebsockets_unauthorized_actions_total",
+	Help: "Number of actions refused because the client was not authorized, by policy and action.",
+}, []string{"policy", "action"})
+
+// Function to parse an unauthorized policy.
+// Parameters:
+// value: string - reject, drop or honeypot.
+// Returns:
+// UnauthorizedPolicy - The policy.
+// error - An error if the value names no policy.
+func ParseUnauthorizedPolicy(value string) (UnauthorizedPolicy, error) {
+	switch policy := UnauthorizedPolicy(value); policy {
+	case RejectUnauthorized, DropUnauthorized, HoneypotUnauthorized:
+		return policy, nil
+	}
+	return "", fmt.Errorf("invalid unauthorized_policy %q", value)
+}
+
+// Function to answer an action the client is not authorized to perform, as the
+// unauthorized policy says.
+// Parameters:
+// client: *Client - The client that sent the action.
+// m: Message - The action.
+func (ps *PubSub) refuse(client *Client, m Message) {
+	if ps.recordRefusal(client, m) {
+		client.Send(forbiddenMessage(m.Action, m.Topic))
+	}
+}
+
+// Function to record an action the client is not authorized to perform, as the
+// unauthorized policy says.
+// Parameters:
+// client: *Client - The client that sent the action.
+// m: Message - The action.
+// Returns:
+// bool - True if the client is to be told the action is forbidden.
+func (ps *PubSub) recordRefusal(client *Client, m Message) bool {
+	options := ps.options()
+	policy := options.unauthorizedPolicy
+	unauthorizedActions.WithLabelValues(string(policy), m.Action).Inc()
+	client.logger().Info("Refused unauthorized action", logKeyAction, m.Action, logKeyTopic, m.Topic, "policy", policy)
+
+	switch policy {
+	case DropUnauthorized:
+		return false
+	case HoneypotUnauthorized:
+		ps.release(context.Background(), autoId(), options.honeypotTopic, unauthorizedRecord(client, m, time.Now()))
+		return false
+	default:
+		return true
+	}
+}
+
+// Function to build the record of an unauthorized action published on the honeypot topic.
+// Parameters:
+// client: *Client - The client that sent the action.
+// m: Message - The action.
+// at: time.Time - When it was received.
+// Returns:
+// []byte - The JSON encoded record.
+func unauthorizedRecord(client *Client, m Message, at time.Time) []byte {
+	record, _ := json.Marshal(struct {
+		Action    string          `json:"action"`
+		Request   string          `json:"request"`
+		Topic     string          `json:"topic"`
+		ClientId  string          `json:"clientId"`
+		Principal string          `json:"principal,omitempty"`
+		Tenant    string          `json:"tenant,omitempty"`
+		Transport string          `json:"transport"`
+		Message   json.RawMessage `json:"message,omitempty"`
+		At        time.Time       `json:"at"`
+	}{UNAUTHORIZED, m.Action, m.Topic, client.Id, client.Principal(), client.Tenant(), client.transportName(), m.Message, at.UTC()})
+	return record
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseUnauthorizedPolicy(t *testing.T) {
+	for _, value := range []string{"reject", "drop", "honeypot"} {
+		policy, err := ParseUnauthorizedPolicy(value)
+		assert.NoError(t, err)
+		assert.Equal(t, UnauthorizedPolicy(value), policy)
+	}
+	_, err := ParseUnauthorizedPolicy("tarpit")
+	assert.Error(t, err)
+}
+
+// A client scoped to the lobby, sending a publish to another topic
+var unauthorizedPublish = []byte(`{"action":"publish","topic":"admin","message":{"cmd":"drop tables"}}`)
+
+func scopedClient(client Client) Client {
+	client.Claims = jwt.MapClaims{"sub": "mallory", topicsClaim: map[string]interface{}{
+		"publish":   []interface{}{"lobby"},
+		"subscribe": []interface{}{"lobby"},
+	}}
+	return client
+}
+
+func TestUnauthorizedActionIsDropped(t *testing.T) {
+	pubsub := &PubSub{}
+	pubsub.options().unauthorizedPolicy = DropUnauthorized
+	client, peer := newTestClient(t)
+	client = scopedClient(client)
+	before := testutil.ToFloat64(unauthorizedActions.WithLabelValues(string(DropUnauthorized), PUBLISH))
+
+	pubsub.HandleRecvdMessage(client, 1, unauthorizedPublish)
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"who","topic":"lobby"}`))
+
+	// The first frame the client gets answers the who, the publish went unanswered
+	var reply struct {
+		Action string `json:"action"`
+	}
+	assert.NoError(t, peer.ReadJSON(&reply))
+	assert.Equal(t, WHO, reply.Action)
+	assert.Equal(t, before+1, testutil.ToFloat64(unauthorizedActions.WithLabelValues(string(DropUnauthorized), PUBLISH)))
+}
+
+func TestUnauthorizedActionIsRecordedOnTheHoneypot(t *testing.T) {
+	pubsub := &PubSub{}
+	pubsub.options().unauthorizedPolicy = HoneypotUnauthorized
+	security, securityPeer := newTestClient(t)
+	pubsub.Subscribe(&security, pubsub.options().honeypotTopic)
+	client, peer := newTestClient(t)
+	client = scopedClient(client)
+
+	pubsub.HandleRecvdMessage(client, 1, unauthorizedPublish)
+
+	var record struct {
+		Action    string          `json:"action"`
+		Request   string          `json:"request"`
+		Topic     string          `json:"topic"`
+		ClientId  string          `json:"clientId"`
+		Principal string          `json:"principal"`
+		Message   json.RawMessage `json:"message"`
+	}
+	assert.NoError(t, securityPeer.ReadJSON(&record))
+	assert.Equal(t, UNAUTHORIZED, record.Action)
+	assert.Equal(t, PUBLISH, record.Request)
+	assert.Equal(t, "admin", record.Topic)
+	assert.Equal(t, client.Id, record.ClientId)
+	assert.Equal(t, "mallory", record.Principal)
+	assert.JSONEq(t, `{"cmd":"drop tables"}`, string(record.Message))
+
+	peer.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, _, err := peer.ReadMessage()
+	assert.Error(t, err, "The client should not be told its action was refused")
+
+	pubsub.HandleRecvdMessage(security, 1, []byte(`{"action":"publish","topic":"$honeypot","message":"fake"}`))
+	assert.NoError(t, securityPeer.ReadJSON(&record))
+	assert.Equal(t, pubsub.options().honeypotTopic, record.Topic, "Clients should not publish to the honeypot topic")
+}
+
+func TestOnlyAdminsSubscribeToTheHoneypot(t *testing.T) {
+	pubsub := &PubSub{}
+	anonymous, anonymousPeer := newTestClient(t)
+	pubsub.HandleRecvdMessage(anonymous, 1, []byte(`{"action":"subscribe","topic":"$honeypot"}`))
+	assert.JSONEq(t, string(forbiddenMessage(SUBSCRIBE, pubsub.options().honeypotTopic)), string(mustRead(t, anonymousPeer)))
+
+	// A token scoped to the honeypot topic still needs the admin permission
+	scoped, scopedPeer := newTestClient(t)
+	scoped.Claims = jwt.MapClaims{"sub": "mallory", topicsClaim: map[string]interface{}{"subscribe": []interface{}{pubsub.options().honeypotTopic}}}
+	pubsub.HandleRecvdMessage(scoped, 1, []byte(`{"action":"subscribe","topic":"$honeypot"}`))
+	assert.JSONEq(t, string(forbiddenMessage(SUBSCRIBE, pubsub.options().honeypotTopic)), string(mustRead(t, scopedPeer)))
+	assert.Empty(t, pubsub.GetSubscriptions(pubsub.options().honeypotTopic, nil))
+
+	security, _ := newTestClient(t)
+	security.Claims = jwt.MapClaims{permissionsClaim: []interface{}{PermissionSubscribe, PermissionAdmin}}
+	pubsub.HandleRecvdMessage(security, 1, []byte(`{"action":"subscribe","topic":"$honeypot"}`))
+	assert.Len(t, pubsub.GetSubscriptions(pubsub.options().honeypotTopic, nil), 1)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// The fixed workload of the hot path benchmarks, which cmd/perfgate profiles and
+// compares between revisions. Changing it makes earlier results incomparable.
+var (
+	// A chat-sized message and a feed-sized one
+	hotPathSmall    = []byte(`{"user":"alice","text":"hello everyone","ts":1760688000}`)
+	hotPathLarge    = []byte(`{"items":[` + strings.TrimSuffix(strings.Repeat(`{"sku":"A-1042","price":19.99,"qty":3,"tags":["sale","new"]},`, 64), ",") + `]}`)
+	hotPathMessages = []struct {
+		name    string
+		message []byte
+	}{{"small", hotPathSmall}, {"large", hotPathLarge}}
+	// Subscribers of the fanned out topic
+	hotPathSubscribers = []int{1, 100}
+)
+
+// hotPathSubscribe subscribes count clients connected over loopback WebSockets to a
+// topic, each draining what it receives.
+func hotPathSubscribe(b *testing.B, pubsub *PubSub, topic string, count int, options SubscribeOptions) {
+	b.Helper()
+	conns := make(chan *websocket.Conn, count)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := pubsub.options().upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		conns <- ws
+	}))
+	b.Cleanup(server.Close)
+
+	for i := 0; i < count; i++ {
+		peer, _, err := websocket.DefaultDialer.Dial("ws"+server.URL[4:], nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Cleanup(func() { peer.Close() })
+		go func() {
+			for {
+				_, reader, err := peer.NextReader()
+				if err != nil {
+					return
+				}
+				io.Copy(io.Discard, reader)
+			}
+		}()
+		pubsub.SubscribeWith(&Client{Id: fmt.Sprint("subscriber-", i), Connection: <-conns}, topic, options)
+	}
+}
+
+func BenchmarkHotPathFanOut(b *testing.B) {
+	for _, subscribers := range hotPathSubscribers {
+		for _, envelope := range []bool{false, true} {
+			b.Run(fmt.Sprintf("subscribers=%d/envelope=%t", subscribers, envelope), func(b *testing.B) {
+				pubsub := &PubSub{}
+				hotPathSubscribe(b, pubsub, "feed", subscribers, SubscribeOptions{Envelope: envelope})
+				ctx := context.Background()
+				b.SetBytes(int64(len(hotPathLarge) * subscribers))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					pubsub.fanOut(ctx, "m1", "feed", hotPathLarge)
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkHotPathDecode(b *testing.B) {
+	pubsub := &PubSub{}
+	client := Client{Id: "publisher"}
+	for _, test := range hotPathMessages {
+		frame := []byte(`{"action":"publish","topic":"chat","message":` + string(test.message) + `}`)
+		b.Run(test.name, func(b *testing.B) {
+			b.SetBytes(int64(len(frame)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				pubsub.HandleRecvdMessage(client, websocket.TextMessage, frame)
+			}
+		})
+	}
+}
+
+func BenchmarkHotPathEnvelope(b *testing.B) {
+	reply := replyHeaders{}
+	for _, test := range hotPathMessages {
+		b.Run(test.name, func(b *testing.B) {
+			b.SetBytes(int64(len(test.message)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				envelopeMessage("m1", "chat", test.message, nil, "alice", reply)
+			}
+		})
+	}
+}
+
+func BenchmarkHotPathProtobuf(b *testing.B) {
+	frame := envelopeMessage("m1", "chat", hotPathLarge, nil, "alice", replyHeaders{})
+	b.SetBytes(int64(len(frame)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := jsonToProtobuf(frame); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+// This file disconnects idle clients, so connections abandoned without being closed,
+// like forgotten browser tabs, do not hold their subscriptions forever. A WebSocket or
+// TCP client that neither sent a frame nor was sent a message for the idle timeout is
+// closed with the idle_timeout reason, and its subscriptions are removed as it leaves.
+// Heartbeat pings and pongs keep a connection open but do not count as activity.
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var idleEvictions = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "gowebsockets_idle_evictions_total",
+	Help: "Number of clients disconnected for being idle.",
+})
+
+// Function to record that a message was sent to the client of a session.
+func (s *Session) Sent() {
+	if s != nil {
+		s.lastSent.Store(time.Now().UnixNano())
+	}
+}
+
+// Function to get how long the client of a session has neither sent nor been sent anything.
+// Parameters:
+// now: time.Time - The time the idle duration is measured at.
+// Returns:
+// time.Duration - The idle duration.
+func (s *Session) IdleFor(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, max(s.lastActive.Load(), s.lastSent.Load())))
+}
+
+// Function to disconnect the WebSocket and TCP clients idle for a timeout.
+// Parameters:
+// timeout: time.Duration - How long a client may be idle.
+// Returns:
+// int - The number of clients disconnected.
+func (ps *PubSub) EvictIdleClients(timeout time.Duration) int {
+	now := time.Now()
+	var idle []Client
+	for _, client := range ps.Clients() {
+		if client.Closable() && client.Session != nil && client.Session.IdleFor(now) >= timeout {
+			idle = append(idle, client)
+		}
+	}
+
+	// Closing the connection ends its read loop, which removes the client and its subscriptions
+	for _, client := range idle {
+		client.logger().Info("Disconnecting idle client", "idle", client.Session.IdleFor(now).Round(time.Second))
+		disconnectClient(context.Background(), client, ReasonIdleTimeout, false)
+	}
+	idleEvictions.Add(float64(len(idle)))
+	return len(idle)
+}
+
+// IdleReaper disconnects idle clients periodically.
+type IdleReaper struct {
+	Timeout time.Duration
+	ps      *PubSub
+	done    chan struct{}
+}
+
+// Function to create a reaper of idle clients.
+// Parameters:
+// ps: *PubSub - The PubSub instance whose clients are disconnected.
+// timeout: time.Duration - How long a client may be idle.
+// Returns:
+// *IdleReaper - The reaper; call Start to begin disconnecting.
+func NewIdleReaper(ps *PubSub, timeout time.Duration) *IdleReaper {
+	return &IdleReaper{Timeout: timeout, ps: ps, done: make(chan struct{})}
+}
+
+// Function to disconnect idle clients every half timeout, or every minute for longer
+// timeouts, so no client stays connected much longer than the timeout.
+func (r *IdleReaper) Start() {
+	go func() {
+		ticker := time.NewTicker(max(min(r.Timeout/2, time.Minute), time.Millisecond))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.done:
+				return
+			case <-ticker.C:
+				if evicted := r.ps.EvictIdleClients(r.Timeout); evicted > 0 {
+					slog.Info("Disconnected idle clients", "count", evicted)
+				}
+			}
+		}
+	}()
+}
+
+// Function to stop disconnecting idle clients.
+func (r *IdleReaper) Stop() {
+	close(r.done)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// backdate makes the session of a client idle for a duration.
+func backdate(session *Session, idle time.Duration) {
+	then := time.Now().Add(-idle).UnixNano()
+	session.lastActive.Store(then)
+	session.lastSent.Store(then)
+}
+
+// sessionOf returns the session of the connected client with an ID.
+func sessionOf(t *testing.T, pubsub *PubSub, id string) *Session {
+	pubsub.mu.Lock()
+	defer pubsub.mu.Unlock()
+	for _, client := range pubsub.Clients() {
+		if client.Id == id {
+			return client.Session
+		}
+	}
+	t.Fatalf("client %s is not connected", id)
+	return nil
+}
+
+func TestSessionIdleFor(t *testing.T) {
+	session := NewSession("192.0.2.1:5000")
+	backdate(session, time.Hour)
+	now := time.Now()
+	assert.InDelta(t, time.Hour.Seconds(), session.IdleFor(now).Seconds(), 1)
+
+	session.Sent()
+	assert.Less(t, session.IdleFor(time.Now()), time.Minute, "Messages sent to the client count as activity")
+	backdate(session, time.Hour)
+	session.Touch()
+	assert.Less(t, session.IdleFor(time.Now()), time.Minute, "Frames from the client count as activity")
+}
+
+func TestEvictIdleClients(t *testing.T) {
+	isolatePubSub(t)
+	server := httptest.NewServer(http.HandlerFunc(ps.webSocketHandler))
+	t.Cleanup(server.Close)
+	connect := func() (*websocket.Conn, string) {
+		ws, _, err := websocket.DefaultDialer.Dial("ws"+server.URL[4:], nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ws.Close() })
+		welcome := readFrame(t, ws)
+		ws.WriteJSON(map[string]string{"action": "subscribe", "topic": "chat"})
+		mustRead(t, ws)
+		return ws, welcome["clientId"].(string)
+	}
+	subscribers := func() int {
+		infos, _ := ps.SubscriberInfos("chat")
+		return len(infos)
+	}
+	idle, idleId := connect()
+	active, activeId := connect()
+	assert.Eventually(t, func() bool { return subscribers() == 2 }, time.Second, 10*time.Millisecond)
+
+	backdate(sessionOf(t, ps, idleId), time.Hour)
+	backdate(sessionOf(t, ps, activeId), time.Hour)
+	sessionOf(t, ps, activeId).Sent()
+	assert.Equal(t, 1, ps.EvictIdleClients(time.Minute))
+
+	_, _, err := idle.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, CloseIdleTimeout), "Idle clients are closed with the idle timeout code")
+	assert.Eventually(t, func() bool { return subscribers() == 1 }, time.Second, 10*time.Millisecond,
+		"The subscriptions of idle clients are removed")
+	active.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, _, err = active.ReadMessage()
+	assert.False(t, websocket.IsCloseError(err, CloseIdleTimeout), "Clients sent a message recently stay connected")
+}
+
+func TestIdleReaper(t *testing.T) {
+	pubsub := &PubSub{}
+	client, peer := newTestClient(t)
+	client.Session = NewSession("192.0.2.1:5000")
+	backdate(client.Session, time.Hour)
+	pubsub.AddClient(client)
+
+	reaper := NewIdleReaper(pubsub, 20*time.Millisecond)
+	reaper.Start()
+	t.Cleanup(reaper.Stop)
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err := peer.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, CloseIdleTimeout))
+}
@@ -0,0 +1,225 @@
+//go:build integration
+
+// This file tests the backplanes end to end against real Redis and NATS servers started
+// in Docker containers, with two brokers relaying to each other as two instances behind
+// a load balancer would, and cluster mode and durable subscriptions with nodes linked
+// over real sockets and clients connecting over the TCP listener. The server has no
+// Postgres store, so there is none to test: history is kept in memory and durable
+// subscriptions in a file. Run with: go test -tags integration -run Integration ./...
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/testcontainers/testcontainers-go"
+	tcnats "github.com/testcontainers/testcontainers-go/modules/nats"
+	tcredis "github.com/testcontainers/testcontainers-go/modules/redis"
+)
+
+// backplane is a bridge that can be disconnected.
+type backplane interface {
+	Bridge
+	Close()
+}
+
+// backplaneFactory connects a broker to a backplane.
+type backplaneFactory func(url string, pubsub *PubSub) (backplane, error)
+
+// startRedis starts a Redis container for the test and returns its URL.
+func startRedis(t *testing.T) string {
+	testcontainers.SkipIfProviderIsNotHealthy(t)
+	ctx := context.Background()
+	container, err := tcredis.Run(ctx, "redis:7-alpine")
+	testcontainers.CleanupContainer(t, container)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url, err := container.ConnectionString(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return url
+}
+
+// startNATS starts a NATS container for the test and returns its URL.
+func startNATS(t *testing.T) string {
+	testcontainers.SkipIfProviderIsNotHealthy(t)
+	ctx := context.Background()
+	container, err := tcnats.Run(ctx, "nats:2.10-alpine")
+	testcontainers.CleanupContainer(t, container)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url, err := container.ConnectionString(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return url
+}
+
+// startBroker starts a broker keeping the history of topics, relaying through a backplane.
+func startBroker(t *testing.T, url string, connect backplaneFactory) *PubSub {
+	pubsub := &PubSub{History: NewMemoryHistory(JSONEntryCodec{}, 10)}
+	bridge, err := connect(url, pubsub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(bridge.Close)
+	pubsub.Bridges = append(pubsub.Bridges, bridge)
+	return pubsub
+}
+
+func connectRedis(url string, pubsub *PubSub) (backplane, error) { return NewRedisBridge(url, pubsub) }
+
+func connectNATS(url string, pubsub *PubSub) (backplane, error) { return NewNATSBridge(url, pubsub) }
+
+// testBackplane checks that two brokers sharing a backplane deliver each other's
+// publishes once, and that the second broker replays what the first one published.
+func testBackplane(t *testing.T, url string, connect backplaneFactory) {
+	first := startBroker(t, url, connect)
+	second := startBroker(t, url, connect)
+	assert.NoError(t, first.CreateTopic("orders", "", TopicPolicy{Retention: RetainDurable}))
+	assert.NoError(t, second.CreateTopic("orders", "", TopicPolicy{Retention: RetainDurable}))
+
+	local, localPeer := newTestClient(t)
+	remote, remotePeer := newTestClient(t)
+	first.HandleRecvdMessage(local, 1, []byte(`{"action":"subscribe","topic":"orders"}`))
+	second.HandleRecvdMessage(remote, 1, []byte(`{"action":"subscribe","topic":"orders"}`))
+
+	first.Publish("orders", []byte(`{"id":1}`), nil)
+	first.Publish("orders", []byte(`{"id":2}`), nil)
+	localPeer.SetReadDeadline(time.Now().Add(10 * time.Second))
+	remotePeer.SetReadDeadline(time.Now().Add(10 * time.Second))
+	assert.JSONEq(t, `{"id":1}`, string(mustRead(t, localPeer)))
+	assert.JSONEq(t, `{"id":1}`, string(mustRead(t, remotePeer)), "Publishes should reach the subscribers of the other broker")
+	assert.JSONEq(t, `{"id":2}`, string(mustRead(t, remotePeer)), "Publishes should keep their order across brokers")
+	mustRead(t, localPeer)
+
+	second.Publish("orders", []byte(`{"id":3}`), nil)
+	assert.JSONEq(t, `{"id":3}`, string(mustRead(t, localPeer)), "Relaying should work both ways")
+	assert.JSONEq(t, `{"id":3}`, string(mustRead(t, remotePeer)))
+	remotePeer.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	_, _, err := remotePeer.ReadMessage()
+	assert.Error(t, err, "A broker should not deliver its own publishes again when they come back from the backplane")
+
+	late, latePeer := newTestClient(t)
+	second.HandleRecvdMessage(late, 1, []byte(`{"action":"history","topic":"orders"}`))
+	replay := readFrame(t, latePeer)
+	assert.Equal(t, HISTORY, replay["action"])
+	assert.Len(t, replay["messages"], 3, "The history of a broker should include what other brokers published")
+}
+
+func TestIntegrationRedisBackplane(t *testing.T) {
+	testBackplane(t, startRedis(t), connectRedis)
+}
+
+func TestIntegrationNATSBackplane(t *testing.T) {
+	testBackplane(t, startNATS(t), connectNATS)
+}
+
+// clusterNode is a node of a cluster served on a test server, keeping the history of
+// topics and the durable subscriptions saved to a file.
+type clusterNode struct {
+	pubsub  *PubSub
+	cluster *Cluster
+	server  *httptest.Server
+}
+
+// startClusterNode starts a cluster node joining peers.
+func startClusterNode(t *testing.T, durableSubsFile string, peers ...string) *clusterNode {
+	lifetimes, err := NewSubscriptionStore(durableSubsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubsub := &PubSub{History: NewMemoryHistory(JSONEntryCodec{}, 10), Lifetimes: lifetimes}
+	server := httptest.NewUnstartedServer(nil)
+	cluster := NewCluster(server.Listener.Addr().String(), "s3cret", pubsub)
+	server.Config.Handler = cluster
+	server.Start()
+	pubsub.Bridges = []Bridge{cluster}
+	node := &clusterNode{pubsub: pubsub, cluster: cluster, server: server}
+	t.Cleanup(node.stop)
+	cluster.Join(peers)
+	return node
+}
+
+// stop takes the node down, as a crash would.
+func (node *clusterNode) stop() {
+	node.cluster.Close()
+	node.server.Close()
+}
+
+func TestIntegrationClusterMode(t *testing.T) {
+	seed := startClusterNode(t, "")
+	second := startClusterNode(t, "", seed.cluster.Address)
+	third := startClusterNode(t, "", seed.cluster.Address)
+	assert.Eventually(t, func() bool {
+		return len(seed.cluster.Members()) == 2 && len(second.cluster.Members()) == 2 && len(third.cluster.Members()) == 2
+	}, 10*time.Second, 20*time.Millisecond, "Nodes joining a seed should link to every member")
+
+	var peers []*websocket.Conn
+	for _, node := range []*clusterNode{seed, second, third} {
+		client, peer := newTestClient(t)
+		node.pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"orders"}`))
+		peer.SetReadDeadline(time.Now().Add(10 * time.Second))
+		peers = append(peers, peer)
+	}
+	second.pubsub.Publish("orders", []byte(`{"id":1}`), nil)
+	third.pubsub.Publish("orders", []byte(`{"id":2}`), nil)
+	for _, peer := range peers {
+		received := []string{string(mustRead(t, peer)), string(mustRead(t, peer))}
+		assert.ElementsMatch(t, []string{`{"id":1}`, `{"id":2}`}, received, "Every node should deliver every publish")
+	}
+
+	// The remaining nodes keep relaying to each other once a node goes down
+	third.stop()
+	assert.Eventually(t, func() bool { return len(seed.cluster.Members()) == 1 && len(second.cluster.Members()) == 1 }, 10*time.Second, 20*time.Millisecond)
+	second.pubsub.Publish("orders", []byte(`{"id":3}`), nil)
+	assert.JSONEq(t, `{"id":3}`, string(mustRead(t, peers[0])), "A publish should be delivered once although every node relays it")
+
+	late, latePeer := newTestClient(t)
+	seed.pubsub.HandleRecvdMessage(late, 1, []byte(`{"action":"history","topic":"orders"}`))
+	replay := readFrame(t, latePeer)
+	assert.Equal(t, HISTORY, replay["action"])
+	assert.Len(t, replay["messages"], 3, "The history of a node should include what the other nodes published")
+}
+
+func TestIntegrationDurableSubscriptionsSurviveARestart(t *testing.T) {
+	keys := NewAPIKeyStore()
+	keys.Add("alice-secret", "alice", []string{PermissionSubscribe})
+	durableSubsFile := filepath.Join(t.TempDir(), "subscriptions.json")
+	other := startClusterNode(t, "")
+	node := startClusterNode(t, durableSubsFile, other.cluster.Address)
+	assert.Eventually(t, func() bool { return len(other.cluster.Members()) == 1 }, 10*time.Second, 20*time.Millisecond)
+	node.pubsub.options().apiKeys = keys
+
+	alice := dialTCP(t, node.pubsub)
+	alice.send(t, `{"action":"connect","apiKey":"alice-secret"}`)
+	assert.Equal(t, "welcome", alice.readJSON(t)["action"])
+	alice.send(t, `{"action":"subscribe","topic":"orders","lifetime":"durable"}`)
+	alice.read(t)
+	assert.Equal(t, "durable", alice.readJSON(t)["lifetime"])
+
+	// The node restarts, and alice connects to it again
+	node.stop()
+	restarted := startClusterNode(t, durableSubsFile, other.cluster.Address)
+	assert.Eventually(t, func() bool { return len(other.cluster.Members()) == 1 && len(restarted.cluster.Members()) == 1 }, 10*time.Second, 20*time.Millisecond)
+	restarted.pubsub.options().apiKeys = keys
+	alice = dialTCP(t, restarted.pubsub)
+	alice.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	alice.send(t, `{"action":"connect","apiKey":"alice-secret"}`)
+	assert.Equal(t, "welcome", alice.readJSON(t)["action"])
+	restored := alice.readJSON(t)
+	assert.Equal(t, "orders", restored["topic"])
+	assert.Equal(t, "durable", restored["lifetime"], "The durable subscription should be restored from the file")
+
+	other.pubsub.Publish("orders", []byte(`{"id":1}`), nil)
+	_, message := alice.read(t)
+	assert.JSONEq(t, `{"id":1}`, string(message), "The restored subscription should receive what other nodes publish")
+}
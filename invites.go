@@ -0,0 +1,125 @@
+// This file implements invitations to private topics: the owner of a topic issues a
+// signed, time-limited grant token, and a client presenting it when subscribing is
+// admitted without being granted access permanently.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Protocol action issuing an invitation
+const INVITE = "invite"
+
+const (
+	defaultInviteTTL = time.Hour
+	maxInviteTTL     = 7 * 24 * time.Hour
+)
+
+// The claims of an invitation
+type inviteClaims struct {
+	Topic string `json:"topic"`
+	jwt.RegisteredClaims
+}
+
+// The frame returned to the owner with the invitation
+type inviteFrame struct {
+	Action    string    `json:"action"`
+	Topic     string    `json:"topic"`
+	Grant     string    `json:"grant"`
+	Principal string    `json:"principal,omitempty"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Function to issue an invitation to a topic.
+// Parameters:
+// topic: string - The topic.
+// owner: string - The principal owning the topic.
+// invitee: string - The only principal the invitation admits, or empty for anyone holding it.
+// ttl: time.Duration - How long the invitation is valid, capped to seven days.
+// Returns:
+// string - The signed grant token.
+// time.Time - When the invitation expires.
+// error - An error if the token could not be signed.
+func (ps *PubSub) issueInvite(topic string, owner string, invitee string, ttl time.Duration) (string, time.Time, error) {
+	if ttl <= 0 {
+		ttl = defaultInviteTTL
+	}
+	if ttl > maxInviteTTL {
+		ttl = maxInviteTTL
+	}
+	now := time.Now()
+	expiresAt := now.Add(ttl).Truncate(time.Second)
+	claims := inviteClaims{
+		Topic: topic,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    owner,
+			Subject:   invitee,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(ps.options().inviteKey)
+	return token, expiresAt, err
+}
+
+// Function to check that an invitation admits a client to a topic. The invitation must
+// be unexpired, for this topic, issued by its current owner and, when it names an
+// invitee, presented by that principal.
+// Parameters:
+// name: string - The name of the topic.
+// grant: string - The grant token presented by the client.
+// client: *Client - The client subscribing.
+// Returns:
+// error - Why the invitation does not admit the client, or nil.
+func (ps *PubSub) checkInvite(name string, grant string, client *Client) error {
+	if grant == "" {
+		return errors.New("no invitation")
+	}
+	claims := &inviteClaims{}
+	_, err := jwt.ParseWithClaims(grant, claims, func(token *jwt.Token) (interface{}, error) {
+		return ps.options().inviteKey, nil
+	}, jwt.WithValidMethods([]string{"HS256"}), jwt.WithExpirationRequired())
+	if err != nil {
+		return err
+	}
+	if claims.Topic != name {
+		return fmt.Errorf("invitation is for topic %q", claims.Topic)
+	}
+	if claims.Subject != "" && claims.Subject != client.Principal() {
+		return errors.New("invitation is for another principal")
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	topic, ok := ps.Topics[name]
+	if !ok || topic.Owner == "" || topic.Owner != claims.Issuer {
+		return errors.New("invitation was not issued by the owner of the topic")
+	}
+	return nil
+}
+
+// Function to issue an invitation requested by the owner of a topic and send it back.
+// Parameters:
+// client: *Client - The owner.
+// m: Message - The invite action, with an optional principal and ttl in seconds.
+// Returns:
+// error - An error if the invitation could not be issued.
+func (ps *PubSub) handleInvite(client *Client, m Message) error {
+	grant, expiresAt, err := ps.issueInvite(m.Topic, client.Principal(), m.Principal, time.Duration(m.TTL)*time.Second)
+	if err != nil {
+		return err
+	}
+	reply, _ := json.Marshal(inviteFrame{
+		Action:    INVITE,
+		Topic:     m.Topic,
+		Grant:     grant,
+		Principal: m.Principal,
+		ExpiresAt: expiresAt,
+	})
+	return client.Send(reply)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+// newPrivateTopic returns a PubSub holding a private topic owned by the returned client.
+func newPrivateTopic(t *testing.T, name string) (*PubSub, Client) {
+	ps := &PubSub{}
+	owner, _ := newTestClient(t)
+	owner.Claims = jwt.MapClaims{"sub": "alice"}
+	ps.mu.Lock()
+	ps.touchTopic(name, &owner).Policy.Private = true
+	ps.mu.Unlock()
+	return ps, owner
+}
+
+func TestInviteAdmitsSubscriber(t *testing.T) {
+	ps, _ := newPrivateTopic(t, "room")
+	bob, bobPeer := newTestClient(t)
+	bob.Claims = jwt.MapClaims{"sub": "bob"}
+
+	grant, expiresAt, err := ps.issueInvite("room", "alice", "bob", time.Minute)
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), expiresAt, 2*time.Second)
+
+	subscribe, _ := json.Marshal(Message{Action: SUBSCRIBE, Topic: "room", Grant: grant})
+	ps.HandleRecvdMessage(bob, 1, subscribe)
+	assert.Len(t, ps.GetSubscriptions("room", &bob), 1, "The invitation should admit bob")
+	assert.False(t, ps.Topics["room"].Grants["bob"], "An invitation should not grant permanent access")
+
+	bobPeer.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, _, err = bobPeer.ReadMessage()
+	assert.Error(t, err, "No error frame should be sent")
+}
+
+func TestInviteIsRejected(t *testing.T) {
+	ps, _ := newPrivateTopic(t, "room")
+	ps.mu.Lock()
+	ps.touchTopic("other", nil)
+	ps.mu.Unlock()
+
+	carol := &Client{Claims: jwt.MapClaims{"sub": "carol"}}
+	forBob, _, _ := ps.issueInvite("room", "alice", "bob", time.Minute)
+	forOther, _, _ := ps.issueInvite("other", "alice", "", time.Minute)
+	notOwner, _, _ := ps.issueInvite("room", "mallory", "", time.Minute)
+	valid, _, _ := ps.issueInvite("room", "alice", "", time.Minute)
+	elsewhere, _, _ := (&PubSub{}).issueInvite("room", "alice", "", time.Minute)
+
+	assert.Error(t, ps.checkInvite("room", "", carol))
+	assert.Error(t, ps.checkInvite("room", forBob, carol), "Invitations naming a principal admit only that principal")
+	assert.Error(t, ps.checkInvite("room", forOther, carol), "Invitations admit only to their topic")
+	assert.Error(t, ps.checkInvite("room", notOwner, carol), "Invitations must be issued by the owner")
+	assert.Error(t, ps.checkInvite("room", valid[:len(valid)-2]+"xx", carol), "Tampered invitations are rejected")
+	assert.Error(t, ps.checkInvite("room", elsewhere, carol), "Invitations are signed with the key of their server")
+	assert.NoError(t, ps.checkInvite("room", valid, carol))
+
+	expired, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, inviteClaims{
+		Topic:            "room",
+		RegisteredClaims: jwt.RegisteredClaims{Issuer: "alice", ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Minute))},
+	}).SignedString(ps.options().inviteKey)
+	assert.Error(t, ps.checkInvite("room", expired, carol), "Expired invitations are rejected")
+}
+
+func TestOnlyOwnerCanInvite(t *testing.T) {
+	ps, _ := newPrivateTopic(t, "room")
+	bob, bobPeer := newTestClient(t)
+	bob.Claims = jwt.MapClaims{"sub": "bob"}
+
+	ps.HandleRecvdMessage(bob, 1, []byte(`{"action":"invite","topic":"room"}`))
+	var reply map[string]string
+	assert.NoError(t, bobPeer.ReadJSON(&reply))
+	assert.Equal(t, "forbidden", reply["code"])
+}
+
+func TestOwnerReceivesInvite(t *testing.T) {
+	ps := &PubSub{}
+	owner, peer := newTestClient(t)
+	owner.Claims = jwt.MapClaims{"sub": "alice"}
+	ps.HandleRecvdMessage(owner, 1, []byte(`{"action":"subscribe","topic":"room"}`))
+	ps.HandleRecvdMessage(owner, 1, []byte(`{"action":"invite","topic":"room","ttl":120}`))
+
+	var invite inviteFrame
+	assert.NoError(t, peer.ReadJSON(&invite))
+	assert.Equal(t, INVITE, invite.Action)
+	assert.NotEmpty(t, invite.Grant)
+	assert.NoError(t, ps.checkInvite("room", invite.Grant, &Client{}))
+}
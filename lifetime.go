@@ -0,0 +1,328 @@
+// This file makes the lifetime of a subscription explicit. A subscribe frame may ask for
+// {"lifetime": "connection"}, the default, for a subscription ending with its connection,
+// {"lifetime": "session"} for one restored when the client resumes its session, or
+// {"lifetime": "durable"} for one saved to the durable subscriptions file, which survives
+// restarts of the server and is restored on every connection of its principal until it
+// is unsubscribed. Subscribe frames naming a lifetime are answered with a subscribed frame
+// confirming it.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Action of the frame confirming a subscription and its lifetime
+const SUBSCRIBED = "subscribed"
+
+// SubscriptionLifetime is how long a subscription outlives the connection that made it.
+type SubscriptionLifetime string
+
+const (
+	// The subscription ends with its connection
+	LifetimeConnection SubscriptionLifetime = "connection"
+	// The subscription is restored when its client resumes its session
+	LifetimeSession SubscriptionLifetime = "session"
+	// The subscription is restored on every connection of its principal, across restarts, until unsubscribed
+	LifetimeDurable SubscriptionLifetime = "durable"
+)
+
+// Function to parse the lifetime asked for by a subscribe frame.
+// Parameters:
+// value: string - The lifetime, "" for the default.
+// Returns:
+// SubscriptionLifetime - The lifetime.
+// error - An error if the lifetime is unknown.
+func ParseSubscriptionLifetime(value string) (SubscriptionLifetime, error) {
+	switch lifetime := SubscriptionLifetime(value); lifetime {
+	case "":
+		return LifetimeConnection, nil
+	case LifetimeConnection, LifetimeSession, LifetimeDurable:
+		return lifetime, nil
+	default:
+		return "", fmt.Errorf("unknown subscription lifetime %q", value)
+	}
+}
+
+// StoredSubscription is a subscription kept while its client is not connected.
+type StoredSubscription struct {
+	Topic    string               `json:"topic"`
+	Lifetime SubscriptionLifetime `json:"lifetime"`
+	Envelope bool                 `json:"envelope,omitempty"`
+	QoS      int                  `json:"qos,omitempty"`
+	NoEcho   bool                 `json:"noEcho,omitempty"`
+	Filter   string               `json:"filter,omitempty"`
+}
+
+// Function to describe a subscription to restore it later.
+// Parameters:
+// sub: Subscription - The subscription.
+// Returns:
+// StoredSubscription - Its topic, lifetime and options.
+func storedSubscriptionOf(sub Subscription) StoredSubscription {
+	stored := StoredSubscription{Topic: sub.Topic, Lifetime: sub.Lifetime, Envelope: sub.Envelope, QoS: sub.QoS, NoEcho: sub.NoEcho}
+	if sub.Filter != nil {
+		stored.Filter = sub.Filter.Source
+	}
+	return stored
+}
+
+// SubscriptionStore keeps the durable subscriptions of principals.
+type SubscriptionStore struct {
+	// File the durable subscriptions are saved to, "" to refuse durable subscriptions
+	Path string
+
+	mu sync.Mutex
+	// Subscriptions by principal and topic
+	subscriptions map[string]map[string]StoredSubscription
+}
+
+// Function to create a store of subscriptions, loading the durable subscriptions saved
+// to its file.
+// Parameters:
+// path: string - The file durable subscriptions are saved to, or "" for none.
+// Returns:
+// *SubscriptionStore - The store.
+// error - An error if the file could not be read.
+func NewSubscriptionStore(path string) (*SubscriptionStore, error) {
+	store := &SubscriptionStore{Path: path, subscriptions: map[string]map[string]StoredSubscription{}}
+	if path == "" {
+		return store, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var durable map[string][]StoredSubscription
+	if err := json.Unmarshal(data, &durable); err != nil {
+		return nil, fmt.Errorf("durable subscriptions %s: %w", path, err)
+	}
+	for principal, subscriptions := range durable {
+		for _, sub := range subscriptions {
+			sub.Lifetime = LifetimeDurable
+			store.putLocked(principal, sub)
+		}
+	}
+	return store, nil
+}
+
+// Function to check whether the store can keep durable subscriptions.
+// Returns:
+// bool - False when no file is configured.
+func (s *SubscriptionStore) Durable() bool {
+	return s != nil && s.Path != ""
+}
+
+// Function to add a subscription. The caller must hold s.mu.
+// Parameters:
+// principal: string - The principal.
+// sub: StoredSubscription - The subscription.
+func (s *SubscriptionStore) putLocked(principal string, sub StoredSubscription) {
+	if s.subscriptions[principal] == nil {
+		s.subscriptions[principal] = map[string]StoredSubscription{}
+	}
+	s.subscriptions[principal][sub.Topic] = sub
+}
+
+// Function to remove a subscription. The caller must hold s.mu.
+// Parameters:
+// principal: string - The principal.
+// topic: string - The topic.
+// Returns:
+// bool - True if a subscription was removed.
+func (s *SubscriptionStore) deleteLocked(principal string, topic string) bool {
+	if _, ok := s.subscriptions[principal][topic]; !ok {
+		return false
+	}
+	delete(s.subscriptions[principal], topic)
+	if len(s.subscriptions[principal]) == 0 {
+		delete(s.subscriptions, principal)
+	}
+	return true
+}
+
+// Function to record the lifetime a principal chose for a subscription: durable
+// subscriptions are saved, any other lifetime forgets a durable subscription saved before.
+// Parameters:
+// principal: string - The principal.
+// sub: StoredSubscription - The subscription.
+// Returns:
+// error - An error if the durable subscriptions could not be saved.
+func (s *SubscriptionStore) Keep(principal string, sub StoredSubscription) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sub.Lifetime == LifetimeDurable {
+		s.putLocked(principal, sub)
+		return s.saveLocked()
+	}
+	if s.deleteLocked(principal, sub.Topic) {
+		return s.saveLocked()
+	}
+	return nil
+}
+
+// Function to forget the subscription of a principal to a topic, when it is unsubscribed.
+// Parameters:
+// principal: string - The principal.
+// topic: string - The topic.
+// Returns:
+// error - An error if the durable subscriptions could not be saved.
+func (s *SubscriptionStore) Forget(principal string, topic string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.deleteLocked(principal, topic) {
+		return s.saveLocked()
+	}
+	return nil
+}
+
+// Function to get the durable subscriptions to restore for a principal that connected.
+// Parameters:
+// principal: string - The principal.
+// Returns:
+// []StoredSubscription - The subscriptions, in no particular order.
+func (s *SubscriptionStore) Restore(principal string) []StoredSubscription {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var restored []StoredSubscription
+	for _, sub := range s.subscriptions[principal] {
+		restored = append(restored, sub)
+	}
+	return restored
+}
+
+// Function to save the durable subscriptions to the file, replacing it atomically. The
+// caller must hold s.mu.
+// Returns:
+// error - An error if the file could not be written.
+func (s *SubscriptionStore) saveLocked() error {
+	if s.Path == "" {
+		return nil
+	}
+	durable := map[string][]StoredSubscription{}
+	for principal, subscriptions := range s.subscriptions {
+		for _, sub := range subscriptions {
+			durable[principal] = append(durable[principal], sub)
+		}
+	}
+	data, err := json.MarshalIndent(durable, "", "  ")
+	if err != nil {
+		return err
+	}
+	temp, err := os.CreateTemp(filepath.Dir(s.Path), filepath.Base(s.Path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), s.Path)
+}
+
+// Function to build the frame confirming a subscription.
+// Parameters:
+// topic: string - The topic.
+// lifetime: SubscriptionLifetime - The lifetime of the subscription.
+// restored: bool - True if the subscription was restored on connect rather than asked for.
+// Returns:
+// []byte - The JSON encoded frame.
+func subscribedMessage(topic string, lifetime SubscriptionLifetime, restored bool) []byte {
+	message, _ := json.Marshal(struct {
+		Action   string               `json:"action"`
+		Topic    string               `json:"topic"`
+		Lifetime SubscriptionLifetime `json:"lifetime"`
+		Restored bool                 `json:"restored,omitempty"`
+	}{SUBSCRIBED, topic, lifetime, restored})
+	return message
+}
+
+// Function to check whether a client may keep a subscription beyond its connection.
+// Parameters:
+// client: *Client - The client.
+// lifetime: SubscriptionLifetime - The lifetime asked for.
+// Returns:
+// string - The code of the error frame refusing the lifetime, or "" if it is allowed.
+func (ps *PubSub) lifetimeRefusal(client *Client, lifetime SubscriptionLifetime) string {
+	switch lifetime {
+	case LifetimeSession:
+		// Sessions can only be resumed if the server issues tokens to resume them
+		if ps.Sessions == nil || client.Session.resumeToken == "" {
+			return "lifetime_unavailable"
+		}
+	case LifetimeDurable:
+		// Only an authenticated principal can be recognized when it connects again
+		if client.Principal() == "" {
+			return "lifetime_requires_principal"
+		}
+		if !ps.Lifetimes.Durable() {
+			return "lifetime_unavailable"
+		}
+	}
+	return ""
+}
+
+// Function to record the lifetime of a subscription a client made.
+// Parameters:
+// client: *Client - The client.
+// sub: StoredSubscription - The subscription.
+func (ps *PubSub) keepSubscription(client *Client, sub StoredSubscription) {
+	if ps.Lifetimes != nil && client.Principal() != "" {
+		if err := ps.Lifetimes.Keep(client.Principal(), sub); err != nil {
+			client.logger().Error("Error saving durable subscriptions", logKeyTopic, sub.Topic, "error", err)
+		}
+	}
+}
+
+// Function to restore the durable subscriptions of the principal of a client that
+// connected.
+// Parameters:
+// client: *Client - The client.
+func (ps *PubSub) restoreDurableSubscriptions(client *Client) {
+	if ps.Lifetimes == nil || client.Principal() == "" {
+		return
+	}
+	ps.restoreSubscriptions(client, ps.Lifetimes.Restore(client.Principal()), nil)
+}
+
+// Function to make subscriptions kept while a client was not connected again. They are
+// made with its current permissions, each confirmed by a subscribed frame, and dropped
+// if the client may no longer subscribe. The messages queued for the restored
+// subscriptions are redelivered before any new message.
+// Parameters:
+// client: *Client - The client.
+// subscriptions: []StoredSubscription - The subscriptions.
+// queued: []offlineMessage - The messages queued for them, or nil for none.
+func (ps *PubSub) restoreSubscriptions(client *Client, subscriptions []StoredSubscription, queued []offlineMessage) {
+	var allowed []StoredSubscription
+	var filters []*Filter
+	restored := map[string]bool{}
+	for _, sub := range subscriptions {
+		filter, err := ParseFilter(sub.Filter)
+		if err != nil || !client.HasPermission(PermissionSubscribe) || !client.TopicAllowed(SUBSCRIBE, sub.Topic) || !ps.aclAllows(client, SUBSCRIBE, sub.Topic) || !mayReadReserved(client, sub.Topic) || !ps.canAccessTopic(sub.Topic, client, SUBSCRIBE) || !ps.canSubscribe(client, sub.Topic) {
+			client.logger().Info("Subscription not restored", logKeyTopic, sub.Topic, "lifetime", sub.Lifetime)
+			client.Send(errorMessage("restore_refused", sub.Topic))
+			continue
+		}
+		client.Send(subscribedMessage(sub.Topic, sub.Lifetime, true))
+		allowed = append(allowed, sub)
+		filters = append(filters, filter)
+		restored[sub.Topic] = true
+	}
+	// Queued messages go out before the client is subscribed, so they are never overtaken
+	ps.flushOffline(client, queued, restored)
+	for i, sub := range allowed {
+		ps.SubscribeWith(client, sub.Topic, SubscribeOptions{Envelope: sub.Envelope, QoS: sub.QoS, NoEcho: sub.NoEcho, Lifetime: sub.Lifetime, Filter: filters[i]})
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+// newAliceClient connects a client authenticated as alice.
+func newAliceClient(t *testing.T) (Client, func() map[string]interface{}) {
+	client, peer := newTestClient(t)
+	client.Claims = jwt.MapClaims{"sub": "alice"}
+	return client, func() map[string]interface{} { return readFrame(t, peer) }
+}
+
+func TestDurableSubscriptionsSurviveRestarts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "subscriptions.json")
+	store, err := NewSubscriptionStore(path)
+	assert.NoError(t, err)
+	pubsub := &PubSub{Lifetimes: store}
+	client, read := newAliceClient(t)
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"orders","lifetime":"durable","qos":1}`))
+	assert.Equal(t, "durable", read()["lifetime"])
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"alerts","lifetime":"durable"}`))
+	read()
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"unsubscribe","topic":"alerts"}`))
+
+	restarted, err := NewSubscriptionStore(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []StoredSubscription{{Topic: "orders", Lifetime: LifetimeDurable, QoS: 1}}, restarted.Restore("alice"), "Unsubscribed durable subscriptions are forgotten")
+	assert.Len(t, restarted.Restore("alice"), 1, "Durable subscriptions are restored on every connection")
+
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"orders","lifetime":"connection"}`))
+	assert.Equal(t, "connection", read()["lifetime"])
+	restarted, _ = NewSubscriptionStore(path)
+	assert.Empty(t, restarted.Restore("alice"), "Subscribing again with another lifetime replaces it")
+}
+
+func TestSubscriptionLifetimeRefusals(t *testing.T) {
+	store, _ := NewSubscriptionStore("")
+	pubsub := &PubSub{Lifetimes: store}
+	client, read := newAliceClient(t)
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"orders","lifetime":"forever"}`))
+	assert.Equal(t, "invalid_lifetime", read()["code"])
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"orders","lifetime":"durable"}`))
+	assert.Equal(t, "lifetime_unavailable", read()["code"], "Durable subscriptions need a file to be saved to")
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"orders","lifetime":"session"}`))
+	assert.Equal(t, "lifetime_unavailable", read()["code"], "Session subscriptions need sessions that can be resumed")
+
+	pubsub.Lifetimes, _ = NewSubscriptionStore(filepath.Join(t.TempDir(), "subscriptions.json"))
+	anonymous, peer := newTestClient(t)
+	pubsub.HandleRecvdMessage(anonymous, 1, []byte(`{"action":"subscribe","topic":"orders","lifetime":"durable"}`))
+	assert.JSONEq(t, string(errorMessage("lifetime_requires_principal", "orders")), string(mustRead(t, peer)))
+	assert.Equal(t, 0, subscriptionCount(pubsub, &anonymous, "orders"))
+}
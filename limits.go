@@ -0,0 +1,145 @@
+// This file defines the limits applied to each client and the welcome frame that
+// tells a client its effective limits when it connects.
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"slices"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Limits are the limits applied to a client. A zero value means unlimited or disabled.
+type Limits struct {
+	MaxSubscriptions  int     `json:"maxSubscriptions"`
+	MaxMessageSize    int64   `json:"maxMessageSize"`
+	RateLimit         float64 `json:"rateLimit"`
+	RateBurst         int     `json:"rateBurst"`
+	HeartbeatInterval int64   `json:"heartbeatIntervalMs"`
+}
+
+// Frames up to this many bytes over the maximum message size are read and answered with
+// an error; larger frames are refused while being read and close the connection
+const messageSizeSlack = 64 * 1024
+
+// Claim a token can carry to override some of the default limits of its client
+const limitsClaim = "limits"
+
+// The first frame sent to a client after it connects
+type welcomeFrame struct {
+	Action   string `json:"action"`
+	ClientId string `json:"clientId"`
+	Limits   Limits `json:"limits"`
+	// Version of the protocol the connection speaks
+	Version int `json:"version"`
+	// Token resuming the session after a disconnect, and whether it resumed one
+	SessionToken string `json:"sessionToken,omitempty"`
+	Resumed      bool   `json:"resumed,omitempty"`
+}
+
+// Function to get the effective limits of a client: the default limits overridden by
+// the fields present in the limits claim of its token.
+// Parameters:
+// claims: jwt.MapClaims - The verified claims of the client, or nil.
+// Returns:
+// Limits - The effective limits.
+func (options *serverOptions) limitsFor(claims jwt.MapClaims) Limits {
+	return limitsFrom(options.defaultLimits, claims)
+}
+
+// Function to get the limits of a client given the default limits.
+// Parameters:
+// defaults: Limits - The default limits.
+// claims: jwt.MapClaims - The verified claims of the client, or nil.
+// Returns:
+// Limits - The default limits overridden by the limits claim.
+func limitsFrom(defaults Limits, claims jwt.MapClaims) Limits {
+	limits := defaults
+	override, ok := claims[limitsClaim]
+	if !ok {
+		return limits
+	}
+	data, err := json.Marshal(override)
+	if err == nil {
+		err = json.Unmarshal(data, &limits)
+	}
+	if err != nil {
+		slog.Warn("Ignoring invalid limits claim", "error", err)
+		return defaults
+	}
+	return limits
+}
+
+// Function to get the read limit of a client's connection.
+// Returns:
+// int64 - The largest frame read from the client, or 0 for no limit.
+func (limits Limits) readLimit() int64 {
+	if limits.MaxMessageSize <= 0 {
+		return 0
+	}
+	return limits.MaxMessageSize + messageSizeSlack
+}
+
+// Function to build the welcome frame of a client.
+// Parameters:
+// client: *Client - The client that connected.
+// Returns:
+// []byte - The JSON encoded welcome frame.
+func welcomeMessage(client *Client) []byte {
+	frame := welcomeFrame{Action: "welcome", ClientId: client.Id, Limits: client.Limits, Version: client.Session.ProtocolVersion()}
+	if client.Session != nil {
+		frame.SessionToken, frame.Resumed = client.Session.resumeToken, client.Session.resumed
+	}
+	message, _ := json.Marshal(frame)
+	return message
+}
+
+// Function to check whether a client may subscribe to one more topic.
+// Parameters:
+// client: *Client - The client subscribing.
+// topic: string - The topic it subscribes to.
+// Returns:
+// bool - False if the client reached its maximum number of subscriptions.
+func (ps *PubSub) canSubscribe(client *Client, topic string) bool {
+	if client.Limits.MaxSubscriptions <= 0 {
+		return true
+	}
+	// Only the topics of the client are looked at
+	topics := ps.clientTopics(client.Id)
+	if slices.Contains(topics, topic) {
+		// Subscribing again to a topic does not add a subscription
+		return true
+	}
+	return len(topics) < client.Limits.MaxSubscriptions
+}
+
+// Function to build the frame telling a client its subscribe was refused because it
+// reached its maximum number of subscriptions.
+// Parameters:
+// topic: string - The topic that was not subscribed.
+// Returns:
+// []byte - The JSON encoded frame.
+func subscriptionLimitMessage(topic string) []byte {
+	message, _ := json.Marshal(map[string]string{
+		"action": "error",
+		"code":   "subscription_limit",
+		"topic":  topic,
+	})
+	return message
+}
+
+// Function to build the frame telling a client a message was refused because it is
+// larger than its maximum message size.
+// Parameters:
+// limit: int64 - The maximum message size of the client.
+// Returns:
+// []byte - The JSON encoded frame.
+func messageTooLargeMessage(limit int64) []byte {
+	message, _ := json.Marshal(map[string]interface{}{
+		"action": "error",
+		"code":   "message_too_large",
+		"limit":  limit,
+	})
+	return message
+}
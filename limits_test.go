@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimitsForClaims(t *testing.T) {
+	options := newServerOptions()
+	options.defaultLimits = Limits{MaxSubscriptions: 10, MaxMessageSize: 1024}
+
+	assert.Equal(t, options.defaultLimits, options.limitsFor(nil))
+
+	limits := options.limitsFor(jwt.MapClaims{"limits": map[string]interface{}{"maxSubscriptions": 50}})
+	assert.Equal(t, 50, limits.MaxSubscriptions, "Claim should override the default")
+	assert.Equal(t, int64(1024), limits.MaxMessageSize, "Fields missing from the claim should keep the default")
+
+	assert.Equal(t, options.defaultLimits, options.limitsFor(jwt.MapClaims{"limits": "lots"}), "Invalid claims should be ignored")
+}
+
+func TestWelcomeMessageCarriesLimits(t *testing.T) {
+	client := Client{Id: "abc", Limits: Limits{MaxSubscriptions: 5, HeartbeatInterval: 30000}}
+
+	var welcome map[string]interface{}
+	assert.NoError(t, json.Unmarshal(welcomeMessage(&client), &welcome))
+	assert.Equal(t, "welcome", welcome["action"])
+	assert.Equal(t, "abc", welcome["clientId"])
+	assert.Equal(t, 5.0, welcome["limits"].(map[string]interface{})["maxSubscriptions"])
+	assert.Equal(t, 30000.0, welcome["limits"].(map[string]interface{})["heartbeatIntervalMs"])
+}
+
+func TestSubscriptionLimitIsEnforced(t *testing.T) {
+	ps := &PubSub{}
+	client, peer := newTestClient(t)
+	client.Limits.MaxSubscriptions = 1
+
+	ps.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"a"}`))
+	ps.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"a"}`))
+	ps.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"b"}`))
+
+	assert.Len(t, ps.Subscriptions(), 1)
+	var reply map[string]string
+	assert.NoError(t, peer.ReadJSON(&reply))
+	assert.Equal(t, "subscription_limit", reply["code"])
+	assert.Equal(t, "b", reply["topic"])
+}
+
+func TestMaxMessageSizeIsEnforced(t *testing.T) {
+	options := isolatePubSub(t)
+	options.defaultLimits = Limits{MaxMessageSize: 64}
+
+	server := httptest.NewServer(http.HandlerFunc(ps.webSocketHandler))
+	defer server.Close()
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	assert.NoError(t, err)
+	defer ws.Close()
+	_, _, err = ws.ReadMessage()
+	assert.NoError(t, err, "Should read the welcome frame")
+
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"action":"publish","topic":"news","message":"`+strings.Repeat("x", 64)+`"}`))
+	var reply map[string]interface{}
+	assert.NoError(t, ws.ReadJSON(&reply))
+	assert.Equal(t, "message_too_large", reply["code"])
+	assert.Equal(t, 64.0, reply["limit"])
+
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"action":"unsubscribe","topic":"news"}`))
+	_, message, err := ws.ReadMessage()
+	assert.NoError(t, err, "Oversized messages should not close the connection")
+	assert.Equal(t, "Server received the message!", string(message))
+
+	ws.WriteMessage(websocket.TextMessage, make([]byte, 64+messageSizeSlack+1))
+	_, _, err = ws.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseMessageTooBig), "Frames far over the limit should close the connection")
+}
@@ -0,0 +1,62 @@
+// This file configures the structured, leveled logger every part of the server logs
+// through, as text for people or as JSON for log aggregation.
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Keys of the attributes identifying what a log line is about
+const (
+	logKeyClient = "client_id"
+	logKeyTopic  = "topic"
+	logKeyAction = "action"
+)
+
+// Function to make the default logger, which the log package writes through as well,
+// log at a level and in a format.
+// Parameters:
+// level: string - debug, info, warn or error.
+// format: string - text or json.
+// w: io.Writer - Where log lines are written.
+// Returns:
+// error - An error if the level or format is unknown.
+func configureLogging(level string, format string, w io.Writer) error {
+	var logLevel slog.Level
+	if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("unknown log level %q", level)
+	}
+	options := &slog.HandlerOptions{Level: logLevel}
+
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "text":
+		handler = slog.NewTextHandler(w, options)
+	case "json":
+		handler = slog.NewJSONHandler(w, options)
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// Function to get a logger adding the ID of a client to every line.
+// Returns:
+// *slog.Logger - The logger.
+func (client *Client) logger() *slog.Logger {
+	return slog.With(logKeyClient, client.Id)
+}
+
+// Function to log an error the server cannot start with and exit.
+// Parameters:
+// msg: string - What failed.
+// err: error - The error.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// syncBuffer collects log lines written by any goroutine.
+type syncBuffer struct {
+	buffer bytes.Buffer
+	mu     sync.Mutex
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.String()
+}
+
+func TestConfigureLogging(t *testing.T) {
+	t.Cleanup(func() { configureLogging("info", "text", os.Stderr) })
+
+	var buffer syncBuffer
+	assert.NoError(t, configureLogging("warn", "json", &buffer))
+	client := Client{Id: "c1"}
+	client.logger().Info("Not logged below the level")
+	client.logger().Warn("Client reached its subscription limit", logKeyAction, SUBSCRIBE, logKeyTopic, "news")
+
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	assert.Len(t, lines, 1, "Lines below the level should be dropped")
+	var line map[string]any
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &line))
+	assert.Equal(t, "WARN", line["level"])
+	assert.Equal(t, "c1", line[logKeyClient])
+	assert.Equal(t, SUBSCRIBE, line[logKeyAction])
+	assert.Equal(t, "news", line[logKeyTopic])
+
+	assert.Error(t, configureLogging("loud", "text", &buffer))
+	assert.Error(t, configureLogging("info", "xml", &buffer))
+}
+
+func TestHandleRecvdMessageLogsClientTopicAndAction(t *testing.T) {
+	var buffer syncBuffer
+	configureLogging("debug", "text", &buffer)
+	t.Cleanup(func() { configureLogging("info", "text", os.Stderr) })
+
+	pubsub := &PubSub{}
+	pubsub.HandleRecvdMessage(Client{Id: "c2"}, 1, []byte(`{"action":"unsubscribe","topic":"sports"}`))
+
+	assert.Contains(t, buffer.String(), "client_id=c2")
+	assert.Contains(t, buffer.String(), "action=unsubscribe")
+	assert.Contains(t, buffer.String(), "topic=sports")
+}
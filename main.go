@@ -2,45 +2,205 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"log/slog"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	//"goproject/go-chan/pubsub"
-	"log"
 	"net/http"
+	"os"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/websocket"
 	"github.com/satori/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"mywebsocketserver/matchmaking"
 )
 
-// Define an upgrader to upgrade the basic HTTP connection to a websocket
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin:     func(r *http.Request) bool { return true },
+type PubSub struct {
+	Topics     map[string]*Topic
+	Bridges    []Bridge
+	History    *MemoryHistory
+	Reports    ReportStore
+	Moderation *Moderation
+	Scanning   *ContentScanning
+	Presence   *PresenceRegistry
+	// Learns the schemas of topics and detects drift, if topics are monitored
+	Schemas *SchemaMonitor
+	// Where the history of expired topics is exported, if anywhere
+	Archive ArchiveSink
+	// Archives the history of selected topics to object storage and reads it back, if configured
+	Archiver *HistoryArchiver
+	// Groups the clients waiting in lobbies into matches, if lobbies are configured
+	Matchmaking *matchmaking.Matchmaker
+	// Transports of the webhooks, by ID
+	webhooks map[string]*webhookTransport
+	// Reads of the history requested by clients, coalesced while in flight
+	historyReads historyReadGroup
+	// Joins and leaves waiting to be announced once ps.mu is released
+	presenceChanges []presenceChange
+	// Captures of the frames of connections, by client ID
+	debugCaptures map[string]*debugCapture
+	// Whether each user is online
+	status statusTracker
+	// Handlers of the requests the server answers itself, by topic
+	rpcHandlers atomic.Pointer[map[string]RPCHandler]
+	// Orders the deliveries to each topic, if read-your-writes consistency is enabled
+	sequencer *topicSequencer
+	// Topics must be created before they are used, instead of being created by their first use
+	ExplicitTopics bool
+	// Samples the messages of selected topics into an analytics sink, if configured
+	Analytics *Analytics
+	// When the messages of QoS 1 subscriptions are delivered again
+	Redelivery RedeliveryPolicy
+	// Durable subscriptions waiting for their principals to connect, if kept
+	Lifetimes *SubscriptionStore
+	// Sessions of disconnected clients waiting to be resumed, if sessions can be resumed
+	Sessions *SessionStore
+	// Messages of QoS 1 subscriptions waiting to be acknowledged
+	inflight inflightTracker
+	// Interceptors of the frames received from clients and of the deliveries of messages
+	inbound  atomic.Pointer[[]Interceptor]
+	outbound atomic.Pointer[[]Interceptor]
+	// Options of the server, read by its handlers and clients
+	opts        *serverOptions
+	optionsOnce sync.Once
+	// Callbacks of embedders run on the lifecycle of clients
+	callbacks lifecycleCallbacks
+	// Delivers the messages of topics with many subscribers in parallel, if configured
+	FanOut *FanOutPool
+	// Shards of the state of the topics and of the clients, created on first use
+	RegistryShards  int
+	shards          []*registryShard
+	clientShardList []*clientShard
+	registryOnce    sync.Once
+	// Order of the subscriptions and of the connections, and the number of connected clients
+	subscriptionSeq atomic.Uint64
+	clientSeq       atomic.Uint64
+	clientCount     atomic.Int64
+	// IDs of the connected clients, with a channel closed once their connection was torn down
+	heldClientIDs map[string]chan struct{}
+	// Guards the state above but the registry shards, whose locks are taken after it, and
+	// orders the changes to subscriptions and topics. Publishing never takes it. It is
+	// never held while adding or removing clients nor while running the callbacks of
+	// embedders, so they may call back into the PubSub. The state stays behind locks
+	// rather than being owned by a single hub goroutine, which every publish, subscribe
+	// and disconnect would have to wait for in turn.
+	mu sync.Mutex
 }
 
-type PubSub struct {
-	Clients       []Client
-	Subscriptions []Subscription
-	mu            sync.Mutex
+// Bridge relays messages published on this server to other server instances.
+type Bridge interface {
+	Relay(ctx context.Context, id string, topic string, message []byte) error
 }
 
 type Client struct {
 	Id         string
 	Connection *websocket.Conn
+	Language   string
+	Transport  Transport
+	Claims     jwt.MapClaims
+	Limits     Limits
+	// Queue of the messages waiting to be written to the connection, if any
+	Outbox *Outbox
+	// Codec compressing the frames of the connection, if the client asked for one
+	Compression Compressor
+	// Codec encoding the frames of the connection, if the client asked for one
+	Codec EnvelopeCodec
+	// Display name and attributes the client gave, if it is connected over a WebSocket
+	Metadata *ClientMetadata
+	// When the connection was opened and last active, if the client is connected
+	Session *Session
+	// Whether the frames of the client are decoded strictly
+	StrictJSON bool
+	// Connection of the client, if it is connected over the plain TCP listener
+	Stream *StreamConn
+	// Message published on behalf of the client if its connection drops, if it registered one
+	Will *Will
+	// Options of the server the client is connected to, if any
+	server *serverOptions
+}
+
+// Transport delivers messages to clients that are not connected over a WebSocket.
+type Transport interface {
+	Deliver(topic string, message []byte) error
 }
 
 type Message struct {
-	Action  string          `json:"action"`
-	Topic   string          `json:"topic"`
-	Message json.RawMessage `json:"message"`
+	Action    string          `json:"action"`
+	Topic     string          `json:"topic"`
+	Message   json.RawMessage `json:"message"`
+	Principal string          `json:"principal,omitempty"`
+	Publisher string          `json:"publisher,omitempty"`
+	Policy    json.RawMessage `json:"policy,omitempty"`
+	Grant     string          `json:"grant,omitempty"`
+	TTL       int             `json:"ttl,omitempty"`
+	Id        string          `json:"id,omitempty"`
+	Reason    string          `json:"reason,omitempty"`
+	Envelope  bool            `json:"envelope,omitempty"`
+	// Binary message of a publish, base64 encoded, sent instead of Message
+	Data []byte `json:"data,omitempty"`
+	// Milliseconds between the stats frames of a subscription, 0 for none
+	StatsInterval int64 `json:"statsInterval,omitempty"`
+	// W3C trace context of the message, e.g. {"traceparent": "00-..."}
+	Trace map[string]string `json:"trace,omitempty"`
+	// Range of a history request: the messages after the message Since, at most Limit
+	Since string `json:"since,omitempty"`
+	Limit int    `json:"limit,omitempty"`
+	// Where a subscription starts delivering: latest, earliest, a sequence or an RFC 3339 time
+	Start string `json:"start,omitempty"`
+	// Where the replies to a request go and the ID matching them to it
+	ReplyTo       string `json:"replyTo,omitempty"`
+	CorrelationId string `json:"correlationId,omitempty"`
+	// Display name and attributes of a hello frame
+	Name       string            `json:"name,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	// Users of a status request
+	Users []string `json:"users,omitempty"`
+	// Delivery guarantee of a subscription: 0 at most once, 1 at least once
+	QoS int `json:"qos,omitempty"`
+	// The publisher of a publish, or the client of a subscription, receives none of its own messages
+	NoEcho bool `json:"noEcho,omitempty"`
+	// How long a subscription outlives its connection: connection, session or durable
+	Lifetime string `json:"lifetime,omitempty"`
+	// Version of the protocol a hello frame asks to speak
+	Version int `json:"version,omitempty"`
+	// Topics of a batch subscribe or unsubscribe, sent instead of Topic
+	Topics []string `json:"topics,omitempty"`
+	// Expression selecting the messages a subscription receives
+	Filter string `json:"filter,omitempty"`
 }
 
 type Subscription struct {
 	Topic  string
 	Client *Client
+	// Deliver messages wrapped in an envelope carrying their ID instead of as is
+	Envelope bool
+	// Counters streamed to the client, if it asked for them
+	Stats *SubscriptionStats
+	// Admitted by an invitation of the owner of the topic rather than its policy
+	Invited bool
+	// When the subscription expires unless refreshed, zero for never
+	ExpiresAt time.Time
+	expiry    *time.Timer
+	// Messages are delivered at least once, in envelopes to acknowledge, when 1
+	QoS int
+	// The messages the client published are not delivered back to it
+	NoEcho bool
+	// How long the subscription outlives its connection, "" for the connection only
+	Lifetime SubscriptionLifetime
+	// Only the messages the filter selects are delivered, nil for all
+	Filter *Filter
+	// Order in which the subscriptions were made, across topics
+	seq uint64
 }
 
 const (
@@ -60,59 +220,272 @@ func autoId() string {
 	fmt.Fprintf(w, "Welcome to the Home Page of the Server!")
 }*/
 
-var ps = &PubSub{}
-
 // Function to set up a basic HTTP server that listens on port 8080
 // and upgrade incoming WebSocket connections. It handles WebSocket 
 // connection requests and upgrades them using the Upgrader method.
 // Parameters:
 // w: http.ResponseWriter - The response writer to write HTTP responses.
 // r: *http.Request - The incoming HTTP request.
-func webSocketHandler(w http.ResponseWriter, r *http.Request) {
+func (ps *PubSub) webSocketHandler(w http.ResponseWriter, r *http.Request) {
+	options := ps.options()
+
+	// Refuse new connections once the server shuts down
+	if ps.rejectDuringShutdown(w) {
+		return
+	}
+
+	// Refuse browsers on origins that are not allowed
+	if options.rejectOrigin(w, r) {
+		return
+	}
+
+	ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer.Start(ctx, "websocket.upgrade", trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("remote_addr", r.RemoteAddr)))
+
+	// Authenticate the request before upgrading it
+	claims, err := options.authenticate(r)
+	if err != nil {
+		slog.Warn("Rejected WebSocket upgrade", "remote_addr", r.RemoteAddr, "error", err)
+		writeUnauthorized(w, err)
+		endSpan(span, err)
+		return
+	}
+	// Widget tokens are only valid on the widget endpoint, which pins their origin
+	if isWidgetToken(claims) {
+		slog.Warn("Rejected WebSocket upgrade", "remote_addr", r.RemoteAddr, "error", errWidgetToken)
+		writeUnauthorized(w, errWidgetToken)
+		endSpan(span, errWidgetToken)
+		return
+	}
+
+	ps.serveWebSocket(ctx, span, w, r, &options.upgrader, claims)
+}
+
+// Function to upgrade an authenticated request to a WebSocket connection and serve
+// its client until it disconnects.
+// Parameters:
+// ctx: context.Context - The context of the upgrade span.
+// span: trace.Span - The upgrade span, ended once the client is added.
+// w: http.ResponseWriter - The response writer to write HTTP responses.
+// r: *http.Request - The incoming HTTP request.
+// upgrader: *websocket.Upgrader - The upgrader of the endpoint.
+// claims: jwt.MapClaims - The verified claims of the client, or nil.
+func (ps *PubSub) serveWebSocket(ctx context.Context, span trace.Span, w http.ResponseWriter, r *http.Request, upgrader *websocket.Upgrader, claims jwt.MapClaims) {
+	options := ps.options()
+	// Refuse the connection once the server, or its IP, holds as many as it may
+	ip := options.clientIP(r)
+	if err := options.connections.acquire("websocket", ip); err != nil {
+		slog.Info("Refused WebSocket connection", "remote_addr", r.RemoteAddr, "ip", ip, "error", err)
+		rejectConnection(w, err)
+		endSpan(span, err)
+		return
+	}
+	defer options.connections.release(ip)
+
+	// Pick the codec the client asked to compress the connection with
+	compression, err := negotiateCompression(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		endSpan(span, err)
+		return
+	}
+	// Read the display name and attributes the client gave
+	metadata, err := metadataFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		endSpan(span, err)
+		return
+	}
+	// and the will to publish if its connection drops
+	will, err := willFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		endSpan(span, err)
+		return
+	}
+	// and the ID to give it
+	id, err := options.newClientID(r, claims)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		endSpan(span, err)
+		return
+	}
+	// Pick the codec the client asked to encode the connection with
+	codec := negotiateCodec(r)
+	// and the version of the protocol it speaks
+	version, versionToken := negotiateVersion(r)
+	responseHeader := http.Header{}
+	if compression != nil {
+		responseHeader.Set(compressionHeader, compression.Name())
+	}
+	if codec != nil {
+		responseHeader.Set(subprotocolHeader, codec.Name())
+	} else if versionToken != "" {
+		responseHeader.Set(subprotocolHeader, versionToken)
+	}
 
 	//fmt.Fprintf(w, "Hello WebSocket!")
 	//Upgrade this connection to a WebSocket connection
-	ws, err := upgrader.Upgrade(w, r, nil)
+	ws, err := upgrader.Upgrade(w, r, responseHeader)
 	if err != nil {
-		log.Println(err)
+		slog.Warn("WebSocket upgrade failed", "remote_addr", r.RemoteAddr, "error", err)
+		endSpan(span, err)
+		return
 	}
+	// Frames are compressed at the configured level if the client negotiated permessage-deflate
+	ws.SetCompressionLevel(options.permessageDeflateLevel)
 
-	// Create a client and assign it a Unique ID
+	// Create a client and assign it the ID the provider decides
 	client := Client{
-		Id:         autoId(),
-		Connection: ws,
+		Id:          id,
+		Connection:  ws,
+		Language:    parseLanguage(r.Header.Get("Accept-Language")),
+		Claims:      claims,
+		Limits:      options.limitsFor(claims),
+		Compression: compression,
+		Codec:       codec,
+		Metadata:    metadata,
+		Session:     NewSession(r.RemoteAddr),
+		StrictJSON:  options.strictJSONEndpoints[r.URL.Path],
+		server:      options,
+	}
+
+	// Every write goes through the client's queue so a slow reader never blocks publishers
+	client.Outbox = NewOutbox(&client, options.sendQueueSize, options.slowConsumerPolicy, options.slowStart)
+	defer client.Outbox.Close()
+
+	// Clients offering only versions of the protocol the server does not speak are closed
+	if version == 0 {
+		slog.Info("Closing client speaking an unsupported protocol version", logKeyClient, client.Id, "protocols", websocket.Subprotocols(r))
+		client.Close(ReasonUnsupportedVersion)
+		span.End()
+		return
+	}
+	client.Session.setProtocolVersion(version)
+	// A client presenting the token of its earlier session gets it back
+	resumed := ps.resumeSession(&client, r.URL.Query().Get(resumeParam))
+	// A connection already holding the ID is replaced by this one
+	releaseID, err := ps.claimClientID(client.Id)
+	if err != nil {
+		slog.Info("Refused WebSocket client whose ID is in use", logKeyClient, client.Id, "error", err)
+		client.Close(ReasonTryAgainLater)
+		span.End()
+		return
 	}
+	defer releaseID()
 
-	// Send a message to the client
-	fmt.Printf("Client Connected:%s", client.Id)
-	err = ws.WriteMessage(1, []byte("Hi Client!"))
+	// Send the welcome frame with the client's ID and limits
+	logger := client.logger()
+	logger.Info("Client connected", "principal", client.Principal(), "remote_addr", r.RemoteAddr)
+	err = client.Send(welcomeMessage(&client))
 	if err != nil {
-		log.Println(err)
+		logger.Error("Error sending welcome message", "error", err)
 	}
+	client.Will = ps.registerWill(&client, will)
 
-	// Add client to the list of clients
+	// Add client to the list of clients, and remove it with its subscriptions on disconnect
 	ps.AddClient(client)
+	defer ps.RemoveClient(client)
+	defer ps.StopDebugCapture(client.Id)
+	ps.userConnected(client.Principal())
+	defer ps.userDisconnected(client.Principal(), options.statusGracePeriod)
+	defer ps.publishWill(&client)
+	ps.restoreSession(&client, resumed)
+	ps.restoreDurableSubscriptions(&client)
+	span.SetAttributes(attribute.String(logKeyClient, client.Id))
+	span.End()
+
+	// Frames far over the size limit are refused while being read and close the connection
+	if limit := client.Limits.readLimit(); limit > 0 {
+		ws.SetReadLimit(limit)
+	}
 
+	// Ping the client so a dead connection is noticed and reaped
+	heartbeat := client.Limits.heartbeat()
+	if heartbeat > 0 {
+		stop := startHeartbeat(&client, heartbeat)
+		defer stop()
+	}
+	ws.SetReadDeadline(deadlineAfter(readWait(options.readTimeout, heartbeat)))
+
+	limiter := newRateLimiter(client.Limits)
 	// Listen indefinitely for new messages coming through on our WebSocket connection
 	for {
 		// Read in a message
 		messageType, p, err := ws.ReadMessage()
 		if err != nil {
-			log.Println(err)
+			logger.Info("Client disconnected", "error", err)
+			if isHeartbeatTimeout(err) {
+				// Without heartbeats, the read timeout passed
+				reason := ReasonHeartbeatTimeout
+				if heartbeat == 0 {
+					reason = ReasonIdleTimeout
+				}
+				client.Close(reason)
+			}
+			// Clients closing normally discard their will
+			if expectedDisconnect(err) {
+				client.Will = nil
+			}
 			return
 		}
-		// Print out the message for clarity
-		log.Println(string(p))
+		client.Session.Touch()
+		// Any message shows the connection is alive, like a pong
+		ws.SetReadDeadline(deadlineAfter(readWait(options.readTimeout, heartbeat)))
+		// Every frame starts its own trace, linked to the upgrade of the connection
+		receiveCtx, receiveSpan := tracer.Start(context.Background(), "websocket.receive",
+			trace.WithNewRoot(), trace.WithLinks(trace.LinkFromContext(ctx)),
+			trace.WithAttributes(attribute.String(logKeyClient, client.Id), attribute.Int("size", len(p))))
+		// Refuse frames over the size limit without processing them
+		if max := client.Limits.MaxMessageSize; max > 0 && int64(len(p)) > max {
+			client.Send(messageTooLargeMessage(max))
+			receiveSpan.End()
+			continue
+		}
+		// Drop frames over the rate limit, and close clients that keep sending them
+		if admitted, closed := limiter.admit(&client, time.Now()); !admitted {
+			receiveSpan.End()
+			if closed {
+				return
+			}
+			continue
+		}
+
+		// Binary frames of a compressed connection carry compressed messages
+		if messageType == websocket.BinaryMessage && client.Compression != nil {
+			if p, err = client.Compression.Decompress(p); err != nil {
+				logger.Warn("Error decompressing message", "error", err)
+				receiveSpan.End()
+				continue
+			}
+			messageType = websocket.TextMessage
+		}
+		// Frames of a connection with a codec are translated to JSON
+		if client.Codec != nil {
+			if p, err = client.Codec.Decode(p); err != nil {
+				logger.Warn("Error decoding message", "codec", client.Codec.Name(), "error", err)
+				receiveSpan.End()
+				continue
+			}
+			messageType = websocket.TextMessage
+		}
+
+		// Log the message for clarity
+		logger.Debug("Received message", "message", string(p))
+		client.Session.capture(debugInbound, p)
 
 		// Send a message indicating the message was received
 		response := []byte("Server received the message!")
-		if err := ws.WriteMessage(messageType, response); err != nil {
-			log.Println(err)
+		if err := client.Send(response); err != nil {
+			logger.Error("Error sending message", "error", err)
+			endSpan(receiveSpan, err)
 			return
 		}
 
 		// Call the handler to handle the received message from the client
-		ps.HandleRecvdMessage(client, messageType, p)
+		ps.HandleRecvdMessageContext(receiveCtx, client, messageType, p)
+		receiveSpan.End()
 
 		//fmt.Printf("New message from client:%s", p)
 
@@ -121,24 +494,46 @@ func webSocketHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // Function to configure and handle the HTTP routes for the server.
-// It sets up two routes: one for serving static files and another for handling
-// WebSocket connections. The static route serves files from the "static" directory
-// and the WebSocket route uses the webSocketHandler function to handle incoming
-// WebSocket connections. 
-func setupRoutes() {
-  // Serve static files from the static directory
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, "static")
+// It sets up three routes: one for serving static files, another for handling
+// WebSocket connections and one exposing Prometheus metrics. The static route serves
+// files from the static directory and the WebSocket route uses the webSocketHandler
+// method of the PubSub to handle incoming WebSocket connections.
+// Parameters:
+// mux: *http.ServeMux - The mux to register the routes on.
+// pubsub: *PubSub - The PubSub the routes serve.
+// staticDir: string - The directory of the static files.
+// metricsPath: string - The path of the metrics, or "" to not serve them.
+func setupRoutes(mux *http.ServeMux, pubsub *PubSub, staticDir string, metricsPath string) {
+	// Serve static files from the static directory
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, staticDir)
 	})
-  // Handle WebSocket connections using the webSocketHandler function
-	http.HandleFunc("/ws", webSocketHandler)
+	// Handle WebSocket connections using the webSocketHandler method
+	mux.HandleFunc("/ws", pubsub.webSocketHandler)
+	// Expose metrics for monitoring, with the activity of the topics of this server
+	if metricsPath != "" {
+		mux.Handle(metricsPath, pubsub.metricsHandler())
+	}
 }
 
 func main() {
-	fmt.Println("This is the main function of the server")
-	setupRoutes()
-	if err := http.ListenAndServe(":8080", nil); err != nil {
-		log.Fatal(err)
+	config, err := LoadConfig(os.Args[1:], os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fatal("Invalid configuration", err)
+	}
+	if err := configureLogging(config.LogLevel, config.LogFormat, os.Stderr); err != nil {
+		fatal("Invalid configuration", err)
+	}
+	slog.Info("Starting the server", "addr", config.ListenAddr)
+	server, err := New(WithConfig(config))
+	if err != nil {
+		fatal("Error setting up the server", err)
+	}
+	if err := server.Run(); err != nil {
+		fatal("Server stopped", err)
 	}
 }
 
@@ -148,12 +543,11 @@ func main() {
 // Returns:
 // *PubSub - A pointer to the updated PubSub instance after adding the client.
 func (ps *PubSub) AddClient(client Client) *PubSub {
-	ps.mu.Lock()
-	defer ps.mu.Unlock()
-	ps.Clients = append(ps.Clients, client)
-	fmt.Println("Adding new client to the list", client.Id, len(ps.Clients))
-	payload := []byte("Hello Client ID" + client.Id)
-	client.Connection.WriteMessage(1, payload)
+	// Only the shard of the client is locked
+	clients := ps.addConnectedClient(client)
+	client.logger().Debug("Adding new client to the list", "clients", clients)
+
+	ps.clientConnected(&client)
 	return ps
 }
 
@@ -164,22 +558,47 @@ func (ps *PubSub) AddClient(client Client) *PubSub {
 // *PubSub - A pointer to the updated PubSub instance after removing the client.
 func (ps *PubSub) RemoveClient(client Client) *PubSub {
 	ps.mu.Lock()
-	defer ps.mu.Unlock()
 
-	// first remove all subscriptions by this client
+	// first remove all subscriptions by this client, visiting only its topics
+
+	var left []string
+	var removed []Subscription
+	for _, topic := range ps.clientTopics(client.Id) {
+		removed = append(removed, ps.removeSubscriptionsLocked(topic, func(sub Subscription) bool {
+			return sub.Client.Id == client.Id
+		})...)
+	}
+	sortSubscriptions(removed)
+	for _, sub := range removed {
+		sub.Stats.Stop()
+		sub.stopExpiry()
+		ps.presenceChangedLocked(LEFT, sub.Client, sub.Topic)
+		left = append(left, sub.Topic)
+	}
+	ps.leaveWaitlistLocked(&client, "")
+	ps.forgetDeliveriesOf(client.Id)
 
-	for index, sub := range ps.Subscriptions {
+	ps.removeConnectedClients(client.Id)
 
-		if client.Id == sub.Client.Id {
-			ps.Subscriptions = append(ps.Subscriptions[:index], ps.Subscriptions[index+1:]...)
-		}
+	// The places the client held in rooms go to the clients waiting for them
+	promoted := map[string][]*Client{}
+	for _, topic := range left {
+		promoted[topic] = ps.promoteLocked(topic)
 	}
+	subscribed := ps.takeSubscribedLocked()
+	ps.mu.Unlock()
 
-	for i, cl := range ps.Clients {
-		if cl.Id == client.Id {
-			ps.Clients = append(ps.Clients[:i], ps.Clients[i+1:]...)
-		}
+	for topic, clients := range promoted {
+		notifyPromoted(topic, clients)
 	}
+	ps.runSubscribeCallbacks(subscribed)
+	if ps.Matchmaking != nil {
+		ps.Matchmaking.LeaveAll(client.Id)
+	}
+	// Session subscriptions wait for the client to resume its session
+	ps.suspendSession(&client, removed)
+	ps.announcePresence()
+	ps.clientDisconnected(&client)
 	return ps
 }
 
@@ -187,12 +606,13 @@ func (ps *PubSub) RemoveClient(client Client) *PubSub {
 // Parameters:
 // message: []byte - The message to be broadcasted to all clients.
 func (ps *PubSub) broadcast(message []byte) {
-	ps.mu.Lock()
-	defer ps.mu.Unlock()
-	for _, client := range ps.Clients {
-		err := client.Connection.WriteMessage(1, message)
-		if err != nil {
-			log.Println("Error writing message:", err)
+	clients := ps.Clients()
+
+	payload := NewPayload(message)
+	for _, client := range clients {
+		err := client.DeliverPayload("", payload)
+		if err != nil && !errors.Is(err, errMessageDropped) {
+			client.logger().Error("Error writing message", "error", err)
 			ps.RemoveClient(client)
 		}
 	}
@@ -203,7 +623,13 @@ func (ps *PubSub) GetSubscriptions(topic string, client *Client) []Subscription
 
 	var subscriptionList []Subscription
 
-	for _, subscription := range ps.Subscriptions {
+	// Only the subscriptions to the topic are looked at
+	indexed := ps.topicSubscriptions(topic)
+	if client == nil && len(indexed) > 0 {
+		return append(make([]Subscription, 0, len(indexed)), indexed...)
+	}
+
+	for _, subscription := range indexed {
 
 		if client != nil {
 
@@ -224,64 +650,526 @@ func (ps *PubSub) GetSubscriptions(topic string, client *Client) []Subscription
 
 // Function to subscribe to a topic
 func (ps *PubSub) Subscribe(client *Client, topic string) *PubSub {
+	return ps.SubscribeWith(client, topic, SubscribeOptions{})
+}
+
+// SubscribeOptions are the options a client can give when subscribing.
+type SubscribeOptions struct {
+	Envelope bool
+	// How often to send stats frames for the subscription, 0 for never
+	StatsInterval time.Duration
+	// Where delivery starts, nil for the next published message
+	Start *StartPosition
+	// Archived messages from Start, read before ps.mu was taken
+	archived []HistoryEntry
+	// Admitted by an invitation of the owner of the topic rather than its policy
+	Invited bool
+	// How long until the subscription expires unless refreshed, 0 for never
+	TTL time.Duration
+	// Delivery guarantee, 1 for at least once
+	QoS int
+	// The messages the client publishes are not delivered back to it
+	NoEcho bool
+	// How long the subscription outlives its connection, "" for the connection only
+	Lifetime SubscriptionLifetime
+	// Only the messages the filter selects are delivered, nil for all
+	Filter *Filter
+}
+
+// Function to subscribe to a topic with options
+func (ps *PubSub) SubscribeWith(client *Client, topic string, options SubscribeOptions) *PubSub {
+	// Nothing is delivered to the topic between the replay and the subscription
+	if options.Start != nil {
+		defer ps.sequence(topic)()
+	}
+	ps.mu.Lock()
+	// The join is announced once ps.mu is released
+	defer ps.announcePresence()
+	defer ps.unlockRunningSubscribeCallbacks()
+
+	ps.subscribeLocked(client, topic, options)
+
+	return ps
+}
+
+// Function to subscribe to a topic with options. The caller must hold ps.mu.
+// Parameters:
+// client: *Client - The subscribing client.
+// topic: string - The topic.
+// options: SubscribeOptions - The options of the subscription.
+func (ps *PubSub) subscribeLocked(client *Client, topic string, options SubscribeOptions) {
 
 	clientSubs := ps.GetSubscriptions(topic, client)
 
 	if len(clientSubs) > 0 {
 
-		// client is subscribed this topic before
+		// client is subscribed this topic before, subscribing again refreshes its expiry
+		ps.updateSubscriptionsLocked(topic, client.Id, func(sub *Subscription) {
+			if options.TTL > 0 || !clientSubs[0].ExpiresAt.IsZero() {
+				ps.setExpiryLocked(sub, options.TTL)
+			}
+			// and changes its lifetime if it names one
+			if options.Lifetime != "" {
+				sub.Lifetime = options.Lifetime
+			}
+			// and replaces its filter if it names one
+			if options.Filter != nil {
+				sub.Filter = options.Filter
+			}
+		})
 
-		return ps
+		return
 	}
 
 	newSubscription := Subscription{
-		Topic:  topic,
-		Client: client,
+		Topic:    topic,
+		Client:   client,
+		Envelope: options.Envelope,
+		Invited:  options.Invited,
+		QoS:      options.QoS,
+		NoEcho:   options.NoEcho,
+		Lifetime: options.Lifetime,
+		Filter:   options.Filter,
+	}
+	if options.StatsInterval > 0 {
+		newSubscription.Stats = NewSubscriptionStats(options.StatsInterval)
+		newSubscription.Stats.Start(client, topic)
+	}
+	// Earlier messages are delivered first, before the subscription receives any other
+	if options.Start != nil {
+		ps.replayLocked(client, topic, options)
 	}
 
-	ps.Subscriptions = append(ps.Subscriptions, newSubscription)
+	ps.setExpiryLocked(&newSubscription, options.TTL)
 
-	return ps
+	ps.addSubscriptionLocked(newSubscription)
+	ps.presenceChangedLocked(JOINED, client, topic)
+	ps.subscribedLocked(client, topic)
+	ps.recordActivity(topic)
 }
 
-// Function to publish to a topic
+// Function to publish to a topic. The message is given a unique ID, scanned if the
+// topic is scanned, then moderated.
 func (ps *PubSub) Publish(topic string, message []byte, excludeClient *Client) {
+	ps.PublishContext(context.Background(), topic, message, excludeClient)
+}
+
+// Function to publish to a topic as part of a trace.
+// Parameters:
+// ctx: context.Context - The context carrying the trace of the publish.
+// topic: string - The topic.
+// message: []byte - The message.
+// excludeClient: *Client - A client the message is not delivered to, usually its publisher, or nil.
+func (ps *PubSub) PublishContext(ctx context.Context, topic string, message []byte, excludeClient *Client) {
+
+	if excludeClient != nil {
+		ctx = withEchoSource(ctx, &echoSource{ClientId: excludeClient.Id, Exclude: true})
+	}
+	id := autoId()
+	ctx, span := tracer.Start(ctx, "pubsub.publish", trace.WithAttributes(
+		attribute.String(logKeyTopic, topic), attribute.String("message_id", id), attribute.Int("size", len(message))))
+	defer span.End()
 
-	subscriptions := ps.GetSubscriptions(topic, nil)
+	if ps.Analytics != nil {
+		ctx = ps.Analytics.Sample(ctx, topic)
+	}
+	if ps.Scanning != nil {
+		if policy, ok := ps.Scanning.PolicyFor(topic); ok {
+			ps.Scanning.Process(ctx, policy, id, topic, message)
+			return
+		}
+	}
+	ps.moderate(ctx, id, topic, message)
+}
 
-	for _, sub := range subscriptions {
+// Function to release a message, unless the topic is moderated, in which case it
+// is quarantined until reviewed.
+// Parameters:
+// ctx: context.Context - The context carrying the trace of the publish.
+// id: string - The ID of the message.
+// topic: string - The topic the message was published to.
+// message: []byte - The published message.
+func (ps *PubSub) moderate(ctx context.Context, id string, topic string, message []byte) {
+	if ps.Moderation != nil && ps.Moderation.Moderates(topic) {
+		ps.Moderation.Quarantine(ctx, id, topic, message)
+		return
+	}
+	ps.release(ctx, id, topic, message)
+}
 
-		fmt.Printf("Sending to client id %s message is %s \n", sub.Client.Id, message)
-		//sub.Client.Connection.WriteMessage(1, message)
+// Function to release a published message: it is delivered to the local subscribers
+// and relayed through every configured bridge.
+// Parameters:
+// ctx: context.Context - The context carrying the trace of the publish.
+// id: string - The ID of the message.
+// topic: string - The topic the message was published to.
+// message: []byte - The published message.
+func (ps *PubSub) release(ctx context.Context, id string, topic string, message []byte) {
+
+	if ps.Schemas != nil {
+		ps.Schemas.Observe(id, topic, message)
+	}
 
-		sub.Client.Send(message)
+	ps.deliver(ctx, id, topic, message)
+	if sample := analyticsSampleFrom(ctx); sample != nil && ps.Analytics != nil {
+		ps.Analytics.Record(sample, id, topic, message)
 	}
+	ps.answer(ctx, id, topic, message)
 
+	for _, bridge := range ps.Bridges {
+		if err := bridge.Relay(ctx, id, topic, message); err != nil {
+			slog.Error("Error relaying message", logKeyTopic, topic, "message_id", id, "error", err)
+		}
+	}
+}
+
+// Function to deliver a message to the subscribers of a topic connected to this server.
+// Parameters:
+// ctx: context.Context - The context carrying the trace of the publish.
+// id: string - The ID of the message, the same on every server.
+// topic: string - The topic the message was published to.
+// message: []byte - The message to be delivered.
+func (ps *PubSub) deliver(ctx context.Context, id string, topic string, message []byte) {
+	// The message is fanned out in the position the history gives it
+	defer ps.sequence(topic)()
+
+	// Recorded before the history grows, so collecting the topic as idle never drops the message
+	ps.recordActivity(topic)
+
+	// Replies are only for the requester connected now
+	if ps.History != nil && !isInbox(topic) {
+		if _, err := ps.History.Append(id, topic, message); err != nil {
+			slog.Error("Error storing message history", logKeyTopic, topic, "message_id", id, "error", err)
+		}
+	}
+
+	ps.fanOut(ctx, id, topic, message)
+}
+
+// Function to write a message to the subscribers of its topic without storing it in
+// the history.
+// Parameters:
+// ctx: context.Context - The context carrying the trace of the delivery.
+// id: string - The ID of the message.
+// topic: string - The topic.
+// message: []byte - The message.
+func (ps *PubSub) fanOut(ctx context.Context, id string, topic string, message []byte) {
+	payload := NewMessagePayload(message)
+	payload.undeflated = ps.deflateExcluded(topic)
+	ps.fanOutPayload(ctx, id, topic, payload)
+}
+
+// Function to write a payload to the subscribers of its topic.
+// Parameters:
+// ctx: context.Context - The context carrying the trace of the delivery.
+// id: string - The ID of the message.
+// topic: string - The topic.
+// payload: *Payload - The payload, shared by every subscriber.
+func (ps *PubSub) fanOutPayload(ctx context.Context, id string, topic string, payload *Payload) {
+	// Only the shard of the topic is locked, so publishes to other topics go on meanwhile
+	subscriptions := ps.topicSubscriptions(topic)
+	ps.countPublish(topic, len(payload.Data))
+	var outbound []Interceptor
+	if interceptors := ps.outbound.Load(); interceptors != nil {
+		outbound = *interceptors
+	}
+
+	ctx, span := tracer.Start(ctx, "pubsub.deliver", trace.WithAttributes(
+		attribute.String(logKeyTopic, topic), attribute.String("message_id", id), attribute.Int("subscribers", len(subscriptions))))
+	defer span.End()
+
+	// Every subscriber shares the same payload; the envelope is built once for all
+	// the subscribers asking for it
+	publication := &publication{ctx: ctx, span: span, id: id, topic: topic, payload: payload}
+	source := echoSourceFrom(ctx)
+	deliver := func(sub Subscription) {
+		if !source.suppresses(sub) {
+			ps.deliverPublication(publication, outbound, sub)
+		}
+	}
+	if ps.FanOut.parallel(len(subscriptions)) {
+		ps.FanOut.deliver(subscriptions, deliver)
+	} else {
+		for _, sub := range subscriptions {
+			deliver(sub)
+		}
+	}
+	// Subscribers that disconnected get the message when they resume their session
+	ps.queueOffline(ctx, id, topic, payload)
+
+}
+
+// Function to deliver a published message to a subscription.
+// Parameters:
+// p: *publication - The message.
+// outbound: []Interceptor - The outbound interceptors.
+// sub: Subscription - The subscription.
+func (ps *PubSub) deliverPublication(p *publication, outbound []Interceptor, sub Subscription) {
+	if sub.Filter != nil && !p.matches(sub.Filter) {
+		return
+	}
+
+	shared := p.payload
+	// Messages to acknowledge carry their ID
+	if sub.Envelope || sub.QoS > 0 {
+		shared = p.envelope()
+	}
+	if len(outbound) > 0 {
+		var delivered bool
+		if shared, delivered = interceptDelivery(p.ctx, outbound, sub, p.id, p.topic, p.payload, shared); !delivered {
+			return
+		}
+	}
+
+	// Each delivery gets a span only when the trace is sampled, so fanning out
+	// does not allocate per subscriber otherwise
+	var subscriberSpan trace.Span
+	if p.span.IsRecording() {
+		_, subscriberSpan = tracer.Start(p.ctx, "pubsub.deliver.subscriber",
+			trace.WithAttributes(attribute.String(logKeyClient, sub.Client.Id)))
+	}
+	var err error
+	if sub.Stats != nil {
+		err = sub.Client.deliverTracked(p.topic, shared, sub.Stats)
+	} else {
+		err = sub.Client.DeliverPayload(p.topic, shared)
+	}
+	if subscriberSpan != nil {
+		endSpan(subscriberSpan, err)
+	}
+	// Clients of other transports have no frame to acknowledge with
+	if sub.QoS > 0 && sub.Client.Transport == nil {
+		ps.trackDelivery(sub.Client, p.topic, p.id, shared, p.payload.Data)
+	}
 }
 
 // Function to send a message 
 func (client *Client) Send(message []byte) error {
 
+	client.Session.Sent()
+	if client.Outbox != nil {
+		return client.Outbox.Push(NewPayload(message))
+	}
+	if client.Stream != nil {
+		return client.Stream.WriteFrame(websocket.TextMessage, message)
+	}
+	if client.Compression != nil || client.Codec != nil {
+		return client.DeliverPayload("", NewPayload(message))
+	}
+	// Clients of other transports have no frame to be told with
+	if client.Transport != nil {
+		return nil
+	}
+	client.armWriteDeadline()
 	return client.Connection.WriteMessage(1, message)
 
 }
 
+// Function to deliver a message published to a topic, using the client's transport
+// when it is not connected over a WebSocket.
+func (client *Client) Deliver(topic string, message []byte) error {
+
+	if client.Transport != nil {
+		return client.Transport.Deliver(topic, message)
+	}
+	return client.Send(message)
+
+}
+
+// Function to subscribe a client to the topic of a subscribe frame.
+// Parameters:
+// ctx: context.Context - The context carrying the trace of the frame.
+// client: *Client - The client.
+// m: Message - The subscribe frame.
+// Returns:
+// TopicResult - Whether the client was subscribed, waitlisted or refused, and why.
+func (ps *PubSub) subscribeTopic(ctx context.Context, client *Client, m Message) TopicResult {
+	logger := client.logger().With(logKeyAction, m.Action, logKeyTopic, m.Topic)
+	refused := func(code string) TopicResult {
+		return TopicResult{Topic: m.Topic, Status: TopicError, Code: code}
+	}
+
+	// The presence of a topic is visible to the clients that may subscribe to it
+	access := m.Topic
+	if topic, ok := presenceTopicOf(m.Topic); ok {
+		access = topic
+	}
+	if !client.HasPermission(PermissionSubscribe) || !client.TopicAllowed(SUBSCRIBE, access) || !ps.aclAllows(client, SUBSCRIBE, access) {
+		return refused(codeForbidden)
+	}
+	// Debug captures may carry anyone's frames, dead letters anyone's messages, the honeypot
+	// anyone's probing, inboxes their client's replies
+	if !mayReadReserved(client, access) {
+		return refused(codeForbidden)
+	}
+
+	// A private topic also admits clients presenting an invitation from its owner
+	invited := false
+	if !ps.canAccessTopic(access, client, SUBSCRIBE) {
+		if ps.checkInvite(access, m.Grant, client) != nil {
+			return refused(codeForbidden)
+		}
+		invited = true
+	}
+
+	start, err := ParseStartPosition(m.Start)
+	if err != nil {
+		return refused("invalid_start")
+	}
+	if m.TTL < 0 {
+		return refused("invalid_ttl")
+	}
+	if m.QoS < 0 || m.QoS > 1 {
+		return refused("invalid_qos")
+	}
+	lifetime, err := ParseSubscriptionLifetime(m.Lifetime)
+	if err != nil {
+		return refused("invalid_lifetime")
+	}
+	filter, err := ParseFilter(m.Filter)
+	if err != nil {
+		logger.Info("Invalid filter", "error", err)
+		return refused("invalid_filter")
+	}
+	if code := ps.lifetimeRefusal(client, lifetime); code != "" {
+		return refused(code)
+	}
+
+	// Subscribing to a lobby waits for a match instead
+	if ps.isLobby(m.Topic) {
+		ps.joinLobby(client, m)
+		return TopicResult{Topic: m.Topic, Status: TopicLobby}
+	}
+
+	if !ps.canSubscribe(client, m.Topic) {
+		logger.Info("Client reached its subscription limit")
+		return refused("subscription_limit")
+	}
+
+	subscription := SubscribeOptions{
+		Envelope:      m.Envelope,
+		StatsInterval: time.Duration(m.StatsInterval) * time.Millisecond,
+		Start:         start,
+		Invited:       invited,
+		TTL:           time.Duration(m.TTL) * time.Second,
+		QoS:           m.QoS,
+		NoEcho:        m.NoEcho,
+		Lifetime:      lifetime,
+		Filter:        filter,
+	}
+	if subscription.archived, err = ps.archivedFrom(ctx, m.Topic, start); err != nil {
+		logger.Error("Error reading the archive", "error", err)
+		return refused("history_unavailable")
+	}
+
+	// A topic with a capacity admits subscribers while it has free places
+	result, position := ps.Join(client, m.Topic, subscription)
+	switch result {
+	case RoomFull:
+		logger.Info("Topic is full")
+		return refused("room_full")
+	case Waitlisted:
+		logger.Info("Client is waiting for a place in the topic", "position", position)
+		return TopicResult{Topic: m.Topic, Status: TopicWaitlisted, Position: position}
+	}
+	logger.Info("New subscriber to topic")
+	// Clients naming a lifetime are told it was granted
+	if m.Lifetime != "" {
+		ps.keepSubscription(client, StoredSubscription{Topic: m.Topic, Lifetime: lifetime, Envelope: m.Envelope, QoS: m.QoS, NoEcho: m.NoEcho, Filter: m.Filter})
+	}
+	return TopicResult{Topic: m.Topic, Status: TopicSubscribed, Lifetime: SubscriptionLifetime(m.Lifetime)}
+}
+
+// Function to answer a subscribe frame naming a single topic with the frame telling
+// its result, if any.
+// Parameters:
+// client: *Client - The client.
+// m: Message - The subscribe frame.
+// result: TopicResult - The result of the subscription.
+func (ps *PubSub) answerSubscribe(client *Client, m Message, result TopicResult) {
+	switch {
+	case result.Code == codeForbidden:
+		ps.refuse(client, m)
+	case result.Status == TopicError:
+		client.Send(errorMessage(result.Code, m.Topic))
+	case result.Status == TopicWaitlisted:
+		client.Send(waitlistedMessage(m.Topic, result.Position))
+	case result.Status == TopicSubscribed && result.Lifetime != "":
+		client.Send(subscribedMessage(m.Topic, result.Lifetime, false))
+	}
+}
+
 // Function to unsubscribe to a topic
 func (ps *PubSub) Unsubscribe(client *Client, topic string) *PubSub {
+	ps.unsubscribe(client, topic)
+	return ps
+}
 
-	//clientSubscriptions := ps.GetSubscriptions(topic, client)
-	for index, sub := range ps.Subscriptions {
+// Function to remove the subscription of a client to a topic, or take it off the
+// waitlist of the topic.
+// Parameters:
+// client: *Client - The client, of which only the ID is used.
+// topic: string - The topic.
+// Returns:
+// *Client - The client of the removed subscription, or nil if it was not subscribed.
+func (ps *PubSub) unsubscribe(client *Client, topic string) *Client {
+	ps.mu.Lock()
 
-		if sub.Client.Id == client.Id && sub.Topic == topic {
-			// found this subscription from client and we do need remove it
-			ps.Subscriptions = append(ps.Subscriptions[:index], ps.Subscriptions[index+1:]...)
+	//clientSubscriptions := ps.GetSubscriptions(topic, client)
+	var subscriber *Client
+	var lifetime SubscriptionLifetime
+	removed := ps.removeSubscriptionsLocked(topic, func(sub Subscription) bool {
+		return sub.Client.Id == client.Id
+	})
+	for _, sub := range removed {
+		// found this subscription from client and we do need remove it
+		sub.Stats.Stop()
+		sub.stopExpiry()
+		ps.presenceChangedLocked(LEFT, sub.Client, topic)
+		subscriber = sub.Client
+		lifetime = sub.Lifetime
+	}
+	ps.leaveWaitlistLocked(client, topic)
+	promoted := ps.promoteLocked(topic)
+	ps.recordActivity(topic)
+	subscribed := ps.takeSubscribedLocked()
+	ps.mu.Unlock()
+
+	notifyPromoted(topic, promoted)
+	ps.runSubscribeCallbacks(subscribed)
+	ps.announcePresence()
+
+	// An unsubscribed durable subscription is not restored any more
+	if lifetime == LifetimeDurable && ps.Lifetimes != nil {
+		if err := ps.Lifetimes.Forget(subscriber.Principal(), topic); err != nil {
+			subscriber.logger().Error("Error saving durable subscriptions", logKeyTopic, topic, "error", err)
 		}
 	}
 
-	return ps
+	return subscriber
 
 }
 
+// Function to check whether a client may publish to a topic.
+// Parameters:
+// client: *Client - The client.
+// topic: string - The topic.
+// Returns:
+// bool - False for the topics only the server publishes to and the topics the client is not allowed to publish to.
+func (ps *PubSub) mayPublish(client *Client, topic string) bool {
+	// Only the server announces presence and status, and publishes to its topics but
+	// for replies to inboxes
+	_, isPresence := presenceTopicOf(topic)
+	if isPresence || isStatusTopic(topic) || reservedTopic(topic) && !isInbox(topic) {
+		return false
+	}
+	if !client.HasPermission(PermissionPublish) || !client.TopicAllowed(PUBLISH, topic) || !ps.aclAllows(client, PUBLISH, topic) {
+		return false
+	}
+	// Anyone holding the address of an inbox may reply to it, without owning it
+	return isInbox(topic) || ps.canAccessTopic(topic, client, PUBLISH)
+}
+
 // Function to handle the messages received.
 // Parameters:
 // client: Client - The client from which the message was received.
@@ -290,42 +1178,223 @@ func (ps *PubSub) Unsubscribe(client *Client, topic string) *PubSub {
 // Returns:
 // *PubSub - A pointer to the PubSub instance after handling the received message.
 func (ps *PubSub) HandleRecvdMessage(client Client, messageType int, payload []byte) *PubSub {
+	return ps.HandleRecvdMessageContext(context.Background(), client, messageType, payload)
+}
+
+// Function to handle a received message as part of a trace. A message carrying a trace
+// context continues the client's trace.
+// Parameters:
+// ctx: context.Context - The context the message was received in.
+// client: Client - The client from which the message was received.
+// messageType: int - The type of the received message.
+// payload: []byte - The payload of the received message.
+// Returns:
+// *PubSub - A pointer to the PubSub instance after handling the received message.
+func (ps *PubSub) HandleRecvdMessageContext(ctx context.Context, client Client, messageType int, payload []byte) *PubSub {
+	// Binary frames of a client that bound a topic are published to it as is
+	if messageType == websocket.BinaryMessage {
+		if topic := client.Session.BoundTopic(); topic != "" {
+			ps.publishBound(ctx, &client, topic, payload)
+			return ps
+		}
+	}
+
 	m := Message{}
 
-	err := json.Unmarshal(payload, &m)
+	var err error
+	if client.StrictJSON {
+		err = decodeStrict(payload, &m)
+	} else {
+		err = json.Unmarshal(payload, &m)
+	}
 	if err != nil {
-		fmt.Println("This is not correct message payload")
+		client.logger().Warn("This is not correct message payload", "error", err)
+		// Strict endpoints tell the client which rule the frame broke
+		var strict *StrictJSONError
+		if errors.As(err, &strict) {
+			rejectedFrames.WithLabelValues(strict.Code).Inc()
+			client.Send(strictJSONMessage(strict))
+			return ps
+		}
+		rejectFrame(&client, codeBadPayload, "", err.Error())
+		return ps
+	}
+	ctx, options := messageContext(ctx, m.Trace)
+	ctx, span := tracer.Start(ctx, "message.handle", append(options, trace.WithAttributes(
+		attribute.String(logKeyClient, client.Id), attribute.String(logKeyAction, m.Action), attribute.String(logKeyTopic, m.Topic)))...)
+	defer span.End()
+
+	// Interceptors added by embedders may change or reject the frame
+	if !ps.interceptInbound(ctx, &client, &m) {
 		return ps
 	}
+	logger := client.logger().With(logKeyAction, m.Action, logKeyTopic, m.Topic)
+
+	// Metadata can only be given before anything else
+	if m.Action != HELLO {
+		client.Metadata.freeze()
+		client.Session.fixProtocolVersion()
+	}
+
+	// Explicit topics must be created before they are used
+	switch m.Action {
+	case PUBLISH, REQUEST, SUBSCRIBE, WHO, PRESENCE, HISTORY:
+		// The topics of a batch are checked one by one
+		if m.Action == SUBSCRIBE && len(m.Topics) > 0 {
+			break
+		}
+		if !ps.topicDeclared(m.Topic) {
+			client.Send(errorMessage("unknown_topic", m.Topic))
+			return ps
+		}
+	}
 
 	switch m.Action {
 
 	case PUBLISH:
 
-		fmt.Println("This is publish new message")
+		if !ps.mayPublish(&client, m.Topic) {
+			ps.refuse(&client, m)
+			break
+		}
+
+		logger.Debug("This is publish new message")
+
+		message := []byte(m.Message)
+		if m.Data != nil {
+			message = m.Data
+		}
+		if !ps.conformsToSchema(&client, m.Topic, message) {
+			break
+		}
+		// A reply carries the correlation ID of its request
+		ctx = withReply(withPublisher(ctx, ps.publisherOf(&client, m)), replyHeaders{ReplyTo: m.ReplyTo, CorrelationId: m.CorrelationId})
+		ctx = withEchoSource(withTenant(ctx, client.Tenant()), &echoSource{ClientId: client.Id, Exclude: m.NoEcho})
+		ps.clientPublished(ctx, &client, m.Topic, message)
+		ps.PublishContext(ctx, m.Topic, message, nil)
+
+		break
+
+	case REQUEST:
+
+		logger.Debug("This is publish new request")
 
-		ps.Publish(m.Topic, m.Message, nil)
+		ps.handleRequest(ctx, &client, m)
 
 		break
 
 	case SUBSCRIBE:
 
-		ps.Subscribe(&client, m.Topic)
+		// A batch names its topics in a list and is answered with the result of each
+		if len(m.Topics) > 0 {
+			ps.subscribeBatch(ctx, &client, m)
+			break
+		}
+		ps.answerSubscribe(&client, m, ps.subscribeTopic(ctx, &client, m))
+
+		break
 
-		fmt.Println("new subscriber to topic", m.Topic, len(ps.Subscriptions), client.Id)
+	case ACK:
+
+		ps.handleAck(&client, m)
+
+		break
+
+	case NACK:
+
+		ps.handleNack(&client, m)
 
 		break
 
 	case UNSUBSCRIBE:
 
-		fmt.Println("Client want to unsubscribe the topic", m.Topic, client.Id)
+		if len(m.Topics) > 0 {
+			ps.unsubscribeBatch(&client, m)
+			break
+		}
+
+		logger.Info("Client wants to unsubscribe from the topic")
+
+		if ps.isLobby(m.Topic) {
+			ps.Matchmaking.Leave(m.Topic, client.Id)
+			break
+		}
 
 		ps.Unsubscribe(&client, m.Topic)
 
 		break
 
-	default:
+	case WHO, PRESENCE:
+
+		if !client.TopicAllowed(SUBSCRIBE, m.Topic) || !ps.aclAllows(&client, SUBSCRIBE, m.Topic) || !ps.canAccessTopic(m.Topic, &client, SUBSCRIBE) {
+			ps.refuse(&client, m)
+			break
+		}
+		client.Send(membersMessage(m.Action, m.Topic, ps.Who(m.Topic)))
+
 		break
+
+	case HISTORY:
+
+		if !client.TopicAllowed(SUBSCRIBE, m.Topic) || !ps.aclAllows(&client, SUBSCRIBE, m.Topic) || !ps.canAccessTopic(m.Topic, &client, SUBSCRIBE) {
+			ps.refuse(&client, m)
+			break
+		}
+		frame, err := ps.HistoryFrame(historyRange{Topic: m.Topic, Since: m.Since, Limit: m.Limit})
+		if err != nil {
+			logger.Error("Error reading message history", "error", err)
+			client.Send(historyUnavailableMessage(m.Topic))
+			break
+		}
+		client.Send(frame)
+
+		break
+
+	case BIND:
+
+		ps.handleBind(&client, m)
+
+		break
+
+	case HELLO:
+
+		handleHello(&client, m)
+
+		break
+
+	case SUBSCRIPTIONS:
+
+		ps.handleSubscriptions(&client)
+
+		break
+
+	case STATUS:
+
+		ps.handleStatus(&client, m)
+
+		break
+
+	case REPORT:
+
+		ps.handleReport(&client, m)
+
+		break
+
+	case CREATE_TOPIC:
+
+		ps.handleCreateTopic(&client, m)
+
+		break
+
+	case DELETE_TOPIC, SET_POLICY, GRANT, REVOKE, INVITE:
+
+		ps.handleOwnerAction(&client, m)
+
+		break
+
+	default:
+		logger.Warn("Unknown action")
+		rejectFrame(&client, codeUnknownAction, m.Topic, fmt.Sprintf("unknown action %q", m.Action))
 	}
 
 	return ps
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 
@@ -17,7 +22,7 @@ func TestAutoID(t *testing.T) {
 }
 
 func TestWebSocketHandler(t *testing.T) {
-	server := httptest.NewServer(http.HandlerFunc(webSocketHandler))
+	server := httptest.NewServer(http.HandlerFunc(ps.webSocketHandler))
 	defer server.Close()
 
 	wsURL := "ws" + server.URL[4:]
@@ -25,6 +30,13 @@ func TestWebSocketHandler(t *testing.T) {
 	assert.NoError(t, err, "Failed to connect to WebSocket")
 	defer ws.Close()
 
+	// Read the welcome frame sent on connect
+	var welcome welcomeFrame
+	err = ws.ReadJSON(&welcome)
+	assert.NoError(t, err, "Failed to read welcome frame from WebSocket")
+	assert.Equal(t, "welcome", welcome.Action, "First frame should be the welcome frame")
+	assert.NotEmpty(t, welcome.ClientId, "Welcome frame should carry the client ID")
+
 	// Write a message to WebSocket
 	message := []byte("Test message")
 	err = ws.WriteMessage(websocket.TextMessage, message)
@@ -40,22 +52,26 @@ func TestWebSocketHandler(t *testing.T) {
 
 func TestSetupRoutes(t *testing.T) {
 	// Test if setupRoutes sets up routes correctly
-	//router := http.NewServeMux()
-	setupRoutes()
-	assert.NotNil(t, http.DefaultServeMux, "DefaultServeMux should be set up")
-	setupRoutes() // Call again to check for idempotence
+	router := http.NewServeMux()
+	setupRoutes(router, ps, "static", "/metrics")
 
 	// Test if the static route is registered
 	requestStatic, _ := http.NewRequest("GET", "/", nil)
 	responseStatic := httptest.NewRecorder()
-	http.DefaultServeMux.ServeHTTP(responseStatic, requestStatic)
+	router.ServeHTTP(responseStatic, requestStatic)
 	assert.Equal(t, http.StatusOK, responseStatic.Code, "Static route should return status OK")
 
-	// Test if the WebSocket route is registered
+	// Test if the WebSocket route is registered; a plain GET is refused by the upgrader
 	requestWS, _ := http.NewRequest("GET", "/ws", nil)
 	responseWS := httptest.NewRecorder()
-	http.DefaultServeMux.ServeHTTP(responseWS, requestWS)
-	assert.Equal(t, http.StatusOK, responseWS.Code, "WebSocket route should return status OK")
+	router.ServeHTTP(responseWS, requestWS)
+	assert.Equal(t, http.StatusBadRequest, responseWS.Code, "WebSocket route should refuse requests that are not upgrades")
+
+	// Test if the metrics route is registered
+	requestMetrics, _ := http.NewRequest("GET", "/metrics", nil)
+	responseMetrics := httptest.NewRecorder()
+	router.ServeHTTP(responseMetrics, requestMetrics)
+	assert.Equal(t, http.StatusOK, responseMetrics.Code, "Metrics route should return status OK")
 }
 
 func TestAddClientAndRemoveClient(t *testing.T) {
@@ -70,23 +86,21 @@ func TestAddClientAndRemoveClient(t *testing.T) {
 
 	// Test AddClient
 	ps.AddClient(client)
-	assert.Len(t, ps.Clients, 1, "Number of clients should be 1 after adding")
+	assert.Len(t, ps.Clients(), 1, "Number of clients should be 1 after adding")
 
 	// Test RemoveClient
 	ps.RemoveClient(client)
-	assert.Len(t, ps.Clients, 0, "Number of clients should be 0 after removing")
+	assert.Len(t, ps.Clients(), 0, "Number of clients should be 0 after removing")
 }
 
 func TestBroadcast(t *testing.T) {
 	ps := PubSub{}
 
-	// Create two mock WebSocket connections
-	mockConn1 := &websocket.Conn{}
-	mockConn2 := &websocket.Conn{}
+	// Create two clients connected over real WebSocket connections
+	client1, peer1 := newTestClient(t)
+	client2, peer2 := newTestClient(t)
 
 	// Add clients to PubSub
-	client1 := Client{Id: autoId(), Connection: mockConn1}
-	client2 := Client{Id: autoId(), Connection: mockConn2}
 	ps.AddClient(client1)
 	ps.AddClient(client2)
 
@@ -95,35 +109,72 @@ func TestBroadcast(t *testing.T) {
 	ps.broadcast(message)
 
 	// Check if both clients received the message
-	_, message1, _ := mockConn1.ReadMessage()
-	_, message2, _ := mockConn2.ReadMessage()
+	_, message1, _ := peer1.ReadMessage()
+	_, message2, _ := peer2.ReadMessage()
 
 	assert.Equal(t, message, message1, "Client1 should receive the broadcasted message")
 	assert.Equal(t, message, message2, "Client2 should receive the broadcasted message")
 }
 
-func TestHandleRecvdMessage(t *testing.T) {
-	ps := PubSub{}
+// brokenTransport fails every delivery, like a connection that went away.
+type brokenTransport struct{}
 
-	// Create a mock WebSocket connection
-	mockConn := &websocket.Conn{}
+func (brokenTransport) Deliver(topic string, message []byte) error {
+	return errors.New("connection reset")
+}
 
-	// Add a client to PubSub
-	client := Client{Id: autoId(), Connection: mockConn}
-	ps.AddClient(client)
+func TestBroadcastRemovesFailingClientsWithoutHoldingLock(t *testing.T) {
+	ps := &PubSub{}
+	healthy, peer := newTestClient(t)
+	ps.AddClient(healthy)
+	ps.AddClient(Client{Id: "gone", Transport: brokenTransport{}})
+	ps.Subscribe(&Client{Id: "gone", Transport: brokenTransport{}}, "news")
+	// Callbacks may call back into the PubSub, which would deadlock were ps.mu held
+	disconnected := make(chan string, 1)
+	ps.OnDisconnect(func(client *Client) {
+		ps.Publish("news", []byte(`"left"`), nil)
+		disconnected <- client.Id
+	})
 
-	// Test HandleRecvdMessage
-	messageType := websocket.TextMessage
-	payload := []byte("Test HandleRecvdMessage")
-	ps.HandleRecvdMessage(client, messageType, payload)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ps.broadcast([]byte("hello"))
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Broadcasting deadlocked removing a failing client")
+	}
+	assert.Equal(t, "gone", <-disconnected)
+	_, message, err := peer.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(message))
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	assert.Len(t, ps.Clients(), 1, "Clients whose delivery failed are removed")
+	assert.Empty(t, ps.Subscriptions())
+}
+
+func TestHandleRecvdMessage(t *testing.T) {
+	ps := PubSub{}
+	client, peer := newTestClient(t)
+	ps.AddClient(client)
 
-	// Check if the broadcasted message is received
-	_, message, _ := mockConn.ReadMessage()
-	expectedBroadcast := []byte("This is a Broadcast message sent by the Server! HELLO Clients!")
-	assert.Equal(t, expectedBroadcast, message, "Client should receive the broadcasted message")
+	// Payloads that are not JSON are answered with an error frame
+	ps.HandleRecvdMessage(client, websocket.TextMessage, []byte("Test HandleRecvdMessage"))
+	frame := readFrame(t, peer)
+	assert.Equal(t, "error", frame["action"])
+	assert.Equal(t, codeBadPayload, frame["code"], "Client should be told its payload was rejected")
+	assert.NotEmpty(t, frame["detail"])
 }
 
 func TestMainFunction(t *testing.T) {
+	// Run main without the flags of the test binary
+	args := os.Args
+	os.Args = []string{"gowebsockets"}
+	t.Cleanup(func() { os.Args = args })
+
 	// Test the main function by running it in a goroutine and checking if it starts without errors
 	go func() {
 		defer func() {
@@ -141,6 +192,73 @@ func TestMainFunction(t *testing.T) {
 	assert.NoError(t, err, "Failed to send HTTP request to server")
 	assert.Equal(t, http.StatusOK, response.StatusCode, "Server should return status OK")
 
-	// Stop the server by closing the default listener
-	http.DefaultServeMux = nil
+	// Stop the server gracefully as a process manager would
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	assert.Eventually(t, func() bool {
+		_, err := http.Get("http://localhost:8080")
+		return err != nil
+	}, 2*time.Second, 10*time.Millisecond, "The server should stop listening")
+}
+
+// newTestClient returns a Client backed by the server side of a real WebSocket
+// connection, together with the dialed peer used to observe what it is sent.
+func newTestClient(t *testing.T) (Client, *websocket.Conn) {
+	serverConns := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := defaultOptions.upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		serverConns <- ws
+	}))
+	t.Cleanup(server.Close)
+
+	peer, _, err := websocket.DefaultDialer.Dial("ws"+server.URL[4:], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { peer.Close() })
+
+	return Client{Id: autoId(), Connection: <-serverConns}, peer
+}
+
+type recordingBridge struct {
+	ids      []string
+	topics   []string
+	messages [][]byte
+	mu       sync.Mutex
+}
+
+func (b *recordingBridge) Relay(ctx context.Context, id string, topic string, message []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.ids = append(b.ids, id)
+	b.topics = append(b.topics, topic)
+	b.messages = append(b.messages, message)
+	return nil
+}
+
+func (b *recordingBridge) relayed() [][]byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([][]byte{}, b.messages...)
+}
+
+func TestPublishRelaysToBridges(t *testing.T) {
+	bridge := &recordingBridge{}
+	ps := PubSub{Bridges: []Bridge{bridge}}
+
+	client, peer := newTestClient(t)
+	ps.Subscribe(&client, "news")
+
+	ps.Publish("news", []byte(`{"x":1}`), nil)
+
+	_, message, err := peer.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte(`{"x":1}`), message, "Local subscriber should receive the message")
+	assert.Equal(t, []string{"news"}, bridge.topics, "Message should be relayed through the bridge")
+	assert.Equal(t, [][]byte{[]byte(`{"x":1}`)}, bridge.messages)
+	assert.Len(t, bridge.ids, 1)
+	assert.NotEmpty(t, bridge.ids[0], "Relayed messages should carry their ID")
 }
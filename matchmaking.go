@@ -0,0 +1,128 @@
+// This file serves the lobbies of the matchmaking package over the pubsub core. A
+// client subscribing to a lobby topic waits in the lobby with the attributes it gives,
+// e.g. {"action":"subscribe","topic":"lobby/arena","attributes":{"rank":"1200"}}, until
+// the matchmaker subscribes it to the topic of a match and tells it with a matched frame.
+// Unsubscribing from the lobby or disconnecting leaves it.
+package main
+
+import (
+	"encoding/json"
+
+	"mywebsocketserver/matchmaking"
+)
+
+// Frame telling a client it waits in a lobby
+const QUEUED = "queued"
+
+// The PubSub as the core of a matchmaker, subscribing and notifying its clients
+type matchmakingCore struct {
+	ps *PubSub
+}
+
+// Function to find a connected client by its ID.
+// Parameters:
+// id: string - The ID of the client.
+// Returns:
+// *Client - A copy of the client.
+// error - errUnknownClient if no client has the ID.
+func (c matchmakingCore) client(id string) (*Client, error) {
+	if clients := c.ps.clientsWithID(id); len(clients) > 0 {
+		return &clients[0], nil
+	}
+	return nil, errUnknownClient
+}
+
+// Function to subscribe a player to the topic of their match.
+// Parameters:
+// clientId: string - The ID of the client.
+// topic: string - The topic of the match.
+// Returns:
+// error - errUnknownClient if the client disconnected.
+func (c matchmakingCore) Subscribe(clientId string, topic string) error {
+	client, err := c.client(clientId)
+	if err != nil {
+		return err
+	}
+	c.ps.Subscribe(client, topic)
+	return nil
+}
+
+// Function to send a frame to a player.
+// Parameters:
+// clientId: string - The ID of the client.
+// frame: []byte - The frame.
+// Returns:
+// error - errUnknownClient if the client disconnected, or the error sending the frame.
+func (c matchmakingCore) Notify(clientId string, frame []byte) error {
+	client, err := c.client(clientId)
+	if err != nil {
+		return err
+	}
+	return client.Send(frame)
+}
+
+// Function to construct the matchmaker of the lobbies of a rules file.
+// Parameters:
+// pubsub: *PubSub - The PubSub the matches are created on.
+// path: string - The JSON file of the rules of the lobbies.
+// Returns:
+// *matchmaking.Matchmaker - The matchmaker.
+// error - An error if the file could not be loaded or its rules are invalid.
+func newMatchmaker(pubsub *PubSub, path string) (*matchmaking.Matchmaker, error) {
+	rules, err := matchmaking.LoadRules(path)
+	if err != nil {
+		return nil, err
+	}
+	return matchmaking.New(matchmakingCore{pubsub}, rules)
+}
+
+// Function to tell whether a topic is a lobby of the matchmaker, if there is one.
+// Parameters:
+// topic: string - The topic.
+// Returns:
+// bool - True if the topic is a lobby.
+func (ps *PubSub) isLobby(topic string) bool {
+	return ps.Matchmaking != nil && ps.Matchmaking.IsLobby(topic)
+}
+
+// Function to put a client in a lobby. The client is told it waits with a queued
+// frame, unless it was matched at once.
+// Parameters:
+// client: *Client - The client.
+// m: Message - The subscribe to the lobby, with the attributes of the player.
+func (ps *PubSub) joinLobby(client *Client, m Message) {
+	player, err := matchmaking.NewPlayer(client.Id, m.Attributes)
+	if err != nil {
+		client.Send(errorMessage("invalid_rank", m.Topic))
+		return
+	}
+	matches, err := ps.Matchmaking.Join(m.Topic, player)
+	if err != nil {
+		client.logger().Error("Error joining lobby", logKeyTopic, m.Topic, "error", err)
+		return
+	}
+	for _, match := range matches {
+		for _, p := range match.Players {
+			if p.ClientId == client.Id {
+				return
+			}
+		}
+	}
+	client.logger().Info("Client waits in lobby", logKeyTopic, m.Topic)
+	client.Send(queuedMessage(m.Topic, len(ps.Matchmaking.Waiting(m.Topic))))
+}
+
+// Function to build the frame telling a client it waits in a lobby.
+// Parameters:
+// topic: string - The topic of the lobby.
+// waiting: int - The number of players waiting in the lobby.
+// Returns:
+// []byte - The JSON encoded frame.
+func queuedMessage(topic string, waiting int) []byte {
+	message, _ := json.Marshal(map[string]interface{}{
+		"action":  QUEUED,
+		"topic":   topic,
+		"waiting": waiting,
+	})
+	return message
+}
@@ -0,0 +1,291 @@
+// This file groups players waiting in lobbies into matches, e.g. for game servers. A
+// lobby is a topic players join with attributes such as their rank; once enough
+// players within the rank range of the lobby are waiting, they are taken out of the
+// lobby, subscribed to a topic of their own for the match and told about it. The
+// package only decides who plays together: subscribing and notifying clients is left
+// to the Core it is given, so it can sit over any pub/sub core.
+package matchmaking
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Frame telling the players of a match about it
+const MATCHED = "matched"
+
+// The attribute of a player holding their rank
+const RankAttribute = "rank"
+
+var (
+	// ErrUnknownLobby is returned when joining a topic that is not a lobby.
+	ErrUnknownLobby = errors.New("matchmaking: unknown lobby")
+	// ErrInvalidRank is returned when the rank attribute of a player is not an integer.
+	ErrInvalidRank = errors.New("matchmaking: invalid rank")
+)
+
+// Core is the pub/sub core matches are created over.
+type Core interface {
+	// Subscribe subscribes a connected client to a topic.
+	Subscribe(clientId string, topic string) error
+	// Notify sends a frame to a connected client.
+	Notify(clientId string, frame []byte) error
+}
+
+// Rules are the rules a lobby groups its players by.
+type Rules struct {
+	// The topic of the lobby, e.g. lobby/arena
+	Topic string `json:"topic"`
+	// Players per match
+	PartySize int `json:"partySize"`
+	// Largest difference of rank between the players of a match, 0 for any
+	RankRange int `json:"rankRange"`
+}
+
+// Player is a client waiting in a lobby.
+type Player struct {
+	ClientId   string            `json:"clientId"`
+	Rank       int               `json:"rank"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	JoinedAt   time.Time         `json:"joinedAt"`
+}
+
+// Match is a group of players and the topic they were subscribed to.
+type Match struct {
+	Id      string   `json:"matchId"`
+	Lobby   string   `json:"lobby"`
+	Topic   string   `json:"topic"`
+	Players []Player `json:"players"`
+}
+
+// A lobby and its players, in the order they joined
+type lobby struct {
+	rules   Rules
+	waiting []Player
+}
+
+// Matchmaker keeps the lobbies and forms their matches.
+type Matchmaker struct {
+	core    Core
+	lobbies map[string]*lobby
+	mu      sync.Mutex
+}
+
+// Function to load the rules of lobbies from a JSON file, e.g.
+// [{"topic": "lobby/arena", "partySize": 2, "rankRange": 200}]
+// Parameters:
+// path: string - The path of the JSON file.
+// Returns:
+// []Rules - The rules.
+// error - An error if the file could not be read.
+func LoadRules(path string) ([]Rules, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []Rules
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// Function to construct a matchmaker.
+// Parameters:
+// core: Core - The core subscribing and notifying the players of matches.
+// rules: []Rules - The rules of each lobby.
+// Returns:
+// *Matchmaker - The matchmaker.
+// error - An error if a lobby has no topic, is given twice or has fewer than 2 players per match.
+func New(core Core, rules []Rules) (*Matchmaker, error) {
+	m := &Matchmaker{core: core, lobbies: map[string]*lobby{}}
+	for _, r := range rules {
+		switch {
+		case r.Topic == "":
+			return nil, errors.New("matchmaking: lobby without a topic")
+		case m.lobbies[r.Topic] != nil:
+			return nil, fmt.Errorf("matchmaking: lobby %q given twice", r.Topic)
+		case r.PartySize < 2:
+			return nil, fmt.Errorf("matchmaking: lobby %q needs a party size of at least 2", r.Topic)
+		case r.RankRange < 0:
+			return nil, fmt.Errorf("matchmaking: lobby %q has a negative rank range", r.Topic)
+		}
+		m.lobbies[r.Topic] = &lobby{rules: r}
+	}
+	return m, nil
+}
+
+// Function to make the player of a client from the attributes it joined with.
+// Parameters:
+// clientId: string - The ID of the client.
+// attributes: map[string]string - The attributes, with the rank under "rank" if ranked.
+// Returns:
+// Player - The player, of rank 0 if no rank was given.
+// error - ErrInvalidRank if the rank is not an integer.
+func NewPlayer(clientId string, attributes map[string]string) (Player, error) {
+	player := Player{ClientId: clientId, Attributes: attributes, JoinedAt: time.Now().UTC()}
+	if rank, ok := attributes[RankAttribute]; ok {
+		var err error
+		if player.Rank, err = strconv.Atoi(rank); err != nil {
+			return Player{}, ErrInvalidRank
+		}
+	}
+	return player, nil
+}
+
+// Function to tell whether a topic is a lobby.
+// Parameters:
+// topic: string - The topic.
+// Returns:
+// bool - True if the topic is a lobby.
+func (m *Matchmaker) IsLobby(topic string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lobbies[topic] != nil
+}
+
+// Function to put a player in a lobby, replacing their earlier entry, and start the
+// matches that became possible.
+// Parameters:
+// topic: string - The topic of the lobby.
+// player: Player - The player.
+// Returns:
+// []Match - The matches started, whose players were subscribed and notified.
+// error - ErrUnknownLobby if the topic is not a lobby.
+func (m *Matchmaker) Join(topic string, player Player) ([]Match, error) {
+	m.mu.Lock()
+	l := m.lobbies[topic]
+	if l == nil {
+		m.mu.Unlock()
+		return nil, ErrUnknownLobby
+	}
+	l.remove(player.ClientId)
+	l.waiting = append(l.waiting, player)
+	var matches []Match
+	for players := l.nextMatch(); players != nil; players = l.nextMatch() {
+		for _, p := range players {
+			l.remove(p.ClientId)
+		}
+		id := newMatchId()
+		matches = append(matches, Match{Id: id, Lobby: topic, Topic: topic + "/match/" + id, Players: players})
+	}
+	m.mu.Unlock()
+
+	// The core is called without the lock, as it may call back into the matchmaker
+	for _, match := range matches {
+		m.start(match)
+	}
+	return matches, nil
+}
+
+// Function to subscribe the players of a match to its topic and tell them about it.
+// Players that disconnected meanwhile are skipped.
+// Parameters:
+// match: Match - The match.
+func (m *Matchmaker) start(match Match) {
+	frame, _ := json.Marshal(struct {
+		Action string `json:"action"`
+		Match
+	}{MATCHED, match})
+	for _, player := range match.Players {
+		if m.core.Subscribe(player.ClientId, match.Topic) != nil {
+			continue
+		}
+		m.core.Notify(player.ClientId, frame)
+	}
+}
+
+// Function to take a player out of a lobby.
+// Parameters:
+// topic: string - The topic of the lobby.
+// clientId: string - The ID of the client of the player.
+// Returns:
+// bool - False if the player was not waiting in the lobby.
+func (m *Matchmaker) Leave(topic string, clientId string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l := m.lobbies[topic]
+	return l != nil && l.remove(clientId)
+}
+
+// Function to take a player out of every lobby, e.g. when their client disconnects.
+// Parameters:
+// clientId: string - The ID of the client of the player.
+func (m *Matchmaker) LeaveAll(clientId string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, l := range m.lobbies {
+		l.remove(clientId)
+	}
+}
+
+// Function to list the players waiting in a lobby.
+// Parameters:
+// topic: string - The topic of the lobby.
+// Returns:
+// []Player - The players, in the order they joined.
+func (m *Matchmaker) Waiting(topic string) []Player {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if l := m.lobbies[topic]; l != nil {
+		return append([]Player{}, l.waiting...)
+	}
+	return nil
+}
+
+// Function to remove a player from the lobby.
+// Parameters:
+// clientId: string - The ID of the client of the player.
+// Returns:
+// bool - False if the player was not waiting.
+func (l *lobby) remove(clientId string) bool {
+	for i, p := range l.waiting {
+		if p.ClientId == clientId {
+			l.waiting = append(l.waiting[:i], l.waiting[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Function to find the players of the next match. Players who waited longest go
+// first: each waiting player, in the order they joined, is matched with the earliest
+// players keeping the ranks of the match within the rank range.
+// Returns:
+// []Player - The players of the match, or nil if no match can be formed.
+func (l *lobby) nextMatch() []Player {
+	for i, first := range l.waiting {
+		players := []Player{first}
+		low, high := first.Rank, first.Rank
+		for j, p := range l.waiting {
+			if j == i {
+				continue
+			}
+			if l.rules.RankRange > 0 && max(high, p.Rank)-min(low, p.Rank) > l.rules.RankRange {
+				continue
+			}
+			players = append(players, p)
+			low, high = min(low, p.Rank), max(high, p.Rank)
+			if len(players) == l.rules.PartySize {
+				return players
+			}
+		}
+	}
+	return nil
+}
+
+// Function to generate the ID of a match.
+// Returns:
+// string - 16 random hexadecimal digits.
+func newMatchId() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,166 @@
+package matchmaking
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A core recording the subscriptions and frames of connected clients
+type fakeCore struct {
+	connected     map[string]bool
+	subscriptions map[string][]string
+	frames        map[string][][]byte
+	mu            sync.Mutex
+}
+
+func newFakeCore(clients ...string) *fakeCore {
+	core := &fakeCore{connected: map[string]bool{}, subscriptions: map[string][]string{}, frames: map[string][][]byte{}}
+	for _, client := range clients {
+		core.connected[client] = true
+	}
+	return core
+}
+
+func (c *fakeCore) Subscribe(clientId string, topic string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.connected[clientId] {
+		return errors.New("not connected")
+	}
+	c.subscriptions[clientId] = append(c.subscriptions[clientId], topic)
+	return nil
+}
+
+func (c *fakeCore) Notify(clientId string, frame []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.frames[clientId] = append(c.frames[clientId], frame)
+	return nil
+}
+
+func player(t *testing.T, clientId string, rank string) Player {
+	p, err := NewPlayer(clientId, map[string]string{RankAttribute: rank})
+	assert.NoError(t, err)
+	return p
+}
+
+func clientIds(players []Player) []string {
+	var ids []string
+	for _, p := range players {
+		ids = append(ids, p.ClientId)
+	}
+	return ids
+}
+
+func TestPlayersWithinRankRangeAreMatched(t *testing.T) {
+	core := newFakeCore("a", "b", "c", "d")
+	m, err := New(core, []Rules{{Topic: "lobby/arena", PartySize: 2, RankRange: 100}})
+	assert.NoError(t, err)
+
+	matches, err := m.Join("lobby/arena", player(t, "a", "1000"))
+	assert.NoError(t, err)
+	assert.Empty(t, matches)
+	matches, _ = m.Join("lobby/arena", player(t, "b", "1500"))
+	assert.Empty(t, matches, "Players too far apart in rank should keep waiting")
+	matches, _ = m.Join("lobby/arena", player(t, "c", "1450"))
+	assert.Len(t, matches, 1)
+	assert.Equal(t, []string{"b", "c"}, clientIds(matches[0].Players))
+	assert.Equal(t, "lobby/arena", matches[0].Lobby)
+	assert.Equal(t, "lobby/arena/match/"+matches[0].Id, matches[0].Topic)
+	assert.Equal(t, []string{"a"}, clientIds(m.Waiting("lobby/arena")))
+
+	// Both players are subscribed and told about the match
+	for _, client := range []string{"b", "c"} {
+		assert.Equal(t, []string{matches[0].Topic}, core.subscriptions[client])
+		assert.Len(t, core.frames[client], 1)
+		var frame struct {
+			Action  string   `json:"action"`
+			MatchId string   `json:"matchId"`
+			Topic   string   `json:"topic"`
+			Players []Player `json:"players"`
+		}
+		assert.NoError(t, json.Unmarshal(core.frames[client][0], &frame))
+		assert.Equal(t, MATCHED, frame.Action)
+		assert.Equal(t, matches[0].Id, frame.MatchId)
+		assert.Equal(t, matches[0].Topic, frame.Topic)
+		assert.Equal(t, []string{"b", "c"}, clientIds(frame.Players))
+	}
+	assert.Empty(t, core.frames["a"])
+}
+
+func TestLongestWaitingPlayersGoFirst(t *testing.T) {
+	core := newFakeCore("a", "b", "c", "d")
+	m, _ := New(core, []Rules{{Topic: "lobby/squads", PartySize: 3}})
+
+	for _, client := range []string{"a", "b"} {
+		matches, _ := m.Join("lobby/squads", player(t, client, "5"))
+		assert.Empty(t, matches)
+	}
+	// Joining again keeps a single entry, at the back of the lobby
+	m.Join("lobby/squads", player(t, "a", "7"))
+	assert.Equal(t, []string{"b", "a"}, clientIds(m.Waiting("lobby/squads")))
+
+	matches, _ := m.Join("lobby/squads", player(t, "c", "9000"))
+	assert.Len(t, matches, 1, "A rank range of 0 should match any ranks")
+	assert.Equal(t, []string{"b", "a", "c"}, clientIds(matches[0].Players))
+	assert.Empty(t, m.Waiting("lobby/squads"))
+}
+
+func TestLeavingLobbies(t *testing.T) {
+	core := newFakeCore("a", "b", "c")
+	m, _ := New(core, []Rules{{Topic: "lobby/one", PartySize: 2}, {Topic: "lobby/two", PartySize: 2}})
+
+	m.Join("lobby/one", player(t, "a", "1"))
+	m.Join("lobby/two", player(t, "a", "1"))
+	assert.True(t, m.Leave("lobby/one", "a"))
+	assert.False(t, m.Leave("lobby/one", "a"))
+	m.LeaveAll("a")
+	assert.Empty(t, m.Waiting("lobby/two"))
+
+	// A player who disconnected before the match started is not subscribed
+	m.Join("lobby/one", player(t, "gone", "1"))
+	matches, _ := m.Join("lobby/one", player(t, "b", "1"))
+	assert.Len(t, matches, 1)
+	assert.Empty(t, core.frames["gone"])
+	assert.Len(t, core.frames["b"], 1)
+
+	_, err := m.Join("lobby/none", player(t, "c", "1"))
+	assert.ErrorIs(t, err, ErrUnknownLobby)
+	assert.False(t, m.IsLobby("lobby/none"))
+	assert.True(t, m.IsLobby("lobby/two"))
+}
+
+func TestInvalidRules(t *testing.T) {
+	for _, rules := range [][]Rules{
+		{{PartySize: 2}},
+		{{Topic: "lobby", PartySize: 1}},
+		{{Topic: "lobby", PartySize: 2, RankRange: -1}},
+		{{Topic: "lobby", PartySize: 2}, {Topic: "lobby", PartySize: 4}},
+	} {
+		_, err := New(newFakeCore(), rules)
+		assert.Error(t, err, "%+v", rules)
+	}
+
+	_, err := NewPlayer("a", map[string]string{RankAttribute: "gold"})
+	assert.ErrorIs(t, err, ErrInvalidRank)
+	p, err := NewPlayer("a", map[string]string{"region": "eu"})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, p.Rank)
+}
+
+func TestLoadRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lobbies.json")
+	os.WriteFile(path, []byte(`[{"topic": "lobby/arena", "partySize": 2, "rankRange": 200}]`), 0o600)
+	rules, err := LoadRules(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []Rules{{Topic: "lobby/arena", PartySize: 2, RankRange: 200}}, rules)
+
+	_, err = LoadRules(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newLobbyPubSub(t *testing.T) *PubSub {
+	path := filepath.Join(t.TempDir(), "lobbies.json")
+	os.WriteFile(path, []byte(`[{"topic": "lobby/arena", "partySize": 2, "rankRange": 100}]`), 0o600)
+	pubsub, err := NewPubSub(Config{MatchmakingFile: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pubsub
+}
+
+type matchedFrame struct {
+	Action  string `json:"action"`
+	MatchId string `json:"matchId"`
+	Lobby   string `json:"lobby"`
+	Topic   string `json:"topic"`
+}
+
+func TestLobbySubscribersAreMatched(t *testing.T) {
+	pubsub := newLobbyPubSub(t)
+	alice, alicePeer := newTestClient(t)
+	bob, bobPeer := newTestClient(t)
+	pubsub.AddClient(alice)
+	pubsub.AddClient(bob)
+
+	pubsub.HandleRecvdMessage(alice, 1, []byte(`{"action":"subscribe","topic":"lobby/arena","attributes":{"rank":"1200"}}`))
+	var queued map[string]interface{}
+	assert.NoError(t, alicePeer.ReadJSON(&queued))
+	assert.Equal(t, map[string]interface{}{"action": QUEUED, "topic": "lobby/arena", "waiting": 1.0}, queued)
+	assert.Empty(t, pubsub.GetSubscriptions("lobby/arena", &alice), "Waiting in a lobby is not a subscription")
+
+	pubsub.HandleRecvdMessage(bob, 1, []byte(`{"action":"subscribe","topic":"lobby/arena","attributes":{"rank":"1250"}}`))
+	var aliceMatch, bobMatch matchedFrame
+	assert.NoError(t, alicePeer.ReadJSON(&aliceMatch))
+	assert.NoError(t, bobPeer.ReadJSON(&bobMatch))
+	assert.Equal(t, "matched", aliceMatch.Action)
+	assert.Equal(t, aliceMatch, bobMatch)
+	assert.Equal(t, "lobby/arena/match/"+aliceMatch.MatchId, aliceMatch.Topic)
+	assert.Len(t, pubsub.GetSubscriptions(aliceMatch.Topic, &alice), 1)
+	assert.Len(t, pubsub.GetSubscriptions(aliceMatch.Topic, &bob), 1)
+
+	pubsub.Publish(aliceMatch.Topic, []byte(`{"move":"e4"}`), nil)
+	_, data, err := bobPeer.ReadMessage()
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"move":"e4"}`, string(data))
+}
+
+func TestLeavingLobbyOnUnsubscribeAndDisconnect(t *testing.T) {
+	pubsub := newLobbyPubSub(t)
+	client, peer := newTestClient(t)
+	pubsub.AddClient(client)
+
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"lobby/arena","attributes":{"rank":"gold"}}`))
+	_, data, err := peer.ReadMessage()
+	assert.NoError(t, err)
+	assert.JSONEq(t, string(errorMessage("invalid_rank", "lobby/arena")), string(data))
+
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"lobby/arena"}`))
+	peer.ReadMessage()
+	assert.Len(t, pubsub.Matchmaking.Waiting("lobby/arena"), 1)
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"unsubscribe","topic":"lobby/arena"}`))
+	assert.Empty(t, pubsub.Matchmaking.Waiting("lobby/arena"))
+
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"lobby/arena"}`))
+	peer.ReadMessage()
+	pubsub.RemoveClient(client)
+	assert.Empty(t, pubsub.Matchmaking.Waiting("lobby/arena"))
+
+	path := filepath.Join(t.TempDir(), "lobbies.json")
+	os.WriteFile(path, []byte(`[{"topic": "lobby/solo", "partySize": 1}]`), 0o600)
+	_, err = NewPubSub(Config{MatchmakingFile: path})
+	assert.Error(t, err)
+}
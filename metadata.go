@@ -0,0 +1,205 @@
+// This file lets clients describe themselves with a display name and key/value
+// attributes, e.g. an avatar URL or a team, which other clients see in presence and
+// operators see in the admin API. Clients give them in the query string of the upgrade
+// request, e.g. ?name=Alice&attr.team=blue, or in a hello frame sent before anything else.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Protocol action setting the metadata of a client
+const HELLO = "hello"
+
+// Prefix of the query parameters giving attributes, e.g. attr.team=blue
+const attributeParamPrefix = "attr."
+
+// Limits of the metadata of a client
+const (
+	maxNameLength           = 64
+	maxAttributes           = 16
+	maxAttributeKeyLength   = 64
+	maxAttributeValueLength = 256
+)
+
+var errMetadataFrozen = errors.New("metadata can only be set before the first other action")
+
+// ClientMetadata is the display name and attributes of a client. It is shared by the
+// copies of its client, and can be changed until the client does anything else.
+type ClientMetadata struct {
+	name       string
+	attributes map[string]string
+	frozen     bool
+	mu         sync.Mutex
+}
+
+// Function to check the metadata given by a client.
+// Parameters:
+// name: string - The display name.
+// attributes: map[string]string - The attributes.
+// Returns:
+// error - An error if the name or an attribute is too long or there are too many attributes.
+func validateMetadata(name string, attributes map[string]string) error {
+	if utf8.RuneCountInString(name) > maxNameLength {
+		return fmt.Errorf("name is longer than %d characters", maxNameLength)
+	}
+	if len(attributes) > maxAttributes {
+		return fmt.Errorf("more than %d attributes", maxAttributes)
+	}
+	for key, value := range attributes {
+		if key == "" || utf8.RuneCountInString(key) > maxAttributeKeyLength {
+			return fmt.Errorf("attribute names must have 1 to %d characters", maxAttributeKeyLength)
+		}
+		if utf8.RuneCountInString(value) > maxAttributeValueLength {
+			return fmt.Errorf("attribute %q is longer than %d characters", key, maxAttributeValueLength)
+		}
+	}
+	return nil
+}
+
+// Function to read the metadata a client gives in the query string of its upgrade request.
+// Parameters:
+// r: *http.Request - The upgrade request.
+// Returns:
+// *ClientMetadata - The metadata, empty when none is given.
+// error - An error if the metadata is invalid.
+func metadataFromRequest(r *http.Request) (*ClientMetadata, error) {
+	query := r.URL.Query()
+	attributes := map[string]string{}
+	for param, values := range query {
+		if key, ok := strings.CutPrefix(param, attributeParamPrefix); ok && len(values) > 0 {
+			attributes[key] = values[0]
+		}
+	}
+	name := query.Get("name")
+	if err := validateMetadata(name, attributes); err != nil {
+		return nil, err
+	}
+	return &ClientMetadata{name: name, attributes: attributes}, nil
+}
+
+// Function to get the display name of a client.
+// Returns:
+// string - The name, or an empty string when the client has none.
+func (m *ClientMetadata) Name() string {
+	if m == nil {
+		return ""
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.name
+}
+
+// Function to get the attributes of a client.
+// Returns:
+// map[string]string - A copy of the attributes, or nil when the client has none.
+func (m *ClientMetadata) Attributes() map[string]string {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.attributes) == 0 {
+		return nil
+	}
+	attributes := make(map[string]string, len(m.attributes))
+	for key, value := range m.attributes {
+		attributes[key] = value
+	}
+	return attributes
+}
+
+// Function to replace the metadata of a client with the metadata of its hello frame.
+// Parameters:
+// name: string - The display name.
+// attributes: map[string]string - The attributes.
+// Returns:
+// error - errMetadataFrozen once the client did anything else, or an error if the metadata is invalid.
+func (m *ClientMetadata) Set(name string, attributes map[string]string) error {
+	if err := validateMetadata(name, attributes); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.frozen {
+		return errMetadataFrozen
+	}
+	m.name = name
+	m.attributes = attributes
+	return nil
+}
+
+// Function to stop the metadata from changing, called when the client does anything
+// other than saying hello.
+func (m *ClientMetadata) freeze() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.frozen = true
+	m.mu.Unlock()
+}
+
+// Function to handle a hello frame.
+// Parameters:
+// client: *Client - The client that sent it.
+// m: Message - The frame, carrying the name and attributes.
+func handleHello(client *Client, m Message) {
+	if m.Version != 0 {
+		if !switchProtocolVersion(client, m.Version) {
+			return
+		}
+		// A hello frame may only choose the version
+		if m.Name == "" && m.Attributes == nil {
+			client.Send(helloMessage(client.Metadata, m.Version))
+			return
+		}
+	}
+	if client.Metadata == nil {
+		client.Send(invalidMetadataMessage(errors.New("this connection has no metadata")))
+		return
+	}
+	if err := client.Metadata.Set(m.Name, m.Attributes); err != nil {
+		client.logger().Info("Refused client metadata", "error", err)
+		client.Send(invalidMetadataMessage(err))
+		return
+	}
+	client.Send(helloMessage(client.Metadata, m.Version))
+}
+
+// Function to build the reply to a hello frame.
+// Parameters:
+// metadata: *ClientMetadata - The metadata of the client.
+// version: int - The version of the protocol the hello frame chose, or 0 if it chose none.
+// Returns:
+// []byte - The JSON encoded frame.
+func helloMessage(metadata *ClientMetadata, version int) []byte {
+	message, _ := json.Marshal(struct {
+		Action     string            `json:"action"`
+		Name       string            `json:"name,omitempty"`
+		Attributes map[string]string `json:"attributes,omitempty"`
+		Version    int               `json:"version,omitempty"`
+	}{HELLO, metadata.Name(), metadata.Attributes(), version})
+	return message
+}
+
+// Function to build the frame telling a client its metadata was refused.
+// Parameters:
+// err: error - Why it was refused.
+// Returns:
+// []byte - The JSON encoded frame.
+func invalidMetadataMessage(err error) []byte {
+	message, _ := json.Marshal(map[string]string{
+		"action":  "error",
+		"code":    "invalid_metadata",
+		"request": HELLO,
+		"reason":  err.Error(),
+	})
+	return message
+}
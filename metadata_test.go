@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetadataFromRequest(t *testing.T) {
+	metadata, err := metadataFromRequest(httptest.NewRequest("GET", "/ws?name=Alice&attr.team=blue&attr.avatar=a.png&token=x", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, "Alice", metadata.Name())
+	assert.Equal(t, map[string]string{"team": "blue", "avatar": "a.png"}, metadata.Attributes())
+
+	metadata, err = metadataFromRequest(httptest.NewRequest("GET", "/ws", nil))
+	assert.NoError(t, err)
+	assert.Empty(t, metadata.Name())
+	assert.Nil(t, metadata.Attributes())
+
+	_, err = metadataFromRequest(httptest.NewRequest("GET", "/ws?name="+strings.Repeat("a", maxNameLength+1), nil))
+	assert.Error(t, err)
+	_, err = metadataFromRequest(httptest.NewRequest("GET", "/ws?attr.bio="+strings.Repeat("a", maxAttributeValueLength+1), nil))
+	assert.Error(t, err)
+
+	var none *ClientMetadata
+	assert.Empty(t, none.Name(), "Clients of other transports have no metadata")
+}
+
+func TestHelloSetsMetadataBeforeAnythingElse(t *testing.T) {
+	pubsub := &PubSub{}
+	client, peer := newTestClient(t)
+	client.Metadata = &ClientMetadata{}
+
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"hello","name":"Bob","attributes":{"team":"red"}}`))
+	_, data, err := peer.ReadMessage()
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"action":"hello","name":"Bob","attributes":{"team":"red"}}`, string(data))
+
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"room"}`))
+	assert.Equal(t, []PresenceMember{{ClientId: client.Id, Name: "Bob", Attributes: map[string]string{"team": "red"}}}, pubsub.Who("room"))
+	infos, err := pubsub.SubscriberInfos("room")
+	assert.NoError(t, err)
+	assert.Equal(t, "Bob", infos[0].Name)
+
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"hello","name":"Mallory"}`))
+	_, data, err = peer.ReadMessage()
+	assert.NoError(t, err)
+	assert.JSONEq(t, string(invalidMetadataMessage(errMetadataFrozen)), string(data), "Metadata should not change once the client acted")
+	assert.Equal(t, "Bob", client.Metadata.Name())
+}
+
+func TestConnectWithMetadata(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(ps.webSocketHandler))
+	defer server.Close()
+
+	_, response, err := websocket.DefaultDialer.Dial("ws"+server.URL[4:]+"?name="+strings.Repeat("a", 100), nil)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+server.URL[4:]+"?name=Alice&attr.team=blue", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	var welcome welcomeFrame
+	_, data, _ := ws.ReadMessage()
+	json.Unmarshal(data, &welcome)
+
+	var info ClientInfo
+	assert.Eventually(t, func() bool {
+		for _, info = range ps.ClientInfos() {
+			if info.Id == welcome.ClientId {
+				return true
+			}
+		}
+		return false
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "Alice", info.Name)
+	assert.Equal(t, map[string]string{"team": "blue"}, info.Attributes)
+}
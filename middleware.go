@@ -0,0 +1,150 @@
+// This file lets embedders of the server add interceptors to the frames clients send
+// and to the deliveries of published messages, for validation, enrichment, redaction or
+// metrics without changing HandleRecvdMessage. Inbound interceptors run, in the order
+// they were added, on every decoded frame before it is handled, and may change it; an
+// error rejects the frame with {"action":"error","code":"intercepted","detail":"..."}.
+// Outbound interceptors run on every delivery of a published message to a subscriber,
+// given it as {"action":"message","topic":...,"id":...,"message":...}, and may change
+// its message for that subscriber alone; an error skips the delivery.
+package main
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Action of the messages given to outbound interceptors
+const interceptedMessage = "message"
+
+var interceptedDeliveries = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "gowebsockets_intercepted_deliveries_total",
+	Help: "Number of deliveries of published messages skipped by an outbound interceptor.",
+})
+
+// Interceptor inspects and may change a message. An error stops it.
+type Interceptor func(ctx context.Context, m *Message) error
+
+// Key of the client of an intercepted message in its context
+type interceptedClientKey struct{}
+
+// Function to get the client an intercepted message was received from or is delivered to.
+// Parameters:
+// ctx: context.Context - The context given to the interceptor.
+// Returns:
+// *Client - The client, or nil outside interceptors.
+func ClientFromContext(ctx context.Context) *Client {
+	client, _ := ctx.Value(interceptedClientKey{}).(*Client)
+	return client
+}
+
+// Function to add an interceptor of the frames received from clients.
+// Parameters:
+// interceptor: Interceptor - The interceptor, run after the ones added before it.
+func (ps *PubSub) Use(interceptor Interceptor) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.inbound.Store(appendInterceptor(ps.inbound.Load(), interceptor))
+}
+
+// Function to add an interceptor of the deliveries of published messages.
+// Parameters:
+// interceptor: Interceptor - The interceptor, run after the ones added before it.
+func (ps *PubSub) UseOutbound(interceptor Interceptor) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.outbound.Store(appendInterceptor(ps.outbound.Load(), interceptor))
+}
+
+// Function to add an interceptor to a chain read without locks, leaving the chain as is.
+// Parameters:
+// chain: *[]Interceptor - The chain, nil if empty.
+// interceptor: Interceptor - The interceptor to add.
+// Returns:
+// *[]Interceptor - A new chain ending with the interceptor.
+func appendInterceptor(chain *[]Interceptor, interceptor Interceptor) *[]Interceptor {
+	var interceptors []Interceptor
+	if chain != nil {
+		interceptors = *chain
+	}
+	interceptors = append(interceptors[:len(interceptors):len(interceptors)], interceptor)
+	return &interceptors
+}
+
+// Function to run interceptors on a message.
+// Parameters:
+// ctx: context.Context - The context of the message.
+// interceptors: []Interceptor - The interceptors.
+// client: *Client - The client the message was received from or is delivered to.
+// m: *Message - The message, changed in place.
+// Returns:
+// error - The error of the first interceptor refusing the message.
+func runInterceptors(ctx context.Context, interceptors []Interceptor, client *Client, m *Message) error {
+	ctx = context.WithValue(ctx, interceptedClientKey{}, client)
+	for _, interceptor := range interceptors {
+		if err := interceptor(ctx, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Function to run the inbound interceptors on a frame received from a client.
+// Parameters:
+// ctx: context.Context - The context the frame was received in.
+// client: *Client - The client.
+// m: *Message - The decoded frame, changed in place.
+// Returns:
+// bool - False if an interceptor rejected the frame, the client having been told.
+func (ps *PubSub) interceptInbound(ctx context.Context, client *Client, m *Message) bool {
+	chain := ps.inbound.Load()
+	if chain == nil {
+		return true
+	}
+	inbound := *chain
+	if err := runInterceptors(ctx, inbound, client, m); err != nil {
+		client.logger().Info("Frame rejected by an interceptor", logKeyAction, m.Action, logKeyTopic, m.Topic, "error", err)
+		rejectFrame(client, codeIntercepted, m.Topic, err.Error())
+		return false
+	}
+	return true
+}
+
+// Function to run the outbound interceptors on the delivery of a published message.
+// Parameters:
+// ctx: context.Context - The context of the publish.
+// interceptors: []Interceptor - The outbound interceptors.
+// sub: Subscription - The subscription the message is delivered to.
+// id: string - The ID of the message.
+// topic: string - The topic.
+// payload: *Payload - The message as published.
+// shared: *Payload - The payload shared by the subscribers delivered the message unchanged.
+// Returns:
+// *Payload - The payload to deliver, shared unless an interceptor changed the message.
+// bool - False if an interceptor skipped the delivery.
+func interceptDelivery(ctx context.Context, interceptors []Interceptor, sub Subscription, id string, topic string, payload *Payload, shared *Payload) (*Payload, bool) {
+	m := Message{Action: interceptedMessage, Topic: topic, Id: id, Publisher: publisherFrom(ctx), Envelope: sub.Envelope, QoS: sub.QoS}
+	if payload.Binary {
+		m.Data = payload.Data
+	} else {
+		m.Message = payload.Data
+	}
+	if err := runInterceptors(ctx, interceptors, sub.Client, &m); err != nil {
+		sub.Client.logger().Debug("Delivery skipped by an interceptor", logKeyTopic, topic, "message_id", id, "error", err)
+		interceptedDeliveries.Inc()
+		return nil, false
+	}
+	message := []byte(m.Message)
+	if payload.Binary {
+		message = m.Data
+	}
+	if bytes.Equal(message, payload.Data) {
+		return shared, true
+	}
+	if sub.Envelope || sub.QoS > 0 {
+		return NewPayload(envelopeMessage(id, topic, message, traceCarrier(ctx), publisherFrom(ctx), replyFrom(ctx))), true
+	}
+	return NewMessagePayload(message), true
+}
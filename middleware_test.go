@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInboundInterceptors(t *testing.T) {
+	pubsub := &PubSub{}
+	watcher, peer := newTestClient(t)
+	pubsub.Subscribe(&watcher, "orders")
+	var order []string
+	pubsub.Use(func(ctx context.Context, m *Message) error {
+		order = append(order, "validate")
+		if m.Topic == "secret" {
+			return errors.New("no secrets")
+		}
+		return nil
+	})
+	pubsub.Use(func(ctx context.Context, m *Message) error {
+		order = append(order, "enrich")
+		m.Message = []byte(`{"from":"` + ClientFromContext(ctx).Id + `"}`)
+		return nil
+	})
+	client, clientPeer := newTestClient(t)
+
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"publish","topic":"orders","message":{}}`))
+	assert.JSONEq(t, `{"from":"`+client.Id+`"}`, string(mustRead(t, peer)), "Interceptors may change the frame")
+	assert.Equal(t, []string{"validate", "enrich"}, order, "Interceptors run in the order they were added")
+
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"publish","topic":"secret","message":{}}`))
+	frame := readFrame(t, clientPeer)
+	assert.Equal(t, codeIntercepted, frame["code"])
+	assert.Equal(t, "no secrets", frame["detail"])
+	assert.Equal(t, []string{"validate", "enrich", "validate"}, order, "An error stops the chain")
+}
+
+func TestOutboundInterceptorsRunPerDelivery(t *testing.T) {
+	pubsub := &PubSub{}
+	admin, adminPeer := newTestClient(t)
+	guest, guestPeer := newTestClient(t)
+	enveloped, envelopedPeer := newTestClient(t)
+	pubsub.Subscribe(&admin, "orders")
+	pubsub.Subscribe(&guest, "orders")
+	pubsub.SubscribeWith(&enveloped, "orders", SubscribeOptions{Envelope: true})
+	pubsub.UseOutbound(func(ctx context.Context, m *Message) error {
+		switch ClientFromContext(ctx).Id {
+		case admin.Id:
+			return nil
+		case guest.Id:
+			return errors.New("guests see nothing")
+		}
+		assert.Equal(t, interceptedMessage, m.Action)
+		assert.True(t, m.Envelope)
+		m.Message = []byte(`{"card":"redacted"}`)
+		return nil
+	})
+
+	pubsub.Publish("orders", []byte(`{"card":"4111"}`), nil)
+	assert.JSONEq(t, `{"card":"4111"}`, string(mustRead(t, adminPeer)))
+	assert.Equal(t, map[string]interface{}{"card": "redacted"}, readFrame(t, envelopedPeer)["message"], "Changed messages are enveloped for subscriptions asking for it")
+	guest.Send([]byte("end"))
+	assert.Equal(t, "end", string(mustRead(t, guestPeer)), "An error skips the delivery")
+}
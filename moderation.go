@@ -0,0 +1,315 @@
+// This file implements the optional moderation pipeline: messages published to
+// moderated topics are held in a quarantine queue until an automated hook or an admin
+// approves them, and are then released to the subscribers in the order they were published.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Verdict is the outcome of reviewing a quarantined message.
+type Verdict string
+
+const (
+	VerdictApprove Verdict = "approve"
+	VerdictReject  Verdict = "reject"
+	// The hook leaves the decision to an admin
+	VerdictPending Verdict = "pending"
+)
+
+// How long a message is held when no timeout is configured
+const defaultModerationTimeout = 5 * time.Minute
+
+var (
+	errUnknownQuarantined = errors.New("unknown quarantined message")
+	errAlreadyDecided     = errors.New("message was already reviewed")
+)
+
+// ModerationHook reviews the messages held in quarantine.
+type ModerationHook interface {
+	Review(ctx context.Context, topic string, id string, message []byte) (Verdict, error)
+}
+
+// HTTPModerationHook reviews messages by posting them to an external service, which
+// answers with {"verdict": "approve" | "reject" | "pending"}.
+type HTTPModerationHook struct {
+	URL    string
+	Client *http.Client
+}
+
+func (h HTTPModerationHook) Review(ctx context.Context, topic string, id string, message []byte) (Verdict, error) {
+	body, err := json.Marshal(struct {
+		Topic   string `json:"topic"`
+		Id      string `json:"id"`
+		Message []byte `json:"message"`
+	}{topic, id, message})
+	if err != nil {
+		return VerdictPending, err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return VerdictPending, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return VerdictPending, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return VerdictPending, fmt.Errorf("moderation hook answered %s", response.Status)
+	}
+
+	var result struct {
+		Verdict Verdict `json:"verdict"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return VerdictPending, err
+	}
+	switch result.Verdict {
+	case VerdictApprove, VerdictReject, VerdictPending:
+		return result.Verdict, nil
+	}
+	return VerdictPending, fmt.Errorf("moderation hook answered unknown verdict %q", result.Verdict)
+}
+
+// QuarantinedMessage is a message waiting for review.
+type QuarantinedMessage struct {
+	Id      string
+	Topic   string
+	Message []byte
+	HeldAt  time.Time
+	Verdict Verdict
+	timer   *time.Timer
+	// Trace of the publish, continued when the message is released
+	trace trace.SpanContext
+	// Principal that published the message, delivered in its envelope once released
+	publisher string
+	// Where the replies to the message go, delivered in its envelope once released
+	reply replyHeaders
+	// Analytics sample of the message, recorded once released
+	sample *analyticsSample
+	// Client that published the message, which may not want it back
+	source *echoSource
+}
+
+// MarshalJSON embeds JSON messages as is and base64 encodes any other message.
+func (q *QuarantinedMessage) MarshalJSON() ([]byte, error) {
+	view := struct {
+		Id      string          `json:"id"`
+		Topic   string          `json:"topic"`
+		HeldAt  time.Time       `json:"heldAt"`
+		Message json.RawMessage `json:"message,omitempty"`
+		Data    []byte          `json:"data,omitempty"`
+	}{Id: q.Id, Topic: q.Topic, HeldAt: q.HeldAt}
+	if json.Valid(q.Message) {
+		view.Message = q.Message
+	} else {
+		view.Data = q.Message
+	}
+	return json.Marshal(view)
+}
+
+type Moderation struct {
+	// Glob patterns of the moderated topics
+	Topics []string
+	// Optional automated reviewer
+	Hook ModerationHook
+	// How long a message is held before TimeoutVerdict is applied
+	Timeout time.Duration
+	// Verdict applied to messages nobody reviewed in time, reject unless set to approve
+	TimeoutVerdict Verdict
+
+	ps     *PubSub
+	queues map[string][]*QuarantinedMessage
+	held   map[string]*QuarantinedMessage
+	mu     sync.Mutex
+}
+
+// Function to create a moderation pipeline.
+// Parameters:
+// topics: []string - Glob patterns of the topics to moderate.
+// hook: ModerationHook - The automated reviewer, or nil to leave every decision to admins.
+// ps: *PubSub - The PubSub instance approved messages are released to.
+// Returns:
+// *Moderation - The pipeline, rejecting messages not reviewed within five minutes.
+func NewModeration(topics []string, hook ModerationHook, ps *PubSub) *Moderation {
+	return &Moderation{
+		Topics:         topics,
+		Hook:           hook,
+		Timeout:        defaultModerationTimeout,
+		TimeoutVerdict: VerdictReject,
+		ps:             ps,
+		queues:         map[string][]*QuarantinedMessage{},
+		held:           map[string]*QuarantinedMessage{},
+	}
+}
+
+// Function to check whether messages published to a topic are moderated.
+// Parameters:
+// topic: string - The topic.
+// Returns:
+// bool - True if the topic matches one of the patterns.
+func (m *Moderation) Moderates(topic string) bool {
+	for _, pattern := range m.Topics {
+		if globMatch(pattern, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// Function to hold a message until it is reviewed. The hook, if any, reviews it in the
+// background, and the timeout verdict applies once the timeout elapses.
+// Parameters:
+// ctx: context.Context - The context carrying the trace of the publish.
+// id: string - The ID of the message.
+// topic: string - The topic the message was published to.
+// message: []byte - The published message.
+func (m *Moderation) Quarantine(ctx context.Context, id string, topic string, message []byte) {
+	q := &QuarantinedMessage{Id: id, Topic: topic, Message: message, HeldAt: time.Now().UTC(), Verdict: VerdictPending,
+		trace: trace.SpanContextFromContext(ctx), publisher: publisherFrom(ctx), reply: replyFrom(ctx),
+		sample: analyticsSampleFrom(ctx), source: echoSourceFrom(ctx)}
+
+	m.mu.Lock()
+	m.queues[topic] = append(m.queues[topic], q)
+	m.held[id] = q
+	q.timer = time.AfterFunc(m.Timeout, func() {
+		m.Decide(id, m.timeoutVerdict())
+	})
+	m.mu.Unlock()
+
+	if m.Hook != nil {
+		go m.review(q)
+	}
+}
+
+// Function to let the hook review a message.
+// Parameters:
+// q: *QuarantinedMessage - The held message.
+func (m *Moderation) review(q *QuarantinedMessage) {
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
+	defer cancel()
+	verdict, err := m.Hook.Review(ctx, q.Topic, q.Id, q.Message)
+	if err != nil {
+		slog.Error("Moderation hook failed", logKeyTopic, q.Topic, "message_id", q.Id, "error", err)
+		return
+	}
+	if verdict != VerdictPending {
+		m.Decide(q.Id, verdict)
+	}
+}
+
+// Function to approve or reject a held message. Approved messages are released once
+// every message published before them on the same topic has been reviewed.
+// Parameters:
+// id: string - The ID of the message.
+// verdict: Verdict - VerdictApprove or VerdictReject.
+// Returns:
+// error - An error if the message is not held or was already reviewed.
+func (m *Moderation) Decide(id string, verdict Verdict) error {
+	if verdict != VerdictApprove && verdict != VerdictReject {
+		return fmt.Errorf("invalid verdict %q", verdict)
+	}
+
+	// The lock is held while releasing so that messages leave in order
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	q, ok := m.held[id]
+	if !ok {
+		return errUnknownQuarantined
+	}
+	if q.Verdict != VerdictPending {
+		return errAlreadyDecided
+	}
+	q.Verdict = verdict
+	q.timer.Stop()
+
+	queue := m.queues[q.Topic]
+	for len(queue) > 0 && queue[0].Verdict != VerdictPending {
+		head := queue[0]
+		queue = queue[1:]
+		delete(m.held, head.Id)
+		if head.Verdict == VerdictApprove {
+			ctx := withPublisher(trace.ContextWithSpanContext(context.Background(), head.trace), head.publisher)
+			ctx = withAnalyticsSample(withReply(ctx, head.reply), head.sample)
+			ctx = withEchoSource(ctx, head.source)
+			m.ps.release(ctx, head.Id, head.Topic, head.Message)
+		} else {
+			slog.Info("Rejected quarantined message", logKeyTopic, head.Topic, "message_id", head.Id)
+		}
+	}
+	if len(queue) == 0 {
+		delete(m.queues, q.Topic)
+	} else {
+		m.queues[q.Topic] = queue
+	}
+	return nil
+}
+
+// Function to list the messages waiting for review.
+// Returns:
+// []*QuarantinedMessage - The pending messages, oldest first.
+func (m *Moderation) Pending() []*QuarantinedMessage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pending := []*QuarantinedMessage{}
+	for _, q := range m.held {
+		if q.Verdict == VerdictPending {
+			pending = append(pending, q)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].HeldAt.Before(pending[j].HeldAt) })
+	return pending
+}
+
+// Function to get the verdict applied when the timeout elapses.
+// Returns:
+// Verdict - VerdictApprove if configured so, VerdictReject otherwise.
+func (m *Moderation) timeoutVerdict() Verdict {
+	if m.TimeoutVerdict == VerdictApprove {
+		return VerdictApprove
+	}
+	return VerdictReject
+}
+
+// Function to register the admin API reviewing quarantined messages.
+// Parameters:
+// mux: *http.ServeMux - The mux to register the routes on.
+// pubsub: *PubSub - The PubSub the routes serve.
+func setupModerationRoutes(mux *http.ServeMux, pubsub *PubSub) {
+	mux.HandleFunc("GET /admin/quarantine", pubsub.requireAPIKey(PermissionAdmin, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, pubsub.Moderation.Pending())
+	}))
+
+	mux.HandleFunc("POST /admin/quarantine/{id}/{verdict}", pubsub.requireAPIKey(PermissionAdmin, func(w http.ResponseWriter, r *http.Request) {
+		err := pubsub.Moderation.Decide(r.PathValue("id"), Verdict(r.PathValue("verdict")))
+		switch {
+		case errors.Is(err, errUnknownQuarantined):
+			http.NotFound(w, r)
+		case errors.Is(err, errAlreadyDecided):
+			http.Error(w, err.Error(), http.StatusConflict)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+}
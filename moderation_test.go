@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type verdictHook struct {
+	verdicts map[string]Verdict
+}
+
+func (h verdictHook) Review(ctx context.Context, topic string, id string, message []byte) (Verdict, error) {
+	return h.verdicts[string(message)], nil
+}
+
+func TestModerationReleasesInOrder(t *testing.T) {
+	bridge := &recordingBridge{}
+	ps := &PubSub{Bridges: []Bridge{bridge}}
+	ps.Moderation = NewModeration([]string{"chat.*"}, nil, ps)
+	client, peer := newTestClient(t)
+	ps.Subscribe(&client, "chat.lobby")
+
+	ps.Publish("chat.lobby", []byte(`"first"`), nil)
+	ps.Publish("chat.lobby", []byte(`"second"`), nil)
+	ps.Publish("chat.lobby", []byte(`"third"`), nil)
+	pending := ps.Moderation.Pending()
+	assert.Len(t, pending, 3)
+
+	assert.NoError(t, ps.Moderation.Decide(pending[1].Id, VerdictApprove))
+	assert.NoError(t, ps.Moderation.Decide(pending[2].Id, VerdictReject))
+	assert.Empty(t, bridge.relayed(), "Messages wait for the ones published before them")
+
+	assert.NoError(t, ps.Moderation.Decide(pending[0].Id, VerdictApprove))
+	assert.Equal(t, [][]byte{[]byte(`"first"`), []byte(`"second"`)}, bridge.relayed())
+	_, message, err := peer.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, `"first"`, string(message))
+	_, message, err = peer.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, `"second"`, string(message))
+
+	assert.Empty(t, ps.Moderation.Pending())
+	assert.ErrorIs(t, ps.Moderation.Decide(pending[0].Id, VerdictApprove), errUnknownQuarantined)
+}
+
+func TestModerationHookAndTimeout(t *testing.T) {
+	ps := &PubSub{}
+	hook := verdictHook{verdicts: map[string]Verdict{`"ok"`: VerdictApprove, `"bad"`: VerdictReject, `"unsure"`: VerdictPending}}
+	ps.Moderation = NewModeration([]string{"*"}, hook, ps)
+	ps.Moderation.Timeout = 200 * time.Millisecond
+	client, peer := newTestClient(t)
+	ps.Subscribe(&client, "news")
+
+	ps.Publish("news", []byte(`"bad"`), nil)
+	ps.Publish("news", []byte(`"ok"`), nil)
+	_, message, err := peer.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, `"ok"`, string(message), "The hook approves and rejects messages")
+
+	ps.Publish("news", []byte(`"unsure"`), nil)
+	assert.Eventually(t, func() bool { return len(ps.Moderation.Pending()) == 0 }, time.Second, 10*time.Millisecond,
+		"Messages nobody reviewed are rejected on timeout")
+}
+
+func TestHTTPModerationHook(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Topic   string `json:"topic"`
+			Message []byte `json:"message"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		if string(body.Message) == "spam" {
+			w.Write([]byte(`{"verdict":"reject"}`))
+			return
+		}
+		w.Write([]byte(`{"verdict":"approve"}`))
+	}))
+	defer server.Close()
+
+	hook := HTTPModerationHook{URL: server.URL}
+	verdict, err := hook.Review(context.Background(), "chat", "1", []byte("spam"))
+	assert.NoError(t, err)
+	assert.Equal(t, VerdictReject, verdict)
+	verdict, err = hook.Review(context.Background(), "chat", "2", []byte("hello"))
+	assert.NoError(t, err)
+	assert.Equal(t, VerdictApprove, verdict)
+}
+
+func TestModerationAdminRoutes(t *testing.T) {
+	keys := NewAPIKeyStore()
+	isolatePubSub(t).apiKeys = keys
+	keys.Add("root", "admin", []string{PermissionAdmin})
+	ps.Moderation = NewModeration([]string{"admin-moderated"}, nil, ps)
+	defer func() { ps.Moderation = nil }()
+
+	ps.Publish("admin-moderated", []byte("held"), nil)
+	id := ps.Moderation.Pending()[0].Id
+
+	mux := http.NewServeMux()
+	setupModerationRoutes(mux, ps)
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, target, nil)
+		request.Header.Set(apiKeyHeader, "root")
+		response := httptest.NewRecorder()
+		mux.ServeHTTP(response, request)
+		return response
+	}
+
+	var listed []map[string]interface{}
+	response := serve("GET", "/admin/quarantine")
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &listed))
+	assert.Len(t, listed, 1)
+	assert.Equal(t, "aGVsZA==", listed[0]["data"])
+
+	assert.Equal(t, http.StatusBadRequest, serve("POST", "/admin/quarantine/"+id+"/maybe").Code)
+	assert.Equal(t, http.StatusNoContent, serve("POST", "/admin/quarantine/"+id+"/reject").Code)
+	assert.Equal(t, http.StatusNotFound, serve("POST", "/admin/quarantine/"+id+"/approve").Code)
+}
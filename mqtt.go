@@ -0,0 +1,576 @@
+// This file implements an MQTT 3.1.1 listener that shares the topic space of the
+// PubSub system, so IoT devices can publish over MQTT while browsers subscribe
+// over WebSockets and vice versa. MQTT clients are authenticated, given an ID and
+// limited as TCP clients are, and their packets are handled as the frames they stand for.
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// MQTT control packet types
+const (
+	mqttConnect     = 1
+	mqttConnack     = 2
+	mqttPublish     = 3
+	mqttPuback      = 4
+	mqttPubrec      = 5
+	mqttPubrel      = 6
+	mqttPubcomp     = 7
+	mqttSubscribe   = 8
+	mqttSuback      = 9
+	mqttUnsubscribe = 10
+	mqttUnsuback    = 11
+	mqttPingreq     = 12
+	mqttPingresp    = 13
+	mqttDisconnect  = 14
+)
+
+// CONNACK return codes
+const (
+	mqttConnAccepted           = 0x00
+	mqttConnRefusedVersion     = 0x01
+	mqttConnRefusedIdentifier  = 0x02
+	mqttConnRefusedUnavailable = 0x03
+	mqttConnRefusedAuthorized  = 0x05
+	mqttSubackFailure          = 0x80
+	mqttProtocolLevel311       = 4
+	mqttMaxRemainingLength     = 268435455
+	mqttConnectTimeout         = 10 * time.Second
+	mqttKeepAliveGraceFraction = 2
+)
+
+// Username of a client whose password is an API key rather than a token
+const mqttAPIKeyUsername = "apikey"
+
+var (
+	errMQTTMalformed      = errors.New("mqtt: malformed packet")
+	errMQTTPacketTooLarge = errors.New("mqtt: packet over the size limit")
+)
+
+type MQTTServer struct {
+	Listener net.Listener
+	ps       *PubSub
+}
+
+// A packet read from an MQTT connection
+type mqttPacket struct {
+	Type  byte
+	Flags byte
+	Body  []byte
+}
+
+// The fields of a CONNECT packet
+type mqttConnectPacket struct {
+	// Client identifier, only checked as sessions are never persisted
+	ClientIdentifier string
+	Username         string
+	Password         string
+	Will             *Will
+	KeepAlive        time.Duration
+}
+
+// The state of one connected MQTT client
+type mqttSession struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	client    Client
+	keepAlive time.Duration
+	mu        sync.Mutex
+	// How long a write may take, 0 for no limit
+	writeTimeout time.Duration
+}
+
+// Function to start listening for MQTT connections.
+// Parameters:
+// addr: string - The TCP address to listen on, e.g. ":1883".
+// ps: *PubSub - The PubSub instance MQTT clients publish to and subscribe on.
+// Returns:
+// *MQTTServer - The listening server; call Serve to accept connections.
+// error - An error if the address could not be listened on.
+func ListenMQTT(addr string, ps *PubSub) (*MQTTServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &MQTTServer{Listener: listener, ps: ps}, nil
+}
+
+// Function to accept MQTT connections until the listener is closed.
+// Returns:
+// error - The error that stopped the accept loop.
+func (s *MQTTServer) Serve() error {
+	for {
+		conn, err := s.Listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handleConn(conn)
+	}
+}
+
+// Function to stop accepting MQTT connections.
+func (s *MQTTServer) Close() error {
+	return s.Listener.Close()
+}
+
+// Function to run the session of one MQTT connection: the CONNECT handshake followed by
+// the packet loop, removing the client's subscriptions when the connection ends.
+// Parameters:
+// conn: net.Conn - The accepted TCP connection.
+func (s *MQTTServer) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	options := s.ps.options()
+	session := &mqttSession{conn: conn, reader: bufio.NewReader(conn), writeTimeout: options.writeTimeout}
+	conn.SetReadDeadline(time.Now().Add(mqttConnectTimeout))
+	// Connections beyond the limit are refused once their CONNECT was read
+	ip := hostOf(conn.RemoteAddr().String())
+	if err := options.connections.acquire("mqtt", ip); err != nil {
+		slog.Info("Refused MQTT connection", "remote_addr", conn.RemoteAddr().String(), "error", err)
+		if _, err := session.readPacket(tcpMaxFrameSize); err == nil {
+			session.writePacket(mqttConnack<<4, []byte{0, mqttConnRefusedUnavailable})
+		}
+		return
+	}
+	defer options.connections.release(ip)
+	remoteAddr := conn.RemoteAddr().String()
+	connect, err := session.readConnect()
+	if err != nil {
+		slog.Warn("MQTT handshake failed", "remote_addr", remoteAddr, "error", err)
+		return
+	}
+	r := connect.request(remoteAddr)
+	claims, err := options.authenticate(r)
+	// Widget tokens are only valid on the widget endpoint, which pins their origin
+	if err == nil && isWidgetToken(claims) {
+		err = errWidgetToken
+	}
+	if err != nil {
+		slog.Info("MQTT client failed authentication", "remote_addr", remoteAddr, "error", err)
+		session.writePacket(mqttConnack<<4, []byte{0, mqttConnRefusedAuthorized})
+		return
+	}
+	id, err := options.newClientID(r, claims)
+	if err != nil {
+		slog.Info("MQTT client has no valid ID", "remote_addr", remoteAddr, "error", err)
+		session.writePacket(mqttConnack<<4, []byte{0, mqttConnRefusedIdentifier})
+		return
+	}
+
+	session.client = Client{
+		Id:        id,
+		Language:  defaultLanguage,
+		Transport: session,
+		Claims:    claims,
+		Limits:    options.limitsFor(claims),
+		Session:   NewSession(remoteAddr),
+		server:    options,
+	}
+	session.keepAlive = connect.KeepAlive
+	// A connection already holding the ID is replaced by this one
+	releaseID, err := s.ps.claimClientID(id)
+	if err != nil {
+		slog.Info("Refused MQTT client whose ID is in use", logKeyClient, id, "error", err)
+		session.writePacket(mqttConnack<<4, []byte{0, mqttConnRefusedUnavailable})
+		return
+	}
+	defer releaseID()
+	if err := session.writePacket(mqttConnack<<4, []byte{0, mqttConnAccepted}); err != nil {
+		slog.Warn("MQTT handshake failed", "remote_addr", remoteAddr, "error", err)
+		return
+	}
+
+	logger := session.client.logger()
+	logger.Info("MQTT client connected", "principal", session.client.Principal(), "remote_addr", remoteAddr)
+	session.client.Will = s.ps.registerWill(&session.client, connect.Will)
+
+	s.ps.AddClient(session.client)
+	defer s.ps.RemoveClient(session.client)
+	s.ps.userConnected(session.client.Principal())
+	defer s.ps.userDisconnected(session.client.Principal(), options.statusGracePeriod)
+	defer s.ps.publishWill(&session.client)
+	s.ps.restoreDurableSubscriptions(&session.client)
+
+	// Packets over the size limit of the client close the connection
+	limit := session.client.Limits.readLimit()
+	if limit <= 0 {
+		limit = tcpMaxFrameSize
+	}
+	limiter := newRateLimiter(session.client.Limits)
+	for {
+		if session.keepAlive > 0 {
+			conn.SetReadDeadline(time.Now().Add(session.keepAlive + session.keepAlive/mqttKeepAliveGraceFraction))
+		} else {
+			conn.SetReadDeadline(deadlineAfter(options.readTimeout))
+		}
+
+		packet, err := session.readPacket(limit)
+		if err != nil {
+			if errors.Is(err, errMQTTPacketTooLarge) {
+				logger.Info("Closing MQTT client sending a packet over the size limit")
+				return
+			}
+			if err != io.EOF {
+				logger.Warn("MQTT read error", "error", err)
+			}
+			return
+		}
+		session.client.Session.Touch()
+		// Drop publishes over the rate limit without acknowledging them, so QoS 1 and 2
+		// clients send them again later, and close clients that keep sending them
+		if packet.Type == mqttPublish {
+			admitted, disconnect, _ := limiter.check(&session.client, time.Now())
+			if disconnect {
+				return
+			}
+			if !admitted {
+				continue
+			}
+		}
+
+		switch packet.Type {
+		case mqttPublish:
+			err = session.handlePublish(s.ps, packet)
+		case mqttPubrel:
+			err = session.writePacket(mqttPubcomp<<4, packet.Body)
+		case mqttSubscribe:
+			err = session.handleSubscribe(s.ps, packet)
+		case mqttUnsubscribe:
+			err = session.handleUnsubscribe(s.ps, packet)
+		case mqttPingreq:
+			err = session.writePacket(mqttPingresp<<4, nil)
+		case mqttDisconnect:
+			// Clients disconnecting normally discard their will
+			session.client.Will = nil
+			return
+		default:
+			err = fmt.Errorf("mqtt: unexpected packet type %d", packet.Type)
+		}
+		if err != nil {
+			logger.Warn("MQTT session error", "error", err)
+			return
+		}
+	}
+}
+
+// Function to read the CONNECT packet, answering it with a CONNACK when it is refused.
+// Returns:
+// mqttConnectPacket - The fields of the packet.
+// error - An error if the client did not send a valid CONNECT packet.
+func (s *mqttSession) readConnect() (mqttConnectPacket, error) {
+	var connect mqttConnectPacket
+	packet, err := s.readPacket(tcpMaxFrameSize)
+	if err != nil {
+		return connect, err
+	}
+	if packet.Type != mqttConnect {
+		return connect, fmt.Errorf("mqtt: expected CONNECT, got packet type %d", packet.Type)
+	}
+
+	body := packet.Body
+	protocol, body, err := readMQTTString(body)
+	if err != nil || len(body) < 4 {
+		return connect, errMQTTMalformed
+	}
+	level, flags := body[0], body[1]
+	connect.KeepAlive = time.Duration(binary.BigEndian.Uint16(body[2:4])) * time.Second
+	body = body[4:]
+
+	if protocol != "MQTT" || level != mqttProtocolLevel311 {
+		s.writePacket(mqttConnack<<4, []byte{0, mqttConnRefusedVersion})
+		return connect, fmt.Errorf("mqtt: unsupported protocol %q level %d", protocol, level)
+	}
+
+	connect.ClientIdentifier, body, err = readMQTTString(body)
+	if err != nil {
+		return connect, errMQTTMalformed
+	}
+	// The will topic and message follow the client identifier when the will flag is set
+	if flags&0x04 != 0 {
+		willTopic, rest, err := readMQTTString(body)
+		if err != nil {
+			return connect, errMQTTMalformed
+		}
+		willMessage, rest, err := readMQTTString(rest)
+		if err != nil {
+			return connect, errMQTTMalformed
+		}
+		connect.Will = &Will{Topic: willTopic, Message: json.RawMessage(willMessage)}
+		body = rest
+	}
+	// Then the username and the password, when their flags are set
+	if flags&0x80 != 0 {
+		if connect.Username, body, err = readMQTTString(body); err != nil {
+			return connect, errMQTTMalformed
+		}
+	}
+	if flags&0x40 != 0 {
+		if connect.Password, _, err = readMQTTString(body); err != nil {
+			return connect, errMQTTMalformed
+		}
+	}
+	// Sessions are never persisted, so a client asking to resume one with an empty
+	// identifier cannot be accepted
+	if connect.ClientIdentifier == "" && flags&0x02 == 0 {
+		s.writePacket(mqttConnack<<4, []byte{0, mqttConnRefusedIdentifier})
+		return connect, errors.New("mqtt: empty client identifier without clean session")
+	}
+	return connect, nil
+}
+
+// Function to build the upgrade request a CONNECT packet stands for, so an MQTT client is
+// authenticated as a WebSocket client presenting the same credentials would be. The
+// password is the token of the client, or its API key with the username apikey.
+// Parameters:
+// remoteAddr: string - The address of the client.
+// Returns:
+// *http.Request - The request.
+func (connect mqttConnectPacket) request(remoteAddr string) *http.Request {
+	frame := tcpConnectFrame{Token: connect.Password}
+	if connect.Username == mqttAPIKeyUsername {
+		frame = tcpConnectFrame{APIKey: connect.Password}
+	}
+	return frame.request(remoteAddr)
+}
+
+// Function to publish a message received from an MQTT client to the PubSub system,
+// acknowledging it according to its QoS level.
+// Parameters:
+// ps: *PubSub - The PubSub instance to publish to.
+// packet: mqttPacket - The PUBLISH packet.
+// Returns:
+// error - An error if the packet was malformed or could not be acknowledged.
+func (s *mqttSession) handlePublish(ps *PubSub, packet mqttPacket) error {
+	qos := (packet.Flags >> 1) & 0x03
+	topic, body, err := readMQTTString(packet.Body)
+	if err != nil || topic == "" || strings.ContainsAny(topic, "+#") {
+		return errMQTTMalformed
+	}
+
+	var packetId []byte
+	if qos > 0 {
+		if len(body) < 2 {
+			return errMQTTMalformed
+		}
+		packetId, body = body[:2], body[2:]
+	}
+
+	// The publish is handled as a publish frame, under the same checks. MQTT 3.1.1
+	// delivers messages to their publisher too when it is subscribed, and has no way
+	// to tell a publisher its publish was refused
+	frame, _ := json.Marshal(Message{Action: PUBLISH, Topic: topic, Data: body})
+	ps.HandleRecvdMessage(s.client, websocket.TextMessage, frame)
+
+	switch qos {
+	case 1:
+		return s.writePacket(mqttPuback<<4, packetId)
+	case 2:
+		return s.writePacket(mqttPubrec<<4, packetId)
+	}
+	return nil
+}
+
+// Function to subscribe an MQTT client to the topics of a SUBSCRIBE packet. Only
+// exact topic names are supported; filters with wildcards are refused in the SUBACK.
+// Parameters:
+// ps: *PubSub - The PubSub instance to subscribe on.
+// packet: mqttPacket - The SUBSCRIBE packet.
+// Returns:
+// error - An error if the packet was malformed or could not be acknowledged.
+func (s *mqttSession) handleSubscribe(ps *PubSub, packet mqttPacket) error {
+	if len(packet.Body) < 2 {
+		return errMQTTMalformed
+	}
+	packetId, body := packet.Body[:2], packet.Body[2:]
+
+	response := append([]byte{}, packetId...)
+	for len(body) > 0 {
+		topic, rest, err := readMQTTString(body)
+		if err != nil || len(rest) < 1 {
+			return errMQTTMalformed
+		}
+		body = rest[1:]
+
+		if topic == "" || strings.ContainsAny(topic, "+#") {
+			response = append(response, mqttSubackFailure)
+			continue
+		}
+		// The subscription is handled as a subscribe frame, under the same checks, and
+		// granted if the client is subscribed afterwards
+		frame, _ := json.Marshal(Message{Action: SUBSCRIBE, Topic: topic})
+		ps.HandleRecvdMessage(s.client, websocket.TextMessage, frame)
+		ps.mu.Lock()
+		subscribed := len(ps.GetSubscriptions(topic, &s.client)) > 0
+		ps.mu.Unlock()
+		if !subscribed {
+			response = append(response, mqttSubackFailure)
+			continue
+		}
+		// Messages are delivered to MQTT clients at QoS 0
+		response = append(response, 0x00)
+	}
+	return s.writePacket(mqttSuback<<4, response)
+}
+
+// Function to unsubscribe an MQTT client from the topics of an UNSUBSCRIBE packet.
+// Parameters:
+// ps: *PubSub - The PubSub instance to unsubscribe from.
+// packet: mqttPacket - The UNSUBSCRIBE packet.
+// Returns:
+// error - An error if the packet was malformed or could not be acknowledged.
+func (s *mqttSession) handleUnsubscribe(ps *PubSub, packet mqttPacket) error {
+	if len(packet.Body) < 2 {
+		return errMQTTMalformed
+	}
+	packetId, body := packet.Body[:2], packet.Body[2:]
+
+	for len(body) > 0 {
+		topic, rest, err := readMQTTString(body)
+		if err != nil {
+			return errMQTTMalformed
+		}
+		body = rest
+		frame, _ := json.Marshal(Message{Action: UNSUBSCRIBE, Topic: topic})
+		ps.HandleRecvdMessage(s.client, websocket.TextMessage, frame)
+	}
+	return s.writePacket(mqttUnsuback<<4, packetId)
+}
+
+// Function to close the connection of the client. MQTT 3.1.1 has no packet telling a
+// client why, so the reason is only logged.
+// Parameters:
+// reason: DisconnectReason - Why the client is disconnected.
+// Returns:
+// error - An error if the connection could not be closed.
+func (s *mqttSession) Close(reason DisconnectReason) error {
+	s.client.logger().Info("Closing MQTT client", "reason", reason)
+	return s.conn.Close()
+}
+
+// Function to deliver a message published on a subscribed topic as a QoS 0 PUBLISH packet.
+// Parameters:
+// topic: string - The topic the message was published to.
+// message: []byte - The message payload.
+// Returns:
+// error - An error if the packet could not be written.
+func (s *mqttSession) Deliver(topic string, message []byte) error {
+	body := appendMQTTString(nil, topic)
+	body = append(body, message...)
+	return s.writePacket(mqttPublish<<4, body)
+}
+
+// Function to read one control packet from the connection.
+// Parameters:
+// limit: int64 - The largest remaining length accepted.
+// Returns:
+// mqttPacket - The packet that was read.
+// error - An error if the connection failed or the packet was malformed.
+func (s *mqttSession) readPacket(limit int64) (mqttPacket, error) {
+	header, err := s.reader.ReadByte()
+	if err != nil {
+		return mqttPacket{}, err
+	}
+
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return mqttPacket{}, errMQTTMalformed
+		}
+		digit, err := s.reader.ReadByte()
+		if err != nil {
+			return mqttPacket{}, err
+		}
+		length += int(digit&0x7f) * multiplier
+		multiplier *= 128
+		if digit&0x80 == 0 {
+			break
+		}
+	}
+
+	// The body is only allocated once its length is known to be within the limit
+	if int64(length) > limit {
+		return mqttPacket{}, errMQTTPacketTooLarge
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(s.reader, body); err != nil {
+		return mqttPacket{}, err
+	}
+	return mqttPacket{Type: header >> 4, Flags: header & 0x0f, Body: body}, nil
+}
+
+// Function to write one control packet to the connection. Writes are serialized so
+// deliveries from publishing goroutines never interleave with acknowledgements.
+// Parameters:
+// header: byte - The first byte of the fixed header (packet type and flags).
+// body: []byte - The variable header and payload.
+// Returns:
+// error - An error if the packet could not be written.
+func (s *mqttSession) writePacket(header byte, body []byte) error {
+	if len(body) > mqttMaxRemainingLength {
+		return errMQTTMalformed
+	}
+
+	packet := []byte{header}
+	length := len(body)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if length == 0 {
+			break
+		}
+	}
+	packet = append(packet, body...)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	armConnWriteDeadline(s.conn, s.writeTimeout, 0)
+	_, err := s.conn.Write(packet)
+	return err
+}
+
+// Function to read a length-prefixed UTF-8 string.
+// Parameters:
+// data: []byte - The data starting with the string.
+// Returns:
+// string - The string that was read.
+// []byte - The data following the string.
+// error - An error if the data is too short.
+func readMQTTString(data []byte) (string, []byte, error) {
+	if len(data) < 2 {
+		return "", nil, errMQTTMalformed
+	}
+	length := int(binary.BigEndian.Uint16(data))
+	if len(data) < 2+length {
+		return "", nil, errMQTTMalformed
+	}
+	return string(data[2 : 2+length]), data[2+length:], nil
+}
+
+// Function to append a length-prefixed UTF-8 string.
+// Parameters:
+// data: []byte - The data to append to.
+// value: string - The string to append.
+// Returns:
+// []byte - The extended data.
+func appendMQTTString(data []byte, value string) []byte {
+	data = binary.BigEndian.AppendUint16(data, uint16(len(value)))
+	return append(data, value...)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// dialMQTT starts an MQTT listener for ps and sends it a CONNECT packet with the
+// credentials, returning the client side session and the body of the CONNACK.
+func dialMQTT(t *testing.T, ps *PubSub, username string, password string) (*mqttSession, []byte) {
+	server, err := ListenMQTT("127.0.0.1:0", ps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	go server.Serve()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	peer := &mqttSession{conn: conn, reader: bufio.NewReader(conn)}
+	flags := byte(0x02)
+	if username != "" {
+		flags |= 0x80
+	}
+	if password != "" {
+		flags |= 0x40
+	}
+	connect := appendMQTTString(nil, "MQTT")
+	connect = append(connect, mqttProtocolLevel311, flags, 0, 60)
+	connect = appendMQTTString(connect, "sensor-1")
+	if username != "" {
+		connect = appendMQTTString(connect, username)
+	}
+	if password != "" {
+		connect = appendMQTTString(connect, password)
+	}
+	assert.NoError(t, peer.writePacket(mqttConnect<<4, connect))
+
+	connack, err := peer.readPacket(tcpMaxFrameSize)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(mqttConnack), connack.Type)
+	return peer, connack.Body
+}
+
+// newTestMQTTSession starts an MQTT listener for ps and returns a connected,
+// handshaken client side session used to exchange raw packets with it.
+func newTestMQTTSession(t *testing.T, ps *PubSub) *mqttSession {
+	peer, connack := dialMQTT(t, ps, "", "")
+	assert.Equal(t, []byte{0, mqttConnAccepted}, connack)
+	return peer
+}
+
+func TestMQTTSubscribeReceivesPublishes(t *testing.T) {
+	ps := &PubSub{}
+	peer := newTestMQTTSession(t, ps)
+
+	subscribe := appendMQTTString([]byte{0, 1}, "alerts")
+	subscribe = append(subscribe, 1)
+	subscribe = appendMQTTString(subscribe, "alerts/#")
+	subscribe = append(subscribe, 0)
+	assert.NoError(t, peer.writePacket(mqttSubscribe<<4|0x02, subscribe))
+
+	suback, err := peer.readPacket(tcpMaxFrameSize)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(mqttSuback), suback.Type)
+	assert.Equal(t, []byte{0, 1, 0x00, mqttSubackFailure}, suback.Body, "Wildcard filters should be refused")
+
+	ps.Publish("alerts", []byte(`{"level":"high"}`), nil)
+
+	publish, err := peer.readPacket(tcpMaxFrameSize)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(mqttPublish), publish.Type)
+	topic, payload, err := readMQTTString(publish.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "alerts", topic)
+	assert.Equal(t, []byte(`{"level":"high"}`), payload)
+}
+
+func TestMQTTPublishReachesWebSocketSubscribers(t *testing.T) {
+	ps := &PubSub{}
+	peer := newTestMQTTSession(t, ps)
+
+	client, wsPeer := newTestClient(t)
+	ps.Subscribe(&client, "sensors")
+
+	publish := appendMQTTString(nil, "sensors")
+	publish = append(publish, 0, 7)
+	publish = append(publish, []byte("21.5")...)
+	assert.NoError(t, peer.writePacket(mqttPublish<<4|0x02, publish))
+
+	puback, err := peer.readPacket(tcpMaxFrameSize)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(mqttPuback), puback.Type)
+	assert.Equal(t, []byte{0, 7}, puback.Body)
+
+	_, message, err := wsPeer.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("21.5"), message)
+}
+
+func TestMQTTDisconnectRemovesSubscriptions(t *testing.T) {
+	ps := &PubSub{}
+	peer := newTestMQTTSession(t, ps)
+
+	subscribe := appendMQTTString([]byte{0, 1}, "alerts")
+	subscribe = append(subscribe, 0)
+	assert.NoError(t, peer.writePacket(mqttSubscribe<<4|0x02, subscribe))
+	_, err := peer.readPacket(tcpMaxFrameSize)
+	assert.NoError(t, err)
+	assert.Len(t, ps.GetSubscriptions("alerts", nil), 1)
+
+	assert.NoError(t, peer.writePacket(mqttDisconnect<<4, nil))
+	assert.Eventually(t, func() bool {
+		ps.mu.Lock()
+		defer ps.mu.Unlock()
+		return len(ps.GetSubscriptions("alerts", nil)) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestMQTTPublishesOverRateLimitAreDroppedThenDisconnected(t *testing.T) {
+	ps := &PubSub{}
+	ps.options().defaultLimits = Limits{RateLimit: 0.01, RateBurst: 1}
+	ps.options().rateLimitStrikes = 3
+	peer := newTestMQTTSession(t, ps)
+	publish := func(packetId byte) {
+		packet := appendMQTTString(nil, "sensors")
+		packet = append(packet, 0, packetId)
+		packet = append(packet, []byte("21.5")...)
+		assert.NoError(t, peer.writePacket(mqttPublish<<4|0x02, packet))
+	}
+
+	// The first publish is acknowledged, the second dropped without an acknowledgement
+	publish(1)
+	puback, err := peer.readPacket(tcpMaxFrameSize)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0, 1}, puback.Body)
+	publish(2)
+	assert.NoError(t, peer.writePacket(mqttPingreq<<4, nil))
+	pingresp, err := peer.readPacket(tcpMaxFrameSize)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(mqttPingresp), pingresp.Type, "Pings are not limited and the dropped publish is not acknowledged")
+
+	// The third publish dropped in a row closes the connection
+	publish(3)
+	publish(4)
+	_, err = peer.readPacket(tcpMaxFrameSize)
+	assert.Error(t, err)
+}
+
+func TestMQTTSubscribeRefusesAdminOnlyTopics(t *testing.T) {
+	ps := &PubSub{}
+	peer := newTestMQTTSession(t, ps)
+
+	subscribe := appendMQTTString([]byte{0, 1}, ps.options().adminEventsTopic)
+	subscribe = append(subscribe, 0)
+	assert.NoError(t, peer.writePacket(mqttSubscribe<<4|0x02, subscribe))
+	suback, err := peer.readPacket(tcpMaxFrameSize)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0, 1, mqttSubackFailure}, suback.Body)
+	assert.Empty(t, ps.GetSubscriptions(ps.options().adminEventsTopic, nil))
+}
+
+func TestMQTTClientsAreAuthenticated(t *testing.T) {
+	ps := &PubSub{}
+	options := ps.options()
+	options.apiKeys = NewAPIKeyStore()
+	options.apiKeys.Add("device-secret", "thermostat", []string{PermissionSubscribe})
+	options.jwtAuthenticator = NewHMACAuthenticator([]byte("s3cret"))
+	widget, err := options.mintWidgetToken(WidgetTokenRequest{Subject: "visitor-42", Origin: "https://shop.example.com", Prefix: "widgets.acme."}, time.Now())
+	assert.NoError(t, err)
+
+	_, connack := dialMQTT(t, ps, "", "")
+	assert.Equal(t, []byte{0, mqttConnRefusedAuthorized}, connack, "Clients without credentials are refused")
+	_, connack = dialMQTT(t, ps, mqttAPIKeyUsername, "wrong")
+	assert.Equal(t, []byte{0, mqttConnRefusedAuthorized}, connack)
+	_, connack = dialMQTT(t, ps, "", widget.Token)
+	assert.Equal(t, []byte{0, mqttConnRefusedAuthorized}, connack, "Widget tokens are refused as on /ws")
+
+	peer, connack := dialMQTT(t, ps, mqttAPIKeyUsername, "device-secret")
+	assert.Equal(t, []byte{0, mqttConnAccepted}, connack)
+	assert.Eventually(t, func() bool {
+		ps.mu.Lock()
+		defer ps.mu.Unlock()
+		return len(ps.Clients()) == 1 && ps.Clients()[0].Principal() == "thermostat"
+	}, time.Second, 10*time.Millisecond)
+
+	// The key does not allow publishing
+	subscriber, wsPeer := newTestClient(t)
+	ps.Subscribe(&subscriber, "sensors")
+	publish := appendMQTTString(nil, "sensors")
+	publish = append(publish, 0, 7)
+	publish = append(publish, []byte("21.5")...)
+	assert.NoError(t, peer.writePacket(mqttPublish<<4|0x02, publish))
+	puback, err := peer.readPacket(tcpMaxFrameSize)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(mqttPuback), puback.Type)
+	wsPeer.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, _, err = wsPeer.ReadMessage()
+	assert.Error(t, err, "Refused publishes are not delivered")
+
+	// MQTT clients can be kicked like the others
+	ps.mu.Lock()
+	id := ps.Clients()[0].Id
+	ps.mu.Unlock()
+	assert.NoError(t, ps.Kick(id, ReasonKicked))
+	_, err = peer.readPacket(tcpMaxFrameSize)
+	assert.Error(t, err)
+}
+
+func TestMQTTSubscribeIsCheckedAsASubscribeFrame(t *testing.T) {
+	ps := &PubSub{}
+	ps.options().defaultLimits = Limits{MaxSubscriptions: 1}
+	peer := newTestMQTTSession(t, ps)
+
+	subscribe := appendMQTTString([]byte{0, 1}, "alerts")
+	subscribe = append(subscribe, 0)
+	subscribe = appendMQTTString(subscribe, "news")
+	subscribe = append(subscribe, 0)
+	assert.NoError(t, peer.writePacket(mqttSubscribe<<4|0x02, subscribe))
+	suback, err := peer.readPacket(tcpMaxFrameSize)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0, 1, 0x00, mqttSubackFailure}, suback.Body, "MQTT clients get the subscription limit of their token")
+}
+
+func TestMQTTPacketsOverTheMessageSizeCloseTheConnection(t *testing.T) {
+	ps := &PubSub{}
+	ps.options().defaultLimits = Limits{MaxMessageSize: 16}
+	peer := newTestMQTTSession(t, ps)
+
+	// A packet announcing 128 MB is refused before its body is read
+	_, err := peer.conn.Write([]byte{mqttPublish << 4, 0x80, 0x80, 0x80, 0x40})
+	assert.NoError(t, err)
+	_, err = peer.readPacket(tcpMaxFrameSize)
+	assert.Error(t, err)
+}
@@ -0,0 +1,373 @@
+// This file translates frames between JSON and MessagePack for the msgpack envelope
+// codec. Only the JSON data model is needed: maps with string keys, arrays, strings,
+// numbers, booleans and nil. Integers stay integers, bin values become base64 strings
+// and integer map keys become decimal strings; extension types have no JSON
+// equivalent and are refused.
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+)
+
+// How deep MessagePack values may nest, so a hostile frame cannot exhaust the stack
+const maxMsgpackDepth = 64
+
+var errMsgpackTruncated = errors.New("msgpack: truncated value")
+
+// Function to translate a JSON document to MessagePack.
+// Parameters:
+// data: []byte - The JSON document.
+// Returns:
+// []byte - The MessagePack value.
+// error - An error if the document is not valid JSON.
+func jsonToMsgpack(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	var buffer bytes.Buffer
+	writeMsgpack(&buffer, value)
+	return buffer.Bytes(), nil
+}
+
+// Function to write a decoded JSON value as MessagePack, in its shortest form.
+// Parameters:
+// buffer: *bytes.Buffer - The buffer written to.
+// value: interface{} - The value, as decoded with json.Decoder.UseNumber.
+func writeMsgpack(buffer *bytes.Buffer, value interface{}) {
+	switch value := value.(type) {
+	case nil:
+		buffer.WriteByte(0xc0)
+	case bool:
+		if value {
+			buffer.WriteByte(0xc3)
+		} else {
+			buffer.WriteByte(0xc2)
+		}
+	case json.Number:
+		if n, err := strconv.ParseInt(string(value), 10, 64); err == nil {
+			writeMsgpackInt(buffer, n)
+			return
+		}
+		if n, err := strconv.ParseUint(string(value), 10, 64); err == nil {
+			buffer.WriteByte(0xcf)
+			binary.Write(buffer, binary.BigEndian, n)
+			return
+		}
+		f, _ := value.Float64()
+		buffer.WriteByte(0xcb)
+		binary.Write(buffer, binary.BigEndian, math.Float64bits(f))
+	case string:
+		writeMsgpackHead(buffer, len(value), 0xa0, 32, 0xd9, 0xda, 0xdb)
+		buffer.WriteString(value)
+	case []interface{}:
+		writeMsgpackHead(buffer, len(value), 0x90, 16, 0, 0xdc, 0xdd)
+		for _, item := range value {
+			writeMsgpack(buffer, item)
+		}
+	case map[string]interface{}:
+		// Keys are sorted so the same document always encodes the same
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		writeMsgpackHead(buffer, len(value), 0x80, 16, 0, 0xde, 0xdf)
+		for _, key := range keys {
+			writeMsgpack(buffer, key)
+			writeMsgpack(buffer, value[key])
+		}
+	}
+}
+
+// Function to write an integer in its shortest form.
+// Parameters:
+// buffer: *bytes.Buffer - The buffer written to.
+// n: int64 - The integer.
+func writeMsgpackInt(buffer *bytes.Buffer, n int64) {
+	switch {
+	case n >= 0 && n <= math.MaxInt8:
+		buffer.WriteByte(byte(n))
+	case n >= -32 && n < 0:
+		buffer.WriteByte(byte(n))
+	case n > 0 && n <= math.MaxUint8:
+		buffer.Write([]byte{0xcc, byte(n)})
+	case n > 0 && n <= math.MaxUint16:
+		buffer.WriteByte(0xcd)
+		binary.Write(buffer, binary.BigEndian, uint16(n))
+	case n > 0 && n <= math.MaxUint32:
+		buffer.WriteByte(0xce)
+		binary.Write(buffer, binary.BigEndian, uint32(n))
+	case n > 0:
+		buffer.WriteByte(0xcf)
+		binary.Write(buffer, binary.BigEndian, uint64(n))
+	case n >= math.MinInt8:
+		buffer.Write([]byte{0xd0, byte(n)})
+	case n >= math.MinInt16:
+		buffer.WriteByte(0xd1)
+		binary.Write(buffer, binary.BigEndian, int16(n))
+	case n >= math.MinInt32:
+		buffer.WriteByte(0xd2)
+		binary.Write(buffer, binary.BigEndian, int32(n))
+	default:
+		buffer.WriteByte(0xd3)
+		binary.Write(buffer, binary.BigEndian, n)
+	}
+}
+
+// Function to write the head of a string, bin, array or map in its shortest form.
+// Parameters:
+// buffer: *bytes.Buffer - The buffer written to.
+// n: int - The length of the value.
+// fix: byte - The first byte of the fix form, which holds the length.
+// fixLimit: int - The lengths below which the fix form is used, 0 if there is none.
+// code8: byte - The first byte of the form with an 8 bit length, 0 if there is none.
+// code16: byte - The first byte of the form with a 16 bit length.
+// code32: byte - The first byte of the form with a 32 bit length.
+func writeMsgpackHead(buffer *bytes.Buffer, n int, fix byte, fixLimit int, code8, code16, code32 byte) {
+	switch {
+	case n < fixLimit:
+		buffer.WriteByte(fix | byte(n))
+	case code8 != 0 && n <= math.MaxUint8:
+		buffer.Write([]byte{code8, byte(n)})
+	case n <= math.MaxUint16:
+		buffer.WriteByte(code16)
+		binary.Write(buffer, binary.BigEndian, uint16(n))
+	default:
+		buffer.WriteByte(code32)
+		binary.Write(buffer, binary.BigEndian, uint32(n))
+	}
+}
+
+// Function to translate a MessagePack value to JSON.
+// Parameters:
+// data: []byte - A single MessagePack value.
+// Returns:
+// []byte - The JSON document.
+// error - An error if the data is not a single well-formed value or cannot be represented in JSON.
+func msgpackToJSON(data []byte) ([]byte, error) {
+	reader := &msgpackReader{data: data}
+	value, err := reader.value(0)
+	if err != nil {
+		return nil, err
+	}
+	if reader.offset != len(data) {
+		return nil, errors.New("msgpack: data after the value")
+	}
+	return json.Marshal(value)
+}
+
+// Reader of the values of a MessagePack document
+type msgpackReader struct {
+	data   []byte
+	offset int
+}
+
+// Function to read n bytes.
+// Parameters:
+// n: uint64 - The number of bytes.
+// Returns:
+// []byte - The bytes.
+// error - errMsgpackTruncated if fewer bytes are left.
+func (r *msgpackReader) bytes(n uint64) ([]byte, error) {
+	if n > uint64(len(r.data)-r.offset) {
+		return nil, errMsgpackTruncated
+	}
+	b := r.data[r.offset : r.offset+int(n)]
+	r.offset += int(n)
+	return b, nil
+}
+
+// Function to read a big-endian unsigned integer.
+// Parameters:
+// size: int - Its size in bytes: 1, 2, 4 or 8.
+// Returns:
+// uint64 - The integer.
+// error - errMsgpackTruncated if fewer bytes are left.
+func (r *msgpackReader) uint(size int) (uint64, error) {
+	b, err := r.bytes(uint64(size))
+	if err != nil {
+		return 0, err
+	}
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	return n, nil
+}
+
+// Function to read a value as a value json.Marshal encodes.
+// Parameters:
+// depth: int - How deep the value is nested.
+// Returns:
+// interface{} - The value.
+// error - An error if the value is malformed, nested too deep or an extension type.
+func (r *msgpackReader) value(depth int) (interface{}, error) {
+	if depth > maxMsgpackDepth {
+		return nil, errors.New("msgpack: values nested too deep")
+	}
+	head, err := r.bytes(1)
+	if err != nil {
+		return nil, err
+	}
+	code := head[0]
+	switch {
+	case code <= 0x7f:
+		return uint64(code), nil
+	case code >= 0xe0:
+		return int64(int8(code)), nil
+	case code <= 0x8f:
+		return r.object(uint64(code&0x0f), depth)
+	case code <= 0x9f:
+		return r.array(uint64(code&0x0f), depth)
+	case code <= 0xbf:
+		return r.text(uint64(code & 0x1f))
+	}
+	switch code {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := r.uint(1 << (code - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		data, err := r.bytes(n)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte{}, data...), nil
+	case 0xca:
+		n, err := r.uint(4)
+		if err != nil {
+			return nil, err
+		}
+		return finite(float64(math.Float32frombits(uint32(n))))
+	case 0xcb:
+		n, err := r.uint(8)
+		if err != nil {
+			return nil, err
+		}
+		return finite(math.Float64frombits(n))
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		return r.uint(1 << (code - 0xcc))
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (code - 0xd0)
+		n, err := r.uint(size)
+		if err != nil {
+			return nil, err
+		}
+		// Sign extend from the size of the integer
+		shift := 64 - 8*size
+		return int64(n<<shift) >> shift, nil
+	case 0xd9, 0xda, 0xdb:
+		n, err := r.uint(1 << (code - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return r.text(n)
+	case 0xdc, 0xdd:
+		n, err := r.uint(2 << (code - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return r.array(n, depth)
+	case 0xde, 0xdf:
+		n, err := r.uint(2 << (code - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return r.object(n, depth)
+	case 0xc7, 0xc8, 0xc9, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return nil, errors.New("msgpack: extension types cannot be represented in JSON")
+	default:
+		return nil, fmt.Errorf("msgpack: invalid type 0x%x", code)
+	}
+}
+
+// Function to read a string.
+// Parameters:
+// n: uint64 - Its length in bytes.
+// Returns:
+// interface{} - The string.
+// error - An error if the data ends within it or it is not valid UTF-8.
+func (r *msgpackReader) text(n uint64) (interface{}, error) {
+	data, err := r.bytes(n)
+	if err != nil {
+		return nil, err
+	}
+	if !utf8.Valid(data) {
+		return nil, errors.New("msgpack: string is not valid UTF-8")
+	}
+	return string(data), nil
+}
+
+// Function to read the items of an array.
+// Parameters:
+// n: uint64 - The number of items.
+// depth: int - How deep the array is nested.
+// Returns:
+// interface{} - The items.
+// error - An error if an item is malformed.
+func (r *msgpackReader) array(n uint64, depth int) (interface{}, error) {
+	// Every item takes at least a byte
+	if n > uint64(len(r.data)-r.offset) {
+		return nil, errMsgpackTruncated
+	}
+	array := make([]interface{}, 0, n)
+	for i := uint64(0); i < n; i++ {
+		item, err := r.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		array = append(array, item)
+	}
+	return array, nil
+}
+
+// Function to read the entries of a map.
+// Parameters:
+// n: uint64 - The number of entries.
+// depth: int - How deep the map is nested.
+// Returns:
+// interface{} - The entries, by key.
+// error - An error if an entry is malformed or a key is neither a string nor an integer.
+func (r *msgpackReader) object(n uint64, depth int) (interface{}, error) {
+	// Every entry takes at least two bytes
+	if n > uint64(len(r.data)-r.offset)/2 {
+		return nil, errMsgpackTruncated
+	}
+	object := make(map[string]interface{}, n)
+	for i := uint64(0); i < n; i++ {
+		key, err := r.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		value, err := r.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		switch key := key.(type) {
+		case string:
+			object[key] = value
+		case uint64, int64:
+			object[fmt.Sprint(key)] = value
+		default:
+			return nil, fmt.Errorf("msgpack: map key of type %T", key)
+		}
+	}
+	return object, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	documents := []string{
+		`{"action":"publish","topic":"sensors/42","message":{"t":21.5,"ok":true,"ids":[1,-2,-200,300,-40000,70000,5000000000,-5000000000],"note":null}}`,
+		`"Server received the message!"`,
+		`[]`,
+		`{}`,
+		`-9223372036854775808`,
+		`18446744073709551615`,
+		`1e300`,
+	}
+	for _, document := range documents {
+		encoded, err := jsonToMsgpack([]byte(document))
+		assert.NoError(t, err, document)
+		decoded, err := msgpackToJSON(encoded)
+		assert.NoError(t, err, document)
+		assert.JSONEq(t, document, string(decoded))
+	}
+}
+
+func TestMsgpackVectors(t *testing.T) {
+	vectors := []struct {
+		msgpack string
+		json    string
+	}{
+		{"00", `0`},
+		{"7f", `127`},
+		{"cc80", `128`},
+		{"cd03e8", `1000`},
+		{"cf000000e8d4a51000", `1000000000000`},
+		{"ff", `-1`},
+		{"e0", `-32`},
+		{"d0df", `-33`},
+		{"d1fc18", `-1000`},
+		{"d2fffe7960", `-100000`},
+		{"ca3fc00000", `1.5`},
+		{"cb3ff199999999999a", `1.1`},
+		{"c2", `false`},
+		{"c3", `true`},
+		{"c0", `null`},
+		{"a3616263", `"abc"`},
+		{"d903616263", `"abc"`},
+		{"c4020102", `"AQI="`},
+		{"93010203", `[1,2,3]`},
+		{"dc0003010203", `[1,2,3]`},
+		{"8201020304", `{"1":2,"3":4}`},
+		{"82a16101a162920203", `{"a":1,"b":[2,3]}`},
+		{"de0001a16101", `{"a":1}`},
+	}
+	for _, vector := range vectors {
+		data, _ := hex.DecodeString(vector.msgpack)
+		decoded, err := msgpackToJSON(data)
+		if assert.NoError(t, err, vector.msgpack) {
+			assert.JSONEq(t, vector.json, string(decoded), vector.msgpack)
+		}
+	}
+
+	encoded, _ := jsonToMsgpack([]byte(`{"compact":true,"schema":0}`))
+	assert.Equal(t, "82a7636f6d70616374c3a6736368656d6100", hex.EncodeToString(encoded), "Maps should be encoded with sorted keys in the shortest form")
+}
+
+func TestMalformedMsgpack(t *testing.T) {
+	// Arrays of a single array, 100 deep, around a 0
+	deep := make([]byte, 101)
+	for i := 0; i < 100; i++ {
+		deep[i] = 0x91
+	}
+	for _, data := range [][]byte{
+		{},
+		{0xcd, 0x03},                         // truncated integer
+		{0xa5, 'a', 'b'},                     // truncated string
+		{0xa2, 0xff, 0xfe},                   // invalid UTF-8
+		{0xcb, 0x7f, 0xf8, 0, 0, 0, 0, 0, 0}, // NaN
+		{0x81, 0x90, 0x01},                   // array key
+		{0x01, 0x02},                         // data after the value
+		{0xc1},                               // never used
+		{0xd4, 0x01, 0x00},                   // extension type
+		{0xdd, 0xff, 0xff, 0xff, 0xff},       // huge array
+		deep,
+	} {
+		_, err := msgpackToJSON(data)
+		assert.Error(t, err, "%x", data)
+	}
+}
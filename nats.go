@@ -0,0 +1,110 @@
+// This file bridges the PubSub system to NATS so that a publish on one server
+// instance is delivered to the subscribers connected to every other instance.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// Subject on which all server instances exchange published messages
+	natsSubject = "gowebsockets.publish"
+
+	// Header carrying the ID of the node that first published the message
+	originNodeHeader = "Origin-Node"
+
+	// Header carrying the PubSub topic of the message
+	topicHeader = "Topic"
+
+	// Header carrying the ID of the message
+	messageIdHeader = "Message-Id"
+
+	// Header carrying the publisher, inbox, correlation ID and trace context of the message
+	relayHeadersHeader = "Relay-Headers"
+)
+
+type NATSBridge struct {
+	NodeId       string
+	Connection   *nats.Conn
+	Subscription *nats.Subscription
+	ps           *PubSub
+}
+
+// Function to connect to a NATS server and start relaying messages for a PubSub.
+// Parameters:
+// url: string - The URL of the NATS server, e.g. nats://127.0.0.1:4222.
+// ps: *PubSub - The PubSub instance that receives messages relayed from other nodes.
+// Returns:
+// *NATSBridge - The connected bridge.
+// error - An error if the connection or subscription failed.
+func NewNATSBridge(url string, ps *PubSub) (*NATSBridge, error) {
+	bridge := &NATSBridge{
+		NodeId: autoId(),
+		ps:     ps,
+	}
+
+	conn, err := nats.Connect(url, nats.Name("gowebsockets-"+bridge.NodeId))
+	if err != nil {
+		return nil, err
+	}
+	bridge.Connection = conn
+
+	sub, err := conn.Subscribe(natsSubject, bridge.handleMsg)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	bridge.Subscription = sub
+
+	slog.Info("Connected to NATS", "url", url, "node_id", bridge.NodeId)
+	return bridge, nil
+}
+
+// Function to relay a locally published message to the other nodes through NATS.
+// Parameters:
+// ctx: context.Context - The context of the publish.
+// id: string - The ID of the message.
+// topic: string - The topic the message was published to.
+// message: []byte - The published message.
+func (b *NATSBridge) Relay(ctx context.Context, id string, topic string, message []byte) error {
+	headers, err := json.Marshal(relayHeadersOf(ctx))
+	if err != nil {
+		return err
+	}
+	msg := nats.NewMsg(natsSubject)
+	msg.Header.Set(originNodeHeader, b.NodeId)
+	msg.Header.Set(messageIdHeader, id)
+	msg.Header.Set(topicHeader, topic)
+	msg.Header.Set(relayHeadersHeader, string(headers))
+	msg.Data = message
+	return b.Connection.PublishMsg(msg)
+}
+
+// Function to handle a message received from NATS. Messages that originated on this
+// node are dropped so that a publish is never delivered twice or relayed in a loop.
+// Parameters:
+// msg: *nats.Msg - The message received from NATS.
+func (b *NATSBridge) handleMsg(msg *nats.Msg) {
+	if msg.Header.Get(originNodeHeader) == b.NodeId {
+		return
+	}
+	var headers relayHeaders
+	if encoded := msg.Header.Get(relayHeadersHeader); encoded != "" {
+		if err := json.Unmarshal([]byte(encoded), &headers); err != nil {
+			slog.Error("Error decoding NATS message headers", "error", err)
+		}
+	}
+	b.ps.deliver(headers.context(), msg.Header.Get(messageIdHeader), msg.Header.Get(topicHeader), msg.Data)
+}
+
+// Function to stop relaying messages and close the NATS connection.
+func (b *NATSBridge) Close() {
+	if b.Subscription != nil {
+		b.Subscription.Unsubscribe()
+	}
+	b.Connection.Close()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNATSBridgeDeliversRemoteMessages(t *testing.T) {
+	ps := &PubSub{}
+	bridge := &NATSBridge{NodeId: autoId(), ps: ps}
+
+	client, peer := newTestClient(t)
+	ps.Subscribe(&client, "news")
+
+	msg := nats.NewMsg(natsSubject)
+	msg.Header.Set(originNodeHeader, autoId())
+	msg.Header.Set(topicHeader, "news")
+	msg.Data = []byte("from another node")
+	bridge.handleMsg(msg)
+
+	_, message, err := peer.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("from another node"), message)
+}
+
+func TestNATSBridgeDropsOwnMessages(t *testing.T) {
+	ps := &PubSub{}
+	bridge := &NATSBridge{NodeId: autoId(), ps: ps}
+
+	client, peer := newTestClient(t)
+	ps.Subscribe(&client, "news")
+
+	msg := nats.NewMsg(natsSubject)
+	msg.Header.Set(originNodeHeader, bridge.NodeId)
+	msg.Header.Set(topicHeader, "news")
+	msg.Data = []byte("echo")
+	bridge.handleMsg(msg)
+
+	peer.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, _, err := peer.ReadMessage()
+	assert.Error(t, err, "Messages published by this node should not be delivered again")
+}
+
+func TestNATSBridgeKeepsTheReplyHeaders(t *testing.T) {
+	ps := &PubSub{}
+	bridge := &NATSBridge{NodeId: autoId(), ps: ps}
+
+	client, peer := newTestClient(t)
+	ps.SubscribeWith(&client, "quotes", SubscribeOptions{Envelope: true})
+
+	ctx := withReply(withPublisher(context.Background(), "alice"), replyHeaders{ReplyTo: "$inbox.c1", CorrelationId: "q1"})
+	headers, _ := json.Marshal(relayHeadersOf(ctx))
+	msg := nats.NewMsg(natsSubject)
+	msg.Header.Set(originNodeHeader, autoId())
+	msg.Header.Set(topicHeader, "quotes")
+	msg.Header.Set(relayHeadersHeader, string(headers))
+	msg.Data = []byte(`{"symbol":"ACME"}`)
+	bridge.handleMsg(msg)
+
+	request := readFrame(t, peer)
+	assert.Equal(t, "alice", request["publisher"])
+	assert.Equal(t, "$inbox.c1", request["replyTo"])
+	assert.Equal(t, "q1", request["correlationId"])
+}
@@ -0,0 +1,211 @@
+// This file stores objects, such as archived history segments, in object storage. The
+// S3 store speaks the S3 REST API with Signature Version 4 and path-style URLs, so it
+// works with AWS S3 and with compatible stores such as MinIO, Ceph or R2.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Largest object read from a store, so a corrupt manifest cannot exhaust memory
+const maxObjectSize = 64 << 20
+
+var errObjectNotFound = errors.New("object not found")
+
+// ObjectStore stores objects by key.
+type ObjectStore interface {
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	// Get returns errObjectNotFound for keys that were never put
+	Get(ctx context.Context, key string) ([]byte, error)
+}
+
+// S3Store stores objects in a bucket of an S3-compatible store.
+type S3Store struct {
+	// URL of the store, e.g. https://s3.eu-west-1.amazonaws.com or http://minio:9000
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// Client sending the requests, http.DefaultClient when nil
+	Client *http.Client
+}
+
+// Function to store an object, replacing any object with the same key.
+// Parameters:
+// ctx: context.Context - Cancels the request.
+// key: string - The key of the object.
+// data: []byte - The object.
+// contentType: string - The media type of the object.
+// Returns:
+// error - An error if the request failed or the store refused the object.
+func (s *S3Store) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	response, err := s.do(ctx, http.MethodPut, key, data, contentType)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+// Function to read an object.
+// Parameters:
+// ctx: context.Context - Cancels the request.
+// key: string - The key of the object.
+// Returns:
+// []byte - The object.
+// error - errObjectNotFound if there is no object with that key, or an error if the request failed.
+func (s *S3Store) Get(ctx context.Context, key string) ([]byte, error) {
+	response, err := s.do(ctx, http.MethodGet, key, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(response.Body, maxObjectSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxObjectSize {
+		return nil, fmt.Errorf("object %s is larger than %d bytes", key, maxObjectSize)
+	}
+	return data, nil
+}
+
+// Function to send a signed request for an object.
+// Parameters:
+// ctx: context.Context - Cancels the request.
+// method: string - The HTTP method.
+// key: string - The key of the object.
+// body: []byte - The body of the request, nil for none.
+// contentType: string - The media type of the body, "" for none.
+// Returns:
+// *http.Response - The successful response, whose body the caller must close.
+// error - errObjectNotFound for 404 responses, or an error if the request failed or was refused.
+func (s *S3Store) do(ctx context.Context, method string, key string, body []byte, contentType string) (*http.Response, error) {
+	target, err := url.Parse(strings.TrimSuffix(s.Endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	target.RawPath = strings.TrimSuffix(target.EscapedPath(), "/") + "/" + s3Escape(s.Bucket) + "/" + s3Escape(key)
+	target.Path = strings.TrimSuffix(target.Path, "/") + "/" + s.Bucket + "/" + key
+
+	request, err := http.NewRequestWithContext(ctx, method, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	hash := sha256.Sum256(body)
+	signS3Request(request, hex.EncodeToString(hash[:]), s.AccessKey, s.SecretKey, s.Region, time.Now())
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode == http.StatusNotFound {
+		response.Body.Close()
+		return nil, errObjectNotFound
+	}
+	if response.StatusCode/100 != 2 {
+		detail, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		response.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s: %s", method, key, response.Status, detail)
+	}
+	return response, nil
+}
+
+// Function to sign a request without a query with AWS Signature Version 4, covering the
+// host and every header already set.
+// Parameters:
+// request: *http.Request - The request, signed in place.
+// payloadHash: string - The hex SHA-256 of the body.
+// accessKey: string - The access key ID.
+// secretKey: string - The secret access key.
+// region: string - The region of the store.
+// now: time.Time - The time of the request.
+func signS3Request(request *http.Request, payloadHash string, accessKey string, secretKey string, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	scope := amzDate[:8] + "/" + region + "/s3/aws4_request"
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": request.URL.Host}
+	for name, values := range request.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		"",
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{amzDate[:8], region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	request.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// Function to compute an HMAC-SHA256.
+// Parameters:
+// key: []byte - The key.
+// data: string - The data.
+// Returns:
+// []byte - The MAC.
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// Function to percent-encode a path as S3 signatures expect: every byte but unreserved
+// characters and slashes is encoded.
+// Parameters:
+// path: string - The path.
+// Returns:
+// string - The encoded path.
+func s3Escape(path string) string {
+	var escaped strings.Builder
+	for _, c := range []byte(path) {
+		if c == '/' || c == '-' || c == '.' || c == '_' || c == '~' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') {
+			escaped.WriteByte(c)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", c)
+		}
+	}
+	return escaped.String()
+}
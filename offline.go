@@ -0,0 +1,115 @@
+// This file queues the messages published to the session subscriptions of a suspended
+// session, so a client resuming it after a short disconnect receives what it missed.
+// Each session queues at most the configured number of messages, dropping the oldest,
+// and its queue is flushed in order when it is resumed, before new messages are
+// delivered to it.
+package main
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Default of how many messages are queued for each suspended session
+const defaultOfflineQueueSize = 100
+
+var offlineMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "gowebsockets_offline_messages_total",
+	Help: "Number of messages published to suspended sessions, by whether they were queued, dropped for a full queue or redelivered.",
+}, []string{"result"})
+
+// offlineMessage is a message published to a subscription of a suspended session.
+type offlineMessage struct {
+	id    string
+	topic string
+	// The payload the subscription is delivered, enveloped if it asked for it
+	payload *Payload
+	// The message as published
+	message []byte
+	qos     int
+}
+
+// Function to add a message to the queues of the suspended sessions subscribed to its
+// topic, dropping the oldest message of a full queue.
+// Parameters:
+// id: string - The ID of the message.
+// topic: string - The topic.
+// message: []byte - The message as published.
+// payload: func(sub StoredSubscription) *Payload - Builds the payload a subscription is delivered, nil if its filter excludes the message.
+func (s *SessionStore) queue(id string, topic string, message []byte, payload func(sub StoredSubscription) *Payload) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.QueueSize <= 0 {
+		return
+	}
+	for _, session := range s.suspended {
+		for _, sub := range session.subscriptions {
+			if sub.Topic != topic {
+				continue
+			}
+			delivered := payload(sub)
+			if delivered == nil {
+				continue
+			}
+			if len(session.queued) >= s.QueueSize {
+				session.queued = session.queued[1:]
+				offlineMessages.WithLabelValues("dropped").Inc()
+			}
+			session.queued = append(session.queued, offlineMessage{id: id, topic: topic, payload: delivered, message: message, qos: sub.QoS})
+			offlineMessages.WithLabelValues("queued").Inc()
+		}
+	}
+}
+
+// Function to queue a message for the suspended sessions subscribed to its topic.
+// Parameters:
+// ctx: context.Context - The context carrying the trace of the delivery.
+// id: string - The ID of the message.
+// topic: string - The topic.
+// payload: *Payload - The payload delivered to the connected subscribers.
+func (ps *PubSub) queueOffline(ctx context.Context, id string, topic string, payload *Payload) {
+	if ps.Sessions == nil {
+		return
+	}
+	var enveloped *Payload
+	ps.Sessions.queue(id, topic, payload.Data, func(sub StoredSubscription) *Payload {
+		if sub.Filter != "" {
+			filter, err := ParseFilter(sub.Filter)
+			if err != nil || payload.Binary || !filter.Matches(payload.Data) {
+				return nil
+			}
+		}
+		if !sub.Envelope && sub.QoS == 0 {
+			return payload
+		}
+		if enveloped == nil {
+			enveloped = NewPayload(envelopeMessage(id, topic, payload.Data, traceCarrier(ctx), publisherFrom(ctx), replyFrom(ctx)))
+			enveloped.undeflated = payload.undeflated
+		}
+		return enveloped
+	})
+}
+
+// Function to redeliver, in order, the messages queued for the subscriptions of a
+// resumed session that were restored.
+// Parameters:
+// client: *Client - The client that resumed the session.
+// queued: []offlineMessage - The messages queued while it was suspended.
+// restored: map[string]bool - The topics whose subscriptions were restored.
+func (ps *PubSub) flushOffline(client *Client, queued []offlineMessage, restored map[string]bool) {
+	for _, message := range queued {
+		if !restored[message.topic] {
+			continue
+		}
+		if err := client.DeliverPayload(message.topic, message.payload); err != nil {
+			client.logger().Error("Error redelivering queued message", logKeyTopic, message.topic, "error", err)
+			return
+		}
+		offlineMessages.WithLabelValues("redelivered").Inc()
+		if message.qos > 0 {
+			ps.trackDelivery(client, message.topic, message.id, message.payload, message.message)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueuedMessagesAreRedeliveredOnResume(t *testing.T) {
+	sessions := NewSessionStore(time.Minute)
+	sessions.QueueSize = 2
+	pubsub := &PubSub{Sessions: sessions}
+	sessions.suspend("token", &suspendedSession{clientId: "phone", subscriptions: []StoredSubscription{
+		{Topic: "orders", Lifetime: LifetimeSession},
+		{Topic: "alerts", Lifetime: LifetimeSession, Envelope: true},
+	}})
+
+	pubsub.Publish("orders", []byte(`{"n":1}`), nil)
+	pubsub.Publish("prices", []byte(`{"n":2}`), nil)
+	pubsub.Publish("alerts", []byte(`{"n":3}`), nil)
+	pubsub.Publish("orders", []byte(`{"n":4}`), nil)
+
+	client, peer := newTestClient(t)
+	client.Session = NewSession("test")
+	resumed := pubsub.resumeSession(&client, "token")
+	assert.Len(t, resumed.queued, 2, "Full queues drop their oldest message")
+	pubsub.AddClient(client)
+	pubsub.restoreSession(&client, resumed)
+
+	assert.Equal(t, SUBSCRIBED, readFrame(t, peer)["action"])
+	assert.Equal(t, SUBSCRIBED, readFrame(t, peer)["action"])
+	alert := readFrame(t, peer)
+	assert.Equal(t, "alerts", alert["topic"], "Queued messages are enveloped for subscriptions asking for it")
+	assert.Equal(t, map[string]interface{}{"n": 3.0}, alert["message"])
+	assert.JSONEq(t, `{"n":4}`, string(mustRead(t, peer)))
+
+	pubsub.Publish("orders", []byte(`{"n":5}`), nil)
+	assert.JSONEq(t, `{"n":5}`, string(mustRead(t, peer)), "The resumed client receives new messages after the queued ones")
+}
+
+func TestQueuedMessagesOfRefusedSubscriptionsAreDropped(t *testing.T) {
+	sessions := NewSessionStore(time.Minute)
+	pubsub := &PubSub{Sessions: sessions}
+	pubsub.options().acl = &ACL{Rules: []ACLRule{{Identity: "*", Subscribe: []string{"public.*"}}}}
+	sessions.suspend("token", &suspendedSession{clientId: "phone", subscriptions: []StoredSubscription{{Topic: "orders", Lifetime: LifetimeSession}}})
+	pubsub.Publish("orders", []byte(`{"n":1}`), nil)
+
+	client, peer := newTestClient(t)
+	client.Session = NewSession("test")
+	pubsub.restoreSession(&client, pubsub.resumeSession(&client, "token"))
+	assert.Equal(t, "restore_refused", readFrame(t, peer)["code"])
+	client.Send([]byte("end"))
+	assert.Equal(t, "end", string(mustRead(t, peer)), "Messages of subscriptions no longer allowed are not redelivered")
+}
@@ -0,0 +1,153 @@
+// This file holds the options of a server: how its clients are authenticated, what
+// they may access, their limits and queues, and the timeouts of their connections.
+// Each PubSub has options of its own, read by its handlers and by the clients
+// connected to it, so servers built by New run side by side in one process.
+package main
+
+import (
+	"crypto/rand"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The options of a server, set from its configuration
+type serverOptions struct {
+	// Upgraders of the WebSocket and widget endpoints
+	upgrader       websocket.Upgrader
+	widgetUpgrader websocket.Upgrader
+	// How long a shutdown may take before remaining connections are dropped
+	shutdownTimeout time.Duration
+	// Set once a shutdown started; new WebSocket upgrades are refused from then on
+	shuttingDown atomic.Bool
+	// How long the server waits for the next frame of a client, 0 for no limit
+	readTimeout time.Duration
+	// How long a write may take, 0 for no limit
+	writeTimeout time.Duration
+	// Level frames are compressed at, from flate.HuffmanOnly to flate.BestCompression,
+	// and the topic patterns whose messages are written uncompressed
+	permessageDeflateLevel    int
+	permessageDeflateExcluded []string
+	// How many topics get a label of their own on /metrics
+	topicMetricsLimit int
+	// Places of the connections of clients
+	connections connectionLimiter
+	tlsOptions  TLSOptions
+	// The origins allowed to connect. Patterns are globs matched against the host of the
+	// Origin header, e.g. "app.example.com" or "*.example.com", or against the whole
+	// origin when they contain a scheme, e.g. "https://app.example.com". When empty, only
+	// pages served from the same host as the server may connect.
+	allowedOrigins []string
+	// Text of the disconnect reasons, by language
+	catalog *MessageCatalog
+	// When set, every WebSocket upgrade must present a valid token
+	jwtAuthenticator *JWTAuthenticator
+	// When set, clients may authenticate with API keys and the admin API is enabled
+	apiKeys *APIKeyStore
+	// When set, a client may only publish or subscribe to the topics its rules allow.
+	// Guarded by aclMu, as it can be replaced through the admin API.
+	acl   *ACL
+	aclMu sync.RWMutex
+	// Key signing invitations; random unless set from configuration, in which case
+	// invitations stay valid across restarts and cluster nodes
+	inviteKey []byte
+	// The limits of clients whose token does not override them
+	defaultLimits Limits
+	// Frames dropped in a row before a client is disconnected, 0 to never disconnect it
+	rateLimitStrikes int
+	// How long widget tokens are valid at most, and the limits of widget clients
+	widgetTokenTTL time.Duration
+	widgetLimits   Limits
+	// Size, policy and slow start of the outbound queues
+	sendQueueSize      int
+	slowConsumerPolicy SlowConsumerPolicy
+	slowStart          SlowStart
+	// Proxies whose forwarding headers are trusted
+	trustedProxies []*net.IPNet
+	// Provider of the IDs of WebSocket, TCP and MQTT clients
+	clientIDs ClientIDProvider
+	// The policy applied to unauthorized actions and the topic they are recorded on
+	unauthorizedPolicy UnauthorizedPolicy
+	honeypotTopic      string
+	// Whether the publisher named by publish frames is used instead of the principal of
+	// the connection
+	trustClientPublisher bool
+	// Paths of the WebSocket endpoints decoding frames strictly, e.g. /ws and /widget
+	strictJSONEndpoints map[string]bool
+	// The topic captures stream to, which only clients explicitly granted the admin
+	// permission may subscribe to, and the directory file captures are written in, if any
+	adminEventsTopic string
+	debugLogDir      string
+	// How long a user stays online after their last connection closed
+	statusGracePeriod time.Duration
+}
+
+// The options of clients that are not connected to a server, e.g. those made by tests
+var defaultOptions = newServerOptions()
+
+// Function to construct the options of a server, with their defaults.
+// Returns:
+// *serverOptions - The options.
+func newServerOptions() *serverOptions {
+	key := make([]byte, 32)
+	rand.Read(key)
+	options := &serverOptions{
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+		},
+		// Widgets run on customer sites that are not among the allowed origins, so their
+		// origin is checked against their token instead.
+		widgetUpgrader: websocket.Upgrader{
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+			CheckOrigin:     func(r *http.Request) bool { return true },
+		},
+		shutdownTimeout:        10 * time.Second,
+		permessageDeflateLevel: defaultDeflateLevel,
+		topicMetricsLimit:      defaultTopicMetricsLimit,
+		connections:            connectionLimiter{byIP: map[string]int64{}},
+		catalog:                newMessageCatalog(),
+		inviteKey:              key,
+		rateLimitStrikes:       defaultRateLimitStrikes,
+		widgetTokenTTL:         2 * time.Minute,
+		widgetLimits:           Limits{MaxSubscriptions: 5, MaxMessageSize: 4096},
+		sendQueueSize:          256,
+		slowConsumerPolicy:     DisconnectSlowConsumer,
+		clientIDs:              UUIDClientIDs{},
+		unauthorizedPolicy:     RejectUnauthorized,
+		honeypotTopic:          "$honeypot",
+		strictJSONEndpoints:    map[string]bool{},
+		adminEventsTopic:       "$admin.events",
+		statusGracePeriod:      5 * time.Second,
+	}
+	options.upgrader.CheckOrigin = options.checkOrigin
+	return options
+}
+
+// Function to get the options of the server of the PubSub, with their defaults until
+// they are set.
+// Returns:
+// *serverOptions - The options.
+func (ps *PubSub) options() *serverOptions {
+	ps.optionsOnce.Do(func() {
+		if ps.opts == nil {
+			ps.opts = newServerOptions()
+		}
+	})
+	return ps.opts
+}
+
+// Function to get the options of the server the client is connected to.
+// Returns:
+// *serverOptions - The options, the defaults if the client is not connected to a server.
+func (client *Client) options() *serverOptions {
+	if client.server == nil {
+		return defaultOptions
+	}
+	return client.server
+}
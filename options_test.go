@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The PubSub the tests share, unless they isolate one
+var ps = &PubSub{}
+
+// isolatePubSub gives a test a PubSub of its own, with the default options, and
+// restores the shared one once the test ends.
+func isolatePubSub(t *testing.T) *serverOptions {
+	previous := ps
+	ps = &PubSub{}
+	t.Cleanup(func() { ps = previous })
+	return ps.options()
+}
+
+func TestPubSubsHaveOptionsOfTheirOwn(t *testing.T) {
+	first, second := &PubSub{}, &PubSub{}
+	first.options().apiKeys = NewAPIKeyStore()
+	first.options().defaultLimits.MaxSubscriptions = 4
+
+	assert.Same(t, first.options(), first.options(), "The options of a PubSub are made once")
+	assert.Nil(t, second.options().apiKeys, "Options set on a PubSub do not leak to another")
+	assert.Zero(t, second.options().defaultLimits.MaxSubscriptions)
+	assert.NotEqual(t, first.options().inviteKey, second.options().inviteKey, "Each server signs invitations with a key of its own")
+}
+
+func TestClientsReadTheOptionsOfTheirServer(t *testing.T) {
+	options := newServerOptions()
+	options.rateLimitStrikes = 3
+	client := &Client{Id: "alice", server: options}
+	assert.Same(t, options, client.options())
+	assert.Same(t, defaultOptions, (&Client{}).options(), "Clients without a server read the defaults")
+
+	request := httptest.NewRequest("GET", "/ws", nil)
+	request.Header.Set("Origin", "http://"+request.Host)
+	assert.True(t, options.upgrader.CheckOrigin(request), "The upgrader checks origins against the options it belongs to")
+	request.Header.Set("Origin", "https://elsewhere.example.com")
+	assert.False(t, options.upgrader.CheckOrigin(request))
+	options.allowedOrigins = []string{"*.example.com"}
+	assert.True(t, options.upgrader.CheckOrigin(request))
+}
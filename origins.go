@@ -0,0 +1,71 @@
+// This file decides which browser origins may open WebSocket connections, so pages
+// on other sites cannot connect with the credentials of a visitor.
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Function to parse a comma separated list of origin patterns.
+// Parameters:
+// value: string - The list, e.g. "https://app.example.com,*.example.org".
+// Returns:
+// []string - The patterns, lower-cased and without empty entries.
+func parseOrigins(value string) []string {
+	var origins []string
+	for _, origin := range strings.Split(value, ",") {
+		if origin = strings.ToLower(strings.TrimSpace(origin)); origin != "" {
+			origins = append(origins, strings.TrimSuffix(origin, "/"))
+		}
+	}
+	return origins
+}
+
+// Function to check the Origin header of an upgrade request. Requests without an
+// Origin header do not come from a browser and are allowed.
+// Parameters:
+// r: *http.Request - The upgrade request.
+// Returns:
+// bool - True if the origin is allowed.
+func (options *serverOptions) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(strings.ToLower(origin))
+	if err != nil || u.Host == "" {
+		return false
+	}
+
+	if len(options.allowedOrigins) == 0 {
+		return strings.EqualFold(u.Host, r.Host)
+	}
+	for _, pattern := range options.allowedOrigins {
+		if strings.Contains(pattern, "://") {
+			if globMatch(pattern, u.Scheme+"://"+u.Host) {
+				return true
+			}
+		} else if globMatch(pattern, u.Host) || globMatch(pattern, u.Hostname()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Function to reject an upgrade request whose origin is not allowed.
+// Parameters:
+// w: http.ResponseWriter - The response writer.
+// r: *http.Request - The upgrade request.
+// Returns:
+// bool - True if the request was rejected.
+func (options *serverOptions) rejectOrigin(w http.ResponseWriter, r *http.Request) bool {
+	if options.checkOrigin(r) {
+		return false
+	}
+	slog.Warn("Rejected WebSocket upgrade from origin", "origin", r.Header.Get("Origin"), "remote_addr", r.RemoteAddr)
+	http.Error(w, "origin not allowed", http.StatusForbidden)
+	return true
+}
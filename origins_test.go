@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckOrigin(t *testing.T) {
+	request := func(host, origin string) *http.Request {
+		r := httptest.NewRequest("GET", "http://"+host+"/ws", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		return r
+	}
+
+	options := newServerOptions()
+	assert.True(t, options.checkOrigin(request("chat.example.com", "")), "Non-browser clients send no Origin")
+	assert.True(t, options.checkOrigin(request("chat.example.com", "https://chat.example.com")), "Same host is allowed by default")
+	assert.False(t, options.checkOrigin(request("chat.example.com", "https://evil.example.net")))
+
+	options.allowedOrigins = parseOrigins("https://app.example.com/, *.example.org ,localhost")
+	assert.True(t, options.checkOrigin(request("ws.example.com", "https://app.example.com")))
+	assert.False(t, options.checkOrigin(request("ws.example.com", "http://app.example.com")), "Patterns with a scheme match it exactly")
+	assert.True(t, options.checkOrigin(request("ws.example.com", "https://a.b.example.org")))
+	assert.False(t, options.checkOrigin(request("ws.example.com", "https://example.org")))
+	assert.True(t, options.checkOrigin(request("ws.example.com", "http://localhost:3000")), "Host patterns match with or without the port")
+	assert.False(t, options.checkOrigin(request("ws.example.com", "https://ws.example.com")), "A configured list replaces the same host default")
+	assert.False(t, options.checkOrigin(request("ws.example.com", "null")))
+}
+
+func TestWebSocketHandlerRejectsOriginBeforeUpgrade(t *testing.T) {
+	options := isolatePubSub(t)
+	options.allowedOrigins = []string{"app.example.com"}
+
+	r := httptest.NewRequest("GET", "/ws", nil)
+	r.Header.Set("Origin", "https://evil.example.net")
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	w := httptest.NewRecorder()
+	ps.webSocketHandler(w, r)
+
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
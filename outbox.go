@@ -0,0 +1,291 @@
+// This file gives every WebSocket client a bounded outbound queue drained by its own
+// writer goroutine, so a client that reads slowly never blocks the publish path. When
+// the queue is full, the slow-consumer policy decides what gives. Delivery to newly
+// connected clients can be ramped up gradually with slow start.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// SlowConsumerPolicy decides what happens when the queue of a client is full.
+type SlowConsumerPolicy string
+
+const (
+	// Drop the oldest queued message to make room for the new one
+	DropOldest SlowConsumerPolicy = "drop_oldest"
+	// Drop the new message
+	DropNewest SlowConsumerPolicy = "drop_newest"
+	// Disconnect the client with the slow_consumer close reason
+	DisconnectSlowConsumer SlowConsumerPolicy = "disconnect"
+)
+
+// SlowStart ramps up the delivery rate of a newly connected client: it starts at
+// InitialRate messages per second and doubles every second until Duration has passed,
+// after which delivery is unthrottled. The zero value disables slow start.
+type SlowStart struct {
+	InitialRate float64
+	Duration    time.Duration
+}
+
+var errMessageDropped = errors.New("message dropped: outbound queue is full")
+
+var (
+	droppedMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gowebsockets_dropped_messages_total",
+		Help: "Number of messages dropped because a client's outbound queue was full, by policy.",
+	}, []string{"policy"})
+	slowConsumerDisconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gowebsockets_slow_consumer_disconnects_total",
+		Help: "Number of clients disconnected because their outbound queue was full.",
+	})
+)
+
+// Function to parse a slow-consumer policy.
+// Parameters:
+// value: string - drop_oldest, drop_newest or disconnect.
+// Returns:
+// SlowConsumerPolicy - The policy.
+// error - An error if the policy is unknown.
+func ParseSlowConsumerPolicy(value string) (SlowConsumerPolicy, error) {
+	switch policy := SlowConsumerPolicy(value); policy {
+	case DropOldest, DropNewest, DisconnectSlowConsumer:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown slow consumer policy %q", value)
+}
+
+// Outbox is the outbound queue of a client.
+type Outbox struct {
+	Capacity  int
+	Policy    SlowConsumerPolicy
+	SlowStart SlowStart
+
+	client  *Client
+	queue   []outboxEntry
+	dropped atomic.Uint64
+	closed  bool
+	writing bool
+	mu      sync.Mutex
+	ready   chan struct{}
+	done    chan struct{}
+	started time.Time
+}
+
+// A queued payload, with the stats of the subscription it is delivered for when they are tracked
+type outboxEntry struct {
+	payload  *Payload
+	stats    *SubscriptionStats
+	queuedAt time.Time
+}
+
+// Function to create the outbound queue of a client and start its writer.
+// Parameters:
+// client: *Client - The client, connected over a WebSocket.
+// capacity: int - The number of messages the queue holds.
+// policy: SlowConsumerPolicy - What to do when the queue is full.
+// start: SlowStart - How delivery ramps up after connecting.
+// Returns:
+// *Outbox - The running queue; close it when the client disconnects.
+func NewOutbox(client *Client, capacity int, policy SlowConsumerPolicy, start SlowStart) *Outbox {
+	outbox := &Outbox{
+		Capacity:  capacity,
+		Policy:    policy,
+		SlowStart: start,
+		client:    client,
+		ready:     make(chan struct{}, 1),
+		done:      make(chan struct{}),
+		started:   time.Now(),
+	}
+	go outbox.run()
+	return outbox
+}
+
+// Function to queue a payload for the writer.
+// Parameters:
+// payload: *Payload - The payload.
+// Returns:
+// error - An error if the outbox is closed or the payload was dropped.
+func (o *Outbox) Push(payload *Payload) error {
+	return o.push(outboxEntry{payload: payload})
+}
+
+// Function to queue a payload delivered for a subscription whose stats are tracked.
+// Parameters:
+// payload: *Payload - The payload.
+// stats: *SubscriptionStats - The stats of the subscription.
+// Returns:
+// error - An error if the outbox is closed or the payload was dropped.
+func (o *Outbox) PushTracked(payload *Payload, stats *SubscriptionStats) error {
+	return o.push(outboxEntry{payload: payload, stats: stats, queuedAt: time.Now()})
+}
+
+// Function to queue an entry, applying the slow-consumer policy when the queue is full.
+// Parameters:
+// entry: outboxEntry - The entry.
+// Returns:
+// error - An error if the outbox is closed or the entry was dropped.
+func (o *Outbox) push(entry outboxEntry) error {
+	o.mu.Lock()
+	if o.closed {
+		o.mu.Unlock()
+		return websocket.ErrCloseSent
+	}
+
+	// The policy applies during slow start too, as messages queue up while it paces delivery
+	if len(o.queue) >= o.Capacity {
+		switch o.Policy {
+		case DropOldest:
+			o.drop(o.Policy, o.queue[0])
+			o.queue = o.queue[1:]
+		case DropNewest:
+			o.drop(o.Policy, entry)
+			o.mu.Unlock()
+			return errMessageDropped
+		default:
+			entry.stats.dropped()
+			o.closed = true
+			o.mu.Unlock()
+			slowConsumerDisconnects.Inc()
+			o.client.logger().Warn("Disconnecting slow consumer", "queued", len(o.queue))
+			close(o.done)
+			o.client.Close(ReasonSlowConsumer)
+			return errMessageDropped
+		}
+	}
+	o.queue = append(o.queue, entry)
+	o.mu.Unlock()
+
+	select {
+	case o.ready <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Function to count a dropped message. The caller must hold o.mu.
+// Parameters:
+// policy: SlowConsumerPolicy - The policy that dropped the message.
+// entry: outboxEntry - The dropped entry.
+func (o *Outbox) drop(policy SlowConsumerPolicy, entry outboxEntry) {
+	o.dropped.Add(1)
+	droppedMessages.WithLabelValues(string(policy)).Inc()
+	entry.stats.dropped()
+}
+
+// Function to get the number of messages dropped from the queue.
+// Returns:
+// uint64 - The number of dropped messages.
+func (o *Outbox) Dropped() uint64 {
+	return o.dropped.Load()
+}
+
+// Function to get the number of queued messages.
+// Returns:
+// int - The number of messages waiting to be written.
+func (o *Outbox) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.queue)
+}
+
+// Function to stop the writer. Queued messages that were not written are discarded.
+func (o *Outbox) Close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.closed {
+		o.closed = true
+		close(o.done)
+	}
+}
+
+// Function to wait until every queued payload has been written.
+// Parameters:
+// ctx: context.Context - Bounds how long to wait.
+// Returns:
+// error - The context's error if the queue was not drained in time.
+func (o *Outbox) Flush(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		o.mu.Lock()
+		idle := o.closed || (len(o.queue) == 0 && !o.writing)
+		o.mu.Unlock()
+		if idle {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Function to write the queued payloads to the connection until the outbox is closed.
+func (o *Outbox) run() {
+	for {
+		select {
+		case <-o.done:
+			return
+		case <-o.ready:
+		}
+
+		for {
+			o.mu.Lock()
+			if o.closed || len(o.queue) == 0 {
+				o.mu.Unlock()
+				break
+			}
+			entry := o.queue[0]
+			o.queue[0] = outboxEntry{}
+			o.queue = o.queue[1:]
+			o.writing = true
+			o.mu.Unlock()
+
+			err := o.client.writePayload(entry.payload)
+			o.mu.Lock()
+			o.writing = false
+			o.mu.Unlock()
+			if err != nil {
+				o.client.logger().Error("Error writing to client", "error", err)
+				o.Close()
+				return
+			}
+			entry.stats.written(entry.queuedAt)
+			if !entry.payload.uncaptured {
+				o.client.Session.capture(debugOutbound, entry.payload.Data)
+			}
+
+			if rate := o.SlowStart.rate(time.Since(o.started)); rate > 0 {
+				select {
+				case <-o.done:
+					return
+				case <-time.After(time.Duration(float64(time.Second) / rate)):
+				}
+			}
+		}
+	}
+}
+
+// Function to get the delivery rate allowed some time after connecting.
+// Parameters:
+// elapsed: time.Duration - The time since the client connected.
+// Returns:
+// float64 - The rate in messages per second, or 0 once delivery is unthrottled.
+func (s SlowStart) rate(elapsed time.Duration) float64 {
+	if s.InitialRate <= 0 || elapsed >= s.Duration {
+		return 0
+	}
+	return s.InitialRate * math.Pow(2, elapsed.Seconds())
+}
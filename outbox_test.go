@@ -0,0 +1,135 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// newStalledOutbox creates an outbox whose writer is not running yet, as if the client
+// had stopped reading.
+func newStalledOutbox(client *Client, capacity int, policy SlowConsumerPolicy) *Outbox {
+	return &Outbox{
+		Capacity: capacity,
+		Policy:   policy,
+		client:   client,
+		ready:    make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+func TestOutboxDropOldest(t *testing.T) {
+	client, peer := newTestClient(t)
+	outbox := newStalledOutbox(&client, 2, DropOldest)
+	before := testutil.ToFloat64(droppedMessages.WithLabelValues(string(DropOldest)))
+
+	for _, message := range []string{"one", "two", "three"} {
+		assert.NoError(t, outbox.Push(NewPayload([]byte(message))))
+	}
+	assert.Equal(t, uint64(1), outbox.Dropped())
+	assert.Equal(t, before+1, testutil.ToFloat64(droppedMessages.WithLabelValues(string(DropOldest))))
+
+	go outbox.run()
+	defer outbox.Close()
+	for _, expected := range []string{"two", "three"} {
+		_, message, err := peer.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(message))
+	}
+}
+
+func TestOutboxDropNewest(t *testing.T) {
+	client, peer := newTestClient(t)
+	outbox := newStalledOutbox(&client, 2, DropNewest)
+
+	assert.NoError(t, outbox.Push(NewPayload([]byte("one"))))
+	assert.NoError(t, outbox.Push(NewPayload([]byte("two"))))
+	assert.ErrorIs(t, outbox.Push(NewPayload([]byte("three"))), errMessageDropped)
+	assert.Equal(t, uint64(1), outbox.Dropped())
+
+	go outbox.run()
+	defer outbox.Close()
+	for _, expected := range []string{"one", "two"} {
+		_, message, err := peer.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(message))
+	}
+}
+
+func TestOutboxDisconnectsSlowConsumer(t *testing.T) {
+	client, peer := newTestClient(t)
+	client.Language = defaultLanguage
+	outbox := newStalledOutbox(&client, 1, DisconnectSlowConsumer)
+	before := testutil.ToFloat64(slowConsumerDisconnects)
+
+	assert.NoError(t, outbox.Push(NewPayload([]byte("one"))))
+	assert.ErrorIs(t, outbox.Push(NewPayload([]byte("two"))), errMessageDropped)
+	assert.Equal(t, before+1, testutil.ToFloat64(slowConsumerDisconnects))
+
+	_, _, err := peer.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, CloseSlowConsumer), "The client should be closed as a slow consumer")
+	assert.Error(t, outbox.Push(NewPayload([]byte("three"))), "A closed outbox should refuse messages")
+}
+
+func TestParseSlowConsumerPolicy(t *testing.T) {
+	policy, err := ParseSlowConsumerPolicy("drop_oldest")
+	assert.NoError(t, err)
+	assert.Equal(t, DropOldest, policy)
+	_, err = ParseSlowConsumerPolicy("block")
+	assert.Error(t, err)
+}
+
+func TestSlowStartRate(t *testing.T) {
+	start := SlowStart{InitialRate: 10, Duration: 5 * time.Second}
+	assert.Equal(t, 10.0, start.rate(0))
+	assert.Equal(t, 40.0, start.rate(2*time.Second), "The rate should double every second")
+	assert.Equal(t, 0.0, start.rate(5*time.Second), "Delivery should be unthrottled after the ramp")
+	assert.Equal(t, 0.0, SlowStart{}.rate(0), "The zero value disables slow start")
+}
+
+func TestSlowStartPacesNewClients(t *testing.T) {
+	client, peer := newTestClient(t)
+	outbox := NewOutbox(&client, 3, DropOldest, SlowStart{InitialRate: 20, Duration: time.Minute})
+	defer outbox.Close()
+
+	started := time.Now()
+	for _, message := range []string{"one", "two", "three", "four"} {
+		assert.NoError(t, outbox.Push(NewPayload([]byte(message))))
+	}
+
+	var received []string
+	for len(received) == 0 || received[len(received)-1] != "four" {
+		_, message, err := peer.ReadMessage()
+		if !assert.NoError(t, err) {
+			return
+		}
+		received = append(received, string(message))
+	}
+	assert.GreaterOrEqual(t, len(received), 3, "At most the oldest message should be dropped")
+	assert.GreaterOrEqual(t, time.Since(started), 80*time.Millisecond, "Messages should be paced at the initial rate")
+}
+
+func TestSlowStartKeepsTheDisconnectPolicy(t *testing.T) {
+	client, peer := newTestClient(t)
+	client.Language = defaultLanguage
+	outbox := NewOutbox(&client, 2, DisconnectSlowConsumer, SlowStart{InitialRate: 1, Duration: time.Minute})
+	defer outbox.Close()
+	before := testutil.ToFloat64(slowConsumerDisconnects)
+
+	// The first message is written at once, the next ones wait a second for their turn
+	var err error
+	for i := 0; i < 5 && err == nil; i++ {
+		err = outbox.Push(NewPayload([]byte("message")))
+	}
+	assert.ErrorIs(t, err, errMessageDropped, "A queue filled during slow start applies the disconnect policy")
+	assert.Equal(t, before+1, testutil.ToFloat64(slowConsumerDisconnects))
+	for {
+		if _, _, err := peer.ReadMessage(); err != nil {
+			assert.True(t, websocket.IsCloseError(err, CloseSlowConsumer), "The client should be closed as a slow consumer, got %v", err)
+			break
+		}
+	}
+}
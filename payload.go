@@ -0,0 +1,153 @@
+// This file shares a published message between all of its subscribers: the payload
+// is never copied per subscriber and the WebSocket frame carrying it is built once.
+package main
+
+import (
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// Payload is a published message delivered to many subscribers. It is immutable once
+// created; a subscriber that needs a transformed message gets a new Payload, which is
+// shared in turn by every subscriber asking for the same transformation.
+type Payload struct {
+	Data []byte
+	// Whether the payload is binary data rather than JSON, sent in binary frames
+	Binary bool
+
+	prepared *websocket.PreparedMessage
+	err      error
+	once     sync.Once
+
+	// Frames of the payload encoded and compressed by each pair of codecs, built on first use
+	encoded map[string]*encodedFrame
+	mu      sync.Mutex
+
+	// Whether the payload is left out of debug captures
+	uncaptured bool
+	// Whether the frames of the payload skip permessage-deflate
+	undeflated bool
+}
+
+// A frame carrying the payload encoded and compressed by a pair of codecs, shared by
+// every connection using them
+type encodedFrame struct {
+	prepared *websocket.PreparedMessage
+	err      error
+	once     sync.Once
+}
+
+// Function to wrap a published message in a payload. The message must not be
+// modified afterwards.
+// Parameters:
+// data: []byte - The message.
+// Returns:
+// *Payload - The payload.
+func NewPayload(data []byte) *Payload {
+	return &Payload{Data: data}
+}
+
+// Function to wrap a published message in a payload, binary unless the message is JSON.
+// The message must not be modified afterwards.
+// Parameters:
+// message: []byte - The message.
+// Returns:
+// *Payload - The payload.
+func NewMessagePayload(message []byte) *Payload {
+	return &Payload{Data: message, Binary: contentTypeOf(message) == contentTypeBinary}
+}
+
+// Function to get the WebSocket frame of the payload, built on first use.
+// Returns:
+// *websocket.PreparedMessage - The frame shared by every WebSocket subscriber.
+// error - An error if the frame could not be built.
+func (p *Payload) Prepared() (*websocket.PreparedMessage, error) {
+	p.once.Do(func() {
+		p.prepared, p.err = websocket.NewPreparedMessage(p.messageType(), p.Data)
+	})
+	return p.prepared, p.err
+}
+
+// Function to get the type of the frames carrying the payload as is.
+// Returns:
+// int - websocket.BinaryMessage for binary payloads, websocket.TextMessage otherwise.
+func (p *Payload) messageType() int {
+	if p.Binary {
+		return websocket.BinaryMessage
+	}
+	return websocket.TextMessage
+}
+
+// Function to get the WebSocket frame of the payload for a connection, encoded by the
+// envelope codec and then compressed by the compression codec the connection asked for.
+// Each frame is built on first use.
+// Parameters:
+// codec: EnvelopeCodec - The envelope codec of the connection, or nil for JSON.
+// compressor: Compressor - The compression codec of the connection, or nil.
+// Returns:
+// *websocket.PreparedMessage - The frame shared by every connection using the codecs.
+// error - An error if the frame could not be built.
+func (p *Payload) PreparedFor(codec EnvelopeCodec, compressor Compressor) (*websocket.PreparedMessage, error) {
+	if codec == nil && compressor == nil {
+		return p.Prepared()
+	}
+	key := "+"
+	if codec != nil {
+		key = codec.Name() + key
+	}
+	if compressor != nil {
+		key += compressor.Name()
+	}
+	p.mu.Lock()
+	if p.encoded == nil {
+		p.encoded = map[string]*encodedFrame{}
+	}
+	frame, ok := p.encoded[key]
+	if !ok {
+		frame = &encodedFrame{}
+		p.encoded[key] = frame
+	}
+	p.mu.Unlock()
+
+	frame.once.Do(func() {
+		data, messageType := p.Data, p.messageType()
+		if codec != nil && p.Binary {
+			// Binary data stays in a binary frame, in the codec's representation of bytes
+			if data, frame.err = codec.EncodeBinary(data); frame.err != nil {
+				return
+			}
+		} else if codec != nil {
+			if data, frame.err = codec.Encode(data); frame.err != nil {
+				return
+			}
+			messageType = codec.MessageType()
+		}
+		if compressor != nil {
+			if data, frame.err = compressor.Compress(data); frame.err != nil {
+				return
+			}
+			messageType = websocket.BinaryMessage
+		}
+		frame.prepared, frame.err = websocket.NewPreparedMessage(messageType, data)
+	})
+	return frame.prepared, frame.err
+}
+
+// Function to deliver a shared payload published to a topic, using the client's
+// transport when it is not connected over a WebSocket.
+// Parameters:
+// topic: string - The topic the message was published to.
+// payload: *Payload - The payload.
+// Returns:
+// error - An error if the payload could not be delivered.
+func (client *Client) DeliverPayload(topic string, payload *Payload) error {
+	client.Session.Sent()
+	if client.Transport != nil {
+		return client.Transport.Deliver(topic, payload.Data)
+	}
+	if client.Outbox != nil {
+		return client.Outbox.Push(payload)
+	}
+	return client.writePayload(payload)
+}
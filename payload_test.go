@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// bufferTransport records the backing array of every message it is given.
+type bufferTransport struct {
+	buffers map[*byte]int
+	mu      sync.Mutex
+}
+
+func (b *bufferTransport) Deliver(topic string, message []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buffers[&message[0]]++
+	return nil
+}
+
+type discardTransport struct{}
+
+func (discardTransport) Deliver(topic string, message []byte) error { return nil }
+
+func TestFanOutSharesOneBuffer(t *testing.T) {
+	ps := &PubSub{}
+	transport := &bufferTransport{buffers: map[*byte]int{}}
+	for i := 0; i < 20; i++ {
+		client := &Client{Id: fmt.Sprint(i), Transport: transport}
+		ps.SubscribeWith(client, "news", SubscribeOptions{Envelope: i%2 == 0})
+	}
+
+	message := []byte(`{"x":1}`)
+	ps.deliver(context.Background(), "m1", "news", message)
+
+	assert.Len(t, transport.buffers, 2, "Plain and enveloped subscribers should each share a single buffer")
+	assert.Equal(t, 10, transport.buffers[&message[0]], "The published message should not be copied")
+}
+
+func TestFanOutAllocationsDoNotGrowWithSubscribers(t *testing.T) {
+	allocations := func(subscribers int) float64 {
+		ps := &PubSub{}
+		for i := 0; i < subscribers; i++ {
+			ps.Subscribe(&Client{Id: fmt.Sprint(i), Transport: discardTransport{}}, "news")
+		}
+		message := []byte(`{"x":1}`)
+		return testing.AllocsPerRun(100, func() { ps.deliver(context.Background(), "m1", "news", message) })
+	}
+
+	assert.Equal(t, allocations(10), allocations(1000), "Fanning out should not allocate per subscriber")
+}
+
+func TestPreparedFrameIsSharedByWebSocketSubscribers(t *testing.T) {
+	ps := &PubSub{}
+	first, firstPeer := newTestClient(t)
+	second, secondPeer := newTestClient(t)
+	ps.Subscribe(&first, "news")
+	ps.Subscribe(&second, "news")
+
+	ps.deliver(context.Background(), "m1", "news", []byte("hello"))
+
+	for _, peer := range []interface {
+		ReadMessage() (int, []byte, error)
+	}{firstPeer, secondPeer} {
+		_, message, err := peer.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(message))
+	}
+
+	payload := NewPayload([]byte("hello"))
+	prepared, err := payload.Prepared()
+	assert.NoError(t, err)
+	again, _ := payload.Prepared()
+	assert.Same(t, prepared, again, "The frame should be built once")
+}
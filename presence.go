@@ -0,0 +1,239 @@
+// This file answers who is subscribed to a topic. In cluster mode every node
+// periodically shares the subscribers connected to it, so the answer covers the whole
+// cluster; it is eventually consistent and lags changes by up to one heartbeat.
+// Clients joining or leaving a topic on this node are also announced on the companion
+// topic presence:<topic>, with the members of the topic at that moment.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Protocol actions to list the subscribers of a topic
+const (
+	WHO      = "who"
+	PRESENCE = "presence"
+)
+
+// Prefix of the companion topics presence events are published on
+const presencePrefix = "presence:"
+
+// Presence events
+const (
+	JOINED = "join"
+	LEFT   = "leave"
+)
+
+// A client that joined or left a topic, waiting to be announced
+type presenceChange struct {
+	Event  string
+	Topic  string
+	Member PresenceMember
+}
+
+// PresenceMember is a client subscribed to a topic.
+type PresenceMember struct {
+	ClientId  string `json:"clientId"`
+	Principal string `json:"principal,omitempty"`
+	Node      string `json:"node,omitempty"`
+	// Display name and attributes the client gave
+	Name       string            `json:"name,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// The presence last reported by another node
+type nodePresence struct {
+	Topics    map[string][]PresenceMember
+	UpdatedAt time.Time
+}
+
+// PresenceRegistry merges the presence reported by the other nodes of the cluster.
+// A node that stops reporting is forgotten once TTL has elapsed.
+type PresenceRegistry struct {
+	NodeId string
+	TTL    time.Duration
+	nodes  map[string]nodePresence
+	mu     sync.Mutex
+}
+
+// Function to create a presence registry.
+// Parameters:
+// nodeId: string - The ID of this node, recorded on its local members.
+// ttl: time.Duration - How long the presence of a node is kept without a heartbeat.
+// Returns:
+// *PresenceRegistry - The empty registry.
+func NewPresenceRegistry(nodeId string, ttl time.Duration) *PresenceRegistry {
+	return &PresenceRegistry{NodeId: nodeId, TTL: ttl, nodes: map[string]nodePresence{}}
+}
+
+// Function to replace the presence of a node with the snapshot it reported.
+// Parameters:
+// node: string - The ID of the node.
+// topics: map[string][]PresenceMember - The subscribers of each topic on that node.
+func (r *PresenceRegistry) Update(node string, topics map[string][]PresenceMember) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nodes[node] = nodePresence{Topics: topics, UpdatedAt: time.Now()}
+}
+
+// Function to get the subscribers of a topic on the other nodes.
+// Parameters:
+// topic: string - The topic.
+// Returns:
+// []PresenceMember - The members reported by nodes whose last heartbeat is recent enough.
+func (r *PresenceRegistry) Remote(topic string) []PresenceMember {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var members []PresenceMember
+	for node, presence := range r.nodes {
+		if time.Since(presence.UpdatedAt) > r.TTL {
+			delete(r.nodes, node)
+			continue
+		}
+		for _, member := range presence.Topics[topic] {
+			member.Node = node
+			members = append(members, member)
+		}
+	}
+	return members
+}
+
+// Function to describe a client as a member of a topic.
+// Returns:
+// PresenceMember - The ID, principal, display name and attributes of the client.
+func (client *Client) presenceMember() PresenceMember {
+	return PresenceMember{
+		ClientId:   client.Id,
+		Principal:  client.Principal(),
+		Name:       client.Metadata.Name(),
+		Attributes: client.Metadata.Attributes(),
+	}
+}
+
+// Function to snapshot the subscribers of every topic connected to this server.
+// Returns:
+// map[string][]PresenceMember - The subscribers, by topic.
+func (ps *PubSub) localPresence() map[string][]PresenceMember {
+	topics := map[string][]PresenceMember{}
+	for _, sub := range ps.Subscriptions() {
+		topics[sub.Topic] = append(topics[sub.Topic], sub.Client.presenceMember())
+	}
+	return topics
+}
+
+// Function to list the subscribers of a topic across the cluster.
+// Parameters:
+// topic: string - The topic.
+// Returns:
+// []PresenceMember - The subscribers, sorted by client ID.
+func (ps *PubSub) Who(topic string) []PresenceMember {
+	members := ps.localPresence()[topic]
+	if ps.Presence != nil {
+		for i := range members {
+			members[i].Node = ps.Presence.NodeId
+		}
+		members = append(members, ps.Presence.Remote(topic)...)
+	}
+	if members == nil {
+		members = []PresenceMember{}
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].ClientId < members[j].ClientId })
+	return members
+}
+
+// Function to build the reply to a who or presence action.
+// Parameters:
+// action: string - The action, who or presence.
+// topic: string - The topic.
+// members: []PresenceMember - Its subscribers.
+// Returns:
+// []byte - The JSON encoded frame.
+func membersMessage(action string, topic string, members []PresenceMember) []byte {
+	message, _ := json.Marshal(struct {
+		Action  string           `json:"action"`
+		Topic   string           `json:"topic"`
+		Members []PresenceMember `json:"members"`
+	}{action, topic, members})
+	return message
+}
+
+// Function to get the companion topic the presence of a topic is announced on.
+// Parameters:
+// topic: string - The topic.
+// Returns:
+// string - The presence topic, e.g. presence:chat.lobby.
+func presenceTopic(topic string) string {
+	return presencePrefix + topic
+}
+
+// Function to get the topic a presence topic announces the presence of.
+// Parameters:
+// topic: string - The topic.
+// Returns:
+// string - The announced topic.
+// bool - False if the topic is not a presence topic.
+func presenceTopicOf(topic string) (string, bool) {
+	return strings.CutPrefix(topic, presencePrefix)
+}
+
+// Function to record a join or leave to be announced by announcePresence. Presence
+// topics have no presence of their own. The caller must hold ps.mu.
+// Parameters:
+// event: string - JOINED or LEFT.
+// client: *Client - The client that joined or left.
+// topic: string - The topic.
+func (ps *PubSub) presenceChangedLocked(event string, client *Client, topic string) {
+	if _, ok := presenceTopicOf(topic); ok {
+		return
+	}
+	ps.presenceChanges = append(ps.presenceChanges, presenceChange{
+		Event:  event,
+		Topic:  topic,
+		Member: client.presenceMember(),
+	})
+}
+
+// Function to announce the recorded joins and leaves on the presence topics that have
+// subscribers. Presence events are not kept in the history. The caller must not hold ps.mu.
+func (ps *PubSub) announcePresence() {
+	ps.mu.Lock()
+	changes := ps.presenceChanges
+	ps.presenceChanges = nil
+	ps.mu.Unlock()
+
+	for _, change := range changes {
+		topic := presenceTopic(change.Topic)
+		ps.mu.Lock()
+		listeners := ps.countSubscribers(topic)
+		ps.mu.Unlock()
+		if listeners == 0 {
+			continue
+		}
+		ps.fanOut(context.Background(), autoId(), topic, presenceEventMessage(change, ps.Who(change.Topic)))
+	}
+}
+
+// Function to build a presence event.
+// Parameters:
+// change: presenceChange - The client that joined or left.
+// members: []PresenceMember - The subscribers of the topic after the change.
+// Returns:
+// []byte - The JSON encoded frame.
+func presenceEventMessage(change presenceChange, members []PresenceMember) []byte {
+	message, _ := json.Marshal(struct {
+		Action     string            `json:"action"`
+		Event      string            `json:"event"`
+		Topic      string            `json:"topic"`
+		ClientId   string            `json:"clientId"`
+		Principal  string            `json:"principal,omitempty"`
+		Name       string            `json:"name,omitempty"`
+		Attributes map[string]string `json:"attributes,omitempty"`
+		Members    []PresenceMember  `json:"members"`
+	}{PRESENCE, change.Event, change.Topic, change.Member.ClientId, change.Member.Principal, change.Member.Name, change.Member.Attributes, members})
+	return message
+}
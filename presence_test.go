@@ -0,0 +1,123 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPresenceRegistryForgetsSilentNodes(t *testing.T) {
+	registry := NewPresenceRegistry("local", 50*time.Millisecond)
+	registry.Update("remote", map[string][]PresenceMember{"room": {{ClientId: "c1"}}})
+
+	assert.Equal(t, []PresenceMember{{ClientId: "c1", Node: "remote"}}, registry.Remote("room"))
+	assert.Empty(t, registry.Remote("lobby"))
+
+	time.Sleep(60 * time.Millisecond)
+	assert.Empty(t, registry.Remote("room"), "Nodes that missed their heartbeats should be forgotten")
+}
+
+func TestWhoListsLocalSubscribers(t *testing.T) {
+	ps := &PubSub{}
+	alice, alicePeer := newTestClient(t)
+	alice.Claims = jwt.MapClaims{"sub": "alice"}
+	bob, _ := newTestClient(t)
+	ps.Subscribe(&alice, "room")
+	ps.Subscribe(&bob, "room")
+
+	ps.HandleRecvdMessage(alice, 1, []byte(`{"action":"who","topic":"room"}`))
+
+	var reply struct {
+		Action  string           `json:"action"`
+		Members []PresenceMember `json:"members"`
+	}
+	assert.NoError(t, alicePeer.ReadJSON(&reply))
+	assert.Equal(t, WHO, reply.Action)
+	assert.ElementsMatch(t, []PresenceMember{{ClientId: alice.Id, Principal: "alice"}, {ClientId: bob.Id}}, reply.Members)
+}
+
+func TestClusterMergesPresenceAcrossNodes(t *testing.T) {
+	nodeA, psA := newTestCluster(t, "s3cret")
+	nodeB, psB := newTestCluster(t, "s3cret")
+	nodeA.SharePresence(20 * time.Millisecond)
+	nodeB.SharePresence(20 * time.Millisecond)
+
+	clientA, _ := newTestClient(t)
+	clientB, _ := newTestClient(t)
+	psA.Subscribe(&clientA, "room")
+	psB.Subscribe(&clientB, "room")
+	nodeA.Join([]string{nodeB.Address})
+
+	expected := []PresenceMember{{ClientId: clientA.Id, Node: nodeA.NodeId}, {ClientId: clientB.Id, Node: nodeB.NodeId}}
+	assert.Eventually(t, func() bool {
+		return len(psA.Who("room")) == 2 && len(psB.Who("room")) == 2
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.ElementsMatch(t, expected, psA.Who("room"))
+	assert.ElementsMatch(t, expected, psB.Who("room"))
+
+	psB.Unsubscribe(&clientB, "room")
+	assert.Eventually(t, func() bool { return len(psA.Who("room")) == 1 }, 2*time.Second, 10*time.Millisecond,
+		"Changes should reach the other nodes with the next heartbeat")
+}
+
+func TestPresenceEventsOnCompanionTopic(t *testing.T) {
+	ps := &PubSub{History: NewMemoryHistory(JSONEntryCodec{}, 10)}
+	watcher, watcherPeer := newTestClient(t)
+	alice, _ := newTestClient(t)
+	alice.Claims = jwt.MapClaims{"sub": "alice"}
+	ps.HandleRecvdMessage(watcher, 1, []byte(`{"action":"subscribe","topic":"presence:room"}`))
+
+	type event struct {
+		Action    string           `json:"action"`
+		Event     string           `json:"event"`
+		Topic     string           `json:"topic"`
+		ClientId  string           `json:"clientId"`
+		Principal string           `json:"principal"`
+		Members   []PresenceMember `json:"members"`
+	}
+	var joined event
+	ps.Subscribe(&alice, "room")
+	assert.NoError(t, watcherPeer.ReadJSON(&joined))
+	assert.Equal(t, event{Action: PRESENCE, Event: JOINED, Topic: "room", ClientId: alice.Id, Principal: "alice",
+		Members: []PresenceMember{{ClientId: alice.Id, Principal: "alice"}}}, joined)
+
+	var left event
+	ps.RemoveClient(alice)
+	assert.NoError(t, watcherPeer.ReadJSON(&left))
+	assert.Equal(t, LEFT, left.Event)
+	assert.Equal(t, alice.Id, left.ClientId)
+	assert.Empty(t, left.Members, "The members should be listed after the client left")
+
+	entries, _ := ps.History.Entries("presence:room")
+	assert.Empty(t, entries, "Presence events should not be kept in the history")
+	assert.Empty(t, ps.presenceChanges)
+}
+
+func TestPresenceActionAndReservedTopics(t *testing.T) {
+	ps := &PubSub{}
+	alice, alicePeer := newTestClient(t)
+	ps.Subscribe(&alice, "room")
+
+	ps.HandleRecvdMessage(alice, 1, []byte(`{"action":"presence","topic":"room"}`))
+	var reply struct {
+		Action  string           `json:"action"`
+		Topic   string           `json:"topic"`
+		Members []PresenceMember `json:"members"`
+	}
+	assert.NoError(t, alicePeer.ReadJSON(&reply))
+	assert.Equal(t, PRESENCE, reply.Action)
+	assert.Equal(t, []PresenceMember{{ClientId: alice.Id}}, reply.Members)
+
+	ps.HandleRecvdMessage(alice, 1, []byte(`{"action":"publish","topic":"presence:room","message":"fake"}`))
+	_, data, err := alicePeer.ReadMessage()
+	assert.NoError(t, err)
+	assert.JSONEq(t, string(forbiddenMessage(PUBLISH, "presence:room")), string(data), "Only the server may announce presence")
+
+	scoped := Client{Id: "scoped", Connection: alice.Connection, Claims: jwt.MapClaims{topicsClaim: map[string]interface{}{
+		"subscribe": []interface{}{"room"},
+	}}}
+	ps.HandleRecvdMessage(scoped, 1, []byte(`{"action":"subscribe","topic":"presence:room"}`))
+	assert.Len(t, ps.GetSubscriptions("presence:room", nil), 1, "Clients may follow the presence of the topics they may subscribe to")
+}
@@ -0,0 +1,124 @@
+// This file prepares the broker for an anticipated spike, e.g. a product launch at
+// 9am, so its first minute is not spent growing maps and slices under load. An
+// operator pre-warms the topics of the event ahead of time: they are created, the
+// subscriptions of every topic are grown for its share of the expected subscribers,
+// the history of every topic is allocated up to its retention limit and, optionally,
+// loaded with messages late joiners will ask for.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+)
+
+// Most subscribers a pre-warm may allocate for, so a typo cannot exhaust memory
+const maxPrewarmSubscribers = 1_000_000
+
+// PrewarmRequest describes an anticipated spike.
+type PrewarmRequest struct {
+	// The topics of the event
+	Topics []string `json:"topics"`
+	// How many subscriptions are expected across the topics
+	Subscribers int `json:"subscribers,omitempty"`
+	// Messages loaded into the history of every topic, oldest first
+	History []json.RawMessage `json:"history,omitempty"`
+}
+
+// PrewarmResult tells what a pre-warm allocated.
+type PrewarmResult struct {
+	// The topics that did not exist yet
+	Created []string `json:"created"`
+	// How many subscriptions fit in the topics without growing their lists
+	SubscriptionCapacity int `json:"subscriptionCapacity"`
+	// Entries allocated in the history of each topic, 0 without a bounded history
+	HistoryCapacity map[string]int `json:"historyCapacity"`
+	// Messages loaded into the histories
+	HistoryLoaded int `json:"historyLoaded"`
+}
+
+// Function to pre-warm the topics of an anticipated spike.
+// Parameters:
+// request: PrewarmRequest - The spike.
+// Returns:
+// PrewarmResult - What was allocated.
+// error - An error if the request is invalid, or asks for history without one being kept.
+func (ps *PubSub) Prewarm(request PrewarmRequest) (PrewarmResult, error) {
+	if len(request.Topics) == 0 {
+		return PrewarmResult{}, errors.New("no topics to pre-warm")
+	}
+	if request.Subscribers < 0 || request.Subscribers > maxPrewarmSubscribers {
+		return PrewarmResult{}, errors.New("subscribers must be between 0 and 1000000")
+	}
+	if len(request.History) > 0 && ps.History == nil {
+		return PrewarmResult{}, errors.New("no history is kept")
+	}
+
+	result := PrewarmResult{Created: []string{}, HistoryCapacity: map[string]int{}}
+	ps.mu.Lock()
+	for _, topic := range request.Topics {
+		if _, ok := ps.Topics[topic]; !ok {
+			ps.touchTopic(topic, nil)
+			result.Created = append(result.Created, topic)
+		}
+	}
+	// The subscriptions of each topic are a list of their own, grown for its share
+	share := (request.Subscribers + len(request.Topics) - 1) / len(request.Topics)
+	for _, topic := range request.Topics {
+		result.SubscriptionCapacity += ps.reserveSubscriptionsLocked(topic, share)
+	}
+	ps.mu.Unlock()
+
+	if ps.History != nil {
+		for _, topic := range request.Topics {
+			result.HistoryCapacity[topic] = ps.History.Reserve(topic)
+			for _, message := range request.History {
+				if _, err := ps.History.Append(autoId(), topic, message); err != nil {
+					return result, err
+				}
+				result.HistoryLoaded++
+			}
+		}
+	}
+	slog.Info("Pre-warmed topics", "topics", len(request.Topics), "created", len(result.Created), "subscribers", request.Subscribers, "history_loaded", result.HistoryLoaded)
+	return result, nil
+}
+
+// Function to allocate the history of a topic up to its retention limit, so the first
+// messages published to it do not grow it.
+// Parameters:
+// topic: string - The topic.
+// Returns:
+// int - The entries allocated, 0 if the topic keeps no history or an unbounded one.
+func (h *MemoryHistory) Reserve(topic string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	limit := h.limitLocked(topic)
+	if limit <= 0 {
+		return 0
+	}
+	h.topics[topic] = slices.Grow(h.topics[topic], limit-len(h.topics[topic]))
+	return limit
+}
+
+// Function to register the admin API pre-warming topics.
+// Parameters:
+// mux: *http.ServeMux - The mux to register the route on.
+// pubsub: *PubSub - The PubSub the route serves.
+func setupPrewarmRoutes(mux *http.ServeMux, pubsub *PubSub) {
+	mux.HandleFunc("POST /admin/prewarm", pubsub.requireAPIKey(PermissionAdmin, func(w http.ResponseWriter, r *http.Request) {
+		var request PrewarmRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		result, err := pubsub.Prewarm(request)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, result)
+	}))
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrewarm(t *testing.T) {
+	pubsub := &PubSub{History: NewMemoryHistory(JSONEntryCodec{}, 10)}
+	pubsub.touchTopic("launch/chat", nil)
+
+	result, err := pubsub.Prewarm(PrewarmRequest{
+		Topics:      []string{"launch/chat", "launch/news"},
+		Subscribers: 500,
+		History:     []json.RawMessage{json.RawMessage(`{"text":"Doors open at 9"}`)},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"launch/news"}, result.Created)
+	assert.GreaterOrEqual(t, result.SubscriptionCapacity, 500)
+	assert.GreaterOrEqual(t, cap(pubsub.topicSubscriptions("launch/chat")), 250, "Each topic is grown for its share")
+	assert.GreaterOrEqual(t, cap(pubsub.topicSubscriptions("launch/news")), 250)
+	assert.Equal(t, map[string]int{"launch/chat": 10, "launch/news": 10}, result.HistoryCapacity)
+	assert.Equal(t, 2, result.HistoryLoaded)
+	assert.Contains(t, pubsub.Topics, "launch/news")
+	assert.Empty(t, pubsub.Topics["launch/news"].Owner)
+
+	entries, err := pubsub.History.Entries("launch/news")
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.JSONEq(t, `{"text":"Doors open at 9"}`, string(entries[0].Payload))
+	}
+	assert.GreaterOrEqual(t, cap(pubsub.History.topics["launch/news"]), 10)
+}
+
+func TestPrewarmRefusesInvalidRequests(t *testing.T) {
+	pubsub := &PubSub{}
+
+	_, err := pubsub.Prewarm(PrewarmRequest{})
+	assert.Error(t, err)
+	_, err = pubsub.Prewarm(PrewarmRequest{Topics: []string{"launch"}, Subscribers: -1})
+	assert.Error(t, err)
+	_, err = pubsub.Prewarm(PrewarmRequest{Topics: []string{"launch"}, Subscribers: maxPrewarmSubscribers + 1})
+	assert.Error(t, err)
+	_, err = pubsub.Prewarm(PrewarmRequest{Topics: []string{"launch"}, History: []json.RawMessage{json.RawMessage(`1`)}})
+	assert.Error(t, err, "history cannot be loaded without one being kept")
+	assert.Empty(t, pubsub.Topics)
+
+	result, err := pubsub.Prewarm(PrewarmRequest{Topics: []string{"launch"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"launch"}, result.Created)
+	assert.Empty(t, result.HistoryCapacity)
+}
+
+func TestMemoryHistoryReserve(t *testing.T) {
+	history := NewMemoryHistory(JSONEntryCodec{}, 5)
+	history.Retention = &RetentionPolicy{Rules: []RetentionRule{{Topic: "durable/*", Tier: RetainDurable}, {Topic: "ephemeral/*", Tier: RetainNone}, {Topic: "latest/*", Tier: RetainLastValue}}}
+
+	assert.Equal(t, 5, history.Reserve("bounded"))
+	assert.GreaterOrEqual(t, cap(history.topics["bounded"]), 5)
+	assert.Equal(t, 0, history.Reserve("durable/orders"))
+	assert.Equal(t, 0, history.Reserve("ephemeral/typing"))
+	assert.Equal(t, 1, history.Reserve("latest/price"))
+}
+
+func TestPrewarmRoute(t *testing.T) {
+	keys := NewAPIKeyStore()
+	isolatePubSub(t).apiKeys = keys
+	keys.Add("root", "admin", []string{PermissionAdmin})
+	keys.Add("reader", "reader", []string{PermissionSubscribe})
+
+	mux := http.NewServeMux()
+	setupPrewarmRoutes(mux, ps)
+	serve := func(key, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest("POST", "/admin/prewarm", strings.NewReader(body))
+		request.Header.Set(apiKeyHeader, key)
+		response := httptest.NewRecorder()
+		mux.ServeHTTP(response, request)
+		return response
+	}
+
+	assert.Equal(t, http.StatusForbidden, serve("reader", `{"topics":["prewarm-route"]}`).Code)
+	assert.Equal(t, http.StatusBadRequest, serve("root", `{"topics":[]}`).Code)
+	assert.Equal(t, http.StatusBadRequest, serve("root", `not json`).Code)
+
+	response := serve("root", `{"topics":["prewarm-route"],"subscribers":10}`)
+	assert.Equal(t, http.StatusOK, response.Code)
+	var result PrewarmResult
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &result))
+	assert.Equal(t, []string{"prewarm-route"}, result.Created)
+	assert.GreaterOrEqual(t, result.SubscriptionCapacity, 10)
+}
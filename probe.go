@@ -0,0 +1,138 @@
+// This file implements synthetic end-to-end monitoring: every node periodically
+// publishes a canary message on a probe topic and a canary subscriber on every node
+// records how long each node's canaries took to arrive and how many went missing.
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Topic on which canary messages are published
+const probeTopic = "$probe"
+
+var (
+	probeSent = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gowebsockets_probe_sent_total",
+		Help: "Number of canary messages published by this node.",
+	})
+	probeReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gowebsockets_probe_received_total",
+		Help: "Number of canary messages received by this node, by origin node.",
+	}, []string{"origin"})
+	probeLost = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gowebsockets_probe_lost_total",
+		Help: "Number of canary messages that never reached this node, by origin node.",
+	}, []string{"origin"})
+	probeLatency = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gowebsockets_probe_latency_seconds",
+		Help: "Publish to delivery latency of the last canary message, by origin node. Includes clock skew between nodes.",
+	}, []string{"origin"})
+	probeLastReceived = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gowebsockets_probe_last_received_timestamp_seconds",
+		Help: "Unix time the last canary message was received, by origin node.",
+	}, []string{"origin"})
+)
+
+// A canary message
+type canary struct {
+	Node     string    `json:"node"`
+	Sequence uint64    `json:"seq"`
+	Sent     time.Time `json:"sent"`
+}
+
+type Prober struct {
+	NodeId   string
+	Interval time.Duration
+	ps       *PubSub
+	client   Client
+	sequence uint64
+	lastSeq  map[string]uint64
+	mu       sync.Mutex
+	done     chan struct{}
+}
+
+// Function to create a prober.
+// Parameters:
+// nodeId: string - The ID identifying this node in the metrics of the other nodes.
+// interval: time.Duration - How often a canary message is published.
+// ps: *PubSub - The PubSub instance to probe.
+// Returns:
+// *Prober - The prober; call Start to begin probing.
+func NewProber(nodeId string, interval time.Duration, ps *PubSub) *Prober {
+	prober := &Prober{
+		NodeId:   nodeId,
+		Interval: interval,
+		ps:       ps,
+		lastSeq:  map[string]uint64{},
+		done:     make(chan struct{}),
+	}
+	prober.client = Client{Id: "probe-" + nodeId, Language: defaultLanguage, Transport: prober}
+	return prober
+}
+
+// Function to subscribe the canary subscriber and publish canary messages every interval.
+func (p *Prober) Start() {
+	p.ps.Subscribe(&p.client, probeTopic)
+	go func() {
+		ticker := time.NewTicker(p.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.done:
+				return
+			case <-ticker.C:
+				p.probe()
+			}
+		}
+	}()
+}
+
+// Function to stop publishing canary messages and unsubscribe the canary subscriber.
+func (p *Prober) Stop() {
+	close(p.done)
+	p.ps.Unsubscribe(&p.client, probeTopic)
+}
+
+// Function to publish the next canary message.
+func (p *Prober) probe() {
+	p.mu.Lock()
+	p.sequence++
+	message, _ := json.Marshal(canary{Node: p.NodeId, Sequence: p.sequence, Sent: time.Now()})
+	p.mu.Unlock()
+
+	p.ps.Publish(probeTopic, message, nil)
+	probeSent.Inc()
+}
+
+// Function to record a canary message received by the canary subscriber.
+// Parameters:
+// topic: string - The probe topic.
+// message: []byte - The canary message.
+// Returns:
+// error - Always nil; messages that are not canaries are ignored.
+func (p *Prober) Deliver(topic string, message []byte) error {
+	var c canary
+	if err := json.Unmarshal(message, &c); err != nil || c.Node == "" {
+		slog.Warn("Ignoring message on probe topic that is not a canary", logKeyTopic, topic)
+		return nil
+	}
+
+	probeReceived.WithLabelValues(c.Node).Inc()
+	probeLatency.WithLabelValues(c.Node).Set(time.Since(c.Sent).Seconds())
+	probeLastReceived.WithLabelValues(c.Node).Set(float64(time.Now().Unix()))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// A gap in the sequence means canaries were lost; a lower sequence means the node restarted
+	if last, ok := p.lastSeq[c.Node]; ok && c.Sequence > last+1 {
+		probeLost.WithLabelValues(c.Node).Add(float64(c.Sequence - last - 1))
+	}
+	p.lastSeq[c.Node] = c.Sequence
+	return nil
+}
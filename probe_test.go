@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProberMeasuresLocalDelivery(t *testing.T) {
+	ps := &PubSub{}
+	prober := NewProber(autoId(), time.Hour, ps)
+	prober.Start()
+	defer prober.Stop()
+
+	prober.probe()
+	prober.probe()
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(probeReceived.WithLabelValues(prober.NodeId)))
+	assert.Equal(t, 0.0, testutil.ToFloat64(probeLost.WithLabelValues(prober.NodeId)))
+	assert.GreaterOrEqual(t, testutil.ToFloat64(probeLatency.WithLabelValues(prober.NodeId)), 0.0)
+}
+
+func TestProberCountsLostCanaries(t *testing.T) {
+	prober := NewProber(autoId(), time.Hour, &PubSub{})
+	origin := autoId()
+
+	for _, sequence := range []uint64{1, 2, 5} {
+		message, _ := json.Marshal(canary{Node: origin, Sequence: sequence, Sent: time.Now()})
+		prober.Deliver(probeTopic, message)
+	}
+	prober.Deliver(probeTopic, []byte("not a canary"))
+
+	assert.Equal(t, 3.0, testutil.ToFloat64(probeReceived.WithLabelValues(origin)))
+	assert.Equal(t, 2.0, testutil.ToFloat64(probeLost.WithLabelValues(origin)), "Sequences 3 and 4 never arrived")
+}
@@ -0,0 +1,120 @@
+// This file translates frames between JSON and the protobuf envelope of
+// envelopepb/envelope.proto for the protobuf envelope codec. Clients send Request
+// messages, the counterpart of Message, and receive Frame messages: delivered
+// envelopes and binary messages map to their own fields and every other frame is
+// carried as a google.protobuf.Value. JSON values are held in the generated types
+// rather than as raw JSON, so their numbers are doubles.
+package main
+
+import (
+	"encoding/json"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"mywebsocketserver/envelopepb"
+)
+
+// Function to translate a frame built by the server to a protobuf Frame.
+// Parameters:
+// frame: []byte - The frame, usually JSON.
+// Returns:
+// []byte - The encoded Frame.
+// error - An error if a JSON value could not be represented.
+func jsonToProtobuf(frame []byte) ([]byte, error) {
+	if !json.Valid(frame) {
+		return proto.Marshal(&envelopepb.Frame{Frame: &envelopepb.Frame_Json{Json: structpb.NewStringValue(string(frame))}})
+	}
+
+	var envelope struct {
+		Action        string            `json:"action"`
+		Topic         string            `json:"topic"`
+		Id            string            `json:"id"`
+		Publisher     string            `json:"publisher"`
+		Message       json.RawMessage   `json:"message"`
+		Data          []byte            `json:"data"`
+		Trace         map[string]string `json:"trace"`
+		ReplyTo       string            `json:"replyTo"`
+		CorrelationId string            `json:"correlationId"`
+	}
+	if json.Unmarshal(frame, &envelope) == nil && envelope.Action == "message" && envelope.Id != "" {
+		message := &envelopepb.Envelope{Topic: envelope.Topic, Id: envelope.Id, Publisher: envelope.Publisher, Trace: envelope.Trace,
+			ReplyTo: envelope.ReplyTo, CorrelationId: envelope.CorrelationId}
+		if envelope.Data != nil {
+			message.Payload = &envelopepb.Envelope_Data{Data: envelope.Data}
+		} else if envelope.Message != nil {
+			value := &structpb.Value{}
+			if err := protojson.Unmarshal(envelope.Message, value); err != nil {
+				return nil, err
+			}
+			message.Payload = &envelopepb.Envelope_Message{Message: value}
+		}
+		return proto.Marshal(&envelopepb.Frame{Frame: &envelopepb.Frame_Envelope{Envelope: message}})
+	}
+
+	value := &structpb.Value{}
+	if err := protojson.Unmarshal(frame, value); err != nil {
+		return nil, err
+	}
+	return proto.Marshal(&envelopepb.Frame{Frame: &envelopepb.Frame_Json{Json: value}})
+}
+
+// Function to translate a protobuf Request of a client to its JSON frame.
+// Parameters:
+// data: []byte - The encoded Request.
+// Returns:
+// []byte - The JSON frame.
+// error - An error if the data is not a Request.
+func protobufToJSON(data []byte) ([]byte, error) {
+	var request envelopepb.Request
+	if err := proto.Unmarshal(data, &request); err != nil {
+		return nil, err
+	}
+	m := Message{
+		Action:        request.Action,
+		Topic:         request.Topic,
+		Principal:     request.Principal,
+		Publisher:     request.Publisher,
+		Grant:         request.Grant,
+		TTL:           int(request.Ttl),
+		Id:            request.Id,
+		Reason:        request.Reason,
+		Envelope:      request.Envelope,
+		StatsInterval: request.StatsInterval,
+		Trace:         request.Trace,
+		Since:         request.Since,
+		Limit:         int(request.Limit),
+		Name:          request.Name,
+		Attributes:    request.Attributes,
+		Users:         request.Users,
+		Start:         request.Start,
+		ReplyTo:       request.ReplyTo,
+		CorrelationId: request.CorrelationId,
+	}
+	if len(request.Data) > 0 {
+		m.Data = request.Data
+	}
+	var err error
+	if request.Message != nil {
+		if m.Message, err = protojson.Marshal(request.Message); err != nil {
+			return nil, err
+		}
+	}
+	if request.Policy != nil {
+		if m.Policy, err = protojson.Marshal(request.Policy); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(m)
+}
+
+// Function to wrap a binary message in a protobuf Frame.
+// Parameters:
+// data: []byte - The binary message.
+// Returns:
+// []byte - The encoded Frame.
+// error - An error if the frame could not be encoded.
+func binaryToProtobuf(data []byte) ([]byte, error) {
+	return proto.Marshal(&envelopepb.Frame{Frame: &envelopepb.Frame_Binary{Binary: data}})
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"mywebsocketserver/envelopepb"
+)
+
+func TestProtobufRequestToJSON(t *testing.T) {
+	message, _ := structpb.NewValue(map[string]interface{}{"t": 21.5, "ok": true})
+	data, _ := proto.Marshal(&envelopepb.Request{
+		Action:        "publish",
+		Topic:         "sensors",
+		Message:       message,
+		StatsInterval: 500,
+		Trace:         map[string]string{"traceparent": "00-1"},
+	})
+	frame, err := protobufToJSON(data)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"action":"publish","topic":"sensors","message":{"t":21.5,"ok":true},"statsInterval":500,"trace":{"traceparent":"00-1"}}`, string(frame))
+
+	data, _ = proto.Marshal(&envelopepb.Request{Action: "publish", Topic: "audio", Data: []byte{0, 1}})
+	frame, _ = protobufToJSON(data)
+	assert.JSONEq(t, `{"action":"publish","topic":"audio","message":null,"data":"AAE="}`, string(frame))
+
+	_, err = protobufToJSON([]byte{0xff})
+	assert.Error(t, err)
+}
+
+func TestJSONToProtobufFrames(t *testing.T) {
+	decode := func(data []byte, err error) *envelopepb.Frame {
+		assert.NoError(t, err)
+		var frame envelopepb.Frame
+		assert.NoError(t, proto.Unmarshal(data, &frame))
+		return &frame
+	}
+
+	envelope := decode(jsonToProtobuf(envelopeMessage("m1", "chat", []byte(`{"text":"hi"}`), nil, "alice", replyHeaders{}))).GetEnvelope()
+	if assert.NotNil(t, envelope) {
+		assert.Equal(t, "chat", envelope.Topic)
+		assert.Equal(t, "m1", envelope.Id)
+		assert.Equal(t, "alice", envelope.Publisher)
+		assert.Equal(t, "hi", envelope.GetMessage().GetStructValue().Fields["text"].GetStringValue())
+	}
+	envelope = decode(jsonToProtobuf(envelopeMessage("m2", "audio", []byte{0xff}, nil, "", replyHeaders{}))).GetEnvelope()
+	assert.Equal(t, []byte{0xff}, envelope.GetData())
+
+	welcome := decode(jsonToProtobuf([]byte(`{"action":"welcome","clientId":"c1"}`))).GetJson()
+	assert.Equal(t, "welcome", welcome.GetStructValue().Fields["action"].GetStringValue())
+	ack := decode(jsonToProtobuf([]byte("Server received the message!"))).GetJson()
+	assert.Equal(t, "Server received the message!", ack.GetStringValue())
+	assert.Equal(t, []byte{1, 2}, decode(binaryToProtobuf([]byte{1, 2})).GetBinary())
+}
+
+func TestProtobufCodecIsNegotiatedBySubprotocol(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(ps.webSocketHandler))
+	defer server.Close()
+	dialer := websocket.Dialer{Subprotocols: []string{"protobuf"}}
+	ws, _, err := dialer.Dial("ws"+server.URL[4:], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	assert.Equal(t, "protobuf", ws.Subprotocol())
+
+	read := func() *envelopepb.Frame {
+		messageType, data, err := ws.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, websocket.BinaryMessage, messageType)
+		var frame envelopepb.Frame
+		assert.NoError(t, proto.Unmarshal(data, &frame))
+		return &frame
+	}
+	send := func(request *envelopepb.Request) {
+		data, _ := proto.Marshal(request)
+		ws.WriteMessage(websocket.BinaryMessage, data)
+		read()
+	}
+	assert.Equal(t, "welcome", read().GetJson().GetStructValue().Fields["action"].GetStringValue())
+
+	send(&envelopepb.Request{Action: "subscribe", Topic: "protobuf-feed", Envelope: true})
+	send(&envelopepb.Request{Action: "publish", Topic: "protobuf-feed", Message: structpb.NewNumberValue(101.25)})
+	envelope := read().GetEnvelope()
+	if assert.NotNil(t, envelope) {
+		assert.Equal(t, "protobuf-feed", envelope.Topic)
+		assert.Equal(t, 101.25, envelope.GetMessage().GetNumberValue())
+	}
+}
@@ -0,0 +1,65 @@
+// This file attributes published messages to their publishers. The publisher of a
+// message is the principal of the connection it was published on: the server sets it
+// and delivers it in the publisher field of envelopes, so subscribers can rely on it.
+// A publisher named by a publish frame is ignored and counted as a spoofing attempt,
+// unless trust_client_publisher is enabled for deployments still migrating clients
+// that name their own author.
+package main
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var spoofedPublishers = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "websocket_spoofed_publisher_total",
+	Help: "Publish frames naming a publisher other than the principal of their connection.",
+})
+
+// Key of the publisher of a message in the context of its publish
+type publisherKey struct{}
+
+// Function to attach the publisher of a message to the context of its publish.
+// Parameters:
+// ctx: context.Context - The context of the publish.
+// publisher: string - The publisher, or "" if anonymous.
+// Returns:
+// context.Context - The context carrying the publisher.
+func withPublisher(ctx context.Context, publisher string) context.Context {
+	if publisher == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, publisherKey{}, publisher)
+}
+
+// Function to get the publisher of the message published in a context.
+// Parameters:
+// ctx: context.Context - The context of the publish.
+// Returns:
+// string - The publisher, or "" for anonymous publishers and messages of the server.
+func publisherFrom(ctx context.Context) string {
+	publisher, _ := ctx.Value(publisherKey{}).(string)
+	return publisher
+}
+
+// Function to determine the publisher of a publish frame.
+// Parameters:
+// client: *Client - The client that sent the frame.
+// m: Message - The publish frame.
+// Returns:
+// string - The principal of the client, or the publisher named by the frame if client publishers are trusted.
+func (ps *PubSub) publisherOf(client *Client, m Message) string {
+	principal := client.Principal()
+	if m.Publisher == "" || m.Publisher == principal {
+		return principal
+	}
+	if ps.options().trustClientPublisher {
+		client.logger().Warn("Trusted the publisher named by a publish frame", "publisher", m.Publisher)
+		return m.Publisher
+	}
+	spoofedPublishers.Inc()
+	client.logger().Warn("Ignored the publisher named by a publish frame", "publisher", m.Publisher)
+	return principal
+}
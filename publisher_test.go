@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublisherIsSetByTheServer(t *testing.T) {
+	pubsub := &PubSub{}
+	envelopes := &eventRecorder{}
+	pubsub.SubscribeWith(&Client{Id: "reader", Transport: envelopes}, "chat", SubscribeOptions{Envelope: true})
+	alice := Client{Id: "alice-1", Claims: map[string]interface{}{"sub": "alice"}}
+	publish := func(client Client, frame string) interface{} {
+		envelopes.frames = nil
+		pubsub.HandleRecvdMessage(client, websocket.TextMessage, []byte(frame))
+		if !assert.Len(t, envelopes.frames, 1) {
+			return nil
+		}
+		return envelopes.frames[0]["publisher"]
+	}
+
+	assert.Equal(t, "alice", publish(alice, `{"action":"publish","topic":"chat","message":"hi"}`))
+	assert.Nil(t, publish(Client{Id: "guest"}, `{"action":"publish","topic":"chat","message":"hi"}`), "Anonymous messages should have no publisher")
+
+	spoofed := testutil.ToFloat64(spoofedPublishers)
+	assert.Equal(t, "alice", publish(alice, `{"action":"publish","topic":"chat","message":"hi","publisher":"bob"}`), "A publisher named by the client should be ignored")
+	assert.Nil(t, publish(Client{Id: "guest"}, `{"action":"publish","topic":"chat","message":"hi","publisher":"bob"}`))
+	assert.Equal(t, spoofed+2, testutil.ToFloat64(spoofedPublishers))
+
+	pubsub.options().trustClientPublisher = true
+	assert.Equal(t, "bob", publish(alice, `{"action":"publish","topic":"chat","message":"hi","publisher":"bob"}`), "Migrating deployments may trust the client")
+}
+
+func TestPublisherSurvivesModeration(t *testing.T) {
+	pubsub := &PubSub{}
+	envelopes := &eventRecorder{}
+	pubsub.SubscribeWith(&Client{Id: "reader", Transport: envelopes}, "reviewed", SubscribeOptions{Envelope: true})
+	pubsub.Moderation = NewModeration([]string{"reviewed"}, nil, pubsub)
+
+	alice := Client{Id: "alice-1", Claims: map[string]interface{}{"sub": "alice"}}
+	pubsub.HandleRecvdMessage(alice, websocket.TextMessage, []byte(`{"action":"publish","topic":"reviewed","message":"hi"}`))
+	assert.Empty(t, envelopes.frames)
+	assert.NoError(t, pubsub.Moderation.Decide(pubsub.Moderation.Pending()[0].Id, VerdictApprove))
+	if assert.Len(t, envelopes.frames, 1) {
+		assert.Equal(t, "alice", envelopes.frames[0]["publisher"])
+	}
+}
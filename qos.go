@@ -0,0 +1,310 @@
+// This file delivers the messages of QoS 1 subscriptions at least once. A client
+// subscribing with {"action":"subscribe","topic":"t","qos":1} receives every message in
+// an envelope and answers with {"action":"ack","id":"..."} once it handled it, or with
+// {"action":"nack","id":"...","reason":"transient"} to have it redelivered after a
+// backoff growing with every attempt. Messages neither acknowledged nor refused within
+// the ack timeout are redelivered too. A message refused with the decode_failure reason,
+// which no redelivery fixes, or delivered the maximum number of times is dead-lettered:
+// it is published with its topic and reason on the $deadletter topic, which only
+// administrators may subscribe to.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Actions acknowledging and refusing a message of a QoS 1 subscription
+const (
+	ACK  = "ack"
+	NACK = "nack"
+)
+
+// Action of the frames of the dead-letter topic
+const DEAD_LETTER = "dead_letter"
+
+// Topic the messages that could not be delivered are published on
+const deadLetterTopic = "$deadletter"
+
+// Reasons a message is refused or dead-lettered
+const (
+	// The client could not decode the message, so redelivering it cannot help
+	nackDecodeFailure = "decode_failure"
+	// The client failed to handle the message for now
+	nackTransient = "transient"
+	// The client did not answer within the ack timeout
+	reasonAckTimeout = "ack_timeout"
+)
+
+// Defaults of redelivery
+const (
+	defaultAckTimeout         = 30 * time.Second
+	defaultRedeliveryBackoff  = time.Second
+	defaultRedeliveryMaxDelay = time.Minute
+	defaultMaxDeliveries      = 5
+)
+
+var (
+	redeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gowebsockets_redeliveries_total",
+		Help: "Number of messages of QoS 1 subscriptions delivered again, by reason.",
+	}, []string{"reason"})
+	deadLetters = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gowebsockets_dead_letters_total",
+		Help: "Number of messages of QoS 1 subscriptions dead-lettered, by reason.",
+	}, []string{"reason"})
+)
+
+// RedeliveryPolicy decides when the messages of QoS 1 subscriptions are delivered again.
+// Zero fields take their defaults.
+type RedeliveryPolicy struct {
+	// How long a delivery may wait for an ack or nack before it is delivered again
+	AckTimeout time.Duration
+	// Delay before the first redelivery of a refused message, doubled on every attempt
+	Backoff time.Duration
+	// Longest delay before a redelivery
+	MaxBackoff time.Duration
+	// Deliveries of a message, the first included, before it is dead-lettered
+	MaxDeliveries int
+}
+
+// Function to fill in the defaults of a policy.
+// Returns:
+// RedeliveryPolicy - The policy with every zero field set to its default.
+func (p RedeliveryPolicy) withDefaults() RedeliveryPolicy {
+	if p.AckTimeout <= 0 {
+		p.AckTimeout = defaultAckTimeout
+	}
+	if p.Backoff <= 0 {
+		p.Backoff = defaultRedeliveryBackoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = defaultRedeliveryMaxDelay
+	}
+	if p.MaxDeliveries <= 0 {
+		p.MaxDeliveries = defaultMaxDeliveries
+	}
+	return p
+}
+
+// Function to get the delay before a refused message is delivered again.
+// Parameters:
+// attempts: int - The deliveries of the message so far.
+// Returns:
+// time.Duration - The backoff doubled for every delivery after the first, at most MaxBackoff.
+func (p RedeliveryPolicy) delay(attempts int) time.Duration {
+	delay := p.Backoff
+	for i := 1; i < attempts && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, p.MaxBackoff)
+}
+
+// inflightMessage is a message of a QoS 1 subscription waiting to be acknowledged.
+type inflightMessage struct {
+	client  *Client
+	topic   string
+	id      string
+	payload *Payload
+	// The published message, dead-lettered if it cannot be delivered
+	message  []byte
+	attempts int
+	timer    *time.Timer
+	// Incremented whenever the timer is replaced, so a stale timer does nothing
+	generation int
+}
+
+// inflightTracker holds the messages waiting to be acknowledged, by client and message ID.
+type inflightTracker struct {
+	mu       sync.Mutex
+	messages map[string]*inflightMessage
+}
+
+// Function to get the key of a delivery.
+// Parameters:
+// clientId: string - The ID of the client.
+// id: string - The ID of the message.
+// Returns:
+// string - The key of the delivery in the tracker.
+func inflightKey(clientId string, id string) string {
+	return clientId + " " + id
+}
+
+// Function to remember a message delivered to a QoS 1 subscription until it is
+// acknowledged.
+// Parameters:
+// client: *Client - The subscriber.
+// topic: string - The topic.
+// id: string - The ID of the message.
+// payload: *Payload - The enveloped message delivered.
+// message: []byte - The published message.
+func (ps *PubSub) trackDelivery(client *Client, topic string, id string, payload *Payload, message []byte) {
+	key := inflightKey(client.Id, id)
+	ps.inflight.mu.Lock()
+	defer ps.inflight.mu.Unlock()
+	if ps.inflight.messages == nil {
+		ps.inflight.messages = map[string]*inflightMessage{}
+	}
+	entry := &inflightMessage{client: client, topic: topic, id: id, payload: payload, message: message, attempts: 1}
+	ps.inflight.messages[key] = entry
+	ps.scheduleInflightLocked(key, entry, ps.Redelivery.withDefaults().AckTimeout, reasonAckTimeout)
+}
+
+// Function to replace the timer of a delivery. The caller must hold ps.inflight.mu.
+// Parameters:
+// key: string - The key of the delivery.
+// entry: *inflightMessage - The delivery.
+// after: time.Duration - When the timer fires.
+// reason: string - Why the message is delivered again when it fires.
+func (ps *PubSub) scheduleInflightLocked(key string, entry *inflightMessage, after time.Duration, reason string) {
+	if entry.timer != nil {
+		entry.timer.Stop()
+	}
+	entry.generation++
+	generation := entry.generation
+	entry.timer = time.AfterFunc(after, func() {
+		ps.redeliver(key, generation, reason)
+	})
+}
+
+// Function to deliver a message again, or dead-letter it once it was delivered the
+// maximum number of times.
+// Parameters:
+// key: string - The key of the delivery.
+// generation: int - The generation of the timer firing.
+// reason: string - Why the message is delivered again.
+func (ps *PubSub) redeliver(key string, generation int, reason string) {
+	policy := ps.Redelivery.withDefaults()
+	ps.inflight.mu.Lock()
+	entry, ok := ps.inflight.messages[key]
+	if !ok || entry.generation != generation {
+		ps.inflight.mu.Unlock()
+		return
+	}
+	if entry.attempts >= policy.MaxDeliveries {
+		delete(ps.inflight.messages, key)
+		ps.inflight.mu.Unlock()
+		ps.deadLetter(entry, reason)
+		return
+	}
+	entry.attempts++
+	ps.scheduleInflightLocked(key, entry, policy.AckTimeout, reasonAckTimeout)
+	ps.inflight.mu.Unlock()
+
+	// Messages of topics the client left are no longer its to handle
+	ps.mu.Lock()
+	subscribed := len(ps.GetSubscriptions(entry.topic, entry.client)) > 0
+	ps.mu.Unlock()
+	if !subscribed {
+		ps.forgetDelivery(key)
+		return
+	}
+	redeliveries.WithLabelValues(reason).Inc()
+	entry.client.DeliverPayload(entry.topic, entry.payload)
+}
+
+// Function to forget a delivery without dead-lettering it.
+// Parameters:
+// key: string - The key of the delivery.
+// Returns:
+// *inflightMessage - The delivery, or nil if it was not waiting.
+func (ps *PubSub) forgetDelivery(key string) *inflightMessage {
+	ps.inflight.mu.Lock()
+	defer ps.inflight.mu.Unlock()
+	entry, ok := ps.inflight.messages[key]
+	if !ok {
+		return nil
+	}
+	entry.timer.Stop()
+	delete(ps.inflight.messages, key)
+	return entry
+}
+
+// Function to forget the deliveries waiting for a client that disconnected.
+// Parameters:
+// clientId: string - The ID of the client.
+func (ps *PubSub) forgetDeliveriesOf(clientId string) {
+	ps.inflight.mu.Lock()
+	defer ps.inflight.mu.Unlock()
+	for key, entry := range ps.inflight.messages {
+		if entry.client.Id == clientId {
+			entry.timer.Stop()
+			delete(ps.inflight.messages, key)
+		}
+	}
+}
+
+// Function to handle an ack frame.
+// Parameters:
+// client: *Client - The client.
+// m: Message - The frame, naming the message acknowledged in Id.
+func (ps *PubSub) handleAck(client *Client, m Message) {
+	// Acknowledging twice is harmless
+	ps.forgetDelivery(inflightKey(client.Id, m.Id))
+}
+
+// Function to handle a nack frame: the message is dead-lettered if the client cannot
+// decode it or it was delivered the maximum number of times, and delivered again after
+// a backoff otherwise.
+// Parameters:
+// client: *Client - The client.
+// m: Message - The frame, naming the message refused in Id and why in Reason.
+func (ps *PubSub) handleNack(client *Client, m Message) {
+	// Any other reason is a transient failure
+	reason := m.Reason
+	if reason != nackDecodeFailure {
+		reason = nackTransient
+	}
+	policy := ps.Redelivery.withDefaults()
+	key := inflightKey(client.Id, m.Id)
+
+	ps.inflight.mu.Lock()
+	entry, ok := ps.inflight.messages[key]
+	if !ok {
+		ps.inflight.mu.Unlock()
+		client.Send(errorMessage("unknown_delivery", m.Topic))
+		return
+	}
+	if reason == nackDecodeFailure || entry.attempts >= policy.MaxDeliveries {
+		entry.timer.Stop()
+		delete(ps.inflight.messages, key)
+		ps.inflight.mu.Unlock()
+		ps.deadLetter(entry, reason)
+		return
+	}
+	ps.scheduleInflightLocked(key, entry, policy.delay(entry.attempts), reason)
+	ps.inflight.mu.Unlock()
+}
+
+// Function to publish a message that could not be delivered on the dead-letter topic,
+// where it is kept in the history if the history is enabled.
+// Parameters:
+// entry: *inflightMessage - The delivery given up.
+// reason: string - Why it was given up.
+func (ps *PubSub) deadLetter(entry *inflightMessage, reason string) {
+	frame := struct {
+		Action   string          `json:"action"`
+		Topic    string          `json:"topic"`
+		Id       string          `json:"id"`
+		ClientId string          `json:"clientId"`
+		Reason   string          `json:"reason"`
+		Attempts int             `json:"attempts"`
+		Message  json.RawMessage `json:"message,omitempty"`
+		Data     []byte          `json:"data,omitempty"`
+	}{Action: DEAD_LETTER, Topic: entry.topic, Id: entry.id, ClientId: entry.client.Id, Reason: reason, Attempts: entry.attempts}
+	if json.Valid(entry.message) {
+		frame.Message = entry.message
+	} else {
+		frame.Data = entry.message
+	}
+	data, _ := json.Marshal(frame)
+
+	entry.client.logger().Warn("Dead-lettered message", logKeyTopic, entry.topic, "message_id", entry.id, "reason", reason, "attempts", entry.attempts)
+	deadLetters.WithLabelValues(reason).Inc()
+	ps.deliver(context.Background(), autoId(), deadLetterTopic, data)
+}
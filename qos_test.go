@@ -0,0 +1,116 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+// newQoSPubSub creates a PubSub redelivering quickly, with a watcher of its dead letters.
+func newQoSPubSub(t *testing.T, policy RedeliveryPolicy) (*PubSub, func() map[string]interface{}) {
+	pubsub := &PubSub{Redelivery: policy}
+	watcher, watcherPeer := newTestClient(t)
+	watcher.Outbox = NewOutbox(&watcher, 8, DisconnectSlowConsumer, SlowStart{})
+	pubsub.Subscribe(&watcher, deadLetterTopic)
+	return pubsub, func() map[string]interface{} { return readFrame(t, watcherPeer) }
+}
+
+// subscribeQoS1 connects a client subscribed to a topic at QoS 1.
+func subscribeQoS1(t *testing.T, pubsub *PubSub, topic string) (Client, func() map[string]interface{}) {
+	client, peer := newTestClient(t)
+	client.Outbox = NewOutbox(&client, 8, DisconnectSlowConsumer, SlowStart{})
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"`+topic+`","qos":1}`))
+	return client, func() map[string]interface{} { return readFrame(t, peer) }
+}
+
+func TestAckedMessagesAreNotRedelivered(t *testing.T) {
+	pubsub, _ := newQoSPubSub(t, RedeliveryPolicy{AckTimeout: 100 * time.Millisecond})
+	client, read := subscribeQoS1(t, pubsub, "orders")
+
+	pubsub.Publish("orders", []byte(`{"id":1}`), nil)
+	delivery := read()
+	assert.Equal(t, "message", delivery["action"], "QoS 1 messages are delivered in envelopes")
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"ack","id":"`+delivery["id"].(string)+`"}`))
+
+	pubsub.Publish("orders", []byte(`{"id":2}`), nil)
+	unacked := read()
+	assert.Equal(t, unacked["id"], read()["id"], "Messages not acknowledged in time are delivered again")
+	assert.Equal(t, map[string]interface{}{"id": 2.0}, unacked["message"], "Acknowledged messages are not delivered again")
+}
+
+func TestNackRedeliversWithBackoff(t *testing.T) {
+	pubsub, readDeadLetter := newQoSPubSub(t, RedeliveryPolicy{AckTimeout: time.Minute, Backoff: 50 * time.Millisecond, MaxDeliveries: 3})
+	client, read := subscribeQoS1(t, pubsub, "orders")
+
+	pubsub.Publish("orders", []byte(`{"id":1}`), nil)
+	id := read()["id"].(string)
+	nack := []byte(`{"action":"nack","topic":"orders","id":"` + id + `","reason":"transient"}`)
+	for attempt := 2; attempt <= 3; attempt++ {
+		pubsub.HandleRecvdMessage(client, 1, nack)
+		assert.Equal(t, id, read()["id"], "A transient failure is retried")
+	}
+	pubsub.HandleRecvdMessage(client, 1, nack)
+
+	deadLetter := readDeadLetter()
+	assert.Equal(t, DEAD_LETTER, deadLetter["action"])
+	assert.Equal(t, "orders", deadLetter["topic"])
+	assert.Equal(t, id, deadLetter["id"])
+	assert.Equal(t, nackTransient, deadLetter["reason"])
+	assert.Equal(t, 3.0, deadLetter["attempts"], "Messages are dead-lettered after the maximum number of deliveries")
+	assert.Equal(t, map[string]interface{}{"id": 1.0}, deadLetter["message"])
+}
+
+func TestDecodeFailuresAreDeadLetteredAtOnce(t *testing.T) {
+	pubsub, readDeadLetter := newQoSPubSub(t, RedeliveryPolicy{})
+	client, read := subscribeQoS1(t, pubsub, "orders")
+
+	pubsub.Publish("orders", []byte(`{"id":1}`), nil)
+	id := read()["id"].(string)
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"nack","topic":"orders","id":"`+id+`","reason":"decode_failure"}`))
+	deadLetter := readDeadLetter()
+	assert.Equal(t, nackDecodeFailure, deadLetter["reason"])
+	assert.Equal(t, 1.0, deadLetter["attempts"])
+
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"nack","topic":"orders","id":"`+id+`"}`))
+	assert.Equal(t, "unknown_delivery", read()["code"], "A message no longer waiting cannot be refused")
+}
+
+func TestDeadLetterTopicIsForAdministrators(t *testing.T) {
+	pubsub := &PubSub{}
+	client, peer := newTestClient(t)
+	client.Claims = jwt.MapClaims{permissionsClaim: []interface{}{PermissionSubscribe, PermissionPublish}}
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"$deadletter"}`))
+	assert.JSONEq(t, string(forbiddenMessage(SUBSCRIBE, deadLetterTopic)), string(mustRead(t, peer)))
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"publish","topic":"$deadletter","message":"fake"}`))
+	assert.JSONEq(t, string(forbiddenMessage(PUBLISH, deadLetterTopic)), string(mustRead(t, peer)))
+
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"orders","qos":2}`))
+	assert.JSONEq(t, string(errorMessage("invalid_qos", "orders")), string(mustRead(t, peer)))
+}
+
+func TestDeadLetterTopicRefusesClientsWithoutPermissions(t *testing.T) {
+	pubsub := &PubSub{}
+	for name, claims := range map[string]jwt.MapClaims{"anonymous": nil, "token without permissions": {"sub": "alice"}} {
+		client, peer := newTestClient(t)
+		client.Claims = claims
+		pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"$deadletter"}`))
+		assert.JSONEq(t, string(forbiddenMessage(SUBSCRIBE, deadLetterTopic)), string(mustRead(t, peer)), name)
+	}
+	assert.Empty(t, pubsub.GetSubscriptions(deadLetterTopic, nil))
+
+	admin, _ := newTestClient(t)
+	admin.Claims = jwt.MapClaims{permissionsClaim: []interface{}{PermissionSubscribe, PermissionAdmin}}
+	pubsub.HandleRecvdMessage(admin, 1, []byte(`{"action":"subscribe","topic":"$deadletter"}`))
+	assert.Len(t, pubsub.GetSubscriptions(deadLetterTopic, nil), 1)
+}
+
+func TestRedeliveryDelay(t *testing.T) {
+	policy := RedeliveryPolicy{Backoff: time.Second, MaxBackoff: 5 * time.Second}.withDefaults()
+	assert.Equal(t, time.Second, policy.delay(1))
+	assert.Equal(t, 2*time.Second, policy.delay(2))
+	assert.Equal(t, 4*time.Second, policy.delay(3))
+	assert.Equal(t, 5*time.Second, policy.delay(4))
+	assert.Equal(t, defaultMaxDeliveries, policy.MaxDeliveries)
+}
@@ -0,0 +1,659 @@
+// This file answers ad-hoc questions about the broker with a small SQL-like language
+// over virtual tables built from a snapshot of its state, e.g.
+//
+//	SELECT id, principal FROM clients WHERE tenant = 'acme' AND subscriptions > 100 AND idle_seconds > 3600 ORDER BY subscriptions DESC LIMIT 10
+//
+// The tables are clients, subscriptions, topics and sessions. WHERE combines
+// comparisons (=, !=, <, <=, >, >= and LIKE with the % and _ wildcards) with AND, OR,
+// NOT and parentheses. Times are RFC 3339 strings in UTC, so they compare as text.
+// Connections record when they were opened and last active for the sessions table.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Session records when a connection was opened and when its client was last active.
+type Session struct {
+	RemoteAddr  string
+	ConnectedAt time.Time
+	// Unix time in nanoseconds of the last frame or packet received
+	lastActive atomic.Int64
+	// Unix time in nanoseconds of the last message sent to the client
+	lastSent atomic.Int64
+	// Capture of the frames of the connection, if an operator started one
+	debug atomic.Pointer[debugCapture]
+	// Topic the binary frames of the connection are published to, if bound
+	bound atomic.Pointer[string]
+	// Version of the protocol the connection speaks, 0 for v1
+	version atomic.Int32
+	// The client sent a frame other than hello, so its version can no longer change
+	versionFixed atomic.Bool
+	// Token resuming the session once the connection drops, if the server issues them
+	resumeToken string
+	// The connection resumed an earlier session
+	resumed bool
+}
+
+// Function to start the session of a connection.
+// Parameters:
+// remoteAddr: string - The address of the client.
+// Returns:
+// *Session - The session, active now.
+func NewSession(remoteAddr string) *Session {
+	session := &Session{RemoteAddr: remoteAddr, ConnectedAt: time.Now().UTC()}
+	session.lastActive.Store(session.ConnectedAt.UnixNano())
+	session.lastSent.Store(session.ConnectedAt.UnixNano())
+	return session
+}
+
+// Function to record that the client of a session sent something.
+func (s *Session) Touch() {
+	if s != nil {
+		s.lastActive.Store(time.Now().UnixNano())
+	}
+}
+
+// Function to get when the client of a session last sent something.
+// Returns:
+// time.Time - The time, in UTC.
+func (s *Session) LastActive() time.Time {
+	return time.Unix(0, s.lastActive.Load()).UTC()
+}
+
+// QueryResult is the answer to a query: the selected columns and one row of values per
+// matching record.
+type QueryResult struct {
+	Columns []string `json:"columns"`
+	Rows    [][]any  `json:"rows"`
+}
+
+// A record of a virtual table. Values are strings, float64, bool or nil.
+type queryRow map[string]any
+
+// The columns of each virtual table, in the order SELECT * returns them
+var queryTables = map[string][]string{
+	"clients":       {"id", "principal", "tenant", "name", "transport", "subscriptions", "queued", "dropped", "connected_at", "idle_seconds"},
+	"subscriptions": {"client_id", "principal", "tenant", "topic", "envelope", "stats"},
+	"topics":        {"name", "owner", "private", "capacity", "subscribers", "waiting", "created_at", "expires_at"},
+	"sessions":      {"client_id", "principal", "tenant", "transport", "remote_addr", "connected_at", "last_active", "idle_seconds"},
+}
+
+// Query is a parsed query.
+type Query struct {
+	Columns []string
+	Table   string
+	Where   queryExpr
+	OrderBy []queryOrder
+	// Maximum number of rows, or -1 for all of them
+	Limit int
+}
+
+// A column rows are sorted by
+type queryOrder struct {
+	Column string
+	Desc   bool
+}
+
+// A condition of a WHERE clause
+type queryExpr interface {
+	eval(row queryRow) bool
+}
+
+type andExpr struct{ left, right queryExpr }
+type orExpr struct{ left, right queryExpr }
+type notExpr struct{ expr queryExpr }
+
+// Operators comparing a column with a literal, besides LIKE
+var comparisonOperators = map[string]bool{"=": true, "!=": true, "<>": true, "<": true, "<=": true, ">": true, ">=": true}
+
+// A comparison of a column with a literal
+type comparisonExpr struct {
+	column string
+	op     string
+	value  any
+	like   *regexp.Regexp
+}
+
+func (e andExpr) eval(row queryRow) bool { return e.left.eval(row) && e.right.eval(row) }
+func (e orExpr) eval(row queryRow) bool  { return e.left.eval(row) || e.right.eval(row) }
+func (e notExpr) eval(row queryRow) bool { return !e.expr.eval(row) }
+
+// Like in SQL, comparing a missing value or values of different types is never true.
+func (e comparisonExpr) eval(row queryRow) bool {
+	value := row[e.column]
+	if e.like != nil {
+		text, ok := value.(string)
+		return ok && e.like.MatchString(text)
+	}
+	order, ok := compareQueryValues(value, e.value)
+	if !ok {
+		return false
+	}
+	switch e.op {
+	case "=":
+		return order == 0
+	case "!=", "<>":
+		return order != 0
+	case "<":
+		return order < 0
+	case "<=":
+		return order <= 0
+	case ">":
+		return order > 0
+	default:
+		return order >= 0
+	}
+}
+
+// Function to compare two values of a row.
+// Parameters:
+// a: any - The first value.
+// b: any - The second value.
+// Returns:
+// int - Negative, zero or positive as a is less than, equal to or greater than b.
+// bool - False if either value is missing or they are of different types.
+func compareQueryValues(a any, b any) (int, bool) {
+	switch a := a.(type) {
+	case string:
+		if b, ok := b.(string); ok {
+			return strings.Compare(a, b), true
+		}
+	case float64:
+		if b, ok := b.(float64); ok {
+			switch {
+			case a < b:
+				return -1, true
+			case a > b:
+				return 1, true
+			}
+			return 0, true
+		}
+	case bool:
+		if b, ok := b.(bool); ok {
+			switch {
+			case a == b:
+				return 0, true
+			case !a:
+				return -1, true
+			}
+			return 1, true
+		}
+	}
+	return 0, false
+}
+
+// A token of a query
+type queryToken struct {
+	kind byte // 'i'dentifier, 'n'umber, 's'tring, 'o'perator or symbol, or 0 at the end
+	text string
+}
+
+// Function to split a query into tokens.
+// Parameters:
+// input: string - The query.
+// Returns:
+// []queryToken - The tokens, ending with an end token.
+// error - An error if the query contains an unexpected character or an unterminated string.
+func tokenizeQuery(input string) ([]queryToken, error) {
+	var tokens []queryToken
+	for i := 0; i < len(input); {
+		c := input[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z'):
+			start := i
+			for i < len(input) && (input[i] == '_' || ('a' <= input[i] && input[i] <= 'z') || ('A' <= input[i] && input[i] <= 'Z') || ('0' <= input[i] && input[i] <= '9')) {
+				i++
+			}
+			tokens = append(tokens, queryToken{'i', input[start:i]})
+		case ('0' <= c && c <= '9') || c == '-' || c == '.':
+			start := i
+			i++
+			for i < len(input) && (('0' <= input[i] && input[i] <= '9') || input[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, queryToken{'n', input[start:i]})
+		case c == '\'':
+			// Quotes are escaped by doubling them, as in SQL
+			var text strings.Builder
+			for i++; ; i++ {
+				if i >= len(input) {
+					return nil, fmt.Errorf("unterminated string")
+				}
+				if input[i] == '\'' {
+					if i+1 < len(input) && input[i+1] == '\'' {
+						i++
+					} else {
+						i++
+						break
+					}
+				}
+				text.WriteByte(input[i])
+			}
+			tokens = append(tokens, queryToken{'s', text.String()})
+		case strings.HasPrefix(input[i:], "!=") || strings.HasPrefix(input[i:], "<>") || strings.HasPrefix(input[i:], "<=") || strings.HasPrefix(input[i:], ">="):
+			tokens = append(tokens, queryToken{'o', input[i : i+2]})
+			i += 2
+		case strings.ContainsRune("=<>*,()", rune(c)):
+			tokens = append(tokens, queryToken{'o', input[i : i+1]})
+			i++
+		default:
+			return nil, fmt.Errorf("unexpected character %q", c)
+		}
+	}
+	return append(tokens, queryToken{}), nil
+}
+
+// A parser of the tokens of a query
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+}
+
+func (p *queryParser) peek() queryToken { return p.tokens[p.pos] }
+
+func (p *queryParser) next() queryToken {
+	token := p.tokens[p.pos]
+	if token.kind != 0 {
+		p.pos++
+	}
+	return token
+}
+
+// Function to consume a keyword if it is the next token.
+// Parameters:
+// keyword: string - The keyword, in upper case.
+// Returns:
+// bool - True if the keyword was consumed.
+func (p *queryParser) accept(keyword string) bool {
+	token := p.peek()
+	if (token.kind == 'i' || token.kind == 'o') && strings.EqualFold(token.text, keyword) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// Function to consume a keyword that must come next.
+// Parameters:
+// keyword: string - The keyword, in upper case.
+// Returns:
+// error - An error if the next token is something else.
+func (p *queryParser) expect(keyword string) error {
+	if !p.accept(keyword) {
+		return fmt.Errorf("expected %s, found %s", keyword, p.describe())
+	}
+	return nil
+}
+
+// Function to describe the next token in error messages.
+// Returns:
+// string - The token, or "end of query".
+func (p *queryParser) describe() string {
+	if token := p.peek(); token.kind != 0 {
+		return strconv.Quote(token.text)
+	}
+	return "end of query"
+}
+
+// Function to consume a column of the table.
+// Parameters:
+// columns: []string - The columns of the table.
+// Returns:
+// string - The column, in lower case.
+// error - An error if the next token is not a column of the table.
+func (p *queryParser) column(columns []string) (string, error) {
+	token := p.next()
+	if token.kind != 'i' {
+		return "", fmt.Errorf("expected a column, found %q", token.text)
+	}
+	name := strings.ToLower(token.text)
+	for _, column := range columns {
+		if column == name {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("unknown column %q, expected one of %s", token.text, strings.Join(columns, ", "))
+}
+
+// Function to parse a query.
+// Parameters:
+// text: string - The query.
+// Returns:
+// Query - The parsed query.
+// error - An error if the query is malformed or names an unknown table or column.
+func ParseQuery(text string) (Query, error) {
+	tokens, err := tokenizeQuery(text)
+	if err != nil {
+		return Query{}, err
+	}
+	p := &queryParser{tokens: tokens}
+	query := Query{Limit: -1}
+
+	if err := p.expect("SELECT"); err != nil {
+		return Query{}, err
+	}
+	// The columns are checked once the table is known
+	var selected []queryToken
+	if !p.accept("*") {
+		for {
+			selected = append(selected, p.next())
+			if !p.accept(",") {
+				break
+			}
+		}
+	}
+	if err := p.expect("FROM"); err != nil {
+		return Query{}, err
+	}
+	query.Table = strings.ToLower(p.next().text)
+	columns, ok := queryTables[query.Table]
+	if !ok {
+		return Query{}, fmt.Errorf("unknown table %q, expected clients, subscriptions, topics or sessions", query.Table)
+	}
+	query.Columns = columns
+	if selected != nil {
+		query.Columns = nil
+		for _, token := range selected {
+			column, err := (&queryParser{tokens: []queryToken{token, {}}}).column(columns)
+			if err != nil {
+				return Query{}, err
+			}
+			query.Columns = append(query.Columns, column)
+		}
+	}
+
+	if p.accept("WHERE") {
+		if query.Where, err = p.or(columns); err != nil {
+			return Query{}, err
+		}
+	}
+	if p.accept("ORDER") {
+		if err := p.expect("BY"); err != nil {
+			return Query{}, err
+		}
+		for {
+			column, err := p.column(columns)
+			if err != nil {
+				return Query{}, err
+			}
+			order := queryOrder{Column: column, Desc: p.accept("DESC")}
+			if !order.Desc {
+				p.accept("ASC")
+			}
+			query.OrderBy = append(query.OrderBy, order)
+			if !p.accept(",") {
+				break
+			}
+		}
+	}
+	if p.accept("LIMIT") {
+		token := p.next()
+		limit, err := strconv.Atoi(token.text)
+		if token.kind != 'n' || err != nil || limit < 0 {
+			return Query{}, fmt.Errorf("expected a row count after LIMIT, found %q", token.text)
+		}
+		query.Limit = limit
+	}
+	if p.peek().kind != 0 {
+		return Query{}, fmt.Errorf("unexpected %s", p.describe())
+	}
+	return query, nil
+}
+
+// Function to parse conditions combined with OR.
+func (p *queryParser) or(columns []string) (queryExpr, error) {
+	left, err := p.and(columns)
+	for err == nil && p.accept("OR") {
+		var right queryExpr
+		if right, err = p.and(columns); err == nil {
+			left = orExpr{left, right}
+		}
+	}
+	return left, err
+}
+
+// Function to parse conditions combined with AND, which binds tighter than OR.
+func (p *queryParser) and(columns []string) (queryExpr, error) {
+	left, err := p.not(columns)
+	for err == nil && p.accept("AND") {
+		var right queryExpr
+		if right, err = p.not(columns); err == nil {
+			left = andExpr{left, right}
+		}
+	}
+	return left, err
+}
+
+// Function to parse a negated condition, a condition in parentheses or a comparison.
+func (p *queryParser) not(columns []string) (queryExpr, error) {
+	if p.accept("NOT") {
+		expr, err := p.not(columns)
+		return notExpr{expr}, err
+	}
+	if p.accept("(") {
+		expr, err := p.or(columns)
+		if err == nil {
+			err = p.expect(")")
+		}
+		return expr, err
+	}
+
+	column, err := p.column(columns)
+	if err != nil {
+		return nil, err
+	}
+	op := p.next()
+	switch {
+	case op.kind == 'i' && strings.EqualFold(op.text, "LIKE"):
+		pattern := p.next()
+		if pattern.kind != 's' {
+			return nil, fmt.Errorf("expected a string after LIKE, found %q", pattern.text)
+		}
+		like := regexp.QuoteMeta(pattern.text)
+		like = strings.NewReplacer("%", ".*", "_", ".").Replace(like)
+		return comparisonExpr{column: column, op: "LIKE", like: regexp.MustCompile("^(?s:" + like + ")$")}, nil
+	case op.kind == 'o' && comparisonOperators[op.text]:
+	default:
+		return nil, fmt.Errorf("expected a comparison after %s, found %q", column, op.text)
+	}
+
+	literal := p.next()
+	var value any
+	switch {
+	case literal.kind == 's':
+		value = literal.text
+	case literal.kind == 'n':
+		number, err := strconv.ParseFloat(literal.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", literal.text)
+		}
+		value = number
+	case literal.kind == 'i' && strings.EqualFold(literal.text, "TRUE"):
+		value = true
+	case literal.kind == 'i' && strings.EqualFold(literal.text, "FALSE"):
+		value = false
+	default:
+		return nil, fmt.Errorf("expected a string, number, TRUE or FALSE, found %q", literal.text)
+	}
+	return comparisonExpr{column: column, op: op.text, value: value}, nil
+}
+
+// Function to format a time for a row.
+// Parameters:
+// t: *time.Time - The time, or nil.
+// Returns:
+// any - The RFC 3339 time in UTC, or nil.
+func queryTime(t *time.Time) any {
+	if t == nil || t.IsZero() {
+		return nil
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// Function to format an optional string for a row.
+// Parameters:
+// s: string - The string.
+// Returns:
+// any - The string, or nil when it is empty.
+func queryString(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// Function to build the rows of a virtual table.
+// Parameters:
+// table: string - The table.
+// now: time.Time - The time idle durations are measured at.
+// Returns:
+// []queryRow - The rows.
+func (ps *PubSub) queryRows(table string, now time.Time) []queryRow {
+	var rows []queryRow
+	switch table {
+	case "clients":
+		for _, info := range ps.ClientInfos() {
+			row := queryRow{
+				"id":            info.Id,
+				"principal":     queryString(info.Principal),
+				"tenant":        queryString(info.Tenant),
+				"name":          queryString(info.Name),
+				"transport":     info.Transport,
+				"subscriptions": float64(len(info.Subscriptions)),
+				"queued":        float64(info.Queued),
+				"dropped":       float64(info.Dropped),
+				"connected_at":  queryTime(info.ConnectedAt),
+				"idle_seconds":  nil,
+			}
+			if info.LastActive != nil {
+				row["idle_seconds"] = now.Sub(*info.LastActive).Seconds()
+			}
+			rows = append(rows, row)
+		}
+	case "sessions":
+		for _, info := range ps.ClientInfos() {
+			if info.ConnectedAt == nil {
+				continue
+			}
+			rows = append(rows, queryRow{
+				"client_id":    info.Id,
+				"principal":    queryString(info.Principal),
+				"tenant":       queryString(info.Tenant),
+				"transport":    info.Transport,
+				"remote_addr":  queryString(info.RemoteAddr),
+				"connected_at": queryTime(info.ConnectedAt),
+				"last_active":  queryTime(info.LastActive),
+				"idle_seconds": now.Sub(*info.LastActive).Seconds(),
+			})
+		}
+	case "subscriptions":
+		for _, sub := range ps.Subscriptions() {
+			rows = append(rows, queryRow{
+				"client_id": sub.Client.Id,
+				"principal": queryString(sub.Client.Principal()),
+				"tenant":    queryString(sub.Client.Tenant()),
+				"topic":     sub.Topic,
+				"envelope":  sub.Envelope,
+				"stats":     sub.Stats != nil,
+			})
+		}
+	case "topics":
+		for _, info := range ps.TopicInfos() {
+			rows = append(rows, queryRow{
+				"name":        info.Name,
+				"owner":       queryString(info.Owner),
+				"private":     info.Policy.Private,
+				"capacity":    float64(info.Policy.Capacity),
+				"subscribers": float64(info.Subscribers),
+				"waiting":     float64(info.Waiting),
+				"created_at":  queryTime(info.CreatedAt),
+				"expires_at":  queryTime(info.Policy.ExpiresAt),
+			})
+		}
+	}
+	return rows
+}
+
+// Function to run a query over a snapshot of the broker.
+// Parameters:
+// text: string - The query.
+// now: time.Time - The time idle durations are measured at.
+// Returns:
+// QueryResult - The selected columns of the matching rows.
+// error - An error if the query is invalid.
+func (ps *PubSub) Query(text string, now time.Time) (QueryResult, error) {
+	query, err := ParseQuery(text)
+	if err != nil {
+		return QueryResult{}, err
+	}
+
+	var rows []queryRow
+	for _, row := range ps.queryRows(query.Table, now) {
+		if query.Where == nil || query.Where.eval(row) {
+			rows = append(rows, row)
+		}
+	}
+	// Missing values sort first, as the smallest values
+	sort.SliceStable(rows, func(i, j int) bool {
+		for _, order := range query.OrderBy {
+			a, b := rows[i][order.Column], rows[j][order.Column]
+			if a == nil || b == nil {
+				if (a == nil) != (b == nil) {
+					return (a == nil) != order.Desc
+				}
+				continue
+			}
+			if c, ok := compareQueryValues(a, b); ok && c != 0 {
+				return (c < 0) != order.Desc
+			}
+		}
+		return false
+	})
+	if query.Limit >= 0 && len(rows) > query.Limit {
+		rows = rows[:query.Limit]
+	}
+
+	result := QueryResult{Columns: query.Columns, Rows: make([][]any, 0, len(rows))}
+	for _, row := range rows {
+		values := make([]any, len(query.Columns))
+		for i, column := range query.Columns {
+			values[i] = row[column]
+		}
+		result.Rows = append(result.Rows, values)
+	}
+	return result, nil
+}
+
+// Function to register the admin endpoint running queries, called with a body such as
+// {"query": "SELECT * FROM topics"}.
+// Parameters:
+// mux: *http.ServeMux - The mux to register the route on.
+// pubsub: *PubSub - The PubSub the route serves.
+func setupQueryRoutes(mux *http.ServeMux, pubsub *PubSub) {
+	mux.HandleFunc("POST /admin/query", pubsub.requireAPIKey(PermissionAdmin, func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Query string `json:"query"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Query == "" {
+			http.Error(w, "expected {\"query\": \"SELECT ... FROM ...\"}", http.StatusBadRequest)
+			return
+		}
+		result, err := pubsub.Query(request.Query, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, result)
+	}))
+}
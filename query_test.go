@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseQuery(t *testing.T) {
+	query, err := ParseQuery("select id, tenant from CLIENTS where tenant = 'acme' and (subscriptions > 100 or not idle_seconds <= 3600) order by subscriptions desc, id limit 5")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"id", "tenant"}, query.Columns)
+	assert.Equal(t, "clients", query.Table)
+	assert.Equal(t, []queryOrder{{"subscriptions", true}, {"id", false}}, query.OrderBy)
+	assert.Equal(t, 5, query.Limit)
+
+	query, err = ParseQuery("SELECT * FROM topics")
+	assert.NoError(t, err)
+	assert.Equal(t, queryTables["topics"], query.Columns)
+	assert.Equal(t, -1, query.Limit)
+
+	for text, reason := range map[string]string{
+		"SELECT * FROM users":                          "unknown table",
+		"SELECT password FROM clients":                 "unknown column",
+		"SELECT * FROM clients WHERE owner = 'x'":      "unknown column",
+		"SELECT * FROM clients WHERE id = 'x":          "unterminated string",
+		"SELECT * FROM clients WHERE id LIKE 5":        "expected a string after LIKE",
+		"SELECT * FROM clients WHERE (id = 'x'":        "expected )",
+		"SELECT * FROM clients LIMIT -1":               "expected a row count",
+		"SELECT * FROM clients; DROP TABLE clients":    "unexpected character",
+		"SELECT * FROM clients WHERE id = 'x' tenant":  "unexpected",
+		"DELETE FROM clients":                          "expected SELECT",
+		"SELECT * FROM clients WHERE subscriptions 10": "expected a comparison",
+	} {
+		_, err := ParseQuery(text)
+		if assert.Error(t, err, text) {
+			assert.Contains(t, err.Error(), reason, text)
+		}
+	}
+}
+
+func TestQueryTables(t *testing.T) {
+	pubsub := &PubSub{}
+	busy := Client{Id: "c1", Claims: jwt.MapClaims{"sub": "alice", tenantClaim: "acme"}, Session: NewSession("10.0.0.1:5000")}
+	busy.Session.lastActive.Store(time.Now().Add(-2 * time.Hour).UnixNano())
+	quiet := Client{Id: "c2", Claims: jwt.MapClaims{"sub": "bob", tenantClaim: "acme"}, Session: NewSession("10.0.0.2:5000")}
+	other := Client{Id: "c3", Claims: jwt.MapClaims{"sub": "carol", tenantClaim: "globex"}, Session: NewSession("10.0.0.3:5000")}
+	for _, client := range []Client{busy, quiet, other} {
+		pubsub.AddClient(client)
+	}
+	for _, topic := range []string{"news", "sports", "weather"} {
+		pubsub.Subscribe(&busy, topic)
+	}
+	pubsub.Subscribe(&quiet, "news")
+	pubsub.Subscribe(&other, "news")
+
+	rows := func(text string) [][]any {
+		result, err := pubsub.Query(text, time.Now())
+		assert.NoError(t, err, text)
+		return result.Rows
+	}
+	assert.Equal(t, [][]any{{"c1", 3.0}},
+		rows("SELECT id, subscriptions FROM clients WHERE tenant = 'acme' AND subscriptions > 1 AND idle_seconds > 3600"))
+	assert.Equal(t, [][]any{{"c1"}, {"c3"}, {"c2"}},
+		rows("SELECT id FROM clients ORDER BY subscriptions DESC, principal DESC"))
+	assert.Equal(t, [][]any{{"c3"}}, rows("SELECT id FROM clients WHERE NOT tenant = 'acme'"))
+	assert.Equal(t, [][]any{{"c1"}, {"c2"}}, rows("SELECT id FROM clients WHERE principal LIKE '_l%' OR principal LIKE 'b%' ORDER BY id"))
+	assert.Equal(t, [][]any{}, rows("SELECT id FROM clients WHERE name = 'Alice'"), "Comparing a missing value should never match")
+	assert.Equal(t, [][]any{{"c1", "10.0.0.1:5000"}}, rows("SELECT client_id, remote_addr FROM sessions ORDER BY idle_seconds DESC LIMIT 1"))
+	assert.Equal(t, [][]any{{"news", 3.0}, {"sports", 1.0}}, rows("SELECT name, subscribers FROM topics WHERE subscribers >= 1 ORDER BY subscribers DESC, name LIMIT 2"))
+	assert.Equal(t, [][]any{{"c1", "acme"}}, rows("SELECT client_id, tenant FROM subscriptions WHERE topic = 'weather'"))
+
+	_, err := pubsub.Query("SELECT * FROM nothing", time.Now())
+	assert.Error(t, err)
+}
+
+func TestQueryRoute(t *testing.T) {
+	keys := NewAPIKeyStore()
+	isolatePubSub(t).apiKeys = keys
+	keys.Add("admin-secret", "ops", []string{PermissionAdmin})
+	keys.Add("reader", "dashboard", []string{PermissionSubscribe})
+	mux := http.NewServeMux()
+	setupQueryRoutes(mux, ps)
+
+	post := func(body string, key string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodPost, "/admin/query", strings.NewReader(body))
+		request.Header.Set(apiKeyHeader, key)
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, request)
+		return recorder
+	}
+	assert.Equal(t, http.StatusForbidden, post(`{"query": "SELECT * FROM topics"}`, "reader").Code)
+
+	response := post(`{"query": "SELECT name, private FROM topics WHERE name = 'no such topic'"}`, "admin-secret")
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.JSONEq(t, `{"columns": ["name", "private"], "rows": []}`, response.Body.String())
+
+	response = post(`{"query": "SELECT * FROM users"}`, "admin-secret")
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	assert.Contains(t, response.Body.String(), "unknown table")
+	assert.Equal(t, http.StatusBadRequest, post(`{}`, "admin-secret").Code)
+}
@@ -0,0 +1,135 @@
+// This file limits how fast each client may send messages, with a token bucket per
+// connection refilled at the rate limit of the client and holding up to its burst. A
+// frame arriving when the bucket is empty is dropped and answered with a rate_limited
+// error frame telling the client when to retry. A client whose frames keep being
+// dropped, for the strikes in a row, is disconnected with the rate_limited close code.
+// The rate and burst are set for every client with RATE_LIMIT and RATE_BURST, and per
+// identity by the limits claim of its token. MQTT clients have no token nor error frame:
+// only their PUBLISH packets are limited, dropped ones are not acknowledged, and clients
+// that keep sending them have their connection closed.
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Frames dropped in a row before a client over its rate limit is disconnected, by default
+const defaultRateLimitStrikes = 20
+
+var rateLimitDisconnects = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "gowebsockets_rate_limit_disconnects_total",
+	Help: "Number of clients disconnected for sending over their rate limit.",
+})
+
+// A token bucket limiting the frames of a connection. It is only used by the goroutine
+// reading the connection, so it has no lock.
+type rateLimiter struct {
+	rate    float64
+	burst   float64
+	tokens  float64
+	updated time.Time
+	// Frames dropped since the last one that was let through
+	strikes int
+}
+
+// Function to create the rate limiter of a client.
+// Parameters:
+// limits: Limits - The limits of the client; a burst of 0 or less allows one second of messages.
+// Returns:
+// *rateLimiter - The limiter, full, or nil if the client has no rate limit.
+func newRateLimiter(limits Limits) *rateLimiter {
+	if limits.RateLimit <= 0 {
+		return nil
+	}
+	burst := float64(limits.RateBurst)
+	if burst <= 0 {
+		burst = math.Max(1, math.Ceil(limits.RateLimit))
+	}
+	return &rateLimiter{rate: limits.RateLimit, burst: burst, tokens: burst, updated: time.Now()}
+}
+
+// Function to take a token from the bucket.
+// Parameters:
+// now: time.Time - The time the frame arrived.
+// Returns:
+// bool - True if there was a token.
+// time.Duration - How long until the next token, if there was none.
+func (l *rateLimiter) allow(now time.Time) (bool, time.Duration) {
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.updated).Seconds()*l.rate)
+	l.updated = now
+	if l.tokens >= 1 {
+		l.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+}
+
+// Function to check a frame of a client against its rate limit. Dropped frames are
+// answered with a rate_limited error frame, and the client is closed once it reaches the
+// strikes in a row.
+// Parameters:
+// client: *Client - The client that sent the frame.
+// now: time.Time - The time the frame arrived.
+// Returns:
+// bool - True if the frame may be handled.
+// bool - True if the client was closed.
+func (l *rateLimiter) admit(client *Client, now time.Time) (bool, bool) {
+	admitted, disconnect, retryAfter := l.check(client, now)
+	if disconnect {
+		client.Close(ReasonRateLimited)
+		return false, true
+	}
+	if !admitted {
+		client.Send(rateLimitedMessage(retryAfter))
+	}
+	return admitted, false
+}
+
+// Function to check a frame of a client against its rate limit without answering it, for
+// protocols with no error frame to answer with. Dropped frames and disconnects are logged
+// and counted.
+// Parameters:
+// client: *Client - The client that sent the frame.
+// now: time.Time - The time the frame arrived.
+// Returns:
+// bool - True if the frame may be handled.
+// bool - True if the client reached the strikes in a row and must be disconnected.
+// time.Duration - How long until the client may send again, if the frame was dropped.
+func (l *rateLimiter) check(client *Client, now time.Time) (bool, bool, time.Duration) {
+	if l == nil {
+		return true, false, 0
+	}
+	allowed, retryAfter := l.allow(now)
+	if allowed {
+		l.strikes = 0
+		return true, false, 0
+	}
+	l.strikes++
+	if strikes := client.options().rateLimitStrikes; strikes > 0 && l.strikes >= strikes {
+		client.logger().Info("Disconnecting client sending over its rate limit", "rate_limit", l.rate, "strikes", l.strikes)
+		rateLimitDisconnects.Inc()
+		return false, true, retryAfter
+	}
+	rejectedFrames.WithLabelValues(string(ReasonRateLimited)).Inc()
+	return false, false, retryAfter
+}
+
+// Function to build the frame telling a client a frame was dropped because it sends
+// faster than its rate limit.
+// Parameters:
+// retryAfter: time.Duration - How long until the client may send again.
+// Returns:
+// []byte - The JSON encoded frame.
+func rateLimitedMessage(retryAfter time.Duration) []byte {
+	message, _ := json.Marshal(map[string]interface{}{
+		"action":       "error",
+		"code":         "rate_limited",
+		"retryAfterMs": int64(math.Ceil(float64(retryAfter) / float64(time.Millisecond))),
+	})
+	return message
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiterRefillsAtItsRate(t *testing.T) {
+	assert.Nil(t, newRateLimiter(Limits{}), "Clients without a rate limit have no limiter")
+	assert.Equal(t, float64(3), newRateLimiter(Limits{RateLimit: 2.5}).burst, "The burst defaults to one second of messages")
+
+	limiter := newRateLimiter(Limits{RateLimit: 10, RateBurst: 2})
+	now := limiter.updated
+	for i := 0; i < 2; i++ {
+		allowed, _ := limiter.allow(now)
+		assert.True(t, allowed, "The burst is allowed at once")
+	}
+	allowed, retryAfter := limiter.allow(now)
+	assert.False(t, allowed)
+	assert.Equal(t, 100*time.Millisecond, retryAfter)
+	allowed, _ = limiter.allow(now.Add(100 * time.Millisecond))
+	assert.True(t, allowed, "A token is added every 1/rate seconds")
+	allowed, _ = limiter.allow(now.Add(time.Hour))
+	assert.True(t, allowed)
+	assert.Equal(t, float64(1), limiter.tokens, "The bucket holds at most the burst")
+}
+
+func TestRateLimitFromTokenClaim(t *testing.T) {
+	options := newServerOptions()
+	options.defaultLimits = Limits{RateLimit: 10, RateBurst: 20}
+	limits := options.limitsFor(jwt.MapClaims{limitsClaim: map[string]interface{}{"rateLimit": 100}})
+	assert.Equal(t, float64(100), limits.RateLimit, "Tokens override the rate limit of their identity")
+	assert.Equal(t, 20, limits.RateBurst)
+}
+
+func TestRateLimitedWebSocketClientIsThrottledThenDisconnected(t *testing.T) {
+	options := isolatePubSub(t)
+	options.defaultLimits = Limits{RateLimit: 0.01, RateBurst: 1}
+	options.rateLimitStrikes = 3
+	server := httptest.NewServer(http.HandlerFunc(ps.webSocketHandler))
+	t.Cleanup(server.Close)
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+server.URL[4:], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	readFrame(t, ws)
+
+	// The first frame is allowed, the second dropped
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, ws.WriteMessage(websocket.TextMessage, []byte(`{"action":"ping"}`)))
+	}
+	for {
+		var frame map[string]interface{}
+		json.Unmarshal(mustRead(t, ws), &frame)
+		if t.Failed() {
+			return
+		}
+		if frame["code"] == "rate_limited" {
+			assert.Greater(t, frame["retryAfterMs"], float64(0))
+			break
+		}
+	}
+
+	// and the third in a row over the limit closes the client
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, ws.WriteMessage(websocket.TextMessage, []byte(`{"action":"ping"}`)))
+	}
+	for {
+		if _, _, err := ws.ReadMessage(); err != nil {
+			assert.True(t, websocket.IsCloseError(err, CloseRateLimited), "Clients over their limit for the strikes in a row are closed, got %v", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,116 @@
+// This file re-authorizes the subscribers of topics whose policy asks for it, every
+// reauthorizeInterval seconds or whenever the ACL, the policy or the grants of the topic
+// change, so clients no longer allowed to subscribe are unsubscribed instead of keeping
+// what they were allowed when they subscribed.
+package main
+
+import (
+	"time"
+)
+
+// Reason of the unsubscribed frame of a subscriber that is no longer allowed to subscribe
+const reasonUnauthorized = "unauthorized"
+
+// Function to check whether the client of a subscription is still allowed to subscribe.
+// Subscribers admitted by an invitation stay admitted by the topic. The caller must hold ps.mu.
+// Parameters:
+// sub: Subscription - The subscription.
+// Returns:
+// bool - True if the client's permissions, the ACL and the topic still allow the subscription.
+func (ps *PubSub) subscriberAuthorizedLocked(sub Subscription) bool {
+	access := accessTopicOf(sub.Topic)
+	client := sub.Client
+	if !client.HasPermission(PermissionSubscribe) || !client.TopicAllowed(SUBSCRIBE, access) || !ps.aclAllows(client, SUBSCRIBE, access) {
+		return false
+	}
+	if !mayReadReserved(client, access) {
+		return false
+	}
+	topic, ok := ps.Topics[access]
+	return !ok || sub.Invited || topic.allows(client, SUBSCRIBE)
+}
+
+// Function to get the topic deciding who may subscribe to another: a topic decides for
+// its presence topic.
+// Parameters:
+// topic: string - The topic subscribed to.
+// Returns:
+// string - The topic access is checked on.
+func accessTopicOf(topic string) string {
+	if presence, ok := presenceTopicOf(topic); ok {
+		return presence
+	}
+	return topic
+}
+
+// Function to re-authorize the subscribers of a topic and of its presence, unsubscribing
+// those no longer allowed to subscribe with an unsubscribed frame.
+// Parameters:
+// name: string - The name of the topic.
+// Returns:
+// int - The number of subscriptions removed.
+func (ps *PubSub) Reauthorize(name string) int {
+	ps.mu.Lock()
+	var revoked []Subscription
+	for _, sub := range ps.Subscriptions() {
+		if accessTopicOf(sub.Topic) == name && !ps.subscriberAuthorizedLocked(sub) {
+			revoked = append(revoked, sub)
+		}
+	}
+	ps.mu.Unlock()
+
+	for _, sub := range revoked {
+		subscriber := ps.unsubscribe(sub.Client, sub.Topic)
+		if subscriber == nil {
+			continue
+		}
+		subscriber.logger().Info("Unsubscribed client no longer authorized", logKeyTopic, sub.Topic)
+		// Clients of other transports have no frame to receive it in
+		if subscriber.Transport == nil {
+			subscriber.Send(unsubscribedMessage(sub.Topic, reasonUnauthorized))
+		}
+	}
+	return len(revoked)
+}
+
+// Function to re-authorize the subscribers of every topic whose policy asks to be
+// re-authorized on changes, after the ACL changed.
+func (ps *PubSub) reauthorizeChanged() {
+	ps.mu.Lock()
+	var names []string
+	for name, topic := range ps.Topics {
+		if topic.Policy.ReauthorizeOnChange {
+			names = append(names, name)
+		}
+	}
+	ps.mu.Unlock()
+
+	for _, name := range names {
+		ps.Reauthorize(name)
+	}
+}
+
+// Function to schedule the next re-authorization of the subscribers of a topic as its
+// policy sets, replacing any earlier schedule. The caller must hold ps.mu.
+// Parameters:
+// topic: *Topic - The topic.
+func (ps *PubSub) scheduleReauthorizationLocked(topic *Topic) {
+	if topic.reauthorization != nil {
+		topic.reauthorization.Stop()
+		topic.reauthorization = nil
+	}
+	if topic.Policy.ReauthorizeInterval <= 0 {
+		return
+	}
+	name := topic.Name
+	topic.reauthorization = time.AfterFunc(time.Duration(topic.Policy.ReauthorizeInterval)*time.Second, func() {
+		ps.Reauthorize(name)
+
+		ps.mu.Lock()
+		defer ps.mu.Unlock()
+		// Unless the topic was deleted or recreated since
+		if ps.Topics[name] == topic {
+			ps.scheduleReauthorizationLocked(topic)
+		}
+	})
+}
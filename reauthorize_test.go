@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+// subscriptionCount counts the subscriptions of a client to a topic.
+func subscriptionCount(pubsub *PubSub, client *Client, topic string) int {
+	pubsub.mu.Lock()
+	defer pubsub.mu.Unlock()
+	return len(pubsub.GetSubscriptions(topic, client))
+}
+
+func TestReauthorizeWhenGrantIsRevoked(t *testing.T) {
+	pubsub := &PubSub{}
+	assert.NoError(t, pubsub.CreateTopic("room", "alice", TopicPolicy{Private: true, ReauthorizeOnChange: true}))
+	alice, _ := newTestClient(t)
+	alice.Claims = jwt.MapClaims{"sub": "alice"}
+	bob, bobPeer := newTestClient(t)
+	bob.Claims = jwt.MapClaims{"sub": "bob"}
+	assert.NoError(t, pubsub.SetTopicGrant("room", "bob", true))
+
+	pubsub.HandleRecvdMessage(alice, 1, []byte(`{"action":"subscribe","topic":"room"}`))
+	pubsub.HandleRecvdMessage(bob, 1, []byte(`{"action":"subscribe","topic":"room"}`))
+	assert.Len(t, pubsub.GetSubscriptions("room", nil), 2)
+
+	assert.NoError(t, pubsub.SetTopicGrant("room", "bob", false))
+	assert.JSONEq(t, string(unsubscribedMessage("room", reasonUnauthorized)), string(mustRead(t, bobPeer)))
+	assert.Equal(t, 0, subscriptionCount(pubsub, &bob, "room"), "Revoked principals should be unsubscribed")
+	assert.Equal(t, 1, subscriptionCount(pubsub, &alice, "room"), "The owner stays subscribed")
+}
+
+func TestReauthorizeWhenACLChanges(t *testing.T) {
+	pubsub := &PubSub{}
+	assert.NoError(t, pubsub.CreateTopic("watched", "", TopicPolicy{ReauthorizeOnChange: true}))
+	assert.NoError(t, pubsub.CreateTopic("unwatched", "", TopicPolicy{}))
+	client, peer := newTestClient(t)
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"watched"}`))
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"presence:watched"}`))
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"unwatched"}`))
+
+	pubsub.SetACL(&ACL{Rules: []ACLRule{{Identity: "*", Subscribe: []string{"public.*"}}}})
+	defer pubsub.SetACL(nil)
+	assert.Equal(t, 0, subscriptionCount(pubsub, &client, "watched"))
+	assert.Equal(t, 0, subscriptionCount(pubsub, &client, "presence:watched"), "The presence of a topic follows its access")
+	assert.Equal(t, 1, subscriptionCount(pubsub, &client, "unwatched"), "Topics not asking for it keep their subscribers")
+
+	reasons := map[string]string{}
+	for len(reasons) < 2 {
+		frame := readFrame(t, peer)
+		if frame["action"] == UNSUBSCRIBED {
+			reasons[frame["topic"].(string)] = frame["reason"].(string)
+		}
+	}
+	assert.Equal(t, map[string]string{"watched": reasonUnauthorized, "presence:watched": reasonUnauthorized}, reasons)
+}
+
+func TestScheduledReauthorization(t *testing.T) {
+	pubsub := &PubSub{}
+	assert.NoError(t, pubsub.CreateTopic("room", "alice", TopicPolicy{Private: true, ReauthorizeInterval: 1}))
+	bob, _ := newTestClient(t)
+	bob.Claims = jwt.MapClaims{"sub": "bob"}
+	bob.Outbox = NewOutbox(&bob, 8, DisconnectSlowConsumer, SlowStart{})
+	assert.NoError(t, pubsub.SetTopicGrant("room", "bob", true))
+	pubsub.HandleRecvdMessage(bob, 1, []byte(`{"action":"subscribe","topic":"room"}`))
+
+	assert.NoError(t, pubsub.SetTopicGrant("room", "bob", false))
+	assert.Equal(t, 1, subscriptionCount(pubsub, &bob, "room"), "Without reauthorizeOnChange, revoking waits for the schedule")
+	assert.Eventually(t, func() bool { return subscriptionCount(pubsub, &bob, "room") == 0 }, 3*time.Second, 20*time.Millisecond)
+
+	assert.NoError(t, pubsub.DeleteTopic("room"))
+}
@@ -0,0 +1,108 @@
+// This file implements a Redis pub/sub backplane so that several server instances
+// behind a load balancer deliver every publish to all of their clients.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis channel on which all server instances exchange published messages
+const redisChannel = "gowebsockets:publish"
+
+type RedisBridge struct {
+	NodeId       string
+	Client       *redis.Client
+	Subscription *redis.PubSub
+	ps           *PubSub
+}
+
+// Redis pub/sub messages carry no headers, so the origin node and topic travel
+// in an envelope around the published message
+type redisEnvelope struct {
+	Origin  string `json:"origin"`
+	Id      string `json:"id"`
+	Topic   string `json:"topic"`
+	Message []byte `json:"message"`
+	relayHeaders
+}
+
+// Function to connect to Redis and start relaying messages for a PubSub.
+// Parameters:
+// url: string - The URL of the Redis server, e.g. redis://127.0.0.1:6379/0.
+// ps: *PubSub - The PubSub instance that receives messages relayed from other nodes.
+// Returns:
+// *RedisBridge - The connected bridge.
+// error - An error if the connection or subscription failed.
+func NewRedisBridge(url string, ps *PubSub) (*RedisBridge, error) {
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+
+	bridge := &RedisBridge{
+		NodeId: autoId(),
+		Client: redis.NewClient(options),
+		ps:     ps,
+	}
+
+	ctx := context.Background()
+	bridge.Subscription = bridge.Client.Subscribe(ctx, redisChannel)
+	// Wait for the subscription to be confirmed so no publish is missed after startup
+	if _, err := bridge.Subscription.Receive(ctx); err != nil {
+		bridge.Close()
+		return nil, err
+	}
+	go bridge.receive()
+
+	slog.Info("Connected to Redis", "addr", options.Addr, "node_id", bridge.NodeId)
+	return bridge, nil
+}
+
+// Function to relay a locally published message to the other nodes through Redis.
+// Parameters:
+// ctx: context.Context - The context of the publish.
+// id: string - The ID of the message.
+// topic: string - The topic the message was published to.
+// message: []byte - The published message.
+func (b *RedisBridge) Relay(ctx context.Context, id string, topic string, message []byte) error {
+	payload, err := json.Marshal(redisEnvelope{Origin: b.NodeId, Id: id, Topic: topic, Message: message, relayHeaders: relayHeadersOf(ctx)})
+	if err != nil {
+		return err
+	}
+	return b.Client.Publish(context.Background(), redisChannel, payload).Err()
+}
+
+// Function to deliver the messages received from Redis until the subscription is closed.
+func (b *RedisBridge) receive() {
+	for msg := range b.Subscription.Channel() {
+		b.handleMessage(msg.Payload)
+	}
+}
+
+// Function to handle a message received from Redis. Messages that originated on this
+// node are dropped so that a publish is never delivered twice.
+// Parameters:
+// payload: string - The envelope received from Redis.
+func (b *RedisBridge) handleMessage(payload string) {
+	var envelope redisEnvelope
+	if err := json.Unmarshal([]byte(payload), &envelope); err != nil {
+		slog.Error("Error decoding Redis message", "error", err)
+		return
+	}
+	if envelope.Origin == b.NodeId {
+		return
+	}
+	b.ps.deliver(envelope.context(), envelope.Id, envelope.Topic, envelope.Message)
+}
+
+// Function to stop relaying messages and close the Redis connection.
+func (b *RedisBridge) Close() {
+	if b.Subscription != nil {
+		b.Subscription.Close()
+	}
+	b.Client.Close()
+}
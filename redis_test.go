@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisBridgeDeliversRemoteMessages(t *testing.T) {
+	ps := &PubSub{}
+	bridge := &RedisBridge{NodeId: autoId(), ps: ps}
+
+	client, peer := newTestClient(t)
+	ps.Subscribe(&client, "news")
+
+	payload, _ := json.Marshal(redisEnvelope{Origin: autoId(), Topic: "news", Message: []byte("from another node")})
+	bridge.handleMessage(string(payload))
+
+	_, message, err := peer.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("from another node"), message)
+}
+
+func TestRedisBridgeDropsOwnMessages(t *testing.T) {
+	ps := &PubSub{}
+	bridge := &RedisBridge{NodeId: autoId(), ps: ps}
+
+	client, peer := newTestClient(t)
+	ps.Subscribe(&client, "news")
+
+	payload, _ := json.Marshal(redisEnvelope{Origin: bridge.NodeId, Topic: "news", Message: []byte("echo")})
+	bridge.handleMessage(string(payload))
+	bridge.handleMessage("not json")
+
+	peer.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, _, err := peer.ReadMessage()
+	assert.Error(t, err, "Messages published by this node should not be delivered again")
+}
+
+func TestRedisBridgeKeepsTheReplyHeaders(t *testing.T) {
+	ps := &PubSub{}
+	bridge := &RedisBridge{NodeId: autoId(), ps: ps}
+
+	client, peer := newTestClient(t)
+	ps.SubscribeWith(&client, "quotes", SubscribeOptions{Envelope: true})
+
+	ctx := withReply(withPublisher(context.Background(), "alice"), replyHeaders{ReplyTo: "$inbox.c1", CorrelationId: "q1"})
+	payload, _ := json.Marshal(redisEnvelope{Origin: autoId(), Topic: "quotes", Message: []byte(`{"symbol":"ACME"}`), relayHeaders: relayHeadersOf(ctx)})
+	bridge.handleMessage(string(payload))
+
+	request := readFrame(t, peer)
+	assert.Equal(t, "alice", request["publisher"])
+	assert.Equal(t, "$inbox.c1", request["replyTo"])
+	assert.Equal(t, "q1", request["correlationId"])
+}
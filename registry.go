@@ -0,0 +1,514 @@
+// This file partitions the state of the topics and of the clients across shards, each
+// with its own lock. Topics are sharded by a hash of their name: a shard holds the
+// subscriptions of its topics, their activity and counters, and a copy of their policy.
+// Clients are sharded by a hash of their ID: a shard holds the connected clients and the
+// topics each of them is subscribed to, so removing a client only visits its own
+// topics. The subscriptions of a topic are an immutable list swapped atomically, and
+// the copy of its policy is replaced whenever the topic changes, so publishing, by the
+// server or by a client, only read-locks the shard of its topic and never waits for
+// ps.mu. Changes to subscriptions and topics are still made under ps.mu, which orders
+// them with waitlists and presence, and then write-lock the shards they touch. Shard
+// locks are always taken after ps.mu, never before, and one shard at a time.
+package main
+
+import (
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Shards of the registry, by default
+const defaultRegistryShards = 32
+
+// A shard of the registry, holding the state of the topics hashed to it.
+type registryShard struct {
+	mu     sync.RWMutex
+	topics map[string]*topicEntry
+}
+
+// The state of a topic in the registry, kept while the topic exists or has
+// subscriptions, activity or counters.
+type topicEntry struct {
+	// Subscriptions of the topic, in subscription order. A list is only ever appended
+	// to past the length readers were given, or replaced, so it is read without locks.
+	subscriptions atomic.Pointer[[]Subscription]
+	// Copy of the topic in ps.Topics, without its waitlist and timers, nil if it does
+	// not exist. It is replaced, never changed, so it is read without locks.
+	topic atomic.Pointer[Topic]
+	// Unix time in nanoseconds of the last publish, subscribe or unsubscribe, 0 if none
+	// since the topic was collected
+	activity atomic.Int64
+	// Messages and bytes published to the topic
+	messages atomic.Uint64
+	bytes    atomic.Uint64
+	// Unix time in nanoseconds of the last publish, 0 if none
+	lastPublishAt atomic.Int64
+}
+
+// A shard of the connected clients, holding the clients whose ID hashes to it.
+type clientShard struct {
+	mu sync.RWMutex
+	// Connected clients, in connection order
+	clients []connectedClient
+	// Topics each client is subscribed to, by client ID
+	topics map[string]map[string]bool
+}
+
+// A connected client and when it was added, to list the clients in connection order.
+type connectedClient struct {
+	seq    uint64
+	client Client
+}
+
+// Function to get the subscriptions of a topic entry.
+// Returns:
+// []Subscription - The subscriptions; the list must not be changed.
+func (e *topicEntry) subscriptionList() []Subscription {
+	if list := e.subscriptions.Load(); list != nil {
+		return *list
+	}
+	return nil
+}
+
+// Function to get the shards of the registry, creating them on first use.
+// Returns:
+// []*registryShard - The shards.
+func (ps *PubSub) registry() []*registryShard {
+	ps.createShards()
+	return ps.shards
+}
+
+// Function to get the shards of the connected clients, creating them on first use.
+// Returns:
+// []*clientShard - The shards.
+func (ps *PubSub) clientShards() []*clientShard {
+	ps.createShards()
+	return ps.clientShardList
+}
+
+// Function to create the shards of the topics and of the clients, once.
+func (ps *PubSub) createShards() {
+	ps.registryOnce.Do(func() {
+		count := ps.RegistryShards
+		if count <= 0 {
+			count = defaultRegistryShards
+		}
+		ps.shards = make([]*registryShard, count)
+		ps.clientShardList = make([]*clientShard, count)
+		for i := range ps.shards {
+			ps.shards[i] = &registryShard{topics: map[string]*topicEntry{}}
+			ps.clientShardList[i] = &clientShard{topics: map[string]map[string]bool{}}
+		}
+	})
+}
+
+// Function to get the shard of a topic.
+// Parameters:
+// topic: string - The topic.
+// Returns:
+// *registryShard - The shard holding the state of the topic.
+func (ps *PubSub) topicShard(topic string) *registryShard {
+	shards := ps.registry()
+	return shards[shardOf(topic, len(shards))]
+}
+
+// Function to get the shard of a client.
+// Parameters:
+// id: string - The ID of the client.
+// Returns:
+// *clientShard - The shard holding the client and its topics.
+func (ps *PubSub) clientShardOf(id string) *clientShard {
+	shards := ps.clientShards()
+	return shards[shardOf(id, len(shards))]
+}
+
+// Function to get the entry of a topic, creating it if needed. The caller must hold
+// the write lock of the shard.
+// Parameters:
+// topic: string - The topic.
+// Returns:
+// *topicEntry - The entry.
+func (shard *registryShard) entryLocked(topic string) *topicEntry {
+	entry := shard.topics[topic]
+	if entry == nil {
+		entry = &topicEntry{}
+		shard.topics[topic] = entry
+	}
+	return entry
+}
+
+// Function to drop the entry of a topic that does not exist and is left without
+// subscriptions, activity nor counters. The caller must hold the write lock of the shard.
+// Parameters:
+// topic: string - The topic.
+// entry: *topicEntry - The entry of the topic.
+func (shard *registryShard) pruneLocked(topic string, entry *topicEntry) {
+	if len(entry.subscriptionList()) == 0 && entry.topic.Load() == nil && entry.activity.Load() == 0 && entry.messages.Load() == 0 {
+		delete(shard.topics, topic)
+	}
+}
+
+// Function to get the entry of a topic under the read lock of its shard.
+// Parameters:
+// topic: string - The topic.
+// Returns:
+// *topicEntry - The entry, or nil if the registry holds nothing of the topic.
+func (ps *PubSub) topicEntry(topic string) *topicEntry {
+	shard := ps.topicShard(topic)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	return shard.topics[topic]
+}
+
+// Function to update the entry of a topic, creating it if needed. The update runs under
+// the read lock of the shard, or its write lock when the entry is created, so removing
+// the topic never loses an update made after it was removed.
+// Parameters:
+// topic: string - The topic.
+// update: func(*topicEntry) - Updates the entry; it must only use atomic operations.
+func (ps *PubSub) updateTopicEntry(topic string, update func(entry *topicEntry)) {
+	shard := ps.topicShard(topic)
+	shard.mu.RLock()
+	if entry := shard.topics[topic]; entry != nil {
+		update(entry)
+		shard.mu.RUnlock()
+		return
+	}
+	shard.mu.RUnlock()
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	update(shard.entryLocked(topic))
+}
+
+// Function to get the subscriptions of a topic without taking ps.mu.
+// Parameters:
+// topic: string - The topic.
+// Returns:
+// []Subscription - The subscriptions, in subscription order; the list must not be changed.
+func (ps *PubSub) topicSubscriptions(topic string) []Subscription {
+	if entry := ps.topicEntry(topic); entry != nil {
+		return entry.subscriptionList()
+	}
+	return nil
+}
+
+// Function to get the copy of a topic without taking ps.mu.
+// Parameters:
+// name: string - The name of the topic.
+// Returns:
+// *Topic - The copy of the topic, which must not be changed, or nil if it does not exist.
+func (ps *PubSub) topicSnapshot(name string) *Topic {
+	if entry := ps.topicEntry(name); entry != nil {
+		return entry.topic.Load()
+	}
+	return nil
+}
+
+// Function to copy a topic of ps.Topics to its shard, once it was created, changed or
+// deleted. The caller must hold ps.mu.
+// Parameters:
+// name: string - The name of the topic.
+func (ps *PubSub) syncTopicLocked(name string) {
+	var snapshot *Topic
+	if topic, ok := ps.Topics[name]; ok {
+		snapshot = topic.snapshot()
+	}
+	shard := ps.topicShard(name)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if snapshot == nil {
+		if entry := shard.topics[name]; entry != nil {
+			entry.topic.Store(nil)
+			shard.pruneLocked(name, entry)
+		}
+		return
+	}
+	shard.entryLocked(name).topic.Store(snapshot)
+}
+
+// Function to add a subscription. The caller must hold ps.mu.
+// Parameters:
+// sub: Subscription - The subscription.
+func (ps *PubSub) addSubscriptionLocked(sub Subscription) {
+	sub.seq = ps.subscriptionSeq.Add(1)
+	shard := ps.topicShard(sub.Topic)
+	shard.mu.Lock()
+	entry := shard.entryLocked(sub.Topic)
+	list := append(entry.subscriptionList(), sub)
+	entry.subscriptions.Store(&list)
+	shard.mu.Unlock()
+
+	clients := ps.clientShardOf(sub.Client.Id)
+	clients.mu.Lock()
+	defer clients.mu.Unlock()
+	topics := clients.topics[sub.Client.Id]
+	if topics == nil {
+		topics = map[string]bool{}
+		clients.topics[sub.Client.Id] = topics
+	}
+	topics[sub.Topic] = true
+}
+
+// Function to remove the subscriptions to a topic a function selects. The caller must
+// hold ps.mu.
+// Parameters:
+// topic: string - The topic.
+// remove: func(Subscription) bool - Whether to remove a subscription.
+// Returns:
+// []Subscription - The subscriptions removed, in subscription order.
+func (ps *PubSub) removeSubscriptionsLocked(topic string, remove func(sub Subscription) bool) []Subscription {
+	var removed []Subscription
+	shard := ps.topicShard(topic)
+	shard.mu.Lock()
+	entry := shard.topics[topic]
+	if entry == nil {
+		shard.mu.Unlock()
+		return nil
+	}
+	// A new list, so the lists readers were given stay as they are
+	var kept []Subscription
+	for _, sub := range entry.subscriptionList() {
+		if remove(sub) {
+			removed = append(removed, sub)
+		} else {
+			kept = append(kept, sub)
+		}
+	}
+	if len(removed) > 0 {
+		if len(kept) == 0 {
+			entry.subscriptions.Store(nil)
+			shard.pruneLocked(topic, entry)
+		} else {
+			entry.subscriptions.Store(&kept)
+		}
+	}
+	shard.mu.Unlock()
+
+	// The topic is forgotten for the clients left without a subscription to it
+	for _, sub := range removed {
+		if hasSubscriber(kept, sub.Client.Id) {
+			continue
+		}
+		clients := ps.clientShardOf(sub.Client.Id)
+		clients.mu.Lock()
+		if topics := clients.topics[sub.Client.Id]; topics != nil {
+			delete(topics, topic)
+			if len(topics) == 0 {
+				delete(clients.topics, sub.Client.Id)
+			}
+		}
+		clients.mu.Unlock()
+	}
+	return removed
+}
+
+// Function to check whether a client has one of a list of subscriptions.
+// Parameters:
+// subscriptions: []Subscription - The subscriptions.
+// id: string - The ID of the client.
+// Returns:
+// bool - True if one of the subscriptions is of the client.
+func hasSubscriber(subscriptions []Subscription, id string) bool {
+	for _, sub := range subscriptions {
+		if sub.Client.Id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Function to change the subscriptions of a client to a topic. The caller must hold ps.mu.
+// Parameters:
+// topic: string - The topic.
+// id: string - The ID of the client.
+// update: func(*Subscription) - Changes a subscription.
+func (ps *PubSub) updateSubscriptionsLocked(topic string, id string, update func(sub *Subscription)) {
+	shard := ps.topicShard(topic)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	entry := shard.topics[topic]
+	if entry == nil {
+		return
+	}
+	// Changed in a copy, so the lists readers were given stay as they are
+	list := append([]Subscription(nil), entry.subscriptionList()...)
+	for i := range list {
+		if list[i].Client.Id == id {
+			update(&list[i])
+		}
+	}
+	entry.subscriptions.Store(&list)
+}
+
+// Function to grow the subscriptions of a topic, so the next ones are added without
+// growing them. The caller must hold ps.mu.
+// Parameters:
+// topic: string - The topic.
+// n: int - How many subscriptions to make room for.
+// Returns:
+// int - How many subscriptions can be added without growing the list.
+func (ps *PubSub) reserveSubscriptionsLocked(topic string, n int) int {
+	shard := ps.topicShard(topic)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	entry := shard.entryLocked(topic)
+	list := entry.subscriptionList()
+	if cap(list)-len(list) < n {
+		// A new list, so appending never writes where readers of the current one look
+		list = slices.Grow(slices.Clip(list), n)
+		entry.subscriptions.Store(&list)
+	}
+	return cap(list) - len(list)
+}
+
+// Function to get the topics a client is subscribed to.
+// Parameters:
+// id: string - The ID of the client.
+// Returns:
+// []string - The topics, in no particular order.
+func (ps *PubSub) clientTopics(id string) []string {
+	shard := ps.clientShardOf(id)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	topics := make([]string, 0, len(shard.topics[id]))
+	for topic := range shard.topics[id] {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+// Function to get the subscriptions of a client, visiting only the topics it is
+// subscribed to.
+// Parameters:
+// id: string - The ID of the client.
+// Returns:
+// []Subscription - The subscriptions, in subscription order.
+func (ps *PubSub) clientSubscriptions(id string) []Subscription {
+	var subscriptions []Subscription
+	for _, topic := range ps.clientTopics(id) {
+		for _, sub := range ps.topicSubscriptions(topic) {
+			if sub.Client.Id == id {
+				subscriptions = append(subscriptions, sub)
+			}
+		}
+	}
+	sortSubscriptions(subscriptions)
+	return subscriptions
+}
+
+// Function to list every subscription.
+// Returns:
+// []Subscription - The subscriptions, in subscription order.
+func (ps *PubSub) Subscriptions() []Subscription {
+	var subscriptions []Subscription
+	for _, shard := range ps.registry() {
+		shard.mu.RLock()
+		for _, entry := range shard.topics {
+			subscriptions = append(subscriptions, entry.subscriptionList()...)
+		}
+		shard.mu.RUnlock()
+	}
+	sortSubscriptions(subscriptions)
+	return subscriptions
+}
+
+// Function to sort subscriptions in the order they were made.
+// Parameters:
+// subscriptions: []Subscription - The subscriptions.
+func sortSubscriptions(subscriptions []Subscription) {
+	sort.Slice(subscriptions, func(i, j int) bool { return subscriptions[i].seq < subscriptions[j].seq })
+}
+
+// Function to add a connected client to its shard.
+// Parameters:
+// client: Client - The client.
+// Returns:
+// int - The number of connected clients.
+func (ps *PubSub) addConnectedClient(client Client) int {
+	shard := ps.clientShardOf(client.Id)
+	shard.mu.Lock()
+	shard.clients = append(shard.clients, connectedClient{seq: ps.clientSeq.Add(1), client: client})
+	shard.mu.Unlock()
+	return int(ps.clientCount.Add(1))
+}
+
+// Function to remove the connected clients with an ID from their shard.
+// Parameters:
+// id: string - The ID of the clients.
+func (ps *PubSub) removeConnectedClients(id string) {
+	shard := ps.clientShardOf(id)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	kept := shard.clients[:0]
+	for _, connected := range shard.clients {
+		if connected.client.Id != id {
+			kept = append(kept, connected)
+		} else {
+			ps.clientCount.Add(-1)
+		}
+	}
+	clear(shard.clients[len(kept):])
+	shard.clients = kept
+}
+
+// Function to get the connected clients with an ID.
+// Parameters:
+// id: string - The ID of the clients.
+// Returns:
+// []Client - The clients, in connection order.
+func (ps *PubSub) clientsWithID(id string) []Client {
+	shard := ps.clientShardOf(id)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	var clients []Client
+	for _, connected := range shard.clients {
+		if connected.client.Id == id {
+			clients = append(clients, connected.client)
+		}
+	}
+	return clients
+}
+
+// Function to list the connected clients.
+// Returns:
+// []Client - The clients, in connection order.
+func (ps *PubSub) Clients() []Client {
+	var connected []connectedClient
+	for _, shard := range ps.clientShards() {
+		shard.mu.RLock()
+		connected = append(connected, shard.clients...)
+		shard.mu.RUnlock()
+	}
+	sort.Slice(connected, func(i, j int) bool { return connected[i].seq < connected[j].seq })
+	clients := make([]Client, len(connected))
+	for i := range connected {
+		clients[i] = connected[i].client
+	}
+	return clients
+}
+
+// Function to forget the activity and counters of a topic. The caller must hold the
+// write lock of the shard of the topic.
+// Parameters:
+// topic: string - The topic.
+// entry: *topicEntry - The entry of the topic.
+func (shard *registryShard) forgetLocked(topic string, entry *topicEntry) {
+	entry.activity.Store(0)
+	entry.messages.Store(0)
+	entry.bytes.Store(0)
+	entry.lastPublishAt.Store(0)
+	shard.pruneLocked(topic, entry)
+}
+
+// Function to forget the activity and counters of a topic.
+// Parameters:
+// topic: string - The topic.
+func (ps *PubSub) forgetTopicState(topic string) {
+	shard := ps.topicShard(topic)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if entry := shard.topics[topic]; entry != nil {
+		shard.forgetLocked(topic, entry)
+	}
+}
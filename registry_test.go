@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// indexedClients lists the IDs of the clients of the indexed subscriptions to a topic.
+func indexedClients(pubsub *PubSub, topic string) []string {
+	var ids []string
+	for _, sub := range pubsub.topicSubscriptions(topic) {
+		ids = append(ids, sub.Client.Id)
+	}
+	return ids
+}
+
+func TestRegistryIndexesSubscriptions(t *testing.T) {
+	pubsub := &PubSub{RegistryShards: 4}
+	alice, bob := &Client{Id: "alice"}, &Client{Id: "bob"}
+	pubsub.Subscribe(alice, "news")
+	pubsub.Subscribe(bob, "news")
+	pubsub.Subscribe(bob, "sports")
+	assert.Equal(t, []string{"alice", "bob"}, indexedClients(pubsub, "news"))
+	assert.Equal(t, []string{"bob"}, indexedClients(pubsub, "sports"))
+
+	filter, err := ParseFilter(`payload.score > 1`)
+	assert.NoError(t, err)
+	pubsub.SubscribeWith(alice, "news", SubscribeOptions{Filter: filter})
+	if subscriptions := pubsub.topicSubscriptions("news"); assert.Len(t, subscriptions, 2) {
+		assert.Equal(t, filter, subscriptions[0].Filter, "Changes to a subscription are indexed")
+	}
+
+	pubsub.Unsubscribe(alice, "news")
+	assert.Equal(t, []string{"bob"}, indexedClients(pubsub, "news"))
+	pubsub.RemoveClient(*bob)
+	assert.Empty(t, indexedClients(pubsub, "news"))
+	assert.Empty(t, indexedClients(pubsub, "sports"))
+	pubsub.forgetTopicState("news")
+	assert.Nil(t, pubsub.topicEntry("news"), "Topics without subscriptions, activity nor counters are forgotten")
+	assert.NotNil(t, pubsub.topicEntry("sports"), "Topics keep their activity")
+}
+
+func TestRegistryListsStayValidAfterChanges(t *testing.T) {
+	pubsub := &PubSub{}
+	for i := 0; i < 3; i++ {
+		pubsub.Subscribe(&Client{Id: fmt.Sprint("client-", i)}, "feed")
+	}
+	before := pubsub.topicSubscriptions("feed")
+	pubsub.Subscribe(&Client{Id: "client-3"}, "feed")
+	pubsub.Unsubscribe(&Client{Id: "client-0"}, "feed")
+	assert.Equal(t, []string{"client-0", "client-1", "client-2"}, []string{before[0].Client.Id, before[1].Client.Id, before[2].Client.Id},
+		"Lists given to publishers are not changed by later subscriptions")
+	assert.Equal(t, []string{"client-1", "client-2", "client-3"}, indexedClients(pubsub, "feed"))
+}
+
+func TestPublishDoesNotWaitForPubSubLock(t *testing.T) {
+	pubsub := &PubSub{}
+	recorder := &orderRecorder{}
+	pubsub.Subscribe(&Client{Id: "reader", Transport: recorder}, "feed")
+
+	pubsub.mu.Lock()
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		pubsub.Publish("feed", []byte(`"hello"`), nil)
+	}()
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Error("Publishing waited for ps.mu")
+	}
+	pubsub.mu.Unlock()
+	<-published
+	assert.Equal(t, []string{`"hello"`}, recorder.messages)
+}
+
+func TestClientPublishDoesNotWaitForPubSubLock(t *testing.T) {
+	pubsub := &PubSub{ExplicitTopics: true}
+	assert.NoError(t, pubsub.CreateTopic("feed", "", TopicPolicy{Schema: map[string]string{"text": "string"}}))
+	var callbacks atomic.Int64
+	pubsub.OnPublish(func(ctx context.Context, client *Client, topic string, message []byte) { callbacks.Add(1) })
+	recorder := &orderRecorder{}
+	pubsub.Subscribe(&Client{Id: "reader", Transport: recorder}, "feed")
+
+	// The topic, its policy and schema and the publish callbacks are read from the shards
+	pubsub.mu.Lock()
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		publisher := Client{Id: "publisher", Session: NewSession("test")}
+		pubsub.HandleRecvdMessage(publisher, websocket.TextMessage, []byte(`{"action":"publish","topic":"feed","message":{"text":"hello"}}`))
+	}()
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Error("Publishing a frame waited for ps.mu")
+	}
+	pubsub.mu.Unlock()
+	<-published
+	assert.Equal(t, []string{`{"text":"hello"}`}, recorder.messages)
+	assert.Equal(t, int64(1), callbacks.Load())
+}
+
+func TestRegistryIndexesTheTopicsOfClients(t *testing.T) {
+	pubsub := &PubSub{RegistryShards: 4}
+	for _, id := range []string{"carol", "alice", "bob"} {
+		pubsub.AddClient(Client{Id: id, Transport: discardTransport{}})
+	}
+	var ids []string
+	for _, client := range pubsub.Clients() {
+		ids = append(ids, client.Id)
+	}
+	assert.Equal(t, []string{"carol", "alice", "bob"}, ids, "Clients are listed in connection order across shards")
+
+	alice := &Client{Id: "alice"}
+	pubsub.Subscribe(alice, "b")
+	pubsub.Subscribe(alice, "a")
+	pubsub.Subscribe(&Client{Id: "bob"}, "a")
+	assert.ElementsMatch(t, []string{"a", "b"}, pubsub.clientTopics("alice"))
+	if subscriptions := pubsub.clientSubscriptions("alice"); assert.Len(t, subscriptions, 2) {
+		assert.Equal(t, "b", subscriptions[0].Topic, "Subscriptions are listed in subscription order")
+	}
+
+	pubsub.Unsubscribe(alice, "b")
+	assert.Equal(t, []string{"a"}, pubsub.clientTopics("alice"))
+	pubsub.RemoveClient(*alice)
+	assert.Empty(t, pubsub.clientTopics("alice"))
+	assert.Len(t, pubsub.clientsWithID("alice"), 0)
+	assert.Equal(t, []string{"bob"}, indexedClients(pubsub, "a"))
+	assert.Len(t, pubsub.Clients(), 2)
+}
+
+func TestRegistryCopiesTopicsToTheirShard(t *testing.T) {
+	pubsub := &PubSub{}
+	assert.NoError(t, pubsub.CreateTopic("room", "alice", TopicPolicy{Private: true}))
+	bob := &Client{Id: "bob", Claims: jwt.MapClaims{"sub": "bob"}}
+	assert.False(t, pubsub.canAccessTopic("room", bob, PUBLISH))
+
+	assert.NoError(t, pubsub.SetTopicGrant("room", "bob", true))
+	assert.True(t, pubsub.canAccessTopic("room", bob, PUBLISH), "Grants are copied to the shard")
+	assert.NoError(t, pubsub.SetTopicPolicy("room", TopicPolicy{Private: true, Publishers: []string{"alice"}}))
+	assert.False(t, pubsub.canAccessTopic("room", bob, PUBLISH), "Policies are copied to the shard")
+
+	assert.NoError(t, pubsub.DeleteTopic("room"))
+	assert.Nil(t, pubsub.topicSnapshot("room"))
+	assert.Nil(t, pubsub.topicEntry("room"), "Deleted topics leave nothing in their shard")
+}
+
+func TestRegistryShardsCounters(t *testing.T) {
+	pubsub := &PubSub{RegistryShards: 2}
+	pubsub.Publish("a", []byte(`1`), nil)
+	pubsub.Publish("b", []byte(`22`), nil)
+	pubsub.Publish("b", []byte(`333`), nil)
+	counters, ok := pubsub.topicCountersOf("b")
+	assert.True(t, ok)
+	assert.Equal(t, uint64(2), counters.messages)
+	assert.Equal(t, uint64(5), counters.bytes)
+	_, ok = pubsub.lastActivity("a")
+	assert.True(t, ok)
+
+	pubsub.forgetTopicState("b")
+	_, ok = pubsub.topicCountersOf("b")
+	assert.False(t, ok)
+	assert.Len(t, pubsub.registry(), 2)
+}
+
+func TestPublishesShareTheShardOfTheirTopic(t *testing.T) {
+	pubsub := &PubSub{}
+	recorder := &orderRecorder{}
+	pubsub.Subscribe(&Client{Id: "reader", Transport: recorder}, "feed")
+
+	// Publishers only read-lock the shard, so a reader holding it does not stop them
+	shard := pubsub.topicShard("feed")
+	shard.mu.RLock()
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		pubsub.Publish("feed", []byte(`"hello"`), nil)
+	}()
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Error("Publishing waited for the write lock of the shard")
+	}
+	shard.mu.RUnlock()
+	<-published
+	assert.Equal(t, []string{`"hello"`}, recorder.messages)
+}
+
+func TestConcurrentPublishesAndSubscribes(t *testing.T) {
+	pubsub := &PubSub{RegistryShards: 2}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				client := &Client{Id: fmt.Sprint("client-", i, "-", j), Transport: discardTransport{}}
+				pubsub.Subscribe(client, "feed")
+				if j%2 == 0 {
+					pubsub.Unsubscribe(client, "feed")
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				pubsub.Publish("feed", []byte(`"tick"`), nil)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Len(t, pubsub.topicSubscriptions("feed"), 4*25)
+	counters, _ := pubsub.topicCountersOf("feed")
+	assert.Equal(t, uint64(4*50), counters.messages)
+}
+
+// BenchmarkConcurrentPublishes publishes from parallel goroutines, each to its own topic,
+// while a client keeps subscribing and leaving. Publishes made by the server and the
+// publish frames of clients only read-lock the shard of their topic, so neither contends
+// with the churn nor with each other.
+func BenchmarkConcurrentPublishes(b *testing.B) {
+	for _, source := range []string{"server", "client"} {
+		b.Run(source, func(b *testing.B) {
+			pubsub := &PubSub{}
+			stop, stopped := make(chan struct{}), make(chan struct{})
+			go func() {
+				defer close(stopped)
+				churn := &Client{Id: "churn", Transport: discardTransport{}}
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					pubsub.Subscribe(churn, "churn")
+					pubsub.Unsubscribe(churn, "churn")
+				}
+			}()
+			defer func() {
+				close(stop)
+				<-stopped
+			}()
+
+			var publishers atomic.Int64
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				topic := fmt.Sprint("topic-", publishers.Add(1))
+				pubsub.Subscribe(&Client{Id: "reader-" + topic, Transport: discardTransport{}}, topic)
+				publisher := Client{Id: "publisher-" + topic, Session: NewSession("bench")}
+				frame := []byte(`{"action":"publish","topic":"` + topic + `","message":"tick"}`)
+				for pb.Next() {
+					if source == "server" {
+						pubsub.Publish(topic, []byte(`"tick"`), nil)
+					} else {
+						pubsub.HandleRecvdMessage(publisher, websocket.TextMessage, frame)
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,47 @@
+// This file carries what the context of a publish says about a message across the
+// bridges and the cluster: its publisher, the inbox and correlation ID of a request and
+// the trace context. The receiving node rebuilds the context from them, so subscribers
+// on every node get the same envelope and responders can reply to a requester
+// connected to another node.
+package main
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// relayHeaders are the fields of the context of a publish relayed with its message
+type relayHeaders struct {
+	Publisher     string            `json:"publisher,omitempty"`
+	ReplyTo       string            `json:"replyTo,omitempty"`
+	CorrelationId string            `json:"correlationId,omitempty"`
+	Trace         map[string]string `json:"trace,omitempty"`
+}
+
+// Function to get the fields of the context of a publish to relay with its message.
+// Parameters:
+// ctx: context.Context - The context of the publish.
+// Returns:
+// relayHeaders - The publisher, reply headers and trace context of the message.
+func relayHeadersOf(ctx context.Context) relayHeaders {
+	reply := replyFrom(ctx)
+	return relayHeaders{
+		Publisher:     publisherFrom(ctx),
+		ReplyTo:       reply.ReplyTo,
+		CorrelationId: reply.CorrelationId,
+		Trace:         traceCarrier(ctx),
+	}
+}
+
+// Function to rebuild the context of a relayed message, to deliver it in.
+// Returns:
+// context.Context - A background context carrying the relayed trace context, publisher and reply headers.
+func (h relayHeaders) context() context.Context {
+	ctx := context.Background()
+	if len(h.Trace) > 0 {
+		ctx = propagator.Extract(ctx, propagation.MapCarrier(h.Trace))
+	}
+	ctx = withPublisher(ctx, h.Publisher)
+	return withReply(ctx, replyHeaders{ReplyTo: h.ReplyTo, CorrelationId: h.CorrelationId})
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestRelayHeadersRebuildTheContextOfThePublish(t *testing.T) {
+	spanContext := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1, 2, 3},
+		SpanID:     trace.SpanID{4, 5, 6},
+		TraceFlags: trace.FlagsSampled,
+	})
+	ctx := trace.ContextWithSpanContext(context.Background(), spanContext)
+	ctx = withReply(withPublisher(ctx, "alice"), replyHeaders{ReplyTo: "$inbox.c1", CorrelationId: "q1"})
+
+	encoded, err := json.Marshal(relayHeadersOf(ctx))
+	assert.NoError(t, err)
+	var headers relayHeaders
+	assert.NoError(t, json.Unmarshal(encoded, &headers))
+	relayed := headers.context()
+	assert.Equal(t, "alice", publisherFrom(relayed))
+	assert.Equal(t, replyHeaders{ReplyTo: "$inbox.c1", CorrelationId: "q1"}, replyFrom(relayed))
+	assert.Equal(t, spanContext.TraceID(), trace.SpanContextFromContext(relayed).TraceID())
+
+	assert.Equal(t, relayHeaders{}, relayHeadersOf(context.Background()), "Messages of the server carry no headers")
+	assert.Equal(t, replyHeaders{}, replyFrom(relayHeaders{}.context()))
+}
+
+func TestRequestReplyAcrossClusterNodes(t *testing.T) {
+	nodeA, psA := newTestCluster(t, "s3cret")
+	nodeB, psB := newTestCluster(t, "s3cret")
+	nodeA.Join([]string{nodeB.Address})
+	assert.Eventually(t, func() bool { return len(nodeA.Members()) == 1 && len(nodeB.Members()) == 1 }, 2*time.Second, 10*time.Millisecond)
+
+	requester, requesterPeer := newTestClient(t)
+	responder, responderPeer := newTestClient(t)
+	psB.HandleRecvdMessage(responder, 1, []byte(`{"action":"subscribe","topic":"quotes","envelope":true}`))
+
+	psA.HandleRecvdMessage(requester, 1, []byte(`{"action":"request","topic":"quotes","message":{"symbol":"ACME"},"correlationId":"q1"}`))
+	requested := readFrame(t, requesterPeer)
+	assert.Equal(t, REQUESTED, requested["action"])
+
+	request := readFrame(t, responderPeer)
+	assert.Equal(t, "$inbox."+requester.Id, request["replyTo"], "The node of the responder delivers the reply fields")
+	assert.Equal(t, "q1", request["correlationId"])
+
+	reply, _ := json.Marshal(map[string]interface{}{"action": "publish", "topic": request["replyTo"], "correlationId": "q1", "message": map[string]float64{"price": 42}})
+	psB.HandleRecvdMessage(responder, 1, reply)
+	answer := readFrame(t, requesterPeer)
+	assert.Equal(t, "$inbox."+requester.Id, answer["topic"])
+	assert.Equal(t, "q1", answer["correlationId"], "The reply reaches the requester on the other node")
+	assert.Equal(t, map[string]interface{}{"price": float64(42)}, answer["message"])
+}
@@ -0,0 +1,160 @@
+// This file lets clients fetch the history of a topic, e.g. to catch up after
+// reconnecting. When many clients ask for the same range at once, as they do when they
+// all reconnect after an outage, the history is read and the reply encoded once and
+// the frame is shared by every client waiting for it.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Protocol action to fetch the history of a topic
+const HISTORY = "history"
+
+var historyRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "gowebsockets_history_reads_total",
+	Help: "Number of history requests, by whether they read the history or shared a read in flight.",
+}, []string{"result"})
+
+// A range of the history of a topic: the entries after the message Since, or all of
+// them when empty, of which the last Limit are kept when Limit is positive.
+type historyRange struct {
+	Topic string
+	Since string
+	Limit int
+}
+
+// A read of a range in flight, done once done is closed
+type historyRead struct {
+	done  chan struct{}
+	frame []byte
+	err   error
+}
+
+// historyReadGroup coalesces the reads of identical ranges that overlap in time. Its
+// zero value is ready to use.
+type historyReadGroup struct {
+	reads map[historyRange]*historyRead
+	mu    sync.Mutex
+}
+
+// Function to read a range, or wait for the read of the same range already in flight
+// and share its result.
+// Parameters:
+// key: historyRange - The range.
+// read: func() ([]byte, error) - Reads the range and encodes the reply.
+// Returns:
+// []byte - The encoded reply, shared by every caller and not to be modified.
+// bool - True if the result of a read in flight was shared.
+// error - The error of the read.
+func (g *historyReadGroup) do(key historyRange, read func() ([]byte, error)) ([]byte, bool, error) {
+	g.mu.Lock()
+	if call, ok := g.reads[key]; ok {
+		g.mu.Unlock()
+		<-call.done
+		return call.frame, true, call.err
+	}
+	if g.reads == nil {
+		g.reads = map[historyRange]*historyRead{}
+	}
+	call := &historyRead{done: make(chan struct{})}
+	g.reads[key] = call
+	g.mu.Unlock()
+
+	call.frame, call.err = read()
+
+	// Later requests read again, so they see messages published since
+	g.mu.Lock()
+	delete(g.reads, key)
+	g.mu.Unlock()
+	close(call.done)
+	return call.frame, false, call.err
+}
+
+// Function to get the reply to a history request, coalescing it with identical
+// requests in flight.
+// Parameters:
+// key: historyRange - The requested range.
+// Returns:
+// []byte - The JSON encoded history frame.
+// error - An error if the history could not be read.
+func (ps *PubSub) HistoryFrame(key historyRange) ([]byte, error) {
+	frame, shared, err := ps.historyReads.do(key, func() ([]byte, error) {
+		return ps.readHistory(key)
+	})
+	if shared {
+		historyRequests.WithLabelValues("coalesced").Inc()
+	} else {
+		historyRequests.WithLabelValues("read").Inc()
+	}
+	return frame, err
+}
+
+// Function to read a range of the history and encode the reply.
+// Parameters:
+// key: historyRange - The range.
+// Returns:
+// []byte - The JSON encoded history frame, with the entries as encoded by the json history codec.
+// error - An error if the history could not be read.
+func (ps *PubSub) readHistory(key historyRange) ([]byte, error) {
+	var entries []HistoryEntry
+	if ps.History != nil {
+		var err error
+		if entries, err = ps.History.Entries(key.Topic); err != nil {
+			return nil, err
+		}
+	}
+	if ps.Archiver != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), archiveTimeout)
+		var err error
+		entries, err = ps.Archiver.Extend(ctx, key, entries)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if key.Since != "" {
+		for i, entry := range entries {
+			if entry.Id == key.Since {
+				entries = entries[i+1:]
+				break
+			}
+		}
+	}
+	if key.Limit > 0 && len(entries) > key.Limit {
+		entries = entries[len(entries)-key.Limit:]
+	}
+
+	messages := make([]json.RawMessage, 0, len(entries))
+	for _, entry := range entries {
+		data, err := JSONEntryCodec{}.Encode(entry)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, data)
+	}
+	return json.Marshal(struct {
+		Action   string            `json:"action"`
+		Topic    string            `json:"topic"`
+		Messages []json.RawMessage `json:"messages"`
+	}{HISTORY, key.Topic, messages})
+}
+
+// Function to build the frame telling a client its history request failed.
+// Parameters:
+// topic: string - The topic of the request.
+// Returns:
+// []byte - The JSON encoded frame.
+func historyUnavailableMessage(topic string) []byte {
+	message, _ := json.Marshal(map[string]string{
+		"action": "error",
+		"code":   "history_unavailable",
+		"topic":  topic,
+	})
+	return message
+}
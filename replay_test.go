@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistoryReadsAreCoalesced(t *testing.T) {
+	var group historyReadGroup
+	var reads atomic.Int32
+	release := make(chan struct{})
+	read := func() ([]byte, error) {
+		reads.Add(1)
+		<-release
+		return []byte(`{"action":"history"}`), nil
+	}
+
+	key := historyRange{Topic: "news", Limit: 10}
+	var wg sync.WaitGroup
+	frames := make([][]byte, 50)
+	var shared atomic.Int32
+	for i := range frames {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			frame, coalesced, err := group.do(key, read)
+			assert.NoError(t, err)
+			if coalesced {
+				shared.Add(1)
+			}
+			frames[i] = frame
+		}()
+	}
+	// Wait for every request to join the read in flight
+	assert.Eventually(t, func() bool {
+		group.mu.Lock()
+		defer group.mu.Unlock()
+		return len(group.reads) == 1
+	}, time.Second, time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), reads.Load(), "Identical requests in flight should share one read")
+	assert.Equal(t, int32(len(frames)-1), shared.Load())
+	for _, frame := range frames {
+		assert.Same(t, &frames[0][0], &frame[0], "Every requester should get the same encoded frame")
+	}
+	assert.Empty(t, group.reads, "A finished read should not be reused")
+
+	_, coalesced, err := group.do(historyRange{Topic: "other"}, func() ([]byte, error) { return nil, errors.New("down") })
+	assert.False(t, coalesced)
+	assert.EqualError(t, err, "down")
+}
+
+func TestHistoryFrameRange(t *testing.T) {
+	pubsub := &PubSub{History: NewMemoryHistory(JSONEntryCodec{}, 10)}
+	for _, id := range []string{"m1", "m2", "m3", "m4"} {
+		pubsub.History.Append(id, "news", []byte(`"`+id+`"`))
+	}
+
+	ids := func(key historyRange) []string {
+		frame, err := pubsub.HistoryFrame(key)
+		assert.NoError(t, err)
+		var reply struct {
+			Action   string `json:"action"`
+			Messages []struct {
+				Id string `json:"id"`
+			} `json:"messages"`
+		}
+		assert.NoError(t, json.Unmarshal(frame, &reply))
+		assert.Equal(t, HISTORY, reply.Action)
+		ids := []string{}
+		for _, message := range reply.Messages {
+			ids = append(ids, message.Id)
+		}
+		return ids
+	}
+	assert.Equal(t, []string{"m1", "m2", "m3", "m4"}, ids(historyRange{Topic: "news"}))
+	assert.Equal(t, []string{"m3", "m4"}, ids(historyRange{Topic: "news", Since: "m2"}))
+	assert.Equal(t, []string{"m4"}, ids(historyRange{Topic: "news", Since: "m1", Limit: 1}))
+	assert.Equal(t, []string{}, ids(historyRange{Topic: "empty"}))
+}
+
+func TestHistoryAction(t *testing.T) {
+	pubsub := &PubSub{History: NewMemoryHistory(JSONEntryCodec{}, 10)}
+	pubsub.History.Append("m1", "news", []byte(`{"headline":"hi"}`))
+	client, peer := newTestClient(t)
+
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"history","topic":"news","limit":5}`))
+	_, data, err := peer.ReadMessage()
+	assert.NoError(t, err)
+	var reply struct {
+		Topic    string            `json:"topic"`
+		Messages []json.RawMessage `json:"messages"`
+	}
+	assert.NoError(t, json.Unmarshal(data, &reply))
+	assert.Equal(t, "news", reply.Topic)
+	if assert.Len(t, reply.Messages, 1) {
+		entry, err := JSONEntryCodec{}.Decode(reply.Messages[0])
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{"headline":"hi"}`, string(entry.Payload))
+	}
+}
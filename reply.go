@@ -0,0 +1,120 @@
+// This file gives publish/subscribe request/reply semantics. Every client has an inbox
+// topic, $inbox.<client ID>, managed by the server: a client sending a request frame
+// is subscribed to its inbox, enveloped, and the request is published with the inbox
+// in the replyTo field and a correlation ID in the correlationId field of its
+// envelope. A responder publishes the reply to the replyTo topic with the same
+// correlation ID, which the requester receives in the envelope of the reply. Inboxes
+// keep no history and only their client may subscribe to them.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+)
+
+// Publishes a message as a request whose replies are delivered to the client's inbox
+const REQUEST = "request"
+
+// Frame telling a client where the replies to its request go
+const REQUESTED = "requested"
+
+// Prefix of the inbox topics, followed by the client ID
+const inboxPrefix = "$inbox."
+
+// Where the replies to a message go and how they are matched to it
+type replyHeaders struct {
+	ReplyTo       string
+	CorrelationId string
+}
+
+// Key of the reply headers of a message in the context of its publish
+type replyKey struct{}
+
+// Function to attach the reply headers of a message to the context of its publish.
+// Parameters:
+// ctx: context.Context - The context of the publish.
+// reply: replyHeaders - The headers, empty for a message expecting no reply.
+// Returns:
+// context.Context - The context carrying the headers.
+func withReply(ctx context.Context, reply replyHeaders) context.Context {
+	if reply == (replyHeaders{}) {
+		return ctx
+	}
+	return context.WithValue(ctx, replyKey{}, reply)
+}
+
+// Function to get the reply headers of the message published in a context.
+// Parameters:
+// ctx: context.Context - The context of the publish.
+// Returns:
+// replyHeaders - The headers, empty if the message expects no reply.
+func replyFrom(ctx context.Context) replyHeaders {
+	reply, _ := ctx.Value(replyKey{}).(replyHeaders)
+	return reply
+}
+
+// Function to get the inbox topic of a client.
+// Parameters:
+// client: *Client - The client.
+// Returns:
+// string - The topic its replies are delivered to.
+func inboxOf(client *Client) string {
+	return inboxPrefix + client.Id
+}
+
+// Function to tell whether a topic is an inbox.
+// Parameters:
+// topic: string - The topic.
+// Returns:
+// bool - True if the topic is the inbox of a client.
+func isInbox(topic string) bool {
+	return strings.HasPrefix(topic, inboxPrefix)
+}
+
+// Function to publish a request: the client is subscribed to its inbox and the message
+// is published with the inbox to reply to and a correlation ID, the one of the frame
+// or a generated one.
+// Parameters:
+// ctx: context.Context - The context the frame was received in.
+// client: *Client - The requesting client.
+// m: Message - The request frame.
+func (ps *PubSub) handleRequest(ctx context.Context, client *Client, m Message) {
+	if isInbox(m.Topic) || !ps.mayPublish(client, m.Topic) {
+		ps.refuse(client, m)
+		return
+	}
+	reply := replyHeaders{ReplyTo: inboxOf(client), CorrelationId: m.CorrelationId}
+	if reply.CorrelationId == "" {
+		reply.CorrelationId = autoId()
+	}
+	ps.SubscribeWith(client, reply.ReplyTo, SubscribeOptions{Envelope: true})
+	client.Send(requestedMessage(m.Topic, reply))
+
+	message := []byte(m.Message)
+	if m.Data != nil {
+		message = m.Data
+	}
+	if !ps.conformsToSchema(client, m.Topic, message) {
+		return
+	}
+	ctx = withReply(withPublisher(ctx, ps.publisherOf(client, m)), reply)
+	ctx = withEchoSource(ctx, &echoSource{ClientId: client.Id, Exclude: m.NoEcho})
+	ps.PublishContext(ctx, m.Topic, message, nil)
+}
+
+// Function to build the frame telling a client where the replies to its request go.
+// Parameters:
+// topic: string - The topic the request was published to.
+// reply: replyHeaders - The inbox and correlation ID of the request.
+// Returns:
+// []byte - The JSON encoded frame.
+func requestedMessage(topic string, reply replyHeaders) []byte {
+	message, _ := json.Marshal(map[string]string{
+		"action":        REQUESTED,
+		"topic":         topic,
+		"replyTo":       reply.ReplyTo,
+		"correlationId": reply.CorrelationId,
+	})
+	return message
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// mustRead reads the next frame of a peer.
+func mustRead(t *testing.T, peer *websocket.Conn) []byte {
+	t.Helper()
+	_, data, err := peer.ReadMessage()
+	assert.NoError(t, err)
+	return data
+}
+
+// readFrame reads the next frame of a peer as JSON.
+func readFrame(t *testing.T, peer *websocket.Conn) map[string]interface{} {
+	t.Helper()
+	var frame map[string]interface{}
+	assert.NoError(t, json.Unmarshal(mustRead(t, peer), &frame))
+	return frame
+}
+
+func TestRequestReply(t *testing.T) {
+	pubsub := &PubSub{}
+	requester, requesterPeer := newTestClient(t)
+	responder, responderPeer := newTestClient(t)
+	pubsub.HandleRecvdMessage(responder, 1, []byte(`{"action":"subscribe","topic":"quotes","envelope":true}`))
+
+	pubsub.HandleRecvdMessage(requester, 1, []byte(`{"action":"request","topic":"quotes","message":{"symbol":"ACME"}}`))
+	requested := readFrame(t, requesterPeer)
+	assert.Equal(t, REQUESTED, requested["action"])
+	assert.Equal(t, "$inbox."+requester.Id, requested["replyTo"])
+	correlationId, _ := requested["correlationId"].(string)
+	assert.NotEmpty(t, correlationId, "A correlation ID should be generated")
+
+	request := readFrame(t, responderPeer)
+	assert.Equal(t, map[string]interface{}{"symbol": "ACME"}, request["message"])
+	assert.Equal(t, requested["replyTo"], request["replyTo"])
+	assert.Equal(t, correlationId, request["correlationId"])
+
+	reply, _ := json.Marshal(map[string]interface{}{"action": "publish", "topic": request["replyTo"], "correlationId": correlationId, "message": map[string]float64{"price": 42}})
+	pubsub.HandleRecvdMessage(responder, 1, reply)
+	answer := readFrame(t, requesterPeer)
+	assert.Equal(t, "$inbox."+requester.Id, answer["topic"])
+	assert.Equal(t, correlationId, answer["correlationId"])
+	assert.Equal(t, map[string]interface{}{"price": float64(42)}, answer["message"])
+
+	// A correlation ID given by the requester is kept
+	pubsub.HandleRecvdMessage(requester, 1, []byte(`{"action":"request","topic":"quotes","message":{},"correlationId":"q2"}`))
+	assert.Equal(t, "q2", readFrame(t, requesterPeer)["correlationId"])
+	assert.Equal(t, "q2", readFrame(t, responderPeer)["correlationId"])
+}
+
+func TestInboxesArePrivate(t *testing.T) {
+	pubsub := &PubSub{History: NewMemoryHistory(JSONEntryCodec{}, 10)}
+	client, peer := newTestClient(t)
+
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"$inbox.someone-else"}`))
+	assert.JSONEq(t, string(forbiddenMessage(SUBSCRIBE, "$inbox.someone-else")), string(mustRead(t, peer)))
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"request","topic":"$inbox.someone-else","message":{}}`))
+	assert.JSONEq(t, string(forbiddenMessage(REQUEST, "$inbox.someone-else")), string(mustRead(t, peer)))
+
+	pubsub.deliver(context.Background(), "r1", "$inbox.someone-else", []byte(`{"price":42}`))
+	entries, err := pubsub.History.Entries("$inbox.someone-else")
+	assert.NoError(t, err)
+	assert.Empty(t, entries, "Replies should not be kept in the history")
+}
@@ -0,0 +1,218 @@
+// This file lets clients report abusive messages by their ID and lets admins redact
+// them: the message is removed from the history and the subscribers of the topic are
+// told to delete their local copy, as moderated chat deployments require.
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Protocol action to report a message
+const REPORT = "report"
+
+// Reasons are free text, truncated to keep the report store small
+const maxReportReasonLength = 500
+
+var errUnknownReport = errors.New("unknown report")
+
+// Report is a message reported by a client for moderation.
+type Report struct {
+	Id        string    `json:"id"`
+	MessageId string    `json:"messageId"`
+	Topic     string    `json:"topic"`
+	Reporter  string    `json:"reporter"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// ReportStore keeps the open reports. The zero value is an empty store.
+type ReportStore struct {
+	reports map[string]Report
+	mu      sync.Mutex
+}
+
+// Function to file a report.
+// Parameters:
+// report: Report - The report; its ID and creation time are filled in.
+// Returns:
+// Report - The stored report.
+func (s *ReportStore) Add(report Report) Report {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.reports == nil {
+		s.reports = map[string]Report{}
+	}
+	report.Id = autoId()
+	report.CreatedAt = time.Now().UTC()
+	s.reports[report.Id] = report
+	return report
+}
+
+// Function to list the open reports.
+// Returns:
+// []Report - The reports, oldest first.
+func (s *ReportStore) List() []Report {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reports := make([]Report, 0, len(s.reports))
+	for _, report := range s.reports {
+		reports = append(reports, report)
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].CreatedAt.Before(reports[j].CreatedAt) })
+	return reports
+}
+
+// Function to dismiss a report without redacting the message.
+// Parameters:
+// id: string - The ID of the report.
+// Returns:
+// bool - False if the report does not exist.
+func (s *ReportStore) Dismiss(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.reports[id]; !ok {
+		return false
+	}
+	delete(s.reports, id)
+	return true
+}
+
+// Function to close every report about a message.
+// Parameters:
+// topic: string - The topic the message was published to.
+// messageId: string - The ID of the message.
+func (s *ReportStore) resolve(topic string, messageId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, report := range s.reports {
+		if report.Topic == topic && report.MessageId == messageId {
+			delete(s.reports, id)
+		}
+	}
+}
+
+// Function to handle a report sent by a client. Clients may only report messages of
+// topics they have access to.
+// Parameters:
+// client: *Client - The reporting client.
+// m: Message - The report action, with the topic, the message ID and an optional reason.
+func (ps *PubSub) handleReport(client *Client, m Message) {
+	if m.Topic == "" || m.Id == "" {
+		client.Send(errorMessage("invalid_report", m.Topic))
+		return
+	}
+	if !ps.canAccessTopic(m.Topic, client, SUBSCRIBE) {
+		ps.refuse(client, m)
+		return
+	}
+
+	reporter := client.Principal()
+	if reporter == "" {
+		reporter = client.Id
+	}
+	reason := m.Reason
+	if len(reason) > maxReportReasonLength {
+		reason = reason[:maxReportReasonLength]
+	}
+	report := ps.Reports.Add(Report{MessageId: m.Id, Topic: m.Topic, Reporter: reporter, Reason: reason})
+	client.logger().Info("Message reported", logKeyAction, REPORT, logKeyTopic, report.Topic, "report_id", report.Id, "message_id", report.MessageId, "reporter", reporter)
+}
+
+// Function to redact a message: it is removed from the history, the reports about it
+// are closed and the subscribers of the topic are told to delete it.
+// Parameters:
+// topic: string - The topic the message was published to.
+// id: string - The ID of the message.
+// Returns:
+// bool - False if the message was not in the history. Subscribers are told either way
+// since they may still hold a message the history no longer keeps.
+func (ps *PubSub) Redact(topic string, id string) bool {
+	found := false
+	if ps.History != nil {
+		found = ps.History.Redact(topic, id)
+	}
+	ps.Reports.resolve(topic, id)
+
+	ps.mu.Lock()
+	subscriptions := ps.GetSubscriptions(topic, nil)
+	ps.mu.Unlock()
+
+	notification, _ := json.Marshal(map[string]string{"action": "redact", "topic": topic, "id": id})
+	for _, sub := range subscriptions {
+		sub.Client.Deliver(topic, notification)
+	}
+	return found
+}
+
+// Function to wrap a delivered message in an envelope carrying its ID, so clients
+// can report it and act on redactions. JSON messages are embedded as is, any other
+// message is base64 encoded.
+// Parameters:
+// id: string - The ID of the message.
+// topic: string - The topic the message was published to.
+// message: []byte - The published message.
+// trace: map[string]string - The trace context of the delivery, or nil.
+// publisher: string - The principal that published the message, or "".
+// reply: replyHeaders - Where the replies to the message go and their correlation ID, if any.
+// Returns:
+// []byte - The JSON encoded envelope.
+func envelopeMessage(id string, topic string, message []byte, trace map[string]string, publisher string, reply replyHeaders) []byte {
+	envelope := struct {
+		Action        string            `json:"action"`
+		Topic         string            `json:"topic"`
+		Id            string            `json:"id"`
+		Publisher     string            `json:"publisher,omitempty"`
+		Message       json.RawMessage   `json:"message,omitempty"`
+		Data          string            `json:"data,omitempty"`
+		Trace         map[string]string `json:"trace,omitempty"`
+		ReplyTo       string            `json:"replyTo,omitempty"`
+		CorrelationId string            `json:"correlationId,omitempty"`
+	}{Action: "message", Topic: topic, Id: id, Publisher: publisher, Trace: trace, ReplyTo: reply.ReplyTo, CorrelationId: reply.CorrelationId}
+	if json.Valid(message) {
+		envelope.Message = message
+	} else {
+		envelope.Data = base64.StdEncoding.EncodeToString(message)
+	}
+	data, _ := json.Marshal(envelope)
+	return data
+}
+
+// Function to build an error frame.
+// Parameters:
+// code: string - The machine-readable error code.
+// topic: string - The topic of the failed request.
+// Returns:
+// []byte - The JSON encoded frame.
+func errorMessage(code string, topic string) []byte {
+	message, _ := json.Marshal(map[string]string{"action": "error", "code": code, "topic": topic})
+	return message
+}
+
+// Function to register the admin API to review reports and redact messages.
+// Parameters:
+// mux: *http.ServeMux - The mux to register the routes on.
+// pubsub: *PubSub - The PubSub the routes serve.
+func setupReportRoutes(mux *http.ServeMux, pubsub *PubSub) {
+	mux.HandleFunc("GET /admin/reports", pubsub.requireAPIKey(PermissionAdmin, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, pubsub.Reports.List())
+	}))
+
+	mux.HandleFunc("DELETE /admin/reports/{id}", pubsub.requireAPIKey(PermissionAdmin, func(w http.ResponseWriter, r *http.Request) {
+		if !pubsub.Reports.Dismiss(r.PathValue("id")) {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	mux.HandleFunc("POST /admin/topics/{topic}/messages/{id}/redact", pubsub.requireAPIKey(PermissionAdmin, func(w http.ResponseWriter, r *http.Request) {
+		pubsub.Redact(r.PathValue("topic"), r.PathValue("id"))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
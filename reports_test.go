@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnvelopeSubscriptionsCarryMessageIds(t *testing.T) {
+	ps := &PubSub{}
+	client, peer := newTestClient(t)
+	ps.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"chat","envelope":true}`))
+
+	ps.Publish("chat", []byte(`{"text":"hi"}`), nil)
+	ps.Publish("chat", []byte("binary"), nil)
+
+	var envelope map[string]interface{}
+	assert.NoError(t, peer.ReadJSON(&envelope))
+	assert.Equal(t, "message", envelope["action"])
+	assert.NotEmpty(t, envelope["id"])
+	assert.Equal(t, map[string]interface{}{"text": "hi"}, envelope["message"])
+
+	assert.NoError(t, peer.ReadJSON(&envelope))
+	assert.Equal(t, "YmluYXJ5", envelope["data"], "Non-JSON messages should be base64 encoded")
+}
+
+func TestReportAndRedact(t *testing.T) {
+	ps := &PubSub{History: NewMemoryHistory(JSONEntryCodec{}, 10)}
+	alice, alicePeer := newTestClient(t)
+	alice.Claims = jwt.MapClaims{"sub": "alice"}
+	ps.HandleRecvdMessage(alice, 1, []byte(`{"action":"subscribe","topic":"chat","envelope":true}`))
+
+	ps.Publish("chat", []byte(`"spam"`), nil)
+	var envelope map[string]string
+	assert.NoError(t, alicePeer.ReadJSON(&envelope))
+	id := envelope["id"]
+
+	report, _ := json.Marshal(Message{Action: REPORT, Topic: "chat", Id: id, Reason: "spam"})
+	ps.HandleRecvdMessage(alice, 1, report)
+	reports := ps.Reports.List()
+	assert.Len(t, reports, 1)
+	assert.Equal(t, "alice", reports[0].Reporter)
+	assert.Equal(t, id, reports[0].MessageId)
+
+	assert.True(t, ps.Redact("chat", id))
+	entries, _ := ps.History.Entries("chat")
+	assert.Empty(t, entries, "Redacted messages should be removed from the history")
+	assert.Empty(t, ps.Reports.List(), "Redacting a message should close its reports")
+
+	var redaction map[string]string
+	assert.NoError(t, alicePeer.ReadJSON(&redaction))
+	assert.Equal(t, map[string]string{"action": "redact", "topic": "chat", "id": id}, redaction)
+}
+
+func TestReportRequiresMessageId(t *testing.T) {
+	ps := &PubSub{}
+	client, peer := newTestClient(t)
+
+	ps.HandleRecvdMessage(client, 1, []byte(`{"action":"report","topic":"chat"}`))
+
+	var reply map[string]string
+	assert.NoError(t, peer.ReadJSON(&reply))
+	assert.Equal(t, "invalid_report", reply["code"])
+	assert.Empty(t, ps.Reports.List())
+}
+
+func TestReportAdminRoutes(t *testing.T) {
+	keys := NewAPIKeyStore()
+	isolatePubSub(t).apiKeys = keys
+	keys.Add("root", "admin", []string{PermissionAdmin})
+
+	first := ps.Reports.Add(Report{MessageId: "m1", Topic: "admin-chat", Reporter: "bob"})
+	ps.Reports.Add(Report{MessageId: "m2", Topic: "admin-chat", Reporter: "bob"})
+
+	mux := http.NewServeMux()
+	setupReportRoutes(mux, ps)
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, target, nil)
+		request.Header.Set(apiKeyHeader, "root")
+		response := httptest.NewRecorder()
+		mux.ServeHTTP(response, request)
+		return response
+	}
+
+	var listed []Report
+	response := serve("GET", "/admin/reports")
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &listed))
+	assert.Len(t, listed, 2)
+
+	assert.Equal(t, http.StatusNoContent, serve("DELETE", "/admin/reports/"+first.Id).Code)
+	assert.Equal(t, http.StatusNotFound, serve("DELETE", "/admin/reports/"+first.Id).Code)
+	assert.Equal(t, http.StatusNoContent, serve("POST", "/admin/topics/admin-chat/messages/m2/redact").Code)
+	assert.Empty(t, ps.Reports.List())
+}
@@ -0,0 +1,254 @@
+// This file lets clients resume their session after a brief disconnect. The welcome
+// frame of every connection carries a session token; a client reconnecting within the
+// session grace period with ?resume=<token> on its upgrade request gets its client ID,
+// metadata and session subscriptions back, and a new token. Tokens are single use and
+// only valid for the principal they were issued to. Messages published to the session
+// subscriptions while the session is suspended are queued for it (see offline.go).
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Query parameter of the upgrade request carrying the token of the session to resume
+const resumeParam = "resume"
+
+// Default of how long a disconnected session can be resumed
+const defaultSessionGrace = 2 * time.Minute
+
+var sessionResumptions = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "gowebsockets_session_resumptions_total",
+	Help: "Number of connections presenting a session token, by result.",
+}, []string{"result"})
+
+// suspendedSession is the state of a disconnected client kept for it to resume.
+type suspendedSession struct {
+	clientId   string
+	principal  string
+	name       string
+	attributes map[string]string
+	// The client had done something else, so its metadata could no longer change
+	frozen        bool
+	subscriptions []StoredSubscription
+	// Messages published to its subscriptions since, oldest first
+	queued []offlineMessage
+	expiry *time.Timer
+	// When its grace period is over
+	expires time.Time
+	// Called once a session handed over by another node is resumed, or nil
+	onResume func()
+}
+
+// SessionStore keeps the sessions of disconnected clients until they are resumed or
+// their grace period is over.
+type SessionStore struct {
+	// How long a disconnected session can be resumed
+	Grace time.Duration
+	// How many messages are queued for each suspended session, 0 for none
+	QueueSize int
+
+	mu sync.Mutex
+	// Suspended sessions by token
+	suspended map[string]*suspendedSession
+	// Set once the sessions are handed over to other nodes, instead of being kept
+	handOff func(token string, session *suspendedSession)
+}
+
+// Function to create a store of sessions.
+// Parameters:
+// grace: time.Duration - How long a disconnected session can be resumed, 0 for the default.
+// Returns:
+// *SessionStore - The store.
+func NewSessionStore(grace time.Duration) *SessionStore {
+	if grace <= 0 {
+		grace = defaultSessionGrace
+	}
+	return &SessionStore{Grace: grace, QueueSize: defaultOfflineQueueSize, suspended: map[string]*suspendedSession{}}
+}
+
+// Function to issue a token to resume a session with.
+// Returns:
+// string - The token.
+func (s *SessionStore) Issue() string {
+	random := make([]byte, 32)
+	rand.Read(random)
+	return hex.EncodeToString(random)
+}
+
+// Function to keep a session for the grace period.
+// Parameters:
+// token: string - The token issued to the session.
+// session: *suspendedSession - Its state.
+func (s *SessionStore) suspend(token string, session *suspendedSession) {
+	s.mu.Lock()
+	handOff := s.handOff
+	if handOff == nil {
+		s.keepLocked(token, session, s.Grace)
+	}
+	s.mu.Unlock()
+	if handOff != nil {
+		session.expires = time.Now().Add(s.Grace)
+		handOff(token, session)
+	}
+}
+
+// Function to keep a session until its grace period is over. The lock must be held.
+// Parameters:
+// token: string - The token issued to the session.
+// session: *suspendedSession - Its state.
+// grace: time.Duration - How long it can still be resumed.
+func (s *SessionStore) keepLocked(token string, session *suspendedSession, grace time.Duration) {
+	session.expires = time.Now().Add(grace)
+	session.expiry = time.AfterFunc(grace, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.suspended[token] == session {
+			delete(s.suspended, token)
+		}
+	})
+	s.suspended[token] = session
+}
+
+// Function to take a suspended session out of the store to resume it.
+// Parameters:
+// token: string - The token presented.
+// principal: string - The principal of the client presenting it.
+// Returns:
+// *suspendedSession - The session, or nil if the token is unknown, expired or was issued to another principal.
+func (s *SessionStore) resume(token string, principal string) *suspendedSession {
+	s.mu.Lock()
+	session, ok := s.suspended[token]
+	if !ok || session.principal != principal {
+		s.mu.Unlock()
+		return nil
+	}
+	session.expiry.Stop()
+	delete(s.suspended, token)
+	s.mu.Unlock()
+	if session.onResume != nil {
+		session.onResume()
+	}
+	return session
+}
+
+// Function to hand the suspended sessions over to other nodes before this one restarts:
+// those kept are taken out of the store, and those suspended from then on are handed
+// over as soon as their client disconnects.
+// Parameters:
+// handOff: func(token string, session *suspendedSession) - Hands a session over.
+func (s *SessionStore) handOver(handOff func(token string, session *suspendedSession)) {
+	s.mu.Lock()
+	sessions := s.suspended
+	for _, session := range sessions {
+		session.expiry.Stop()
+	}
+	s.suspended = map[string]*suspendedSession{}
+	s.handOff = handOff
+	s.mu.Unlock()
+	for token, session := range sessions {
+		handOff(token, session)
+	}
+}
+
+// Function to keep a session handed over by another node for the rest of its grace period.
+// Parameters:
+// token: string - The token issued to the session.
+// session: *suspendedSession - Its state, with the time its grace period is over.
+// onResume: func() - Called if the session is resumed on this node.
+// Returns:
+// bool - False if the session was already kept or its grace period is over.
+func (s *SessionStore) adopt(token string, session *suspendedSession, onResume func()) bool {
+	grace := time.Until(session.expires)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.suspended[token]; ok || grace <= 0 {
+		return false
+	}
+	session.onResume = onResume
+	s.keepLocked(token, session, grace)
+	return true
+}
+
+// Function to forget a session, once another node resumed it.
+// Parameters:
+// token: string - The token issued to the session.
+func (s *SessionStore) forget(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if session, ok := s.suspended[token]; ok {
+		session.expiry.Stop()
+		delete(s.suspended, token)
+	}
+}
+
+// Function to resume the session whose token a connecting client presented. The client
+// takes the ID and, unless its upgrade request gave its own, the metadata of the session.
+// Parameters:
+// client: *Client - The client, not added yet.
+// token: string - The token presented, or "" for none.
+// Returns:
+// *suspendedSession - The session whose subscriptions to restore once the client is added, or nil if none was resumed.
+func (ps *PubSub) resumeSession(client *Client, token string) *suspendedSession {
+	if ps.Sessions == nil || client.Session == nil {
+		return nil
+	}
+	var resumed *suspendedSession
+	if token != "" {
+		if session := ps.Sessions.resume(token, client.Principal()); session != nil {
+			sessionResumptions.WithLabelValues("resumed").Inc()
+			client.Id = session.clientId
+			if client.Metadata == nil || client.Metadata.Name() == "" && len(client.Metadata.Attributes()) == 0 {
+				client.Metadata = &ClientMetadata{name: session.name, attributes: session.attributes, frozen: session.frozen}
+			}
+			client.Session.resumed = true
+			client.logger().Info("Session resumed", "subscriptions", len(session.subscriptions), "queued", len(session.queued))
+			resumed = session
+		} else {
+			sessionResumptions.WithLabelValues("unknown").Inc()
+			client.logger().Info("Session could not be resumed")
+		}
+	}
+	// Tokens are single use, so every connection gets a new one
+	client.Session.resumeToken = ps.Sessions.Issue()
+	return resumed
+}
+
+// Function to restore the session subscriptions of a resumed session, redelivering the
+// messages queued for them.
+// Parameters:
+// client: *Client - The client, added.
+// session: *suspendedSession - The session resumed, or nil for none.
+func (ps *PubSub) restoreSession(client *Client, session *suspendedSession) {
+	if session != nil {
+		ps.restoreSubscriptions(client, session.subscriptions, session.queued)
+	}
+}
+
+// Function to suspend the session of a client that disconnected, keeping its ID,
+// metadata and session subscriptions for it to resume.
+// Parameters:
+// client: *Client - The client.
+// subscriptions: []Subscription - The subscriptions it had.
+func (ps *PubSub) suspendSession(client *Client, subscriptions []Subscription) {
+	if ps.Sessions == nil || client.Session == nil || client.Session.resumeToken == "" {
+		return
+	}
+	session := &suspendedSession{clientId: client.Id, principal: client.Principal()}
+	if client.Metadata != nil {
+		client.Metadata.mu.Lock()
+		session.name, session.attributes, session.frozen = client.Metadata.name, client.Metadata.attributes, client.Metadata.frozen
+		client.Metadata.mu.Unlock()
+	}
+	for _, sub := range subscriptions {
+		if sub.Lifetime == LifetimeSession {
+			session.subscriptions = append(session.subscriptions, storedSubscriptionOf(sub))
+		}
+	}
+	ps.Sessions.suspend(client.Session.resumeToken, session)
+}
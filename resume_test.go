@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResumeSession(t *testing.T) {
+	isolatePubSub(t)
+	ps.Sessions = NewSessionStore(time.Minute)
+	server := httptest.NewServer(http.HandlerFunc(ps.webSocketHandler))
+	defer server.Close()
+	dial := func(query string) (*websocket.Conn, welcomeFrame) {
+		ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ws.Close() })
+		var welcome welcomeFrame
+		assert.NoError(t, ws.ReadJSON(&welcome))
+		return ws, welcome
+	}
+
+	ws, first := dial("?name=Alice")
+	assert.NotEmpty(t, first.SessionToken)
+	assert.False(t, first.Resumed)
+	ws.WriteJSON(map[string]interface{}{"action": SUBSCRIBE, "topic": "orders", "lifetime": "session"})
+	ws.WriteJSON(map[string]interface{}{"action": SUBSCRIBE, "topic": "prices"})
+	for range 3 {
+		ws.ReadMessage()
+	}
+	ws.Close()
+	assert.Eventually(t, func() bool { return !isConnected(first.ClientId) }, time.Second, 10*time.Millisecond)
+
+	ws, second := dial("?resume=" + first.SessionToken)
+	assert.Equal(t, first.ClientId, second.ClientId, "A resumed session keeps its client ID")
+	assert.True(t, second.Resumed)
+	assert.NotEqual(t, first.SessionToken, second.SessionToken, "Every connection gets a new token")
+	var restored map[string]interface{}
+	assert.NoError(t, ws.ReadJSON(&restored))
+	assert.Equal(t, map[string]interface{}{"action": SUBSCRIBED, "topic": "orders", "lifetime": "session", "restored": true}, restored)
+	client := &Client{Id: second.ClientId}
+	assert.Equal(t, 1, subscriptionCount(ps, client, "orders"))
+	assert.Equal(t, 0, subscriptionCount(ps, client, "prices"), "Connection subscriptions are not resumed")
+	ps.mu.Lock()
+	for _, connected := range ps.Clients() {
+		if connected.Id == second.ClientId {
+			assert.Equal(t, "Alice", connected.Metadata.Name(), "A resumed session keeps its metadata")
+		}
+	}
+	ps.mu.Unlock()
+
+	_, third := dial("?resume=" + first.SessionToken)
+	assert.NotEqual(t, first.ClientId, third.ClientId, "Tokens are single use")
+	assert.False(t, third.Resumed)
+}
+
+func TestSessionStoreChecksPrincipalAndGrace(t *testing.T) {
+	store := NewSessionStore(50 * time.Millisecond)
+	store.suspend("t1", &suspendedSession{clientId: "c1", principal: "alice"})
+	assert.Nil(t, store.resume("t1", "mallory"), "Tokens are only valid for their principal")
+	assert.Equal(t, "c1", store.resume("t1", "alice").clientId)
+
+	store.suspend("t2", &suspendedSession{clientId: "c2"})
+	time.Sleep(100 * time.Millisecond)
+	assert.Nil(t, store.resume("t2", ""), "Sessions cannot be resumed after the grace period")
+}
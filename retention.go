@@ -0,0 +1,167 @@
+// This file assigns a retention tier to every topic from a policy of topic patterns,
+// so how much history a topic keeps is decided in one place instead of by each
+// feature storing messages.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// RetentionTier decides how many of the messages published to a topic are kept.
+type RetentionTier string
+
+const (
+	// Nothing is kept, not even the retained message
+	RetainNone RetentionTier = "none"
+	// Only the latest message is kept, as the retained message
+	RetainLastValue RetentionTier = "last_value"
+	// The latest messages are kept, up to the short history limit
+	RetainShort RetentionTier = "short"
+	// Every message is kept
+	RetainDurable RetentionTier = "durable"
+)
+
+// RetentionRule assigns a tier to the topics matching Topic, a glob where * matches
+// any sequence of characters and ? matches a single character.
+type RetentionRule struct {
+	Topic string        `json:"topic"`
+	Tier  RetentionTier `json:"tier"`
+}
+
+// RetentionPolicy assigns the tier of the first matching rule to a topic, and Default
+// to the topics no rule matches.
+type RetentionPolicy struct {
+	Default RetentionTier   `json:"default"`
+	Rules   []RetentionRule `json:"rules"`
+	// Number of messages kept by the short tier, the history limit when 0
+	ShortLimit int `json:"shortLimit"`
+}
+
+// Function to load a retention policy from a JSON file, e.g.
+// {"default": "none", "shortLimit": 50, "rules": [{"topic": "prices.*", "tier": "last_value"}, {"topic": "orders.*", "tier": "durable"}]}
+// Parameters:
+// path: string - The path of the JSON file.
+// Returns:
+// *RetentionPolicy - The policy.
+// error - An error if the file could not be read or names an unknown tier.
+func LoadRetentionPolicy(path string) (*RetentionPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	policy := &RetentionPolicy{}
+	if err := json.Unmarshal(data, policy); err != nil {
+		return nil, err
+	}
+	if err := policy.validate(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// Function to check that the policy only names known tiers.
+// Returns:
+// error - An error naming the first unknown tier.
+func (p *RetentionPolicy) validate() error {
+	tiers := []RetentionTier{p.Default}
+	for _, rule := range p.Rules {
+		tiers = append(tiers, rule.Tier)
+	}
+	for _, tier := range tiers {
+		switch tier {
+		case "", RetainNone, RetainLastValue, RetainShort, RetainDurable:
+		default:
+			return fmt.Errorf("unknown retention tier %q", tier)
+		}
+	}
+	return nil
+}
+
+// Function to get the retention tier of a topic.
+// Parameters:
+// topic: string - The topic.
+// Returns:
+// RetentionTier - The tier of the first rule matching the topic, or the default tier.
+func (p *RetentionPolicy) Tier(topic string) RetentionTier {
+	if p == nil {
+		return RetainShort
+	}
+	for _, rule := range p.Rules {
+		if globMatch(rule.Topic, topic) {
+			return rule.Tier
+		}
+	}
+	if p.Default == "" {
+		return RetainShort
+	}
+	return p.Default
+}
+
+// Function to get how many messages of a topic are kept.
+// Parameters:
+// topic: string - The topic.
+// historyLimit: int - The limit of the history, used by the short tier.
+// Returns:
+// int - The number of messages kept, or -1 when every message is kept.
+func (p *RetentionPolicy) Limit(topic string, historyLimit int) int {
+	return p.tierLimit(p.Tier(topic), historyLimit)
+}
+
+// Function to get how many messages a retention tier keeps.
+// Parameters:
+// tier: RetentionTier - The tier.
+// historyLimit: int - The limit of the history, used by the short tier.
+// Returns:
+// int - The number of messages kept, or -1 when every message is kept.
+func (p *RetentionPolicy) tierLimit(tier RetentionTier, historyLimit int) int {
+	switch tier {
+	case RetainNone:
+		return 0
+	case RetainLastValue:
+		return 1
+	case RetainDurable:
+		return -1
+	}
+	if p != nil && p.ShortLimit > 0 {
+		return p.ShortLimit
+	}
+	if historyLimit <= 0 {
+		return -1
+	}
+	return historyLimit
+}
+
+// Function to get how many messages of a topic the history keeps. The caller must hold h.mu.
+// Parameters:
+// topic: string - The topic.
+// Returns:
+// int - The number of messages kept, or -1 when every message is kept.
+func (h *MemoryHistory) limitLocked(topic string) int {
+	if tier, ok := h.tiers[topic]; ok {
+		return h.Retention.tierLimit(tier, h.Limit)
+	}
+	return h.Retention.Limit(topic, h.Limit)
+}
+
+// Function to set the retention tier of a single topic, overriding the retention policy,
+// and drop the entries the tier no longer keeps.
+// Parameters:
+// topic: string - The topic.
+// tier: RetentionTier - The tier, or "" to follow the retention policy again.
+func (h *MemoryHistory) SetTier(topic string, tier RetentionTier) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if tier == "" {
+		delete(h.tiers, topic)
+	} else {
+		if h.tiers == nil {
+			h.tiers = map[string]RetentionTier{}
+		}
+		h.tiers[topic] = tier
+	}
+	if limit := h.limitLocked(topic); limit >= 0 && len(h.topics[topic]) > limit {
+		h.topics[topic] = h.topics[topic][len(h.topics[topic])-limit:]
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetentionPolicyTier(t *testing.T) {
+	policy := &RetentionPolicy{
+		Default: RetainNone,
+		Rules: []RetentionRule{
+			{Topic: "prices.*", Tier: RetainLastValue},
+			{Topic: "orders.*", Tier: RetainDurable},
+			{Topic: "*", Tier: RetainShort},
+		},
+	}
+	assert.Equal(t, RetainLastValue, policy.Tier("prices.eur"))
+	assert.Equal(t, RetainDurable, policy.Tier("orders.new"))
+	assert.Equal(t, RetainShort, policy.Tier("chat"), "The first matching rule should win")
+	assert.Equal(t, RetainNone, (&RetentionPolicy{Default: RetainNone}).Tier("chat"))
+
+	var noPolicy *RetentionPolicy
+	assert.Equal(t, RetainShort, noPolicy.Tier("chat"), "Without a policy every topic keeps a short history")
+	assert.Equal(t, 10, noPolicy.Limit("chat", 10))
+}
+
+func TestLoadRetentionPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "retention.json")
+	os.WriteFile(path, []byte(`{"default": "none", "shortLimit": 5, "rules": [{"topic": "chat.*", "tier": "short"}]}`), 0o600)
+	policy, err := LoadRetentionPolicy(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, policy.Limit("chat.lobby", 100))
+	assert.Equal(t, 0, policy.Limit("metrics", 100))
+
+	os.WriteFile(path, []byte(`{"rules": [{"topic": "*", "tier": "forever"}]}`), 0o600)
+	_, err = LoadRetentionPolicy(path)
+	assert.Error(t, err, "Unknown tiers should be refused")
+}
+
+func TestMemoryHistoryRespectsRetentionTiers(t *testing.T) {
+	history := NewMemoryHistory(JSONEntryCodec{}, 2)
+	history.Retention = &RetentionPolicy{Rules: []RetentionRule{
+		{Topic: "typing", Tier: RetainNone},
+		{Topic: "price", Tier: RetainLastValue},
+		{Topic: "orders", Tier: RetainDurable},
+	}}
+	for _, topic := range []string{"typing", "price", "chat", "orders"} {
+		for _, message := range []string{`1`, `2`, `3`} {
+			history.Append(autoId(), topic, []byte(message))
+		}
+	}
+
+	for topic, expected := range map[string]int{"typing": 0, "price": 1, "chat": 2, "orders": 3} {
+		entries, err := history.Entries(topic)
+		assert.NoError(t, err)
+		assert.Len(t, entries, expected, topic)
+	}
+	retained, ok, _ := history.Retained("price")
+	assert.True(t, ok)
+	assert.Equal(t, []byte(`3`), retained.Payload)
+	_, ok, _ = history.Retained("typing")
+	assert.False(t, ok, "A topic keeping nothing has no retained message")
+}
@@ -0,0 +1,646 @@
+// This file restarts the nodes of a cluster one at a time with a single admin call, so
+// operators can upgrade the fleet without going under a minimum capacity. The node the
+// call reaches coordinates: it asks every other node in turn to drain, checks that the
+// sessions of its clients were handed over to the other nodes, so the clients resume
+// them wherever they reconnect, and waits for it to rejoin the cluster before the next
+// one. It restarts itself last. A node restarts by shutting down gracefully, as on
+// SIGTERM, for its supervisor to start it again with the new version. A step that does
+// not complete in time stops the rolling restart. The coordinator announces to every
+// node which node it drains, and nodes only take restart and session frames from that
+// coordinator and that node, over their own links.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// How long each step of a rolling restart may take when the request does not say
+	defaultRolloutStepTimeout = 2 * time.Minute
+	// How often the coordinator checks on the node restarting
+	rolloutPollInterval = 50 * time.Millisecond
+)
+
+// RolloutState is how far a rolling restart, or one of its steps, went.
+type RolloutState string
+
+const (
+	RolloutPending    RolloutState = "pending"
+	RolloutDraining   RolloutState = "draining"
+	RolloutRestarting RolloutState = "restarting"
+	RolloutDone       RolloutState = "done"
+	RolloutRunning    RolloutState = "running"
+	RolloutCompleted  RolloutState = "completed"
+	RolloutFailed     RolloutState = "failed"
+)
+
+var errRolloutRunning = errors.New("a rolling restart is already running")
+
+// A rolling restart as announced by its coordinator
+type activeRollout struct {
+	id          string
+	coordinator string
+	// The node draining, whose sessions the other nodes adopt
+	draining string
+}
+
+// RolloutRequest starts a rolling restart.
+type RolloutRequest struct {
+	// Nodes that must keep serving while one restarts, all the others when 0
+	MinNodes int `json:"minNodes"`
+	// Disconnects per second when draining a node
+	Rate float64 `json:"rate"`
+	// How long each step may take, a Go duration such as 2m
+	StepTimeout string `json:"stepTimeout"`
+
+	stepTimeout time.Duration
+}
+
+// RolloutStep is the restart of one node.
+type RolloutStep struct {
+	Node    string       `json:"node"`
+	Address string       `json:"addr"`
+	State   RolloutState `json:"state"`
+	// Sessions the node handed over to the other nodes
+	Sessions int `json:"sessions"`
+	// The ID of the node once it rejoined the cluster
+	RestartedAs string `json:"restartedAs,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// Rollout is a rolling restart of the cluster, restarting one node per step.
+type Rollout struct {
+	Id       string        `json:"id"`
+	State    RolloutState  `json:"state"`
+	MinNodes int           `json:"minNodes"`
+	Steps    []RolloutStep `json:"steps"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// A session handed over by a draining node
+type migratedSession struct {
+	Token         string               `json:"token"`
+	ClientId      string               `json:"clientId"`
+	Principal     string               `json:"principal,omitempty"`
+	Name          string               `json:"name,omitempty"`
+	Attributes    map[string]string    `json:"attributes,omitempty"`
+	Frozen        bool                 `json:"frozen,omitempty"`
+	Subscriptions []StoredSubscription `json:"subscriptions,omitempty"`
+	Queued        []migratedMessage    `json:"queued,omitempty"`
+	// What is left of its grace period, rather than when it ends, as clocks differ between nodes
+	GraceMs int64 `json:"graceMs"`
+}
+
+// A message queued for a session handed over
+type migratedMessage struct {
+	Id      string `json:"id"`
+	Topic   string `json:"topic"`
+	Payload []byte `json:"payload"`
+	Binary  bool   `json:"binary,omitempty"`
+	Message []byte `json:"message"`
+	QoS     int    `json:"qos,omitempty"`
+}
+
+// Function to fill in the defaults of a rolling restart request and check it.
+// Parameters:
+// peers: int - The number of other nodes linked to the coordinator.
+// Returns:
+// error - An error if the cluster cannot keep the minimum capacity or the step timeout is invalid.
+func (request *RolloutRequest) validate(peers int) error {
+	if request.MinNodes == 0 {
+		request.MinNodes = peers
+	}
+	if request.MinNodes < 0 {
+		return fmt.Errorf("invalid minNodes %d", request.MinNodes)
+	}
+	if request.MinNodes > peers {
+		return fmt.Errorf("minNodes %d is more than the %d nodes left serving while one restarts", request.MinNodes, peers)
+	}
+	if request.Rate <= 0 {
+		request.Rate = defaultDrainRate
+	}
+	request.stepTimeout = defaultRolloutStepTimeout
+	if request.StepTimeout != "" {
+		timeout, err := time.ParseDuration(request.StepTimeout)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid stepTimeout %q", request.StepTimeout)
+		}
+		request.stepTimeout = timeout
+	}
+	return nil
+}
+
+// Function to start a rolling restart coordinated by this node: the other nodes restart
+// in the order of their address, and this node last.
+// Parameters:
+// request: RolloutRequest - The request.
+// Returns:
+// Rollout - The rolling restart started.
+// error - errRolloutRunning if one is already running, or an error if the request is invalid.
+func (c *Cluster) StartRollout(request RolloutRequest) (Rollout, error) {
+	members := c.Members()
+	if err := request.validate(len(members)); err != nil {
+		return Rollout{}, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.rollout != nil && c.rollout.State == RolloutRunning {
+		return Rollout{}, errRolloutRunning
+	}
+	rollout := &Rollout{Id: autoId(), State: RolloutRunning, MinNodes: request.MinNodes}
+	for _, member := range append(members, Member{NodeId: c.NodeId, Address: c.Address}) {
+		rollout.Steps = append(rollout.Steps, RolloutStep{Node: member.NodeId, Address: member.Address, State: RolloutPending})
+	}
+	c.rollout = rollout
+	slog.Info("Rolling restart started", "rollout", rollout.Id, "nodes", len(rollout.Steps), "min_nodes", request.MinNodes)
+	go c.runRollout(rollout, request)
+	return rollout.copy(), nil
+}
+
+// Function to get the last rolling restart coordinated by this node.
+// Returns:
+// Rollout - The rolling restart.
+// bool - False if this node did not coordinate any.
+func (c *Cluster) RolloutStatus() (Rollout, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.rollout == nil {
+		return Rollout{}, false
+	}
+	return c.rollout.copy(), true
+}
+
+// Function to copy a rolling restart, with the lock of the cluster held.
+// Returns:
+// Rollout - The copy.
+func (r *Rollout) copy() Rollout {
+	copied := *r
+	copied.Steps = append([]RolloutStep{}, r.Steps...)
+	return copied
+}
+
+// Function to run the steps of a rolling restart, stopping at the first that fails.
+// Parameters:
+// rollout: *Rollout - The rolling restart.
+// request: RolloutRequest - The validated request.
+func (c *Cluster) runRollout(rollout *Rollout, request RolloutRequest) {
+	for i := range rollout.Steps {
+		var step RolloutStep
+		c.updateStep(rollout, i, func(s *RolloutStep) { step = *s })
+		var err error
+		if step.Node == c.NodeId {
+			err = c.restartSelf(rollout, i, request)
+		} else {
+			err = c.restartPeer(rollout, i, request)
+		}
+		if err != nil {
+			c.announceRollout(rollout.Id, "")
+			slog.Error("Rolling restart failed", "rollout", rollout.Id, "node", step.Node, "peer", step.Address, "error", err)
+			c.updateStep(rollout, i, func(s *RolloutStep) {
+				s.State, s.Error = RolloutFailed, err.Error()
+				rollout.State, rollout.Error = RolloutFailed, fmt.Sprintf("restarting %s: %v", step.Address, err)
+			})
+			return
+		}
+	}
+}
+
+// Function to restart another node: once the cluster can spare it, it drains and hands
+// its sessions over, then restarts and rejoins.
+// Parameters:
+// rollout: *Rollout - The rolling restart.
+// i: int - The index of the step.
+// request: RolloutRequest - The validated request.
+// Returns:
+// error - An error if a stage of the step did not complete in time.
+func (c *Cluster) restartPeer(rollout *Rollout, i int, request RolloutRequest) error {
+	step := rollout.Steps[i]
+	if err := c.waitForCapacity(step.Node, request); err != nil {
+		return err
+	}
+
+	drained := make(chan clusterFrame, 1)
+	c.mu.Lock()
+	c.drainWaiters[step.Node] = drained
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.drainWaiters, step.Node)
+		c.mu.Unlock()
+	}()
+	c.announceRollout(rollout.Id, step.Node)
+	c.updateStep(rollout, i, func(s *RolloutStep) { s.State = RolloutDraining })
+	err := c.sendTo(step.Node, clusterFrame{Type: clusterRestart, Node: c.NodeId, Rollout: rollout.Id, Rate: request.Rate})
+	if err != nil {
+		return err
+	}
+	var frame clusterFrame
+	select {
+	case frame = <-drained:
+	case <-time.After(request.stepTimeout):
+		return fmt.Errorf("the node did not drain within %v", request.stepTimeout)
+	case <-c.done:
+		return fmt.Errorf("the coordinator stopped")
+	}
+	c.updateStep(rollout, i, func(s *RolloutStep) { s.State, s.Sessions = RolloutRestarting, frame.Count })
+
+	// The sessions are sent before the node reports it drained, but possibly over another link
+	migrated := c.waitUntil(request.stepTimeout, func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return len(c.adopted[step.Node]) >= frame.Count
+	})
+	if !migrated {
+		return fmt.Errorf("the %d sessions of the node were not handed over within %v", frame.Count, request.stepTimeout)
+	}
+
+	var restartedAs string
+	rejoined := c.waitUntil(request.stepTimeout, func() bool {
+		for _, member := range c.Members() {
+			if member.Address == step.Address && member.NodeId != step.Node {
+				restartedAs = member.NodeId
+				return true
+			}
+		}
+		return false
+	})
+	if !rejoined {
+		return fmt.Errorf("the node did not rejoin the cluster within %v", request.stepTimeout)
+	}
+	c.updateStep(rollout, i, func(s *RolloutStep) { s.State, s.RestartedAs = RolloutDone, restartedAs })
+	slog.Info("Node restarted", "rollout", rollout.Id, "node", step.Node, "restarted_as", restartedAs, "sessions", frame.Count)
+	return nil
+}
+
+// Function to restart the coordinator, the last step: once the cluster can spare it, it
+// drains and hands its sessions over, then restarts.
+// Parameters:
+// rollout: *Rollout - The rolling restart.
+// i: int - The index of the step.
+// request: RolloutRequest - The validated request.
+// Returns:
+// error - An error if the cluster could not spare this node in time.
+func (c *Cluster) restartSelf(rollout *Rollout, i int, request RolloutRequest) error {
+	if err := c.waitForCapacity(c.NodeId, request); err != nil {
+		return err
+	}
+	if !c.restarting.CompareAndSwap(false, true) {
+		return fmt.Errorf("the node is already restarting")
+	}
+	c.announceRollout(rollout.Id, c.NodeId)
+	c.updateStep(rollout, i, func(s *RolloutStep) { s.State = RolloutDraining })
+	count := c.drainAndHandOver(rollout.Id, request.Rate)
+	// This node cannot see itself rejoin, so the rolling restart completes here
+	c.updateStep(rollout, i, func(s *RolloutStep) {
+		s.State, s.Sessions = RolloutRestarting, count
+		rollout.State = RolloutCompleted
+	})
+	slog.Info("Rolling restart completed, restarting the coordinator", "rollout", rollout.Id, "sessions", count)
+	c.restart()
+	return nil
+}
+
+// Function to wait until enough nodes besides one are linked to serve while it restarts.
+// Parameters:
+// node: string - The ID of the node about to restart.
+// request: RolloutRequest - The validated request.
+// Returns:
+// error - An error if the cluster did not have the capacity in time.
+func (c *Cluster) waitForCapacity(node string, request RolloutRequest) error {
+	var serving int
+	ok := c.waitUntil(request.stepTimeout, func() bool {
+		serving = 0
+		if node != c.NodeId {
+			serving++
+		}
+		for _, member := range c.Members() {
+			if member.NodeId != node {
+				serving++
+			}
+		}
+		return serving >= request.MinNodes
+	})
+	if !ok {
+		return fmt.Errorf("only %d nodes would serve while it restarts, %d are required", serving, request.MinNodes)
+	}
+	return nil
+}
+
+// Function to wait for a condition, checking it at the poll interval.
+// Parameters:
+// timeout: time.Duration - How long to wait.
+// condition: func() bool - The condition.
+// Returns:
+// bool - False if the condition was not met in time or the cluster node was closed.
+func (c *Cluster) waitUntil(timeout time.Duration, condition func() bool) bool {
+	deadline := time.After(timeout)
+	for !condition() {
+		select {
+		case <-deadline:
+			return false
+		case <-c.done:
+			return false
+		case <-time.After(rolloutPollInterval):
+		}
+	}
+	return true
+}
+
+// Function to change a step of a rolling restart with the lock of the cluster held.
+// Parameters:
+// rollout: *Rollout - The rolling restart.
+// i: int - The index of the step.
+// update: func(*RolloutStep) - Changes the step, or the rolling restart.
+func (c *Cluster) updateStep(rollout *Rollout, i int, update func(*RolloutStep)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	update(&rollout.Steps[i])
+}
+
+// Function to tell every node which node a rolling restart drains next, so they accept
+// its restart and session frames, or that the rolling restart is over.
+// Parameters:
+// id: string - The ID of the rolling restart.
+// draining: string - The ID of the node to drain, or "" once the rolling restart is over.
+func (c *Cluster) announceRollout(id string, draining string) {
+	c.mu.Lock()
+	c.active = activeRollout{}
+	if draining != "" {
+		c.active = activeRollout{id: id, coordinator: c.NodeId, draining: draining}
+	}
+	c.mu.Unlock()
+	c.forward(clusterFrame{Type: clusterRollout, Node: c.NodeId, Rollout: id, Target: draining}, nil)
+}
+
+// Function to record the rolling restart a coordinator announced. Announcements are only
+// taken from the coordinator itself, over its own link, and not while this node
+// coordinates a rolling restart of its own.
+// Parameters:
+// link: *clusterLink - The link the announcement was received on.
+// frame: clusterFrame - The announcement.
+func (c *Cluster) rolloutAnnounced(link *clusterLink, frame clusterFrame) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if link.member.NodeId == "" || link.member.NodeId != frame.Node || c.rollout != nil && c.rollout.State == RolloutRunning {
+		slog.Warn("Refusing a rolling restart announcement", "node", frame.Node, "rollout", frame.Rollout)
+		return
+	}
+	if frame.Target == "" {
+		if c.active.coordinator == frame.Node && c.active.id == frame.Rollout {
+			c.active = activeRollout{}
+		}
+		return
+	}
+	c.active = activeRollout{id: frame.Rollout, coordinator: frame.Node, draining: frame.Target}
+}
+
+// Function to get the rolling restart a frame belongs to: it must come from the node it
+// names, over that node's own link, for the rolling restart announced to this node.
+// Parameters:
+// link: *clusterLink - The link the frame was received on.
+// frame: clusterFrame - The frame.
+// Returns:
+// activeRollout - The rolling restart.
+// bool - False if the frame is refused.
+func (c *Cluster) activeRolloutOf(link *clusterLink, frame clusterFrame) (activeRollout, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if link.member.NodeId == "" || link.member.NodeId != frame.Node || c.active.id == "" || c.active.id != frame.Rollout {
+		slog.Warn("Refusing a frame outside of an active rolling restart", "frame", frame.Type, "node", frame.Node, "rollout", frame.Rollout)
+		return activeRollout{}, false
+	}
+	return c.active, true
+}
+
+// Function to drain this node when the coordinator of a rolling restart asks for it,
+// tell the coordinator, then restart.
+// Parameters:
+// frame: clusterFrame - The restart frame from the coordinator.
+func (c *Cluster) drainForRestart(frame clusterFrame) {
+	if !c.restarting.CompareAndSwap(false, true) {
+		return
+	}
+	slog.Info("Draining for a rolling restart", "rollout", frame.Rollout, "coordinator", frame.Node)
+	count := c.drainAndHandOver(frame.Rollout, frame.Rate)
+	err := c.sendTo(frame.Node, clusterFrame{Type: clusterDrained, Node: c.NodeId, Rollout: frame.Rollout, Count: count})
+	if err != nil {
+		slog.Error("Error telling the coordinator this node drained", "rollout", frame.Rollout, "error", err)
+	}
+	c.restart()
+}
+
+// Function to drain this node: upgrades are refused so clients reconnect to other
+// nodes, every client is disconnected, and the session of each is handed over to the
+// other nodes as soon as it is suspended.
+// Parameters:
+// rollout: string - The ID of the rolling restart draining this node.
+// rate: float64 - Disconnects per second.
+// Returns:
+// int - The number of sessions handed over.
+func (c *Cluster) drainAndHandOver(rollout string, rate float64) int {
+	c.ps.options().shuttingDown.Store(true)
+	var handedOver atomic.Int64
+	if c.ps.Sessions != nil {
+		c.ps.Sessions.handOver(func(token string, session *suspendedSession) {
+			handedOver.Add(1)
+			c.forward(clusterFrame{Type: clusterSessions, Node: c.NodeId, Rollout: rollout, Sessions: []migratedSession{migratedSessionOf(token, session)}}, nil)
+		})
+	}
+	_, done := c.ps.Drain(DrainRequest{Mode: DrainGraceful, Reason: ReasonServerRestart, Rate: rate})
+	<-done
+	// Sessions are suspended once the connections of the drained clients are torn down
+	c.waitUntil(drainFlushTimeout, func() bool { return c.ps.closableClients() == 0 })
+	return int(handedOver.Load())
+}
+
+// Function to keep the sessions handed over by a draining node, for their clients to
+// resume them on this node. Sessions this node already keeps, or whose grace period ran
+// out on the way, are recorded as handed over all the same.
+// Parameters:
+// frame: clusterFrame - The sessions frame.
+func (c *Cluster) adoptSessions(frame clusterFrame) {
+	if c.ps.Sessions == nil {
+		return
+	}
+	for _, migrated := range frame.Sessions {
+		token := migrated.Token
+		c.ps.Sessions.adopt(token, migrated.session(), func() {
+			// The other nodes the session was handed over to must not resume it again
+			c.forward(clusterFrame{Type: clusterSessionResumed, Token: token}, nil)
+		})
+		c.mu.Lock()
+		if c.adopted[frame.Node] == nil {
+			c.adopted[frame.Node] = map[string]bool{}
+		}
+		c.adopted[frame.Node][token] = true
+		c.mu.Unlock()
+	}
+}
+
+// Function to pass the report of a node that drained to the rolling restart waiting for it.
+// Parameters:
+// frame: clusterFrame - The drained frame.
+func (c *Cluster) nodeDrained(frame clusterFrame) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if waiter, ok := c.drainWaiters[frame.Node]; ok {
+		select {
+		case waiter <- frame:
+		default:
+		}
+	}
+}
+
+// Function to send a frame to one linked node.
+// Parameters:
+// node: string - The ID of the node.
+// frame: clusterFrame - The frame.
+// Returns:
+// error - An error if the node is not linked or the frame could not be written.
+func (c *Cluster) sendTo(node string, frame clusterFrame) error {
+	c.mu.Lock()
+	var target *clusterLink
+	for link := range c.links {
+		if link.member.NodeId == node {
+			target = link
+			break
+		}
+	}
+	c.mu.Unlock()
+	if target == nil {
+		return fmt.Errorf("node %s is not linked", node)
+	}
+	return target.send(frame)
+}
+
+// Function to restart this node once it drained.
+func (c *Cluster) restart() {
+	if c.Restart != nil {
+		c.Restart()
+	}
+}
+
+// Function to restart the process: it shuts down gracefully as on SIGTERM, for its
+// supervisor to start it again.
+func restartProcess() {
+	process, err := os.FindProcess(os.Getpid())
+	if err == nil {
+		err = process.Signal(syscall.SIGTERM)
+	}
+	if err != nil {
+		slog.Error("Error restarting", "error", err)
+	}
+}
+
+// Function to count the clients that can be disconnected, those of the protocols with a
+// close frame.
+// Returns:
+// int - The number of clients.
+func (ps *PubSub) closableClients() int {
+	count := 0
+	for _, client := range ps.Clients() {
+		if client.Closable() {
+			count++
+		}
+	}
+	return count
+}
+
+// Function to describe a suspended session to hand it over.
+// Parameters:
+// token: string - The token issued to the session.
+// session: *suspendedSession - The session.
+// Returns:
+// migratedSession - The session as sent to the other nodes.
+func migratedSessionOf(token string, session *suspendedSession) migratedSession {
+	migrated := migratedSession{
+		Token:         token,
+		ClientId:      session.clientId,
+		Principal:     session.principal,
+		Name:          session.name,
+		Attributes:    session.attributes,
+		Frozen:        session.frozen,
+		Subscriptions: session.subscriptions,
+		GraceMs:       time.Until(session.expires).Milliseconds(),
+	}
+	for _, queued := range session.queued {
+		migrated.Queued = append(migrated.Queued, migratedMessage{
+			Id:      queued.id,
+			Topic:   queued.topic,
+			Payload: queued.payload.Data,
+			Binary:  queued.payload.Binary,
+			Message: queued.message,
+			QoS:     queued.qos,
+		})
+	}
+	return migrated
+}
+
+// Function to rebuild a session handed over by another node.
+// Returns:
+// *suspendedSession - The session, not kept yet.
+func (m migratedSession) session() *suspendedSession {
+	session := &suspendedSession{
+		clientId:      m.ClientId,
+		principal:     m.Principal,
+		name:          m.Name,
+		attributes:    m.Attributes,
+		frozen:        m.Frozen,
+		subscriptions: m.Subscriptions,
+		expires:       time.Now().Add(time.Duration(m.GraceMs) * time.Millisecond),
+	}
+	for _, queued := range m.Queued {
+		payload := NewPayload(queued.Payload)
+		payload.Binary = queued.Binary
+		session.queued = append(session.queued, offlineMessage{
+			id:      queued.Id,
+			topic:   queued.Topic,
+			payload: payload,
+			message: queued.Message,
+			qos:     queued.QoS,
+		})
+	}
+	return session
+}
+
+// Function to register the admin API starting and following rolling restarts.
+// Parameters:
+// mux: *http.ServeMux - The mux to register the routes on.
+// cluster: *Cluster - The cluster node coordinating the rolling restarts.
+func setupRolloutRoutes(mux *http.ServeMux, cluster *Cluster) {
+	mux.HandleFunc("POST /admin/cluster/restart", cluster.ps.requireAPIKey(PermissionAdmin, func(w http.ResponseWriter, r *http.Request) {
+		var request RolloutRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				http.Error(w, "invalid request", http.StatusBadRequest)
+				return
+			}
+		}
+		rollout, err := cluster.StartRollout(request)
+		switch {
+		case errors.Is(err, errRolloutRunning):
+			http.Error(w, err.Error(), http.StatusConflict)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			writeJSON(w, http.StatusAccepted, rollout)
+		}
+	}))
+
+	mux.HandleFunc("GET /admin/cluster/restart", cluster.ps.requireAPIKey(PermissionAdmin, func(w http.ResponseWriter, r *http.Request) {
+		rollout, ok := cluster.RolloutStatus()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, http.StatusOK, rollout)
+	}))
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// restartableTestNode is a cluster node served on a test server, whose restart starts a
+// new node at the same address joining the others, as a supervisor would.
+type restartableTestNode struct {
+	address string
+	// The addresses a restarted node joins
+	peers []string
+	// Whether a restart brings the node back
+	comesBack bool
+
+	mu       sync.Mutex
+	cluster  *Cluster
+	restarts int
+}
+
+func newRestartableTestNode(t *testing.T, comesBack bool) *restartableTestNode {
+	node := &restartableTestNode{comesBack: comesBack}
+	server := httptest.NewUnstartedServer(nil)
+	node.address = server.Listener.Addr().String()
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		node.current().ServeHTTP(w, r)
+	})
+	node.start()
+	server.Start()
+	t.Cleanup(func() {
+		node.current().Close()
+		server.Close()
+	})
+	return node
+}
+
+func (node *restartableTestNode) start() {
+	ps := &PubSub{Sessions: NewSessionStore(time.Minute)}
+	cluster := NewCluster(node.address, "s3cret", ps)
+	ps.Bridges = []Bridge{cluster}
+	cluster.Restart = node.restart
+	node.mu.Lock()
+	node.cluster = cluster
+	node.mu.Unlock()
+	cluster.Join(node.peers)
+}
+
+func (node *restartableTestNode) restart() {
+	node.mu.Lock()
+	node.restarts++
+	previous := node.cluster
+	node.mu.Unlock()
+	previous.Close()
+	if node.comesBack {
+		node.start()
+	}
+}
+
+func (node *restartableTestNode) current() *Cluster {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	return node.cluster
+}
+
+func (node *restartableTestNode) restarted() int {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	return node.restarts
+}
+
+// holdsSession tells whether the current node keeps a session to resume.
+func (node *restartableTestNode) holdsSession(token string) bool {
+	sessions := node.current().ps.Sessions
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+	_, ok := sessions.suspended[token]
+	return ok
+}
+
+func TestRollingRestartRestartsEveryNodeAndKeepsSessions(t *testing.T) {
+	coordinator := newRestartableTestNode(t, false)
+	nodeB := newRestartableTestNode(t, true)
+	nodeC := newRestartableTestNode(t, true)
+	nodeB.peers = []string{coordinator.address, nodeC.address}
+	nodeC.peers = []string{coordinator.address, nodeB.address}
+	coordinator.current().Join([]string{nodeB.address, nodeC.address})
+	assert.Eventually(t, func() bool {
+		return len(coordinator.current().Members()) == 2 && len(nodeB.current().Members()) == 2 && len(nodeC.current().Members()) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// A client of B that disconnected, with a message queued for its session
+	queued := NewPayload([]byte(`{"n":1}`))
+	nodeB.current().ps.Sessions.suspend("token-b", &suspendedSession{
+		clientId:      "client-b",
+		principal:     "alice",
+		name:          "Alice",
+		subscriptions: []StoredSubscription{{Topic: "news", Lifetime: LifetimeSession}},
+		queued:        []offlineMessage{{id: "m1", topic: "news", payload: queued, message: queued.Data}},
+	})
+	oldB, oldC := nodeB.current().NodeId, nodeC.current().NodeId
+
+	rollout, err := coordinator.current().StartRollout(RolloutRequest{StepTimeout: "5s"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, rollout.MinNodes, "By default every other node keeps serving")
+	_, err = coordinator.current().StartRollout(RolloutRequest{StepTimeout: "5s"})
+	assert.ErrorIs(t, err, errRolloutRunning)
+
+	assert.Eventually(t, func() bool {
+		status, _ := coordinator.current().RolloutStatus()
+		return status.State == RolloutCompleted
+	}, 20*time.Second, 20*time.Millisecond)
+	status, _ := coordinator.current().RolloutStatus()
+	if !assert.Len(t, status.Steps, 3) {
+		return
+	}
+	restarted := map[string]RolloutStep{}
+	for _, step := range status.Steps[:2] {
+		assert.Equal(t, RolloutDone, step.State, step.Address)
+		restarted[step.Node] = step
+	}
+	assert.Equal(t, 1, restarted[oldB].Sessions, "B hands the session over")
+	assert.Equal(t, nodeB.current().NodeId, restarted[oldB].RestartedAs)
+	assert.Equal(t, nodeC.current().NodeId, restarted[oldC].RestartedAs)
+	assert.Equal(t, RolloutRestarting, status.Steps[2].State, "The coordinator restarts last")
+	assert.Equal(t, []int{1, 1, 1}, []int{nodeB.restarted(), nodeC.restarted(), coordinator.restarted()})
+
+	// The coordinator handed the session over to the restarted nodes before restarting
+	assert.Eventually(t, func() bool { return nodeB.holdsSession("token-b") && nodeC.holdsSession("token-b") }, 2*time.Second, 10*time.Millisecond)
+	assert.Nil(t, nodeC.current().ps.Sessions.resume("token-b", "mallory"), "The session is still only valid for its principal")
+	session := nodeC.current().ps.Sessions.resume("token-b", "alice")
+	if assert.NotNil(t, session) {
+		assert.Equal(t, "client-b", session.clientId)
+		assert.Equal(t, "Alice", session.name)
+		assert.Equal(t, []StoredSubscription{{Topic: "news", Lifetime: LifetimeSession}}, session.subscriptions)
+		if assert.Len(t, session.queued, 1) {
+			assert.Equal(t, "m1", session.queued[0].id)
+			assert.Equal(t, []byte(`{"n":1}`), session.queued[0].payload.Data)
+		}
+	}
+	assert.Eventually(t, func() bool { return !nodeB.holdsSession("token-b") }, 2*time.Second, 10*time.Millisecond,
+		"Once resumed on one node, the other nodes forget the session")
+}
+
+func TestRollingRestartStopsWhenANodeDoesNotComeBack(t *testing.T) {
+	coordinator := newRestartableTestNode(t, false)
+	nodeB := newRestartableTestNode(t, false)
+	coordinator.current().Join([]string{nodeB.address})
+	assert.Eventually(t, func() bool { return len(coordinator.current().Members()) == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	_, err := coordinator.current().StartRollout(RolloutRequest{MinNodes: 1, StepTimeout: "300ms"})
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		status, _ := coordinator.current().RolloutStatus()
+		return status.State == RolloutFailed
+	}, 5*time.Second, 20*time.Millisecond)
+
+	status, _ := coordinator.current().RolloutStatus()
+	assert.Equal(t, RolloutFailed, status.Steps[0].State)
+	assert.Contains(t, status.Steps[0].Error, "did not rejoin")
+	assert.Equal(t, RolloutPending, status.Steps[1].State)
+	assert.Equal(t, 0, coordinator.restarted(), "The coordinator does not restart after a failed step")
+
+	_, err = coordinator.current().StartRollout(RolloutRequest{MinNodes: 1})
+	assert.Error(t, err, "With B gone, restarting the coordinator would leave no node serving")
+}
+
+func TestRollingRestartFramesNeedAnActiveRollout(t *testing.T) {
+	nodeA := newRestartableTestNode(t, false)
+	nodeB := newRestartableTestNode(t, false)
+	nodeA.current().Join([]string{nodeB.address})
+	assert.Eventually(t, func() bool { return len(nodeA.current().Members()) == 1 && len(nodeB.current().Members()) == 1 }, 5*time.Second, 10*time.Millisecond)
+	a, b := nodeA.current(), nodeB.current()
+	forged := migratedSession{Token: "forged", ClientId: "victim", Principal: "alice", GraceMs: 60000}
+
+	// Without an announced rolling restart, restart and session frames are dropped
+	assert.NoError(t, a.sendTo(b.NodeId, clusterFrame{Type: clusterRestart, Node: a.NodeId, Rollout: "r1"}))
+	assert.NoError(t, a.sendTo(b.NodeId, clusterFrame{Type: clusterSessions, Node: a.NodeId, Rollout: "r1", Sessions: []migratedSession{forged}}))
+	// Frames naming another node than the one that sent them are dropped too
+	a.announceRollout("r1", b.NodeId)
+	assert.NoError(t, a.sendTo(b.NodeId, clusterFrame{Type: clusterSessions, Node: b.NodeId, Rollout: "r1", Sessions: []migratedSession{forged}}))
+	// Only the node draining hands sessions over
+	assert.NoError(t, a.sendTo(b.NodeId, clusterFrame{Type: clusterSessions, Node: a.NodeId, Rollout: "r1", Sessions: []migratedSession{forged}}))
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, 0, nodeB.restarted())
+	assert.False(t, nodeB.holdsSession("forged"))
+
+	// The coordinator of the announced rolling restart may restart the node it drains
+	assert.NoError(t, a.sendTo(b.NodeId, clusterFrame{Type: clusterRestart, Node: a.NodeId, Rollout: "r1"}))
+	assert.Eventually(t, func() bool { return nodeB.restarted() == 1 }, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestRollingRestartAdminRoute(t *testing.T) {
+	node := newRestartableTestNode(t, false)
+	keys := NewAPIKeyStore()
+	node.current().ps.options().apiKeys = keys
+	keys.Add("admin-secret", "ops", []string{PermissionAdmin})
+	mux := http.NewServeMux()
+	setupRolloutRoutes(mux, node.current())
+
+	call := func(method string, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, "/admin/cluster/restart", strings.NewReader(body))
+		request.Header.Set(apiKeyHeader, "admin-secret")
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, request)
+		return recorder
+	}
+	assert.Equal(t, http.StatusNotFound, call(http.MethodGet, "").Code)
+	assert.Equal(t, http.StatusBadRequest, call(http.MethodPost, `{"minNodes": 1}`).Code, "A single node cannot keep another serving")
+	assert.Equal(t, http.StatusBadRequest, call(http.MethodPost, `{"stepTimeout": "soon"}`).Code)
+
+	response := call(http.MethodPost, "")
+	assert.Equal(t, http.StatusAccepted, response.Code)
+	assert.Contains(t, response.Body.String(), `"state":"running"`)
+	assert.Eventually(t, func() bool { return node.restarted() == 1 }, 5*time.Second, 10*time.Millisecond)
+	response = call(http.MethodGet, "")
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Contains(t, response.Body.String(), `"state":"completed"`)
+}
@@ -0,0 +1,178 @@
+// This file turns topics into rooms with a limited number of participants, e.g. for
+// webinars or auctions. The owner of a topic sets its capacity in the topic policy.
+// Subscribes to a full room are refused, or queued in a FIFO waitlist when the policy
+// asks for one, and waiting clients are promoted in order as places free up.
+package main
+
+import "encoding/json"
+
+// Protocol actions telling a client about its place in a room
+const (
+	// The client waits for a place in a full room
+	WAITLISTED = "waitlisted"
+	// A place freed up and the waiting client is now subscribed
+	PROMOTED = "promoted"
+)
+
+// JoinResult tells how a subscribe to a topic was handled.
+type JoinResult int
+
+const (
+	// The client is subscribed
+	Joined JoinResult = iota
+	// The room is full and the client waits for a place
+	Waitlisted
+	// The room is full and has no waitlist
+	RoomFull
+)
+
+// A client waiting for a place in a full room
+type waitlistEntry struct {
+	client  *Client
+	options SubscribeOptions
+}
+
+// Function to subscribe to a topic unless it is a full room, in which case the client
+// is put on the waitlist of the room if it has one.
+// Parameters:
+// client: *Client - The subscribing client.
+// topic: string - The topic.
+// options: SubscribeOptions - The options of the subscription.
+// Returns:
+// JoinResult - Whether the client joined, waits or was refused.
+// int - The position of the client on the waitlist, starting at 1, when it waits.
+func (ps *PubSub) Join(client *Client, topic string, options SubscribeOptions) (JoinResult, int) {
+	if options.Start != nil {
+		defer ps.sequence(topic)()
+	}
+	ps.mu.Lock()
+	// The join is announced once ps.mu is released
+	defer ps.announcePresence()
+	defer ps.unlockRunningSubscribeCallbacks()
+
+	room := ps.Topics[topic]
+	if room == nil || room.Policy.Capacity <= 0 || len(ps.GetSubscriptions(topic, client)) > 0 {
+		ps.subscribeLocked(client, topic, options)
+		return Joined, 0
+	}
+	for i, entry := range room.waitlist {
+		if entry.client.Id == client.Id {
+			room.waitlist[i].options = options
+			return Waitlisted, i + 1
+		}
+	}
+	// Clients already waiting go first
+	if len(room.waitlist) == 0 && ps.countSubscribers(topic) < room.Policy.Capacity {
+		ps.subscribeLocked(client, topic, options)
+		return Joined, 0
+	}
+	if !room.Policy.Waitlist {
+		return RoomFull, 0
+	}
+	room.waitlist = append(room.waitlist, waitlistEntry{client: client, options: options})
+	return Waitlisted, len(room.waitlist)
+}
+
+// Function to count the subscribers of a topic. The caller must hold ps.mu.
+// Parameters:
+// topic: string - The topic.
+// Returns:
+// int - The number of subscriptions to the topic.
+func (ps *PubSub) countSubscribers(topic string) int {
+	return len(ps.topicSubscriptions(topic))
+}
+
+// Function to subscribe waiting clients, in order, while their room has free places.
+// The caller must hold ps.mu and send the promoted clients promotedMessage once it
+// released it.
+// Parameters:
+// topic: string - The topic of the room.
+// Returns:
+// []*Client - The clients subscribed from the waitlist.
+func (ps *PubSub) promoteLocked(topic string) []*Client {
+	room := ps.Topics[topic]
+	if room == nil {
+		return nil
+	}
+	var promoted []*Client
+	for len(room.waitlist) > 0 && (room.Policy.Capacity <= 0 || ps.countSubscribers(topic) < room.Policy.Capacity) {
+		entry := room.waitlist[0]
+		room.waitlist = room.waitlist[1:]
+		ps.subscribeLocked(entry.client, topic, entry.options)
+		promoted = append(promoted, entry.client)
+	}
+	return promoted
+}
+
+// Function to take a client off the waitlists of rooms. The caller must hold ps.mu.
+// Parameters:
+// client: *Client - The client.
+// topic: string - The topic of the room, or an empty string for every room.
+func (ps *PubSub) leaveWaitlistLocked(client *Client, topic string) {
+	for name, room := range ps.Topics {
+		if topic != "" && name != topic {
+			continue
+		}
+		waitlist := room.waitlist[:0]
+		for _, entry := range room.waitlist {
+			if entry.client.Id != client.Id {
+				waitlist = append(waitlist, entry)
+			}
+		}
+		room.waitlist = waitlist
+	}
+}
+
+// Function to tell clients they were promoted from the waitlist of a room.
+// Parameters:
+// topic: string - The topic of the room.
+// clients: []*Client - The promoted clients.
+func notifyPromoted(topic string, clients []*Client) {
+	for _, client := range clients {
+		client.logger().Info("Client promoted from the waitlist", logKeyTopic, topic)
+		client.Send(promotedMessage(topic))
+	}
+}
+
+// Function to build the frame telling a client it waits for a place in a room.
+// Parameters:
+// topic: string - The topic of the room.
+// position: int - The position of the client on the waitlist, starting at 1.
+// Returns:
+// []byte - The JSON encoded frame.
+func waitlistedMessage(topic string, position int) []byte {
+	message, _ := json.Marshal(map[string]interface{}{
+		"action":   WAITLISTED,
+		"topic":    topic,
+		"position": position,
+	})
+	return message
+}
+
+// Function to build the frame telling a waiting client it joined the room.
+// Parameters:
+// topic: string - The topic of the room.
+// Returns:
+// []byte - The JSON encoded frame.
+func promotedMessage(topic string) []byte {
+	message, _ := json.Marshal(map[string]string{
+		"action": PROMOTED,
+		"topic":  topic,
+	})
+	return message
+}
+
+// Function to build the frame telling a client its subscribe was refused because the
+// room is full.
+// Parameters:
+// topic: string - The topic of the room.
+// Returns:
+// []byte - The JSON encoded frame.
+func roomFullMessage(topic string) []byte {
+	message, _ := json.Marshal(map[string]string{
+		"action": "error",
+		"code":   "room_full",
+		"topic":  topic,
+	})
+	return message
+}
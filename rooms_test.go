@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoomWaitlist(t *testing.T) {
+	pubsub := &PubSub{}
+	subscribe := []byte(`{"action":"subscribe","topic":"auction"}`)
+	var clients []Client
+	var peers []*websocket.Conn
+	for i := 0; i < 4; i++ {
+		client, peer := newTestClient(t)
+		clients = append(clients, client)
+		peers = append(peers, peer)
+	}
+	expectFrame := func(peer *websocket.Conn, expected string) {
+		_, message, err := peer.ReadMessage()
+		assert.NoError(t, err)
+		assert.JSONEq(t, expected, string(message))
+	}
+
+	pubsub.HandleRecvdMessage(clients[0], 1, subscribe)
+	assert.NoError(t, pubsub.SetTopicPolicy("auction", TopicPolicy{Capacity: 1, Waitlist: true}))
+	pubsub.HandleRecvdMessage(clients[1], 1, subscribe)
+	expectFrame(peers[1], `{"action":"waitlisted","topic":"auction","position":1}`)
+	pubsub.HandleRecvdMessage(clients[2], 1, subscribe)
+	expectFrame(peers[2], `{"action":"waitlisted","topic":"auction","position":2}`)
+	assert.Len(t, pubsub.Subscriptions(), 1)
+
+	pubsub.Unsubscribe(&clients[0], "auction")
+	expectFrame(peers[1], `{"action":"promoted","topic":"auction"}`)
+	assert.Len(t, pubsub.GetSubscriptions("auction", &clients[1]), 1, "The first waiting client should take the free place")
+
+	assert.NoError(t, pubsub.SetTopicPolicy("auction", TopicPolicy{Capacity: 1}))
+	pubsub.HandleRecvdMessage(clients[3], 1, subscribe)
+	expectFrame(peers[3], `{"action":"error","code":"room_full","topic":"auction"}`)
+
+	pubsub.RemoveClient(clients[1])
+	expectFrame(peers[2], `{"action":"promoted","topic":"auction"}`)
+	assert.Len(t, pubsub.GetSubscriptions("auction", nil), 1)
+	assert.Len(t, pubsub.GetSubscriptions("auction", &clients[2]), 1)
+}
+
+func TestRoomWaitlistLeave(t *testing.T) {
+	pubsub := &PubSub{}
+	owner := Client{Id: "owner"}
+	waiting := Client{Id: "waiting"}
+	pubsub.SubscribeWith(&owner, "webinar", SubscribeOptions{})
+	pubsub.mu.Lock()
+	pubsub.touchTopic("webinar", nil).Policy = TopicPolicy{Capacity: 1, Waitlist: true}
+	pubsub.mu.Unlock()
+
+	result, position := pubsub.Join(&waiting, "webinar", SubscribeOptions{})
+	assert.Equal(t, Waitlisted, result)
+	assert.Equal(t, 1, position)
+	result, position = pubsub.Join(&waiting, "webinar", SubscribeOptions{})
+	assert.Equal(t, Waitlisted, result, "Subscribing again should keep the place on the waitlist")
+	assert.Equal(t, 1, position)
+
+	pubsub.Unsubscribe(&waiting, "webinar")
+	assert.Empty(t, pubsub.Topics["webinar"].waitlist, "Unsubscribing should leave the waitlist")
+	result, _ = pubsub.Join(&owner, "webinar", SubscribeOptions{})
+	assert.Equal(t, Joined, result, "Subscribers should stay subscribed")
+}
@@ -0,0 +1,94 @@
+// This file lets embedders answer requests in the server itself: a handler registered
+// for a topic is called with every request published on it, and what it returns is
+// published to the inbox of the requester with the correlation ID of the request, as
+// a responding client would. Requests are still delivered to the subscribers of the
+// topic. Only the server the request was published to answers it, as bridges do not
+// carry reply headers.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"maps"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Time a handler has to answer a request
+const rpcTimeout = 30 * time.Second
+
+// RPCRequest is a request published on a topic the server answers.
+type RPCRequest struct {
+	Id    string
+	Topic string
+	// The message as published, JSON or binary
+	Message []byte
+	// The principal that published the request, "" if anonymous
+	Publisher     string
+	CorrelationId string
+}
+
+// RPCHandler answers the requests of a topic. The response is published to the
+// requester as is; an error is published as {"error": "..."}.
+type RPCHandler func(ctx context.Context, request RPCRequest) ([]byte, error)
+
+// Function to register the handler answering the requests published on a topic,
+// replacing any previous one; a nil handler unregisters it.
+// Parameters:
+// topic: string - The topic.
+// handler: RPCHandler - The handler.
+func (ps *PubSub) Handle(topic string, handler RPCHandler) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	// A new map, so requests being answered read the handlers without locks
+	handlers := map[string]RPCHandler{}
+	if current := ps.rpcHandlers.Load(); current != nil {
+		maps.Copy(handlers, *current)
+	}
+	if handler == nil {
+		delete(handlers, topic)
+	} else {
+		handlers[topic] = handler
+	}
+	ps.rpcHandlers.Store(&handlers)
+}
+
+// Function to answer a released message if it is a request on a topic with a handler.
+// The handler runs in the background, so a slow handler does not hold up the publisher.
+// Parameters:
+// ctx: context.Context - The context of the publish, carrying its reply headers.
+// id: string - The ID of the message.
+// topic: string - The topic.
+// message: []byte - The message.
+func (ps *PubSub) answer(ctx context.Context, id string, topic string, message []byte) {
+	reply := replyFrom(ctx)
+	if reply.ReplyTo == "" {
+		return
+	}
+	var handler RPCHandler
+	if handlers := ps.rpcHandlers.Load(); handlers != nil {
+		handler = (*handlers)[topic]
+	}
+	if handler == nil {
+		return
+	}
+
+	request := RPCRequest{Id: id, Topic: topic, Message: message, Publisher: publisherFrom(ctx), CorrelationId: reply.CorrelationId}
+	// The response is published by the server, not the requester
+	ctx = trace.ContextWithSpanContext(context.Background(), trace.SpanContextFromContext(ctx))
+	go func() {
+		ctx, span := tracer.Start(ctx, "rpc.handle", trace.WithAttributes(attribute.String(logKeyTopic, topic), attribute.String("message_id", id)))
+		handlerCtx, cancel := context.WithTimeout(ctx, rpcTimeout)
+		response, err := handler(handlerCtx, request)
+		cancel()
+		if err != nil {
+			slog.Warn("Request handler failed", logKeyTopic, topic, "message_id", id, "error", err)
+			response, _ = json.Marshal(map[string]string{"error": err.Error()})
+		}
+		ps.PublishContext(withReply(ctx, replyHeaders{CorrelationId: reply.CorrelationId}), reply.ReplyTo, response, nil)
+		endSpan(span, err)
+	}()
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleRequests(t *testing.T) {
+	pubsub := &PubSub{}
+	requests := make(chan RPCRequest, 4)
+	pubsub.Handle("quotes", func(ctx context.Context, request RPCRequest) ([]byte, error) {
+		requests <- request
+		if string(request.Message) == `{"symbol":"NONE"}` {
+			return nil, errors.New("unknown symbol")
+		}
+		return []byte(`{"price":42}`), nil
+	})
+	client, peer := newTestClient(t)
+	// Responses are written by the handler's goroutine, so writes go through the outbox
+	client.Outbox = NewOutbox(&client, 8, DisconnectSlowConsumer, SlowStart{})
+	defer client.Outbox.Close()
+
+	// A publish expecting no reply is not answered
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"publish","topic":"quotes","message":{"symbol":"ACME"}}`))
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"request","topic":"quotes","message":{"symbol":"ACME"},"correlationId":"q1"}`))
+	assert.Equal(t, REQUESTED, readFrame(t, peer)["action"])
+	select {
+	case request := <-requests:
+		assert.Equal(t, "quotes", request.Topic)
+		assert.Equal(t, `{"symbol":"ACME"}`, string(request.Message))
+		assert.Equal(t, "q1", request.CorrelationId)
+	case <-time.After(2 * time.Second):
+		t.Fatal("The handler should be called")
+	}
+	reply := readFrame(t, peer)
+	assert.Equal(t, inboxOf(&client), reply["topic"])
+	assert.Equal(t, "q1", reply["correlationId"])
+	assert.Equal(t, map[string]interface{}{"price": float64(42)}, reply["message"])
+	assert.Empty(t, requests, "Only the request should reach the handler")
+
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"request","topic":"quotes","message":{"symbol":"NONE"},"correlationId":"q2"}`))
+	readFrame(t, peer)
+	<-requests
+	reply = readFrame(t, peer)
+	assert.Equal(t, "q2", reply["correlationId"])
+	assert.Equal(t, map[string]interface{}{"error": "unknown symbol"}, reply["message"])
+
+	pubsub.Handle("quotes", nil)
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"request","topic":"quotes","message":{},"correlationId":"q3"}`))
+	readFrame(t, peer)
+	select {
+	case <-requests:
+		t.Fatal("An unregistered handler should not be called")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,289 @@
+// This file is the integration point for inline content scanning: messages published
+// to selected topics are passed to a scanner, e.g. an HTTP classifier, and flagged
+// messages are blocked, reported, or delivered and then redacted depending on the topic.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ScanPolicy decides what happens to the messages of a topic when they are flagged.
+type ScanPolicy string
+
+const (
+	// Messages are held until scanned and flagged messages are dropped
+	ScanBlock ScanPolicy = "block"
+	// Messages are held until scanned and flagged messages are delivered and reported
+	ScanFlag ScanPolicy = "flag"
+	// Messages are delivered at once and redacted if they are flagged
+	ScanRedact ScanPolicy = "redact"
+)
+
+// How long a scan may take before the message is delivered unscanned
+const defaultScanTimeout = 2 * time.Second
+
+// Reporter recorded on the reports filed for flagged messages
+const scannerReporter = "scanner"
+
+var (
+	scanDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gowebsockets_scan_duration_seconds",
+		Help:    "Time taken to scan a message, by policy.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 10),
+	}, []string{"policy"})
+	scanResults = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gowebsockets_scan_results_total",
+		Help: "Number of scanned messages, by policy and result (clean, flagged or error).",
+	}, []string{"policy", "result"})
+)
+
+// ScanResult is the verdict of a content scanner.
+type ScanResult struct {
+	Flagged bool     `json:"flagged"`
+	Labels  []string `json:"labels,omitempty"`
+}
+
+// ContentScanner classifies published messages.
+type ContentScanner interface {
+	Scan(ctx context.Context, topic string, id string, message []byte) (ScanResult, error)
+}
+
+// HTTPClassifier scans messages by posting {"topic","id","message"} to a classifier
+// service, which answers with a ScanResult such as {"flagged": true, "labels": ["spam"]}.
+type HTTPClassifier struct {
+	URL    string
+	Client *http.Client
+}
+
+func (c HTTPClassifier) Scan(ctx context.Context, topic string, id string, message []byte) (ScanResult, error) {
+	body, err := json.Marshal(struct {
+		Topic   string `json:"topic"`
+		Id      string `json:"id"`
+		Message []byte `json:"message"`
+	}{topic, id, message})
+	if err != nil {
+		return ScanResult{}, err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, bytes.NewReader(body))
+	if err != nil {
+		return ScanResult{}, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return ScanResult{}, fmt.Errorf("classifier answered %s", response.Status)
+	}
+
+	var result ScanResult
+	err = json.NewDecoder(response.Body).Decode(&result)
+	return result, err
+}
+
+// KeywordScanner flags messages containing any of its words, ignoring case. It is a
+// minimal scanner for tests and small deployments.
+type KeywordScanner struct {
+	Words []string
+}
+
+func (k KeywordScanner) Scan(ctx context.Context, topic string, id string, message []byte) (ScanResult, error) {
+	text := strings.ToLower(string(message))
+	var result ScanResult
+	for _, word := range k.Words {
+		if strings.Contains(text, strings.ToLower(word)) {
+			result.Flagged = true
+			result.Labels = append(result.Labels, word)
+		}
+	}
+	return result, nil
+}
+
+// ScanRule applies a policy to the topics matching a glob pattern.
+type ScanRule struct {
+	Topic  string
+	Policy ScanPolicy
+}
+
+// Function to parse scan rules from a comma separated list of pattern=policy pairs.
+// Parameters:
+// value: string - The rules, e.g. "chat.*=block,news=redact".
+// Returns:
+// []ScanRule - The rules, in order.
+// error - An error if a rule is malformed or names an unknown policy.
+func ParseScanRules(value string) ([]ScanRule, error) {
+	var rules []ScanRule
+	for _, rule := range strings.Split(value, ",") {
+		topic, policy, ok := strings.Cut(strings.TrimSpace(rule), "=")
+		if !ok || topic == "" {
+			return nil, fmt.Errorf("invalid scan rule %q", rule)
+		}
+		switch ScanPolicy(policy) {
+		case ScanBlock, ScanFlag, ScanRedact:
+		default:
+			return nil, fmt.Errorf("unknown scan policy %q", policy)
+		}
+		rules = append(rules, ScanRule{Topic: topic, Policy: ScanPolicy(policy)})
+	}
+	return rules, nil
+}
+
+type ContentScanning struct {
+	Scanner ContentScanner
+	Rules   []ScanRule
+	// How long a scan may take; messages whose scan fails or times out are delivered
+	Timeout time.Duration
+
+	ps *PubSub
+	// The last message of each topic still being scanned, closed once it is handled
+	inflight map[string]chan struct{}
+	mu       sync.Mutex
+}
+
+// Function to create the content scanning stage.
+// Parameters:
+// scanner: ContentScanner - The scanner.
+// rules: []ScanRule - The topics to scan and their policies; the first matching rule applies.
+// ps: *PubSub - The PubSub instance scanned messages are passed on to.
+// Returns:
+// *ContentScanning - The scanning stage.
+func NewContentScanning(scanner ContentScanner, rules []ScanRule, ps *PubSub) *ContentScanning {
+	return &ContentScanning{
+		Scanner:  scanner,
+		Rules:    rules,
+		Timeout:  defaultScanTimeout,
+		ps:       ps,
+		inflight: map[string]chan struct{}{},
+	}
+}
+
+// Function to get the policy of a topic.
+// Parameters:
+// topic: string - The topic.
+// Returns:
+// ScanPolicy - The policy of the first matching rule.
+// bool - False if the topic is not scanned.
+func (s *ContentScanning) PolicyFor(topic string) (ScanPolicy, bool) {
+	for _, rule := range s.Rules {
+		if globMatch(rule.Topic, topic) {
+			return rule.Policy, true
+		}
+	}
+	return "", false
+}
+
+// Function to scan a published message in the background and pass it on according
+// to the policy. Messages held for scanning are passed on in the order they were
+// published, even when their scans complete out of order.
+// Parameters:
+// ctx: context.Context - The context carrying the trace of the publish.
+// policy: ScanPolicy - The policy of the topic.
+// id: string - The ID of the message.
+// topic: string - The topic the message was published to.
+// message: []byte - The published message.
+func (s *ContentScanning) Process(ctx context.Context, policy ScanPolicy, id string, topic string, message []byte) {
+	ctx = detachTrace(ctx)
+	if policy == ScanRedact {
+		s.ps.moderate(ctx, id, topic, message)
+		go func() {
+			if result, err := s.scan(policy, id, topic, message); err == nil && result.Flagged {
+				s.report(id, topic, result)
+				s.ps.Redact(topic, id)
+			}
+		}()
+		return
+	}
+
+	done := make(chan struct{})
+	s.mu.Lock()
+	previous := s.inflight[topic]
+	s.inflight[topic] = done
+	s.mu.Unlock()
+
+	go func() {
+		result, err := s.scan(policy, id, topic, message)
+		if previous != nil {
+			<-previous
+		}
+
+		switch {
+		case err != nil:
+			s.ps.moderate(ctx, id, topic, message)
+		case result.Flagged && policy == ScanBlock:
+			slog.Info("Blocked flagged message", logKeyTopic, topic, "message_id", id, "labels", result.Labels)
+		case result.Flagged:
+			s.report(id, topic, result)
+			s.ps.moderate(ctx, id, topic, message)
+		default:
+			s.ps.moderate(ctx, id, topic, message)
+		}
+
+		s.mu.Lock()
+		if s.inflight[topic] == done {
+			delete(s.inflight, topic)
+		}
+		s.mu.Unlock()
+		close(done)
+	}()
+}
+
+// Function to run the scanner on a message, recording the latency and result.
+// Parameters:
+// policy: ScanPolicy - The policy of the topic, used as a metric label.
+// id: string - The ID of the message.
+// topic: string - The topic the message was published to.
+// message: []byte - The published message.
+// Returns:
+// ScanResult - The verdict of the scanner.
+// error - An error if the scan failed or timed out.
+func (s *ContentScanning) scan(policy ScanPolicy, id string, topic string, message []byte) (ScanResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	result, err := s.Scanner.Scan(ctx, topic, id, message)
+	scanDuration.WithLabelValues(string(policy)).Observe(time.Since(start).Seconds())
+
+	switch {
+	case err != nil:
+		slog.Error("Content scan failed", logKeyTopic, topic, "message_id", id, "error", err)
+		scanResults.WithLabelValues(string(policy), "error").Inc()
+	case result.Flagged:
+		scanResults.WithLabelValues(string(policy), "flagged").Inc()
+	default:
+		scanResults.WithLabelValues(string(policy), "clean").Inc()
+	}
+	return result, err
+}
+
+// Function to file a report for a flagged message so admins can review it.
+// Parameters:
+// id: string - The ID of the message.
+// topic: string - The topic the message was published to.
+// result: ScanResult - The verdict of the scanner.
+func (s *ContentScanning) report(id string, topic string, result ScanResult) {
+	s.ps.Reports.Add(Report{
+		MessageId: id,
+		Topic:     topic,
+		Reporter:  scannerReporter,
+		Reason:    strings.Join(result.Labels, ","),
+	})
+}
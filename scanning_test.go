@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// slowScanner takes longer to scan the first message so scans complete out of order.
+type slowScanner struct {
+	once sync.Once
+}
+
+func (s *slowScanner) Scan(ctx context.Context, topic string, id string, message []byte) (ScanResult, error) {
+	s.once.Do(func() { time.Sleep(50 * time.Millisecond) })
+	return KeywordScanner{Words: []string{"spam"}}.Scan(ctx, topic, id, message)
+}
+
+// scanningIdle reports whether no message is waiting to be scanned.
+func scanningIdle(s *ContentScanning) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.inflight) == 0
+}
+
+func TestParseScanRules(t *testing.T) {
+	rules, err := ParseScanRules("chat.*=block, news=redact")
+	assert.NoError(t, err)
+	assert.Equal(t, []ScanRule{{"chat.*", ScanBlock}, {"news", ScanRedact}}, rules)
+
+	_, err = ParseScanRules("chat=delete")
+	assert.Error(t, err)
+	_, err = ParseScanRules("chat")
+	assert.Error(t, err)
+}
+
+func TestScanBlockKeepsOrderAndDropsFlagged(t *testing.T) {
+	bridge := &recordingBridge{}
+	ps := &PubSub{Bridges: []Bridge{bridge}}
+	ps.Scanning = NewContentScanning(&slowScanner{}, []ScanRule{{"chat", ScanBlock}}, ps)
+	before := testutil.ToFloat64(scanResults.WithLabelValues("block", "flagged"))
+
+	ps.Publish("chat", []byte(`"first"`), nil)
+	ps.Publish("chat", []byte(`"buy spam"`), nil)
+	ps.Publish("chat", []byte(`"second"`), nil)
+	ps.Publish("other", []byte(`"spam"`), nil)
+
+	assert.Eventually(t, func() bool { return scanningIdle(ps.Scanning) && len(bridge.relayed()) == 3 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, [][]byte{[]byte(`"spam"`), []byte(`"first"`), []byte(`"second"`)}, bridge.relayed(),
+		"Unscanned topics are not held, and scanned messages keep their order")
+	assert.Equal(t, before+1, testutil.ToFloat64(scanResults.WithLabelValues("block", "flagged")))
+}
+
+func TestScanFlagDeliversAndReports(t *testing.T) {
+	bridge := &recordingBridge{}
+	ps := &PubSub{Bridges: []Bridge{bridge}}
+	ps.Scanning = NewContentScanning(KeywordScanner{Words: []string{"spam"}}, []ScanRule{{"*", ScanFlag}}, ps)
+
+	ps.Publish("chat", []byte(`"SPAM offer"`), nil)
+
+	assert.Eventually(t, func() bool { return len(ps.Reports.List()) == 1 }, time.Second, 10*time.Millisecond)
+	report := ps.Reports.List()[0]
+	assert.Equal(t, scannerReporter, report.Reporter)
+	assert.Equal(t, "spam", report.Reason)
+	assert.Eventually(t, func() bool { return scanningIdle(ps.Scanning) }, time.Second, 10*time.Millisecond)
+	assert.Len(t, bridge.relayed(), 1, "Flagged messages are still delivered")
+}
+
+func TestScanRedactDeliversThenRedacts(t *testing.T) {
+	ps := &PubSub{}
+	ps.Scanning = NewContentScanning(KeywordScanner{Words: []string{"spam"}}, []ScanRule{{"chat", ScanRedact}}, ps)
+	client, peer := newTestClient(t)
+	ps.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"chat","envelope":true}`))
+
+	ps.Publish("chat", []byte(`"spam"`), nil)
+
+	var delivered, redaction map[string]string
+	assert.NoError(t, peer.ReadJSON(&delivered))
+	assert.Equal(t, "message", delivered["action"])
+	assert.NoError(t, peer.ReadJSON(&redaction))
+	assert.Equal(t, "redact", redaction["action"])
+	assert.Equal(t, delivered["id"], redaction["id"])
+}
+
+func TestHTTPClassifier(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"flagged":true,"labels":["toxic"]}`))
+	}))
+	defer server.Close()
+
+	result, err := HTTPClassifier{URL: server.URL}.Scan(context.Background(), "chat", "1", []byte("hi"))
+	assert.NoError(t, err)
+	assert.Equal(t, ScanResult{Flagged: true, Labels: []string{"toxic"}}, result)
+
+	server.Close()
+	_, err = HTTPClassifier{URL: server.URL}.Scan(context.Background(), "chat", "1", []byte("hi"))
+	assert.Error(t, err)
+}
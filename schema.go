@@ -0,0 +1,357 @@
+// This file infers the structure of the messages of monitored topics and raises an
+// alert when new messages drift from it, catching producer regressions before
+// consumers break. A sample of the published messages is flattened into field paths
+// and their JSON types, e.g. order.items[].price: number; the first samples of a topic
+// learn its schema, and later samples missing required fields, adding fields or
+// changing their types beyond the drift threshold are counted in a metric and
+// announced on the admin events topic.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand/v2"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Frame announcing that a message drifted from the schema of its topic
+const SCHEMA_DRIFT = "schema_drift"
+
+// Defaults of schema monitoring
+const (
+	defaultSchemaSampleRate      = 0.1
+	defaultSchemaLearningSamples = 100
+	defaultSchemaDriftThreshold  = 0.3
+)
+
+// Most fields recorded per message, so a huge message cannot grow a schema without bound
+const maxSchemaFields = 256
+
+// Shortest interval between two drift announcements of a topic
+var schemaAlertInterval = time.Minute
+
+var schemaDrifts = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "websocket_schema_drift_total",
+	Help: "Sampled messages that drifted from the inferred schema of their topic.",
+}, []string{"topic"})
+
+// SchemaMonitor learns the schema of the messages of topics and detects drift.
+type SchemaMonitor struct {
+	// Glob patterns of the monitored topics
+	Topics []string
+	// Fraction of the messages sampled
+	SampleRate float64
+	// Samples learning the schema of a topic before drift is detected
+	LearningSamples int
+	// Fraction of the fields of a sample that may differ from the schema before it drifts
+	DriftThreshold float64
+
+	ps      *PubSub
+	schemas map[string]*topicSchema
+	mu      sync.Mutex
+}
+
+// The schema learned for a topic
+type topicSchema struct {
+	samples int
+	// How many samples had each field, and the types it had
+	fields map[string]*fieldStats
+	drifts int
+	// When drift was last announced
+	alerted time.Time
+}
+
+// The occurrences of a field in the samples of a topic
+type fieldStats struct {
+	seen  int
+	types map[string]bool
+}
+
+// TopicSchema describes the schema learned for a topic.
+type TopicSchema struct {
+	Topic    string `json:"topic"`
+	Samples  int    `json:"samples"`
+	Learning bool   `json:"learning"`
+	// The types of every field, e.g. {"price": ["number"]}
+	Fields map[string][]string `json:"fields"`
+	// The fields every learning sample had
+	Required []string `json:"required"`
+	Drifts   int      `json:"drifts"`
+}
+
+// SchemaDrift is how a sample differs from the schema of its topic.
+type SchemaDrift struct {
+	Topic     string   `json:"topic"`
+	MessageId string   `json:"messageId"`
+	Missing   []string `json:"missing,omitempty"`
+	Added     []string `json:"added,omitempty"`
+	Changed   []string `json:"changed,omitempty"`
+	// Fraction of the fields of the sample and the schema that differ
+	Score float64 `json:"score"`
+}
+
+// Function to create a schema monitor with the default settings.
+// Parameters:
+// topics: []string - Glob patterns of the topics to monitor.
+// ps: *PubSub - The PubSub drift is announced on.
+// Returns:
+// *SchemaMonitor - The monitor.
+func NewSchemaMonitor(topics []string, ps *PubSub) *SchemaMonitor {
+	return &SchemaMonitor{
+		Topics:          topics,
+		SampleRate:      defaultSchemaSampleRate,
+		LearningSamples: defaultSchemaLearningSamples,
+		DriftThreshold:  defaultSchemaDriftThreshold,
+		ps:              ps,
+		schemas:         map[string]*topicSchema{},
+	}
+}
+
+// Function to check whether the messages of a topic are monitored.
+// Parameters:
+// topic: string - The topic.
+// Returns:
+// bool - True if the topic matches one of the patterns.
+func (m *SchemaMonitor) Monitors(topic string) bool {
+	for _, pattern := range m.Topics {
+		if globMatch(pattern, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// Function to sample a published message: it teaches the schema of its topic while
+// the schema is learned, and is checked for drift afterwards.
+// Parameters:
+// id: string - The ID of the message.
+// topic: string - The topic.
+// message: []byte - The message.
+// Returns:
+// *SchemaDrift - The drift of the message if it was sampled and drifted, or nil.
+func (m *SchemaMonitor) Observe(id string, topic string, message []byte) *SchemaDrift {
+	if !m.Monitors(topic) || rand.Float64() >= m.SampleRate {
+		return nil
+	}
+	fields := inferFields(message)
+
+	m.mu.Lock()
+	schema := m.schemas[topic]
+	if schema == nil {
+		schema = &topicSchema{fields: map[string]*fieldStats{}}
+		m.schemas[topic] = schema
+	}
+	if schema.samples < m.LearningSamples {
+		schema.learn(fields)
+		m.mu.Unlock()
+		return nil
+	}
+	drift := schema.compare(fields)
+	if drift.Score < m.DriftThreshold {
+		m.mu.Unlock()
+		return nil
+	}
+	schema.drifts++
+	announce := time.Since(schema.alerted) >= schemaAlertInterval
+	if announce {
+		schema.alerted = time.Now()
+	}
+	m.mu.Unlock()
+
+	drift.Topic, drift.MessageId = topic, id
+	schemaDrifts.WithLabelValues(topic).Inc()
+	if announce {
+		m.announce(drift)
+	}
+	return &drift
+}
+
+// Function to announce drift on the admin events topic.
+// Parameters:
+// drift: SchemaDrift - The drift.
+func (m *SchemaMonitor) announce(drift SchemaDrift) {
+	data, _ := json.Marshal(struct {
+		Action string `json:"action"`
+		SchemaDrift
+	}{SCHEMA_DRIFT, drift})
+	(&Client{}).logger().Warn("Message drifted from the schema of its topic", logKeyTopic, drift.Topic, "message_id", drift.MessageId, "score", drift.Score)
+	m.ps.fanOut(context.Background(), autoId(), m.ps.options().adminEventsTopic, data)
+}
+
+// Function to list the schemas learned.
+// Returns:
+// []TopicSchema - The schemas, sorted by topic.
+func (m *SchemaMonitor) Schemas() []TopicSchema {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	schemas := make([]TopicSchema, 0, len(m.schemas))
+	for topic, schema := range m.schemas {
+		view := TopicSchema{
+			Topic:    topic,
+			Samples:  schema.samples,
+			Learning: schema.samples < m.LearningSamples,
+			Fields:   map[string][]string{},
+			Required: []string{},
+			Drifts:   schema.drifts,
+		}
+		for path, stats := range schema.fields {
+			view.Fields[path] = stats.typeList()
+			if stats.seen == schema.samples {
+				view.Required = append(view.Required, path)
+			}
+		}
+		sort.Strings(view.Required)
+		schemas = append(schemas, view)
+	}
+	sort.Slice(schemas, func(i, j int) bool { return schemas[i].Topic < schemas[j].Topic })
+	return schemas
+}
+
+// Function to forget the schema of a topic, e.g. after an intended change of its
+// messages, so it is learned again.
+// Parameters:
+// topic: string - The topic.
+// Returns:
+// bool - False if no schema was learned for the topic.
+func (m *SchemaMonitor) Reset(topic string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.schemas[topic]
+	delete(m.schemas, topic)
+	return ok
+}
+
+// Function to learn the fields of a sample.
+// Parameters:
+// fields: map[string]string - The type of every field of the sample.
+func (s *topicSchema) learn(fields map[string]string) {
+	s.samples++
+	for path, typ := range fields {
+		stats := s.fields[path]
+		if stats == nil {
+			stats = &fieldStats{types: map[string]bool{}}
+			s.fields[path] = stats
+		}
+		stats.seen++
+		stats.types[typ] = true
+	}
+}
+
+// Function to compare the fields of a sample with the schema.
+// Parameters:
+// fields: map[string]string - The type of every field of the sample.
+// Returns:
+// SchemaDrift - The required fields the sample misses, the fields it adds and the fields whose type changed.
+func (s *topicSchema) compare(fields map[string]string) SchemaDrift {
+	var drift SchemaDrift
+	for path, stats := range s.fields {
+		if _, ok := fields[path]; !ok && stats.seen == s.samples {
+			drift.Missing = append(drift.Missing, path)
+		}
+	}
+	union := len(s.fields)
+	for path, typ := range fields {
+		stats := s.fields[path]
+		switch {
+		case stats == nil:
+			drift.Added = append(drift.Added, path)
+			union++
+		case !stats.types[typ]:
+			drift.Changed = append(drift.Changed, path)
+		}
+	}
+	sort.Strings(drift.Missing)
+	sort.Strings(drift.Added)
+	sort.Strings(drift.Changed)
+	if union > 0 {
+		drift.Score = float64(len(drift.Missing)+len(drift.Added)+len(drift.Changed)) / float64(union)
+	}
+	return drift
+}
+
+// Function to list the types a field had.
+// Returns:
+// []string - The types, sorted.
+func (f *fieldStats) typeList() []string {
+	types := make([]string, 0, len(f.types))
+	for typ := range f.types {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// Function to infer the fields of a message.
+// Parameters:
+// message: []byte - The message.
+// Returns:
+// map[string]string - The JSON type of every field by path, e.g. items[].price: number. The root is the empty path, of type binary for messages that are not JSON.
+func inferFields(message []byte) map[string]string {
+	var value interface{}
+	if err := json.Unmarshal(message, &value); err != nil {
+		return map[string]string{"": "binary"}
+	}
+	fields := map[string]string{}
+	flattenFields(fields, "", value)
+	return fields
+}
+
+// Function to record the type of a value and of everything it holds.
+// Parameters:
+// fields: map[string]string - The fields recorded, up to maxSchemaFields.
+// path: string - The path of the value.
+// value: interface{} - The decoded value.
+func flattenFields(fields map[string]string, path string, value interface{}) {
+	if len(fields) >= maxSchemaFields {
+		return
+	}
+	switch value := value.(type) {
+	case map[string]interface{}:
+		fields[path] = "object"
+		for key, item := range value {
+			child := key
+			if path != "" {
+				child = path + "." + key
+			}
+			flattenFields(fields, child, item)
+		}
+	case []interface{}:
+		fields[path] = "array"
+		// The items of an array share a path, so its length does not matter
+		for _, item := range value {
+			flattenFields(fields, path+"[]", item)
+		}
+	case string:
+		fields[path] = "string"
+	case float64:
+		fields[path] = "number"
+	case bool:
+		fields[path] = "boolean"
+	case nil:
+		fields[path] = "null"
+	}
+}
+
+// Function to register the admin API listing and resetting the learned schemas.
+// Parameters:
+// mux: *http.ServeMux - The mux to register the routes on.
+// pubsub: *PubSub - The PubSub the routes serve.
+func setupSchemaRoutes(mux *http.ServeMux, pubsub *PubSub) {
+	mux.HandleFunc("GET /admin/schemas", pubsub.requireAPIKey(PermissionAdmin, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, pubsub.Schemas.Schemas())
+	}))
+
+	mux.HandleFunc("DELETE /admin/schemas/{topic}", pubsub.requireAPIKey(PermissionAdmin, func(w http.ResponseWriter, r *http.Request) {
+		if !pubsub.Schemas.Reset(r.PathValue("topic")) {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// eventRecorder records the frames published on a topic.
+type eventRecorder struct {
+	frames []map[string]interface{}
+	mu     sync.Mutex
+}
+
+func (r *eventRecorder) Deliver(topic string, message []byte) error {
+	var frame map[string]interface{}
+	json.Unmarshal(message, &frame)
+	r.mu.Lock()
+	r.frames = append(r.frames, frame)
+	r.mu.Unlock()
+	return nil
+}
+
+func TestInferFields(t *testing.T) {
+	fields := inferFields([]byte(`{"id":1,"order":{"items":[{"price":2.5},{"price":3,"gift":true}]},"note":null}`))
+	assert.Equal(t, map[string]string{
+		"":                    "object",
+		"id":                  "number",
+		"order":               "object",
+		"order.items":         "array",
+		"order.items[]":       "object",
+		"order.items[].price": "number",
+		"order.items[].gift":  "boolean",
+		"note":                "null",
+	}, fields)
+	assert.Equal(t, map[string]string{"": "binary"}, inferFields([]byte("not json")))
+}
+
+func TestSchemaDriftIsDetected(t *testing.T) {
+	pubsub := &PubSub{}
+	recorder := &eventRecorder{}
+	pubsub.Subscribe(&Client{Id: "admin", Transport: recorder}, pubsub.options().adminEventsTopic)
+	monitor := NewSchemaMonitor([]string{"orders/*"}, pubsub)
+	monitor.SampleRate = 1
+	monitor.LearningSamples = 3
+
+	assert.Nil(t, monitor.Observe("m1", "orders/eu", []byte(`{"id":1,"price":2.5,"tags":["a"]}`)))
+	assert.Nil(t, monitor.Observe("m2", "orders/eu", []byte(`{"id":2,"price":3,"tags":[],"note":"gift"}`)))
+	assert.Nil(t, monitor.Observe("m3", "orders/eu", []byte(`{"id":3,"price":4,"tags":["b"]}`)))
+	assert.Nil(t, monitor.Observe("m4", "users/1", []byte(`{"name":"alice"}`)), "Unmonitored topics should be ignored")
+
+	// Optional fields may be missing, and a single new field stays below the threshold
+	assert.Nil(t, monitor.Observe("m5", "orders/eu", []byte(`{"id":4,"price":5,"tags":["c"]}`)))
+	assert.Nil(t, monitor.Observe("m6", "orders/eu", []byte(`{"id":5,"price":5,"tags":["c"],"currency":"EUR"}`)))
+
+	drift := monitor.Observe("m7", "orders/eu", []byte(`{"id":"6","cost":5}`))
+	if assert.NotNil(t, drift) {
+		assert.Equal(t, []string{"price", "tags"}, drift.Missing, "Fields absent from some samples, such as the items of an empty array, should not be required")
+		assert.Equal(t, []string{"cost"}, drift.Added)
+		assert.Equal(t, []string{"id"}, drift.Changed)
+		assert.InDelta(t, 4.0/7, drift.Score, 0.001)
+	}
+	assert.NotNil(t, monitor.Observe("m8", "orders/eu", []byte(`{"id":"7"}`)))
+	assert.Equal(t, 2.0, testutil.ToFloat64(schemaDrifts.WithLabelValues("orders/eu")))
+
+	assert.Len(t, recorder.frames, 1, "Drift should be announced once per interval")
+	assert.Equal(t, SCHEMA_DRIFT, recorder.frames[0]["action"])
+	assert.Equal(t, "m7", recorder.frames[0]["messageId"])
+
+	schemas := monitor.Schemas()
+	if assert.Len(t, schemas, 1) {
+		assert.False(t, schemas[0].Learning)
+		assert.Equal(t, 2, schemas[0].Drifts)
+		assert.Equal(t, []string{"", "id", "price", "tags"}, schemas[0].Required)
+		assert.Equal(t, []string{"number"}, schemas[0].Fields["id"])
+	}
+}
+
+func TestSchemaAdminRoutes(t *testing.T) {
+	keys := NewAPIKeyStore()
+	isolatePubSub(t).apiKeys = keys
+	keys.Add("root", "admin", []string{PermissionAdmin})
+	ps.Schemas = NewSchemaMonitor([]string{"admin-schema"}, ps)
+	ps.Schemas.SampleRate = 1
+	defer func() { ps.Schemas = nil }()
+
+	ps.Publish("admin-schema", []byte(`{"t":21.5}`), nil)
+
+	mux := http.NewServeMux()
+	setupSchemaRoutes(mux, ps)
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, target, nil)
+		request.Header.Set(apiKeyHeader, "root")
+		response := httptest.NewRecorder()
+		mux.ServeHTTP(response, request)
+		return response
+	}
+
+	var listed []TopicSchema
+	response := serve("GET", "/admin/schemas")
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &listed))
+	if assert.Len(t, listed, 1) {
+		assert.Equal(t, "admin-schema", listed[0].Topic)
+		assert.True(t, listed[0].Learning)
+		assert.Equal(t, 1, listed[0].Samples)
+	}
+
+	assert.Equal(t, http.StatusNoContent, serve("DELETE", "/admin/schemas/admin-schema").Code)
+	assert.Equal(t, http.StatusNotFound, serve("DELETE", "/admin/schemas/admin-schema").Code)
+	assert.Empty(t, ps.Schemas.Schemas())
+}
@@ -0,0 +1,72 @@
+// This file gives publishers that also subscribe read-your-writes consistency. The
+// history sequences the messages of a topic, but messages published concurrently, by
+// several clients or relayed by other nodes, could be fanned out in another order than
+// the one they were given, so each subscriber, the publisher included, could see its
+// own message before or after others than the history says. With the option enabled,
+// a message is sequenced and fanned out in one step per topic, so every subscriber of
+// this node receives the messages of a topic in the order of its history, and a
+// subscription starting from an earlier position receives the replayed messages and
+// the live ones without gap or duplicate. Nodes of a cluster each sequence the
+// messages they deliver, in the order the messages reach them.
+package main
+
+import "sync"
+
+// Serializes the deliveries to each topic
+type topicSequencer struct {
+	mu    sync.Mutex
+	locks map[string]*sequenceLock
+}
+
+// The lock of a topic, dropped once no delivery holds or waits for it
+type sequenceLock struct {
+	sync.Mutex
+	users int
+}
+
+// Function to create a sequencer.
+// Returns:
+// *topicSequencer - The sequencer, holding no topic.
+func newTopicSequencer() *topicSequencer {
+	return &topicSequencer{locks: map[string]*sequenceLock{}}
+}
+
+// Function to wait until no other delivery to a topic is in progress and hold it.
+// Parameters:
+// topic: string - The topic.
+// Returns:
+// func() - Releases the topic.
+func (s *topicSequencer) lock(topic string) func() {
+	s.mu.Lock()
+	l := s.locks[topic]
+	if l == nil {
+		l = &sequenceLock{}
+		s.locks[topic] = l
+	}
+	l.users++
+	s.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		s.mu.Lock()
+		l.users--
+		if l.users == 0 {
+			delete(s.locks, topic)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Function to hold a topic while its messages are sequenced and fanned out, if
+// read-your-writes consistency is enabled. It must not be called with ps.mu held.
+// Parameters:
+// topic: string - The topic.
+// Returns:
+// func() - Releases the topic.
+func (ps *PubSub) sequence(topic string) func() {
+	if ps.sequencer == nil {
+		return func() {}
+	}
+	return ps.sequencer.lock(topic)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// orderRecorder records the messages delivered to a client in order.
+type orderRecorder struct {
+	messages []string
+	mu       sync.Mutex
+}
+
+func (r *orderRecorder) Deliver(topic string, message []byte) error {
+	// Yielding lets concurrent deliveries interleave
+	runtime.Gosched()
+	r.mu.Lock()
+	r.messages = append(r.messages, string(message))
+	r.mu.Unlock()
+	return nil
+}
+
+// historyOrder lists the messages of a topic in the order of the history.
+func historyOrder(t *testing.T, pubsub *PubSub, topic string) []string {
+	t.Helper()
+	entries, err := pubsub.History.Entries(topic)
+	assert.NoError(t, err)
+	var messages []string
+	for _, entry := range entries {
+		messages = append(messages, string(entry.Payload))
+	}
+	return messages
+}
+
+func TestReadYourWrites(t *testing.T) {
+	pubsub := &PubSub{History: NewMemoryHistory(JSONEntryCodec{}, 10_000), sequencer: newTopicSequencer()}
+	const publishers, messages = 4, 200
+
+	// Every publisher subscribes to the topic it publishes to
+	recorders := make([]*orderRecorder, publishers)
+	for i := range recorders {
+		recorders[i] = &orderRecorder{}
+		pubsub.Subscribe(&Client{Id: fmt.Sprint("publisher-", i), Transport: recorders[i]}, "orders")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < publishers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < messages; n++ {
+				pubsub.Publish("orders", []byte(fmt.Sprintf(`{"publisher":%d,"n":%d}`, i, n)), nil)
+			}
+		}()
+	}
+	// Messages relayed by other nodes interleave with the local ones
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for n := 0; n < messages; n++ {
+			pubsub.deliver(context.Background(), fmt.Sprint("remote-", n), "orders", []byte(fmt.Sprintf(`{"node":"b","n":%d}`, n)))
+		}
+	}()
+	// A subscriber from the earliest message joins while they are published
+	late := &orderRecorder{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		pubsub.SubscribeWith(&Client{Id: "late", Transport: late}, "orders", SubscribeOptions{Start: &StartPosition{Earliest: true}})
+	}()
+	wg.Wait()
+
+	history := historyOrder(t, pubsub, "orders")
+	assert.Len(t, history, (publishers+1)*messages)
+	for i, recorder := range recorders {
+		assert.Equal(t, history, recorder.messages, "Publisher %d should receive every message in the order of the history", i)
+	}
+	assert.Equal(t, history, late.messages, "The replay and the live messages should follow each other without gap or duplicate")
+	assert.Empty(t, pubsub.sequencer.locks, "The locks of idle topics should be dropped")
+}
+
+func TestSequenceWithoutReadYourWrites(t *testing.T) {
+	pubsub := &PubSub{}
+	unlock := pubsub.sequence("orders")
+	// Another delivery to the topic does not wait
+	pubsub.sequence("orders")()
+	unlock()
+}
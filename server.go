@@ -0,0 +1,485 @@
+// This file constructs the server from its configuration: the options of its
+// handlers, the PubSub with its history, moderation, scanning and bridges, and the
+// HTTP server with its routes.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Pieces of the server given in code, replacing those the configuration would build
+type serverParts struct {
+	authenticator *JWTAuthenticator
+	apiKeys       *APIKeyStore
+	acl           *ACL
+	history       *MemoryHistory
+	limits        *Limits
+	clientIDs     ClientIDProvider
+}
+
+// Function to construct the server from a configuration. Its handlers serve the
+// PubSub it builds, with options of their own.
+// Parameters:
+// config: Config - The configuration.
+// Returns:
+// *http.Server - The server, ready to be run.
+// func() - Closes the bridges, cluster, prober, MQTT and TCP listeners, archives the history and flushes the traces once the server stopped.
+// error - An error if a file named by the configuration could not be loaded or a value is invalid.
+func NewServer(config Config) (*http.Server, func(), error) {
+	server, _, closeAll, err := newServer(config, serverParts{})
+	return server, closeAll, err
+}
+
+// Function to construct the server from a configuration and pieces given in code.
+// Parameters:
+// config: Config - The configuration.
+// parts: serverParts - The pieces replacing those of the configuration.
+// Returns:
+// *http.Server - The server, ready to be run.
+// *PubSub - The PubSub of the server.
+// func() - Closes what the server started once it stopped.
+// error - An error if a file named by the configuration could not be loaded or a value is invalid.
+func newServer(config Config, parts serverParts) (*http.Server, *PubSub, func(), error) {
+	var closers []func()
+	closeAll := func() {
+		for i := len(closers) - 1; i >= 0; i-- {
+			closers[i]()
+		}
+	}
+	fail := func(err error) (*http.Server, *PubSub, func(), error) {
+		closeAll()
+		return nil, nil, nil, err
+	}
+
+	options, err := configureHandlers(config)
+	if err != nil {
+		return fail(err)
+	}
+	if parts.authenticator != nil {
+		options.jwtAuthenticator = parts.authenticator
+	}
+	if parts.apiKeys != nil {
+		options.apiKeys = parts.apiKeys
+	}
+	if parts.acl != nil {
+		options.acl = parts.acl
+	}
+	if parts.clientIDs != nil {
+		options.clientIDs = parts.clientIDs
+	}
+	if parts.limits != nil {
+		options.defaultLimits = *parts.limits
+		options.widgetLimits.HeartbeatInterval = options.defaultLimits.HeartbeatInterval
+		options.widgetLimits.RateLimit, options.widgetLimits.RateBurst = options.defaultLimits.RateLimit, options.defaultLimits.RateBurst
+	}
+	if config.TraceEndpoint != "" {
+		shutdownTracing, err := setupTracing(config.TraceEndpoint, config.TraceSampleRatio)
+		if err != nil {
+			return fail(err)
+		}
+		closers = append(closers, shutdownTracing)
+	}
+
+	pubsub, err := newPubSub(config, parts.history)
+	if err != nil {
+		return fail(err)
+	}
+	pubsub.opts = options
+
+	mux := http.NewServeMux()
+	if options.apiKeys != nil {
+		setupAPIKeyRoutes(mux, pubsub)
+		setupTopicAdminRoutes(mux, pubsub)
+		setupTopicLifecycleRoutes(mux, pubsub)
+		setupACLRoutes(mux, pubsub)
+		setupSimulationRoutes(mux, pubsub)
+		setupReportRoutes(mux, pubsub)
+		setupDrainRoutes(mux, pubsub)
+		setupAdminRoutes(mux, pubsub)
+		setupQueryRoutes(mux, pubsub)
+		setupDebugRoutes(mux, pubsub)
+		setupStatusRoutes(mux, pubsub)
+		setupWebhookRoutes(mux, pubsub)
+		setupPrewarmRoutes(mux, pubsub)
+		if options.jwtAuthenticator != nil && options.jwtAuthenticator.CanMint() {
+			setupTokenRoutes(mux, pubsub)
+		}
+		if pubsub.Moderation != nil {
+			setupModerationRoutes(mux, pubsub)
+		}
+		if pubsub.Schemas != nil {
+			setupSchemaRoutes(mux, pubsub)
+		}
+	}
+
+	if options.jwtAuthenticator != nil {
+		setupWidgetRoutes(mux, pubsub)
+	}
+
+	if config.NATSURL != "" {
+		bridge, err := NewNATSBridge(config.NATSURL, pubsub)
+		if err != nil {
+			return fail(err)
+		}
+		closers = append(closers, bridge.Close)
+		pubsub.Bridges = append(pubsub.Bridges, bridge)
+	}
+	if config.RedisURL != "" {
+		bridge, err := NewRedisBridge(config.RedisURL, pubsub)
+		if err != nil {
+			return fail(err)
+		}
+		closers = append(closers, bridge.Close)
+		pubsub.Bridges = append(pubsub.Bridges, bridge)
+	}
+	nodeId := autoId()
+	if config.ClusterAddress != "" {
+		if config.ClusterSecret == "" {
+			return fail(errors.New("cluster mode needs a cluster secret"))
+		}
+		cluster := NewCluster(config.ClusterAddress, config.ClusterSecret, pubsub)
+		closers = append(closers, cluster.Close)
+		cluster.Restart = restartProcess
+		mux.Handle("/cluster", cluster)
+		if options.apiKeys != nil {
+			setupRolloutRoutes(mux, cluster)
+		}
+		pubsub.Bridges = append(pubsub.Bridges, cluster)
+		cluster.SharePresence(clusterPresenceInterval)
+		if len(config.ClusterPeers) > 0 {
+			cluster.Join(config.ClusterPeers)
+		}
+		nodeId = cluster.NodeId
+	}
+	if pubsub.Archiver != nil {
+		pubsub.Archiver.Start()
+		closers = append(closers, pubsub.Archiver.Stop)
+	}
+	if pubsub.FanOut != nil {
+		closers = append(closers, pubsub.FanOut.Stop)
+	}
+	if pubsub.Analytics != nil {
+		pubsub.Analytics.Start()
+		closers = append(closers, pubsub.Analytics.Stop)
+	}
+	if config.TopicIdleTTL > 0 {
+		collector := NewTopicCollector(pubsub, config.TopicIdleTTL)
+		collector.Start()
+		closers = append(closers, collector.Stop)
+	}
+	if config.IdleTimeout > 0 {
+		reaper := NewIdleReaper(pubsub, config.IdleTimeout)
+		reaper.Start()
+		closers = append(closers, reaper.Stop)
+	}
+	if config.ProbeInterval > 0 {
+		prober := NewProber(nodeId, config.ProbeInterval, pubsub)
+		prober.Start()
+		closers = append(closers, prober.Stop)
+	}
+	if config.MQTTAddr != "" {
+		mqttServer, err := ListenMQTT(config.MQTTAddr, pubsub)
+		if err != nil {
+			return fail(err)
+		}
+		closers = append(closers, func() { mqttServer.Close() })
+		go mqttServer.Serve()
+	}
+	if config.TCPAddr != "" {
+		tcpServer, err := ListenTCP(config.TCPAddr, pubsub)
+		if err != nil {
+			return fail(err)
+		}
+		closers = append(closers, func() { tcpServer.Close() })
+		go tcpServer.Serve()
+	}
+
+	setupRoutes(mux, pubsub, config.StaticDir, config.MetricsPath)
+	return &http.Server{Addr: config.ListenAddr, Handler: mux}, pubsub, closeAll, nil
+}
+
+// Function to construct the options the handlers of a server read: TLS, origins,
+// authentication, access control, limits and outbound queues.
+// Parameters:
+// config: Config - The configuration.
+// Returns:
+// *serverOptions - The options.
+// error - An error if a file named by the configuration could not be loaded or a value is invalid.
+func configureHandlers(config Config) (*serverOptions, error) {
+	options := newServerOptions()
+	options.upgrader.ReadBufferSize = config.ReadBufferSize
+	options.upgrader.WriteBufferSize = config.WriteBufferSize
+	options.widgetUpgrader.ReadBufferSize = config.ReadBufferSize
+	options.widgetUpgrader.WriteBufferSize = config.WriteBufferSize
+	options.shutdownTimeout = config.ShutdownTimeout
+	options.readTimeout = config.ReadTimeout
+	options.writeTimeout = config.WriteTimeout
+
+	if err := validDeflateLevel(config.PermessageDeflateLevel); err != nil {
+		return nil, err
+	}
+	options.upgrader.EnableCompression = config.PermessageDeflate
+	options.widgetUpgrader.EnableCompression = config.PermessageDeflate
+	options.permessageDeflateLevel = config.PermessageDeflateLevel
+	options.permessageDeflateExcluded = config.PermessageDeflateExcludeTopics
+	options.topicMetricsLimit = config.TopicMetricsLimit
+	options.connections.max.Store(int64(config.MaxConnections))
+	options.connections.maxPerIP.Store(int64(config.MaxConnsPerIP))
+
+	options.tlsOptions = TLSOptions{
+		CertFile:      config.TLSCertFile,
+		KeyFile:       config.TLSKeyFile,
+		AutocertHosts: config.AutocertHosts,
+		AutocertCache: config.AutocertCache,
+		AutocertEmail: config.AutocertEmail,
+	}
+	options.allowedOrigins = parseOrigins(strings.Join(config.AllowedOrigins, ","))
+	if config.CloseReasonCatalog != "" {
+		if err := options.catalog.Load(config.CloseReasonCatalog); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.JWTSecret != "" {
+		options.jwtAuthenticator = NewHMACAuthenticator([]byte(config.JWTSecret))
+	} else if config.JWTPublicKeyFile != "" {
+		pemData, err := os.ReadFile(config.JWTPublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if options.jwtAuthenticator, err = NewPublicKeyAuthenticator(pemData); err != nil {
+			return nil, err
+		}
+	}
+	if options.jwtAuthenticator != nil {
+		options.jwtAuthenticator.Issuer = config.JWTIssuer
+		options.jwtAuthenticator.Audience = config.JWTAudience
+		options.jwtAuthenticator.TokenTTL = config.TokenTTL
+		options.jwtAuthenticator.TokenMaxTTL = config.TokenMaxTTL
+	}
+
+	if config.APIKeysFile != "" {
+		options.apiKeys = NewAPIKeyStore()
+		if err := options.apiKeys.LoadFile(config.APIKeysFile); err != nil {
+			return nil, err
+		}
+	}
+	if config.AdminAPIKey != "" {
+		if options.apiKeys == nil {
+			options.apiKeys = NewAPIKeyStore()
+		}
+		options.apiKeys.Add(config.AdminAPIKey, "admin", []string{PermissionAdmin})
+	}
+
+	if config.ACLFile != "" {
+		var err error
+		if options.acl, err = LoadACL(config.ACLFile); err != nil {
+			return nil, err
+		}
+	}
+	if config.InviteSecret != "" {
+		options.inviteKey = []byte(config.InviteSecret)
+	}
+
+	options.defaultLimits = Limits{
+		MaxSubscriptions:  config.MaxSubscriptions,
+		MaxMessageSize:    config.MaxMessageSize,
+		RateLimit:         config.RateLimit,
+		RateBurst:         config.RateBurst,
+		HeartbeatInterval: config.HeartbeatInterval.Milliseconds(),
+	}
+	options.rateLimitStrikes = config.RateLimitStrikes
+	if config.WidgetTokenTTL <= 0 {
+		return nil, fmt.Errorf("invalid widget_token_ttl %v", config.WidgetTokenTTL)
+	}
+	options.widgetTokenTTL = config.WidgetTokenTTL
+	options.widgetLimits = Limits{
+		MaxSubscriptions:  config.WidgetMaxSubscriptions,
+		MaxMessageSize:    config.WidgetMaxMessageSize,
+		RateLimit:         options.defaultLimits.RateLimit,
+		RateBurst:         options.defaultLimits.RateBurst,
+		HeartbeatInterval: options.defaultLimits.HeartbeatInterval,
+	}
+	if config.SendQueueSize < 1 {
+		return nil, fmt.Errorf("invalid send_queue_size %d", config.SendQueueSize)
+	}
+	options.sendQueueSize = config.SendQueueSize
+	var err error
+	if options.slowConsumerPolicy, err = ParseSlowConsumerPolicy(config.SlowConsumerPolicy); err != nil {
+		return nil, err
+	}
+	if options.trustedProxies, err = parseTrustedProxies(config.TrustedProxies); err != nil {
+		return nil, err
+	}
+	if options.clientIDs, err = ParseClientIDProvider(config.ClientIDProvider); err != nil {
+		return nil, err
+	}
+	if config.SlowStartRate > 0 {
+		options.slowStart = SlowStart{InitialRate: config.SlowStartRate, Duration: config.SlowStartDuration}
+	}
+	if options.unauthorizedPolicy, err = ParseUnauthorizedPolicy(config.UnauthorizedPolicy); err != nil {
+		return nil, err
+	}
+	// The topics of the server are the ones starting with $, which clients cannot publish to
+	if !reservedTopic(config.HoneypotTopic) {
+		return nil, fmt.Errorf("invalid honeypot_topic %q", config.HoneypotTopic)
+	}
+	options.honeypotTopic = config.HoneypotTopic
+	options.trustClientPublisher = config.TrustClientPublisher
+	for _, path := range config.StrictJSONEndpoints {
+		options.strictJSONEndpoints[path] = true
+	}
+	if !reservedTopic(config.AdminEventsTopic) {
+		return nil, fmt.Errorf("invalid admin_events_topic %q", config.AdminEventsTopic)
+	}
+	options.adminEventsTopic = config.AdminEventsTopic
+	options.debugLogDir = config.DebugLogDir
+	options.statusGracePeriod = config.StatusGracePeriod
+	return options, nil
+}
+
+// Function to construct a PubSub with the history, moderation and content scanning
+// a configuration asks for. Bridges are added by NewServer.
+// Parameters:
+// config: Config - The configuration.
+// Returns:
+// *PubSub - The PubSub.
+// error - An error if a file named by the configuration could not be loaded or a value is invalid.
+func NewPubSub(config Config) (*PubSub, error) {
+	return newPubSub(config, nil)
+}
+
+// Function to construct a PubSub from a configuration and, optionally, a history given in code.
+// Parameters:
+// config: Config - The configuration.
+// history: *MemoryHistory - The history, or nil for the one the configuration asks for.
+// Returns:
+// *PubSub - The PubSub.
+// error - An error if a file named by the configuration could not be loaded or a value is invalid.
+func newPubSub(config Config, history *MemoryHistory) (*PubSub, error) {
+	pubsub := &PubSub{History: history}
+
+	var retention *RetentionPolicy
+	if config.RetentionPolicyFile != "" {
+		var err error
+		if retention, err = LoadRetentionPolicy(config.RetentionPolicyFile); err != nil {
+			return nil, err
+		}
+	}
+	if history == nil && (config.HistoryLimit > 0 || retention != nil) {
+		codec, err := GetEntryCodec(config.HistoryCodec)
+		if err != nil {
+			return nil, err
+		}
+		pubsub.History = NewMemoryHistory(codec, config.HistoryLimit)
+		pubsub.History.Retention = retention
+		if config.HistoryCompression != "" {
+			if pubsub.History.Compression, err = ParseCompressionRules(config.HistoryCompression); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if config.ReadYourWrites {
+		pubsub.sequencer = newTopicSequencer()
+	}
+	pubsub.ExplicitTopics = config.ExplicitTopics
+	pubsub.RegistryShards = config.RegistryShards
+	if config.FanOutWorkers > 0 {
+		pubsub.FanOut = NewFanOutPool(config.FanOutWorkers, config.FanOutThreshold)
+	}
+	pubsub.Redelivery = RedeliveryPolicy{
+		AckTimeout:    config.AckTimeout,
+		Backoff:       config.RedeliveryBackoff,
+		MaxBackoff:    config.RedeliveryMaxDelay,
+		MaxDeliveries: config.MaxDeliveries,
+	}
+	lifetimes, err := NewSubscriptionStore(config.DurableSubsFile)
+	if err != nil {
+		return nil, err
+	}
+	pubsub.Lifetimes = lifetimes
+	pubsub.Sessions = NewSessionStore(config.SessionGrace)
+	pubsub.Sessions.QueueSize = config.OfflineQueueSize
+
+	if config.ArchiveDir != "" {
+		pubsub.Archive = FileArchive{Dir: config.ArchiveDir}
+	}
+	if len(config.ArchiveTopics) > 0 {
+		if pubsub.History == nil {
+			return nil, fmt.Errorf("archiving history needs a history limit or retention policy")
+		}
+		if config.ArchiveS3Endpoint == "" || config.ArchiveS3Bucket == "" {
+			return nil, fmt.Errorf("archiving history needs an S3 endpoint and bucket")
+		}
+		if config.ArchiveInterval <= 0 {
+			return nil, fmt.Errorf("archive interval %v is not positive", config.ArchiveInterval)
+		}
+		store := &S3Store{
+			Endpoint:  config.ArchiveS3Endpoint,
+			Region:    config.ArchiveS3Region,
+			Bucket:    config.ArchiveS3Bucket,
+			AccessKey: config.ArchiveS3AccessKey,
+			SecretKey: config.ArchiveS3SecretKey,
+		}
+		pubsub.Archiver = NewHistoryArchiver(store, config.ArchiveTopics, pubsub)
+		pubsub.Archiver.Prefix = config.ArchiveS3Prefix
+		pubsub.Archiver.Interval = config.ArchiveInterval
+	}
+
+	if len(config.ModerationTopics) > 0 {
+		var hook ModerationHook
+		if config.ModerationHookURL != "" {
+			hook = HTTPModerationHook{URL: config.ModerationHookURL}
+		}
+		pubsub.Moderation = NewModeration(config.ModerationTopics, hook, pubsub)
+		pubsub.Moderation.Timeout = config.ModerationTimeout
+		pubsub.Moderation.TimeoutVerdict = Verdict(config.ModerationTimeoutVerdict)
+	}
+
+	if config.ScanURL != "" {
+		rules, err := ParseScanRules(config.ScanTopics)
+		if err != nil {
+			return nil, err
+		}
+		pubsub.Scanning = NewContentScanning(HTTPClassifier{URL: config.ScanURL}, rules, pubsub)
+		pubsub.Scanning.Timeout = config.ScanTimeout
+	}
+
+	if len(config.SchemaTopics) > 0 {
+		if config.SchemaSampleRate <= 0 || config.SchemaSampleRate > 1 {
+			return nil, fmt.Errorf("schema sample rate %v is not within (0, 1]", config.SchemaSampleRate)
+		}
+		pubsub.Schemas = NewSchemaMonitor(config.SchemaTopics, pubsub)
+		pubsub.Schemas.SampleRate = config.SchemaSampleRate
+		pubsub.Schemas.LearningSamples = config.SchemaLearningSamples
+		pubsub.Schemas.DriftThreshold = config.SchemaDriftThreshold
+	}
+
+	if config.AnalyticsPolicyFile != "" {
+		if config.AnalyticsURL == "" {
+			return nil, fmt.Errorf("an analytics policy needs an analytics URL")
+		}
+		policy, err := LoadAnalyticsPolicy(config.AnalyticsPolicyFile)
+		if err != nil {
+			return nil, err
+		}
+		var sink AnalyticsSink = HTTPAnalyticsSink{URL: config.AnalyticsURL}
+		if config.AnalyticsClickHouseTable != "" {
+			sink = ClickHouseSink{URL: config.AnalyticsURL, Table: config.AnalyticsClickHouseTable}
+		}
+		pubsub.Analytics = NewAnalytics(policy, sink)
+	}
+
+	if config.MatchmakingFile != "" {
+		var err error
+		if pubsub.Matchmaking, err = newMatchmaker(pubsub, config.MatchmakingFile); err != nil {
+			return nil, err
+		}
+	}
+	return pubsub, nil
+}
@@ -0,0 +1,91 @@
+// This file shuts the server down gracefully on SIGTERM or SIGINT: upgrades are
+// refused, every client gets its pending messages followed by a close frame, and the
+// HTTP server stops within a timeout instead of dying mid-write.
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Function to run the server until it fails or a termination signal arrives, then
+// shut it down gracefully.
+// Parameters:
+// server: *http.Server - The server, with its address and handler set.
+// pubsub: *PubSub - The PubSub of the server.
+// Returns:
+// error - The error that stopped the server, or the error of the shutdown.
+func run(server *http.Server, pubsub *PubSub) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	errs := make(chan error, 1)
+	go func() { errs <- listenAndServe(server, pubsub.options().tlsOptions) }()
+
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-signals:
+		slog.Info("Shutting down", "signal", sig.String())
+	}
+	return shutdown(server, pubsub, pubsub.options().shutdownTimeout)
+}
+
+// Function to shut the server down: stop accepting connections and upgrades, then
+// drain and close every client.
+// Parameters:
+// server: *http.Server - The running server.
+// pubsub: *PubSub - The PubSub of the server.
+// timeout: time.Duration - How long the whole shutdown may take.
+// Returns:
+// error - An error if the shutdown did not complete in time.
+func shutdown(server *http.Server, pubsub *PubSub, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	pubsub.options().shuttingDown.Store(true)
+	// WebSocket connections are hijacked, so this only stops the listeners and plain HTTP requests
+	err := server.Shutdown(ctx)
+	return errors.Join(err, pubsub.Shutdown(ctx))
+}
+
+// Function to disconnect every WebSocket client after writing the messages queued for it.
+// Parameters:
+// ctx: context.Context - Bounds how long to wait for the queues to drain.
+// Returns:
+// error - The context's error if some queues were not drained in time.
+func (ps *PubSub) Shutdown(ctx context.Context) error {
+	clients := ps.Clients()
+
+	var err error
+	for _, client := range clients {
+		if !client.Closable() {
+			continue
+		}
+		if flushErr := disconnectClient(ctx, client, ReasonServerShutdown, true); flushErr != nil {
+			err = flushErr
+		}
+	}
+	return err
+}
+
+// Function to refuse an upgrade request while the server shuts down.
+// Parameters:
+// w: http.ResponseWriter - The response writer.
+// Returns:
+// bool - True if the request was refused.
+func (ps *PubSub) rejectDuringShutdown(w http.ResponseWriter) bool {
+	if !ps.options().shuttingDown.Load() {
+		return false
+	}
+	w.Header().Set("Retry-After", "5")
+	http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+	return true
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShutdownFlushesQueuedMessagesBeforeClosing(t *testing.T) {
+	pubsub := &PubSub{}
+	client, peer := newTestClient(t)
+	client.Outbox = newStalledOutbox(&client, 8, DisconnectSlowConsumer)
+	pubsub.AddClient(client)
+	for _, message := range []string{"one", "two"} {
+		assert.NoError(t, client.Outbox.Push(NewPayload([]byte(message))))
+	}
+
+	go client.Outbox.run()
+	client.Outbox.ready <- struct{}{}
+	assert.NoError(t, pubsub.Shutdown(context.Background()))
+
+	for _, expected := range []string{"one", "two"} {
+		_, message, err := peer.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(message))
+	}
+	_, _, err := peer.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "The client should get the shutdown close code")
+}
+
+func TestShutdownStopsServerAndClosesClients(t *testing.T) {
+	isolatePubSub(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(ps.webSocketHandler)}
+	go server.Serve(listener)
+	url := "ws://" + listener.Addr().String()
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	_, _, err = ws.ReadMessage()
+	assert.NoError(t, err, "The client should get its welcome message")
+
+	assert.NoError(t, shutdown(server, ps, time.Second))
+
+	_, _, err = ws.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "The client should get the shutdown close code")
+	_, _, err = websocket.DefaultDialer.Dial(url, nil)
+	assert.Error(t, err, "The server should stop accepting connections")
+}
+
+func TestWebSocketHandlerRefusesUpgradesDuringShutdown(t *testing.T) {
+	options := isolatePubSub(t)
+	options.shuttingDown.Store(true)
+
+	request := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	recorder := httptest.NewRecorder()
+	ps.webSocketHandler(recorder, request)
+
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	assert.NotEmpty(t, recorder.Header().Get("Retry-After"))
+}
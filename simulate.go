@@ -0,0 +1,234 @@
+// This file previews the impact of a policy change before it is rolled out. The admin
+// API evaluates a proposed ACL, default limits or topic policies against the clients
+// connected now and reports the subscriptions that would be rejected and the clients
+// whose limits would tighten, without applying it. None of these changes closes a
+// connection: rejected subscriptions are removed and new limits apply when clients
+// reconnect, so there are no disconnects to report.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// When a subscription that is no longer allowed is removed
+const (
+	// The change re-authorizes the subscribers of the topic
+	revokedImmediately = "immediately"
+	// The subscribers of the topic are re-authorized periodically
+	revokedAtReauthorization = "next_reauthorization"
+	// The subscription is kept until the client subscribes again
+	revokedAtSubscribe = "next_subscribe"
+)
+
+// PolicyChange is a proposed change of the ACL, the default limits or the policies of topics.
+// Nil fields are left as they are.
+type PolicyChange struct {
+	ACL *ACL `json:"acl,omitempty"`
+	// Proposes removing the ACL, allowing everything
+	RemoveACL bool                   `json:"removeAcl,omitempty"`
+	Limits    *Limits                `json:"limits,omitempty"`
+	Policies  map[string]TopicPolicy `json:"policies,omitempty"`
+}
+
+// SimulatedRejection is a subscription a change would no longer allow.
+type SimulatedRejection struct {
+	ClientId  string `json:"clientId"`
+	Principal string `json:"principal,omitempty"`
+	Topic     string `json:"topic"`
+	// What refuses it: acl or policy
+	Cause string `json:"cause"`
+	// When it would be removed: immediately, next_reauthorization or next_subscribe
+	Revoked string `json:"revoked"`
+}
+
+// SimulatedThrottle is a client whose limits a change would tighten. New default limits
+// apply to the connections made after they are rolled out.
+type SimulatedThrottle struct {
+	ClientId  string `json:"clientId"`
+	Principal string `json:"principal,omitempty"`
+	// Names of the limits that would be lower
+	Tightened []string `json:"tightened"`
+	Limits    Limits   `json:"limits"`
+	// Subscriptions the client holds over its new maximum, refused when it reconnects
+	OverSubscriptions int `json:"overSubscriptions,omitempty"`
+}
+
+// SimulationReport is the impact of a change on the clients connected when it was simulated.
+type SimulationReport struct {
+	Rejected  []SimulatedRejection `json:"rejected"`
+	Throttled []SimulatedThrottle  `json:"throttled"`
+}
+
+// Function to evaluate a change against the connected clients and their subscriptions
+// without applying it.
+// Parameters:
+// change: PolicyChange - The proposed change.
+// Returns:
+// SimulationReport - The clients and subscriptions affected.
+// error - An error if a proposed policy is invalid or names a topic that does not exist.
+func (ps *PubSub) Simulate(change PolicyChange) (SimulationReport, error) {
+	for name, policy := range change.Policies {
+		if err := policy.validate(); err != nil {
+			return SimulationReport{}, fmt.Errorf("policy of %s: %w", name, err)
+		}
+	}
+	proposedACL := change.ACL
+	if proposedACL == nil && !change.RemoveACL {
+		proposedACL = ps.currentACL()
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for name := range change.Policies {
+		if _, ok := ps.Topics[name]; !ok {
+			return SimulationReport{}, fmt.Errorf("%s: %w", name, errUnknownTopic)
+		}
+	}
+
+	report := SimulationReport{Rejected: []SimulatedRejection{}, Throttled: []SimulatedThrottle{}}
+	for _, sub := range ps.Subscriptions() {
+		if rejection, ok := ps.simulateSubscriptionLocked(sub, change, proposedACL); ok {
+			report.Rejected = append(report.Rejected, rejection)
+		}
+	}
+	if change.Limits != nil {
+		clients := ps.Clients()
+		for i := range clients {
+			if throttle, ok := ps.simulateLimitsLocked(&clients[i], *change.Limits); ok {
+				report.Throttled = append(report.Throttled, throttle)
+			}
+		}
+	}
+	sort.Slice(report.Rejected, func(i, j int) bool {
+		a, b := report.Rejected[i], report.Rejected[j]
+		return a.Topic < b.Topic || a.Topic == b.Topic && a.ClientId < b.ClientId
+	})
+	return report, nil
+}
+
+// Function to check whether a change would reject a subscription. The caller must hold ps.mu.
+// Parameters:
+// sub: Subscription - The subscription.
+// change: PolicyChange - The proposed change.
+// proposedACL: *ACL - The ACL after the change, or nil for none.
+// Returns:
+// SimulatedRejection - The rejection.
+// bool - True if the subscription would no longer be allowed while it is allowed now.
+func (ps *PubSub) simulateSubscriptionLocked(sub Subscription, change PolicyChange, proposedACL *ACL) (SimulatedRejection, bool) {
+	// Subscriptions not allowed now are not the change's doing
+	if !ps.subscriberAuthorizedLocked(sub) {
+		return SimulatedRejection{}, false
+	}
+	access := accessTopicOf(sub.Topic)
+	rejection := SimulatedRejection{ClientId: sub.Client.Id, Principal: sub.Client.Principal(), Topic: sub.Topic}
+
+	// Without a topic there is no policy to re-authorize on, so the subscription stays
+	var policy TopicPolicy
+	topic, ok := ps.Topics[access]
+	if ok {
+		policy = topic.Policy
+		if proposed, changed := change.Policies[access]; changed {
+			policy = proposed
+		}
+	}
+
+	switch {
+	case proposedACL != nil && !proposedACL.Allowed(sub.Client, SUBSCRIBE, access):
+		rejection.Cause = "acl"
+	case ok && !sub.Invited && !topic.allowsWith(sub.Client, SUBSCRIBE, policy):
+		rejection.Cause = "policy"
+	default:
+		return SimulatedRejection{}, false
+	}
+
+	switch {
+	case ok && policy.ReauthorizeOnChange:
+		rejection.Revoked = revokedImmediately
+	case ok && policy.ReauthorizeInterval > 0:
+		rejection.Revoked = revokedAtReauthorization
+	default:
+		rejection.Revoked = revokedAtSubscribe
+	}
+	return rejection, true
+}
+
+// Function to check whether new default limits would tighten the limits of a client.
+// The caller must hold ps.mu.
+// Parameters:
+// client: *Client - The client.
+// defaults: Limits - The proposed default limits.
+// Returns:
+// SimulatedThrottle - The throttle.
+// bool - True if any limit of the client would be lower.
+func (ps *PubSub) simulateLimitsLocked(client *Client, defaults Limits) (SimulatedThrottle, bool) {
+	proposed := limitsFrom(defaults, client.Claims)
+	current := client.Limits
+	var tightened []string
+	// A zero limit is no limit
+	lower := func(proposed, current float64) bool {
+		return proposed > 0 && (current <= 0 || proposed < current)
+	}
+	if lower(float64(proposed.MaxSubscriptions), float64(current.MaxSubscriptions)) {
+		tightened = append(tightened, "maxSubscriptions")
+	}
+	if lower(float64(proposed.MaxMessageSize), float64(current.MaxMessageSize)) {
+		tightened = append(tightened, "maxMessageSize")
+	}
+	if lower(proposed.RateLimit, current.RateLimit) {
+		tightened = append(tightened, "rateLimit")
+	}
+	if lower(float64(proposed.RateBurst), float64(current.RateBurst)) {
+		tightened = append(tightened, "rateBurst")
+	}
+	if len(tightened) == 0 {
+		return SimulatedThrottle{}, false
+	}
+
+	throttle := SimulatedThrottle{ClientId: client.Id, Principal: client.Principal(), Tightened: tightened, Limits: proposed}
+	if proposed.MaxSubscriptions > 0 {
+		count := len(ps.clientTopics(client.Id))
+		throttle.OverSubscriptions = max(count-proposed.MaxSubscriptions, 0)
+	}
+	return throttle, true
+}
+
+// Function to check whether a topic would allow a client an action under another policy.
+// Parameters:
+// client: *Client - The client.
+// action: string - PUBLISH or SUBSCRIBE.
+// policy: TopicPolicy - The policy.
+// Returns:
+// bool - True if the owner, the grants and the policy allow the action.
+func (topic *Topic) allowsWith(client *Client, action string, policy TopicPolicy) bool {
+	proposed := *topic
+	proposed.Policy = policy
+	return proposed.allows(client, action)
+}
+
+// Function to register the admin API simulating policy changes.
+// Parameters:
+// mux: *http.ServeMux - The mux to register the routes on.
+// pubsub: *PubSub - The PubSub the routes serve.
+func setupSimulationRoutes(mux *http.ServeMux, pubsub *PubSub) {
+	mux.HandleFunc("POST /admin/simulate", pubsub.requireAPIKey(PermissionAdmin, func(w http.ResponseWriter, r *http.Request) {
+		var change PolicyChange
+		if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		report, err := pubsub.Simulate(change)
+		if errors.Is(err, errUnknownTopic) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	}))
+}
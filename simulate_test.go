@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSimulateACLAndPolicyChanges(t *testing.T) {
+	pubsub := &PubSub{Topics: map[string]*Topic{
+		"orders": {Name: "orders", Owner: "carol", Policy: TopicPolicy{ReauthorizeOnChange: true}},
+		"prices": {Name: "prices", Policy: TopicPolicy{ReauthorizeInterval: 60}},
+	}}
+	alice := &Client{Id: "a", Claims: jwt.MapClaims{"sub": "alice"}}
+	bob := &Client{Id: "b", Claims: jwt.MapClaims{"sub": "bob"}}
+	carol := &Client{Id: "c", Claims: jwt.MapClaims{"sub": "carol"}}
+	for _, client := range []*Client{alice, bob, carol} {
+		pubsub.Subscribe(client, "orders")
+	}
+	pubsub.Subscribe(bob, "prices")
+	pubsub.Subscribe(bob, "news")
+
+	report, err := pubsub.Simulate(PolicyChange{
+		ACL:      &ACL{Rules: []ACLRule{{Identity: "*", Subscribe: []string{"orders"}}, {Identity: "carol", Subscribe: []string{"*"}}}},
+		Policies: map[string]TopicPolicy{"orders": {Private: true, ReauthorizeOnChange: true}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []SimulatedRejection{
+		{ClientId: "b", Principal: "bob", Topic: "news", Cause: "acl", Revoked: revokedAtSubscribe},
+		{ClientId: "a", Principal: "alice", Topic: "orders", Cause: "policy", Revoked: revokedImmediately},
+		{ClientId: "b", Principal: "bob", Topic: "orders", Cause: "policy", Revoked: revokedImmediately},
+		{ClientId: "b", Principal: "bob", Topic: "prices", Cause: "acl", Revoked: revokedAtReauthorization},
+	}, report.Rejected, "The owner keeps its subscription to its private topic")
+	assert.Len(t, pubsub.Subscriptions(), 5, "Simulating a change does not apply it")
+	assert.Nil(t, pubsub.currentACL())
+
+	_, err = pubsub.Simulate(PolicyChange{Policies: map[string]TopicPolicy{"missing": {}}})
+	assert.ErrorIs(t, err, errUnknownTopic)
+}
+
+func TestSimulateLimits(t *testing.T) {
+	pubsub := &PubSub{}
+	unlimited := Client{Id: "u"}
+	overridden := Client{Id: "o", Claims: jwt.MapClaims{limitsClaim: map[string]interface{}{"maxSubscriptions": 10}}, Limits: Limits{MaxSubscriptions: 10}}
+	pubsub.AddClient(unlimited)
+	pubsub.AddClient(overridden)
+	for _, topic := range []string{"a", "b", "c"} {
+		pubsub.Subscribe(&unlimited, topic)
+	}
+
+	report, err := pubsub.Simulate(PolicyChange{Limits: &Limits{MaxSubscriptions: 2, RateLimit: 5}})
+	assert.NoError(t, err)
+	if assert.Len(t, report.Throttled, 2) {
+		assert.Equal(t, []string{"maxSubscriptions", "rateLimit"}, report.Throttled[0].Tightened)
+		assert.Equal(t, 1, report.Throttled[0].OverSubscriptions)
+		assert.Equal(t, []string{"rateLimit"}, report.Throttled[1].Tightened, "Limits claims keep overriding the defaults")
+	}
+}
+
+func TestSimulationRoute(t *testing.T) {
+	isolatePubSub(t)
+	ps.Subscribe(&Client{Id: "a"}, "orders")
+	keys := NewAPIKeyStore()
+	ps.options().apiKeys = keys
+	keys.Add("root", "admin", []string{PermissionAdmin})
+
+	mux := http.NewServeMux()
+	setupSimulationRoutes(mux, ps)
+	simulate := func(body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest("POST", "/admin/simulate", strings.NewReader(body))
+		request.Header.Set(apiKeyHeader, "root")
+		response := httptest.NewRecorder()
+		mux.ServeHTTP(response, request)
+		return response
+	}
+
+	response := simulate(`{"acl": {"rules": []}}`)
+	assert.Equal(t, http.StatusOK, response.Code)
+	var report SimulationReport
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &report))
+	assert.Len(t, report.Rejected, 1)
+	assert.Equal(t, http.StatusNotFound, simulate(`{"policies": {"missing": {}}}`).Code)
+	assert.Equal(t, http.StatusBadRequest, simulate(`{`).Code)
+}
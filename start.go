@@ -0,0 +1,172 @@
+// This file lets a subscription start delivering from an earlier position than the next
+// published message, as Kafka consumers do: the earliest message still available, the
+// message with a given sequence, or the first message published at or after a given
+// time. The messages from the start position are read from the history and, when the
+// topic is archived, the archive, and delivered before any message published after the
+// subscription, in the form the subscription asked for.
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Start positions of subscriptions, besides a sequence or an RFC 3339 time
+const (
+	// Only messages published after subscribing, the default
+	StartLatest = "latest"
+	// Every message still available
+	StartEarliest = "earliest"
+)
+
+var errInvalidStart = errors.New("start must be latest, earliest, a sequence or an RFC 3339 time")
+
+// StartPosition is where a subscription starts delivering from, other than the latest
+// message.
+type StartPosition struct {
+	// Every message still available
+	Earliest bool
+	// The messages whose sequence is at least Sequence, if positive
+	Sequence uint64
+	// The messages published at or after Time, if not zero
+	Time time.Time
+}
+
+// Function to parse the start position of a subscribe frame.
+// Parameters:
+// value: string - latest or "", earliest, a sequence as given in history frames, or an RFC 3339 time.
+// Returns:
+// *StartPosition - The position, nil for latest.
+// error - errInvalidStart if the value is none of these.
+func ParseStartPosition(value string) (*StartPosition, error) {
+	switch value {
+	case "", StartLatest:
+		return nil, nil
+	case StartEarliest:
+		return &StartPosition{Earliest: true}, nil
+	}
+	if sequence, err := strconv.ParseUint(value, 10, 64); err == nil && sequence > 0 {
+		return &StartPosition{Sequence: sequence}, nil
+	}
+	if at, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return &StartPosition{Time: at}, nil
+	}
+	return nil, errInvalidStart
+}
+
+// Function to tell whether an entry of the history is at or after the position.
+// Parameters:
+// entry: HistoryEntry - The entry.
+// Returns:
+// bool - True if the entry is delivered to a subscription starting at the position.
+func (s *StartPosition) Includes(entry HistoryEntry) bool {
+	switch {
+	case s.Sequence > 0:
+		return entry.Sequence >= s.Sequence
+	case !s.Time.IsZero():
+		return !entry.Timestamp.Before(s.Time)
+	}
+	return s.Earliest
+}
+
+// Function to read the archived messages of a topic from a start position, so they can
+// be delivered once ps.mu is held.
+// Parameters:
+// ctx: context.Context - Cancels the requests to the archive.
+// topic: string - The topic.
+// start: *StartPosition - The start position, or nil for latest.
+// Returns:
+// []HistoryEntry - The archived entries, oldest first; nil without a start position or an archive.
+// error - An error if the archive could not be read.
+func (ps *PubSub) archivedFrom(ctx context.Context, topic string, start *StartPosition) ([]HistoryEntry, error) {
+	if start == nil || ps.Archiver == nil {
+		return nil, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, archiveTimeout)
+	defer cancel()
+	return ps.Archiver.From(ctx, topic, start)
+}
+
+// Function to deliver the messages of a topic from the start position of a new
+// subscription, before any message published after it. The caller must hold ps.mu.
+// Parameters:
+// client: *Client - The subscribing client.
+// topic: string - The topic.
+// options: SubscribeOptions - The options of the subscription, with its start position.
+func (ps *PubSub) replayLocked(client *Client, topic string, options SubscribeOptions) {
+	entries := options.archived
+	if ps.History != nil {
+		recent, err := ps.History.Entries(topic)
+		if err != nil {
+			client.logger().Error("Error reading the history", logKeyTopic, topic, "error", err)
+		}
+		// Entries still in memory may have been archived too
+		seen := make(map[string]bool, len(entries))
+		for _, entry := range entries {
+			seen[entry.Id] = true
+		}
+		for _, entry := range recent {
+			if !seen[entry.Id] && options.Start.Includes(entry) {
+				entries = append(entries, entry)
+			}
+		}
+	}
+
+	for _, entry := range entries {
+		if options.Filter != nil && !options.Filter.Matches(entry.Payload) {
+			continue
+		}
+		payload := NewMessagePayload(entry.Payload)
+		if options.Envelope {
+			payload = NewPayload(envelopeMessage(entry.Id, topic, entry.Payload, nil, "", replyHeaders{}))
+		}
+		if err := client.DeliverPayload(topic, payload); err != nil {
+			client.logger().Error("Error replaying a message", logKeyTopic, topic, "error", err)
+			return
+		}
+	}
+	client.logger().Info("Replayed messages from the start position", logKeyTopic, topic, "messages", len(entries))
+}
+
+// Function to read the archived entries of a topic from a start position, newest
+// segments first, at most maxArchiveReplay entries.
+// Parameters:
+// ctx: context.Context - Cancels the requests to the store.
+// topic: string - The topic.
+// start: *StartPosition - The start position.
+// Returns:
+// []HistoryEntry - The entries at or after the position, oldest first.
+// error - An error if the archive could not be read.
+func (a *HistoryArchiver) From(ctx context.Context, topic string, start *StartPosition) ([]HistoryEntry, error) {
+	if !a.Archives(topic) {
+		return nil, nil
+	}
+	manifest, err := a.manifest(ctx, topic)
+	if err != nil {
+		return nil, err
+	}
+	var entries []HistoryEntry
+	for i := len(manifest.Segments) - 1; i >= 0 && len(entries) < maxArchiveReplay; i-- {
+		segment := manifest.Segments[i]
+		if !start.Time.IsZero() && segment.To.Before(start.Time) {
+			break
+		}
+		read, err := a.readSegment(ctx, segment)
+		if err != nil {
+			return nil, err
+		}
+		read = slices.DeleteFunc(read, func(entry HistoryEntry) bool { return !start.Includes(entry) })
+		entries = append(read, entries...)
+		// Sequences grow, so the segments before one holding earlier sequences hold only those
+		if start.Sequence > 0 && len(read) < segment.Count {
+			break
+		}
+	}
+	if len(entries) > maxArchiveReplay {
+		entries = entries[len(entries)-maxArchiveReplay:]
+	}
+	return entries, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseStartPosition(t *testing.T) {
+	for _, value := range []string{"", "latest"} {
+		start, err := ParseStartPosition(value)
+		assert.NoError(t, err)
+		assert.Nil(t, start)
+	}
+	start, err := ParseStartPosition("earliest")
+	assert.NoError(t, err)
+	assert.Equal(t, &StartPosition{Earliest: true}, start)
+	start, err = ParseStartPosition("42")
+	assert.NoError(t, err)
+	assert.Equal(t, &StartPosition{Sequence: 42}, start)
+	start, err = ParseStartPosition("2026-10-17T09:00:00Z")
+	assert.NoError(t, err)
+	assert.Equal(t, &StartPosition{Time: time.Date(2026, 10, 17, 9, 0, 0, 0, time.UTC)}, start)
+
+	for _, value := range []string{"0", "-1", "yesterday"} {
+		_, err := ParseStartPosition(value)
+		assert.ErrorIs(t, err, errInvalidStart, value)
+	}
+}
+
+func TestSubscribeFromStartPosition(t *testing.T) {
+	pubsub := &PubSub{History: NewMemoryHistory(JSONEntryCodec{}, 10)}
+	pubsub.History.Append("m1", "orders", []byte(`{"n":1}`))
+	second, _ := pubsub.History.Append("m2", "orders", []byte(`{"n":2}`))
+	time.Sleep(time.Millisecond)
+	at := time.Now()
+	pubsub.History.Append("m3", "orders", []byte(`{"n":3}`))
+
+	// subscribe subscribes a new client from a start position and publishes m4
+	subscribe := func(options SubscribeOptions) []map[string]interface{} {
+		recorder := &eventRecorder{}
+		pubsub.SubscribeWith(&Client{Id: "consumer", Transport: recorder}, "orders", options)
+		pubsub.fanOut(context.Background(), "m4", "orders", []byte(`{"n":4}`))
+		pubsub.Unsubscribe(&Client{Id: "consumer"}, "orders")
+		return recorder.frames
+	}
+	numbers := func(frames []map[string]interface{}) []float64 {
+		var numbers []float64
+		for _, frame := range frames {
+			numbers = append(numbers, frame["n"].(float64))
+		}
+		return numbers
+	}
+
+	assert.Equal(t, []float64{4}, numbers(subscribe(SubscribeOptions{})), "Latest should only deliver new messages")
+	assert.Equal(t, []float64{1, 2, 3, 4}, numbers(subscribe(SubscribeOptions{Start: &StartPosition{Earliest: true}})))
+	assert.Equal(t, []float64{2, 3, 4}, numbers(subscribe(SubscribeOptions{Start: &StartPosition{Sequence: second.Sequence}})))
+	assert.Equal(t, []float64{3, 4}, numbers(subscribe(SubscribeOptions{Start: &StartPosition{Time: at}})))
+
+	enveloped := subscribe(SubscribeOptions{Envelope: true, Start: &StartPosition{Time: at}})
+	if assert.Len(t, enveloped, 2) {
+		assert.Equal(t, "m3", enveloped[0]["id"])
+		assert.Equal(t, map[string]interface{}{"n": float64(3)}, enveloped[0]["message"])
+		assert.Equal(t, "m4", enveloped[1]["id"])
+	}
+}
+
+func TestSubscribeFromArchivedStartPosition(t *testing.T) {
+	_, store := newFakeS3(t)
+	ctx := context.Background()
+	pubsub := &PubSub{History: NewMemoryHistory(JSONEntryCodec{}, 2)}
+	pubsub.Archiver = NewHistoryArchiver(store, []string{"orders"}, pubsub)
+	var entries []HistoryEntry
+	for i := 1; i <= 4; i++ {
+		entry, _ := pubsub.History.Append(fmt.Sprintf("m%d", i), "orders", []byte(fmt.Sprintf(`{"n":%d}`, i)))
+		entries = append(entries, entry)
+		assert.NoError(t, pubsub.Archiver.Flush(ctx))
+	}
+	pubsub.History.Append("m5", "orders", []byte(`{"n":5}`))
+
+	// Memory holds m4 and m5, the archive m1 to m4
+	for _, test := range []struct {
+		start *StartPosition
+		want  []float64
+	}{
+		{&StartPosition{Earliest: true}, []float64{1, 2, 3, 4, 5}},
+		{&StartPosition{Sequence: entries[1].Sequence}, []float64{2, 3, 4, 5}},
+		{&StartPosition{Time: entries[2].Timestamp}, []float64{3, 4, 5}},
+	} {
+		options := SubscribeOptions{Start: test.start}
+		var err error
+		options.archived, err = pubsub.archivedFrom(ctx, "orders", test.start)
+		assert.NoError(t, err)
+
+		recorder := &eventRecorder{}
+		pubsub.SubscribeWith(&Client{Id: "consumer", Transport: recorder}, "orders", options)
+		pubsub.Unsubscribe(&Client{Id: "consumer"}, "orders")
+		var numbers []float64
+		for _, frame := range recorder.frames {
+			numbers = append(numbers, frame["n"].(float64))
+		}
+		assert.Equal(t, test.want, numbers)
+	}
+}
+
+func TestSubscribeRefusesInvalidStartPosition(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(ps.webSocketHandler))
+	defer server.Close()
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+server.URL[4:], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	ws.ReadMessage()
+
+	ws.WriteJSON(map[string]string{"action": "subscribe", "topic": "start-orders", "start": "yesterday"})
+	_, ack, _ := ws.ReadMessage()
+	assert.Equal(t, "Server received the message!", string(ack))
+	_, refusal, err := ws.ReadMessage()
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"action":"error","code":"invalid_start","topic":"start-orders"}`, string(refusal))
+}
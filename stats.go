@@ -0,0 +1,152 @@
+// This file streams the health of a subscription to the subscribing client. A client
+// subscribing with a stats interval periodically gets a stats frame with the messages
+// delivered and dropped on that subscription, the delivery rate and the queueing lag,
+// so client SDKs can adapt by themselves, e.g. switch to conflation or drop topics.
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Protocol action of the periodic stats frame of a subscription
+const STATS = "stats"
+
+// Shortest interval between two stats frames of a subscription
+const minStatsInterval = time.Second
+
+// SubscriptionStats counts what happened to the messages of one subscription.
+// Its methods may be called on a nil pointer, for subscriptions that are not tracked.
+type SubscriptionStats struct {
+	Interval  time.Duration
+	delivered atomic.Int64
+	drops     atomic.Int64
+	// How long the last delivered message waited in the queue, in nanoseconds
+	lag  atomic.Int64
+	stop chan struct{}
+	once sync.Once
+}
+
+// The frame reporting the stats of a subscription
+type statsFrame struct {
+	Action    string `json:"action"`
+	Topic     string `json:"topic"`
+	Delivered int64  `json:"delivered"`
+	Dropped   int64  `json:"dropped"`
+	// Messages delivered per second since the previous frame
+	DeliveredRate float64 `json:"deliveredRate"`
+	LagMs         int64   `json:"lagMs"`
+	// Messages waiting in the client's queue
+	Queued int `json:"queued"`
+}
+
+// Function to create the stats of a subscription.
+// Parameters:
+// interval: time.Duration - How often the stats are sent, raised to minStatsInterval.
+// Returns:
+// *SubscriptionStats - The stats, with every counter at zero.
+func NewSubscriptionStats(interval time.Duration) *SubscriptionStats {
+	if interval < minStatsInterval {
+		interval = minStatsInterval
+	}
+	return &SubscriptionStats{Interval: interval, stop: make(chan struct{})}
+}
+
+// Function to count a message written to the client.
+// Parameters:
+// queuedAt: time.Time - When the message was queued.
+func (s *SubscriptionStats) written(queuedAt time.Time) {
+	if s == nil {
+		return
+	}
+	s.delivered.Add(1)
+	s.lag.Store(int64(time.Since(queuedAt)))
+}
+
+// Function to count a message dropped instead of being written to the client.
+func (s *SubscriptionStats) dropped() {
+	if s == nil {
+		return
+	}
+	s.drops.Add(1)
+}
+
+// Function to start sending the stats of a subscription to its client every interval,
+// until they are stopped or the client can no longer be written to.
+// Parameters:
+// client: *Client - The subscribing client.
+// topic: string - The topic of the subscription.
+func (s *SubscriptionStats) Start(client *Client, topic string) {
+	go func() {
+		ticker := time.NewTicker(s.Interval)
+		defer ticker.Stop()
+		var previous int64
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+			}
+			frame := s.frame(client, topic, previous)
+			previous = frame.Delivered
+			message, _ := json.Marshal(frame)
+			if err := client.Send(message); err != nil {
+				client.logger().Debug("Stopping subscription stats", logKeyTopic, topic, "error", err)
+				return
+			}
+		}
+	}()
+}
+
+// Function to build the stats frame of a subscription.
+// Parameters:
+// client: *Client - The subscribing client.
+// topic: string - The topic of the subscription.
+// previous: int64 - The messages delivered when the previous frame was built.
+// Returns:
+// statsFrame - The frame.
+func (s *SubscriptionStats) frame(client *Client, topic string, previous int64) statsFrame {
+	frame := statsFrame{
+		Action:    STATS,
+		Topic:     topic,
+		Delivered: s.delivered.Load(),
+		Dropped:   s.drops.Load(),
+		LagMs:     time.Duration(s.lag.Load()).Milliseconds(),
+	}
+	frame.DeliveredRate = float64(frame.Delivered-previous) / s.Interval.Seconds()
+	if client.Outbox != nil {
+		frame.Queued = client.Outbox.Len()
+	}
+	return frame
+}
+
+// Function to stop sending the stats of a subscription. It is safe to call more than once.
+func (s *SubscriptionStats) Stop() {
+	if s == nil {
+		return
+	}
+	s.once.Do(func() { close(s.stop) })
+}
+
+// Function to deliver a shared payload for a subscription whose stats are tracked.
+// Parameters:
+// topic: string - The topic the message was published to.
+// payload: *Payload - The payload.
+// stats: *SubscriptionStats - The stats of the subscription.
+// Returns:
+// error - An error if the payload could not be delivered.
+func (client *Client) deliverTracked(topic string, payload *Payload, stats *SubscriptionStats) error {
+	if client.Transport == nil && client.Outbox != nil {
+		return client.Outbox.PushTracked(payload, stats)
+	}
+	queuedAt := time.Now()
+	err := client.DeliverPayload(topic, payload)
+	if err != nil {
+		stats.dropped()
+		return err
+	}
+	stats.written(queuedAt)
+	return nil
+}
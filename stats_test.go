@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubscriptionStatsFrames(t *testing.T) {
+	pubsub := &PubSub{}
+	client, peer := newTestClient(t)
+	client.Outbox = NewOutbox(&client, 8, DisconnectSlowConsumer, SlowStart{})
+	defer client.Outbox.Close()
+	pubsub.AddClient(client)
+
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"prices","statsInterval":10}`))
+	assert.Equal(t, minStatsInterval, pubsub.Subscriptions()[0].Stats.Interval, "The interval should be raised to the minimum")
+	for i := 0; i < 3; i++ {
+		pubsub.Publish("prices", []byte(`"tick"`), nil)
+	}
+	for i := 0; i < 3; i++ {
+		_, message, err := peer.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, `"tick"`, string(message))
+	}
+
+	peer.SetReadDeadline(time.Now().Add(2 * minStatsInterval))
+	_, data, err := peer.ReadMessage()
+	assert.NoError(t, err)
+	var frame statsFrame
+	assert.NoError(t, json.Unmarshal(data, &frame))
+	assert.Equal(t, STATS, frame.Action)
+	assert.Equal(t, "prices", frame.Topic)
+	assert.Equal(t, int64(3), frame.Delivered)
+	assert.Equal(t, int64(0), frame.Dropped)
+	assert.Equal(t, 3.0, frame.DeliveredRate)
+
+	pubsub.Unsubscribe(&client, "prices")
+	peer.SetReadDeadline(time.Now().Add(minStatsInterval + 200*time.Millisecond))
+	_, _, err = peer.ReadMessage()
+	assert.Error(t, err, "No stats should be sent once unsubscribed")
+}
+
+func TestSubscriptionStatsCountDrops(t *testing.T) {
+	client, peer := newTestClient(t)
+	outbox := newStalledOutbox(&client, 2, DropOldest)
+	client.Outbox = outbox
+	stats := NewSubscriptionStats(time.Second)
+
+	for _, message := range []string{"one", "two", "three"} {
+		assert.NoError(t, client.deliverTracked("news", NewPayload([]byte(message)), stats))
+	}
+	assert.Equal(t, int64(1), stats.drops.Load(), "The dropped message should be counted on its subscription")
+
+	go outbox.run()
+	defer outbox.Close()
+	for range 2 {
+		_, _, err := peer.ReadMessage()
+		assert.NoError(t, err)
+	}
+	assert.Eventually(t, func() bool { return stats.delivered.Load() == 2 }, time.Second, 10*time.Millisecond)
+	frame := stats.frame(&client, "news", 0)
+	assert.Equal(t, int64(2), frame.Delivered)
+	assert.Equal(t, int64(1), frame.Dropped)
+	assert.Equal(t, 0, frame.Queued)
+}
@@ -0,0 +1,246 @@
+// This file tracks whether users are online: a user is online while at least one of
+// their connections is open, and goes offline once the last one has been closed for a
+// grace period, so a client reconnecting after a network blip does not flap. Changes
+// are published on presence/<user>, and clients and the HTTP API can ask for the status
+// and last-seen time of users. Users are the principals of authenticated clients; in a
+// cluster each node reports the users connected to it.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Protocol action asking for the status of users, and the frame announcing a change
+const STATUS = "status"
+
+// Prefix of the topics the status of each user is published on
+const statusPrefix = "presence/"
+
+// Statuses of a user
+const (
+	StatusOnline  = "online"
+	StatusOffline = "offline"
+)
+
+// Maximum number of users in one status request
+const maxStatusUsers = 100
+
+// UserStatus is whether a user is online and when they were last seen.
+type UserStatus struct {
+	User   string `json:"user"`
+	Status string `json:"status"`
+	// When the last connection of the user closed, unknown for users never seen
+	LastSeen    *time.Time `json:"lastSeen,omitempty"`
+	Connections int        `json:"connections"`
+}
+
+// The connections of a user
+type userPresence struct {
+	connections int
+	online      bool
+	lastSeen    time.Time
+	// Incremented on every connection, so a pending offline transition of an earlier
+	// disconnection can tell it is stale
+	generation uint64
+}
+
+// Tracker of the status of every user seen since the server started
+type statusTracker struct {
+	users map[string]*userPresence
+	mu    sync.Mutex
+}
+
+// Function to get the topic the status of a user is published on.
+// Parameters:
+// user: string - The principal of the user.
+// Returns:
+// string - The topic, e.g. presence/alice.
+func statusTopic(user string) string {
+	return statusPrefix + user
+}
+
+// Function to record that a connection of a user opened. The user goes online at once.
+// Parameters:
+// user: string - The principal of the user, or an empty string for anonymous clients.
+func (ps *PubSub) userConnected(user string) {
+	if user == "" {
+		return
+	}
+	ps.status.mu.Lock()
+	if ps.status.users == nil {
+		ps.status.users = map[string]*userPresence{}
+	}
+	presence := ps.status.users[user]
+	if presence == nil {
+		presence = &userPresence{}
+		ps.status.users[user] = presence
+	}
+	presence.connections++
+	presence.generation++
+	changed := !presence.online
+	presence.online = true
+	status := presence.status(user)
+	ps.status.mu.Unlock()
+
+	if changed {
+		ps.announceStatus(status)
+	}
+}
+
+// Function to record that a connection of a user closed. The user goes offline once
+// they have had no connection for the grace period.
+// Parameters:
+// user: string - The principal of the user, or an empty string for anonymous clients.
+// grace: time.Duration - The grace period in force when the connection opened.
+func (ps *PubSub) userDisconnected(user string, grace time.Duration) {
+	if user == "" {
+		return
+	}
+	ps.status.mu.Lock()
+	presence := ps.status.users[user]
+	if presence == nil || presence.connections == 0 {
+		ps.status.mu.Unlock()
+		return
+	}
+	presence.connections--
+	presence.lastSeen = time.Now().UTC()
+	generation := presence.generation
+	last := presence.connections == 0
+	ps.status.mu.Unlock()
+
+	if last {
+		time.AfterFunc(grace, func() { ps.userWentOffline(user, generation) })
+	}
+}
+
+// Function to take a user offline once the grace period after their last connection
+// closed has elapsed, unless they connected again meanwhile.
+// Parameters:
+// user: string - The principal of the user.
+// generation: uint64 - The generation of the user when the connection closed.
+func (ps *PubSub) userWentOffline(user string, generation uint64) {
+	ps.status.mu.Lock()
+	presence := ps.status.users[user]
+	if presence == nil || presence.generation != generation || presence.connections > 0 || !presence.online {
+		ps.status.mu.Unlock()
+		return
+	}
+	presence.online = false
+	status := presence.status(user)
+	ps.status.mu.Unlock()
+
+	ps.announceStatus(status)
+}
+
+// Function to describe the presence of a user.
+// Parameters:
+// user: string - The principal of the user.
+// Returns:
+// UserStatus - The status.
+func (p *userPresence) status(user string) UserStatus {
+	status := UserStatus{User: user, Status: StatusOffline, Connections: p.connections}
+	if p.online {
+		status.Status = StatusOnline
+	}
+	if !p.lastSeen.IsZero() {
+		lastSeen := p.lastSeen
+		status.LastSeen = &lastSeen
+	}
+	return status
+}
+
+// Function to publish a change of the status of a user on their status topic.
+// Parameters:
+// status: UserStatus - The new status.
+func (ps *PubSub) announceStatus(status UserStatus) {
+	ps.release(context.Background(), autoId(), statusTopic(status.User), statusMessage(status))
+}
+
+// Function to build the frame announcing the status of a user.
+// Parameters:
+// status: UserStatus - The status.
+// Returns:
+// []byte - The JSON encoded frame.
+func statusMessage(status UserStatus) []byte {
+	message, _ := json.Marshal(struct {
+		Action string `json:"action"`
+		UserStatus
+	}{STATUS, status})
+	return message
+}
+
+// Function to get the status of users.
+// Parameters:
+// users: []string - The principals of the users.
+// Returns:
+// []UserStatus - The status of each user, in the order asked; users never seen are offline.
+func (ps *PubSub) UserStatuses(users []string) []UserStatus {
+	ps.status.mu.Lock()
+	defer ps.status.mu.Unlock()
+	statuses := make([]UserStatus, 0, len(users))
+	for _, user := range users {
+		if presence := ps.status.users[user]; presence != nil {
+			statuses = append(statuses, presence.status(user))
+		} else {
+			statuses = append(statuses, UserStatus{User: user, Status: StatusOffline})
+		}
+	}
+	return statuses
+}
+
+// Function to answer a status request of a client. The client must be allowed to
+// subscribe to the status topic of every user it asks about.
+// Parameters:
+// client: *Client - The client asking.
+// m: Message - The request, listing the users.
+func (ps *PubSub) handleStatus(client *Client, m Message) {
+	if len(m.Users) == 0 || len(m.Users) > maxStatusUsers {
+		client.Send(errorMessage("invalid_status_request", ""))
+		return
+	}
+	for _, user := range m.Users {
+		topic := statusTopic(user)
+		if !client.TopicAllowed(SUBSCRIBE, topic) || !ps.aclAllows(client, SUBSCRIBE, topic) || !ps.canAccessTopic(topic, client, SUBSCRIBE) {
+			m.Topic = topic
+			ps.refuse(client, m)
+			return
+		}
+	}
+	message, _ := json.Marshal(struct {
+		Action string       `json:"action"`
+		Users  []UserStatus `json:"users"`
+	}{STATUS, ps.UserStatuses(m.Users)})
+	client.Send(message)
+}
+
+// Function to register the HTTP API answering the status of users, e.g.
+// GET /status?user=alice&user=bob.
+// Parameters:
+// mux: *http.ServeMux - The mux to register the route on.
+// pubsub: *PubSub - The PubSub the route serves.
+func setupStatusRoutes(mux *http.ServeMux, pubsub *PubSub) {
+	mux.HandleFunc("GET /status", pubsub.requireAPIKey(PermissionSubscribe, func(w http.ResponseWriter, r *http.Request) {
+		users := r.URL.Query()["user"]
+		if len(users) == 0 || len(users) > maxStatusUsers {
+			http.Error(w, fmt.Sprintf("give 1 to %d user parameters", maxStatusUsers), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, pubsub.UserStatuses(users))
+	}))
+}
+
+// Function to tell whether a topic is the status topic of a user, which only the
+// server publishes to.
+// Parameters:
+// topic: string - The topic.
+// Returns:
+// bool - True for presence/<user> topics.
+func isStatusTopic(topic string) bool {
+	return strings.HasPrefix(topic, statusPrefix)
+}
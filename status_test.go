@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+// A transport recording the statuses announced on the topics it subscribes to
+type statusRecorder struct {
+	statuses []UserStatus
+	mu       sync.Mutex
+}
+
+func (r *statusRecorder) Deliver(topic string, message []byte) error {
+	var status UserStatus
+	json.Unmarshal(message, &status)
+	r.mu.Lock()
+	r.statuses = append(r.statuses, status)
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *statusRecorder) announced() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	statuses := []string{}
+	for _, status := range r.statuses {
+		statuses = append(statuses, status.Status)
+	}
+	return statuses
+}
+
+func TestStatusTransitionsAreDebounced(t *testing.T) {
+	grace := 100 * time.Millisecond
+	pubsub := &PubSub{}
+	recorder := &statusRecorder{}
+	pubsub.Subscribe(&Client{Id: "watcher", Transport: recorder}, statusTopic("alice"))
+
+	pubsub.userConnected("alice")
+	assert.Equal(t, []string{StatusOnline}, recorder.announced())
+	assert.Nil(t, recorder.statuses[0].LastSeen)
+
+	// A second tab, and a reconnection within the grace period, change nothing
+	pubsub.userConnected("alice")
+	pubsub.userDisconnected("alice", grace)
+	pubsub.userDisconnected("alice", grace)
+	time.Sleep(20 * time.Millisecond)
+	pubsub.userConnected("alice")
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, []string{StatusOnline}, recorder.announced(), "Reconnecting within the grace period should not go offline")
+	status := pubsub.UserStatuses([]string{"alice"})[0]
+	assert.Equal(t, StatusOnline, status.Status)
+	assert.Equal(t, 1, status.Connections)
+	assert.NotNil(t, status.LastSeen)
+
+	pubsub.userDisconnected("alice", grace)
+	assert.Eventually(t, func() bool { return len(recorder.announced()) == 2 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{StatusOnline, StatusOffline}, recorder.announced())
+	assert.Equal(t, "alice", recorder.statuses[1].User)
+	assert.NotNil(t, recorder.statuses[1].LastSeen)
+
+	assert.Equal(t, []UserStatus{{User: "nobody", Status: StatusOffline}}, pubsub.UserStatuses([]string{"nobody"}))
+	pubsub.userConnected("")
+	assert.Nil(t, pubsub.status.users[""], "Anonymous clients should not be tracked")
+}
+
+func TestStatusAction(t *testing.T) {
+	pubsub := &PubSub{}
+	pubsub.userConnected("bob")
+	client, peer := newTestClient(t)
+
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"status","users":["bob","carol"]}`))
+	var reply struct {
+		Action string       `json:"action"`
+		Users  []UserStatus `json:"users"`
+	}
+	assert.NoError(t, peer.ReadJSON(&reply))
+	assert.Equal(t, STATUS, reply.Action)
+	assert.Equal(t, []UserStatus{{User: "bob", Status: StatusOnline, Connections: 1}, {User: "carol", Status: StatusOffline}}, reply.Users)
+
+	client.Claims = jwt.MapClaims{"sub": "mallory", topicsClaim: map[string]interface{}{"subscribe": []interface{}{"presence/bob"}}}
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"status","users":["bob","carol"]}`))
+	_, data, err := peer.ReadMessage()
+	assert.NoError(t, err)
+	assert.JSONEq(t, string(forbiddenMessage(STATUS, "presence/carol")), string(data))
+
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"publish","topic":"presence/bob","message":{"status":"offline"}}`))
+	_, data, err = peer.ReadMessage()
+	assert.NoError(t, err)
+	assert.JSONEq(t, string(forbiddenMessage(PUBLISH, "presence/bob")), string(data), "Only the server should publish statuses")
+}
+
+func TestStatusRoute(t *testing.T) {
+	keys := NewAPIKeyStore()
+	isolatePubSub(t).apiKeys = keys
+	keys.Add("app", "backend", []string{PermissionSubscribe})
+	mux := http.NewServeMux()
+	setupStatusRoutes(mux, ps)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, path, nil)
+		request.Header.Set(apiKeyHeader, "app")
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, request)
+		return recorder
+	}
+	assert.Equal(t, http.StatusBadRequest, get("/status").Code)
+	response := get("/status?user=status-route-user")
+	assert.Equal(t, http.StatusOK, response.Code)
+	var statuses []UserStatus
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &statuses))
+	assert.Equal(t, []UserStatus{{User: "status-route-user", Status: StatusOffline}}, statuses)
+}
@@ -0,0 +1,125 @@
+// This file decodes the frames of clients strictly, for security-sensitive deployments
+// that want no room for parsers disagreeing about a frame: frames that are not valid
+// UTF-8, repeat a key or carry a field the protocol does not know are refused with an
+// error code naming the violation instead of being handled. Strict decoding is turned
+// on per WebSocket endpoint.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// Error codes of the frames refused by strict decoding
+const (
+	codeInvalidJSON  = "invalid_json"
+	codeInvalidUTF8  = "invalid_utf8"
+	codeDuplicateKey = "duplicate_key"
+	codeUnknownField = "unknown_field"
+)
+
+// StrictJSONError is a frame refused by strict decoding.
+type StrictJSONError struct {
+	// The violation, e.g. duplicate_key
+	Code   string
+	Reason string
+}
+
+// Function to describe the error.
+// Returns:
+// string - The code and reason.
+func (e *StrictJSONError) Error() string {
+	return e.Code + ": " + e.Reason
+}
+
+// Function to decode a frame strictly.
+// Parameters:
+// payload: []byte - The frame.
+// m: *Message - The message decoded.
+// Returns:
+// error - A *StrictJSONError if the frame is not valid UTF-8, not a single JSON value, repeats a key or has an unknown field.
+func decodeStrict(payload []byte, m *Message) error {
+	if !utf8.Valid(payload) {
+		return &StrictJSONError{Code: codeInvalidUTF8, Reason: "frame is not valid UTF-8"}
+	}
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	if err := checkDuplicateKeys(decoder); err != nil {
+		return err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return &StrictJSONError{Code: codeInvalidJSON, Reason: "data after the frame"}
+	}
+
+	decoder = json.NewDecoder(bytes.NewReader(payload))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(m); err != nil {
+		// The decoder does not export the error of an unknown field
+		var syntax *json.SyntaxError
+		var typ *json.UnmarshalTypeError
+		if !errors.As(err, &syntax) && !errors.As(err, &typ) {
+			return &StrictJSONError{Code: codeUnknownField, Reason: err.Error()}
+		}
+		return &StrictJSONError{Code: codeInvalidJSON, Reason: err.Error()}
+	}
+	return nil
+}
+
+// Function to read a JSON value, checking that none of its objects repeats a key.
+// Parameters:
+// decoder: *json.Decoder - The decoder positioned before the value.
+// Returns:
+// error - A *StrictJSONError if the value is not valid JSON or repeats a key.
+func checkDuplicateKeys(decoder *json.Decoder) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return &StrictJSONError{Code: codeInvalidJSON, Reason: err.Error()}
+	}
+	switch token {
+	case json.Delim('{'):
+		keys := map[string]bool{}
+		for decoder.More() {
+			key, err := decoder.Token()
+			if err != nil {
+				return &StrictJSONError{Code: codeInvalidJSON, Reason: err.Error()}
+			}
+			if keys[key.(string)] {
+				return &StrictJSONError{Code: codeDuplicateKey, Reason: fmt.Sprintf("key %q given twice", key)}
+			}
+			keys[key.(string)] = true
+			if err := checkDuplicateKeys(decoder); err != nil {
+				return err
+			}
+		}
+		if _, err := decoder.Token(); err != nil {
+			return &StrictJSONError{Code: codeInvalidJSON, Reason: err.Error()}
+		}
+	case json.Delim('['):
+		for decoder.More() {
+			if err := checkDuplicateKeys(decoder); err != nil {
+				return err
+			}
+		}
+		if _, err := decoder.Token(); err != nil {
+			return &StrictJSONError{Code: codeInvalidJSON, Reason: err.Error()}
+		}
+	}
+	return nil
+}
+
+// Function to build the frame telling a client its frame was refused by strict decoding.
+// Parameters:
+// err: *StrictJSONError - The violation.
+// Returns:
+// []byte - The JSON encoded frame.
+func strictJSONMessage(err *StrictJSONError) []byte {
+	message, _ := json.Marshal(map[string]string{
+		"action": "error",
+		"code":   err.Code,
+		"reason": err.Reason,
+	})
+	return message
+}
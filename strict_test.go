@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeStrict(t *testing.T) {
+	tests := []struct {
+		frame string
+		code  string
+	}{
+		{`{"action":"publish","topic":"news","message":{"a":1,"b":[{"c":2}]}}`, ""},
+		{"{\"action\":\"publish\",\"topic\":\"n\xffws\"}", codeInvalidUTF8},
+		{`{"action":"publish","topic":"news","topic":"admin"}`, codeDuplicateKey},
+		{`{"action":"publish","message":{"a":1,"a":2}}`, codeDuplicateKey},
+		{`{"action":"publish","message":[{"a":1},{"b":1,"b":2}]}`, codeDuplicateKey},
+		{`{"action":"publish","sudo":true}`, codeUnknownField},
+		{`{"action":"publish"`, codeInvalidJSON},
+		{`{"action":"publish"} {"action":"subscribe"}`, codeInvalidJSON},
+		{`{"action":7}`, codeInvalidJSON},
+	}
+	for _, test := range tests {
+		var m Message
+		err := decodeStrict([]byte(test.frame), &m)
+		if test.code == "" {
+			assert.NoError(t, err, test.frame)
+			assert.Equal(t, "news", m.Topic)
+			continue
+		}
+		var strict *StrictJSONError
+		if assert.ErrorAs(t, err, &strict, test.frame) {
+			assert.Equal(t, test.code, strict.Code, test.frame)
+		}
+	}
+}
+
+func TestStrictClientsAreToldWhatWasWrong(t *testing.T) {
+	pubsub := &PubSub{}
+	client, peer := newTestClient(t)
+
+	// Lenient clients have unknown fields ignored
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"news","sudo":true}`))
+	assert.Len(t, pubsub.GetSubscriptions("news", &client), 1)
+
+	client.StrictJSON = true
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"sports","sudo":true}`))
+	var frame map[string]string
+	assert.NoError(t, peer.ReadJSON(&frame))
+	assert.Equal(t, "error", frame["action"])
+	assert.Equal(t, codeUnknownField, frame["code"])
+	assert.Contains(t, frame["reason"], "sudo")
+	assert.Empty(t, pubsub.GetSubscriptions("sports", &client))
+}
+
+func TestStrictJSONIsSelectedPerEndpoint(t *testing.T) {
+	options := isolatePubSub(t)
+	options.strictJSONEndpoints = map[string]bool{"/strict": true}
+	server := httptest.NewServer(http.HandlerFunc(ps.webSocketHandler))
+	defer server.Close()
+
+	send := func(path string) map[string]interface{} {
+		ws, _, err := websocket.DefaultDialer.Dial("ws"+server.URL[4:]+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ws.Close()
+		ws.ReadMessage()
+		ws.WriteMessage(websocket.TextMessage, []byte(`{"action":"who","topic":"news","topic":"admin"}`))
+		ws.ReadMessage()
+		var frame map[string]interface{}
+		assert.NoError(t, ws.ReadJSON(&frame))
+		return frame
+	}
+	assert.Equal(t, codeDuplicateKey, send("/strict")["code"])
+	assert.Equal(t, WHO, send("/ws")["action"], "Other endpoints should stay lenient")
+}
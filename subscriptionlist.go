@@ -0,0 +1,94 @@
+// This file answers {"action":"subscriptions"} with the subscriptions of the calling
+// client, so client libraries can check their state against the server's and reconcile
+// it, e.g. after a reconnect:
+// {"action":"subscriptions","subscriptions":[{"topic":"orders","qos":1,"lifetime":"session"}],"waitlisted":[{"topic":"room","position":2}]}.
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+// Action of the frame asking for the subscriptions of the client, and of its answer
+const SUBSCRIPTIONS = "subscriptions"
+
+// OwnSubscription describes a subscription of the client asking for its subscriptions.
+type OwnSubscription struct {
+	Topic    string               `json:"topic"`
+	Envelope bool                 `json:"envelope,omitempty"`
+	QoS      int                  `json:"qos,omitempty"`
+	NoEcho   bool                 `json:"noEcho,omitempty"`
+	Lifetime SubscriptionLifetime `json:"lifetime"`
+	// Whether counters are streamed for the subscription
+	Stats bool `json:"stats,omitempty"`
+	// When the subscription expires unless refreshed, if it has a TTL
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// Expression selecting the messages the subscription receives, if it has one
+	Filter string `json:"filter,omitempty"`
+}
+
+// WaitlistPlace is the place of a client on the waitlist of a full room.
+type WaitlistPlace struct {
+	Topic    string `json:"topic"`
+	Position int    `json:"position"`
+}
+
+// Function to list the subscriptions of a client and the waitlists it is on.
+// Parameters:
+// client: *Client - The client.
+// Returns:
+// []OwnSubscription - The subscriptions, sorted by topic.
+// []WaitlistPlace - The places on waitlists, sorted by topic.
+func (ps *PubSub) subscriptionsOf(client *Client) ([]OwnSubscription, []WaitlistPlace) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	subscriptions := []OwnSubscription{}
+	for _, sub := range ps.clientSubscriptions(client.Id) {
+		own := OwnSubscription{Topic: sub.Topic, Envelope: sub.Envelope, QoS: sub.QoS, NoEcho: sub.NoEcho, Lifetime: sub.Lifetime, Stats: sub.Stats != nil}
+		if own.Lifetime == "" {
+			own.Lifetime = LifetimeConnection
+		}
+		if sub.Filter != nil {
+			own.Filter = sub.Filter.Source
+		}
+		if !sub.ExpiresAt.IsZero() {
+			expiresAt := sub.ExpiresAt
+			own.ExpiresAt = &expiresAt
+		}
+		subscriptions = append(subscriptions, own)
+	}
+	waitlisted := []WaitlistPlace{}
+	for name, topic := range ps.Topics {
+		for i, entry := range topic.waitlist {
+			if entry.client.Id == client.Id {
+				waitlisted = append(waitlisted, WaitlistPlace{Topic: name, Position: i + 1})
+			}
+		}
+	}
+	sort.Slice(subscriptions, func(i, j int) bool { return subscriptions[i].Topic < subscriptions[j].Topic })
+	sort.Slice(waitlisted, func(i, j int) bool { return waitlisted[i].Topic < waitlisted[j].Topic })
+	return subscriptions, waitlisted
+}
+
+// Function to build the frame listing the subscriptions of a client.
+// Parameters:
+// subscriptions: []OwnSubscription - The subscriptions.
+// waitlisted: []WaitlistPlace - The places on waitlists.
+// Returns:
+// []byte - The JSON encoded frame.
+func subscriptionsMessage(subscriptions []OwnSubscription, waitlisted []WaitlistPlace) []byte {
+	message, _ := json.Marshal(struct {
+		Action        string            `json:"action"`
+		Subscriptions []OwnSubscription `json:"subscriptions"`
+		Waitlisted    []WaitlistPlace   `json:"waitlisted"`
+	}{SUBSCRIPTIONS, subscriptions, waitlisted})
+	return message
+}
+
+// Function to answer a client asking for its subscriptions.
+// Parameters:
+// client: *Client - The client.
+func (ps *PubSub) handleSubscriptions(client *Client) {
+	client.Send(subscriptionsMessage(ps.subscriptionsOf(client)))
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListOwnSubscriptions(t *testing.T) {
+	pubsub := &PubSub{}
+	pubsub.CreateTopic("room", "", TopicPolicy{Capacity: 1, Waitlist: true})
+	client, peer := newTestClient(t)
+	other, _ := newTestClient(t)
+	pubsub.Subscribe(&other, "room")
+	pubsub.Subscribe(&other, "orders")
+
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"orders","qos":1,"envelope":true}`))
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"alerts","ttl":60}`))
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"room"}`))
+	assert.Equal(t, WAITLISTED, readFrame(t, peer)["action"])
+
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"subscriptions"}`))
+	frame := readFrame(t, peer)
+	assert.Equal(t, SUBSCRIPTIONS, frame["action"])
+	subscriptions := frame["subscriptions"].([]interface{})
+	assert.Len(t, subscriptions, 2, "Only the subscriptions of the client are listed")
+	alerts := subscriptions[0].(map[string]interface{})
+	assert.Equal(t, "alerts", alerts["topic"])
+	assert.NotEmpty(t, alerts["expiresAt"])
+	assert.Equal(t, map[string]interface{}{"topic": "orders", "qos": 1.0, "envelope": true, "lifetime": "connection"}, subscriptions[1])
+	assert.Equal(t, []interface{}{map[string]interface{}{"topic": "room", "position": 1.0}}, frame["waitlisted"])
+}
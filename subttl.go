@@ -0,0 +1,65 @@
+// This file lets subscriptions expire: a subscribe with a ttl, e.g.
+// {"action":"subscribe","topic":"t","ttl":300}, is removed with an unsubscribed frame
+// unless the client subscribes again within ttl seconds, which refreshes it. Ephemeral
+// dashboards stay subscribed while open, and forgotten subscriptions do not accumulate.
+package main
+
+import (
+	"time"
+)
+
+// Reason of the unsubscribed frame of a subscription that was not refreshed in time
+const reasonExpired = "expired"
+
+// Function to make a subscription expire after a TTL, replacing any earlier expiry.
+// The caller must hold ps.mu.
+// Parameters:
+// sub: *Subscription - The subscription, being changed in the shard of its topic.
+// ttl: time.Duration - How long until the subscription expires, 0 for never.
+func (ps *PubSub) setExpiryLocked(sub *Subscription, ttl time.Duration) {
+	sub.stopExpiry()
+	if ttl <= 0 {
+		sub.ExpiresAt = time.Time{}
+		return
+	}
+	sub.ExpiresAt = time.Now().Add(ttl)
+	client, topic := sub.Client, sub.Topic
+	sub.expiry = time.AfterFunc(ttl, func() {
+		ps.expireSubscription(client, topic)
+	})
+}
+
+// Function to stop the timer of a subscription that expires.
+func (sub *Subscription) stopExpiry() {
+	if sub.expiry != nil {
+		sub.expiry.Stop()
+		sub.expiry = nil
+	}
+}
+
+// Function to remove a subscription whose TTL ran out, unless it was refreshed or
+// removed since, and tell its client with an unsubscribed frame.
+// Parameters:
+// client: *Client - The client of the subscription.
+// topic: string - The topic of the subscription.
+func (ps *PubSub) expireSubscription(client *Client, topic string) {
+	ps.mu.Lock()
+	expired := false
+	for _, sub := range ps.GetSubscriptions(topic, client) {
+		expired = !sub.ExpiresAt.IsZero() && !time.Now().Before(sub.ExpiresAt)
+	}
+	ps.mu.Unlock()
+	if !expired {
+		return
+	}
+
+	subscriber := ps.unsubscribe(client, topic)
+	if subscriber == nil {
+		return
+	}
+	subscriber.logger().Info("Subscription expired", logKeyTopic, topic)
+	// Clients of other transports have no frame to receive it in
+	if subscriber.Transport == nil {
+		subscriber.Send(unsubscribedMessage(topic, reasonExpired))
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubscriptionExpires(t *testing.T) {
+	pubsub := &PubSub{}
+	client, peer := newTestClient(t)
+	client.Outbox = NewOutbox(&client, 8, DisconnectSlowConsumer, SlowStart{})
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"dashboard","ttl":1}`))
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"orders"}`))
+
+	infos, err := pubsub.SubscriberInfos("dashboard")
+	if assert.NoError(t, err) && assert.Len(t, infos, 1) {
+		assert.NotNil(t, infos[0].ExpiresAt)
+	}
+	assert.Eventually(t, func() bool { return subscriptionCount(pubsub, &client, "dashboard") == 0 }, 3*time.Second, 20*time.Millisecond)
+	assert.JSONEq(t, string(unsubscribedMessage("dashboard", reasonExpired)), string(mustRead(t, peer)))
+	assert.Equal(t, 1, subscriptionCount(pubsub, &client, "orders"), "Subscriptions without a ttl do not expire")
+}
+
+func TestSubscribingAgainRefreshesExpiry(t *testing.T) {
+	pubsub := &PubSub{}
+	client, _ := newTestClient(t)
+	client.Outbox = NewOutbox(&client, 8, DisconnectSlowConsumer, SlowStart{})
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"dashboard","ttl":1}`))
+	time.Sleep(600 * time.Millisecond)
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"dashboard","ttl":1}`))
+	time.Sleep(600 * time.Millisecond)
+	assert.Equal(t, 1, subscriptionCount(pubsub, &client, "dashboard"), "A refreshed subscription should outlive its first ttl")
+
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"dashboard"}`))
+	time.Sleep(1200 * time.Millisecond)
+	assert.Equal(t, 1, subscriptionCount(pubsub, &client, "dashboard"), "Subscribing again without a ttl keeps the subscription")
+}
+
+func TestSubscribeRejectsNegativeTTL(t *testing.T) {
+	pubsub := &PubSub{}
+	client, peer := newTestClient(t)
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"dashboard","ttl":-5}`))
+	assert.JSONEq(t, string(errorMessage("invalid_ttl", "dashboard")), string(mustRead(t, peer)))
+	assert.Equal(t, 0, subscriptionCount(pubsub, &client, "dashboard"))
+}
@@ -0,0 +1,335 @@
+// This file implements a plain TCP listener speaking the envelope protocol without the
+// overhead of HTTP and WebSockets, for embedded devices and internal services. Every
+// frame is a 4 byte big-endian length, a 1 byte frame type numbered like the WebSocket
+// opcodes (1 text, 2 binary, 8 close) and the payload. A client first sends a text frame
+// {"action":"connect"} giving the token or API key a WebSocket client would present,
+// and if any the session token to resume and the will to publish if the connection
+// drops; from then on it exchanges the same frames as a WebSocket client, and shares
+// its topics, authentication, limits and policies. Close frames carry the close code
+// and reason of the WebSocket close frame.
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Action of the first frame of a TCP client
+const CONNECT = "connect"
+
+const (
+	// Size of the length and type prefixing every frame
+	tcpFrameHeaderSize = 5
+	// Largest frame read before a client is authenticated and given its limits
+	tcpMaxFrameSize = 1 << 20
+	// How long a TCP client has to send its connect frame
+	tcpConnectTimeout = 10 * time.Second
+)
+
+var errTCPFrameTooLarge = errors.New("tcp: frame too large")
+
+// TCPServer accepts clients speaking the envelope protocol over plain TCP.
+type TCPServer struct {
+	Listener net.Listener
+	ps       *PubSub
+}
+
+// StreamConn writes the frames of a client connected over plain TCP.
+type StreamConn struct {
+	conn net.Conn
+	mu   sync.Mutex
+	// How long a write may take, 0 for no limit
+	writeTimeout time.Duration
+}
+
+// tcpConnectFrame is the first frame of a TCP client.
+type tcpConnectFrame struct {
+	Action string `json:"action"`
+	// Token of the client, as in the Authorization header of an upgrade request
+	Token string `json:"token,omitempty"`
+	// API key of the client, as in the API key header of an upgrade request
+	APIKey string `json:"apiKey,omitempty"`
+	// Token of the session to resume, as in the resume query parameter
+	Resume string `json:"resume,omitempty"`
+	// Message to publish if the connection drops, as in the will query parameters
+	Will *Will `json:"will,omitempty"`
+}
+
+// Function to start listening for TCP clients.
+// Parameters:
+// addr: string - The TCP address to listen on, e.g. ":7000".
+// ps: *PubSub - The PubSub instance TCP clients publish to and subscribe on.
+// Returns:
+// *TCPServer - The listening server; call Serve to accept connections.
+// error - An error if the address could not be listened on.
+func ListenTCP(addr string, ps *PubSub) (*TCPServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &TCPServer{Listener: listener, ps: ps}, nil
+}
+
+// Function to accept TCP clients until the listener is closed.
+// Returns:
+// error - The error that stopped the accept loop.
+func (s *TCPServer) Serve() error {
+	for {
+		conn, err := s.Listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handleConn(conn)
+	}
+}
+
+// Function to stop accepting TCP clients.
+func (s *TCPServer) Close() error {
+	return s.Listener.Close()
+}
+
+// Function to write a frame to a TCP client.
+// Parameters:
+// messageType: int - The type of the frame, websocket.TextMessage, BinaryMessage or CloseMessage.
+// data: []byte - The payload.
+// Returns:
+// error - An error if the frame could not be written.
+func (c *StreamConn) WriteFrame(messageType int, data []byte) error {
+	frame := make([]byte, tcpFrameHeaderSize+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	frame[4] = byte(messageType)
+	copy(frame[tcpFrameHeaderSize:], data)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	armConnWriteDeadline(c.conn, c.writeTimeout, closeWriteWait)
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// Function to close the connection of a TCP client.
+// Returns:
+// error - An error if the connection could not be closed.
+func (c *StreamConn) Close() error {
+	return c.conn.Close()
+}
+
+// Function to read a frame of a TCP client.
+// Parameters:
+// reader: *bufio.Reader - The connection.
+// limit: int64 - The largest payload accepted.
+// Returns:
+// int - The type of the frame.
+// []byte - The payload.
+// error - An error if the frame could not be read or is over the limit.
+func readTCPFrame(reader *bufio.Reader, limit int64) (int, []byte, error) {
+	var header [tcpFrameHeaderSize]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:4])
+	if int64(size) > limit {
+		return 0, nil, errTCPFrameTooLarge
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return 0, nil, err
+	}
+	return int(header[4]), data, nil
+}
+
+// Function to build the upgrade request a connect frame stands for, so a TCP client is
+// authenticated as a WebSocket client presenting the same credentials would be.
+// Parameters:
+// remoteAddr: string - The address of the client.
+// Returns:
+// *http.Request - The request.
+func (connect tcpConnectFrame) request(remoteAddr string) *http.Request {
+	r, _ := http.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = remoteAddr
+	if connect.Token != "" {
+		r.Header.Set("Authorization", "Bearer "+connect.Token)
+	}
+	if connect.APIKey != "" {
+		r.Header.Set(apiKeyHeader, connect.APIKey)
+	}
+	return r
+}
+
+// Function to read the connect frame of a TCP client.
+// Parameters:
+// reader: *bufio.Reader - The connection.
+// Returns:
+// tcpConnectFrame - The connect frame.
+// error - An error if the first frame is not a connect frame.
+func readTCPConnect(reader *bufio.Reader) (tcpConnectFrame, error) {
+	var connect tcpConnectFrame
+	messageType, data, err := readTCPFrame(reader, tcpMaxFrameSize)
+	if err != nil {
+		return connect, err
+	}
+	if messageType != websocket.TextMessage {
+		return connect, fmt.Errorf("tcp: expected a connect frame, got frame type %d", messageType)
+	}
+	if err := json.Unmarshal(data, &connect); err != nil {
+		return connect, err
+	}
+	if connect.Action != CONNECT {
+		return connect, fmt.Errorf("tcp: expected a connect frame, got %q", connect.Action)
+	}
+	return connect, nil
+}
+
+// Function to run the session of one TCP client: the connect frame followed by the frame
+// loop, removing the client with its subscriptions when the connection ends.
+// Parameters:
+// conn: net.Conn - The accepted TCP connection.
+func (s *TCPServer) handleConn(conn net.Conn) {
+	defer conn.Close()
+	remoteAddr := conn.RemoteAddr().String()
+	reader := bufio.NewReader(conn)
+	options := s.ps.options()
+	stream := &StreamConn{conn: conn, writeTimeout: options.writeTimeout}
+
+	conn.SetReadDeadline(time.Now().Add(tcpConnectTimeout))
+	connect, err := readTCPConnect(reader)
+	if err != nil {
+		slog.Warn("TCP handshake failed", "remote_addr", remoteAddr, "error", err)
+		stream.WriteFrame(websocket.CloseMessage, options.catalog.closeMessage(ReasonProtocolError, defaultLanguage))
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	if options.shuttingDown.Load() {
+		stream.WriteFrame(websocket.CloseMessage, options.catalog.closeMessage(ReasonServerShutdown, defaultLanguage))
+		return
+	}
+	ip := hostOf(remoteAddr)
+	if err := options.connections.acquire("tcp", ip); err != nil {
+		slog.Info("Refused TCP connection", "remote_addr", remoteAddr, "error", err)
+		stream.WriteFrame(websocket.CloseMessage, options.catalog.closeMessage(connectionRefusal(err), defaultLanguage))
+		return
+	}
+	defer options.connections.release(ip)
+	r := connect.request(remoteAddr)
+	claims, err := options.authenticate(r)
+	if err != nil {
+		slog.Info("TCP client failed authentication", "remote_addr", remoteAddr, "error", err)
+		stream.WriteFrame(websocket.TextMessage, errorDetailMessage("unauthorized", "", err.Error()))
+		stream.WriteFrame(websocket.CloseMessage, options.catalog.closeMessage(ReasonUnauthorized, defaultLanguage))
+		return
+	}
+	// Widget tokens are only valid on the widget endpoint, which pins their origin
+	if isWidgetToken(claims) {
+		slog.Info("TCP client failed authentication", "remote_addr", remoteAddr, "error", errWidgetToken)
+		stream.WriteFrame(websocket.TextMessage, errorDetailMessage("unauthorized", "", errWidgetToken.Error()))
+		stream.WriteFrame(websocket.CloseMessage, options.catalog.closeMessage(ReasonUnauthorized, defaultLanguage))
+		return
+	}
+
+	id, err := options.newClientID(r, claims)
+	if err != nil {
+		slog.Info("TCP client has no valid ID", "remote_addr", remoteAddr, "error", err)
+		stream.WriteFrame(websocket.TextMessage, errorDetailMessage("invalid_client_id", "", err.Error()))
+		stream.WriteFrame(websocket.CloseMessage, options.catalog.closeMessage(ReasonPolicyViolation, defaultLanguage))
+		return
+	}
+
+	client := Client{
+		Id:       id,
+		Language: defaultLanguage,
+		Claims:   claims,
+		Limits:   options.limitsFor(claims),
+		Session:  NewSession(remoteAddr),
+		Stream:   stream,
+		server:   options,
+	}
+	// Every write goes through the client's queue so a slow reader never blocks publishers
+	client.Outbox = NewOutbox(&client, options.sendQueueSize, options.slowConsumerPolicy, options.slowStart)
+	defer client.Outbox.Close()
+	// A client presenting the token of its earlier session gets it back
+	resumed := s.ps.resumeSession(&client, connect.Resume)
+	// A connection already holding the ID is replaced by this one
+	releaseID, err := s.ps.claimClientID(client.Id)
+	if err != nil {
+		slog.Info("Refused TCP client whose ID is in use", logKeyClient, client.Id, "error", err)
+		client.Close(ReasonTryAgainLater)
+		return
+	}
+	defer releaseID()
+
+	logger := client.logger()
+	logger.Info("TCP client connected", "principal", client.Principal(), "remote_addr", remoteAddr)
+	if err := client.Send(welcomeMessage(&client)); err != nil {
+		logger.Error("Error sending welcome message", "error", err)
+	}
+	client.Will = s.ps.registerWill(&client, connect.Will)
+
+	s.ps.AddClient(client)
+	defer s.ps.RemoveClient(client)
+	defer s.ps.StopDebugCapture(client.Id)
+	s.ps.userConnected(client.Principal())
+	defer s.ps.userDisconnected(client.Principal(), options.statusGracePeriod)
+	defer s.ps.publishWill(&client)
+	s.ps.restoreSession(&client, resumed)
+	s.ps.restoreDurableSubscriptions(&client)
+
+	// Frames over the size limit of the client close the connection
+	limit := client.Limits.readLimit()
+	if limit <= 0 {
+		limit = tcpMaxFrameSize
+	}
+	limiter := newRateLimiter(client.Limits)
+	for {
+		conn.SetReadDeadline(deadlineAfter(options.readTimeout))
+		messageType, p, err := readTCPFrame(reader, limit)
+		if errors.Is(err, errTCPFrameTooLarge) {
+			logger.Info("Closing TCP client sending a frame over the size limit")
+			client.Close(ReasonMessageTooLarge)
+			return
+		}
+		if err != nil {
+			logger.Info("TCP client disconnected", "error", err)
+			if isHeartbeatTimeout(err) {
+				client.Close(ReasonIdleTimeout)
+			}
+			return
+		}
+		if messageType == websocket.CloseMessage {
+			logger.Info("TCP client disconnected")
+			// Clients closing normally discard their will
+			client.Will = nil
+			return
+		}
+		client.Session.Touch()
+		// Refuse frames over the size limit without processing them
+		if max := client.Limits.MaxMessageSize; max > 0 && int64(len(p)) > max {
+			client.Send(messageTooLargeMessage(max))
+			continue
+		}
+		// Drop frames over the rate limit, and close clients that keep sending them
+		if admitted, closed := limiter.admit(&client, time.Now()); !admitted {
+			if closed {
+				return
+			}
+			continue
+		}
+
+		logger.Debug("Received message", "message", string(p))
+		client.Session.capture(debugInbound, p)
+		if err := client.Send([]byte("Server received the message!")); err != nil {
+			logger.Error("Error sending message", "error", err)
+			return
+		}
+		s.ps.HandleRecvdMessage(client, messageType, p)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// tcpPeer is the client side of a connection to the TCP listener.
+type tcpPeer struct {
+	conn   net.Conn
+	stream *StreamConn
+	reader *bufio.Reader
+}
+
+// dialTCP starts a TCP listener for ps and connects to it.
+func dialTCP(t *testing.T, ps *PubSub) *tcpPeer {
+	server, err := ListenTCP("127.0.0.1:0", ps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	go server.Serve()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	return &tcpPeer{conn: conn, stream: &StreamConn{conn: conn}, reader: bufio.NewReader(conn)}
+}
+
+// send writes a text frame.
+func (p *tcpPeer) send(t *testing.T, frame string) {
+	t.Helper()
+	assert.NoError(t, p.stream.WriteFrame(websocket.TextMessage, []byte(frame)))
+}
+
+// read reads the next frame.
+func (p *tcpPeer) read(t *testing.T) (int, []byte) {
+	t.Helper()
+	messageType, data, err := readTCPFrame(p.reader, tcpMaxFrameSize)
+	assert.NoError(t, err)
+	return messageType, data
+}
+
+// readJSON reads the next frame as JSON.
+func (p *tcpPeer) readJSON(t *testing.T) map[string]interface{} {
+	t.Helper()
+	_, data := p.read(t)
+	var frame map[string]interface{}
+	assert.NoError(t, json.Unmarshal(data, &frame))
+	return frame
+}
+
+func TestTCPClientsShareTopicsWithWebSockets(t *testing.T) {
+	pubsub := &PubSub{}
+	peer := dialTCP(t, pubsub)
+	peer.send(t, `{"action":"connect"}`)
+	welcome := peer.readJSON(t)
+	assert.Equal(t, "welcome", welcome["action"])
+
+	peer.send(t, `{"action":"subscribe","topic":"sensors"}`)
+	_, ack := peer.read(t)
+	assert.Equal(t, "Server received the message!", string(ack))
+	assert.Eventually(t, func() bool {
+		pubsub.mu.Lock()
+		defer pubsub.mu.Unlock()
+		return len(pubsub.GetSubscriptions("sensors", nil)) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	browser, _ := newTestClient(t)
+	pubsub.HandleRecvdMessage(browser, 1, []byte(`{"action":"publish","topic":"sensors","message":{"celsius":21.5}}`))
+	messageType, message := peer.read(t)
+	assert.Equal(t, websocket.TextMessage, messageType)
+	assert.JSONEq(t, `{"celsius":21.5}`, string(message))
+
+	peer.send(t, `{"action":"dance"}`)
+	peer.read(t)
+	assert.Equal(t, codeUnknownAction, peer.readJSON(t)["code"], "TCP clients get the error frames of WebSocket clients")
+
+	peer.stream.WriteFrame(websocket.CloseMessage, nil)
+	assert.Eventually(t, func() bool {
+		pubsub.mu.Lock()
+		defer pubsub.mu.Unlock()
+		return len(pubsub.GetSubscriptions("sensors", nil)) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestTCPClientsAreAuthenticated(t *testing.T) {
+	pubsub := &PubSub{}
+	keys := NewAPIKeyStore()
+	pubsub.options().apiKeys = keys
+	keys.Add("device-secret", "thermostat", nil)
+
+	refused := dialTCP(t, pubsub)
+	refused.send(t, `{"action":"connect","apiKey":"wrong"}`)
+	assert.Equal(t, "unauthorized", refused.readJSON(t)["code"])
+	messageType, data := refused.read(t)
+	assert.Equal(t, websocket.CloseMessage, messageType)
+	assert.Equal(t, closeCode(ReasonUnauthorized), int(binary.BigEndian.Uint16(data)))
+
+	accepted := dialTCP(t, pubsub)
+	accepted.send(t, `{"action":"connect","apiKey":"device-secret"}`)
+	assert.Equal(t, "welcome", accepted.readJSON(t)["action"])
+	assert.Eventually(t, func() bool {
+		pubsub.mu.Lock()
+		defer pubsub.mu.Unlock()
+		return len(pubsub.Clients()) == 1 && pubsub.Clients()[0].Principal() == "thermostat"
+	}, time.Second, 10*time.Millisecond)
+
+	// TCP clients can be kicked like WebSocket clients
+	pubsub.mu.Lock()
+	id := pubsub.Clients()[0].Id
+	pubsub.mu.Unlock()
+	assert.NoError(t, pubsub.Kick(id, ReasonKicked))
+	for {
+		messageType, data = accepted.read(t)
+		if messageType == websocket.CloseMessage {
+			break
+		}
+	}
+	assert.Equal(t, closeCode(ReasonKicked), int(binary.BigEndian.Uint16(data)))
+}
+
+func TestTCPRefusesWidgetTokens(t *testing.T) {
+	pubsub := &PubSub{}
+	options := pubsub.options()
+	options.jwtAuthenticator = NewHMACAuthenticator([]byte("s3cret"))
+	minted, err := options.mintWidgetToken(WidgetTokenRequest{Subject: "visitor-42", Origin: "https://shop.example.com", Prefix: "widgets.acme."}, time.Now())
+	assert.NoError(t, err)
+
+	peer := dialTCP(t, pubsub)
+	peer.send(t, `{"action":"connect","token":"`+minted.Token+`"}`)
+	refusal := peer.readJSON(t)
+	assert.Equal(t, "unauthorized", refusal["code"])
+	assert.Equal(t, errWidgetToken.Error(), refusal["detail"])
+	messageType, data := peer.read(t)
+	assert.Equal(t, websocket.CloseMessage, messageType)
+	assert.Equal(t, closeCode(ReasonUnauthorized), int(binary.BigEndian.Uint16(data)))
+	assert.Empty(t, pubsub.Clients())
+}
+
+func TestTCPHandshakeRequiresConnectFrame(t *testing.T) {
+	peer := dialTCP(t, &PubSub{})
+	peer.send(t, `{"action":"subscribe","topic":"sensors"}`)
+	messageType, data := peer.read(t)
+	assert.Equal(t, websocket.CloseMessage, messageType)
+	assert.Equal(t, closeCode(ReasonProtocolError), int(binary.BigEndian.Uint16(data)))
+}
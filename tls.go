@@ -0,0 +1,104 @@
+// This file terminates TLS so clients can connect with wss://, either with a
+// certificate and key from files or with certificates provisioned automatically
+// from Let's Encrypt for the configured hostnames.
+package main
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"net/http"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	// Let's Encrypt validates hostnames on the standard ports
+	autocertHTTPSAddr = ":443"
+	autocertHTTPAddr  = ":80"
+
+	defaultAutocertCache = "autocert-cache"
+)
+
+// TLSOptions selects how the server terminates TLS. TLS is disabled when neither
+// certificate files nor autocert hostnames are set.
+type TLSOptions struct {
+	CertFile string
+	KeyFile  string
+
+	// Hostnames to provision certificates for with autocert
+	AutocertHosts []string
+	// Directory where provisioned certificates are kept across restarts
+	AutocertCache string
+	// Contact address registered with Let's Encrypt, optional
+	AutocertEmail string
+}
+
+// Function to check whether TLS is configured.
+// Returns:
+// bool - True if the server serves wss:// instead of ws://.
+func (o TLSOptions) Enabled() bool {
+	return o.CertFile != "" || len(o.AutocertHosts) > 0
+}
+
+// Function to create the autocert manager for the configured hostnames.
+// Returns:
+// *autocert.Manager - The manager, refusing certificates for any other hostname.
+func (o TLSOptions) autocertManager() *autocert.Manager {
+	cache := o.AutocertCache
+	if cache == "" {
+		cache = defaultAutocertCache
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(o.AutocertHosts...),
+		Cache:      autocert.DirCache(cache),
+		Email:      o.AutocertEmail,
+	}
+}
+
+// Function to build the TLS configuration from the certificate files.
+// Returns:
+// *tls.Config - The configuration.
+// error - An error if the certificate or key could not be loaded.
+func (o TLSOptions) fileConfig() (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{certificate}}, nil
+}
+
+// Function to serve HTTP and WebSocket requests, over TLS when it is configured. In
+// autocert mode the server listens on :443 instead of its address, and on :80 to answer
+// the ACME challenges and redirect plain HTTP requests to HTTPS.
+// Parameters:
+// server: *http.Server - The server, with its address and handler set.
+// tlsOptions: TLSOptions - The TLS options of the server.
+// Returns:
+// error - The error that stopped the server; http.ErrServerClosed after a shutdown.
+func listenAndServe(server *http.Server, tlsOptions TLSOptions) error {
+	switch {
+	case len(tlsOptions.AutocertHosts) > 0:
+		manager := tlsOptions.autocertManager()
+		go func() {
+			if err := http.ListenAndServe(autocertHTTPAddr, manager.HTTPHandler(nil)); err != nil {
+				slog.Error("ACME challenge listener stopped", "error", err)
+			}
+		}()
+		server.Addr = autocertHTTPSAddr
+		server.TLSConfig = manager.TLSConfig()
+		server.TLSConfig.MinVersion = tls.VersionTLS12
+		slog.Info("Serving wss:// with autocert certificates", "hosts", tlsOptions.AutocertHosts)
+		return server.ListenAndServeTLS("", "")
+
+	case tlsOptions.CertFile != "":
+		config, err := tlsOptions.fileConfig()
+		if err != nil {
+			return err
+		}
+		server.TLSConfig = config
+		slog.Info("Serving wss://", "addr", server.Addr)
+		return server.ListenAndServeTLS("", "")
+	}
+	return server.ListenAndServe()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestCertificate writes a self-signed certificate for 127.0.0.1 and its key.
+func writeTestCertificate(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600)
+	return certFile, keyFile
+}
+
+func TestTLSFromCertificateFiles(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t)
+	options := TLSOptions{CertFile: certFile, KeyFile: keyFile}
+	assert.True(t, options.Enabled())
+
+	config, err := options.fileConfig()
+	assert.NoError(t, err)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(ps.webSocketHandler))
+	server.TLS = config
+	server.StartTLS()
+	defer server.Close()
+
+	dialer := websocket.Dialer{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	ws, _, err := dialer.Dial("wss"+strings.TrimPrefix(server.URL, "https")+"/ws", nil)
+	assert.NoError(t, err, "Clients should connect with wss://")
+	if err == nil {
+		ws.Close()
+	}
+
+	_, err = TLSOptions{CertFile: certFile, KeyFile: certFile}.fileConfig()
+	assert.Error(t, err)
+}
+
+func TestAutocertOnlyServesConfiguredHosts(t *testing.T) {
+	options := TLSOptions{AutocertHosts: []string{"chat.example.com"}}
+	assert.True(t, options.Enabled())
+	assert.False(t, TLSOptions{}.Enabled())
+
+	manager := options.autocertManager()
+	assert.NoError(t, manager.HostPolicy(context.Background(), "chat.example.com"))
+	assert.Error(t, manager.HostPolicy(context.Background(), "evil.example.net"))
+}
@@ -0,0 +1,149 @@
+// This file lets a backend mint short-lived connection tokens for its frontends. A
+// token names the topics its client may publish and subscribe to and can carry limits,
+// so browsers never hold long-lived credentials and the broker enforces the scope.
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Permission of the API keys that may mint tokens
+const PermissionMintTokens = "mint_tokens"
+
+// Claim listing the topic patterns a token is scoped to
+const topicsClaim = "topics"
+
+// How long minted tokens are valid by default, and at most, unless the authenticator says otherwise
+const (
+	defaultTokenTTL    = 5 * time.Minute
+	defaultTokenMaxTTL = time.Hour
+)
+
+// TopicScope lists the topics a client may publish and subscribe to, as glob patterns
+// where * matches any sequence of characters and ? matches a single character.
+type TopicScope struct {
+	Publish   []string `json:"publish"`
+	Subscribe []string `json:"subscribe"`
+}
+
+// TokenRequest is what a backend asks for when minting a token.
+type TokenRequest struct {
+	Subject string     `json:"subject"`
+	Tenant  string     `json:"tenant,omitempty"`
+	Topics  TopicScope `json:"topics"`
+	Limits  *Limits    `json:"limits,omitempty"`
+	// Lifetime of the token in seconds, the default TTL when 0
+	TTL int `json:"ttl,omitempty"`
+	// Pins the origin and topic prefix of widget tokens, which only mintWidgetToken sets
+	Widget *WidgetScope `json:"-"`
+}
+
+// MintedToken is a minted token and when it expires.
+type MintedToken struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Function to check whether the authenticator can sign tokens, which needs a shared secret.
+// Returns:
+// bool - True if tokens can be minted.
+func (a *JWTAuthenticator) CanMint() bool {
+	_, ok := a.Key.([]byte)
+	return ok
+}
+
+// Function to mint a connection token.
+// Parameters:
+// request: TokenRequest - The subject, topics and limits of the token.
+// now: time.Time - The time the token is issued at.
+// Returns:
+// MintedToken - The signed token.
+// error - An error if the token could not be signed.
+func (a *JWTAuthenticator) Mint(request TokenRequest, now time.Time) (MintedToken, error) {
+	ttl, maxTTL := a.TokenTTL, a.TokenMaxTTL
+	if ttl <= 0 {
+		ttl = defaultTokenTTL
+	}
+	if maxTTL <= 0 {
+		maxTTL = defaultTokenMaxTTL
+	}
+	if request.TTL > 0 {
+		ttl = time.Duration(request.TTL) * time.Second
+	}
+	ttl = min(ttl, maxTTL)
+	expiresAt := now.Add(ttl).Truncate(time.Second)
+
+	claims := jwt.MapClaims{
+		"sub":       request.Subject,
+		"iat":       now.Unix(),
+		"exp":       expiresAt.Unix(),
+		topicsClaim: request.Topics,
+	}
+	if a.Issuer != "" {
+		claims["iss"] = a.Issuer
+	}
+	if a.Audience != "" {
+		claims["aud"] = a.Audience
+	}
+	if request.Tenant != "" {
+		claims[tenantClaim] = request.Tenant
+	}
+	if request.Limits != nil {
+		claims[limitsClaim] = request.Limits
+	}
+	if request.Widget != nil {
+		claims[widgetClaim] = request.Widget
+	}
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(a.Key)
+	if err != nil {
+		return MintedToken{}, err
+	}
+	return MintedToken{Token: token, ExpiresAt: expiresAt.UTC()}, nil
+}
+
+// Function to check whether the token of a client allows an action on a topic. Clients
+// whose token is not scoped to topics may act on every topic.
+// Parameters:
+// action: string - PUBLISH or SUBSCRIBE.
+// topic: string - The topic.
+// Returns:
+// bool - True if a pattern of the token's scope for the action matches the topic.
+func (client *Client) TopicAllowed(action string, topic string) bool {
+	scope, ok := client.Claims[topicsClaim].(map[string]interface{})
+	if !ok {
+		return true
+	}
+	patterns, _ := scope[action].([]interface{})
+	for _, pattern := range patterns {
+		if pattern, ok := pattern.(string); ok && globMatch(pattern, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// Function to register the endpoint minting connection tokens, called by backends with
+// an API key holding the mint_tokens permission.
+// Parameters:
+// mux: *http.ServeMux - The mux to register the route on.
+// pubsub: *PubSub - The PubSub the route serves.
+func setupTokenRoutes(mux *http.ServeMux, pubsub *PubSub) {
+	mux.HandleFunc("POST /tokens", pubsub.requireAPIKey(PermissionMintTokens, func(w http.ResponseWriter, r *http.Request) {
+		var request TokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Subject == "" || request.TTL < 0 {
+			http.Error(w, "expected {\"subject\": ..., \"topics\": {\"publish\": [...], \"subscribe\": [...]}}", http.StatusBadRequest)
+			return
+		}
+		token, err := pubsub.options().jwtAuthenticator.Mint(request, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusCreated, token)
+	}))
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMintCapsTheLifetime(t *testing.T) {
+	auth := NewHMACAuthenticator([]byte("s3cret"))
+	now := time.Now()
+
+	minted, err := auth.Mint(TokenRequest{Subject: "alice", TTL: 60}, now)
+	assert.NoError(t, err)
+	assert.WithinDuration(t, now.Add(time.Minute), minted.ExpiresAt, time.Second)
+
+	minted, err = auth.Mint(TokenRequest{Subject: "alice", TTL: 7 * 24 * 3600}, now)
+	assert.NoError(t, err)
+	assert.WithinDuration(t, now.Add(defaultTokenMaxTTL), minted.ExpiresAt, time.Second, "The lifetime should be capped")
+
+	auth.TokenMaxTTL = 2 * time.Hour
+	minted, err = auth.Mint(TokenRequest{Subject: "alice", TTL: 7 * 24 * 3600}, now)
+	assert.NoError(t, err)
+	assert.WithinDuration(t, now.Add(2*time.Hour), minted.ExpiresAt, time.Second, "Each authenticator may have a cap of its own")
+
+	claims, err := auth.Authenticate(httptest.NewRequest("GET", "/ws?token="+minted.Token, nil))
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", claims["sub"])
+
+	assert.False(t, (&JWTAuthenticator{Key: &ecdsa.PublicKey{}}).CanMint(), "Tokens verified with a public key cannot be minted")
+}
+
+func TestTopicAllowed(t *testing.T) {
+	client := Client{Claims: jwt.MapClaims{topicsClaim: map[string]interface{}{
+		"publish":   []interface{}{"chat.room1"},
+		"subscribe": []interface{}{"chat.*"},
+	}}}
+	assert.True(t, client.TopicAllowed(PUBLISH, "chat.room1"))
+	assert.False(t, client.TopicAllowed(PUBLISH, "chat.room2"))
+	assert.True(t, client.TopicAllowed(SUBSCRIBE, "chat.room2"))
+	assert.False(t, client.TopicAllowed(SUBSCRIBE, "admin"))
+
+	unscoped := Client{Claims: jwt.MapClaims{"sub": "backend"}}
+	assert.True(t, unscoped.TopicAllowed(PUBLISH, "anything"))
+}
+
+func TestMintedTokenScopesTheClient(t *testing.T) {
+	options := isolatePubSub(t)
+	options.jwtAuthenticator = NewHMACAuthenticator([]byte("s3cret"))
+	options.apiKeys = NewAPIKeyStore()
+	options.apiKeys.Add("minter", "backend", []string{PermissionMintTokens})
+	options.apiKeys.Add("reader", "dashboard", []string{PermissionSubscribe})
+	mux := http.NewServeMux()
+	setupTokenRoutes(mux, ps)
+	mux.HandleFunc("/ws", ps.webSocketHandler)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	body := `{"subject": "alice", "topics": {"publish": ["chat.lobby"], "subscribe": ["chat.*"]}, "limits": {"maxSubscriptions": 2}}`
+	mint := func(key string) *http.Response {
+		request, _ := http.NewRequest(http.MethodPost, server.URL+"/tokens", strings.NewReader(body))
+		request.Header.Set(apiKeyHeader, key)
+		response, err := http.DefaultClient.Do(request)
+		assert.NoError(t, err)
+		return response
+	}
+	assert.Equal(t, http.StatusForbidden, mint("reader").StatusCode, "Only keys with the mint_tokens permission may mint")
+
+	response := mint("minter")
+	assert.Equal(t, http.StatusCreated, response.StatusCode)
+	var minted MintedToken
+	json.NewDecoder(response.Body).Decode(&minted)
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+server.URL[4:]+"/ws?token="+minted.Token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	var welcome welcomeFrame
+	_, data, _ := ws.ReadMessage()
+	json.Unmarshal(data, &welcome)
+	assert.Equal(t, 2, welcome.Limits.MaxSubscriptions, "The limits of the token should apply")
+
+	ws.WriteJSON(Message{Action: PUBLISH, Topic: "chat.secret", Message: json.RawMessage(`"hi"`)})
+	ws.ReadMessage() // Server received the message!
+	_, data, err = ws.ReadMessage()
+	assert.NoError(t, err)
+	assert.JSONEq(t, string(forbiddenMessage(PUBLISH, "chat.secret")), string(data))
+}
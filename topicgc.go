@@ -0,0 +1,158 @@
+// This file collects idle topics, so long-running servers do not keep the state of
+// every topic ever used. The last activity of every topic is tracked, and a topic
+// without subscribers nor waiting clients that saw no activity for the idle TTL has its
+// history, unless its policy asks for durable retention, and its learned schema purged.
+// The topic itself is forgotten unless it was created or configured explicitly or has an
+// owner, whose policy and grants are kept.
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Action of the event announcing a topic forgotten as idle
+const TOPIC_COLLECTED = "topic_collected"
+
+var topicsCollected = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "gowebsockets_topics_collected_total",
+	Help: "Number of idle topics whose state was purged.",
+})
+
+// Function to record activity on a topic: a message published to it, or a client
+// subscribing to or leaving it.
+// Parameters:
+// topic: string - The topic.
+func (ps *PubSub) recordActivity(topic string) {
+	now := time.Now().UnixNano()
+	ps.updateTopicEntry(topic, func(entry *topicEntry) {
+		entry.activity.Store(now)
+	})
+}
+
+// Function to get when a topic last saw activity.
+// Parameters:
+// topic: string - The topic.
+// Returns:
+// time.Time - The time of the last activity.
+// bool - False if the topic saw none since it was last collected.
+func (ps *PubSub) lastActivity(topic string) (time.Time, bool) {
+	entry := ps.topicEntry(topic)
+	if entry == nil || entry.activity.Load() == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, entry.activity.Load()), true
+}
+
+// Function to purge the state of the topics that have no subscribers and saw no
+// activity for a TTL.
+// Parameters:
+// ttl: time.Duration - How long a topic without subscribers is kept after its last activity.
+// Returns:
+// []string - The topics purged.
+func (ps *PubSub) CollectIdleTopics(ttl time.Duration) []string {
+	now := time.Now()
+	var collected []string
+	var forgotten []*Topic
+
+	ps.mu.Lock()
+	// The presence of a topic keeps the topic in use
+	busy := map[string]bool{}
+	for _, sub := range ps.Subscriptions() {
+		busy[sub.Topic] = true
+		busy[accessTopicOf(sub.Topic)] = true
+	}
+	for _, shard := range ps.registry() {
+		shard.mu.Lock()
+		for name, entry := range shard.topics {
+			topic := ps.Topics[name]
+			last := entry.activity.Load()
+			if last == 0 || busy[name] || now.Sub(time.Unix(0, last)) < ttl || topic != nil && len(topic.waitlist) > 0 {
+				continue
+			}
+			shard.forgetLocked(name, entry)
+			// Purged while the shard of the topic is write-locked, so a message being
+			// published to the topic is either recorded as activity before or stored after.
+			// Topics asking for durable retention keep it.
+			if ps.History != nil && (topic == nil || topic.Policy.Retention != RetainDurable) {
+				ps.History.Delete(name)
+			}
+			if ps.Schemas != nil {
+				ps.Schemas.Reset(name)
+			}
+			collected = append(collected, name)
+			if topic == nil {
+				continue
+			}
+			if topic.configured || topic.Owner != "" {
+				// The history keeps following the retention of the topic
+				if ps.History != nil && topic.Policy.Retention != "" {
+					ps.History.SetTier(name, topic.Policy.Retention)
+				}
+				continue
+			}
+			if topic.expiry != nil {
+				topic.expiry.Stop()
+			}
+			if topic.reauthorization != nil {
+				topic.reauthorization.Stop()
+			}
+			delete(ps.Topics, name)
+			// Under the write lock of the shard already
+			entry.topic.Store(nil)
+			shard.pruneLocked(name, entry)
+			forgotten = append(forgotten, topic)
+		}
+		shard.mu.Unlock()
+	}
+	ps.mu.Unlock()
+
+	for _, topic := range forgotten {
+		ps.announceTopic(TOPIC_COLLECTED, topic.Name, topic.Owner, topic.Policy)
+	}
+	topicsCollected.Add(float64(len(collected)))
+	return collected
+}
+
+// TopicCollector collects idle topics periodically.
+type TopicCollector struct {
+	TTL  time.Duration
+	ps   *PubSub
+	done chan struct{}
+}
+
+// Function to create a collector of idle topics.
+// Parameters:
+// ps: *PubSub - The PubSub instance whose topics are collected.
+// ttl: time.Duration - How long a topic without subscribers is kept after its last activity.
+// Returns:
+// *TopicCollector - The collector; call Start to begin collecting.
+func NewTopicCollector(ps *PubSub, ttl time.Duration) *TopicCollector {
+	return &TopicCollector{TTL: ttl, ps: ps, done: make(chan struct{})}
+}
+
+// Function to collect idle topics every TTL, or every minute for longer TTLs.
+func (c *TopicCollector) Start() {
+	go func() {
+		ticker := time.NewTicker(min(c.TTL, time.Minute))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.done:
+				return
+			case <-ticker.C:
+				if collected := c.ps.CollectIdleTopics(c.TTL); len(collected) > 0 {
+					slog.Info("Collected idle topics", "count", len(collected))
+				}
+			}
+		}
+	}()
+}
+
+// Function to stop collecting idle topics.
+func (c *TopicCollector) Stop() {
+	close(c.done)
+}
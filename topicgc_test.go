@@ -0,0 +1,75 @@
+package main
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+// idleFor backdates the last activity of topics.
+func idleFor(pubsub *PubSub, idle time.Duration, topics ...string) {
+	for _, topic := range topics {
+		pubsub.updateTopicEntry(topic, func(entry *topicEntry) {
+			entry.activity.Store(time.Now().Add(-idle).UnixNano())
+		})
+	}
+}
+
+func TestCollectIdleTopics(t *testing.T) {
+	pubsub := &PubSub{History: NewMemoryHistory(JSONEntryCodec{}, 10)}
+	watcher, watcherPeer := newTestClient(t)
+	watcher.Claims = jwt.MapClaims{permissionsClaim: []interface{}{PermissionSubscribe, PermissionAdmin}}
+	client, _ := newTestClient(t)
+	pubsub.HandleRecvdMessage(watcher, 1, []byte(`{"action":"subscribe","topic":"$topics"}`))
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"chat"}`))
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"publish","topic":"news","message":"old"}`))
+	assert.Equal(t, TOPIC_CREATED, readFrame(t, watcherPeer)["action"])
+	assert.Equal(t, TOPIC_CREATED, readFrame(t, watcherPeer)["action"])
+	assert.NoError(t, pubsub.CreateTopic("orders", "", TopicPolicy{}))
+	assert.NoError(t, pubsub.CreateTopic("ledger", "", TopicPolicy{Retention: RetainDurable}))
+	readFrame(t, watcherPeer)
+	readFrame(t, watcherPeer)
+	pubsub.Publish("orders", []byte(`"old"`), nil)
+	pubsub.Publish("ledger", []byte(`"old"`), nil)
+	pubsub.Publish("recent", []byte(`"new"`), nil)
+
+	idleFor(pubsub, time.Hour, "chat", "news", "orders", "ledger")
+	collected := pubsub.CollectIdleTopics(time.Minute)
+	sort.Strings(collected)
+	assert.Equal(t, []string{"ledger", "news", "orders"}, collected, "Topics with subscribers or recent activity are kept")
+
+	for topic, kept := range map[string]int{"news": 0, "orders": 0, "ledger": 1, "recent": 1, "chat": 0} {
+		entries, err := pubsub.History.Entries(topic)
+		assert.NoError(t, err)
+		assert.Len(t, entries, kept, topic)
+	}
+	assert.NotContains(t, pubsub.Topics, "news", "Topics created by their first use are forgotten")
+	assert.Contains(t, pubsub.Topics, "orders", "Topics created explicitly keep their configuration")
+	assert.Contains(t, pubsub.Topics, "chat")
+	collectedEvent := readFrame(t, watcherPeer)
+	assert.Equal(t, TOPIC_COLLECTED, collectedEvent["action"])
+	assert.Equal(t, "news", collectedEvent["topic"])
+
+	assert.Empty(t, pubsub.CollectIdleTopics(time.Minute), "Collected topics are not collected again")
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"unsubscribe","topic":"chat"}`))
+	assert.Empty(t, pubsub.CollectIdleTopics(time.Minute), "Leaving a topic is activity")
+	idleFor(pubsub, time.Hour, "chat")
+	assert.Equal(t, []string{"chat"}, pubsub.CollectIdleTopics(time.Minute))
+}
+
+func TestTopicInfosShowLastActivity(t *testing.T) {
+	pubsub := &PubSub{}
+	before := time.Now()
+	pubsub.Publish("news", []byte(`"hello"`), nil)
+
+	infos := pubsub.TopicInfos()
+	assert.Empty(t, infos, "Topics without a record nor subscribers are not listed")
+	pubsub.Subscribe(&Client{Id: "c1", Transport: discardTransport{}}, "news")
+	infos = pubsub.TopicInfos()
+	if assert.Len(t, infos, 1) && assert.NotNil(t, infos[0].LastActivity) {
+		assert.False(t, infos[0].LastActivity.Before(before))
+	}
+}
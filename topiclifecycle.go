@@ -0,0 +1,294 @@
+// This file manages the lifecycle of topics explicitly: topics are created with a
+// policy (retention, maximum subscribers, schema and ACL), configured and deleted
+// through the protocol and the admin API, and every creation and deletion is announced
+// on the topic events system topic. With explicit topics, publishing or subscribing to
+// a topic that was never created is refused instead of creating it.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+const (
+	// Protocol action creating a topic
+	CREATE_TOPIC = "create_topic"
+	// Action of the event announcing a new topic
+	TOPIC_CREATED = "topic_created"
+	// Topic announcing the topics created and deleted, which only the server publishes to
+	topicEventsTopic = "$topics"
+)
+
+var errTopicExists = errors.New("topic already exists")
+
+// Error of a topic policy that cannot be applied
+type invalidPolicyError struct {
+	reason string
+}
+
+func (e *invalidPolicyError) Error() string {
+	return "invalid topic policy: " + e.reason
+}
+
+// Types of the fields a topic schema may require, as inferFields names them
+var schemaFieldTypes = map[string]bool{
+	"object": true, "array": true, "string": true, "number": true, "boolean": true, "null": true, "binary": true,
+}
+
+// TopicSpec describes a topic to create through the admin API.
+type TopicSpec struct {
+	Name   string      `json:"name"`
+	Owner  string      `json:"owner,omitempty"`
+	Policy TopicPolicy `json:"policy"`
+}
+
+// Function to check whether a topic is used by the server itself, so it exists without
+// being created: the topics starting with $, presence and status topics.
+// Parameters:
+// name: string - The name of the topic.
+// Returns:
+// bool - True for topics of the server.
+func isServerTopic(name string) bool {
+	_, isPresence := presenceTopicOf(name)
+	return reservedTopic(name) || isPresence || isStatusTopic(name)
+}
+
+// Function to check whether a topic may be used: with explicit topics, it must have
+// been created first. The presence of a topic exists as long as the topic does.
+// Parameters:
+// name: string - The name of the topic.
+// Returns:
+// bool - True if topics are implicit, the topic exists or it is a topic of the server.
+func (ps *PubSub) topicDeclared(name string) bool {
+	if topic, ok := presenceTopicOf(name); ok {
+		name = topic
+	}
+	if !ps.ExplicitTopics || isServerTopic(name) {
+		return true
+	}
+	// Read from the shard of the topic, so publishing does not wait for ps.mu
+	return ps.topicSnapshot(name) != nil
+}
+
+// Function to create a topic with a policy and announce it.
+// Parameters:
+// name: string - The name of the topic.
+// owner: string - The principal owning the topic, or an empty string.
+// policy: TopicPolicy - The policy of the topic.
+// Returns:
+// error - An error if the topic already exists, is a topic of the server, or the policy is invalid.
+func (ps *PubSub) CreateTopic(name string, owner string, policy TopicPolicy) error {
+	if name == "" || isServerTopic(name) {
+		return &invalidPolicyError{fmt.Sprintf("topic name %q is reserved", name)}
+	}
+	if err := policy.validate(); err != nil {
+		return err
+	}
+	ps.mu.Lock()
+	if _, ok := ps.Topics[name]; ok {
+		ps.mu.Unlock()
+		return errTopicExists
+	}
+	topic := ps.touchTopic(name, nil)
+	topic.Owner = owner
+	topic.Policy = policy
+	topic.configured = true
+	ps.syncTopicLocked(name)
+	ps.scheduleExpiryLocked(topic)
+	ps.scheduleReauthorizationLocked(topic)
+	ps.mu.Unlock()
+
+	ps.setRetention(name, policy.Retention)
+	ps.announceTopic(TOPIC_CREATED, name, owner, policy)
+	return nil
+}
+
+// Function to get a copy of a topic.
+// Parameters:
+// name: string - The name of the topic.
+// Returns:
+// Topic - The topic, without its waitlist.
+// error - An error if the topic does not exist.
+func (ps *PubSub) TopicConfig(name string) (Topic, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	topic, ok := ps.Topics[name]
+	if !ok {
+		return Topic{}, errUnknownTopic
+	}
+	return *topic.snapshot(), nil
+}
+
+// Function to announce the creation or deletion of a topic on the topic events topic.
+// Private topics are not announced, as their names are only known to their members.
+// Parameters:
+// action: string - TOPIC_CREATED, topic_deleted or TOPIC_EXPIRED.
+// name: string - The name of the topic.
+// owner: string - The owner of the topic.
+// policy: TopicPolicy - The policy of the topic.
+func (ps *PubSub) announceTopic(action string, name string, owner string, policy TopicPolicy) {
+	if policy.Private || isServerTopic(name) {
+		return
+	}
+	// Most servers have no one watching topics, so the events are not even built
+	ps.mu.Lock()
+	watched := len(ps.GetSubscriptions(topicEventsTopic, nil)) > 0
+	ps.mu.Unlock()
+	if !watched {
+		return
+	}
+	event, _ := json.Marshal(struct {
+		Action string      `json:"action"`
+		Topic  string      `json:"topic"`
+		Owner  string      `json:"owner,omitempty"`
+		Policy TopicPolicy `json:"policy"`
+	}{action, name, owner, policy})
+	ps.fanOut(context.Background(), autoId(), topicEventsTopic, event)
+}
+
+// Function to apply the retention tier of a topic to the history, if any.
+// Parameters:
+// name: string - The name of the topic.
+// tier: RetentionTier - The tier, or "" to follow the retention policy.
+func (ps *PubSub) setRetention(name string, tier RetentionTier) {
+	if ps.History != nil {
+		ps.History.SetTier(name, tier)
+	}
+}
+
+// Function to check that a policy can be applied.
+// Returns:
+// error - An *invalidPolicyError naming the first problem.
+func (p TopicPolicy) validate() error {
+	if p.Capacity < 0 {
+		return &invalidPolicyError{"capacity must not be negative"}
+	}
+	if p.ReauthorizeInterval < 0 {
+		return &invalidPolicyError{"reauthorizeInterval must not be negative"}
+	}
+	if err := (&RetentionPolicy{Default: p.Retention}).validate(); err != nil {
+		return &invalidPolicyError{err.Error()}
+	}
+	for path, fieldType := range p.Schema {
+		if !schemaFieldTypes[fieldType] {
+			return &invalidPolicyError{fmt.Sprintf("unknown type %q of field %q", fieldType, path)}
+		}
+	}
+	return nil
+}
+
+// Function to check whether the ACL of a policy lets a client perform an action.
+// Parameters:
+// client: *Client - The client.
+// action: string - PUBLISH or SUBSCRIBE.
+// Returns:
+// bool - True if the policy lists no identity for the action or one matching the client.
+func (p TopicPolicy) admits(client *Client, action string) bool {
+	patterns := p.Subscribers
+	if action == PUBLISH {
+		patterns = p.Publishers
+	}
+	if len(patterns) == 0 {
+		return true
+	}
+	identity := client.identity()
+	for _, pattern := range patterns {
+		if globMatch(pattern, identity) {
+			return true
+		}
+	}
+	return false
+}
+
+// Function to check a message against the schema of its topic, telling the publishing
+// client when it does not conform.
+// Parameters:
+// client: *Client - The publishing client.
+// topic: string - The topic.
+// message: []byte - The message.
+// Returns:
+// bool - True if the topic has no schema or the message has every field it requires.
+func (ps *PubSub) conformsToSchema(client *Client, topic string, message []byte) bool {
+	var schema map[string]string
+	if t := ps.topicSnapshot(topic); t != nil {
+		schema = t.Policy.Schema
+	}
+	if len(schema) == 0 {
+		return true
+	}
+	fields := inferFields(message)
+	for path, fieldType := range schema {
+		if fields[path] != fieldType {
+			client.Send(errorMessage("schema_violation", topic))
+			return false
+		}
+	}
+	return true
+}
+
+// Function to handle a client creating a topic, which it then owns.
+// Parameters:
+// client: *Client - The client.
+// m: Message - The action, with the topic and its policy.
+func (ps *PubSub) handleCreateTopic(client *Client, m Message) {
+	if !client.HasPermission(PermissionPublish) || !client.TopicAllowed(PUBLISH, m.Topic) || !ps.aclAllows(client, PUBLISH, m.Topic) {
+		ps.refuse(client, m)
+		return
+	}
+	var policy TopicPolicy
+	if len(m.Policy) > 0 {
+		if err := json.Unmarshal(m.Policy, &policy); err != nil {
+			client.Send(errorMessage("invalid_policy", m.Topic))
+			return
+		}
+	}
+
+	var invalid *invalidPolicyError
+	switch err := ps.CreateTopic(m.Topic, client.Principal(), policy); {
+	case errors.Is(err, errTopicExists):
+		client.Send(errorMessage("topic_exists", m.Topic))
+	case errors.As(err, &invalid):
+		client.Send(errorMessage("invalid_policy", m.Topic))
+	default:
+		message, _ := json.Marshal(map[string]string{"action": TOPIC_CREATED, "topic": m.Topic})
+		client.Send(message)
+	}
+}
+
+// Function to register the admin API creating topics and reading their configuration.
+// Topics are configured with PUT /admin/topics/{topic}/policy and deleted with
+// DELETE /admin/topics/{topic}.
+// Parameters:
+// mux: *http.ServeMux - The mux to register the routes on.
+// pubsub: *PubSub - The PubSub the routes serve.
+func setupTopicLifecycleRoutes(mux *http.ServeMux, pubsub *PubSub) {
+	mux.HandleFunc("POST /admin/topics", pubsub.requireAPIKey(PermissionAdmin, func(w http.ResponseWriter, r *http.Request) {
+		var spec TopicSpec
+		if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var invalid *invalidPolicyError
+		switch err := pubsub.CreateTopic(spec.Name, spec.Owner, spec.Policy); {
+		case errors.Is(err, errTopicExists):
+			http.Error(w, err.Error(), http.StatusConflict)
+		case errors.As(err, &invalid):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			topic, _ := pubsub.TopicConfig(spec.Name)
+			writeJSON(w, http.StatusCreated, topic)
+		}
+	}))
+
+	mux.HandleFunc("GET /admin/topics/{topic}", pubsub.requireAPIKey(PermissionAdmin, func(w http.ResponseWriter, r *http.Request) {
+		topic, err := pubsub.TopicConfig(r.PathValue("topic"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, http.StatusOK, topic)
+	}))
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExplicitTopicLifecycle(t *testing.T) {
+	pubsub := &PubSub{ExplicitTopics: true, History: NewMemoryHistory(JSONEntryCodec{}, 10)}
+	watcher, watcherPeer := newTestClient(t)
+	watcher.Claims = jwt.MapClaims{permissionsClaim: []interface{}{PermissionSubscribe, PermissionAdmin}}
+	client, peer := newTestClient(t)
+	pubsub.HandleRecvdMessage(watcher, 1, []byte(`{"action":"subscribe","topic":"$topics"}`))
+
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"publish","topic":"orders","message":{"id":1}}`))
+	assert.JSONEq(t, string(errorMessage("unknown_topic", "orders")), string(mustRead(t, peer)))
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"orders"}`))
+	assert.JSONEq(t, string(errorMessage("unknown_topic", "orders")), string(mustRead(t, peer)))
+	assert.NotContains(t, pubsub.Topics, "orders", "Explicit topics are not created by their first use")
+
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"create_topic","topic":"orders","policy":{"retention":"last_value","schema":{"id":"number"}}}`))
+	assert.Equal(t, TOPIC_CREATED, readFrame(t, peer)["action"])
+	created := readFrame(t, watcherPeer)
+	assert.Equal(t, TOPIC_CREATED, created["action"])
+	assert.Equal(t, "orders", created["topic"])
+	assert.Equal(t, map[string]interface{}{"id": "number"}, created["policy"].(map[string]interface{})["schema"])
+
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"create_topic","topic":"orders"}`))
+	assert.JSONEq(t, string(errorMessage("topic_exists", "orders")), string(mustRead(t, peer)))
+
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"publish","topic":"orders","message":{"id":"one"}}`))
+	assert.JSONEq(t, string(errorMessage("schema_violation", "orders")), string(mustRead(t, peer)))
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"publish","topic":"orders","message":{"id":1}}`))
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"publish","topic":"orders","message":{"id":2}}`))
+	entries, err := pubsub.History.Entries("orders")
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 1, "The retention of the topic overrides the history limit") {
+		assert.JSONEq(t, `{"id":2}`, string(entries[0].Payload))
+	}
+
+	assert.NoError(t, pubsub.DeleteTopic("orders"))
+	deleted := readFrame(t, watcherPeer)
+	assert.Equal(t, "topic_deleted", deleted["action"])
+	assert.Equal(t, "orders", deleted["topic"])
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"publish","topic":"orders","message":{"id":3}}`))
+	assert.JSONEq(t, string(errorMessage("unknown_topic", "orders")), string(mustRead(t, peer)))
+}
+
+func TestImplicitTopicsAreAnnounced(t *testing.T) {
+	pubsub := &PubSub{}
+	watcher, watcherPeer := newTestClient(t)
+	watcher.Claims = jwt.MapClaims{permissionsClaim: []interface{}{PermissionSubscribe, PermissionAdmin}}
+	client, peer := newTestClient(t)
+	pubsub.HandleRecvdMessage(watcher, 1, []byte(`{"action":"subscribe","topic":"$topics"}`))
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"$topics"}`))
+	assert.JSONEq(t, string(forbiddenMessage(SUBSCRIBE, "$topics")), string(mustRead(t, peer)), "Only admins watch the topics of the server")
+
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"lobby"}`))
+	created := readFrame(t, watcherPeer)
+	assert.Equal(t, TOPIC_CREATED, created["action"])
+	assert.Equal(t, "lobby", created["topic"])
+
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"publish","topic":"$topics","message":"fake"}`))
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"lobby"}`))
+	assert.NoError(t, pubsub.CreateTopic("secret", "", TopicPolicy{Private: true}))
+	assert.NoError(t, pubsub.DeleteTopic("lobby"))
+	assert.Equal(t, "topic_deleted", readFrame(t, watcherPeer)["action"], "Only the server announces topics, and never private ones")
+}
+
+func TestTopicPolicyACL(t *testing.T) {
+	pubsub := &PubSub{}
+	assert.NoError(t, pubsub.CreateTopic("prices", "owner", TopicPolicy{Publishers: []string{"backend-*"}, Subscribers: []string{"trader-*"}}))
+	anonymous, anonymousPeer := newTestClient(t)
+	backend, _ := newTestClient(t)
+	backend.Claims = jwt.MapClaims{"sub": "backend-1"}
+	owner, _ := newTestClient(t)
+	owner.Claims = jwt.MapClaims{"sub": "owner"}
+
+	pubsub.HandleRecvdMessage(anonymous, 1, []byte(`{"action":"publish","topic":"prices","message":1}`))
+	assert.JSONEq(t, string(forbiddenMessage(PUBLISH, "prices")), string(mustRead(t, anonymousPeer)))
+	pubsub.HandleRecvdMessage(backend, 1, []byte(`{"action":"subscribe","topic":"prices"}`))
+	assert.Empty(t, pubsub.GetSubscriptions("prices", nil), "Publishers may not subscribe unless listed")
+
+	assert.True(t, pubsub.mayPublish(&backend, "prices"))
+	assert.True(t, pubsub.mayPublish(&owner, "prices"), "The owner bypasses the ACL of its topic")
+	pubsub.HandleRecvdMessage(owner, 1, []byte(`{"action":"subscribe","topic":"prices"}`))
+	assert.Len(t, pubsub.GetSubscriptions("prices", nil), 1)
+}
+
+func TestInvalidTopicPolicies(t *testing.T) {
+	pubsub := &PubSub{}
+	for _, policy := range []TopicPolicy{
+		{Capacity: -1},
+		{Retention: "forever"},
+		{Schema: map[string]string{"id": "integer"}},
+	} {
+		assert.Error(t, pubsub.CreateTopic("room", "", policy))
+	}
+	assert.Error(t, pubsub.CreateTopic("$topics", "", TopicPolicy{}), "Topics of the server cannot be created")
+	assert.NoError(t, pubsub.CreateTopic("room", "", TopicPolicy{}))
+	assert.ErrorIs(t, pubsub.CreateTopic("room", "", TopicPolicy{}), errTopicExists)
+	assert.Error(t, pubsub.SetTopicPolicy("room", TopicPolicy{Retention: "forever"}))
+}
+
+func TestTopicLifecycleRoutes(t *testing.T) {
+	keys := NewAPIKeyStore()
+	isolatePubSub(t).apiKeys = keys
+	keys.Add("root", "admin", []string{PermissionAdmin})
+
+	mux := http.NewServeMux()
+	setupTopicAdminRoutes(mux, ps)
+	setupTopicLifecycleRoutes(mux, ps)
+	serve := func(method, target, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, target, strings.NewReader(body))
+		request.Header.Set(apiKeyHeader, "root")
+		response := httptest.NewRecorder()
+		mux.ServeHTTP(response, request)
+		return response
+	}
+
+	response := serve("POST", "/admin/topics", `{"name":"lifecycle-room","owner":"alice","policy":{"capacity":2}}`)
+	assert.Equal(t, http.StatusCreated, response.Code)
+	assert.Equal(t, http.StatusConflict, serve("POST", "/admin/topics", `{"name":"lifecycle-room"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, serve("POST", "/admin/topics", `{"name":"other-room","policy":{"retention":"forever"}}`).Code)
+
+	assert.Equal(t, http.StatusNoContent, serve("PUT", "/admin/topics/lifecycle-room/policy", `{"capacity":3,"retention":"durable"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, serve("PUT", "/admin/topics/lifecycle-room/policy", `{"capacity":-1}`).Code)
+	response = serve("GET", "/admin/topics/lifecycle-room", "")
+	assert.Equal(t, http.StatusOK, response.Code)
+	var topic Topic
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &topic))
+	assert.Equal(t, "alice", topic.Owner)
+	assert.Equal(t, TopicPolicy{Capacity: 3, Retention: RetainDurable}, topic.Policy)
+
+	assert.Equal(t, http.StatusNoContent, serve("DELETE", "/admin/topics/lifecycle-room", "").Code)
+	assert.Equal(t, http.StatusNotFound, serve("GET", "/admin/topics/lifecycle-room", "").Code)
+}
@@ -0,0 +1,170 @@
+// This file counts the messages and bytes published to each topic and when it was last
+// published to, for capacity planning. The counters are listed with the subscriber count
+// of each topic by GET /admin/topics and exported on /metrics with a topic label:
+// gowebsockets_topic_messages_total, gowebsockets_topic_bytes_total,
+// gowebsockets_topic_subscribers and gowebsockets_topic_last_publish_timestamp_seconds.
+// Only the busiest topics get a label of their own, the others being added up under
+// topic="_other", so many short-lived topics cannot overwhelm the metrics. The counters
+// of a topic are dropped with it when it is deleted or collected.
+package main
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Default of how many topics get a label of their own on /metrics
+const defaultTopicMetricsLimit = 1000
+
+// Label of the topics beyond the limit on /metrics
+const otherTopicsLabel = "_other"
+
+// topicCounters are the counters of the messages published to a topic.
+type topicCounters struct {
+	messages      uint64
+	bytes         uint64
+	lastPublishAt time.Time
+}
+
+// TopicMetric is the activity of a topic.
+type TopicMetric struct {
+	Topic       string
+	Messages    uint64
+	Bytes       uint64
+	Subscribers int
+	// When the topic was last published to, zero if never
+	LastPublishAt time.Time
+}
+
+// Function to count a message published to a topic.
+// Parameters:
+// topic: string - The topic.
+// size: int - The size of the message in bytes.
+func (ps *PubSub) countPublish(topic string, size int) {
+	now := time.Now().UnixNano()
+	ps.updateTopicEntry(topic, func(entry *topicEntry) {
+		entry.messages.Add(1)
+		entry.bytes.Add(uint64(size))
+		entry.lastPublishAt.Store(now)
+	})
+}
+
+// Function to get the counters of a topic.
+// Parameters:
+// topic: string - The topic.
+// Returns:
+// topicCounters - A copy of the counters.
+// bool - False if nothing was published to the topic since it was last collected.
+func (ps *PubSub) topicCountersOf(topic string) (topicCounters, bool) {
+	entry := ps.topicEntry(topic)
+	if entry == nil || entry.messages.Load() == 0 {
+		return topicCounters{}, false
+	}
+	return entry.counters(), true
+}
+
+// Function to read the counters of a topic entry.
+// Returns:
+// topicCounters - A copy of the counters.
+func (e *topicEntry) counters() topicCounters {
+	counters := topicCounters{messages: e.messages.Load(), bytes: e.bytes.Load()}
+	if last := e.lastPublishAt.Load(); last != 0 {
+		counters.lastPublishAt = time.Unix(0, last)
+	}
+	return counters
+}
+
+// Function to list the activity of the topics that were published to or have subscribers.
+// Returns:
+// []TopicMetric - The activity of each topic, busiest first.
+func (ps *PubSub) TopicMetrics() []TopicMetric {
+	metrics := map[string]*TopicMetric{}
+	for _, shard := range ps.registry() {
+		shard.mu.RLock()
+		for topic, entry := range shard.topics {
+			counters, subscribers := entry.counters(), len(entry.subscriptionList())
+			if counters.messages == 0 && subscribers == 0 {
+				continue
+			}
+			metrics[topic] = &TopicMetric{Topic: topic, Messages: counters.messages, Bytes: counters.bytes,
+				Subscribers: subscribers, LastPublishAt: counters.lastPublishAt}
+		}
+		shard.mu.RUnlock()
+	}
+
+	list := make([]TopicMetric, 0, len(metrics))
+	for _, metric := range metrics {
+		list = append(list, *metric)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Messages != list[j].Messages {
+			return list[i].Messages > list[j].Messages
+		}
+		return list[i].Topic < list[j].Topic
+	})
+	return list
+}
+
+// topicMetricsCollector exports the activity of the topics of a PubSub.
+type topicMetricsCollector struct {
+	ps *PubSub
+}
+
+var (
+	topicMessagesDesc = prometheus.NewDesc("gowebsockets_topic_messages_total",
+		"Number of messages published to a topic.", []string{"topic"}, nil)
+	topicBytesDesc = prometheus.NewDesc("gowebsockets_topic_bytes_total",
+		"Number of bytes published to a topic.", []string{"topic"}, nil)
+	topicSubscribersDesc = prometheus.NewDesc("gowebsockets_topic_subscribers",
+		"Number of subscribers of a topic.", []string{"topic"}, nil)
+	topicLastPublishDesc = prometheus.NewDesc("gowebsockets_topic_last_publish_timestamp_seconds",
+		"Unix time a topic was last published to.", []string{"topic"}, nil)
+)
+
+// Function to describe the metrics of the collector.
+func (topicMetricsCollector) Describe(descs chan<- *prometheus.Desc) {
+	descs <- topicMessagesDesc
+	descs <- topicBytesDesc
+	descs <- topicSubscribersDesc
+	descs <- topicLastPublishDesc
+}
+
+// Function to collect the metrics of the busiest topics, adding up the others.
+func (c topicMetricsCollector) Collect(metrics chan<- prometheus.Metric) {
+	list := c.ps.TopicMetrics()
+	if limit := c.ps.options().topicMetricsLimit; len(list) > limit {
+		other := TopicMetric{Topic: otherTopicsLabel}
+		for _, metric := range list[limit:] {
+			other.Messages += metric.Messages
+			other.Bytes += metric.Bytes
+			other.Subscribers += metric.Subscribers
+			if metric.LastPublishAt.After(other.LastPublishAt) {
+				other.LastPublishAt = metric.LastPublishAt
+			}
+		}
+		list = append(list[:limit:limit], other)
+	}
+	for _, metric := range list {
+		metrics <- prometheus.MustNewConstMetric(topicMessagesDesc, prometheus.CounterValue, float64(metric.Messages), metric.Topic)
+		metrics <- prometheus.MustNewConstMetric(topicBytesDesc, prometheus.CounterValue, float64(metric.Bytes), metric.Topic)
+		metrics <- prometheus.MustNewConstMetric(topicSubscribersDesc, prometheus.GaugeValue, float64(metric.Subscribers), metric.Topic)
+		if !metric.LastPublishAt.IsZero() {
+			metrics <- prometheus.MustNewConstMetric(topicLastPublishDesc, prometheus.GaugeValue, float64(metric.LastPublishAt.UnixNano())/1e9, metric.Topic)
+		}
+	}
+}
+
+// Function to build the handler serving the metrics of the process along with the
+// activity of the topics of the PubSub.
+// Returns:
+// http.Handler - The handler.
+func (ps *PubSub) metricsHandler() http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(topicMetricsCollector{ps: ps})
+	gatherers := prometheus.Gatherers{prometheus.DefaultGatherer, registry}
+	return promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{}))
+}
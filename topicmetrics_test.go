@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTopicMetricsCountPublishes(t *testing.T) {
+	pubsub := &PubSub{}
+	client, peer := newTestClient(t)
+	pubsub.Subscribe(&client, "orders")
+	pubsub.Publish("orders", []byte(`{"n":1}`), nil)
+	pubsub.Publish("orders", []byte(`{"n":22}`), nil)
+	pubsub.Publish("prices", []byte(`1`), nil)
+	mustRead(t, peer)
+	mustRead(t, peer)
+
+	metrics := pubsub.TopicMetrics()
+	assert.Len(t, metrics, 2)
+	assert.Equal(t, "orders", metrics[0].Topic, "The busiest topics come first")
+	assert.Equal(t, uint64(2), metrics[0].Messages)
+	assert.Equal(t, uint64(15), metrics[0].Bytes)
+	assert.Equal(t, 1, metrics[0].Subscribers)
+	assert.False(t, metrics[0].LastPublishAt.IsZero())
+	assert.Equal(t, TopicMetric{Topic: "prices", Messages: 1, Bytes: 1, LastPublishAt: metrics[1].LastPublishAt}, metrics[1])
+
+	infos := pubsub.TopicInfos()
+	assert.Equal(t, uint64(2), infos[0].Messages)
+	assert.Equal(t, uint64(15), infos[0].Bytes)
+	assert.NotNil(t, infos[0].LastPublishAt)
+
+	pubsub.Unsubscribe(&client, "orders")
+	pubsub.CollectIdleTopics(0)
+	assert.Empty(t, pubsub.TopicMetrics(), "Collected topics drop their counters")
+}
+
+func TestTopicMetricsCollectorLimitsLabels(t *testing.T) {
+	pubsub := &PubSub{}
+	pubsub.options().topicMetricsLimit = 1
+	pubsub.Publish("busy", []byte(`1`), nil)
+	pubsub.Publish("busy", []byte(`1`), nil)
+	pubsub.Publish("quiet.a", []byte(`1`), nil)
+	pubsub.Publish("quiet.b", []byte(`1`), nil)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(topicMetricsCollector{ps: pubsub})
+	families, err := registry.Gather()
+	assert.NoError(t, err)
+	messages := map[string]float64{}
+	for _, family := range families {
+		if family.GetName() != "gowebsockets_topic_messages_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			messages[metric.GetLabel()[0].GetValue()] = metric.GetCounter().GetValue()
+		}
+	}
+	assert.Equal(t, map[string]float64{"busy": 2, otherTopicsLabel: 2}, messages, "Topics beyond the limit are added up")
+}
@@ -0,0 +1,380 @@
+// This file tracks the topics created by clients: who created (owns) each topic, its
+// policy and the principals granted access to it, so users can create private channels.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Protocol actions reserved to the owner of a topic
+const (
+	DELETE_TOPIC = "delete_topic"
+	SET_POLICY   = "set_policy"
+	GRANT        = "grant"
+	REVOKE       = "revoke"
+)
+
+var errUnknownTopic = errors.New("unknown topic")
+
+// TopicPolicy is the policy of a topic, changed by its owner.
+type TopicPolicy struct {
+	// Only the owner and the principals granted access may publish and subscribe
+	Private bool `json:"private"`
+	// Maximum number of subscribers, 0 for unlimited
+	Capacity int `json:"capacity,omitempty"`
+	// Queue subscribes to the full topic instead of refusing them
+	Waitlist bool `json:"waitlist,omitempty"`
+	// When the topic is archived and deleted, if ever
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// Retention tier of the topic, overriding the retention policy of the server
+	Retention RetentionTier `json:"retention,omitempty"`
+	// Type of the fields every message must have by path, as the schema registry infers them
+	Schema map[string]string `json:"schema,omitempty"`
+	// Identities that may publish and subscribe, as ACL patterns; everyone when empty
+	Publishers  []string `json:"publishers,omitempty"`
+	Subscribers []string `json:"subscribers,omitempty"`
+	// Seconds between re-authorizations of the subscribers, 0 to only check them when they subscribe
+	ReauthorizeInterval int `json:"reauthorizeInterval,omitempty"`
+	// Re-authorize the subscribers whenever the ACL, the policy or the grants of the topic change
+	ReauthorizeOnChange bool `json:"reauthorizeOnChange,omitempty"`
+}
+
+// Topic describes a topic created by publishing or subscribing to it.
+type Topic struct {
+	Name      string          `json:"name"`
+	Owner     string          `json:"owner,omitempty"`
+	CreatedAt time.Time       `json:"createdAt"`
+	Policy    TopicPolicy     `json:"policy"`
+	Grants    map[string]bool `json:"-"`
+	// Clients waiting for a place, in arrival order
+	waitlist []waitlistEntry
+	// Fires when the topic expires
+	expiry *time.Timer
+	// Fires when the subscribers are next re-authorized
+	reauthorization *time.Timer
+	// Created or configured explicitly rather than by its first use, so kept when idle
+	configured bool
+}
+
+// Function to get the principal a client is authenticated as.
+// Returns:
+// string - The subject of the client's claims, or an empty string for anonymous clients.
+func (client *Client) Principal() string {
+	principal, _ := client.Claims["sub"].(string)
+	return principal
+}
+
+// Function to get a topic, creating it owned by the client when it does not exist yet.
+// The caller must hold ps.mu.
+// Parameters:
+// name: string - The name of the topic.
+// client: *Client - The client creating the topic, or nil.
+// Returns:
+// *Topic - The topic.
+func (ps *PubSub) touchTopic(name string, client *Client) *Topic {
+	if ps.Topics == nil {
+		ps.Topics = map[string]*Topic{}
+	}
+	topic, ok := ps.Topics[name]
+	if !ok {
+		topic = &Topic{Name: name, CreatedAt: time.Now().UTC(), Grants: map[string]bool{}}
+		if client != nil {
+			topic.Owner = client.Principal()
+		}
+		ps.Topics[name] = topic
+		ps.syncTopicLocked(name)
+		ps.recordActivity(name)
+	}
+	return topic
+}
+
+// Function to copy a topic for the readers that do not hold ps.mu.
+// Returns:
+// *Topic - The copy, without its waitlist and timers.
+func (topic *Topic) snapshot() *Topic {
+	grants := make(map[string]bool, len(topic.Grants))
+	for principal := range topic.Grants {
+		grants[principal] = true
+	}
+	return &Topic{Name: topic.Name, Owner: topic.Owner, CreatedAt: topic.CreatedAt, Policy: topic.Policy, Grants: grants}
+}
+
+// Function to check whether a client may publish or subscribe to a topic, creating the
+// topic owned by the client when it does not exist yet and topics are not explicit.
+// Parameters:
+// name: string - The name of the topic.
+// client: *Client - The client.
+// action: string - PUBLISH or SUBSCRIBE.
+// Returns:
+// bool - False if the topic is private and the client is neither its owner nor granted access, if its policy does not list the client for the action, or if it was never created and topics are explicit.
+func (ps *PubSub) canAccessTopic(name string, client *Client, action string) bool {
+	// Topics that exist are checked against their copy in the shard, without ps.mu
+	if topic := ps.topicSnapshot(name); topic != nil {
+		return topic.allows(client, action)
+	}
+	ps.mu.Lock()
+	_, exists := ps.Topics[name]
+	if !exists && ps.ExplicitTopics && !isServerTopic(name) {
+		ps.mu.Unlock()
+		return false
+	}
+	topic := ps.touchTopic(name, client)
+	allowed := topic.allows(client, action)
+	owner := topic.Owner
+	ps.mu.Unlock()
+
+	if !exists {
+		ps.announceTopic(TOPIC_CREATED, name, owner, TopicPolicy{})
+	}
+	return allowed
+}
+
+// Function to check whether a topic lets a client publish or subscribe to it. The
+// caller must hold ps.mu, unless the topic is a copy from its shard.
+// Parameters:
+// client: *Client - The client.
+// action: string - PUBLISH or SUBSCRIBE.
+// Returns:
+// bool - True for the owner, and for other clients unless the topic is private and they are not granted access or its policy does not list them for the action.
+func (topic *Topic) allows(client *Client, action string) bool {
+	principal := client.Principal()
+	if principal != "" && principal == topic.Owner {
+		return true
+	}
+	if topic.Policy.Private && (principal == "" || !topic.Grants[principal]) {
+		return false
+	}
+	return topic.Policy.admits(client, action)
+}
+
+// Function to check whether a client owns a topic.
+// Parameters:
+// name: string - The name of the topic.
+// client: *Client - The client.
+// Returns:
+// bool - True if the client is authenticated as the creator of the topic.
+func (ps *PubSub) isTopicOwner(name string, client *Client) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	topic, ok := ps.Topics[name]
+	return ok && topic.Owner != "" && topic.Owner == client.Principal()
+}
+
+// Function to delete a topic: its subscribers are told and unsubscribed and its history is dropped.
+// Parameters:
+// name: string - The name of the topic.
+// Returns:
+// error - An error if the topic does not exist.
+func (ps *PubSub) DeleteTopic(name string) error {
+	return ps.deleteTopic(name, "topic_deleted")
+}
+
+// Function to delete a topic, telling its subscribers why.
+// Parameters:
+// name: string - The name of the topic.
+// action: string - The action of the frame sent to the subscribers.
+// Returns:
+// error - An error if the topic does not exist.
+func (ps *PubSub) deleteTopic(name string, action string) error {
+	ps.mu.Lock()
+	topic, ok := ps.Topics[name]
+	if !ok {
+		ps.mu.Unlock()
+		return errUnknownTopic
+	}
+	if topic.expiry != nil {
+		topic.expiry.Stop()
+	}
+	if topic.reauthorization != nil {
+		topic.reauthorization.Stop()
+	}
+	waitlist := topic.waitlist
+	delete(ps.Topics, name)
+	ps.syncTopicLocked(name)
+
+	var subscribers []*Client
+	for _, entry := range waitlist {
+		subscribers = append(subscribers, entry.client)
+	}
+	for _, sub := range ps.removeSubscriptionsLocked(name, func(Subscription) bool { return true }) {
+		subscribers = append(subscribers, sub.Client)
+		sub.Stats.Stop()
+		sub.stopExpiry()
+		ps.presenceChangedLocked(LEFT, sub.Client, name)
+	}
+	ps.forgetTopicState(name)
+	ps.mu.Unlock()
+	ps.announcePresence()
+
+	if ps.History != nil {
+		ps.History.Delete(name)
+	}
+
+	notification, _ := json.Marshal(map[string]string{"action": action, "topic": name})
+	for _, subscriber := range subscribers {
+		subscriber.Send(notification)
+	}
+	ps.announceTopic(action, name, topic.Owner, topic.Policy)
+	return nil
+}
+
+// Function to change the policy of a topic.
+// Parameters:
+// name: string - The name of the topic.
+// policy: TopicPolicy - The new policy.
+// Returns:
+// error - An error if the topic does not exist or the policy is invalid.
+func (ps *PubSub) SetTopicPolicy(name string, policy TopicPolicy) error {
+	if err := policy.validate(); err != nil {
+		return err
+	}
+	ps.mu.Lock()
+	topic, ok := ps.Topics[name]
+	if !ok {
+		ps.mu.Unlock()
+		return errUnknownTopic
+	}
+	topic.Policy = policy
+	topic.configured = true
+	ps.syncTopicLocked(name)
+	ps.scheduleExpiryLocked(topic)
+	ps.scheduleReauthorizationLocked(topic)
+	// A larger capacity frees places for the waiting clients
+	promoted := ps.promoteLocked(name)
+	subscribed := ps.takeSubscribedLocked()
+	ps.mu.Unlock()
+	ps.setRetention(name, policy.Retention)
+
+	notifyPromoted(name, promoted)
+	ps.runSubscribeCallbacks(subscribed)
+	ps.announcePresence()
+	if policy.ReauthorizeOnChange {
+		ps.Reauthorize(name)
+	}
+	return nil
+}
+
+// Function to grant or revoke the access of a principal to a topic.
+// Parameters:
+// name: string - The name of the topic.
+// principal: string - The principal.
+// granted: bool - True to grant access, false to revoke it.
+// Returns:
+// error - An error if the topic does not exist.
+func (ps *PubSub) SetTopicGrant(name string, principal string, granted bool) error {
+	ps.mu.Lock()
+	topic, ok := ps.Topics[name]
+	if !ok {
+		ps.mu.Unlock()
+		return errUnknownTopic
+	}
+	if granted {
+		topic.Grants[principal] = true
+	} else {
+		delete(topic.Grants, principal)
+	}
+	topic.configured = true
+	ps.syncTopicLocked(name)
+	reauthorize := !granted && topic.Policy.ReauthorizeOnChange
+	ps.mu.Unlock()
+
+	if reauthorize {
+		ps.Reauthorize(name)
+	}
+	return nil
+}
+
+// Function to handle the owner-only protocol actions of a client.
+// Parameters:
+// client: *Client - The client that sent the action.
+// m: Message - The received message.
+func (ps *PubSub) handleOwnerAction(client *Client, m Message) {
+	if !ps.isTopicOwner(m.Topic, client) {
+		ps.refuse(client, m)
+		return
+	}
+
+	var err error
+	switch m.Action {
+	case DELETE_TOPIC:
+		err = ps.DeleteTopic(m.Topic)
+	case SET_POLICY:
+		var policy TopicPolicy
+		if err = json.Unmarshal(m.Policy, &policy); err == nil {
+			err = ps.SetTopicPolicy(m.Topic, policy)
+		}
+	case INVITE:
+		err = ps.handleInvite(client, m)
+	case GRANT, REVOKE:
+		if m.Principal == "" {
+			err = errors.New("missing principal")
+		} else {
+			err = ps.SetTopicGrant(m.Topic, m.Principal, m.Action == GRANT)
+		}
+	}
+	if err != nil {
+		client.logger().Warn("Owner action failed", logKeyAction, m.Action, logKeyTopic, m.Topic, "error", err)
+	}
+}
+
+// MarshalJSON lists the grants of a topic as a sorted array.
+func (t Topic) MarshalJSON() ([]byte, error) {
+	grants := make([]string, 0, len(t.Grants))
+	for principal := range t.Grants {
+		grants = append(grants, principal)
+	}
+	sort.Strings(grants)
+	type topic Topic
+	return json.Marshal(struct {
+		topic
+		Grants []string `json:"grants"`
+	}{topic(t), grants})
+}
+
+// Function to register the admin API managing topics on behalf of their owners.
+// Parameters:
+// mux: *http.ServeMux - The mux to register the routes on.
+// pubsub: *PubSub - The PubSub the routes serve.
+func setupTopicAdminRoutes(mux *http.ServeMux, pubsub *PubSub) {
+	mux.HandleFunc("DELETE /admin/topics/{topic}", pubsub.requireAPIKey(PermissionAdmin, func(w http.ResponseWriter, r *http.Request) {
+		writeTopicResult(w, r, pubsub.DeleteTopic(r.PathValue("topic")))
+	}))
+
+	mux.HandleFunc("PUT /admin/topics/{topic}/policy", pubsub.requireAPIKey(PermissionAdmin, func(w http.ResponseWriter, r *http.Request) {
+		var policy TopicPolicy
+		if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeTopicResult(w, r, pubsub.SetTopicPolicy(r.PathValue("topic"), policy))
+	}))
+
+	mux.HandleFunc("PUT /admin/topics/{topic}/grants/{principal}", pubsub.requireAPIKey(PermissionAdmin, func(w http.ResponseWriter, r *http.Request) {
+		writeTopicResult(w, r, pubsub.SetTopicGrant(r.PathValue("topic"), r.PathValue("principal"), true))
+	}))
+
+	mux.HandleFunc("DELETE /admin/topics/{topic}/grants/{principal}", pubsub.requireAPIKey(PermissionAdmin, func(w http.ResponseWriter, r *http.Request) {
+		writeTopicResult(w, r, pubsub.SetTopicGrant(r.PathValue("topic"), r.PathValue("principal"), false))
+	}))
+}
+
+// Function to answer an admin topic request.
+// Parameters:
+// w: http.ResponseWriter - The response writer.
+// r: *http.Request - The request.
+// err: error - The result of the operation.
+func writeTopicResult(w http.ResponseWriter, r *http.Request, err error) {
+	var invalid *invalidPolicyError
+	switch {
+	case errors.Is(err, errUnknownTopic):
+		http.NotFound(w, r)
+	case errors.As(err, &invalid):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
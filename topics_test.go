@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTopicOwnerControlsPrivateTopic(t *testing.T) {
+	ps := &PubSub{}
+	alice, alicePeer := newTestClient(t)
+	alice.Claims = jwt.MapClaims{"sub": "alice"}
+	bob, bobPeer := newTestClient(t)
+	bob.Claims = jwt.MapClaims{"sub": "bob"}
+
+	ps.HandleRecvdMessage(alice, 1, []byte(`{"action":"subscribe","topic":"room"}`))
+	assert.Equal(t, "alice", ps.Topics["room"].Owner, "The first client to use a topic owns it")
+
+	ps.HandleRecvdMessage(bob, 1, []byte(`{"action":"set_policy","topic":"room","policy":{"private":true}}`))
+	var reply map[string]string
+	assert.NoError(t, bobPeer.ReadJSON(&reply))
+	assert.Equal(t, "forbidden", reply["code"], "Only the owner may change the policy")
+
+	ps.HandleRecvdMessage(alice, 1, []byte(`{"action":"set_policy","topic":"room","policy":{"private":true}}`))
+	assert.True(t, ps.Topics["room"].Policy.Private)
+
+	ps.HandleRecvdMessage(bob, 1, []byte(`{"action":"subscribe","topic":"room"}`))
+	assert.NoError(t, bobPeer.ReadJSON(&reply))
+	assert.Equal(t, "forbidden", reply["code"], "Private topics refuse other principals")
+
+	ps.HandleRecvdMessage(alice, 1, []byte(`{"action":"grant","topic":"room","principal":"bob"}`))
+	ps.HandleRecvdMessage(bob, 1, []byte(`{"action":"subscribe","topic":"room"}`))
+	assert.Len(t, ps.GetSubscriptions("room", nil), 2, "Granted principals may subscribe")
+
+	ps.HandleRecvdMessage(alice, 1, []byte(`{"action":"delete_topic","topic":"room"}`))
+	assert.Empty(t, ps.GetSubscriptions("room", nil))
+	assert.NotContains(t, ps.Topics, "room")
+	assert.NoError(t, alicePeer.ReadJSON(&reply))
+	assert.Equal(t, "topic_deleted", reply["action"])
+	assert.NoError(t, bobPeer.ReadJSON(&reply))
+	assert.Equal(t, "topic_deleted", reply["action"])
+}
+
+func TestAnonymousTopicsHaveNoOwner(t *testing.T) {
+	ps := &PubSub{}
+	client, peer := newTestClient(t)
+
+	ps.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"lobby"}`))
+	ps.HandleRecvdMessage(client, 1, []byte(`{"action":"delete_topic","topic":"lobby"}`))
+
+	var reply map[string]string
+	assert.NoError(t, peer.ReadJSON(&reply))
+	assert.Equal(t, "forbidden", reply["code"], "Topics created anonymously cannot be managed by clients")
+	assert.Contains(t, ps.Topics, "lobby")
+}
+
+func TestTopicAdminRoutes(t *testing.T) {
+	keys := NewAPIKeyStore()
+	isolatePubSub(t).apiKeys = keys
+	keys.Add("root", "admin", []string{PermissionAdmin})
+
+	ps.mu.Lock()
+	ps.touchTopic("admin-room", nil)
+	ps.mu.Unlock()
+
+	mux := http.NewServeMux()
+	setupTopicAdminRoutes(mux, ps)
+	serve := func(method, target string) int {
+		request := httptest.NewRequest(method, target, nil)
+		request.Header.Set(apiKeyHeader, "root")
+		response := httptest.NewRecorder()
+		mux.ServeHTTP(response, request)
+		return response.Code
+	}
+
+	assert.Equal(t, http.StatusNoContent, serve("PUT", "/admin/topics/admin-room/grants/carol"))
+	assert.True(t, ps.Topics["admin-room"].Grants["carol"])
+	assert.Equal(t, http.StatusNoContent, serve("DELETE", "/admin/topics/admin-room/grants/carol"))
+	assert.False(t, ps.Topics["admin-room"].Grants["carol"])
+	assert.Equal(t, http.StatusNoContent, serve("DELETE", "/admin/topics/admin-room"))
+	assert.Equal(t, http.StatusNotFound, serve("DELETE", "/admin/topics/admin-room"))
+}
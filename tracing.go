@@ -0,0 +1,118 @@
+// This file traces the flow of messages with OpenTelemetry: the WebSocket upgrade, every
+// frame received, its handling, the publish and the fan-out to each subscriber. Clients
+// can continue their own trace by sending a W3C trace context with a message, and
+// subscribers asking for envelopes get the trace context of the delivery with it.
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// Name of the service the spans are reported for
+const serviceName = "gowebsockets"
+
+// Tracer of the spans of the server, a no-op until tracing is set up
+var tracer trace.Tracer = noop.NewTracerProvider().Tracer(serviceName)
+
+// Propagator reading and writing W3C trace contexts in headers and messages
+var propagator = propagation.TraceContext{}
+
+// Function to export the spans of the server to an OTLP/HTTP collector.
+// Parameters:
+// endpoint: string - The URL of the collector, e.g. http://localhost:4318.
+// sampleRatio: float64 - The fraction of traces started by the server that are sampled.
+// Returns:
+// func() - Exports the remaining spans and stops the exporter.
+// error - An error if the exporter could not be created or the ratio is invalid.
+func setupTracing(endpoint string, sampleRatio float64) (func(), error) {
+	if sampleRatio < 0 || sampleRatio > 1 {
+		return nil, fmt.Errorf("invalid trace_sample_ratio %v", sampleRatio)
+	}
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	)
+	tracer = provider.Tracer(serviceName)
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			slog.Error("Error flushing traces", "error", err)
+		}
+	}, nil
+}
+
+// Function to get the context a message continues: the trace context the client sent
+// with it, or the context it was received in.
+// Parameters:
+// ctx: context.Context - The context the message was received in.
+// carrier: map[string]string - The trace context sent with the message, if any.
+// Returns:
+// context.Context - The parent of the spans of the message.
+// []trace.SpanStartOption - Links the span to the receive span when the client's trace is continued.
+func messageContext(ctx context.Context, carrier map[string]string) (context.Context, []trace.SpanStartOption) {
+	if len(carrier) == 0 {
+		return ctx, nil
+	}
+	remote := trace.SpanContextFromContext(propagator.Extract(context.Background(), propagation.MapCarrier(carrier)))
+	if !remote.IsValid() {
+		return ctx, nil
+	}
+	link := trace.LinkFromContext(ctx)
+	return trace.ContextWithRemoteSpanContext(ctx, remote), []trace.SpanStartOption{trace.WithLinks(link)}
+}
+
+// Function to keep the trace of a context without its deadline or cancellation, for
+// work that outlives it such as scanning.
+// Parameters:
+// ctx: context.Context - The context.
+// Returns:
+// context.Context - A background context carrying the span context, publisher, reply headers, analytics sample and publishing client of ctx.
+func detachTrace(ctx context.Context) context.Context {
+	detached := withPublisher(trace.ContextWithSpanContext(context.Background(), trace.SpanContextFromContext(ctx)), publisherFrom(ctx))
+	detached = withAnalyticsSample(withReply(detached, replyFrom(ctx)), analyticsSampleFrom(ctx))
+	return withEchoSource(detached, echoSourceFrom(ctx))
+}
+
+// Function to get the trace context of a span to send with a message.
+// Parameters:
+// ctx: context.Context - The context of the span.
+// Returns:
+// map[string]string - The W3C trace context, or nil when the span is not traced.
+func traceCarrier(ctx context.Context) map[string]string {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return nil
+	}
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	return carrier
+}
+
+// Function to end a span, recording the error it failed with if any.
+// Parameters:
+// span: trace.Span - The span.
+// err: error - The error, or nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// envelopeTransport keeps the last message it is given.
+type envelopeTransport struct {
+	message []byte
+}
+
+func (e *envelopeTransport) Deliver(topic string, message []byte) error {
+	e.message = message
+	return nil
+}
+
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	tracer = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer(serviceName)
+	t.Cleanup(func() { tracer = noop.NewTracerProvider().Tracer(serviceName) })
+	return recorder
+}
+
+func TestTracePublishToEverySubscriber(t *testing.T) {
+	recorder := recordSpans(t)
+	pubsub := &PubSub{}
+	transport := &envelopeTransport{}
+	pubsub.SubscribeWith(&Client{Id: "enveloped", Transport: transport}, "orders", SubscribeOptions{Envelope: true})
+	pubsub.Subscribe(&Client{Id: "plain", Transport: discardTransport{}}, "orders")
+
+	traceparent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	pubsub.HandleRecvdMessage(Client{Id: "publisher"}, 1,
+		[]byte(`{"action":"publish","topic":"orders","message":{"id":1},"trace":{"traceparent":"`+traceparent+`"}}`))
+
+	spans := map[string][]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = append(spans[span.Name()], span)
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.SpanContext().TraceID().String(),
+			"Every span should continue the trace sent with the message")
+	}
+	assert.Len(t, spans["message.handle"], 1)
+	assert.Len(t, spans["pubsub.publish"], 1)
+	assert.Len(t, spans["pubsub.deliver"], 1)
+	assert.Len(t, spans["pubsub.deliver.subscriber"], 2, "Every subscriber delivery should be traced")
+	deliver := spans["pubsub.deliver"][0]
+	assert.Equal(t, spans["pubsub.publish"][0].SpanContext().SpanID(), deliver.Parent().SpanID())
+
+	var envelope struct {
+		Trace map[string]string `json:"trace"`
+	}
+	assert.NoError(t, json.Unmarshal(transport.message, &envelope))
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-"+deliver.SpanContext().SpanID().String()+"-01",
+		envelope.Trace["traceparent"], "The envelope should carry the trace context of the delivery")
+}
+
+func TestTraceReceivedFrameWithoutTraceContext(t *testing.T) {
+	recorder := recordSpans(t)
+	pubsub := &PubSub{}
+	receiveCtx, receive := tracer.Start(context.Background(), "websocket.receive")
+	pubsub.HandleRecvdMessageContext(receiveCtx, Client{Id: "c1"}, 1, []byte(`{"action":"publish","topic":"news","message":"hi"}`))
+	receive.End()
+
+	for _, span := range recorder.Ended() {
+		assert.Equal(t, receive.SpanContext().TraceID(), span.SpanContext().TraceID(),
+			"A message without a trace context should continue the trace it was received in")
+	}
+	assert.Len(t, recorder.Ended(), 4)
+	assert.Equal(t, trace.SpanContext{}, trace.SpanContextFromContext(detachTrace(context.Background())))
+}
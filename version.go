@@ -0,0 +1,125 @@
+// This file negotiates the version of the envelope protocol a connection speaks, so the
+// server can serve clients of different versions side by side. A client names the
+// versions it speaks with gowebsockets.v<N> subprotocol tokens on the upgrade request,
+// or with {"action":"hello","version":N} before any other frame; it speaks v1, the
+// current protocol, if it names none. The welcome frame tells the client the version it
+// got, and a client asking only for versions the server does not speak is closed with
+// the unsupported_version close code.
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// Version of the protocol spoken by clients that do not name one
+const protocolV1 = 1
+
+// Versions of the protocol the server speaks, the newest last
+var supportedProtocolVersions = []int{protocolV1}
+
+// Prefix of the subprotocol tokens naming a version of the protocol
+const versionSubprotocolPrefix = "gowebsockets.v"
+
+// Codes of the error frames refusing a version
+const (
+	// The server does not speak the version, sent to clients that cannot be closed
+	codeUnsupportedVersion = "unsupported_version"
+	// The client already sent frames in another version
+	codeVersionFixed = "version_fixed"
+)
+
+// Function to check whether the server speaks a version of the protocol.
+// Parameters:
+// version: int - The version.
+// Returns:
+// bool - True if the version is supported.
+func supportedProtocolVersion(version int) bool {
+	for _, supported := range supportedProtocolVersions {
+		if supported == version {
+			return true
+		}
+	}
+	return false
+}
+
+// Function to pick the version of the protocol of a connection from the subprotocol
+// tokens the client offered.
+// Parameters:
+// r: *http.Request - The upgrade request.
+// Returns:
+// int - The newest supported version offered, v1 if the client offered no version, or 0 if it offered only unsupported versions.
+// string - The token of the version picked, or "" if the client offered none.
+func negotiateVersion(r *http.Request) (int, string) {
+	offered := false
+	version, token := 0, ""
+	for _, name := range websocket.Subprotocols(r) {
+		number, ok := strings.CutPrefix(name, versionSubprotocolPrefix)
+		if !ok {
+			continue
+		}
+		offered = true
+		if n, err := strconv.Atoi(number); err == nil && supportedProtocolVersion(n) && n > version {
+			version, token = n, name
+		}
+	}
+	if !offered {
+		return protocolV1, ""
+	}
+	return version, token
+}
+
+// Function to get the version of the protocol a session speaks.
+// Returns:
+// int - The version, v1 unless another was negotiated.
+func (s *Session) ProtocolVersion() int {
+	if s == nil || s.version.Load() == 0 {
+		return protocolV1
+	}
+	return int(s.version.Load())
+}
+
+// Function to set the version of the protocol a session speaks.
+// Parameters:
+// version: int - The version.
+func (s *Session) setProtocolVersion(version int) {
+	if s != nil {
+		s.version.Store(int32(version))
+	}
+}
+
+// Function to fix the version of the protocol of a session, once the client sent a frame
+// in it.
+func (s *Session) fixProtocolVersion() {
+	if s != nil {
+		s.versionFixed.Store(true)
+	}
+}
+
+// Function to switch a client to the version of the protocol its hello frame asks for.
+// Clients asking for a version the server does not speak are closed.
+// Parameters:
+// client: *Client - The client.
+// version: int - The version asked for.
+// Returns:
+// bool - True if the client speaks the version now.
+func switchProtocolVersion(client *Client, version int) bool {
+	if !supportedProtocolVersion(version) {
+		client.logger().Info("Closing client speaking an unsupported protocol version", "version", version)
+		if !client.Closable() {
+			client.Send(errorDetailMessage(codeUnsupportedVersion, "", "unsupported protocol version "+strconv.Itoa(version)))
+		} else {
+			client.Close(ReasonUnsupportedVersion)
+		}
+		return false
+	}
+	if client.Session != nil && client.Session.versionFixed.Load() && version != client.Session.ProtocolVersion() {
+		client.Send(errorDetailMessage(codeVersionFixed, "", "the protocol version can only be chosen before any other frame"))
+		return false
+	}
+	client.Session.setProtocolVersion(version)
+	return true
+}
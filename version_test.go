@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// dialVersion connects to a test server offering subprotocols.
+func dialVersion(t *testing.T, subprotocols ...string) (*websocket.Conn, *http.Response) {
+	server := httptest.NewServer(http.HandlerFunc(ps.webSocketHandler))
+	t.Cleanup(server.Close)
+	dialer := websocket.Dialer{Subprotocols: subprotocols}
+	ws, response, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return ws, response
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	offer := func(subprotocols ...string) *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		if len(subprotocols) > 0 {
+			r.Header.Set(subprotocolHeader, strings.Join(subprotocols, ", "))
+		}
+		return r
+	}
+	version, token := negotiateVersion(offer())
+	assert.Equal(t, protocolV1, version, "Clients naming no version speak v1")
+	assert.Empty(t, token)
+	version, token = negotiateVersion(offer("cbor", "gowebsockets.v9", "gowebsockets.v1"))
+	assert.Equal(t, protocolV1, version)
+	assert.Equal(t, "gowebsockets.v1", token)
+	version, _ = negotiateVersion(offer("gowebsockets.v9", "gowebsockets.vx"))
+	assert.Equal(t, 0, version, "Clients offering only unsupported versions get none")
+}
+
+func TestVersionSubprotocol(t *testing.T) {
+	ws, response := dialVersion(t, "gowebsockets.v1")
+	assert.Equal(t, "gowebsockets.v1", response.Header.Get(subprotocolHeader))
+	var welcome welcomeFrame
+	assert.NoError(t, ws.ReadJSON(&welcome))
+	assert.Equal(t, protocolV1, welcome.Version)
+
+	unsupported, _ := dialVersion(t, "gowebsockets.v9")
+	_, _, err := unsupported.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, CloseUnsupportedVersion), "Clients speaking only unknown versions are closed")
+}
+
+func TestHelloChoosesVersion(t *testing.T) {
+	ws, _ := dialVersion(t)
+	ws.ReadMessage()
+
+	ws.WriteJSON(map[string]interface{}{"action": HELLO, "version": 1})
+	ws.ReadMessage()
+	var frame map[string]interface{}
+	assert.NoError(t, ws.ReadJSON(&frame))
+	assert.Equal(t, map[string]interface{}{"action": HELLO, "version": 1.0}, frame)
+
+	ws.WriteJSON(map[string]interface{}{"action": HELLO, "version": 2})
+	ws.ReadMessage()
+	_, _, err := ws.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, CloseUnsupportedVersion))
+}
+
+func TestVersionIsFixedByOtherFrames(t *testing.T) {
+	pubsub := &PubSub{}
+	client, peer := newTestClient(t)
+	client.Session = NewSession("test")
+	supportedProtocolVersions = []int{protocolV1, 2}
+	defer func() { supportedProtocolVersions = []int{protocolV1} }()
+
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"subscribe","topic":"chat"}`))
+	pubsub.HandleRecvdMessage(client, 1, []byte(`{"action":"hello","version":2}`))
+	assert.Equal(t, codeVersionFixed, readFrame(t, peer)["code"])
+	assert.Equal(t, protocolV1, client.Session.ProtocolVersion())
+}
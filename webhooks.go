@@ -0,0 +1,288 @@
+// This file lets consumers that do not speak WebSockets subscribe to a topic with an
+// HTTP callback URL. A webhook is a client of its own whose transport POSTs every
+// message of its topic, wrapped in an envelope carrying the message ID, to the URL. The
+// requests are signed with a secret of the webhook so the receiver can check they came
+// from the server, and are retried with exponential backoff while the URL fails.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Headers of the requests of a webhook
+const (
+	webhookIdHeader        = "X-Webhook-Id"
+	webhookTopicHeader     = "X-Webhook-Topic"
+	webhookTimestampHeader = "X-Webhook-Timestamp"
+	webhookSignatureHeader = "X-Webhook-Signature"
+)
+
+// Messages queued per webhook, and how many times a message is posted before it is dropped
+const (
+	webhookQueueSize = 256
+	webhookAttempts  = 5
+)
+
+// How long to wait before retrying a failed request the first time, doubling every retry
+var webhookRetryDelay = time.Second
+
+// How long a request of a webhook may take
+const webhookTimeout = 10 * time.Second
+
+var errUnknownWebhook = errors.New("unknown webhook")
+
+// Webhook is an HTTP callback URL subscribed to a topic.
+type Webhook struct {
+	Id    string `json:"id"`
+	Topic string `json:"topic"`
+	URL   string `json:"url"`
+	// Key signing the requests, only shown when the webhook is created
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Transport posting the messages of a webhook to its URL from a queue, so a slow URL
+// does not hold up publishers
+type webhookTransport struct {
+	webhook Webhook
+	client  *http.Client
+	queue   chan []byte
+	ctx     context.Context
+	stop    context.CancelFunc
+}
+
+// Function to register a webhook and subscribe it to its topic.
+// Parameters:
+// topic: string - The topic.
+// callback: string - The http or https URL the messages are posted to.
+// secret: string - The key signing the requests, or an empty string to generate one.
+// Returns:
+// Webhook - The webhook, with its secret.
+// error - An error if the topic is empty or the URL is not an absolute http or https URL.
+func (ps *PubSub) AddWebhook(topic string, callback string, secret string) (Webhook, error) {
+	if topic == "" {
+		return Webhook{}, errors.New("webhook without a topic")
+	}
+	parsed, err := url.Parse(callback)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return Webhook{}, fmt.Errorf("invalid webhook url %q", callback)
+	}
+	if secret == "" {
+		random := make([]byte, 32)
+		rand.Read(random)
+		secret = hex.EncodeToString(random)
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	transport := &webhookTransport{
+		webhook: Webhook{Id: "webhook-" + autoId(), Topic: topic, URL: callback, Secret: secret, CreatedAt: time.Now().UTC()},
+		client:  &http.Client{Timeout: webhookTimeout},
+		queue:   make(chan []byte, webhookQueueSize),
+		ctx:     ctx,
+		stop:    stop,
+	}
+	go transport.run()
+
+	client := Client{Id: transport.webhook.Id, Language: defaultLanguage, Transport: transport}
+	ps.mu.Lock()
+	if ps.webhooks == nil {
+		ps.webhooks = map[string]*webhookTransport{}
+	}
+	ps.webhooks[client.Id] = transport
+	ps.mu.Unlock()
+	ps.AddClient(client)
+	ps.SubscribeWith(&client, topic, SubscribeOptions{Envelope: true})
+
+	slog.Info("Added webhook", logKeyClient, client.Id, logKeyTopic, topic, "url", callback)
+	return transport.webhook, nil
+}
+
+// Function to unsubscribe and remove a webhook. Messages still queued are dropped.
+// Parameters:
+// id: string - The ID of the webhook.
+// Returns:
+// error - errUnknownWebhook if no webhook has the ID.
+func (ps *PubSub) RemoveWebhook(id string) error {
+	ps.mu.Lock()
+	transport := ps.webhooks[id]
+	delete(ps.webhooks, id)
+	ps.mu.Unlock()
+	if transport == nil {
+		return errUnknownWebhook
+	}
+	ps.RemoveClient(Client{Id: id})
+	transport.stop()
+	slog.Info("Removed webhook", logKeyClient, id)
+	return nil
+}
+
+// Function to list the webhooks, without their secrets.
+// Returns:
+// []Webhook - The webhooks, oldest first.
+func (ps *PubSub) Webhooks() []Webhook {
+	ps.mu.Lock()
+	webhooks := make([]Webhook, 0, len(ps.webhooks))
+	for _, transport := range ps.webhooks {
+		webhook := transport.webhook
+		webhook.Secret = ""
+		webhooks = append(webhooks, webhook)
+	}
+	ps.mu.Unlock()
+	sort.Slice(webhooks, func(i, j int) bool { return webhooks[i].CreatedAt.Before(webhooks[j].CreatedAt) })
+	return webhooks
+}
+
+// Function to queue a message for the URL of the webhook.
+// Parameters:
+// topic: string - The topic the message was published to.
+// message: []byte - The message, in its envelope.
+// Returns:
+// error - errMessageDropped if the queue is full.
+func (t *webhookTransport) Deliver(topic string, message []byte) error {
+	select {
+	case t.queue <- message:
+		return nil
+	default:
+		slog.Warn("Dropped webhook message", logKeyClient, t.webhook.Id, logKeyTopic, topic)
+		return errMessageDropped
+	}
+}
+
+// Function to post the queued messages, in order, until the webhook is removed.
+func (t *webhookTransport) run() {
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case message := <-t.queue:
+			if err := t.post(message); err != nil && t.ctx.Err() == nil {
+				slog.Error("Error posting webhook message", logKeyClient, t.webhook.Id, "url", t.webhook.URL, "error", err)
+			}
+		}
+	}
+}
+
+// Function to post a message, retrying with exponential backoff while the URL cannot
+// be reached, answers 429 or a server error.
+// Parameters:
+// message: []byte - The message.
+// Returns:
+// error - The last error if every attempt failed or the URL refused the message.
+func (t *webhookTransport) post(message []byte) error {
+	delay := webhookRetryDelay
+	var err error
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		var retry bool
+		if retry, err = t.attempt(message); !retry {
+			return err
+		}
+		if attempt == webhookAttempts {
+			break
+		}
+		select {
+		case <-t.ctx.Done():
+			return t.ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+	return err
+}
+
+// Function to post a message once.
+// Parameters:
+// message: []byte - The message.
+// Returns:
+// bool - True if the request failed and is worth retrying.
+// error - An error if the request failed.
+func (t *webhookTransport) attempt(message []byte) (bool, error) {
+	request, err := http.NewRequestWithContext(t.ctx, http.MethodPost, t.webhook.URL, bytes.NewReader(message))
+	if err != nil {
+		return false, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(webhookIdHeader, t.webhook.Id)
+	request.Header.Set(webhookTopicHeader, t.webhook.Topic)
+	request.Header.Set(webhookTimestampHeader, timestamp)
+	request.Header.Set(webhookSignatureHeader, signWebhook(t.webhook.Secret, timestamp, message))
+
+	response, err := t.client.Do(request)
+	if err != nil {
+		return true, err
+	}
+	response.Body.Close()
+	switch {
+	case response.StatusCode < 300:
+		return false, nil
+	case response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500:
+		return true, fmt.Errorf("webhook answered %s", response.Status)
+	default:
+		return false, fmt.Errorf("webhook answered %s", response.Status)
+	}
+}
+
+// Function to sign a request of a webhook. The receiver recomputes the signature from
+// the timestamp header and the body, and can refuse old timestamps to stop replays.
+// Parameters:
+// secret: string - The secret of the webhook.
+// timestamp: string - The Unix time of the request.
+// body: []byte - The body of the request.
+// Returns:
+// string - sha256= followed by the hex encoded HMAC-SHA256 of the timestamp, a dot and the body.
+func signWebhook(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Function to register the admin API adding, listing and removing webhooks.
+// Parameters:
+// mux: *http.ServeMux - The mux to register the routes on.
+// pubsub: *PubSub - The PubSub the routes serve.
+func setupWebhookRoutes(mux *http.ServeMux, pubsub *PubSub) {
+	mux.HandleFunc("GET /admin/webhooks", pubsub.requireAPIKey(PermissionAdmin, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, pubsub.Webhooks())
+	}))
+
+	mux.HandleFunc("POST /admin/webhooks", pubsub.requireAPIKey(PermissionAdmin, func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Topic  string `json:"topic"`
+			URL    string `json:"url"`
+			Secret string `json:"secret"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "expected {\"topic\": ..., \"url\": ...}", http.StatusBadRequest)
+			return
+		}
+		webhook, err := pubsub.AddWebhook(request.Topic, request.URL, request.Secret)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusCreated, webhook)
+	}))
+
+	mux.HandleFunc("DELETE /admin/webhooks/{id}", pubsub.requireAPIKey(PermissionAdmin, func(w http.ResponseWriter, r *http.Request) {
+		if pubsub.RemoveWebhook(r.PathValue("id")) != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type webhookRequest struct {
+	header http.Header
+	body   []byte
+}
+
+// A callback URL answering the given statuses in turn, then 200, and recording the requests
+func newWebhookReceiver(t *testing.T, statuses ...int) (*httptest.Server, chan webhookRequest, *atomic.Int32) {
+	requests := make(chan webhookRequest, 16)
+	attempts := &atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if n := int(attempts.Add(1)); n <= len(statuses) {
+			w.WriteHeader(statuses[n-1])
+			return
+		}
+		requests <- webhookRequest{r.Header, body}
+	}))
+	t.Cleanup(server.Close)
+	return server, requests, attempts
+}
+
+func TestWebhookPostsSignedMessages(t *testing.T) {
+	pubsub := &PubSub{}
+	server, requests, _ := newWebhookReceiver(t)
+	webhook, err := pubsub.AddWebhook("orders", server.URL, "s3cret")
+	assert.NoError(t, err)
+	t.Cleanup(func() { pubsub.RemoveWebhook(webhook.Id) })
+	assert.Equal(t, "s3cret", webhook.Secret)
+	assert.Equal(t, []Webhook{{Id: webhook.Id, Topic: "orders", URL: server.URL, CreatedAt: webhook.CreatedAt}}, pubsub.Webhooks())
+
+	pubsub.Publish("orders", []byte(`{"order":42}`), nil)
+	select {
+	case request := <-requests:
+		var envelope struct {
+			Topic   string          `json:"topic"`
+			Id      string          `json:"id"`
+			Message json.RawMessage `json:"message"`
+		}
+		assert.NoError(t, json.Unmarshal(request.body, &envelope))
+		assert.Equal(t, "orders", envelope.Topic)
+		assert.NotEmpty(t, envelope.Id)
+		assert.JSONEq(t, `{"order":42}`, string(envelope.Message))
+		assert.Equal(t, webhook.Id, request.header.Get(webhookIdHeader))
+		assert.Equal(t, "orders", request.header.Get(webhookTopicHeader))
+		timestamp := request.header.Get(webhookTimestampHeader)
+		assert.Equal(t, signWebhook("s3cret", timestamp, request.body), request.header.Get(webhookSignatureHeader))
+	case <-time.After(2 * time.Second):
+		t.Fatal("The message was not posted")
+	}
+
+	infos := pubsub.ClientInfos()
+	assert.Len(t, infos, 1)
+	assert.Equal(t, "webhook", infos[0].Transport)
+
+	assert.NoError(t, pubsub.RemoveWebhook(webhook.Id))
+	assert.ErrorIs(t, pubsub.RemoveWebhook(webhook.Id), errUnknownWebhook)
+	assert.Empty(t, pubsub.GetSubscriptions("orders", nil))
+}
+
+func TestWebhookRetriesFailures(t *testing.T) {
+	webhookRetryDelay = 10 * time.Millisecond
+	t.Cleanup(func() { webhookRetryDelay = time.Second })
+	pubsub := &PubSub{}
+
+	server, requests, attempts := newWebhookReceiver(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	webhook, _ := pubsub.AddWebhook("orders", server.URL, "")
+	t.Cleanup(func() { pubsub.RemoveWebhook(webhook.Id) })
+	assert.Len(t, webhook.Secret, 64, "A secret should be generated")
+	pubsub.Publish("orders", []byte(`"retried"`), nil)
+	select {
+	case request := <-requests:
+		assert.Contains(t, string(request.body), `"retried"`)
+		assert.Equal(t, int32(3), attempts.Load())
+	case <-time.After(2 * time.Second):
+		t.Fatal("The message was not retried")
+	}
+
+	// Refusals are not retried
+	server, _, attempts = newWebhookReceiver(t, http.StatusBadRequest)
+	refused, _ := pubsub.AddWebhook("invoices", server.URL, "")
+	t.Cleanup(func() { pubsub.RemoveWebhook(refused.Id) })
+	pubsub.Publish("invoices", []byte(`"refused"`), nil)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(1), attempts.Load())
+}
+
+func TestWebhookRoutes(t *testing.T) {
+	keys := NewAPIKeyStore()
+	isolatePubSub(t).apiKeys = keys
+	keys.Add("admin-secret", "ops", []string{PermissionAdmin})
+	mux := http.NewServeMux()
+	setupWebhookRoutes(mux, ps)
+	receiver, _, _ := newWebhookReceiver(t)
+
+	call := func(method string, path string, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, path, strings.NewReader(body))
+		request.Header.Set(apiKeyHeader, "admin-secret")
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, request)
+		return recorder
+	}
+	assert.Equal(t, http.StatusBadRequest, call("POST", "/admin/webhooks", `{"topic": "orders", "url": "ftp://example.com"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, call("POST", "/admin/webhooks", `{"url": "`+receiver.URL+`"}`).Code)
+
+	response := call("POST", "/admin/webhooks", `{"topic": "orders", "url": "`+receiver.URL+`"}`)
+	assert.Equal(t, http.StatusCreated, response.Code)
+	var webhook Webhook
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &webhook))
+	t.Cleanup(func() { ps.RemoveWebhook(webhook.Id) })
+	assert.NotEmpty(t, webhook.Secret)
+	listed := call("GET", "/admin/webhooks", "").Body.String()
+	assert.Contains(t, listed, webhook.Id)
+	assert.NotContains(t, listed, webhook.Secret, "Secrets should only be shown on creation")
+
+	assert.Equal(t, http.StatusNoContent, call("DELETE", "/admin/webhooks/"+webhook.Id, "").Code)
+	assert.Equal(t, http.StatusNotFound, call("DELETE", "/admin/webhooks/"+webhook.Id, "").Code)
+}
@@ -0,0 +1,200 @@
+// This file serves the live widgets customers embed on their own sites. A widget
+// connects to its own endpoint with a short-lived token the host site minted for it
+// and handed over with postMessage. The token pins the origin of the widget's page and a
+// topic prefix. The endpoint only accepts it from that origin, keeps the client to the
+// prefix and applies the reduced limits of widgets.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Claim pinning the origin and topic prefix of a widget token
+const widgetClaim = "widget"
+
+var errWidgetToken = errors.New("widget tokens are only accepted on /widget")
+var errNotWidgetToken = errors.New("not a widget token")
+
+// WidgetScope is what a widget token pins: the origin of the page the widget runs on,
+// e.g. https://shop.example.com, and the prefix of the topics it may use.
+type WidgetScope struct {
+	Origin string `json:"origin"`
+	Prefix string `json:"prefix"`
+}
+
+// WidgetTokenRequest is what a host site asks for when minting a widget token.
+type WidgetTokenRequest struct {
+	Subject string `json:"subject"`
+	Origin  string `json:"origin"`
+	Prefix  string `json:"prefix"`
+	// Lifetime of the token in seconds, capped by the widget token TTL
+	TTL int `json:"ttl,omitempty"`
+}
+
+// Function to reduce an origin to its lower-cased scheme and host.
+// Parameters:
+// origin: string - The origin, e.g. "https://Shop.example.com".
+// Returns:
+// string - The origin, e.g. "https://shop.example.com".
+// bool - False if it is not an http or https origin without a path.
+func normalizeOrigin(origin string) (string, bool) {
+	u, err := url.Parse(strings.ToLower(strings.TrimSuffix(origin, "/")))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" || u.User != nil {
+		return "", false
+	}
+	return u.Scheme + "://" + u.Host, true
+}
+
+// Function to read the widget claim of a token.
+// Parameters:
+// claims: jwt.MapClaims - The verified claims.
+// Returns:
+// WidgetScope - The pinned origin and topic prefix.
+// bool - False if the token is not a widget token.
+func widgetScope(claims jwt.MapClaims) (WidgetScope, bool) {
+	claim, ok := claims[widgetClaim].(map[string]interface{})
+	if !ok {
+		return WidgetScope{}, false
+	}
+	origin, _ := claim["origin"].(string)
+	prefix, _ := claim["prefix"].(string)
+	return WidgetScope{Origin: origin, Prefix: prefix}, true
+}
+
+// Function to check whether a token is a widget token.
+// Parameters:
+// claims: jwt.MapClaims - The verified claims, or nil.
+// Returns:
+// bool - True if the token carries a widget claim.
+func isWidgetToken(claims jwt.MapClaims) bool {
+	_, ok := claims[widgetClaim]
+	return ok
+}
+
+// Function to mint a widget token, scoped to the topics of its prefix.
+// Parameters:
+// request: WidgetTokenRequest - The subject, origin, prefix and lifetime of the token.
+// now: time.Time - The time the token is issued at.
+// Returns:
+// MintedToken - The signed token.
+// error - An error if the origin or prefix is invalid or the token could not be signed.
+func (options *serverOptions) mintWidgetToken(request WidgetTokenRequest, now time.Time) (MintedToken, error) {
+	origin, ok := normalizeOrigin(request.Origin)
+	if !ok {
+		return MintedToken{}, errors.New("origin must be an http or https origin, e.g. https://shop.example.com")
+	}
+	if request.Prefix == "" || strings.ContainsAny(request.Prefix, "*?") {
+		return MintedToken{}, errors.New("prefix must be a topic prefix without wildcards")
+	}
+	ttl := int(options.widgetTokenTTL / time.Second)
+	if request.TTL > 0 {
+		ttl = min(request.TTL, ttl)
+	}
+	topics := []string{request.Prefix + "*"}
+	return options.jwtAuthenticator.Mint(TokenRequest{
+		Subject: request.Subject,
+		Topics:  TopicScope{Publish: topics, Subscribe: topics},
+		TTL:     ttl,
+		Widget:  &WidgetScope{Origin: origin, Prefix: request.Prefix},
+	}, now)
+}
+
+// Function to get the claims a widget client is served with: the claims of its token,
+// scoped to the topics of its prefix and with the limits of widgets whatever the token
+// says, so a leaked host secret cannot widen them.
+// Parameters:
+// claims: jwt.MapClaims - The verified claims of the widget token.
+// scope: WidgetScope - The widget claim of the token.
+// limits: Limits - The limits of widgets.
+// Returns:
+// jwt.MapClaims - The claims of the client.
+func widgetClaims(claims jwt.MapClaims, scope WidgetScope, limits Limits) jwt.MapClaims {
+	scoped := jwt.MapClaims{}
+	for name, value := range claims {
+		scoped[name] = value
+	}
+	topics := []interface{}{scope.Prefix + "*"}
+	scoped[topicsClaim] = map[string]interface{}{PUBLISH: topics, SUBSCRIBE: topics}
+	scoped[limitsClaim] = limits
+	return scoped
+}
+
+// Function to handle the WebSocket connections of widgets. Only widget tokens are
+// accepted, and only from the origin they pin.
+// Parameters:
+// w: http.ResponseWriter - The response writer to write HTTP responses.
+// r: *http.Request - The incoming HTTP request.
+func (ps *PubSub) widgetHandler(w http.ResponseWriter, r *http.Request) {
+	options := ps.options()
+	if ps.rejectDuringShutdown(w) {
+		return
+	}
+
+	ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer.Start(ctx, "websocket.upgrade", trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("remote_addr", r.RemoteAddr), attribute.Bool("widget", true)))
+
+	claims, err := options.jwtAuthenticator.Authenticate(r)
+	scope, ok := widgetScope(claims)
+	if err == nil && (!ok || scope.Prefix == "" || strings.ContainsAny(scope.Prefix, "*?")) {
+		err = errNotWidgetToken
+	}
+	if err != nil {
+		slog.Warn("Rejected widget upgrade", "remote_addr", r.RemoteAddr, "error", err)
+		writeUnauthorized(w, err)
+		endSpan(span, err)
+		return
+	}
+
+	// Widgets run in browsers, which always send the origin of their page
+	origin, ok := normalizeOrigin(r.Header.Get("Origin"))
+	pinned, _ := normalizeOrigin(scope.Origin)
+	if !ok || origin != pinned {
+		err := errors.New("origin not allowed")
+		slog.Warn("Rejected widget upgrade from origin", "origin", r.Header.Get("Origin"), "pinned_origin", scope.Origin, "remote_addr", r.RemoteAddr)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		endSpan(span, err)
+		return
+	}
+
+	ps.serveWebSocket(ctx, span, w, r, &options.widgetUpgrader, widgetClaims(claims, scope, options.widgetLimits))
+}
+
+// Function to register the widget endpoint and, when the server can sign tokens, the
+// endpoint host sites mint widget tokens with using an API key holding the mint_tokens
+// permission.
+// Parameters:
+// mux: *http.ServeMux - The mux to register the routes on.
+// pubsub: *PubSub - The PubSub the routes serve.
+func setupWidgetRoutes(mux *http.ServeMux, pubsub *PubSub) {
+	mux.HandleFunc("/widget", pubsub.widgetHandler)
+
+	options := pubsub.options()
+	if options.apiKeys == nil || !options.jwtAuthenticator.CanMint() {
+		return
+	}
+	mux.HandleFunc("POST /widget/tokens", pubsub.requireAPIKey(PermissionMintTokens, func(w http.ResponseWriter, r *http.Request) {
+		var request WidgetTokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Subject == "" || request.TTL < 0 {
+			http.Error(w, "expected {\"subject\": ..., \"origin\": ..., \"prefix\": ...}", http.StatusBadRequest)
+			return
+		}
+		token, err := options.mintWidgetToken(request, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusCreated, token)
+	}))
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeOrigin(t *testing.T) {
+	origin, ok := normalizeOrigin("https://Shop.Example.com/")
+	assert.True(t, ok)
+	assert.Equal(t, "https://shop.example.com", origin)
+
+	for _, invalid := range []string{"", "null", "shop.example.com", "ftp://shop.example.com", "https://shop.example.com/page"} {
+		_, ok := normalizeOrigin(invalid)
+		assert.False(t, ok, invalid)
+	}
+}
+
+func TestWidgetClaimsOverrideTheToken(t *testing.T) {
+	claims := jwt.MapClaims{
+		"sub":       "visitor",
+		topicsClaim: map[string]interface{}{"publish": []interface{}{"*"}},
+		limitsClaim: map[string]interface{}{"maxSubscriptions": 1000},
+	}
+	options := newServerOptions()
+	client := Client{Claims: widgetClaims(claims, WidgetScope{Origin: "https://shop.example.com", Prefix: "widgets.acme."}, options.widgetLimits)}
+	client.Limits = options.limitsFor(client.Claims)
+
+	assert.True(t, client.TopicAllowed(PUBLISH, "widgets.acme.votes"))
+	assert.False(t, client.TopicAllowed(PUBLISH, "widgets.other.votes"), "The client should be kept to its prefix")
+	assert.False(t, client.TopicAllowed(SUBSCRIBE, "admin"))
+	assert.Equal(t, options.widgetLimits, client.Limits, "The limits of widgets should apply whatever the token says")
+	assert.Equal(t, map[string]interface{}{"publish": []interface{}{"*"}}, claims[topicsClaim], "The token's claims should not change")
+}
+
+func TestWidgetEndpoint(t *testing.T) {
+	options := isolatePubSub(t)
+	options.jwtAuthenticator = NewHMACAuthenticator([]byte("s3cret"))
+	options.apiKeys = NewAPIKeyStore()
+	options.apiKeys.Add("minter", "acme", []string{PermissionMintTokens})
+	mux := http.NewServeMux()
+	setupWidgetRoutes(mux, ps)
+	mux.HandleFunc("/ws", ps.webSocketHandler)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	mint := func(body string) *http.Response {
+		request, _ := http.NewRequest(http.MethodPost, server.URL+"/widget/tokens", strings.NewReader(body))
+		request.Header.Set(apiKeyHeader, "minter")
+		response, err := http.DefaultClient.Do(request)
+		assert.NoError(t, err)
+		return response
+	}
+	assert.Equal(t, http.StatusBadRequest, mint(`{"subject": "visitor", "origin": "https://shop.example.com", "prefix": "*"}`).StatusCode)
+	assert.Equal(t, http.StatusBadRequest, mint(`{"subject": "visitor", "origin": "shop.example.com", "prefix": "widgets.acme."}`).StatusCode)
+
+	response := mint(`{"subject": "visitor", "origin": "https://shop.example.com", "prefix": "widgets.acme.", "ttl": 3600}`)
+	assert.Equal(t, http.StatusCreated, response.StatusCode)
+	var minted MintedToken
+	json.NewDecoder(response.Body).Decode(&minted)
+	assert.WithinDuration(t, time.Now().Add(options.widgetTokenTTL), minted.ExpiresAt, time.Second, "The lifetime should be capped")
+
+	url := "ws" + server.URL[4:]
+	dial := func(path string, origin string) (*websocket.Conn, *http.Response, error) {
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+		return websocket.DefaultDialer.Dial(url+path+"?token="+minted.Token, header)
+	}
+	_, response, err := dial("/widget", "https://evil.example.com")
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusForbidden, response.StatusCode, "Only the pinned origin may connect")
+	_, response, err = dial("/ws", "")
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusUnauthorized, response.StatusCode, "Widget tokens should only be accepted on the widget endpoint")
+
+	ws, _, err := dial("/widget", "https://shop.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	var welcome welcomeFrame
+	_, data, _ := ws.ReadMessage()
+	json.Unmarshal(data, &welcome)
+	assert.Equal(t, options.widgetLimits.MaxSubscriptions, welcome.Limits.MaxSubscriptions, "The limits of widgets should apply")
+
+	ws.WriteJSON(Message{Action: PUBLISH, Topic: "chat.secret", Message: json.RawMessage(`"hi"`)})
+	ws.ReadMessage() // Server received the message!
+	_, data, err = ws.ReadMessage()
+	assert.NoError(t, err)
+	assert.JSONEq(t, string(forbiddenMessage(PUBLISH, "chat.secret")), string(data))
+}
+
+func TestWidgetEndpointRejectsOtherTokens(t *testing.T) {
+	options := isolatePubSub(t)
+	options.jwtAuthenticator = NewHMACAuthenticator([]byte("s3cret"))
+	minted, err := options.jwtAuthenticator.Mint(TokenRequest{Subject: "backend"}, time.Now())
+	assert.NoError(t, err)
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodGet, "/widget?token="+minted.Token, nil)
+	request.Header.Set("Origin", "https://shop.example.com")
+	ps.widgetHandler(recorder, request)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), errNotWidgetToken.Error())
+}
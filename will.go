@@ -0,0 +1,109 @@
+// This file lets a client register a last will when it connects: a message the server
+// publishes on its behalf if its connection drops unexpectedly, so its peers learn it
+// went away, e.g. ?will_topic=status/alice&will_message={"online":false}. A client
+// closing its connection normally (close code 1000 or 1001, an MQTT DISCONNECT or a TCP
+// close frame) discards its will. The will is checked like a publish of the client when
+// it connects, refused with a will_refused error frame, and published only if the client
+// may still publish to its topic.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Query parameters of the upgrade request registering a will
+const (
+	willTopicParam   = "will_topic"
+	willMessageParam = "will_message"
+)
+
+var willsPublished = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "gowebsockets_wills_published_total",
+	Help: "Number of last will messages published for clients whose connection dropped.",
+})
+
+// Will is the message published on behalf of a client whose connection drops.
+type Will struct {
+	Topic   string          `json:"topic"`
+	Message json.RawMessage `json:"message"`
+}
+
+// Function to read the will a client gives in the query string of its upgrade request.
+// Parameters:
+// r: *http.Request - The upgrade request.
+// Returns:
+// *Will - The will, or nil when none is given.
+// error - An error if the will has no topic or its message is not JSON.
+func willFromRequest(r *http.Request) (*Will, error) {
+	query := r.URL.Query()
+	topic, message := query.Get(willTopicParam), query.Get(willMessageParam)
+	if topic == "" && message == "" {
+		return nil, nil
+	}
+	if topic == "" {
+		return nil, errors.New("will_message requires will_topic")
+	}
+	if !json.Valid([]byte(message)) {
+		return nil, errors.New("will_message must be JSON")
+	}
+	return &Will{Topic: topic, Message: json.RawMessage(message)}, nil
+}
+
+// Function to check whether a client disconnected on purpose, discarding its will.
+// Parameters:
+// err: error - The error that ended reading the WebSocket connection.
+// Returns:
+// bool - True if the client closed the connection normally or because it went away.
+func expectedDisconnect(err error) bool {
+	return websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway)
+}
+
+// Function to check the will of a connecting client as a publish of the client.
+// Parameters:
+// client: *Client - The client, not added yet.
+// will: *Will - The will, or nil for none.
+// Returns:
+// *Will - The will to keep, or nil if there is none or it was refused.
+func (ps *PubSub) registerWill(client *Client, will *Will) *Will {
+	if will == nil {
+		return nil
+	}
+	if will.Topic == "" || !ps.topicDeclared(will.Topic) || !ps.mayPublish(client, will.Topic) {
+		client.logger().Info("Will refused", logKeyTopic, will.Topic)
+		// Clients of other transports have no frame to be told with
+		if client.Transport == nil {
+			client.Send(errorMessage("will_refused", will.Topic))
+		}
+		return nil
+	}
+	if client.Transport == nil && !ps.conformsToSchema(client, will.Topic, will.Message) {
+		return nil
+	}
+	return will
+}
+
+// Function to publish the will of a client whose connection dropped.
+// Parameters:
+// client: *Client - The client.
+func (ps *PubSub) publishWill(client *Client) {
+	will := client.Will
+	if will == nil {
+		return
+	}
+	// Permissions may have been revoked since the will was registered
+	if !ps.mayPublish(client, will.Topic) {
+		client.logger().Info("Will not published", logKeyTopic, will.Topic)
+		return
+	}
+	client.logger().Info("Publishing will", logKeyTopic, will.Topic)
+	willsPublished.Inc()
+	ctx := withTenant(withPublisher(context.Background(), client.Principal()), client.Tenant())
+	ps.PublishContext(ctx, will.Topic, will.Message, nil)
+}
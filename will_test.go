@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// dialWithWill connects to a test server on the global ps with a will.
+func dialWithWill(t *testing.T, query string) (*websocket.Conn, welcomeFrame) {
+	server := httptest.NewServer(http.HandlerFunc(ps.webSocketHandler))
+	t.Cleanup(server.Close)
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	var welcome welcomeFrame
+	assert.NoError(t, ws.ReadJSON(&welcome))
+	return ws, welcome
+}
+
+func TestWillIsPublishedWhenConnectionDrops(t *testing.T) {
+	isolatePubSub(t)
+	watcher, peer := newTestClient(t)
+	ps.Subscribe(&watcher, "status")
+
+	ws, welcome := dialWithWill(t, `?will_topic=status&will_message={"online":false}`)
+	assert.Eventually(t, func() bool { return isConnected(welcome.ClientId) }, time.Second, 10*time.Millisecond)
+	ws.UnderlyingConn().Close()
+	assert.JSONEq(t, `{"online":false}`, string(mustRead(t, peer)))
+}
+
+func TestWillIsDiscardedOnNormalClose(t *testing.T) {
+	isolatePubSub(t)
+	watcher, peer := newTestClient(t)
+	ps.Subscribe(&watcher, "status")
+
+	ws, welcome := dialWithWill(t, `?will_topic=status&will_message={"online":false}`)
+	assert.Eventually(t, func() bool { return isConnected(welcome.ClientId) }, time.Second, 10*time.Millisecond)
+	ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	assert.Eventually(t, func() bool { return !isConnected(welcome.ClientId) }, time.Second, 10*time.Millisecond)
+	ps.Publish("status", []byte(`{"end":true}`), nil)
+	assert.JSONEq(t, `{"end":true}`, string(mustRead(t, peer)), "Clients closing normally discard their will")
+}
+
+func TestWillFromRequest(t *testing.T) {
+	will, err := willFromRequest(httptest.NewRequest("GET", "/", nil))
+	assert.NoError(t, err)
+	assert.Nil(t, will)
+	_, err = willFromRequest(httptest.NewRequest("GET", `/?will_message=1`, nil))
+	assert.Error(t, err, "A will needs a topic")
+	_, err = willFromRequest(httptest.NewRequest("GET", `/?will_topic=status&will_message=offline`, nil))
+	assert.Error(t, err, "Will messages are JSON")
+}
+
+func TestWillIsCheckedAsAPublish(t *testing.T) {
+	pubsub := &PubSub{}
+	pubsub.options().acl = &ACL{Rules: []ACLRule{{Identity: "*", Publish: []string{"public.*"}}}}
+	client, peer := newTestClient(t)
+	assert.Nil(t, pubsub.registerWill(&client, &Will{Topic: "status", Message: []byte(`{}`)}))
+	assert.JSONEq(t, string(errorMessage("will_refused", "status")), string(mustRead(t, peer)))
+	assert.NotNil(t, pubsub.registerWill(&client, &Will{Topic: "public.status", Message: []byte(`{}`)}))
+}
+
+func TestMQTTWillIsPublishedWhenConnectionDrops(t *testing.T) {
+	pubsub := &PubSub{}
+	watcher, peer := newTestClient(t)
+	pubsub.Subscribe(&watcher, "status")
+
+	server, err := ListenMQTT("127.0.0.1:0", pubsub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	go server.Serve()
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	device := &mqttSession{conn: conn, reader: bufio.NewReader(conn)}
+	connect := appendMQTTString(nil, "MQTT")
+	connect = append(connect, mqttProtocolLevel311, 0x02|0x04, 0, 60)
+	connect = appendMQTTString(connect, "sensor-1")
+	connect = appendMQTTString(connect, "status")
+	connect = appendMQTTString(connect, `{"sensor":"offline"}`)
+	assert.NoError(t, device.writePacket(mqttConnect<<4, connect))
+	_, err = device.readPacket(tcpMaxFrameSize)
+	assert.NoError(t, err)
+	conn.Close()
+	assert.JSONEq(t, `{"sensor":"offline"}`, string(mustRead(t, peer)))
+}